@@ -0,0 +1,77 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// AllocateMode controls how files are allocated when DiskIO is initialized
+type AllocateMode int
+
+const (
+	AllocateNone   AllocateMode = iota // files grow as pieces are written
+	AllocateSparse                     // files are truncated to their final length
+	AllocateFull                       // disk space is reserved for the full length of files
+)
+
+var allocateModeNames = []string{"none", "sparse", "full"}
+
+var errFallocateUnsupported = errors.New("fallocate is not supported")
+
+func (mode AllocateMode) String() string {
+	if mode < 0 || int(mode) >= len(allocateModeNames) {
+		return fmt.Sprintf("AllocateMode(%d)", int(mode))
+	}
+	return allocateModeNames[mode]
+}
+
+// ParseAllocateMode returns the AllocateMode with the given name
+func ParseAllocateMode(name string) (AllocateMode, error) {
+	for mode, modeName := range allocateModeNames {
+		if name == modeName {
+			return AllocateMode(mode), nil
+		}
+	}
+	return AllocateNone, fmt.Errorf("Unknown allocation mode %q (expected none, sparse or full)", name)
+}
+
+// allocateFile sizes a file to length according to mode. A file that's
+// already the right size is left alone, and a file that's too long is
+// truncated. If the platform can't reserve disk space for a file in
+// AllocateFull mode, it falls back to AllocateSparse.
+func allocateFile(file *os.File, length int64, mode AllocateMode) error {
+	if mode == AllocateNone {
+		return nil
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == length {
+		return nil
+	}
+	if fi.Size() > length {
+		log.Printf("DiskIO : allocateFile : WARNING: Truncating %s from %d to %d bytes", file.Name(), fi.Size(), length)
+		return file.Truncate(length)
+	}
+
+	if mode == AllocateFull {
+		err = fallocate(file, length)
+		if err == nil {
+			return nil
+		} else if errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("Not enough disk space to allocate %s (%d bytes): %w", file.Name(), length, err)
+		} else if err != errFallocateUnsupported && !errors.Is(err, syscall.EOPNOTSUPP) {
+			return err
+		}
+		log.Printf("DiskIO : allocateFile : Unable to reserve space for %s, allocating sparsely", file.Name())
+	}
+	return file.Truncate(length)
+}
@@ -0,0 +1,19 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves disk space for the first length bytes of file,
+// extending it if required
+func fallocate(file *os.File, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, length)
+}
@@ -0,0 +1,17 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// fallocate is only implemented on Linux
+func fallocate(file *os.File, length int64) error {
+	return errFallocateUnsupported
+}
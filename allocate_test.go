@@ -0,0 +1,88 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fileSize(t *testing.T, name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// Files are allocated to their full length in each mode except none
+func TestAllocateModes(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	expected := map[AllocateMode]int64{AllocateNone: 0, AllocateSparse: 100000, AllocateFull: 100000}
+	for mode, size := range expected {
+		name := filepath.Join(dir, mode.String())
+		file, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = allocateFile(file, 100000, mode)
+		file.Close()
+		if err != nil {
+			t.Errorf("Unable to allocate a file in %s mode: %s", mode, err)
+		}
+		if n := fileSize(t, name); n != size {
+			t.Errorf("Expected a file allocated in %s mode to be %d bytes, but it was %d", mode, size, n)
+		}
+	}
+}
+
+// Existing files of the right size are left alone, and files that are too
+// long are truncated
+func TestAllocateExistingFile(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	data := createTestPayload(1, 1000)
+
+	name := filepath.Join(dir, "exact")
+	ioutil.WriteFile(name, data, 0644)
+	file, _ := os.OpenFile(name, os.O_RDWR, 0644)
+	err := allocateFile(file, 1000, AllocateFull)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, _ := ioutil.ReadFile(name); !bytes.Equal(onDisk, data) {
+		t.Errorf("Expected a file of the right size to be left alone")
+	}
+
+	name = filepath.Join(dir, "long")
+	ioutil.WriteFile(name, data, 0644)
+	file, _ = os.OpenFile(name, os.O_RDWR, 0644)
+	err = allocateFile(file, 600, AllocateSparse)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, _ := ioutil.ReadFile(name); !bytes.Equal(onDisk, data[:600]) {
+		t.Errorf("Expected a file that's too long to be truncated to %d bytes, but it was %d", 600, len(onDisk))
+	}
+}
+
+func TestParseAllocateMode(t *testing.T) {
+	for _, mode := range []AllocateMode{AllocateNone, AllocateSparse, AllocateFull} {
+		parsed, err := ParseAllocateMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("Expected %q to parse as %d, but got %d, %v", mode, mode, parsed, err)
+		}
+	}
+	if _, err := ParseAllocateMode("preallocate"); err == nil {
+		t.Errorf("Expected an error parsing an unknown allocation mode")
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Interval at which availability changes are coalesced and sent to
+// subscribers
+var availabilityInterval = time.Second
+
+// Updates buffered for a subscriber. A subscriber that falls further behind
+// has its updates dropped, and is sent a new snapshot once it catches up.
+const availabilityBuffer = 16
+
+// AvailabilityCause is why the number of peers having a piece changed
+type AvailabilityCause int
+
+const (
+	AvailabilityBitfield   AvailabilityCause = iota // a peer connected and sent its bitfield
+	AvailabilityHave                                // a peer sent a have
+	AvailabilityDisconnect                          // a peer disconnected
+)
+
+var availabilityCauseNames = []string{"bitfield", "have", "disconnect"}
+
+func (cause AvailabilityCause) String() string {
+	if int(cause) < len(availabilityCauseNames) {
+		return availabilityCauseNames[cause]
+	}
+	return fmt.Sprintf("AvailabilityCause(%d)", int(cause))
+}
+
+// AvailabilityDelta is a change in the number of connected peers having a
+// piece over an interval. Cause is the last cause within the interval.
+type AvailabilityDelta struct {
+	Piece int
+	Old   int
+	New   int
+	Cause AvailabilityCause
+}
+
+// AvailabilityUpdate is sent to subscribers on each interval the
+// availability changed. The first update of a subscription has a snapshot
+// of the number of peers having each piece, which the deltas of the
+// following updates apply to. An update with Resync set replaces the
+// snapshot, after updates were dropped because the subscriber fell behind.
+type AvailabilityUpdate struct {
+	Snapshot []int // nil unless it's the first update or Resync is set
+	Resync   bool
+	Deltas   []AvailabilityDelta
+}
+
+// AvailabilitySubscription receives the changes in piece availability of a
+// running torrent until it's closed, or the torrent stops and Updates is
+// closed
+type AvailabilitySubscription struct {
+	Updates   <-chan AvailabilityUpdate
+	updates   chan AvailabilityUpdate
+	stale     bool          // updates were dropped, a snapshot is due, accessed by the Controller only
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+func newAvailabilitySubscription() *AvailabilitySubscription {
+	updates := make(chan AvailabilityUpdate, availabilityBuffer)
+	return &AvailabilitySubscription{Updates: updates, updates: updates, closed: make(chan struct{})}
+}
+
+// Close ends the subscription. Updates may still hold updates sent before.
+func (s *AvailabilitySubscription) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func (s *AvailabilitySubscription) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// send sends an update without blocking. The subscriber is marked stale if
+// its buffer is full.
+func (s *AvailabilitySubscription) send(update AvailabilityUpdate) {
+	select {
+	case s.updates <- update:
+	default:
+		log.Println("Controller : AvailabilitySubscription : Subscriber fell behind, dropping updates until it catches up")
+		s.stale = true
+	}
+}
+
+// SubscribeAvailability subscribes to the changes in the number of connected
+// peers having each piece, for drawing a heatmap of the swarm. The
+// subscription should be closed when no longer needed.
+func (t *Torrent) SubscribeAvailability() (*AvailabilitySubscription, error) {
+	s := newAvailabilitySubscription()
+	select {
+	case t.availabilitySubscriptions <- s:
+		return s, nil
+	case <-t.quit:
+		return nil, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-t.stopping:
+		return nil, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-time.After(dumpTimeout):
+		return nil, fmt.Errorf("Torrent %s isn't running", t.metaInfo.Info.Name)
+	}
+}
+
+// changeAvailability counts a peer gaining or losing a piece, and records
+// the change for subscribers
+func (cont *Controller) changeAvailability(pieceNum int, change int, cause AvailabilityCause) {
+	old := int(cont.availability[pieceNum])
+	cont.availability[pieceNum] = uint16(old + change)
+	if len(cont.subscribers) == 0 {
+		return
+	}
+	if delta, ok := cont.pendingAvailability[pieceNum]; ok {
+		delta.New, delta.Cause = old+change, cause
+		return
+	}
+	cont.pendingAvailability[pieceNum] = &AvailabilityDelta{Piece: pieceNum, Old: old, New: old + change, Cause: cause}
+}
+
+// availabilitySnapshot returns the number of connected peers having each
+// piece
+func (cont *Controller) availabilitySnapshot() []int {
+	snapshot := make([]int, len(cont.availability))
+	for pieceNum, count := range cont.availability {
+		snapshot[pieceNum] = int(count)
+	}
+	return snapshot
+}
+
+// peerAvailable counts the pieces a peer reported having, skipping those it
+// was already known to have
+func (cont *Controller) peerAvailable(peerInfo *PeerInfo, piece HavePiece) {
+	if peerInfo.availablePieces[piece.pieceNum] {
+		return
+	}
+	peerInfo.availablePieces[piece.pieceNum] = true
+	cause := AvailabilityHave
+	if piece.bitfield {
+		cause = AvailabilityBitfield
+	}
+	cont.changeAvailability(piece.pieceNum, 1, cause)
+}
+
+// peerUnavailable stops counting the pieces of a peer that disconnected
+func (cont *Controller) peerUnavailable(peerInfo *PeerInfo) {
+	for pieceNum, hasPiece := range peerInfo.availablePieces {
+		if hasPiece {
+			cont.changeAvailability(pieceNum, -1, AvailabilityDisconnect)
+		}
+	}
+}
+
+// subscribeAvailability adds a subscriber and sends it a snapshot. Pending
+// changes are flushed first, the snapshot includes them already.
+func (cont *Controller) subscribeAvailability(s *AvailabilitySubscription) {
+	cont.flushAvailability()
+	if len(cont.subscribers) == 0 {
+		cont.availabilityTicker = cont.clock.NewTicker(availabilityInterval)
+	}
+	cont.subscribers[s] = struct{}{}
+	s.send(AvailabilityUpdate{Snapshot: cont.availabilitySnapshot()})
+}
+
+// flushAvailability sends the changes coalesced since the last flush to the
+// subscribers, or a snapshot to those that fell behind and have caught up.
+// Closed subscriptions are dropped.
+func (cont *Controller) flushAvailability() {
+	deltas := make([]AvailabilityDelta, 0, len(cont.pendingAvailability))
+	for _, delta := range cont.pendingAvailability {
+		if delta.Old != delta.New {
+			deltas = append(deltas, *delta)
+		}
+	}
+	cont.pendingAvailability = make(map[int]*AvailabilityDelta)
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Piece < deltas[j].Piece })
+
+	for s := range cont.subscribers {
+		if s.isClosed() {
+			delete(cont.subscribers, s)
+			close(s.updates)
+			continue
+		}
+		if s.stale {
+			if len(s.updates) < cap(s.updates) {
+				s.stale = false
+				s.send(AvailabilityUpdate{Snapshot: cont.availabilitySnapshot(), Resync: true})
+			}
+		} else if len(deltas) > 0 {
+			s.send(AvailabilityUpdate{Deltas: deltas})
+		}
+	}
+	if len(cont.subscribers) == 0 && cont.availabilityTicker != nil {
+		cont.availabilityTicker.Stop()
+		cont.availabilityTicker = nil
+	}
+}
+
+// closeSubscribers closes the updates of every subscriber, when the
+// Controller stops
+func (cont *Controller) closeSubscribers() {
+	for s := range cont.subscribers {
+		close(s.updates)
+		delete(cont.subscribers, s)
+	}
+	if cont.availabilityTicker != nil {
+		cont.availabilityTicker.Stop()
+		cont.availabilityTicker = nil
+	}
+}
+
+// availabilityTick returns the channel of the ticker flushing availability
+// changes, nil without subscribers
+func (cont *Controller) availabilityTick() <-chan time.Time {
+	if cont.availabilityTicker == nil {
+		return nil
+	}
+	return cont.availabilityTicker.C()
+}
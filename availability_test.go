@@ -0,0 +1,179 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// applyAvailabilityUpdates applies the updates received so far to a
+// subscriber's view of the availability
+func applyAvailabilityUpdates(t *testing.T, s *AvailabilitySubscription, view []int) []int {
+	for {
+		select {
+		case update := <-s.Updates:
+			if update.Snapshot != nil {
+				view = update.Snapshot
+			} else if view == nil {
+				t.Fatal("Expected a snapshot before any deltas")
+			}
+			for _, delta := range update.Deltas {
+				if view[delta.Piece] != delta.Old {
+					t.Errorf("Expected piece %d to have %d peers before %+v, but it had %d", delta.Piece, delta.Old, delta, view[delta.Piece])
+				}
+				view[delta.Piece] = delta.New
+			}
+		default:
+			return view
+		}
+	}
+}
+
+// Deltas applied to the snapshot taken on subscribing reproduce the
+// availability after a sequence of connects, haves and disconnects, for a
+// subscriber that keeps up, one that subscribes late and one that falls
+// behind
+func TestAvailabilityDeltas(t *testing.T) {
+	const numPieces = 8
+	cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	cont.clock = newFakeClock()
+	connect := func(peerName string, pieces ...int) *PeerInfo {
+		peerInfo := addTestPeer(cont, peerName)
+		peerInfo.availablePieces = make([]bool, numPieces)
+		for _, pieceNum := range pieces {
+			cont.peerAvailable(peerInfo, HavePiece{pieceNum: pieceNum, peerName: peerName, bitfield: true})
+		}
+		return peerInfo
+	}
+	have := func(peerInfo *PeerInfo, pieceNum int) {
+		cont.peerAvailable(peerInfo, HavePiece{pieceNum: pieceNum, peerName: peerInfo.peerName})
+	}
+	disconnect := func(peerInfo *PeerInfo) {
+		cont.peerUnavailable(peerInfo)
+		delete(cont.peers, peerInfo.peerName)
+	}
+
+	first := connect("1.1.1.1:1", 0, 1, 2)
+	steady := newAvailabilitySubscription()
+	behind := newAvailabilitySubscription()
+	cont.subscribeAvailability(steady)
+	cont.subscribeAvailability(behind)
+	if cont.availabilityTicker == nil {
+		t.Fatal("Expected a ticker to flush changes to subscribers")
+	}
+	steadyView := applyAvailabilityUpdates(t, steady, nil)
+	behindView := applyAvailabilityUpdates(t, behind, nil)
+
+	second := connect("2.2.2.2:2", 1, 2, 3, 4)
+	have(first, 5)
+	have(first, 5) // repeated, not counted twice
+	cont.flushAvailability()
+	update := <-steady.Updates
+	expected := []AvailabilityDelta{
+		{Piece: 1, Old: 1, New: 2, Cause: AvailabilityBitfield},
+		{Piece: 2, Old: 1, New: 2, Cause: AvailabilityBitfield},
+		{Piece: 3, Old: 0, New: 1, Cause: AvailabilityBitfield},
+		{Piece: 4, Old: 0, New: 1, Cause: AvailabilityBitfield},
+		{Piece: 5, Old: 0, New: 1, Cause: AvailabilityHave},
+	}
+	if !reflect.DeepEqual(update.Deltas, expected) {
+		t.Errorf("Expected deltas %+v, but got %+v", expected, update.Deltas)
+	}
+	for _, delta := range update.Deltas {
+		steadyView[delta.Piece] = delta.New
+	}
+
+	// A piece gained and lost within a tick isn't reported
+	third := connect("3.3.3.3:3", 6)
+	have(second, 7)
+	disconnect(third)
+	// Subscribing flushes the pending changes to the other subscribers
+	late := newAvailabilitySubscription()
+	cont.subscribeAvailability(late)
+	lateView := applyAvailabilityUpdates(t, late, nil)
+	update = <-steady.Updates
+	expected = []AvailabilityDelta{{Piece: 7, Old: 0, New: 1, Cause: AvailabilityHave}}
+	if !reflect.DeepEqual(update.Deltas, expected) {
+		t.Errorf("Expected deltas %+v, but got %+v", expected, update.Deltas)
+	}
+	for _, delta := range update.Deltas {
+		steadyView[delta.Piece] = delta.New
+	}
+
+	// The subscriber that doesn't read falls behind and is resynced
+	for i := 0; i < availabilityBuffer+4; i++ {
+		if i%2 == 0 {
+			have(second, 0)
+		} else {
+			disconnect(second)
+			second = connect("2.2.2.2:2", 1, 2, 3, 4, 7)
+		}
+		cont.flushAvailability()
+		steadyView = applyAvailabilityUpdates(t, steady, steadyView)
+		lateView = applyAvailabilityUpdates(t, late, lateView)
+	}
+	if !behind.stale {
+		t.Fatal("Expected the subscriber that didn't read to fall behind")
+	}
+	disconnect(first)
+	behindView = applyAvailabilityUpdates(t, behind, behindView)
+	cont.flushAvailability()
+	steadyView = applyAvailabilityUpdates(t, steady, steadyView)
+	lateView = applyAvailabilityUpdates(t, late, lateView)
+	behindView = applyAvailabilityUpdates(t, behind, nil)
+
+	final := make([]int, numPieces)
+	for _, peerInfo := range cont.peers {
+		for pieceNum, hasPiece := range peerInfo.availablePieces {
+			if hasPiece {
+				final[pieceNum]++
+			}
+		}
+	}
+	if !reflect.DeepEqual(cont.availabilitySnapshot(), final) {
+		t.Errorf("Expected the availability to be %v, but it was %v", final, cont.availability)
+	}
+	for name, view := range map[string][]int{"steady": steadyView, "late": lateView, "resynced": behindView} {
+		if !reflect.DeepEqual(view, final) {
+			t.Errorf("Expected the %s subscriber to see %v, but it saw %v", name, final, view)
+		}
+	}
+
+	// Closed subscriptions are dropped, along with the ticker
+	for _, s := range []*AvailabilitySubscription{steady, behind, late} {
+		s.Close()
+	}
+	cont.flushAvailability()
+	if len(cont.subscribers) != 0 || cont.availabilityTicker != nil {
+		t.Errorf("Expected closed subscriptions and the ticker to be dropped")
+	}
+	if _, ok := <-steady.Updates; ok {
+		t.Errorf("Expected the updates of a closed subscription to be closed")
+	}
+}
+
+// A subscription through a running Controller starts with a snapshot and
+// ends when the Controller stops
+func TestAvailabilitySubscription(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+	s := newAvailabilitySubscription()
+	cont.subscribe <- s
+	select {
+	case update := <-s.Updates:
+		if len(update.Snapshot) != len(cont.finishedPieces) {
+			t.Errorf("Expected a snapshot of %d pieces, but got %+v", len(cont.finishedPieces), update)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the snapshot")
+	}
+	cont.Stop()
+	if _, ok := <-s.Updates; ok {
+		t.Errorf("Expected the updates to be closed when the Controller stops")
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// BenchmarkOptions control a BenchmarkPeer run
+type BenchmarkOptions struct {
+	Duration      time.Duration // stop after this long, 0 runs until every piece the peer has is downloaded
+	PipelineDepth int           // block requests kept outstanding, defaultRequestDepth if 0
+	SkipVerify    bool          // don't hash check the pieces received
+	Storage       io.Writer     // where received pieces are written, discarded if nil
+}
+
+// BenchmarkReport is the outcome of downloading from a single peer with
+// BenchmarkPeer. The time spent waiting for the network, hashing and
+// writing adds up to roughly Elapsed, whichever dominates is the bottleneck.
+type BenchmarkReport struct {
+	Peer            string
+	PiecesAvailable int           // pieces the peer advertised
+	Pieces          int           // pieces downloaded
+	Bytes           int64         // bytes of blocks received
+	HashFailures    int           // pieces that failed their hash check
+	Elapsed         time.Duration // from the first request to the end of the run
+	Throughput      float64       // bytes per second over Elapsed
+	RTT             time.Duration // shortest time between a request and its block
+	PipelineDepth   int           // block requests kept outstanding
+	NetworkWait     time.Duration // time spent waiting for messages from the peer
+	HashTime        time.Duration
+	WriteTime       time.Duration
+	Completed       bool   // every piece the peer advertised was downloaded
+	Error           string `json:",omitempty"` // why the run ended early, if it did
+}
+
+// benchmarkBlock identifies a block requested during a benchmark
+type benchmarkBlock struct {
+	piece int
+	begin int
+}
+
+// benchmarkPiece is a piece being assembled during a benchmark
+type benchmarkPiece struct {
+	data     []byte
+	received int // bytes received
+}
+
+// BenchmarkPeer downloads from the peer at address, such as "10.0.0.1:6881",
+// to measure how fast it can be done and where the time goes. The pieces are
+// written to opts.Storage in the order they complete rather than to the files
+// of the torrent, and the torrent's stats and bitfield aren't touched, so it
+// may be run whether or not the torrent is running. Only peers are supported,
+// not webseeds.
+func (t *Torrent) BenchmarkPeer(ctx context.Context, address string, opts BenchmarkOptions) (*BenchmarkReport, error) {
+	log.Printf("Torrent : BenchmarkPeer : Started against %s", address)
+	defer log.Println("Torrent : BenchmarkPeer : Completed")
+
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return nil, errors.New("Webseeds aren't supported")
+	}
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	if opts.PipelineDepth <= 0 {
+		opts.PipelineDepth = defaultRequestDepth
+	}
+	if opts.Storage == nil {
+		opts.Storage = io.Discard
+	}
+
+	conn, stop, err := t.dialPeer(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	b := &benchmark{
+		t:         t,
+		conn:      conn,
+		opts:      opts,
+		report:    &BenchmarkReport{Peer: address, PipelineDepth: opts.PipelineDepth},
+		numPieces: t.pieceHashes().Len(),
+		length:    t.TotalLength(),
+		pieces:    make(map[int]*benchmarkPiece),
+		requests:  make(map[benchmarkBlock]time.Time),
+		choked:    true,
+	}
+	b.have = make([]bool, b.numPieces)
+	err = b.run()
+	if b.report.Elapsed > 0 {
+		b.report.Throughput = float64(b.report.Bytes) / b.report.Elapsed.Seconds()
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			b.report.Error = err.Error()
+		} else if opts.Duration == 0 || ctx.Err() != context.DeadlineExceeded {
+			b.report.Error = ctx.Err().Error()
+		}
+	}
+	return b.report, nil
+}
+
+// benchmark is the state of a BenchmarkPeer run
+type benchmark struct {
+	t         *Torrent
+	conn      io.ReadWriter
+	opts      BenchmarkOptions
+	report    *BenchmarkReport
+	numPieces int
+	length    int                          // total length of the torrent
+	have      []bool                       // pieces the peer advertised
+	queue     []benchmarkBlock             // blocks to request, in order
+	pieces    map[int]*benchmarkPiece      // pieces being assembled
+	requests  map[benchmarkBlock]time.Time // outstanding requests and when they were sent
+	choked    bool
+	started   time.Time // when the first request was sent
+}
+
+// pieceLength returns the length of a piece, the last piece may be shorter
+func (b *benchmark) pieceLength(pieceNum int) int {
+	length := b.length - pieceNum*b.t.metaInfo.Info.PieceLength
+	if length > b.t.metaInfo.Info.PieceLength {
+		return b.t.metaInfo.Info.PieceLength
+	}
+	return length
+}
+
+// addPiece queues the blocks of a piece the peer has
+func (b *benchmark) addPiece(pieceNum int) {
+	if pieceNum < 0 || pieceNum >= b.numPieces || b.have[pieceNum] {
+		return
+	}
+	b.have[pieceNum] = true
+	b.report.PiecesAvailable++
+	for begin := 0; begin < b.pieceLength(pieceNum); begin += downloadBlockSize {
+		b.queue = append(b.queue, benchmarkBlock{piece: pieceNum, begin: begin})
+	}
+}
+
+// blockLength returns the length of a block, the last block of a piece may
+// be shorter
+func (b *benchmark) blockLength(block benchmarkBlock) int {
+	length := b.pieceLength(block.piece) - block.begin
+	if length > downloadBlockSize {
+		return downloadBlockSize
+	}
+	return length
+}
+
+// writeMessage sends a message to the peer
+func (b *benchmark) writeMessage(id int, payload []byte) error {
+	message := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(message, uint32(1+len(payload)))
+	message[4] = byte(id)
+	copy(message[5:], payload)
+	_, err := b.conn.Write(message)
+	return err
+}
+
+// fillPipeline sends requests until opts.PipelineDepth are outstanding
+func (b *benchmark) fillPipeline() error {
+	for !b.choked && len(b.requests) < b.opts.PipelineDepth && len(b.queue) > 0 {
+		block := b.queue[0]
+		b.queue = b.queue[1:]
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:], uint32(block.piece))
+		binary.BigEndian.PutUint32(payload[4:], uint32(block.begin))
+		binary.BigEndian.PutUint32(payload[8:], uint32(b.blockLength(block)))
+		err := b.writeMessage(MsgRequest, payload)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if b.started.IsZero() {
+			b.started = now
+		}
+		b.requests[block] = now
+	}
+	return nil
+}
+
+// done reports whether every advertised piece has been downloaded
+func (b *benchmark) done() bool {
+	return b.report.PiecesAvailable > 0 && len(b.queue) == 0 && len(b.requests) == 0 && len(b.pieces) == 0
+}
+
+// run downloads until every advertised piece has been downloaded, or the
+// connection fails or is unblocked by the context
+func (b *benchmark) run() error {
+	defer func() {
+		if !b.started.IsZero() {
+			b.report.Elapsed = time.Since(b.started)
+		}
+	}()
+	err := b.writeMessage(MsgInterested, nil)
+	if err != nil {
+		return err
+	}
+	// Blocks and the bitfield are the longest messages expected
+	maxLength := uint32(9 + downloadBlockSize)
+	if bitfieldLength := uint32(1 + (b.numPieces+7)/8); bitfieldLength > maxLength {
+		maxLength = bitfieldLength
+	}
+	for !b.done() {
+		waitStart := time.Now()
+		length := make([]byte, 4)
+		_, err := io.ReadFull(b.conn, length)
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(length) > maxLength {
+			return fmt.Errorf("Message of %d bytes is too long", binary.BigEndian.Uint32(length))
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(length))
+		_, err = io.ReadFull(b.conn, payload)
+		if err != nil {
+			return err
+		}
+		if !b.started.IsZero() {
+			b.report.NetworkWait += time.Since(waitStart)
+		}
+		if len(payload) == 0 {
+			// keepalive
+			continue
+		}
+		err = b.handleMessage(int(payload[0]), payload[1:])
+		if err != nil {
+			return err
+		}
+		err = b.fillPipeline()
+		if err != nil {
+			return err
+		}
+	}
+	b.report.Completed = true
+	return nil
+}
+
+// handleMessage acts on a message from the peer
+func (b *benchmark) handleMessage(id int, payload []byte) error {
+	switch id {
+	case MsgChoke:
+		// The peer drops our outstanding requests, ask again once we're
+		// unchoked
+		b.choked = true
+		for block := range b.requests {
+			b.queue = append(b.queue, block)
+		}
+		b.requests = make(map[benchmarkBlock]time.Time)
+	case MsgUnchoke:
+		b.choked = false
+	case MsgHave:
+		if len(payload) != 4 {
+			return fmt.Errorf("Have of %d bytes", len(payload))
+		}
+		b.addPiece(int(binary.BigEndian.Uint32(payload)))
+	case MsgBitfield:
+		if len(payload) != (b.numPieces+7)/8 {
+			return fmt.Errorf("Bitfield of %d bytes for %d pieces", len(payload), b.numPieces)
+		}
+		for pieceNum, ok := range convertByteSliceToBoolSlice(b.numPieces, payload) {
+			if ok {
+				b.addPiece(pieceNum)
+			}
+		}
+	case MsgBlock:
+		if len(payload) < 8 {
+			return fmt.Errorf("Block of %d bytes", len(payload))
+		}
+		block := benchmarkBlock{piece: int(binary.BigEndian.Uint32(payload[0:4])), begin: int(binary.BigEndian.Uint32(payload[4:8]))}
+		data := payload[8:]
+		sentAt, ok := b.requests[block]
+		if !ok || len(data) != b.blockLength(block) {
+			// Not requested, or cancelled by a choke
+			return nil
+		}
+		delete(b.requests, block)
+		if rtt := time.Since(sentAt); b.report.RTT == 0 || rtt < b.report.RTT {
+			b.report.RTT = rtt
+		}
+		b.report.Bytes += int64(len(data))
+		return b.receiveBlock(block, data)
+	}
+	return nil
+}
+
+// receiveBlock adds a block to its piece, and hash checks and writes the
+// piece once it's complete
+func (b *benchmark) receiveBlock(block benchmarkBlock, data []byte) error {
+	piece, ok := b.pieces[block.piece]
+	if !ok {
+		piece = &benchmarkPiece{data: make([]byte, b.pieceLength(block.piece))}
+		b.pieces[block.piece] = piece
+	}
+	copy(piece.data[block.begin:], data)
+	piece.received += len(data)
+	if piece.received < len(piece.data) {
+		return nil
+	}
+	delete(b.pieces, block.piece)
+
+	if !b.opts.SkipVerify {
+		start := time.Now()
+		good := checkHash(piece.data, b.t.pieceHashes().At(block.piece))
+		b.report.HashTime += time.Since(start)
+		if !good {
+			b.report.HashFailures++
+			return nil
+		}
+	}
+	start := time.Now()
+	_, err := b.opts.Storage.Write(piece.data)
+	b.report.WriteTime += time.Since(start)
+	if err != nil {
+		return err
+	}
+	b.report.Pieces++
+	return nil
+}
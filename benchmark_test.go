@@ -0,0 +1,116 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// createBenchmarkTorrent returns a stopped torrent of three and a half
+// pieces of two blocks each, downloading into dir
+func createBenchmarkTorrent(dir string) (*Torrent, []byte) {
+	pieceLength := 2 * downloadBlockSize
+	data := createTestPayload(4, pieceLength)
+	data = data[:len(data)-pieceLength/2]
+	t := &Torrent{metaInfo: createTestMetaInfo(data, pieceLength), infoHash: bytes.Repeat([]byte{0xab}, 20), downloadDir: dir}
+	return t, data
+}
+
+// A benchmark against a seed downloads every piece into the storage given,
+// reports where the time went and leaves the files of the torrent alone
+func TestBenchmarkPeer(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	torrent, data := createBenchmarkTorrent(dir)
+	listener, _ := startServingPeer(t, torrent.infoHash, 4, func(pieceNum, begin, length int) []byte {
+		offset := pieceNum*torrent.metaInfo.Info.PieceLength + begin
+		return data[offset : offset+length]
+	})
+	defer listener.Close()
+
+	var storage bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := torrent.BenchmarkPeer(ctx, listener.Addr().String(), BenchmarkOptions{PipelineDepth: 3, Storage: &storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Completed || report.Error != "" {
+		t.Fatalf("Expected the benchmark to complete, but got %+v", report)
+	}
+	if report.PiecesAvailable != 4 || report.Pieces != 4 || report.HashFailures != 0 {
+		t.Errorf("Expected 4 good pieces, but got %+v", report)
+	}
+	if report.Bytes != int64(len(data)) || storage.Len() != len(data) {
+		t.Errorf("Expected %d bytes received and stored, but got %d and %d", len(data), report.Bytes, storage.Len())
+	}
+	if report.PipelineDepth != 3 {
+		t.Errorf("Expected a pipeline depth of %d, but got %d", 3, report.PipelineDepth)
+	}
+	if report.Elapsed <= 0 || report.Throughput <= 0 || report.RTT <= 0 || report.NetworkWait <= 0 || report.HashTime <= 0 || report.WriteTime <= 0 {
+		t.Errorf("Expected every measurement to be populated, but got %+v", report)
+	}
+	if report.RTT > report.Elapsed || report.NetworkWait > report.Elapsed {
+		t.Errorf("Expected the measurements to be within the elapsed time, but got %+v", report)
+	}
+
+	// Nothing was written to the download directory
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected the download directory to be empty, but it has %d files", len(files))
+	}
+	if torrent.diskIO != nil {
+		t.Errorf("Expected the benchmark not to create DiskIO")
+	}
+}
+
+// Bad pieces are counted as hash failures unless verification is skipped,
+// and webseeds are refused
+func TestBenchmarkPeerVerification(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	torrent, data := createBenchmarkTorrent(dir)
+	listener, _ := startBadPeer(t, torrent.infoHash, 4)
+	defer listener.Close()
+
+	tests := []struct {
+		skipVerify   bool
+		pieces       int
+		hashFailures int
+	}{
+		{false, 0, 4},
+		{true, 4, 0},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		report, err := torrent.BenchmarkPeer(ctx, listener.Addr().String(), BenchmarkOptions{SkipVerify: test.skipVerify})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Completed || report.Pieces != test.pieces || report.HashFailures != test.hashFailures || report.Bytes != int64(len(data)) {
+			t.Errorf("Expected %d pieces and %d hash failures with SkipVerify %v, but got %+v", test.pieces, test.hashFailures, test.skipVerify, report)
+		}
+		if test.skipVerify && report.HashTime != 0 {
+			t.Errorf("Expected no time spent hashing, but got %s", report.HashTime)
+		}
+		if report.PipelineDepth != defaultRequestDepth {
+			t.Errorf("Expected the default pipeline depth of %d, but got %d", defaultRequestDepth, report.PipelineDepth)
+		}
+	}
+
+	_, err := torrent.BenchmarkPeer(context.Background(), "http://127.0.0.1/seed", BenchmarkOptions{})
+	if err == nil {
+		t.Errorf("Expected benchmarking a webseed to fail")
+	}
+}
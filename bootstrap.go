@@ -0,0 +1,293 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxBootstrapHandshakes = 8               // peers handshaked with during a bootstrap
+	bootstrapBitfieldWait  = 5 * time.Second // time a peer has to send its bitfield after the handshake
+	trackerSource          = "tracker"
+)
+
+// Discovery sources that aren't implemented, and are reported as such
+var unsupportedSources = []string{"dht", "lsd"}
+
+// BootstrapReport describes the swarm found by Bootstrap, for deciding
+// whether a torrent is worth starting
+type BootstrapReport struct {
+	Trackers            []BootstrapTracker
+	CandidatePeers      map[string]int // distinct peers found, by discovery source
+	UnsupportedSources  []string       // discovery sources that weren't tried
+	HandshakesAttempted int
+	HandshakesCompleted int
+	Seeds               int     // handshaked peers that advertised every piece
+	Availability        float64 // share of the pieces held by at least one handshaked peer
+	Copies              float64 // average number of handshaked peers holding each piece
+	TimedOut            bool    // the timeout expired before every step finished
+	Elapsed             time.Duration
+}
+
+// BootstrapTracker is the result of announcing to a tracker during a
+// bootstrap
+type BootstrapTracker struct {
+	URL       string
+	Reachable bool
+	Seeders   int
+	Leechers  int
+	Peers     int    // peers returned by the tracker
+	Error     string `json:",omitempty"`
+}
+
+// Viable reports whether every piece of the torrent was seen on a peer
+// we've handshaked with
+func (report *BootstrapReport) Viable() bool {
+	return report.Availability >= 1
+}
+
+// Bootstrap announces to the trackers of the torrent and handshakes with a
+// few of the peers found, to report on the health of the swarm within
+// timeout. It doesn't allocate files or start any component, so the torrent
+// stays stopped until Run is called.
+func (t *Torrent) Bootstrap(ctx context.Context, timeout time.Duration) *BootstrapReport {
+	log.Println("Torrent : Bootstrap : Started")
+	defer log.Println("Torrent : Bootstrap : Completed")
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	report := &BootstrapReport{CandidatePeers: make(map[string]int), UnsupportedSources: unsupportedSources}
+	peers := t.bootstrapTrackers(ctx, report)
+	bitfields := t.bootstrapHandshakes(ctx, peers, report)
+
+	numPieces := t.pieceHashes().Len()
+	if numPieces > 0 {
+		available, copies := 0, 0
+		counts := make([]int, numPieces)
+		for _, bitfield := range bitfields {
+			have := 0
+			for i, ok := range bitfield {
+				if ok {
+					counts[i]++
+					have++
+				}
+			}
+			if have == numPieces {
+				report.Seeds++
+			}
+			copies += have
+		}
+		for _, count := range counts {
+			if count > 0 {
+				available++
+			}
+		}
+		report.Availability = float64(available) / float64(numPieces)
+		report.Copies = float64(copies) / float64(numPieces)
+	}
+	report.TimedOut = ctx.Err() != nil
+	report.Elapsed = time.Since(start)
+	return report
+}
+
+// bootstrapTrackers announces to every tracker at once and returns the
+// distinct peers they returned. Trackers that haven't responded when the
+// context is done are reported as unreachable.
+func (t *Torrent) bootstrapTrackers(ctx context.Context, report *BootstrapReport) []PeerTuple {
+	var urls []string
+	for _, tier := range announceTiers(t.metaInfo) {
+		urls = append(urls, tier...)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+
+	type result struct {
+		index    int
+		response TrackerResponse
+		err      error
+	}
+	results := make(chan result, len(urls))
+	report.Trackers = make([]BootstrapTracker, len(urls))
+	for i, announceURL := range urls {
+		report.Trackers[i] = BootstrapTracker{URL: announceURL, Error: "No response"}
+		tr, err := newTracker(initKey(), t.port, t.infoHash, announceURL, quit)
+		if err != nil {
+			results <- result{index: i, err: err}
+			continue
+		}
+		go func(i int, tr Tracker) {
+			defer tr.Close()
+			response, err := tr.Announce(Interval)
+			results <- result{index: i, response: response, err: err}
+		}(i, tr)
+	}
+
+	seen := make(map[string]bool)
+	var peers []PeerTuple
+	for received := 0; received < len(urls); received++ {
+		var r result
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			return peers
+		}
+		status := &report.Trackers[r.index]
+		if r.err != nil {
+			status.Error = r.err.Error()
+			continue
+		}
+		status.Reachable, status.Error = true, ""
+		status.Seeders, status.Leechers, status.Peers = r.response.Complete, r.response.Incomplete, len(r.response.Peers)
+		for _, peer := range r.response.Peers {
+			peerName := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
+			if !seen[peerName] {
+				seen[peerName] = true
+				peers = append(peers, peer)
+				report.CandidatePeers[trackerSource]++
+			}
+		}
+	}
+	return peers
+}
+
+// bootstrapHandshakes handshakes with up to maxBootstrapHandshakes peers at
+// once and returns the bitfield each of them advertised
+func (t *Torrent) bootstrapHandshakes(ctx context.Context, peers []PeerTuple, report *BootstrapReport) [][]bool {
+	if len(peers) > maxBootstrapHandshakes {
+		peers = peers[:maxBootstrapHandshakes]
+	}
+	report.HandshakesAttempted = len(peers)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var bitfields [][]bool
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer PeerTuple) {
+			defer wg.Done()
+			bitfield, err := t.probePeer(ctx, peer)
+			if err != nil {
+				log.Printf("Torrent : Bootstrap : Handshake with %s:%d failed: %s", peer.IP, peer.Port, err)
+				return
+			}
+			mutex.Lock()
+			report.HandshakesCompleted++
+			if bitfield != nil {
+				bitfields = append(bitfields, bitfield)
+			}
+			mutex.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return bitfields
+}
+
+// probePeer connects to a peer, exchanges handshakes and waits for it to
+// advertise the pieces it has. The bitfield is nil if the peer didn't send
+// one, or any haves, in time.
+func (t *Torrent) probePeer(ctx context.Context, peer PeerTuple) ([]bool, error) {
+	conn, stop, err := t.dialPeer(ctx, fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	deadline := time.Now().Add(bootstrapBitfieldWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	// Only bitfield and have messages are expected before we've sent
+	// anything but the handshake
+	numPieces := t.pieceHashes().Len()
+	maxLength := uint32(1 + (numPieces+7)/8)
+	if maxLength < 5 {
+		maxLength = 5
+	}
+	var bitfield []bool
+	for {
+		length := make([]byte, 4)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			// The handshake completed, whatever was advertised in time
+			// counts
+			return bitfield, nil
+		}
+		if binary.BigEndian.Uint32(length) > maxLength {
+			return bitfield, nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(length))
+		_, err = io.ReadFull(conn, payload)
+		if err != nil {
+			return bitfield, nil
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		switch int(payload[0]) {
+		case MsgBitfield:
+			// The bitfield is the first message, if sent at all
+			if len(payload)-1 != (numPieces+7)/8 {
+				return nil, fmt.Errorf("Bitfield of %d bytes for %d pieces", len(payload)-1, numPieces)
+			}
+			return convertByteSliceToBoolSlice(numPieces, payload[1:]), nil
+		case MsgHave:
+			if len(payload) < 5 {
+				continue
+			}
+			if bitfield == nil {
+				bitfield = make([]bool, numPieces)
+			}
+			pieceNum := int(binary.BigEndian.Uint32(payload[1:5]))
+			if pieceNum < numPieces {
+				bitfield[pieceNum] = true
+			}
+		}
+	}
+}
+
+// dialPeer connects to the peer at address and exchanges handshakes. Reads
+// and writes on the connection are unblocked once the context is done, until
+// stop is called.
+func (t *Torrent) dialPeer(ctx context.Context, address string) (net.Conn, func() bool, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp4", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	fail := func(err error) (net.Conn, func() bool, error) {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+
+	err = writeHandshake(conn, t.infoHash, localReserved(false))
+	if err != nil {
+		return fail(err)
+	}
+	var handshake Handshake
+	err = binary.Read(conn, binary.BigEndian, &handshake)
+	if err != nil {
+		return fail(err)
+	}
+	err = verifyHandshake(&handshake, t.infoHash)
+	if err != nil {
+		return fail(err)
+	}
+	return conn, stop, nil
+}
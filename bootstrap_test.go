@@ -0,0 +1,124 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startTestSeed accepts connections on loopback, exchanges handshakes and
+// advertises bitfield
+func startTestSeed(t *testing.T, infoHash []byte, bitfield []byte) *net.TCPListener {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			var handshake Handshake
+			err = binary.Read(conn, binary.BigEndian, &handshake)
+			if err == nil {
+				reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+				copy(reply.InfoHash[:], infoHash)
+				copy(reply.PeerID[:], fmt.Sprintf("-XX0001-%012d", listener.Addr().(*net.TCPAddr).Port))
+				binary.Write(conn, binary.BigEndian, &reply)
+				message := make([]byte, 5, 5+len(bitfield))
+				binary.BigEndian.PutUint32(message, uint32(1+len(bitfield)))
+				message[4] = byte(MsgBitfield)
+				conn.Write(append(message, bitfield...))
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+// startTestTracker returns peers in a compact announce response
+func startTestTracker(seeders, leechers int, peers ...*net.TCPListener) *httptest.Server {
+	var compact []byte
+	for _, peer := range peers {
+		addr := peer.Addr().(*net.TCPAddr)
+		compact = append(compact, addr.IP.To4()...)
+		compact = append(compact, byte(addr.Port>>8), byte(addr.Port))
+	}
+	response := fmt.Sprintf("d8:completei%de10:incompletei%de8:intervali1800e5:peers%d:%se", seeders, leechers, len(compact), compact)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+}
+
+// createBootstrapTorrent creates a torrent of 12 pieces with a tracker in
+// each tier
+func createBootstrapTorrent(trackers ...string) *Torrent {
+	t := &Torrent{infoHash: bytes.Repeat([]byte{0xab}, 20)}
+	t.metaInfo.Info.Pieces = string(make([]byte, 12*20))
+	for _, tracker := range trackers {
+		t.metaInfo.AnnounceList = append(t.metaInfo.AnnounceList, []string{tracker})
+	}
+	return t
+}
+
+// A swarm with a seed and a leecher is reported as fully available
+func TestBootstrapHealthy(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	seed := startTestSeed(t, infoHash, []byte{0xff, 0xf0})
+	defer seed.Close()
+	leecher := startTestSeed(t, infoHash, []byte{0xfc, 0x00})
+	defer leecher.Close()
+	tracker := startTestTracker(1, 1, seed, leecher)
+	defer tracker.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	defer dead.Close()
+
+	torrent := createBootstrapTorrent(tracker.URL+"/announce", dead.URL+"/announce")
+	report := torrent.Bootstrap(context.Background(), 10*time.Second)
+
+	if len(report.Trackers) != 2 {
+		t.Fatalf("Expected %d trackers in the report, but got %+v", 2, report.Trackers)
+	}
+	if tr := report.Trackers[0]; !tr.Reachable || tr.Seeders != 1 || tr.Leechers != 1 || tr.Peers != 2 {
+		t.Errorf("Unexpected report for the working tracker: %+v", tr)
+	}
+	if tr := report.Trackers[1]; tr.Reachable || tr.Error == "" {
+		t.Errorf("Expected the dead tracker to be unreachable, but got %+v", tr)
+	}
+	if report.CandidatePeers[trackerSource] != 2 || report.HandshakesAttempted != 2 || report.HandshakesCompleted != 2 {
+		t.Errorf("Expected %d peers found and handshaked, but got %+v", 2, report)
+	}
+	if report.Seeds != 1 || report.Availability != 1 || report.Copies != 1.5 || !report.Viable() || report.TimedOut {
+		t.Errorf("Expected a viable swarm with %d seed, but got %+v", 1, report)
+	}
+}
+
+// A swarm without working trackers is reported as unavailable
+func TestBootstrapDead(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	defer dead.Close()
+
+	torrent := createBootstrapTorrent(dead.URL + "/announce")
+	report := torrent.Bootstrap(context.Background(), 10*time.Second)
+
+	if len(report.Trackers) != 1 || report.Trackers[0].Reachable {
+		t.Errorf("Expected the tracker to be unreachable, but got %+v", report.Trackers)
+	}
+	if report.CandidatePeers[trackerSource] != 0 || report.HandshakesAttempted != 0 || report.HandshakesCompleted != 0 {
+		t.Errorf("Expected no peers, but got %+v", report)
+	}
+	if report.Seeds != 0 || report.Availability != 0 || report.Viable() {
+		t.Errorf("Expected a swarm that isn't viable, but got %+v", report)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Choke overrides, set per peer address with Torrent.SetChokeOverride
+const (
+	ChokeAuto    = iota // unchoke the peer while it's interested
+	PinUnchoked         // keep the peer unchoked, whether or not it's interested
+	NeverUnchoke        // keep the peer choked, whether or not it's interested
+)
+
+var chokeOverrideNames = []string{"auto", "pin-unchoked", "never-unchoke"}
+
+// chokeOverride is the override of a peer address
+type chokeOverride struct {
+	mode   int
+	sticky bool // kept when the peer disconnects, for the rest of the session
+}
+
+// ChokeOverrides holds the choke overrides of peer addresses for the
+// session. It's shared between the Torrent, which sets them, the
+// PeerManager, which clears them when peers disconnect, and the peers, which
+// look theirs up when deciding whether to unchoke.
+type ChokeOverrides struct {
+	mutex   sync.Mutex
+	peers   map[string]chokeOverride // by peer address
+	banned  map[string]bool          // IPs whose overrides are ignored
+	changed chan struct{}            // signals the PeerManager that an override changed
+}
+
+func NewChokeOverrides() *ChokeOverrides {
+	return &ChokeOverrides{
+		peers:   make(map[string]chokeOverride),
+		banned:  make(map[string]bool),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// canonicalPeerName returns address, such as "10.0.0.1:6881", in the form
+// peers are named by
+func canonicalPeerName(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid peer address %q, expected an IP address and port", address)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("Invalid port in peer address %q", address)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// set changes the override of a peer address. ChokeAuto without sticky
+// removes the override.
+func (co *ChokeOverrides) set(peerName string, mode int, sticky bool) {
+	co.mutex.Lock()
+	if mode == ChokeAuto && !sticky {
+		delete(co.peers, peerName)
+	} else {
+		co.peers[peerName] = chokeOverride{mode: mode, sticky: sticky}
+	}
+	co.mutex.Unlock()
+	select {
+	case co.changed <- struct{}{}:
+	default:
+		// A change is already waiting to be applied
+	}
+}
+
+// get returns the override of a peer, ChokeAuto if it has none or its IP is
+// banned
+func (co *ChokeOverrides) get(peerName string) chokeOverride {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	host, _, err := net.SplitHostPort(peerName)
+	if err == nil && co.banned[host] {
+		return chokeOverride{}
+	}
+	return co.peers[peerName]
+}
+
+// ban ignores the overrides of every peer at an IP from now on
+func (co *ChokeOverrides) ban(ip net.IP) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	co.banned[ip.String()] = true
+}
+
+// disconnected clears the override of a peer that disconnected, unless it's
+// sticky
+func (co *ChokeOverrides) disconnected(peerName string) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	if override, ok := co.peers[peerName]; ok && !override.sticky {
+		log.Printf("ChokeOverrides : disconnected : Clearing the %s override of %s", chokeOverrideNames[override.mode], peerName)
+		delete(co.peers, peerName)
+	}
+}
+
+// shouldUnchoke decides whether a peer is unchoked, by its override and
+// whether it's interested in our pieces
+func shouldUnchoke(mode int, peerInterested bool) bool {
+	switch mode {
+	case PinUnchoked:
+		return true
+	case NeverUnchoke:
+		return false
+	}
+	return peerInterested
+}
+
+// updateChoke chokes or unchokes the peer according to its override and
+// whether it's interested, sending a message only if that changes
+func (p *Peer) updateChoke() {
+	mode := ChokeAuto
+	if p.chokeOverrides != nil {
+		mode = p.chokeOverrides.get(p.peerName).mode
+	}
+	unchoke := shouldUnchoke(mode, p.peerInterested)
+	if unchoke && p.amChoking {
+		p.sendUnchoke()
+	} else if !unchoke && !p.amChoking {
+		p.sendChoke()
+	}
+}
+
+// SetChokeOverride overrides whether the peer at address, such as
+// "10.0.0.1:6881", is unchoked: PinUnchoked keeps it unchoked, NeverUnchoke
+// keeps it choked and ChokeAuto restores the usual behaviour of unchoking
+// peers while they're interested. The override applies whenever a peer at
+// the address is connected, from now until it disconnects, or for the rest of
+// the session if sticky is set. It's ignored once the peer's IP is banned.
+// SetChokeOverride may be called before or while the torrent runs.
+func (t *Torrent) SetChokeOverride(address string, mode int, sticky bool) error {
+	if mode < ChokeAuto || mode > NeverUnchoke {
+		return fmt.Errorf("Invalid choke override %d", mode)
+	}
+	peerName, err := canonicalPeerName(address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Torrent : SetChokeOverride : Setting the choke override of %s to %s (sticky %t)", peerName, chokeOverrideNames[mode], sticky)
+	t.chokeOverrides.set(peerName, mode, sticky)
+	return nil
+}
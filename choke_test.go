@@ -0,0 +1,135 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShouldUnchoke(t *testing.T) {
+	tests := []struct {
+		mode       int
+		interested bool
+		unchoke    bool
+	}{
+		{ChokeAuto, false, false},
+		{ChokeAuto, true, true},
+		{PinUnchoked, false, true},
+		{PinUnchoked, true, true},
+		{NeverUnchoke, false, false},
+		{NeverUnchoke, true, false},
+	}
+	for _, test := range tests {
+		if unchoke := shouldUnchoke(test.mode, test.interested); unchoke != test.unchoke {
+			t.Errorf("Expected unchoke %v for %s with interested %v, but got %v", test.unchoke, chokeOverrideNames[test.mode], test.interested, unchoke)
+		}
+	}
+}
+
+// Overrides are kept by canonical address, cleared on disconnect unless
+// sticky, and ignored once the peer's IP is banned
+func TestChokeOverrides(t *testing.T) {
+	torrent := &Torrent{chokeOverrides: NewChokeOverrides()}
+	co := torrent.chokeOverrides
+	for _, address := range []string{"10.0.0.1", "seedbox:6881", "10.0.0.1:http", "10.0.0.1:70000"} {
+		if torrent.SetChokeOverride(address, PinUnchoked, false) == nil {
+			t.Errorf("Expected %q to be an invalid address", address)
+		}
+	}
+	if torrent.SetChokeOverride("10.0.0.1:6881", NeverUnchoke+1, false) == nil {
+		t.Errorf("Expected an invalid override to be refused")
+	}
+
+	torrent.SetChokeOverride("[::ffff:10.0.0.1]:6881", PinUnchoked, false)
+	torrent.SetChokeOverride("10.0.0.2:6881", NeverUnchoke, true)
+	torrent.SetChokeOverride("10.0.0.3:6881", PinUnchoked, true)
+	select {
+	case <-co.changed:
+	default:
+		t.Errorf("Expected the change to be signalled")
+	}
+	if co.get("10.0.0.1:6881").mode != PinUnchoked || co.get("10.0.0.2:6881").mode != NeverUnchoke {
+		t.Errorf("Expected the overrides to be set, but got %v", co.peers)
+	}
+
+	co.disconnected("10.0.0.1:6881")
+	co.disconnected("10.0.0.2:6881")
+	if co.get("10.0.0.1:6881").mode != ChokeAuto {
+		t.Errorf("Expected the override to be cleared on disconnect")
+	}
+	if co.get("10.0.0.2:6881").mode != NeverUnchoke {
+		t.Errorf("Expected the sticky override to be kept on disconnect")
+	}
+
+	co.ban(net.IPv4(10, 0, 0, 3))
+	if co.get("10.0.0.3:6881").mode != ChokeAuto {
+		t.Errorf("Expected the override of a banned peer to be ignored")
+	}
+
+	torrent.SetChokeOverride("10.0.0.2:6881", ChokeAuto, false)
+	if len(co.peers) != 1 {
+		t.Errorf("Expected only the override of the banned peer to be left, but got %v", co.peers)
+	}
+}
+
+// receiveChoke returns true if the next message sent to a peer is an
+// unchoke, false if it's a choke, and fails if neither is sent
+func receiveChoke(t *testing.T, p *Peer) bool {
+	select {
+	case message := <-p.sendChan:
+		if len(message) != 5 || (int(message[4]) != MsgChoke && int(message[4]) != MsgUnchoke) {
+			t.Fatalf("Expected a choke or an unchoke to be sent to %s, but got %x", p.peerName, message)
+		}
+		return int(message[4]) == MsgUnchoke
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a choke or an unchoke to be sent to %s", p.peerName)
+	}
+	return false
+}
+
+// Peers are unchoked each round according to their interest and overrides,
+// and only told when that changes
+func TestPeerChokeOverrideRounds(t *testing.T) {
+	co := NewChokeOverrides()
+	names := []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"}
+	peers := make([]*Peer, len(names))
+	for i, name := range names {
+		peers[i] = NewPeer(name, make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+		peers[i].chokeOverrides = co
+	}
+
+	rounds := []struct {
+		overrides  []int
+		interested []bool
+		unchoked   []bool
+	}{
+		{[]int{ChokeAuto, ChokeAuto, ChokeAuto}, []bool{true, false, true}, []bool{true, false, true}},
+		{[]int{ChokeAuto, PinUnchoked, NeverUnchoke}, []bool{true, false, true}, []bool{true, true, false}},
+		{[]int{NeverUnchoke, PinUnchoked, NeverUnchoke}, []bool{true, true, false}, []bool{false, true, false}},
+		{[]int{ChokeAuto, ChokeAuto, ChokeAuto}, []bool{true, true, false}, []bool{true, true, false}},
+	}
+	for round, test := range rounds {
+		for i, p := range peers {
+			co.set(p.peerName, test.overrides[i], false)
+			wasUnchoked := !p.amChoking
+			p.peerInterested = test.interested[i]
+			p.updateChoke()
+			if unchoked := !p.amChoking; unchoked != test.unchoked[i] {
+				t.Errorf("Round %d: expected %s to be unchoked %v, but it was %v", round, p.peerName, test.unchoked[i], unchoked)
+			} else if unchoked != wasUnchoked && receiveChoke(t, p) != unchoked {
+				t.Errorf("Round %d: expected %s to be sent unchoke %v", round, p.peerName, unchoked)
+			}
+		}
+	}
+	for _, p := range peers {
+		select {
+		case message := <-p.sendChan:
+			t.Errorf("Expected no more messages to %s, but got %x", p.peerName, message)
+		default:
+		}
+	}
+}
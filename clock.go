@@ -0,0 +1,170 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules ticks. Components take a Clock so that
+// tests can control time with a fake one, and only compare times read from
+// the same Clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at an interval, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the real clock. The times it returns carry a monotonic
+// reading, so durations between them aren't affected by changes to the wall
+// clock.
+var systemClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// clockOrSystem returns the clock, or the system clock if it's nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return systemClock
+	}
+	return clock
+}
+
+// How far the time between two ticks may be off before the clock is
+// considered to have jumped, and how often the ClockJumpDetector checks
+var (
+	clockJumpThreshold = 10 * time.Second
+	clockJumpInterval  = time.Second
+)
+
+// clockJump returns how far the clock jumped between two ticks that were
+// meant to be interval apart, or 0 if it didn't. A jump shows up either as
+// ticks that are much further apart than the interval, when the monotonic
+// clock kept running through a suspend, or as the wall clock moving
+// differently from the monotonic clock, when the monotonic clock stopped
+// during a suspend or NTP stepped the time.
+func clockJump(last, now time.Time, interval time.Duration) time.Duration {
+	if last.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(last)
+	jump := absDuration(elapsed - interval)
+	if wall := absDuration(now.Round(0).Sub(last.Round(0)) - elapsed); wall > jump {
+		jump = wall
+	}
+	if jump < clockJumpThreshold {
+		return 0
+	}
+	return jump
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// clampElapsed returns a duration measured between two readings of a clock,
+// no less than min. Rates divided by it stay sane when the clock stepped
+// backwards or the readings are moments apart.
+func clampElapsed(elapsed, min time.Duration) time.Duration {
+	if elapsed < min {
+		return min
+	}
+	return elapsed
+}
+
+// ClockJumpDetector watches for the clock jumping, such as when the machine
+// resumes from suspend or NTP steps the time, and tells its subscribers how
+// far it jumped. Components with a ticker of their own check for jumps
+// between their ticks with clockJump instead, so that they handle a jump
+// before acting on the tick that revealed it.
+type ClockJumpDetector struct {
+	clock       Clock
+	mutex       sync.Mutex // guards subscribers
+	subscribers []chan time.Duration
+	lifecycle   lifecycle
+	quit        chan struct{}
+}
+
+func NewClockJumpDetector(clock Clock) *ClockJumpDetector {
+	return &ClockJumpDetector{clock: clockOrSystem(clock), quit: make(chan struct{})}
+}
+
+// Subscribe returns a channel that receives the size of each jump. A jump
+// is dropped if the subscriber hasn't received the last one yet. The
+// channel of a nil detector never receives.
+func (d *ClockJumpDetector) Subscribe() <-chan time.Duration {
+	if d == nil {
+		return nil
+	}
+	ch := make(chan time.Duration, 1)
+	d.mutex.Lock()
+	d.subscribers = append(d.subscribers, ch)
+	d.mutex.Unlock()
+	return ch
+}
+
+// Stop stops the detector and waits for Run to return
+func (d *ClockJumpDetector) Stop() error {
+	return d.lifecycle.stop(func() { close(d.quit) })
+}
+
+func (d *ClockJumpDetector) Run() {
+	if err := d.lifecycle.start(); err != nil {
+		log.Printf("ClockJumpDetector : Run : Not running: %s", err)
+		return
+	}
+	defer d.lifecycle.finish()
+	log.Println("ClockJumpDetector : Run : Started")
+	defer log.Println("ClockJumpDetector : Run : Completed")
+
+	ticker := d.clock.NewTicker(clockJumpInterval)
+	defer ticker.Stop()
+	last := d.clock.Now()
+
+	for {
+		select {
+		case now := <-ticker.C():
+			if jump := clockJump(last, now, clockJumpInterval); jump > 0 {
+				log.Printf("ClockJumpDetector : Run : The clock jumped by %v", jump)
+				d.notify(jump)
+			}
+			last = now
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *ClockJumpDetector) notify(jump time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, ch := range d.subscribers {
+		select {
+		case ch <- jump:
+		default:
+		}
+	}
+}
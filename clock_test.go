@@ -0,0 +1,237 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when it's told to. It records the
+// durations of every After, such as announces and reconnects.
+type fakeClock struct {
+	mutex     sync.Mutex
+	now       time.Time
+	timers    []*fakeTimer
+	scheduled []time.Duration
+}
+
+// fakeTimer is a pending After, or a ticker if it has a period
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.scheduled = append(c.scheduled, d)
+	return c.addTimer(d, 0).c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.addTimer(d, d)
+}
+
+func (c *fakeClock) addTimer(d time.Duration, period time.Duration) *fakeTimer {
+	timer := &fakeTimer{clock: c, when: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() {
+	c := t.clock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward and fires the timers that are due. Like a
+// time.Ticker, a ticker whose last tick hasn't been received drops ticks.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.when.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		select {
+		case timer.c <- c.now:
+		default:
+		}
+		if timer.period > 0 {
+			for !timer.when.After(c.now) {
+				timer.when = timer.when.Add(timer.period)
+			}
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+}
+
+// Jump moves the clock forward without firing any timers, as when the
+// machine is suspended and timers stop with the monotonic clock. The jump
+// is seen on the next tick.
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		timer.when = timer.when.Add(d)
+	}
+}
+
+// waitForTicks waits for the ticks fired by Advance to be received, so
+// that the next ones aren't dropped
+func (c *fakeClock) waitForTicks(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mutex.Lock()
+		received := true
+		for _, timer := range c.timers {
+			if len(timer.c) > 0 {
+				received = false
+			}
+		}
+		c.mutex.Unlock()
+		if received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for ticks to be received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// tick advances the clock and waits for the ticks to be received
+func (c *fakeClock) tick(t *testing.T, d time.Duration) {
+	c.Advance(d)
+	c.waitForTicks(t)
+}
+
+// waitForTimers waits for n timers or tickers to be pending, so that the
+// components under test are ready for the clock to move
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mutex.Lock()
+		pending := len(c.timers)
+		c.mutex.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d timers, %d are pending", n, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForScheduled waits for n Afters to have been scheduled and returns
+// the durations of every one scheduled so far
+func (c *fakeClock) waitForScheduled(t *testing.T, n int) []time.Duration {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mutex.Lock()
+		scheduled := append([]time.Duration(nil), c.scheduled...)
+		c.mutex.Unlock()
+		if len(scheduled) >= n {
+			return scheduled
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d Afters, %d were scheduled", n, len(scheduled))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClockJump(t *testing.T) {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		last     time.Time
+		now      time.Time
+		expected time.Duration
+	}{
+		{time.Time{}, start, 0},
+		{start, start.Add(time.Second), 0},
+		{start, start.Add(5 * time.Second), 0},
+		{start, start.Add(2*time.Hour + time.Second), 2 * time.Hour},
+		{start, start.Add(-time.Minute + time.Second), time.Minute},
+	}
+	for _, test := range tests {
+		if jump := clockJump(test.last, test.now, time.Second); jump != test.expected {
+			t.Errorf("Expected a jump of %v from %v to %v, but got %v", test.expected, test.last, test.now, jump)
+		}
+	}
+
+	// Readings of the system clock are a monotonic time apart, however far
+	// apart their wall clocks are
+	now := time.Now()
+	if jump := clockJump(now.Add(-time.Second), now, time.Second); jump != 0 {
+		t.Errorf("Expected no jump between readings a second apart, but got %v", jump)
+	}
+}
+
+// Subscribers are told about a jump once, and not about regular ticks
+func TestClockJumpDetector(t *testing.T) {
+	clock := newFakeClock()
+	detector := NewClockJumpDetector(clock)
+	jumps := detector.Subscribe()
+	go detector.Run()
+	defer close(detector.quit)
+	clock.waitForTimers(t, 1)
+
+	for i := 0; i < 3; i++ {
+		clock.tick(t, time.Second)
+	}
+	clock.Jump(2 * time.Hour)
+	clock.tick(t, time.Second)
+	select {
+	case jump := <-jumps:
+		if jump < 2*time.Hour {
+			t.Errorf("Expected a jump of at least %v, but got %v", 2*time.Hour, jump)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the jump")
+	}
+	select {
+	case jump := <-jumps:
+		t.Errorf("Unexpected second jump of %v", jump)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var nilDetector *ClockJumpDetector
+	if nilDetector.Subscribe() != nil {
+		t.Errorf("Expected a nil detector to return a nil channel")
+	}
+}
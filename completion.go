@@ -0,0 +1,284 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Stages of the piece completion pipeline, in the order they are executed.
+// Every side effect of a piece being done happens in exactly one stage, and
+// a stage never starts before the previous one has finished. The verify
+// stage checks the SHA-1 hash of the piece against the metainfo. The write
+// stage writes the piece to disk and, depending on the durability policy,
+// syncs it. The record stage updates the authoritative bitfield and appends
+// the piece to the resume journal. Finally the announce stage fans the news
+// out, first to Stats (bytes left) and then to the Controller (HAVE
+// broadcast, interest recompute and completion detection).
+//
+// Because a piece is only recorded once it's on disk, and only announced
+// once it's recorded, we never advertise a piece that a crash would lose and
+// never report left=0 before the last piece is flushed.
+const (
+	stageVerify = iota
+	stageWrite
+	stageRecord
+	stageAnnounce
+)
+
+var stageNames = []string{"verify", "write", "record", "announce"}
+
+// Durability policies for piece writes
+const (
+	DurabilityNone = iota // leave flushing to the operating system
+	DurabilitySync        // sync files to disk before recording a piece
+)
+
+var errPieceHashMismatch = errors.New("Piece failed hash check")
+
+var errPieceCancelled = errors.New("Piece cancelled by Abort")
+
+// stageIOError is an I/O error in the write or record stage. Unlike a piece
+// that fails its hash check, it means the files of the torrent can no longer
+// be written, and stops DiskIO.
+type stageIOError struct {
+	err error
+}
+
+func (e *stageIOError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageIOError) Unwrap() error {
+	return e.err
+}
+
+// Number of lock stripes used to keep pieces with the same index from being
+// completed or rechecked concurrently
+const pieceLockStripes = 64
+
+// pieceLock returns the lock held while completing or rechecking a piece
+func (diskio *DiskIO) pieceLock(pieceNum int) *sync.Mutex {
+	return &diskio.pieceLocks[uint(pieceNum)%pieceLockStripes]
+}
+
+// runCompletions serves single piece rechecks, whether requested or queued
+// by a failed read or the verification policy
+func (diskio *DiskIO) runCompletions() {
+	defer close(diskio.completionsDone)
+	for {
+		select {
+		case request := <-diskio.contChans.verifyPiece:
+			request.response <- diskio.recheckPiece(request.pieceNum)
+		case pieceNum := <-diskio.rechecks:
+			diskio.recheckPiece(pieceNum)
+		case <-diskio.drained:
+			return
+		}
+	}
+}
+
+// processPiece completes a piece received from a peer, or drops it if DiskIO
+// has failed or is being aborted. An I/O error stops DiskIO.
+func (diskio *DiskIO) processPiece(piece Piece) {
+	err := diskio.Err()
+	if err == nil && diskio.isCancelled() {
+		atomic.AddInt32(&diskio.cancelledItems, 1)
+		err = errPieceCancelled
+	} else if err == nil && diskio.readOnly {
+		// Peers are never asked for pieces, but a piece may still be
+		// sent or imported
+		err = ErrReadOnly
+		log.Printf("DiskIO : processPiece : Piece %x from %s not completed: %s", piece.index, piece.peerName, err)
+	} else if err == nil {
+		err = diskio.completePiece(piece)
+		if err != nil {
+			log.Printf("DiskIO : processPiece : Piece %x from %s not completed: %s", piece.index, piece.peerName, err)
+		}
+		var ioErr *stageIOError
+		if errors.As(err, &ioErr) {
+			diskio.fail(ioErr.err)
+		}
+	}
+	if piece.result != nil {
+		piece.result <- err
+	}
+}
+
+// completePiece runs a received piece through each stage of the completion
+// pipeline. If a stage fails, or the fault hook aborts the pipeline after a
+// stage, none of the following stages are run. Different pieces may be
+// completed concurrently, the bookkeeping shared between them is guarded by
+// pipelineMutex.
+func (diskio *DiskIO) completePiece(piece Piece) error {
+	lock := diskio.pieceLock(piece.index)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for stage := stageVerify; stage <= stageAnnounce; stage++ {
+		var err error
+		switch stage {
+		case stageVerify:
+			if piece.index < 0 || piece.index >= len(diskio.pieces) {
+				err = fmt.Errorf("Piece index %d out of range", piece.index)
+			} else if !piece.unverified && !diskio.checkHash(piece.data, piece.index) {
+				diskio.countWrite(WriteStats{FailedPieces: 1, FailedBytes: int64(len(piece.data))})
+				err = errPieceHashMismatch
+			} else if piece.peerName != importPeerName {
+				// Imported pieces come from the local filesystem and don't
+				// need to be corroborated
+				diskio.pipelineMutex.Lock()
+				if diskio.tightened {
+					err = diskio.corroborate(piece)
+				}
+				diskio.pipelineMutex.Unlock()
+			}
+		case stageWrite:
+			diskio.pipelineMutex.Lock()
+			diskio.countPieceWrite(piece)
+			err = diskio.journalStarted(piece.index)
+			diskio.pipelineMutex.Unlock()
+			if err == nil {
+				// The piece holds on to its worker while it's retried, so
+				// the write queue backs up instead of piece data piling up
+				err = diskio.retry(diskio.writeRetry, fmt.Sprintf("write of piece %x", piece.index), func() error {
+					return diskio.writePiece(piece)
+				})
+			}
+			if err == nil {
+				// A failed fsync isn't retried, the kernel may have dropped
+				// the dirty pages already and a retry could succeed without
+				// the data ever reaching the disk
+				err = diskio.syncAfterWrite(len(piece.data))
+			}
+			if err != nil {
+				err = &stageIOError{err}
+			}
+			diskio.pipelineMutex.Lock()
+			diskio.checkWriteGuard()
+			diskio.pipelineMutex.Unlock()
+		case stageRecord:
+			diskio.pipelineMutex.Lock()
+			diskio.piecesMutex.Lock()
+			diskio.pieces[piece.index] = true
+			diskio.piecesMutex.Unlock()
+			err = diskio.journalDone(piece.index)
+			if err == nil && diskio.complete != nil {
+				// Drop the .part suffix of the files this piece completes
+				err = diskio.completeFiles(piece.index)
+			}
+			diskio.pipelineMutex.Unlock()
+			if piece.unverified {
+				diskio.verification.recordUnverified(piece.peerName, piece.index)
+			}
+			if err != nil {
+				err = &stageIOError{err}
+			}
+		case stageAnnounce:
+			// The piece is on disk, so it's fine to skip announcing it
+			// when shutting down
+			select {
+			case diskio.statsCh <- len(piece.data):
+			case <-diskio.quit:
+			}
+			select {
+			case diskio.contChans.receivedPiece <- ReceivedPiece{pieceNum: piece.index, peerName: piece.peerName, duplicateBlocks: piece.duplicateBlocks}:
+			case <-diskio.quit:
+			}
+		}
+		if err == nil && diskio.faultHook != nil {
+			err = diskio.faultHook(stage)
+		}
+		if err != nil {
+			return fmt.Errorf("%s stage: %w", stageNames[stage], err)
+		}
+	}
+	diskio.checkMoveDue()
+	return nil
+}
+
+// recheckPiece verifies a single piece on disk and brings the bitfield and
+// the journal in line with the result
+func (diskio *DiskIO) recheckPiece(pieceNum int) VerifyResponse {
+	lock := diskio.pieceLock(pieceNum)
+	lock.Lock()
+	defer lock.Unlock()
+
+	diskio.cache.invalidate(pieceNum)
+	good, err := diskio.VerifyPiece(pieceNum)
+	if err != nil {
+		log.Printf("DiskIO : recheckPiece : Unable to verify piece %x: %s", pieceNum, err)
+		return VerifyResponse{pieceNum: pieceNum, err: err}
+	}
+	diskio.pipelineMutex.Lock()
+	defer diskio.pipelineMutex.Unlock()
+	if diskio.pieces[pieceNum] != good {
+		log.Printf("DiskIO : recheckPiece : Piece %x changed from %t to %t on disk", pieceNum, diskio.pieces[pieceNum], good)
+		if !good {
+			diskio.announceLost([]int{pieceNum}, diskio.pieceLength(pieceNum))
+		}
+		diskio.piecesMutex.Lock()
+		diskio.pieces[pieceNum] = good
+		diskio.piecesMutex.Unlock()
+		if diskio.journal != nil {
+			err = diskio.compactJournal()
+		}
+		if err == nil && good && diskio.complete != nil {
+			err = diskio.completeFiles(pieceNum)
+		}
+	}
+	return VerifyResponse{pieceNum: pieceNum, good: good, err: err}
+}
+
+// syncAfterWrite syncs the files after a piece is written, according to the
+// durability policy. With DurabilityNone the files are synced every
+// syncEvery bytes, if it's set.
+func (diskio *DiskIO) syncAfterWrite(length int) error {
+	if diskio.durability == DurabilitySync {
+		return diskio.syncFiles()
+	}
+	if diskio.syncEvery <= 0 {
+		return nil
+	}
+	diskio.pipelineMutex.Lock()
+	diskio.unsynced += int64(length)
+	due := diskio.unsynced >= diskio.syncEvery
+	if due {
+		diskio.unsynced = 0
+	}
+	diskio.pipelineMutex.Unlock()
+	if !due {
+		return nil
+	}
+	return diskio.syncFiles()
+}
+
+// syncFiles commits the contents of every open file, and of every mapping,
+// to stable storage. Nothing is written to read-only storage.
+func (diskio *DiskIO) syncFiles() error {
+	if diskio.readOnly {
+		return nil
+	}
+	err := diskio.syncMaps()
+	if err != nil {
+		return err
+	}
+	diskio.filesMutex.RLock()
+	defer diskio.filesMutex.RUnlock()
+	for _, file := range diskio.files {
+		if file == nil {
+			continue
+		}
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,6 +16,14 @@ const (
 	maxSimultaneousDownloadsPerPeer = 5
 )*/
 
+// Pieces downloaded from a peer at once, see MemoryProfile
+const defaultDownloadsPerPeer = 5
+
+// haveBatchWindow is how long haves are batched for after requests were sent
+// because of a have. When many peers connect at once, their bitfields are
+// handled by a single request pass instead of one pass each.
+const haveBatchWindow = 100 * time.Millisecond
+
 type RarityMap struct {
 	data map[int][]int
 }
@@ -70,12 +78,38 @@ func (r *RarityMap) getPiecesByRarity() []int {
 
 type Controller struct {
 	finishedPieces                  []bool
-	pieceHashes                     [][]byte
+	pieceHashes                     PieceHashes
 	activeRequestsTotals            []int
 	peers                           map[string]*PeerInfo
 	maxSimultaneousDownloadsPerPeer int
+	maxAssignedBlocks               int // blocks a peer may be assigned across its pieces, 0 for no cap, see canAssign
+	pieceLength                     int // length of every piece but the last, the block cap is off if 0
+	totalLength                     int // total length of the torrent
 	downloadComplete                bool
+	wantedPieces                    []bool                      // pieces overlapping a wanted file, nil if every piece is wanted
+	wanted                          chan []bool                 // changes to wantedPieces
+	noDuplicateRequests             bool                        // don't request a piece from more than one peer at a time
+	sequential                      bool                        // request pieces in ascending order instead of rarest first
+	corroborating                   map[int]string              // pieces waiting for a second copy, mapped to the peer that sent the first
+	badCopies                       map[int]map[string]struct{} // peers that sent a copy of a piece that failed its hash check
+	completed                       chan struct{}               // closed when the download completes, but not if it was already complete
+	failed                          chan struct{}               // closed when the torrent stops because of a disk error
+	diskFailed                      bool
 	rxChans                         *ControllerRxChans
+	snapshot                        chan chan *SwarmDump // requests for the Controller's view of the swarm
+	timings                         *PieceTimings        // how long completed pieces took to download
+	pieceTimings                    map[int]*pieceTiming // pieces requested but not completed yet
+	haveBatchWindow                 time.Duration        // see haveBatchWindow, 0 to send requests for every have
+	haveBatch                       map[string]struct{}  // peers with new pieces waiting for the next request pass
+	haveBatchTimer                  <-chan time.Time     // fires at the end of the batch, nil without one
+	lastHavePass                    time.Time            // when requests were last sent because of haves
+	availability                    []uint16             // connected peers having each piece, choked or not
+	pendingAvailability             map[int]*AvailabilityDelta
+	subscribers                     map[*AvailabilitySubscription]struct{} // subscribers to availability changes
+	subscribe                       chan *AvailabilitySubscription
+	availabilityTicker              Ticker // flushes availability changes to subscribers, nil without any
+	clock                           Clock
+	lifecycle                       lifecycle
 	quit                            chan struct{}
 }
 
@@ -94,7 +128,13 @@ func NewControllerPeerChans() *ControllerPeerChans {
 }
 
 type ControllerDiskIOChans struct {
-	receivedPiece chan ReceivedPiece // Other end is IO
+	receivedPiece    chan ReceivedPiece // Other end is IO
+	verifyPiece      chan VerifyRequest // Other end is IO
+	unconfirmedPiece chan ReceivedPiece // Other end is IO. Used when a piece must be corroborated by another peer.
+	tighten          chan struct{}      // Other end is IO. Closed when too many extra bytes have been written.
+	diskError        chan error         // Other end is IO. Used when IO stops because the files can't be written.
+	lostPieces       chan []int         // Other end is IO. Used when pieces on disk were changed by another program.
+	recheck          chan []bool        // Other end is IO. Used to send the pieces found on disk by a full recheck.
 }
 
 type ControllerPeerManagerChans struct {
@@ -108,12 +148,14 @@ func NewControllerPeerManagerChans() *ControllerPeerManagerChans {
 }
 
 type PeerControllerChans struct {
-	chokeStatus chan PeerChokeStatus // Other end is Peer. Used when the peer is becomes choked or unchoked
-	havePiece   chan chan HavePiece  // Other end is Peer. used When the peer receives a HAVE message
+	chokeStatus  chan PeerChokeStatus  // Other end is Peer. Used when the peer is becomes choked or unchoked
+	havePiece    chan chan HavePiece   // Other end is Peer. used When the peer receives a HAVE message
+	badPiece     chan BadPiece         // Other end is Peer. Used when a piece downloaded by the peer fails its hash check
+	requestDepth chan PeerRequestDepth // Other end is Peer. Used when the peer changes the number of block requests it keeps outstanding
 }
 
 func NewPeerControllerChans() *PeerControllerChans {
-	return &PeerControllerChans{chokeStatus: make(chan PeerChokeStatus), havePiece: make(chan chan HavePiece)}
+	return &PeerControllerChans{chokeStatus: make(chan PeerChokeStatus), havePiece: make(chan chan HavePiece), badPiece: make(chan BadPiece), requestDepth: make(chan PeerRequestDepth)}
 }
 
 type ControllerRxChans struct {
@@ -122,33 +164,70 @@ type ControllerRxChans struct {
 	peer        PeerControllerChans
 }
 
-func NewController(finishedPieces []bool, pieceHashes [][]byte, diskIOChans ControllerDiskIOChans,
+func NewController(finishedPieces []bool, pieceHashes PieceHashes, diskIOChans ControllerDiskIOChans,
 	peerManagerChans ControllerPeerManagerChans, peerChans PeerControllerChans) *Controller {
 
 	if len(finishedPieces) == 0 {
 		log.Fatalf("ERROR: can't construct controller with an empty finishedPieces slice")
 	}
 
-	if len(pieceHashes) != len(finishedPieces) {
-		log.Fatalf("ERROR: can't construct controller with finishedPieces size of %d and pieceHahses size of %d", len(finishedPieces), len(pieceHashes))
+	if pieceHashes.Len() != len(finishedPieces) {
+		log.Fatalf("ERROR: can't construct controller with finishedPieces size of %d and pieceHahses size of %d", len(finishedPieces), pieceHashes.Len())
 	}
 
-	cont := &Controller{finishedPieces: finishedPieces, pieceHashes: pieceHashes, quit: make(chan struct{})}
+	cont := &Controller{finishedPieces: finishedPieces, pieceHashes: pieceHashes, completed: make(chan struct{}), failed: make(chan struct{}), quit: make(chan struct{})}
+	cont.snapshot = make(chan chan *SwarmDump)
+	cont.wanted = make(chan []bool)
 	cont.rxChans = &ControllerRxChans{diskIOChans, peerManagerChans, peerChans}
 	cont.peers = make(map[string]*PeerInfo)
+	cont.corroborating = make(map[int]string)
+	cont.badCopies = make(map[int]map[string]struct{})
+	cont.timings = NewPieceTimings()
+	cont.pieceTimings = make(map[int]*pieceTiming)
+	cont.haveBatchWindow = haveBatchWindow
+	cont.haveBatch = make(map[string]struct{})
+	cont.availability = make([]uint16, len(finishedPieces))
+	cont.pendingAvailability = make(map[int]*AvailabilityDelta)
+	cont.subscribers = make(map[*AvailabilitySubscription]struct{})
+	cont.subscribe = make(chan *AvailabilitySubscription)
+	cont.clock = systemClock
 	cont.activeRequestsTotals = make([]int, len(finishedPieces))
-	cont.maxSimultaneousDownloadsPerPeer = 5 // only 5 pieces at a time
+	cont.maxSimultaneousDownloadsPerPeer = defaultDownloadsPerPeer
+	cont.maxAssignedBlocks = assignedBlockDepths * defaultRequestDepth
 
 	cont.updateCompletedFlagIfFinished(true)
 
 	return cont
 }
 
+// pieceWanted returns true if a piece should be downloaded once it's needed
+func (cont *Controller) pieceWanted(pieceNum int) bool {
+	return cont.wantedPieces == nil || cont.wantedPieces[pieceNum]
+}
+
+// wantedFinished returns true if every wanted piece has been downloaded
+func (cont *Controller) wantedFinished() bool {
+	for pieceNum, hasPiece := range cont.finishedPieces {
+		if !hasPiece && cont.pieceWanted(pieceNum) {
+			return false
+		}
+	}
+	return true
+}
+
 func (cont *Controller) updateCompletedFlagIfFinished(initializing bool) {
-	for _, hasPiece := range cont.finishedPieces {
-		if !hasPiece {
-			// There is at least one piece that we haven't finished downloading
-			return
+	if !cont.wantedFinished() {
+		// There is at least one wanted piece that we haven't finished
+		// downloading
+		return
+	}
+	if !initializing && !cont.downloadComplete {
+		// Let the trackers know that the download completed, unless it
+		// already completed before more files were wanted
+		select {
+		case <-cont.completed:
+		default:
+			close(cont.completed)
 		}
 	}
 	cont.downloadComplete = true
@@ -172,6 +251,51 @@ func (cont *Controller) updateCompletedFlagIfFinished(initializing bool) {
 	log.Println("")
 }
 
+// setWantedPieces changes which pieces are downloaded, nil for every piece.
+// Requests already sent for pieces that are no longer wanted are left to
+// finish. If more pieces are wanted after the download completed, the
+// download resumes.
+func (cont *Controller) setWantedPieces(wanted []bool, initializing bool) {
+	cont.wantedPieces = wanted
+	if !cont.downloadComplete {
+		cont.updateCompletedFlagIfFinished(initializing)
+	} else if !cont.wantedFinished() {
+		log.Println("Controller : setWantedPieces : More pieces are wanted, resuming the download")
+		cont.resumeDownload()
+	}
+	for _, peerInfo := range cont.peers {
+		cont.updateQuantityNeededForPeer(peerInfo)
+	}
+	cont.sendRequestsToAllPeers()
+}
+
+// resumeDownload goes back to downloading after the download completed
+func (cont *Controller) resumeDownload() {
+	cont.downloadComplete = false
+	go func() {
+		cont.rxChans.peerManager.seeding <- false
+	}()
+}
+
+// losePieces forgets finished pieces that DiskIO found changed on disk by
+// another program. Peers stop advertising them, and they're downloaded again.
+func (cont *Controller) losePieces(pieces []int) {
+	for _, pieceNum := range pieces {
+		cont.finishedPieces[pieceNum] = false
+	}
+	for _, peerInfo := range cont.peers {
+		go sendLostToPeer(pieces, peerInfo.chans.havePiece)
+	}
+	if cont.downloadComplete && !cont.wantedFinished() {
+		log.Println("Controller : losePieces : Wanted pieces were lost, resuming the download")
+		cont.resumeDownload()
+	}
+	for _, peerInfo := range cont.peers {
+		cont.updateQuantityNeededForPeer(peerInfo)
+	}
+	cont.sendRequestsToAllPeers()
+}
+
 func (cont *Controller) sendHaveToPeersWhoNeedPiece(pieceNum int) {
 	for _, peerInfo := range cont.peers {
 		if !peerInfo.availablePieces[pieceNum] {
@@ -189,8 +313,23 @@ func sendHaveToPeer(pieceNum int, outerChan chan chan HavePiece) {
 	close(innerChan)
 }
 
+func sendLostToPeer(pieces []int, outerChan chan chan HavePiece) {
+	innerChan := make(chan HavePiece)
+	outerChan <- innerChan
+	for _, pieceNum := range pieces {
+		innerChan <- HavePiece{pieceNum: pieceNum, lost: true}
+	}
+	close(innerChan)
+}
+
 func (cont *Controller) removePieceFromActiveRequests(piece ReceivedPiece) {
-	finishingPeer := cont.peers[piece.peerName]
+	finishingPeer, exists := cont.peers[piece.peerName]
+	if !exists {
+		// The piece didn't come from a connected peer, for example it was
+		// imported from the local filesystem
+		finishingPeer = &PeerInfo{activeRequests: map[int]struct{}{piece.pieceNum: struct{}{}}}
+		cont.activeRequestsTotals[piece.pieceNum]++
+	}
 	if _, exists := finishingPeer.activeRequests[piece.pieceNum]; exists {
 		// Remove this piece from the peer's activeRequests set
 		delete(finishingPeer.activeRequests, piece.pieceNum)
@@ -247,25 +386,58 @@ func (cont *Controller) createPeerPieceTotals() []int {
 	return peerPieceTotals
 }
 
+// createRaritySlice returns the pieces we need in the order they should be
+// requested. That's rarest first, except for the first and last pieces,
+// which are requested before the rest so that the files can be previewed.
+// In sequential mode it's in ascending order.
 func (cont *Controller) createRaritySlice() []int {
+	if cont.sequential {
+		return cont.createSequentialSlice()
+	}
 	rarityMap := NewRarityMap()
 
 	peerPieceTotals := cont.createPeerPieceTotals()
 
 	for pieceNum, total := range peerPieceTotals {
-		if cont.finishedPieces[pieceNum] {
+		if cont.finishedPieces[pieceNum] || !cont.pieceWanted(pieceNum) {
 			continue
 		}
 
 		rarityMap.put(total, pieceNum)
 	}
-	return rarityMap.getPiecesByRarity()
+	return prioritizeEnds(rarityMap.getPiecesByRarity(), len(cont.finishedPieces))
+}
+
+// createSequentialSlice returns the pieces we need in ascending order
+func (cont *Controller) createSequentialSlice() []int {
+	pieces := make([]int, 0)
+	for pieceNum, finished := range cont.finishedPieces {
+		if !finished && cont.pieceWanted(pieceNum) {
+			pieces = append(pieces, pieceNum)
+		}
+	}
+	return pieces
+}
+
+// prioritizeEnds moves the first and last of numPieces pieces to the front of
+// pieces, if they're in it
+func prioritizeEnds(pieces []int, numPieces int) []int {
+	prioritized := make([]int, 0, len(pieces))
+	rest := make([]int, 0, len(pieces))
+	for _, pieceNum := range pieces {
+		if pieceNum == 0 || pieceNum == numPieces-1 {
+			prioritized = append(prioritized, pieceNum)
+		} else {
+			rest = append(rest, pieceNum)
+		}
+	}
+	return append(prioritized, rest...)
 }
 
 func (cont *Controller) updateQuantityNeededForPeer(peerInfo *PeerInfo) {
 	qtyPiecesNeeded := 0
 	for pieceNum, pieceFinished := range cont.finishedPieces {
-		if !pieceFinished && peerInfo.availablePieces[pieceNum] {
+		if !pieceFinished && cont.pieceWanted(pieceNum) && peerInfo.availablePieces[pieceNum] {
 			qtyPiecesNeeded++
 		}
 	}
@@ -323,6 +495,20 @@ func (cont *Controller) createDownloadPriorityForPeer(peerInfo *PeerInfo, rarity
 
 	for rarityIndex, pieceNum := range raritySlice {
 		if peerInfo.availablePieces[pieceNum] {
+			if cont.noDuplicateRequests && cont.activeRequestsTotals[pieceNum] > 0 {
+				// Another peer is already working on this piece
+				continue
+			}
+			if cont.corroborating[pieceNum] == peerInfo.peerName && cont.availableFromOtherPeer(pieceNum, peerInfo.peerName) {
+				// This peer sent the copy of the piece waiting to be
+				// corroborated, and another peer can send a second copy
+				continue
+			}
+			if _, bad := cont.badCopies[pieceNum][peerInfo.peerName]; bad && cont.availableFromGoodPeer(pieceNum) {
+				// This peer sent a bad copy of the piece, and another peer
+				// can send it instead
+				continue
+			}
 			if _, exists := peerInfo.activeRequests[pieceNum]; !exists {
 				// 1) The peer has this piece available
 				// 2) We need this piece, because it's in the raritySlice
@@ -347,6 +533,9 @@ func (cont *Controller) sendRequestsToPeer(peerInfo *PeerInfo, raritySlice []int
 	if cont.downloadComplete {
 		//log.Printf("Controller : SendRequestsToPeer : Not sending requests to %s because we've finished downloading the file.", peerInfo.peerName)
 
+	} else if cont.diskFailed {
+		// Pieces can't be written anymore
+
 	} else {
 		// Create the slice of pieces that this peer should work on next. It will not
 		// include pieces that have already been written to disk, or pieces that the
@@ -362,15 +551,23 @@ func (cont *Controller) sendRequestsToPeer(peerInfo *PeerInfo, raritySlice []int
 					// We've sent enough requests
 					break
 				}
+				if !cont.canAssign(peerInfo, pieceNum) {
+					// Too many blocks or duplicates, a smaller piece or
+					// one nobody else is working on may still fit
+					continue
+				}
 
 				// Create a new RequestPiece message and send it to the peer
 				requestMessage := &RequestPiece{
 					pieceNum:     pieceNum,
-					expectedHash: cont.pieceHashes[pieceNum],
+					expectedHash: cont.pieceHashes.At(pieceNum),
+					unchokes:     peerInfo.unchokes,
 				}
 				//log.Printf("Controller : SendRequestsToPeer : Requesting %s to get piece %x", peerInfo.peerName, pieceNum)
 				go func() { peerInfo.chans.requestPiece <- *requestMessage }()
 
+				cont.pieceRequested(pieceNum, peerInfo.peerName)
+
 				// Add this pieceNum to the set of pieces that this peer is working on
 				peerInfo.activeRequests[pieceNum] = struct{}{}
 
@@ -382,6 +579,17 @@ func (cont *Controller) sendRequestsToPeer(peerInfo *PeerInfo, raritySlice []int
 	}
 }
 
+// sendRequestsToAllPeers sends more requests to every unchoked peer that
+// isn't working on the maximum number of pieces
+func (cont *Controller) sendRequestsToAllPeers() {
+	raritySlice := cont.createRaritySlice()
+	for _, peerInfo := range sortedPeersByQtyPiecesNeeded(cont.peers) {
+		if cont.canTakeMore(peerInfo) {
+			cont.sendRequestsToPeer(peerInfo, raritySlice)
+		}
+	}
+}
+
 func sendBitfieldOverChannel(outerChan chan<- chan HavePiece, peerName string, bitfield []bool) {
 
 	bitfieldCopy := make([]bool, len(bitfield))
@@ -405,6 +613,87 @@ func sendBitfieldOverChannel(outerChan chan<- chan HavePiece, peerName string, b
 	}()
 }
 
+// availableFromGoodPeer returns true if an unchoked peer that hasn't sent a
+// bad copy of a piece has it
+func (cont *Controller) availableFromGoodPeer(pieceNum int) bool {
+	for peerName, peerInfo := range cont.peers {
+		if _, bad := cont.badCopies[pieceNum][peerName]; !bad && !peerInfo.isChoked && peerInfo.availablePieces[pieceNum] {
+			return true
+		}
+	}
+	return false
+}
+
+// availableFromOtherPeer returns whether an unchoked peer other than peerName
+// has a piece
+func (cont *Controller) availableFromOtherPeer(pieceNum int, peerName string) bool {
+	for otherName, peerInfo := range cont.peers {
+		if otherName != peerName && !peerInfo.isChoked && peerInfo.availablePieces[pieceNum] {
+			return true
+		}
+	}
+	return false
+}
+
+// discardBadPiece forgets a piece that failed its hash check as being
+// downloaded by the peer that sent it, and requests it again, from another
+// peer if possible
+func (cont *Controller) discardBadPiece(piece BadPiece) {
+	if cont.badCopies[piece.pieceNum] == nil {
+		cont.badCopies[piece.pieceNum] = make(map[string]struct{})
+	}
+	cont.badCopies[piece.pieceNum][piece.peerName] = struct{}{}
+	if peerInfo, exists := cont.peers[piece.peerName]; exists {
+		if _, exists := peerInfo.activeRequests[piece.pieceNum]; exists {
+			delete(peerInfo.activeRequests, piece.pieceNum)
+			cont.activeRequestsTotals[piece.pieceNum]--
+		}
+	}
+	cont.sendRequestsToAllPeers()
+}
+
+// receivedHaves sends requests to a peer that has announced new pieces. The
+// first peer to do so is sent requests right away, peers that announce
+// pieces within haveBatchWindow of it are batched and sent requests together
+// by flushHaveBatch.
+func (cont *Controller) receivedHaves(peerInfo *PeerInfo) {
+	now := cont.clock.Now()
+	if cont.haveBatchTimer == nil && now.Sub(cont.lastHavePass) >= cont.haveBatchWindow {
+		if cont.canTakeMore(peerInfo) {
+			cont.lastHavePass = now
+			cont.sendRequestsToPeer(peerInfo, cont.createRaritySlice())
+		}
+		return
+	}
+	cont.haveBatch[peerInfo.peerName] = struct{}{}
+	if cont.haveBatchTimer == nil {
+		wait := cont.haveBatchWindow - now.Sub(cont.lastHavePass)
+		if wait > cont.haveBatchWindow {
+			// The clock went back
+			wait = cont.haveBatchWindow
+		}
+		cont.haveBatchTimer = cont.clock.After(wait)
+	}
+}
+
+// flushHaveBatch sends requests to the peers batched by receivedHaves, with a
+// single rarity slice that counts the pieces of all of them
+func (cont *Controller) flushHaveBatch() {
+	cont.haveBatchTimer = nil
+	if len(cont.haveBatch) == 0 {
+		return
+	}
+	log.Printf("Controller : flushHaveBatch : Sending requests to %d peers with new pieces", len(cont.haveBatch))
+	cont.lastHavePass = cont.clock.Now()
+	raritySlice := cont.createRaritySlice()
+	for _, peerInfo := range sortedPeersByQtyPiecesNeeded(cont.peers) {
+		if _, batched := cont.haveBatch[peerInfo.peerName]; batched && cont.canTakeMore(peerInfo) {
+			cont.sendRequestsToPeer(peerInfo, raritySlice)
+		}
+	}
+	cont.haveBatch = make(map[string]struct{})
+}
+
 func (cont *Controller) removeUnfinishedWorkForPeer(peerInfo *PeerInfo) {
 	// First decrement activeRequestsTotals for each piece that this peer was working on
 	for pieceNum, _ := range peerInfo.activeRequests {
@@ -415,9 +704,20 @@ func (cont *Controller) removeUnfinishedWorkForPeer(peerInfo *PeerInfo) {
 	peerInfo.activeRequests = make(map[int]struct{})
 }
 
+// Stop stops the Controller and waits for Run to return
+func (cont *Controller) Stop() error {
+	return cont.lifecycle.stop(func() { close(cont.quit) })
+}
+
 func (cont *Controller) Run() {
+	if err := cont.lifecycle.start(); err != nil {
+		log.Printf("Controller : Run : Not running: %s", err)
+		return
+	}
+	defer cont.lifecycle.finish()
 	log.Println("Controller : Run : Started")
 	defer log.Println("Controller : Run : Completed")
+	defer cont.closeSubscribers()
 
 	for {
 		select {
@@ -435,8 +735,12 @@ func (cont *Controller) Run() {
 				log.Printf("Controller : Run (Received Piece) : WARNING. Was notified that %s finished downloading piece %x but it's currently choked.", piece.peerName, piece.pieceNum)
 			}
 
+			cont.pieceCompleted(piece)
+
 			// Update our bitfield to show that we now have that piece
 			cont.finishedPieces[piece.pieceNum] = true
+			delete(cont.corroborating, piece.pieceNum)
+			delete(cont.badCopies, piece.pieceNum)
 
 			// If this is the last piece that we needed, update the complete flag.
 			cont.updateCompletedFlagIfFinished(false)
@@ -467,10 +771,43 @@ func (cont *Controller) Run() {
 			for _, peerInfo := range sortedPeers {
 				// Confirm that this peer is still connected and is available to take requests
 				// and also that the peer needs more requests
-				if !peerInfo.isChoked && len(peerInfo.activeRequests) < cont.maxSimultaneousDownloadsPerPeer {
+				if cont.canTakeMore(peerInfo) {
 					cont.sendRequestsToPeer(peerInfo, raritySlice)
 				}
 			}
+		case piece := <-cont.rxChans.diskIO.unconfirmedPiece:
+			// DiskIO is holding this piece until another peer sends a matching copy
+			log.Printf("Controller : Run (Unconfirmed Piece) : Piece %x from %s needs to be corroborated", piece.pieceNum, piece.peerName)
+			cont.corroborating[piece.pieceNum] = piece.peerName
+			if peerInfo, exists := cont.peers[piece.peerName]; exists {
+				if _, exists := peerInfo.activeRequests[piece.pieceNum]; exists {
+					delete(peerInfo.activeRequests, piece.pieceNum)
+					cont.activeRequestsTotals[piece.pieceNum]--
+				}
+			}
+			cont.sendRequestsToAllPeers()
+
+		case <-cont.rxChans.diskIO.tighten:
+			log.Printf("Controller : Run (Tighten) : Too many extra bytes written, no longer requesting pieces from more than one peer")
+			cont.noDuplicateRequests = true
+			cont.maxSimultaneousDownloadsPerPeer = tightenedDownloadsPerPeer
+			cont.rxChans.diskIO.tighten = nil
+
+		case err := <-cont.rxChans.diskIO.diskError:
+			log.Printf("Controller : Run (Disk Error) : ERROR: %s. No longer requesting pieces", err)
+			cont.diskFailed = true
+			for _, peerInfo := range cont.peers {
+				cont.removeUnfinishedWorkForPeer(peerInfo)
+			}
+			close(cont.failed)
+			cont.rxChans.diskIO.diskError = nil
+
+		case pieces := <-cont.rxChans.diskIO.lostPieces:
+			log.Printf("Controller : Run (Lost Pieces) : WARNING: %d pieces were changed on disk by another program, downloading them again", len(pieces))
+			cont.losePieces(pieces)
+
+		case pieces := <-cont.rxChans.diskIO.recheck:
+			cont.rebuildPieces(pieces)
 		// === END OF MESSAGES FROM DISK_IO ===
 
 		// === START OF MESSAGES FROM PEER_MANAGER ===
@@ -504,8 +841,10 @@ func (cont *Controller) Run() {
 			}
 
 			cont.removeUnfinishedWorkForPeer(peerInfo)
+			cont.peerUnavailable(peerInfo)
 
 			delete(cont.peers, peerName)
+			delete(cont.haveBatch, peerName)
 
 		// === END OF MESSAGES FROM PEER_MANAGER ===
 
@@ -518,7 +857,7 @@ func (cont *Controller) Run() {
 
 			if !exists {
 				log.Printf("Controller : Run (Choke Status) : WARNING: Unable to process PeerChokeStatus from %s because it doesn't exist in the peers mapping", chokeStatus.peerName)
-				return
+				break
 			}
 
 			peerInfo.isChoked = chokeStatus.isChoked
@@ -532,7 +871,10 @@ func (cont *Controller) Run() {
 				cont.removeUnfinishedWorkForPeer(peerInfo)
 
 			} else {
-				// The peer (presumably) transitioned from choked to unchoked
+				// The peer (presumably) transitioned from choked to unchoked. The
+				// peer counts its unchokes too, and drops pieces given in an
+				// earlier one, which were removed when it choked us.
+				peerInfo.unchokes++
 
 				// Create a slice of pieces sorted by rarity
 				raritySlice := cont.createRaritySlice()
@@ -542,6 +884,19 @@ func (cont *Controller) Run() {
 
 			}
 
+		case requestDepth := <-cont.rxChans.peer.requestDepth:
+			peerInfo, exists := cont.peers[requestDepth.peerName]
+			if !exists {
+				log.Printf("Controller : Run (Request Depth) : WARNING: Unable to process PeerRequestDepth from %s because it doesn't exist in the peers mapping", requestDepth.peerName)
+				break
+			}
+			deeper := requestDepth.depth > peerInfo.requestDepth
+			peerInfo.requestDepth = requestDepth.depth
+			if deeper && !peerInfo.isChoked {
+				// The peer may take more pieces to keep its requests going
+				cont.sendRequestsToPeer(peerInfo, cont.createRaritySlice())
+			}
+
 		case innerChan := <-cont.rxChans.peer.havePiece:
 
 			var peerInfo *PeerInfo
@@ -559,7 +914,7 @@ func (cont *Controller) Run() {
 				}
 
 				// Mark this peer as having this piece
-				peerInfo.availablePieces[piece.pieceNum] = true
+				cont.peerAvailable(peerInfo, piece)
 
 				pieceCount += 1
 
@@ -570,17 +925,27 @@ func (cont *Controller) Run() {
 			// This is either one or more HAVE messages sent for the initial peer bitfield, or it's
 			// a single HAVE message sent because the peer has a new piece. In either case, we should
 			// attempt to download more pieces.
-			if !peerInfo.isChoked && len(peerInfo.activeRequests) < cont.maxSimultaneousDownloadsPerPeer {
+			if peerInfo != nil {
+				cont.receivedHaves(peerInfo)
+			}
 
-				// Create a slice of pieces sorted by rarity
-				raritySlice := cont.createRaritySlice()
+		case <-cont.haveBatchTimer:
+			cont.flushHaveBatch()
+		case piece := <-cont.rxChans.peer.badPiece:
+			log.Printf("Controller : Run (Bad Piece) : Piece %x from %s failed its hash check, requesting it again", piece.pieceNum, piece.peerName)
+			cont.discardBadPiece(piece)
+		// === END OF MESSAGES FROM PEER ===
 
-				// Send requests to the peer
+		case wanted := <-cont.wanted:
+			cont.setWantedPieces(wanted, false)
 
-				cont.sendRequestsToPeer(peerInfo, raritySlice)
+		case reply := <-cont.snapshot:
+			reply <- cont.dumpSwarm()
 
-			}
-		// === END OF MESSAGES FROM PEER ===
+		case s := <-cont.subscribe:
+			cont.subscribeAvailability(s)
+		case <-cont.availabilityTick():
+			cont.flushAvailability()
 
 		case <-cont.quit:
 			return
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 )
@@ -195,17 +198,15 @@ func TestRaritySeveralValues(t *testing.T) {
 func createTestController() *Controller {
 	// Initialize the slice of pieces that have been supposedly downloaded
 	finishedPieces := []bool{true, false, false, false, false, false, false, false, false, true}
-	pieceHashes := make([][]byte, len(finishedPieces))
-	/*
-		// Populate the pieceHashes with some dummy values
-		for i := range pieceHashes {
-			pieceHashes[i] = make([]byte, 1)
-			pieceHashes[i][0] = byte(i)
-		}
-	*/
+	pieceHashes := PieceHashes(make([]byte, len(finishedPieces)*sha1.Size))
 
 	// Create stubs and channels for DiskIO, PeerManager, and Peer
-	diskIOStub := ControllerDiskIOChans{receivedPiece: make(chan ReceivedPiece)}
+	diskIOStub := ControllerDiskIOChans{
+		receivedPiece:    make(chan ReceivedPiece),
+		unconfirmedPiece: make(chan ReceivedPiece),
+		tighten:          make(chan struct{}),
+		lostPieces:       make(chan []int),
+	}
 	peerManagerStub := ControllerPeerManagerChans{
 		newPeer:  make(chan PeerComms),
 		deadPeer: make(chan string),
@@ -214,10 +215,14 @@ func createTestController() *Controller {
 	peerStub := PeerControllerChans{
 		chokeStatus: make(chan PeerChokeStatus),
 		havePiece:   make(chan chan HavePiece),
+		badPiece:    make(chan BadPiece),
 	}
 
-	// Create the controller and return it
-	return NewController(finishedPieces, pieceHashes, diskIOStub, peerManagerStub, peerStub)
+	// Create the controller and return it. Requests are sent for every
+	// have, so the tests don't wait for batches of them.
+	cont := NewController(finishedPieces, pieceHashes, diskIOStub, peerManagerStub, peerStub)
+	cont.haveBatchWindow = 0
+	return cont
 }
 
 func TestControllerRunStop(t *testing.T) {
@@ -612,7 +617,7 @@ func TestControllerTwoPeersDownloadingSamePieceAndOneFinishes(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 
 	// Inform controller that piece1 was finished by peer1
-	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{1, peer1Name}
+	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{pieceNum: 1, peerName: peer1Name}
 
 	// Confirm that peer2 is told to cancel piece number 1
 	assertCancelReceived(t, peer2Comms.chans.cancelPiece, 1)
@@ -671,3 +676,550 @@ func TestShuffle(t *testing.T) {
 		}
 	}
 }
+
+func TestControllerCompleted(t *testing.T) {
+	// The completed channel is closed when the last piece is received, but
+	// not when the download was already complete at startup
+	cont := createTestController()
+	for pieceNum := range cont.finishedPieces {
+		cont.finishedPieces[pieceNum] = true
+	}
+	cont.updateCompletedFlagIfFinished(false)
+	select {
+	case <-cont.completed:
+		// PASS
+	default:
+		t.Errorf("Completed channel was not closed after the last piece was received.")
+	}
+
+	finishedPieces := []bool{true, true}
+	cont = NewController(finishedPieces, PieceHashes(make([]byte, len(finishedPieces)*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	select {
+	case <-cont.completed:
+		t.Errorf("Completed channel was closed for a download that was already complete.")
+	default:
+		// PASS
+	}
+}
+
+// Once DiskIO tightens behaviour, a piece is only requested from one peer at a
+// time, and a piece waiting to be corroborated is requested from another peer
+func TestControllerTighten(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+	close(cont.rxChans.diskIO.tighten)
+
+	peer1Name := "1.2.3.4:1234"
+	peer1Comms := NewPeerComms(peer1Name, *NewControllerPeerChans())
+	peer2Name := "4.2.2.2:53"
+	peer2Comms := NewPeerComms(peer2Name, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peer1Comms
+	cont.rxChans.peerManager.newPeer <- *peer2Comms
+
+	// Both peers only have pieces 1 and 2
+	bitfield := []bool{false, true, true, false, false, false, false, false, false, false}
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer1Name, bitfield)
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer2Name, bitfield)
+	time.Sleep(10 * time.Millisecond)
+
+	// Only one piece is requested from each peer, and never the same piece
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer1Name, false}
+	request1 := <-peer1Comms.chans.requestPiece
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer2Name, false}
+	request2 := <-peer2Comms.chans.requestPiece
+	if request1.pieceNum == request2.pieceNum {
+		t.Errorf("Piece %d was requested from both peers", request1.pieceNum)
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case request := <-peer1Comms.chans.requestPiece:
+		t.Errorf("Peer1 was asked for a second piece %d", request.pieceNum)
+	default:
+	}
+
+	// peer1's copy needs to be corroborated, so it's requested from peer2
+	// once peer2 has finished its current piece
+	cont.rxChans.diskIO.unconfirmedPiece <- ReceivedPiece{pieceNum: request1.pieceNum, peerName: peer1Name}
+	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{pieceNum: request2.pieceNum, peerName: peer2Name}
+	assertRequestsReceived(t, peer2Comms, map[int]bool{request1.pieceNum: false})
+	select {
+	case request := <-peer1Comms.chans.requestPiece:
+		t.Errorf("Peer1 was asked for piece %d", request.pieceNum)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(cont.quit)
+}
+
+// A piece waiting to be corroborated is requested again from the peer that
+// sent it when no other peer has it
+func TestControllerCorroborateSinglePeer(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+	close(cont.rxChans.diskIO.tighten)
+
+	peerName := "1.2.3.4:1234"
+	peerComms := NewPeerComms(peerName, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peerComms
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peerName, []bool{false, true, false, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peerName, false}
+	assertRequestsReceived(t, peerComms, map[int]bool{1: false})
+
+	cont.rxChans.diskIO.unconfirmedPiece <- ReceivedPiece{pieceNum: 1, peerName: peerName}
+	assertRequestsReceived(t, peerComms, map[int]bool{1: false})
+
+	close(cont.quit)
+}
+
+// A piece imported from the local filesystem cancels the peer that was
+// downloading it
+func TestControllerImportedPiece(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+
+	peerName := "1.2.3.4:1234"
+	peerComms := NewPeerComms(peerName, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peerComms
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peerName, false}
+	time.Sleep(10 * time.Millisecond)
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peerName, []bool{false, true, false, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+
+	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{pieceNum: 1, peerName: importPeerName}
+	assertCancelReceived(t, peerComms.chans.cancelPiece, 1)
+
+	close(cont.quit)
+}
+
+// Pieces that aren't wanted aren't requested, and the download completes
+// once every wanted piece is finished
+func TestControllerWantedPieces(t *testing.T) {
+	cont := createTestController()
+	wanted := []bool{true, true, true, false, false, false, false, false, true, true}
+	cont.setWantedPieces(wanted, true)
+	go cont.Run()
+
+	peer1Name := "1.2.3.4:1234"
+	peer1Comms := NewPeerComms(peer1Name, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peer1Comms
+
+	// peer1 has every piece
+	peer1Bitfield := []bool{true, true, true, true, true, true, true, true, true, true}
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer1Name, peer1Bitfield)
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer1Name, false}
+
+	// Only the wanted pieces 1, 2 and 8 are requested
+	requestsFromController := convertZeroOrMoreRequestsToBitfield(t, peer1Comms.chans.requestPiece, len(peer1Bitfield))
+	expectedRequestsBitfield := []bool{false, true, true, false, false, false, false, false, true, false}
+	assertActualBitfieldMatchesExpected(t, expectedRequestsBitfield, requestsFromController)
+
+	// Wanting piece 3 as well requests it
+	cont.wanted <- []bool{true, true, true, true, false, false, false, false, true, true}
+	requestsFromController = convertZeroOrMoreRequestsToBitfield(t, peer1Comms.chans.requestPiece, len(peer1Bitfield))
+	expectedRequestsBitfield = []bool{false, false, false, true, false, false, false, false, false, false}
+	assertActualBitfieldMatchesExpected(t, expectedRequestsBitfield, requestsFromController)
+
+	close(cont.quit)
+}
+
+// Wanting more pieces after the download completed resumes it, and it can
+// complete again
+func TestControllerWantedPiecesCompleted(t *testing.T) {
+	cont := createTestController()
+	wanted := []bool{true, false, false, false, false, false, false, false, false, true}
+	cont.setWantedPieces(wanted, true)
+	if !cont.downloadComplete {
+		t.Fatal("Expected the download to be complete with only finished pieces wanted")
+	}
+	select {
+	case <-cont.completed:
+		t.Errorf("Completed channel was closed for a download that was already complete.")
+	default:
+	}
+
+	wanted[1] = true
+	cont.setWantedPieces(wanted, false)
+	if cont.downloadComplete {
+		t.Fatal("Expected the download to resume once piece 1 was wanted")
+	}
+	cont.finishedPieces[1] = true
+	cont.updateCompletedFlagIfFinished(false)
+	select {
+	case <-cont.completed:
+	default:
+		t.Errorf("Completed channel was not closed after the last wanted piece was received.")
+	}
+
+	// Completing a second time doesn't close the channel again
+	wanted[2] = true
+	cont.setWantedPieces(wanted, false)
+	cont.finishedPieces[2] = true
+	cont.updateCompletedFlagIfFinished(false)
+	if !cont.downloadComplete {
+		t.Errorf("Expected the download to be complete again")
+	}
+}
+
+// A piece that fails its hash check is requested again from another peer,
+// while a good piece isn't requested again
+func TestControllerBadPiece(t *testing.T) {
+	cont := createTestController()
+	cont.noDuplicateRequests = true
+	go cont.Run()
+
+	peer1Name := "1.2.3.4:1234"
+	peer1Comms := NewPeerComms(peer1Name, *NewControllerPeerChans())
+	peer2Name := "4.2.2.2:53"
+	peer2Comms := NewPeerComms(peer2Name, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peer1Comms
+	cont.rxChans.peerManager.newPeer <- *peer2Comms
+
+	// peer1 has pieces 1 and 2, and is asked for both
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer1Name, []bool{false, true, true, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer1Name, false}
+	assertRequestsReceived(t, peer1Comms, map[int]bool{1: false, 2: false})
+
+	// peer2 only has piece 2, which peer1 is already working on
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer2Name, []bool{false, false, true, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer2Name, false}
+
+	// Piece 1 is good and piece 2 is bad, so only piece 2 is requested
+	// again, and from peer2
+	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{pieceNum: 1, peerName: peer1Name}
+	cont.rxChans.peer.badPiece <- BadPiece{pieceNum: 2, peerName: peer1Name}
+	requests := convertZeroOrMoreRequestsToBitfield(t, peer2Comms.chans.requestPiece, 10)
+	assertActualBitfieldMatchesExpected(t, []bool{false, false, true, false, false, false, false, false, false, false}, requests)
+	requests = convertZeroOrMoreRequestsToBitfield(t, peer1Comms.chans.requestPiece, 10)
+	assertActualBitfieldMatchesExpected(t, make([]bool, 10), requests)
+
+	close(cont.quit)
+}
+
+// A piece that fails its hash check is requested again from the same peer
+// if no other peer has it
+func TestControllerBadPieceOnlyPeer(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+
+	peerName := "1.2.3.4:1234"
+	peerComms := NewPeerComms(peerName, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peerComms
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peerName, []bool{false, true, false, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peerName, false}
+	assertRequestsReceived(t, peerComms, map[int]bool{1: false})
+
+	cont.rxChans.peer.badPiece <- BadPiece{pieceNum: 1, peerName: peerName}
+	assertRequestsReceived(t, peerComms, map[int]bool{1: false})
+
+	close(cont.quit)
+}
+
+// receiveHaves returns the pieces sent to a peer in the next HAVE inner
+// channel from the controller, or nil if none is sent in time
+func receiveHaves(t *testing.T, peerComms *PeerComms) []int {
+	select {
+	case innerChan := <-peerComms.chans.havePiece:
+		pieces := make([]int, 0)
+		for have := range innerChan {
+			pieces = append(pieces, have.pieceNum)
+		}
+		return pieces
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+// A completed piece is announced to every peer that doesn't have it
+func TestControllerBroadcastHave(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+
+	peerNames := []string{"1.2.3.4:1234", "4.2.2.2:53", "8.8.8.8:6881", "9.9.9.9:6881"}
+	peers := make([]*PeerComms, len(peerNames))
+	for i, peerName := range peerNames {
+		peers[i] = NewPeerComms(peerName, *NewControllerPeerChans())
+		cont.rxChans.peerManager.newPeer <- *peers[i]
+		// The initial bitfield has our pieces 0 and 9
+		if haves := receiveHaves(t, peers[i]); len(haves) != 2 {
+			t.Fatalf("Expected the initial bitfield of %s to have 2 pieces, but got %v", peerName, haves)
+		}
+	}
+	// Only the last peer has piece 1
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peerNames[3], []bool{false, true, false, false, false, false, false, false, false, false})
+	time.Sleep(10 * time.Millisecond)
+
+	cont.rxChans.diskIO.receivedPiece <- ReceivedPiece{pieceNum: 1, peerName: peerNames[3]}
+	for i, peerComms := range peers {
+		haves := receiveHaves(t, peerComms)
+		if i == 3 {
+			if haves != nil {
+				t.Errorf("Expected no HAVE for %s, which has the piece, but got %v", peerComms.peerName, haves)
+			}
+		} else if len(haves) != 1 || haves[0] != 1 {
+			t.Errorf("Expected a HAVE for piece 1 to be sent to %s, but got %v", peerComms.peerName, haves)
+		}
+	}
+
+	close(cont.quit)
+}
+
+// Pieces lost on disk are taken back from every peer and downloaded again
+func TestControllerLostPieces(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+
+	peerName := "1.2.3.4:1234"
+	peerComms := NewPeerComms(peerName, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peerComms
+	receiveHaves(t, peerComms)
+	// The peer only has piece 9, which we already have
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peerName, []bool{false, false, false, false, false, false, false, false, false, true})
+	time.Sleep(10 * time.Millisecond)
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peerName, false}
+
+	cont.rxChans.diskIO.lostPieces <- []int{9}
+	select {
+	case innerChan := <-peerComms.chans.havePiece:
+		for have := range innerChan {
+			if have.pieceNum != 9 || !have.lost {
+				t.Errorf("Expected piece 9 to be taken back, but got %+v", have)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected piece 9 to be taken back from %s", peerName)
+	}
+	assertRequestsReceived(t, peerComms, map[int]bool{9: false})
+
+	close(cont.quit)
+}
+
+// addTestPeer adds an unchoked peer with every piece to cont, as the
+// Controller does for a new peer that unchokes us
+func addTestPeer(cont *Controller, peerName string) *PeerInfo {
+	numPieces := len(cont.finishedPieces)
+	chans := ControllerPeerChans{requestPiece: make(chan RequestPiece, numPieces), cancelPiece: make(chan CancelPiece, numPieces)}
+	peerInfo := NewPeerInfo(numPieces, *NewPeerComms(peerName, chans))
+	peerInfo.isChoked = false
+	for pieceNum := range peerInfo.availablePieces {
+		peerInfo.availablePieces[pieceNum] = true
+	}
+	cont.peers[peerName] = peerInfo
+	return peerInfo
+}
+
+// In sequential mode pieces are requested strictly in ascending order, by
+// one peer or spread across several
+func TestControllerSequential(t *testing.T) {
+	const numPieces = 40
+	cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	cont.sequential = true
+	peers := []*PeerInfo{addTestPeer(cont, "1.2.3.4:1234"), addTestPeer(cont, "2.3.4.5:2345")}
+
+	requested := make([]bool, numPieces)
+	highest := -1
+	for step := 0; step < numPieces; step++ {
+		for _, peerInfo := range peers {
+			cont.sendRequestsToPeer(peerInfo, cont.createRaritySlice())
+		}
+		// Pieces requested in this step come after every earlier one
+		for pieceNum, total := range cont.activeRequestsTotals {
+			if total > 0 && !requested[pieceNum] {
+				if pieceNum < highest {
+					t.Fatalf("Piece %d was requested after piece %d", pieceNum, highest)
+				}
+				requested[pieceNum] = true
+				highest = pieceNum
+			}
+		}
+		// The lowest piece in flight completes
+		for pieceNum, total := range cont.activeRequestsTotals {
+			if total > 0 {
+				for _, peerInfo := range peers {
+					if _, ok := peerInfo.activeRequests[pieceNum]; ok {
+						cont.removePieceFromActiveRequests(ReceivedPiece{pieceNum: pieceNum, peerName: peerInfo.peerName})
+					}
+				}
+				cont.finishedPieces[pieceNum] = true
+				break
+			}
+		}
+	}
+	for pieceNum := range requested {
+		if !requested[pieceNum] {
+			t.Errorf("Expected piece %d to be requested", pieceNum)
+		}
+	}
+}
+
+// Rarest first still requests the first and last pieces before the others
+func TestControllerFirstLastPriority(t *testing.T) {
+	const numPieces = 40
+	cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	addTestPeer(cont, "1.2.3.4:1234")
+	// Every other piece is rarer than the first and last
+	addTestPeer(cont, "2.3.4.5:2345").availablePieces[numPieces-1] = true
+	for pieceNum := 1; pieceNum < numPieces-1; pieceNum++ {
+		cont.peers["2.3.4.5:2345"].availablePieces[pieceNum] = false
+	}
+
+	// The first and last pieces are as rare as each other, so either may
+	// come first
+	raritySlice := cont.createRaritySlice()
+	if len(raritySlice) != numPieces || raritySlice[0]+raritySlice[1] != numPieces-1 || raritySlice[0]*raritySlice[1] != 0 {
+		t.Errorf("Expected pieces %d and %d first, but got %v", 0, numPieces-1, raritySlice)
+	}
+	cont.finishedPieces[0] = true
+	raritySlice = cont.createRaritySlice()
+	if len(raritySlice) != numPieces-1 || raritySlice[0] != numPieces-1 {
+		t.Errorf("Expected piece %d first once piece %d is finished, but got %v", numPieces-1, 0, raritySlice)
+	}
+}
+
+// Peers announcing pieces right after another one did are sent requests in
+// one pass at the end of the batch, and a peer announcing pieces later is
+// sent requests right away
+func TestControllerHaveBatch(t *testing.T) {
+	const numPieces = 40
+	cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	clock := newFakeClock()
+	cont.clock = clock
+	cont.lastHavePass = clock.Now().Add(-haveBatchWindow)
+	first := addTestPeer(cont, "1.2.3.4:1234")
+	cont.receivedHaves(first)
+	if len(first.activeRequests) == 0 || cont.haveBatchTimer != nil {
+		t.Fatalf("Expected the first peer to be sent requests right away")
+	}
+
+	batched := []*PeerInfo{addTestPeer(cont, "2.3.4.5:2345"), addTestPeer(cont, "3.4.5.6:3456")}
+	for _, peerInfo := range batched {
+		cont.receivedHaves(peerInfo)
+		if len(peerInfo.activeRequests) != 0 {
+			t.Errorf("Expected %s to wait for the end of the batch, but it was sent requests", peerInfo.peerName)
+		}
+	}
+	if cont.haveBatchTimer == nil {
+		t.Fatalf("Expected a batch to be started")
+	}
+	clock.Advance(haveBatchWindow)
+	<-cont.haveBatchTimer
+	cont.flushHaveBatch()
+	for _, peerInfo := range batched {
+		if len(peerInfo.activeRequests) == 0 {
+			t.Errorf("Expected %s to be sent requests at the end of the batch", peerInfo.peerName)
+		}
+	}
+
+	clock.Advance(2 * haveBatchWindow)
+	later := addTestPeer(cont, "4.5.6.7:4567")
+	cont.receivedHaves(later)
+	if len(later.activeRequests) == 0 || cont.haveBatchTimer != nil {
+		t.Errorf("Expected a peer announcing pieces later to be sent requests right away")
+	}
+}
+
+// benchmarkBitfieldStorm has 200 peers announce their bitfields at once, with
+// requests sent every window. Its time to first request is how long the
+// first peer waited for requests.
+func benchmarkBitfieldStorm(b *testing.B, window time.Duration) {
+	const numPieces, numPeers = 1000, 200
+	var firstRequests time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+		cont.haveBatchWindow = window
+		peers := make([]*PeerInfo, numPeers)
+		for n := range peers {
+			peers[n] = addTestPeer(cont, fmt.Sprintf("10.0.%d.%d:6881", n/256, n%256))
+			for pieceNum := range peers[n].availablePieces {
+				peers[n].availablePieces[pieceNum] = (pieceNum+n)%3 != 0
+			}
+		}
+		b.StartTimer()
+
+		start := time.Now()
+		for n, peerInfo := range peers {
+			cont.receivedHaves(peerInfo)
+			if n == 0 {
+				firstRequests += time.Since(start)
+			}
+		}
+		if cont.haveBatchTimer != nil {
+			cont.flushHaveBatch()
+		}
+	}
+	b.ReportMetric(float64(firstRequests.Nanoseconds())/float64(b.N), "ns/first-request")
+}
+
+func BenchmarkBitfieldStormPerMessage(b *testing.B) {
+	benchmarkBitfieldStorm(b, 0)
+}
+
+func BenchmarkBitfieldStormBatched(b *testing.B) {
+	benchmarkBitfieldStorm(b, haveBatchWindow)
+}
+
+// However fast a peer flaps between choked and unchoked, the controller
+// tags the pieces it gives with the peer's unchokes, and each piece is left
+// counted once as being downloaded
+func TestControllerChokeFlapping(t *testing.T) {
+	cont := createTestController()
+	go cont.Run()
+
+	peer1Name := "1.2.3.4:1234"
+	peer1Comms := NewPeerComms(peer1Name, *NewControllerPeerChans())
+	cont.rxChans.peerManager.newPeer <- *peer1Comms
+	peer1Bitfield := []bool{true, true, false, true, true, false, false, false, true, false}
+	sendBitfieldOverChannel(cont.rxChans.peer.havePiece, peer1Name, peer1Bitfield)
+
+	// The bitfield reaches the controller by the time it's given pieces
+	cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer1Name, false}
+	given := make(map[int][]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case request := <-peer1Comms.chans.requestPiece:
+			given[request.pieceNum] = append(given[request.pieceNum], request.unchokes)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 4 pieces to be given in the first unchoke, but got %d", i)
+		}
+	}
+	for _, isChoked := range []bool{true, false, true, false} {
+		cont.rxChans.peer.chokeStatus <- PeerChokeStatus{peer1Name, isChoked}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := cont.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for done := false; !done; {
+		select {
+		case request := <-peer1Comms.chans.requestPiece:
+			given[request.pieceNum] = append(given[request.pieceNum], request.unchokes)
+		default:
+			done = true
+		}
+	}
+	for _, pieceNum := range []int{1, 3, 4, 8} {
+		// Sent from goroutines, in any order
+		sort.Ints(given[pieceNum])
+		if fmt.Sprint(given[pieceNum]) != "[1 2 3]" {
+			t.Errorf("Expected piece %d to be given once in each of the 3 unchokes, but it was given in %v", pieceNum, given[pieceNum])
+		}
+	}
+	for pieceNum, total := range cont.activeRequestsTotals {
+		expected := 0
+		if _, active := cont.peers[peer1Name].activeRequests[pieceNum]; active {
+			expected = 1
+		}
+		if total != expected {
+			t.Errorf("Expected piece %d to be counted %d times as being downloaded, but it was counted %d times", pieceNum, expected, total)
+		}
+	}
+	if len(cont.peers[peer1Name].activeRequests) != 4 {
+		t.Errorf("Expected the peer to be downloading 4 pieces, but it's downloading %v", cont.peers[peer1Name].activeRequests)
+	}
+}
@@ -0,0 +1,837 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mainline DHT support for trackerless torrents. See BEP 5.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"log"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dhtK                 = 8    // nodes in a bucket, and closest nodes a search ends with
+	dhtAlpha             = 3    // queries in flight at once during a search
+	dhtBufferSize        = 2048 // largest KRPC message read
+	dhtCompactNodeLength = 26   // node ID, IPv4 address and port
+	maxDHTStoredPeers    = 100  // peers announced to us kept for each info hash
+	maxDHTStoredTorrents = 100  // info hashes peers are kept for
+	dhtPingQueue         = 16   // nodes peers told us about waiting to be pinged
+)
+
+// Bit of the reserved bytes of a handshake flagging a DHT node, whose UDP
+// port is sent in a port message
+const (
+	dhtReservedByte = 7
+	dhtReservedBit  = 0x01
+)
+
+// Nodes the DHT is joined through when the routing table is empty
+var dhtBootstrapNodes = []string{"router.bittorrent.com:6881", "router.utorrent.com:6881", "dht.transmissionbt.com:6881"}
+
+// Time a node has to answer a query
+var dhtQueryTimeout = 5 * time.Second
+
+// Interval between searches for peers, which announce us to the nodes
+// closest to the info hash as well
+var dhtSearchInterval = 15 * time.Minute
+
+// Interval between changes of the secret tokens are made from. Tokens made
+// from the previous secret are accepted too.
+var dhtTokenRotation = 5 * time.Minute
+
+// Time after which a node that hasn't been heard from may be replaced by
+// another in its bucket
+var dhtNodeStale = 15 * time.Minute
+
+// KRPC error codes
+const (
+	krpcGenericError  = 201
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+var (
+	errDHTTimeout = errors.New("Timed out waiting for a response")
+	errDHTStopped = errors.New("DHT stopped")
+)
+
+// supportsDHT returns true if the reserved bytes of a handshake flag a DHT
+// node
+func supportsDHT(reserved [8]byte) bool {
+	return reserved[dhtReservedByte]&dhtReservedBit != 0
+}
+
+// sendPort sends the peer the UDP port of our DHT node, if we run one and
+// the peer does too
+func (p *Peer) sendPort() {
+	if p.dhtPort == 0 || !supportsDHT(p.reserved) {
+		return
+	}
+	log.Printf("Peer : sendPort : Sending DHT port %d to %s", p.dhtPort, p.peerName)
+	p.sendMessage(NewPort(p.dhtPort))
+}
+
+// receivedPort queues the DHT node of the peer to be pinged, which adds it to
+// the routing table if it answers
+func (p *Peer) receivedPort(payload []byte) {
+	port, err := ParsePort(payload)
+	if err != nil || port == 0 || p.dhtPings == nil {
+		log.Printf("Ignoring a Port message that was received from %s", p.peerName)
+		return
+	}
+	host, _, err := net.SplitHostPort(p.peerName)
+	if err != nil {
+		log.Printf("Ignoring a Port message that was received from %s: %s", p.peerName, err)
+		return
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(host), Port: int(port)}
+	select {
+	case p.dhtPings <- addr:
+		log.Printf("Peer : receivedPort : Pinging the DHT node of %s at %s", p.peerName, addr)
+	default:
+		log.Printf("Peer : receivedPort : Not pinging the DHT node of %s, too many are waiting", p.peerName)
+	}
+}
+
+// NodeID identifies a node, and is compared with info hashes by XOR distance
+type NodeID [20]byte
+
+func newNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// closer returns true if a is closer to id than b is
+func (id NodeID) closer(a NodeID, b NodeID) bool {
+	for i := range id {
+		da, db := a[i]^id[i], b[i]^id[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix returns the number of leading bits id shares with other
+func (id NodeID) commonPrefix(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+type dhtNode struct {
+	id       NodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+// encodeCompactNodes encodes nodes in compact node info form
+func encodeCompactNodes(nodes []dhtNode) string {
+	b := make([]byte, 0, dhtCompactNodeLength*len(nodes))
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		b = append(b, node.id[:]...)
+		b = append(b, ip...)
+		b = append(b, byte(node.addr.Port>>8), byte(node.addr.Port))
+	}
+	return string(b)
+}
+
+// parseCompactNodes parses nodes in compact node info form
+func parseCompactNodes(s string) ([]dhtNode, error) {
+	if len(s)%dhtCompactNodeLength != 0 {
+		return nil, fmt.Errorf("Nodes of %d bytes aren't compact node info", len(s))
+	}
+	nodes := make([]dhtNode, 0, len(s)/dhtCompactNodeLength)
+	for i := 0; i < len(s); i += dhtCompactNodeLength {
+		var node dhtNode
+		copy(node.id[:], s[i:i+20])
+		ip := net.IPv4(s[i+20], s[i+21], s[i+22], s[i+23])
+		node.addr = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16([]byte(s[i+24 : i+26])))}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// routingTable keeps up to dhtK nodes in each bucket, nodes sharing the same
+// number of leading bits with our own ID going into the same bucket
+type routingTable struct {
+	own     NodeID
+	buckets [160][]dhtNode
+}
+
+func newRoutingTable(own NodeID) *routingTable {
+	return &routingTable{own: own}
+}
+
+// add adds a node we've heard from, or updates when it was last seen. A full
+// bucket only takes the node in place of a stale one.
+func (rt *routingTable) add(node dhtNode) {
+	prefix := rt.own.commonPrefix(node.id)
+	if prefix == len(rt.buckets) {
+		// Our own ID
+		return
+	}
+	bucket := rt.buckets[prefix]
+	for i := range bucket {
+		if bucket[i].id == node.id {
+			bucket[i] = node
+			return
+		}
+	}
+	if len(bucket) < dhtK {
+		rt.buckets[prefix] = append(bucket, node)
+		return
+	}
+	for i := range bucket {
+		if node.lastSeen.Sub(bucket[i].lastSeen) > dhtNodeStale {
+			bucket[i] = node
+			return
+		}
+	}
+}
+
+// remove removes a node that failed to answer
+func (rt *routingTable) remove(id NodeID) {
+	prefix := rt.own.commonPrefix(id)
+	if prefix == len(rt.buckets) {
+		return
+	}
+	bucket := rt.buckets[prefix]
+	for i := range bucket {
+		if bucket[i].id == id {
+			rt.buckets[prefix] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes closest to target, closest first
+func (rt *routingTable) closest(target NodeID, n int) []dhtNode {
+	var nodes []dhtNode
+	for _, bucket := range rt.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return target.closer(nodes[i].id, nodes[j].id) })
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (rt *routingTable) len() int {
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// krpcMessage is a KRPC query, response or error. Only the fields of its
+// type are set.
+type krpcMessage struct {
+	T string                 // transaction ID
+	Y string                 // "q", "r" or "e"
+	Q string                 // method of a query
+	A map[string]interface{} // arguments of a query
+	R map[string]interface{} // values of a response
+	E *krpcError             // error
+}
+
+type krpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+func encodeKRPC(m krpcMessage) ([]byte, error) {
+	dict := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		dict["q"], dict["a"] = m.Q, m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = []interface{}{m.E.Code, m.E.Message}
+	default:
+		return nil, fmt.Errorf("Unknown KRPC message type %q", m.Y)
+	}
+	var b bytes.Buffer
+	err := bencode.Marshal(&b, dict)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeKRPC(data []byte) (krpcMessage, error) {
+	var m krpcMessage
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return m, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return m, errors.New("KRPC message isn't a dictionary")
+	}
+	if m.T, ok = dict["t"].(string); !ok {
+		return m, errors.New("KRPC message has no transaction ID")
+	}
+	m.Y, _ = dict["y"].(string)
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		if m.A, ok = dict["a"].(map[string]interface{}); !ok || m.Q == "" {
+			return m, errors.New("KRPC query has no method or arguments")
+		}
+	case "r":
+		if m.R, ok = dict["r"].(map[string]interface{}); !ok {
+			return m, errors.New("KRPC response has no values")
+		}
+	case "e":
+		list, _ := dict["e"].([]interface{})
+		if len(list) != 2 {
+			return m, errors.New("KRPC error isn't a code and a message")
+		}
+		code, _ := list[0].(int64)
+		message, _ := list[1].(string)
+		m.E = &krpcError{Code: int(code), Message: message}
+	default:
+		return m, fmt.Errorf("Unknown KRPC message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// dictID returns the 20 byte ID under key of a query's arguments or a
+// response's values
+func dictID(dict map[string]interface{}, key string) (NodeID, error) {
+	var id NodeID
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, fmt.Errorf("Invalid %s", key)
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// dictPeers returns the peers in the values of a get_peers response
+func dictPeers(dict map[string]interface{}) []PeerTuple {
+	var peers []PeerTuple
+	values, _ := dict["values"].([]interface{})
+	for _, value := range values {
+		if s, ok := value.(string); ok && len(s) == 6 {
+			peers = append(peers, parseCompactPeers([]byte(s))...)
+		}
+	}
+	return peers
+}
+
+type dhtTransaction struct {
+	addr     *net.UDPAddr
+	response chan krpcMessage
+}
+
+// DHT is a node of the mainline DHT that searches for peers of a torrent,
+// sends them to the PeerManager and announces us to the nodes closest to
+// the torrent
+type DHT struct {
+	id              NodeID
+	infoHash        NodeID
+	port            uint16 // TCP port announced for peers to connect to
+	conn            *net.UDPConn
+	peerChans       trackerPeerChans
+	pings           chan *net.UDPAddr // nodes to ping, from the port messages of peers
+	mutex           sync.Mutex        // guards the fields below
+	table           *routingTable
+	transactions    map[string]*dhtTransaction // queries waiting for a response, by transaction ID
+	nextTransaction uint16
+	secret          []byte                 // tokens handed out are made from it
+	prevSecret      []byte                 // tokens made from it are still accepted
+	stored          map[NodeID][]PeerTuple // peers announced to us, by info hash
+	lifecycle       lifecycle
+	quit            chan struct{}
+}
+
+// NewDHT listens for KRPC messages on UDP port, any free port if 0, and
+// announces port for peers to connect to
+func NewDHT(infoHash []byte, port uint16, peerChans trackerPeerChans) (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+	d := &DHT{id: newNodeID(), port: port, conn: conn, peerChans: peerChans, pings: make(chan *net.UDPAddr, dhtPingQueue), quit: make(chan struct{})}
+	copy(d.infoHash[:], infoHash)
+	d.table = newRoutingTable(d.id)
+	d.transactions = make(map[string]*dhtTransaction)
+	d.stored = make(map[NodeID][]PeerTuple)
+	d.secret = newSecret()
+	return d, nil
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return secret
+}
+
+// Port returns the UDP port the DHT listens on
+func (d *DHT) Port() uint16 {
+	return uint16(d.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Stop stops searching and answering queries, and waits for Run to return
+func (d *DHT) Stop() error {
+	return d.lifecycle.stop(func() {
+		close(d.quit)
+		d.conn.Close()
+	})
+}
+
+// Run answers queries from other nodes and searches for peers every
+// dhtSearchInterval
+func (d *DHT) Run() {
+	if err := d.lifecycle.start(); err != nil {
+		log.Printf("DHT : Run : Not running: %s", err)
+		return
+	}
+	defer d.lifecycle.finish()
+	log.Printf("DHT : Run : Started as node %s on %s", d.id, d.conn.LocalAddr())
+	defer log.Println("DHT : Run : Completed")
+
+	go d.receive()
+	searchTicker := time.NewTicker(dhtSearchInterval)
+	defer searchTicker.Stop()
+	tokenTicker := time.NewTicker(dhtTokenRotation)
+	defer tokenTicker.Stop()
+	searchDone := make(chan struct{})
+	searching := true
+	go d.search(searchDone)
+
+	for {
+		select {
+		case <-searchTicker.C:
+			if !searching {
+				searching = true
+				go d.search(searchDone)
+			}
+		case <-searchDone:
+			searching = false
+		case addr := <-d.pings:
+			go d.ping(addr)
+		case <-tokenTicker.C:
+			d.mutex.Lock()
+			d.prevSecret, d.secret = d.secret, newSecret()
+			d.mutex.Unlock()
+		case <-d.quit:
+			log.Println("DHT : Run : Stopping")
+			if searching {
+				<-searchDone
+			}
+			return
+		}
+	}
+}
+
+// receive reads KRPC messages until the connection is closed, answering
+// queries and handing responses to the queries waiting for them
+func (d *DHT) receive() {
+	buf := make([]byte, dhtBufferSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.quit:
+			default:
+				log.Printf("DHT : receive : Unable to read: %s", err)
+			}
+			return
+		}
+		m, err := decodeKRPC(buf[:n])
+		if err != nil {
+			log.Printf("DHT : receive : Ignoring an invalid message from %s: %s", addr, err)
+			continue
+		}
+		if m.Y == "q" {
+			d.answer(m, addr)
+			continue
+		}
+		d.mutex.Lock()
+		transaction, ok := d.transactions[m.T]
+		d.mutex.Unlock()
+		if !ok || !transaction.addr.IP.Equal(addr.IP) || transaction.addr.Port != addr.Port {
+			continue
+		}
+		select {
+		case transaction.response <- m:
+		default:
+		}
+	}
+}
+
+// ping adds the node at addr to the routing table if it answers a ping
+func (d *DHT) ping(addr *net.UDPAddr) {
+	r, err := d.query(addr, "ping", nil)
+	if err == nil {
+		var id NodeID
+		id, err = dictID(r, "id")
+		if err == nil {
+			d.mutex.Lock()
+			d.table.add(dhtNode{id: id, addr: addr, lastSeen: time.Now()})
+			d.mutex.Unlock()
+			return
+		}
+	}
+	log.Printf("DHT : ping : No answer from %s: %s", addr, err)
+}
+
+// send sends a KRPC message to addr
+func (d *DHT) send(m krpcMessage, addr *net.UDPAddr) error {
+	data, err := encodeKRPC(m)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// query sends a query to addr and returns the values of its response. Our
+// ID is added to the arguments.
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	a := map[string]interface{}{"id": string(d.id[:])}
+	for key, value := range args {
+		a[key] = value
+	}
+	transaction := &dhtTransaction{addr: addr, response: make(chan krpcMessage, 1)}
+	d.mutex.Lock()
+	d.nextTransaction++
+	t := string([]byte{byte(d.nextTransaction >> 8), byte(d.nextTransaction)})
+	d.transactions[t] = transaction
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.transactions, t)
+		d.mutex.Unlock()
+	}()
+
+	err := d.send(krpcMessage{T: t, Y: "q", Q: method, A: a}, addr)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(dhtQueryTimeout)
+	defer timer.Stop()
+	select {
+	case m := <-transaction.response:
+		if m.E != nil {
+			return nil, m.E
+		}
+		return m.R, nil
+	case <-timer.C:
+		return nil, errDHTTimeout
+	case <-d.quit:
+		return nil, errDHTStopped
+	}
+}
+
+// token returns the token a node at ip is given with get_peers responses,
+// made from secret
+func token(ip net.IP, secret []byte) string {
+	h := sha1.New()
+	h.Write(ip.To16())
+	h.Write(secret)
+	return string(h.Sum(nil))
+}
+
+// answer answers a query from another node
+func (d *DHT) answer(m krpcMessage, addr *net.UDPAddr) {
+	reply := func(r map[string]interface{}) {
+		r["id"] = string(d.id[:])
+		d.send(krpcMessage{T: m.T, Y: "r", R: r}, addr)
+	}
+	fail := func(code int, message string) {
+		d.send(krpcMessage{T: m.T, Y: "e", E: &krpcError{Code: code, Message: message}}, addr)
+	}
+	id, err := dictID(m.A, "id")
+	if err != nil {
+		fail(krpcProtocolError, err.Error())
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.table.add(dhtNode{id: id, addr: addr, lastSeen: time.Now()})
+
+	switch m.Q {
+	case "ping":
+		reply(map[string]interface{}{})
+	case "find_node":
+		target, err := dictID(m.A, "target")
+		if err != nil {
+			fail(krpcProtocolError, err.Error())
+			return
+		}
+		reply(map[string]interface{}{"nodes": encodeCompactNodes(d.table.closest(target, dhtK))})
+	case "get_peers":
+		infoHash, err := dictID(m.A, "info_hash")
+		if err != nil {
+			fail(krpcProtocolError, err.Error())
+			return
+		}
+		r := map[string]interface{}{"token": token(addr.IP, d.secret)}
+		if peers := d.stored[infoHash]; len(peers) > 0 {
+			values := make([]interface{}, len(peers))
+			for i, peer := range peers {
+				values[i] = compactPeers([]PeerTuple{peer})
+			}
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeCompactNodes(d.table.closest(infoHash, dhtK))
+		}
+		reply(r)
+	case "announce_peer":
+		infoHash, err := dictID(m.A, "info_hash")
+		if err != nil {
+			fail(krpcProtocolError, err.Error())
+			return
+		}
+		t, _ := m.A["token"].(string)
+		if t != token(addr.IP, d.secret) && (d.prevSecret == nil || t != token(addr.IP, d.prevSecret)) {
+			fail(krpcProtocolError, "Bad token")
+			return
+		}
+		port, _ := m.A["port"].(int64)
+		if implied, _ := m.A["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			fail(krpcProtocolError, "Invalid port")
+			return
+		}
+		d.store(infoHash, PeerTuple{IP: addr.IP, Port: uint16(port)})
+		reply(map[string]interface{}{})
+	default:
+		fail(krpcMethodUnknown, "Method Unknown")
+	}
+}
+
+// store keeps a peer announced to us, replacing the oldest if there are
+// maxDHTStoredPeers already. mutex must be held.
+func (d *DHT) store(infoHash NodeID, peer PeerTuple) {
+	peers, ok := d.stored[infoHash]
+	if !ok && len(d.stored) >= maxDHTStoredTorrents {
+		return
+	}
+	for i := range peers {
+		if peers[i].IP.Equal(peer.IP) && peers[i].Port == peer.Port {
+			peers = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	if len(peers) >= maxDHTStoredPeers {
+		peers = peers[1:]
+	}
+	d.stored[infoHash] = append(peers, peer)
+}
+
+// search joins the DHT through the bootstrap nodes if we know too few nodes,
+// sends the peers of the torrent the closest nodes know to the PeerManager
+// and announces us to them
+func (d *DHT) search(done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	d.mutex.Lock()
+	known := d.table.len()
+	d.mutex.Unlock()
+	if known < dhtK {
+		d.lookup("find_node", d.id, map[string]interface{}{"target": string(d.id[:])}, nil)
+	}
+
+	tokens := make(map[string]string)
+	seen := make(map[string]bool)
+	var found []PeerTuple
+	closest := d.lookup("get_peers", d.infoHash, map[string]interface{}{"info_hash": string(d.infoHash[:])}, func(node dhtNode, r map[string]interface{}) {
+		if t, ok := r["token"].(string); ok {
+			tokens[node.addr.String()] = t
+		}
+		for _, peer := range dictPeers(r) {
+			peerName := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
+			if !seen[peerName] {
+				seen[peerName] = true
+				found = append(found, peer)
+			}
+		}
+	})
+	log.Printf("DHT : search : Found %d peers through %d nodes", len(found), len(closest))
+	for _, peer := range found {
+		select {
+		case d.peerChans.peers <- peer:
+		case <-d.quit:
+			return
+		}
+	}
+
+	announced := 0
+	for _, node := range closest {
+		t, ok := tokens[node.addr.String()]
+		if !ok {
+			continue
+		}
+		_, err := d.query(node.addr, "announce_peer", map[string]interface{}{"info_hash": string(d.infoHash[:]), "port": int(d.port), "token": t, "implied_port": 0})
+		if err != nil {
+			log.Printf("DHT : search : Unable to announce to %s: %s", node.addr, err)
+			continue
+		}
+		announced++
+	}
+	log.Printf("DHT : search : Announced to %d nodes", announced)
+}
+
+// lookup queries the nodes closest to target, dhtAlpha at a time, moving on
+// to the closer nodes they return until the dhtK closest nodes that answered
+// have all been queried. The bootstrap nodes are queried if no nodes are
+// known. handle, if not nil, is called with every response. It returns the
+// nodes that answered, closest first.
+func (d *DHT) lookup(method string, target NodeID, args map[string]interface{}, handle func(node dhtNode, r map[string]interface{})) []dhtNode {
+	type candidate struct {
+		node    dhtNode
+		known   bool // the node's ID is known, bootstrap nodes' aren't
+		queried bool
+		failed  bool
+	}
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	add := func(node dhtNode, known bool) {
+		if seen[node.addr.String()] || (known && node.id == d.id) {
+			return
+		}
+		seen[node.addr.String()] = true
+		candidates = append(candidates, &candidate{node: node, known: known})
+	}
+	d.mutex.Lock()
+	for _, node := range d.table.closest(target, dhtK) {
+		add(node, true)
+	}
+	d.mutex.Unlock()
+	if len(candidates) == 0 {
+		for _, host := range dhtBootstrapNodes {
+			addr, err := net.ResolveUDPAddr("udp4", host)
+			if err != nil {
+				log.Printf("DHT : lookup : Unable to resolve bootstrap node %s: %s", host, err)
+				continue
+			}
+			add(dhtNode{addr: addr}, false)
+		}
+	}
+
+	type result struct {
+		c   *candidate
+		r   map[string]interface{}
+		err error
+	}
+	results := make(chan result)
+	inFlight := 0
+	var answered []dhtNode
+	for {
+		// Nodes whose IDs aren't known are queried first, then the
+		// closest
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if a.known != b.known {
+				return !a.known
+			}
+			return target.closer(a.node.id, b.node.id)
+		})
+		considered := 0
+		for _, c := range candidates {
+			if inFlight >= dhtAlpha || considered >= dhtK {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			considered++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inFlight++
+			go func(c *candidate) {
+				r, err := d.query(c.node.addr, method, args)
+				results <- result{c, r, err}
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		res := <-results
+		inFlight--
+		if res.err == nil {
+			id, err := dictID(res.r, "id")
+			if err != nil {
+				res.err = err
+			} else {
+				res.c.node.id, res.c.known = id, true
+			}
+		}
+		if res.err != nil {
+			res.c.failed = true
+			if res.c.known {
+				d.mutex.Lock()
+				d.table.remove(res.c.node.id)
+				d.mutex.Unlock()
+			}
+			continue
+		}
+		res.c.node.lastSeen = time.Now()
+		answered = append(answered, res.c.node)
+		d.mutex.Lock()
+		d.table.add(res.c.node)
+		d.mutex.Unlock()
+		if nodes, ok := res.r["nodes"].(string); ok {
+			parsed, err := parseCompactNodes(nodes)
+			if err != nil {
+				log.Printf("DHT : lookup : Ignoring the nodes from %s: %s", res.c.node.addr, err)
+			}
+			for _, node := range parsed {
+				add(node, true)
+			}
+		}
+		if handle != nil {
+			handle(res.c.node, res.r)
+		}
+	}
+
+	sort.Slice(answered, func(i, j int) bool { return target.closer(answered[i].id, answered[j].id) })
+	if len(answered) > dhtK {
+		answered = answered[:dhtK]
+	}
+	return answered
+}
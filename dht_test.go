@@ -0,0 +1,329 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// KRPC queries, responses and errors decode to what was encoded, and
+// invalid messages are rejected
+func TestKRPCMessages(t *testing.T) {
+	id := newNodeID()
+	messages := []krpcMessage{
+		{T: "aa", Y: "q", Q: "get_peers", A: map[string]interface{}{"id": string(id[:]), "info_hash": string(id[:])}},
+		{T: "bb", Y: "r", R: map[string]interface{}{"id": string(id[:]), "token": "xyz", "values": []interface{}{"\x7f\x00\x00\x01\x1a\xe1"}}},
+		{T: "cc", Y: "e", E: &krpcError{Code: krpcMethodUnknown, Message: "Method Unknown"}},
+	}
+	for _, m := range messages {
+		data, err := encodeKRPC(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeKRPC(data)
+		if err != nil {
+			t.Fatalf("Unable to decode %q: %s", data, err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("Expected %q to decode to %+v, but got %+v", data, m, decoded)
+		}
+	}
+	r := messages[1].R
+	if peers := dictPeers(r); len(peers) != 1 || !peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || peers[0].Port != 6881 {
+		t.Errorf("Expected peer 127.0.0.1:6881 in the values, but got %v", peers)
+	}
+
+	for _, data := range []string{"", "le", "d1:y1:qe", "d1:t2:aa1:y1:xe", "d1:t2:aa1:y1:qe", "d1:t2:aa1:y1:re", "d1:e" + "li201ee" + "1:t2:aa1:y1:ee"} {
+		if _, err := decodeKRPC([]byte(data)); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+
+	nodes := []dhtNode{{id: newNodeID(), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}}, {id: newNodeID(), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 51413}}}
+	parsed, err := parseCompactNodes(encodeCompactNodes(nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range nodes {
+		if parsed[i].id != nodes[i].id || !parsed[i].addr.IP.Equal(nodes[i].addr.IP) || parsed[i].addr.Port != nodes[i].addr.Port {
+			t.Errorf("Expected node %d to be %v at %s, but got %v at %s", i, nodes[i].id, nodes[i].addr, parsed[i].id, parsed[i].addr)
+		}
+	}
+	if _, err := parseCompactNodes("short"); err == nil {
+		t.Error("Expected nodes of 5 bytes to be rejected")
+	}
+}
+
+// The routing table returns the nodes closest to a target first, and a full
+// bucket only takes a node in place of a stale one
+func TestRoutingTable(t *testing.T) {
+	var own NodeID
+	rt := newRoutingTable(own)
+	now := time.Now()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	// Every node shares no leading bits with our ID, so they share a
+	// bucket
+	for i := 0; i < dhtK+1; i++ {
+		var id NodeID
+		id[0], id[19] = 0x80, byte(i)
+		rt.add(dhtNode{id: id, addr: addr, lastSeen: now})
+	}
+	if rt.len() != dhtK {
+		t.Fatalf("Expected a full bucket of %d nodes, but the table has %d", dhtK, rt.len())
+	}
+	var target NodeID
+	target[0], target[19] = 0x80, 5
+	closest := rt.closest(target, 3)
+	for i, expected := range []byte{5, 4, 7} {
+		if closest[i].id[19] != expected {
+			t.Errorf("Expected node %d to be the closest number %d, but it was %d", expected, i, closest[i].id[19])
+		}
+	}
+
+	var fresh NodeID
+	fresh[0], fresh[19] = 0x80, 0xff
+	rt.add(dhtNode{id: fresh, addr: addr, lastSeen: now.Add(dhtNodeStale + time.Second)})
+	if closest := rt.closest(fresh, 1); closest[0].id != fresh {
+		t.Errorf("Expected node %v to replace a stale node, but the closest is %v", fresh, closest[0].id)
+	}
+	rt.add(dhtNode{id: own, addr: addr, lastSeen: now})
+	rt.remove(fresh)
+	if rt.len() != dhtK-1 {
+		t.Errorf("Expected %d nodes, but the table has %d", dhtK-1, rt.len())
+	}
+}
+
+// mockDHTNode answers the queries it receives with answer, which returns
+// the values of a response, nil to not answer
+type mockDHTNode struct {
+	id      NodeID
+	conn    *net.UDPConn
+	queries chan krpcMessage
+}
+
+func startMockDHTNode(t *testing.T, answer func(m krpcMessage) map[string]interface{}) *mockDHTNode {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &mockDHTNode{id: newNodeID(), conn: conn, queries: make(chan krpcMessage, 10)}
+	go func() {
+		buf := make([]byte, dhtBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m, err := decodeKRPC(buf[:n])
+			if err != nil || m.Y != "q" {
+				continue
+			}
+			node.queries <- m
+			r := answer(m)
+			if r == nil {
+				continue
+			}
+			r["id"] = string(node.id[:])
+			data, _ := encodeKRPC(krpcMessage{T: m.T, Y: "r", R: r})
+			conn.WriteToUDP(data, addr)
+		}
+	}()
+	return node
+}
+
+func (node *mockDHTNode) compact() string {
+	return encodeCompactNodes([]dhtNode{{id: node.id, addr: node.conn.LocalAddr().(*net.UDPAddr)}})
+}
+
+// A search joins the DHT through the bootstrap node, follows the nodes it
+// returns to the ones that know peers, sends the peers to the PeerManager
+// and announces us to the nodes that gave tokens
+func TestDHTGetPeers(t *testing.T) {
+	peers := []PeerTuple{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, {IP: net.IPv4(10, 0, 0, 2), Port: 51413}}
+	withPeer := func(peer PeerTuple, token string) func(m krpcMessage) map[string]interface{} {
+		return func(m krpcMessage) map[string]interface{} {
+			switch m.Q {
+			case "get_peers":
+				return map[string]interface{}{"token": token, "values": []interface{}{compactPeers([]PeerTuple{peer})}}
+			case "announce_peer":
+				return map[string]interface{}{}
+			}
+			return map[string]interface{}{"nodes": ""}
+		}
+	}
+	b := startMockDHTNode(t, withPeer(peers[0], "token-b"))
+	defer b.conn.Close()
+	c := startMockDHTNode(t, withPeer(peers[1], "token-c"))
+	defer c.conn.Close()
+	router := startMockDHTNode(t, func(m krpcMessage) map[string]interface{} {
+		return map[string]interface{}{"nodes": b.compact() + c.compact()}
+	})
+	defer router.conn.Close()
+
+	bootstrapNodes := dhtBootstrapNodes
+	dhtBootstrapNodes = []string{router.conn.LocalAddr().String()}
+	defer func() { dhtBootstrapNodes = bootstrapNodes }()
+
+	peerChans := trackerPeerChans{peers: make(chan PeerTuple, 10)}
+	dht, err := NewDHT(make([]byte, 20), 0, peerChans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.port = 6881
+	go dht.Run()
+	defer dht.Stop()
+
+	found := make(map[string]bool)
+	for len(found) < len(peers) {
+		select {
+		case peer := <-peerChans.peers:
+			found[peer.IP.String()] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for peers, found %v", found)
+		}
+	}
+	for _, node := range []struct {
+		mock  *mockDHTNode
+		token string
+	}{{b, "token-b"}, {c, "token-c"}} {
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case m := <-node.mock.queries:
+				if m.Q != "announce_peer" {
+					continue
+				}
+				if m.A["token"] != node.token || m.A["port"] != int64(6881) {
+					t.Errorf("Expected an announce with token %q and port %d, but got %v", node.token, 6881, m.A)
+				}
+				break wait
+			case <-deadline:
+				t.Fatalf("Timed out waiting for the announce to the node with token %q", node.token)
+			}
+		}
+	}
+	select {
+	case m := <-router.queries:
+		if m.Q != "find_node" {
+			t.Errorf("Expected the bootstrap node to be sent find_node first, but got %s", m.Q)
+		}
+	default:
+		t.Error("Expected the bootstrap node to be queried")
+	}
+}
+
+// Peers announced to us with a valid token are returned by get_peers
+func TestDHTAnswerQueries(t *testing.T) {
+	bootstrapNodes := dhtBootstrapNodes
+	dhtBootstrapNodes = nil
+	defer func() { dhtBootstrapNodes = bootstrapNodes }()
+
+	dht, err := NewDHT(make([]byte, 20), 0, trackerPeerChans{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go dht.Run()
+	defer dht.Stop()
+	client, err := NewDHT(make([]byte, 20), 0, trackerPeerChans{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.receive()
+	defer client.conn.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: dht.conn.LocalAddr().(*net.UDPAddr).Port}
+	id := newNodeID()
+	infoHash := string(id[:])
+	r, err := client.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := r["token"].(string)
+	if _, err := client.query(addr, "announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 6881, "token": "bad"}); err == nil {
+		t.Error("Expected an announce with a bad token to fail")
+	}
+	if _, err := client.query(addr, "announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 6881, "token": token}); err != nil {
+		t.Fatal(err)
+	}
+	r, err = client.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := dictPeers(r); len(peers) != 1 || peers[0].Port != 6881 {
+		t.Errorf("Expected the announced peer, but got %v", peers)
+	}
+	if _, err := client.query(addr, "vote", map[string]interface{}{}); err == nil {
+		t.Error("Expected an unknown method to fail")
+	}
+}
+
+// Peers that run a DHT node are sent our DHT port, and the node in a port
+// message from a peer is queued for a ping, which adds it to the routing
+// table
+func TestPortMessage(t *testing.T) {
+	bootstrapNodes := dhtBootstrapNodes
+	dhtBootstrapNodes = nil
+	defer func() { dhtBootstrapNodes = bootstrapNodes }()
+
+	node := startMockDHTNode(t, func(m krpcMessage) map[string]interface{} {
+		return map[string]interface{}{}
+	})
+	defer node.conn.Close()
+	nodeAddr := node.conn.LocalAddr().(*net.UDPAddr)
+
+	dht, err := NewDHT(make([]byte, 20), 0, trackerPeerChans{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go dht.Run()
+	defer dht.Stop()
+
+	p := NewPeer(fmt.Sprintf("127.0.0.1:%d", nodeAddr.Port+1), make([]byte, 20), 10, 16384, 10*16384, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	p.dhtPort = dht.Port()
+	p.reserved = localReserved(true)
+	pings := make(chan *net.UDPAddr, 1)
+	p.dhtPings = pings
+	go p.sendPort()
+	select {
+	case message := <-p.sendChan:
+		if !bytes.Equal(message, NewPort(dht.Port()).Bytes()) {
+			t.Errorf("Expected a port message for port %d, but got %x", dht.Port(), message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the port message")
+	}
+
+	p.decodeMessage(append([]byte{byte(MsgPort)}, byte(nodeAddr.Port>>8), byte(nodeAddr.Port)))
+	var addr *net.UDPAddr
+	select {
+	case addr = <-pings:
+	default:
+		t.Fatal("Expected the peer's DHT node to be queued for a ping")
+	}
+	if !addr.IP.Equal(nodeAddr.IP) || addr.Port != nodeAddr.Port {
+		t.Errorf("Expected node %s to be queued, but got %s", nodeAddr, addr)
+	}
+
+	dht.pings <- addr
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dht.mutex.Lock()
+		closest := dht.table.closest(node.id, 1)
+		dht.mutex.Unlock()
+		if len(closest) == 1 && closest[0].id == node.id {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the pinged node to be added to the routing table")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -5,15 +5,25 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Default number of workers completing pieces and serving block requests
+const defaultDiskWorkers = 4
+
+// Number of pieces, and of block requests, queued for the workers before
+// peers have to wait
+const diskQueueSize = 16
+
 type diskIOPeerChans struct {
 	// Channels to peers
 	writePiece   chan Piece
@@ -21,272 +31,1080 @@ type diskIOPeerChans struct {
 }
 
 type DiskIO struct {
-	metaInfo  MetaInfo
-	files     []*os.File
-	peerChans diskIOPeerChans
-	contChans ControllerDiskIOChans
-	statsCh   chan int // channel of bytes written to disk
-	quit      chan struct{}
+	// First, to be 64 bit aligned for atomic access on 32 bit platforms
+	diskCounters          diskCounters
+	metaInfo              MetaInfo
+	pieceHashes           PieceHashes       // shares the memory of metaInfo.Info.Pieces
+	downloadDir           string            // absolute path of the directory files are stored in now, guarded by pathsMutex
+	incompleteDir         string            // absolute path of the directory files are downloaded into, and the journal kept in
+	completeDir           string            // absolute path of the directory files are moved to once complete, "" to leave them
+	moveDue               chan struct{}     // signals Run that every wanted piece is verified, buffered
+	moveAbandoned         int32             // set if the files can't be moved to completeDir, accessed atomically
+	payloadMoved          chan PayloadMoved // outcome of moving the files to completeDir, sent without blocking
+	files                 []*os.File
+	paths                 []string // where each file is stored, at its final or partial name, guarded by pathsMutex
+	complete              []bool   // files moved to their final name, guarded by pipelineMutex
+	pathsMutex            sync.Mutex
+	renames               []string // paths files were renamed to relative to downloadDir, "" if not renamed, nil if none was, guarded by renamesMutex
+	renamesMutex          sync.Mutex
+	filesMutex            sync.RWMutex        // guards the entries of files, which are nil until the file is created
+	stamps                []fileStamp         // stamps of the files after DiskIO last changed them, guarded by stampsMutex
+	stampsDirty           []int32             // files written since their stamp was taken, accessed atomically
+	stampsMutex           sync.RWMutex        // held for reading while files are written, and for writing while they're checked
+	fileCompleted         chan FileCompleted  // files completed, sent without blocking
+	verifyProgress        chan VerifyProgress // progress updates from Verify, should be buffered
+	pieces                []bool              // authoritative bitfield of pieces verified on disk
+	piecesMutex           sync.RWMutex        // guards pieces for readers outside the completion pipeline
+	journal               *os.File            // resume journal of finished pieces
+	journalRecords        int                 // records in the journal, guarded by pipelineMutex
+	writing               map[int]int         // pieces being written, by the number of copies, guarded by pipelineMutex
+	durability            int                 // durability policy for piece writes
+	syncEvery             int64               // with DurabilityNone, sync after this many bytes are written, 0 disables
+	unsynced              int64               // bytes written since the last sync
+	allocateMode          AllocateMode        // how files are allocated by Init
+	ioMode                IOMode              // how files are read and written, set before Init
+	maps                  [][]byte            // mappings of the files in IOModeMmap, nil for files that aren't mapped
+	mapsMutex             sync.RWMutex        // held for reading while mappings are accessed, and for writing while they change
+	diskSpace             DiskSpace           // checked for room for the wanted files before allocating them
+	spaceMargin           float64             // free space within this share of the space needed is warned about
+	wantedFiles           []bool              // files to download, nil for every file, see Torrent.SetFileWanted
+	written               []bool              // pieces written during this session
+	unconfirmed           map[int]Piece       // pieces waiting to be corroborated by another peer
+	unconfirmedCopies     map[int]int         // copies received of each piece waiting to be corroborated
+	tightened             bool                // set once the write guard has tripped
+	writeStats            WriteStats
+	writeStatsMutex       sync.Mutex
+	maxWriteAmplification float64           // extra writes allowed as a multiple of the torrent size, 0 disables the guard
+	workers               int               // number of workers completing pieces and serving block requests
+	writeQueue            chan Piece        // pieces waiting for a worker
+	readQueue             chan BlockRequest // block requests waiting for a worker
+	inFlight              int32             // pieces and block requests being processed by a worker, accessed atomically
+	cancelledItems        int32             // queued pieces and block requests dropped by Abort, accessed atomically
+	workersDone           sync.WaitGroup
+	pipelineMutex         sync.Mutex                   // guards the bookkeeping shared by pieces completed concurrently
+	pieceLocks            [pieceLockStripes]sync.Mutex // keep pieces with the same index from being completed concurrently
+	cache                 *readCache                   // cache of verified pieces for serving block requests
+	skipUploadCheck       bool                         // don't hash check pieces read to serve block requests
+	maxServedPieceLength  int                          // blocks of longer pieces aren't served, 0 for no limit
+	rechecks              chan int                     // pieces queued to be checked on disk
+	fullRechecks          chan chan RecheckResult      // requests for a recheck of every piece
+	verification          *VerificationPolicy          // which received pieces are hash checked, may be nil
+	faultHook             func(stage int) error        // called after each completion stage, used by tests
+	storageFault          func(write bool) error       // called before each read or write of the files, used by tests
+	readOnly              bool                         // the files are served from read-only storage, see readonly.go
+	writeRetry            retryPolicy                  // retries of piece writes failing with transient errors
+	readRetry             retryPolicy                  // retries of piece reads failing with transient errors
+	peerChans             diskIOPeerChans
+	contChans             ControllerDiskIOChans
+	statsCh               chan int       // channel of bytes written to disk, negative for pieces lost
+	diskStatsCh           chan DiskStats // snapshots of the disk throughput, consumed by Stats
+	err                   error          // the error that stopped DiskIO, set once before dying is closed
+	errOnce               sync.Once
+	dying                 chan struct{}  // closed when DiskIO stops because of an error
+	pending               sync.WaitGroup // piece writes and block reads in progress
+	drained               chan struct{}  // closed once no piece writes are in progress, stops the completion pipeline
+	completionsDone       chan struct{}  // closed when the completion pipeline has stopped
+	closeErr              error          // error syncing or closing the files, set before done is closed
+	done                  chan struct{}  // closed when Run has finished and the files are closed
+	cancelled             chan struct{}  // closed by Abort, queued work is dropped instead of processed
+	cancelOnce            sync.Once
+	lifecycle             lifecycle
+	quit                  chan struct{}
+}
+
+// VerifyProgress reports how far along Verify is
+type VerifyProgress struct {
+	PiecesChecked int
+	PiecesTotal   int
+	PiecesGood    int
+	Done          bool // set on the final update, when Verify completes or is cancelled
+	Resumed       bool // the pieces were loaded from resume data instead of being checked
+}
+
+// Minimum time between progress updates sent by Verify
+var verifyProgressInterval = 500 * time.Millisecond
+
+// verifyReporter rate limits the progress updates sent by Verify
+type verifyReporter struct {
+	progress VerifyProgress
+	lastSent time.Time
+	ch       chan VerifyProgress
+}
+
+// update records the result of checking a single piece, and sends an update
+// if enough time has passed since the last one.
+func (r *verifyReporter) update(good bool) {
+	r.progress.PiecesChecked++
+	if good {
+		r.progress.PiecesGood++
+	}
+	if time.Since(r.lastSent) >= verifyProgressInterval {
+		r.send()
+	}
+}
+
+// finish sends the final progress update
+func (r *verifyReporter) finish() {
+	r.progress.Done = true
+	r.send()
 }
 
-// checkHash accepts a byte buffer and pieceIndex, computes the SHA-1 hash of
+// send delivers the current progress without ever blocking Verify. If the
+// previous update hasn't been read yet it's replaced by this one, so a slow
+// reader only sees the latest progress, and the final update is always
+// delivered to a buffered channel.
+func (r *verifyReporter) send() {
+	r.lastSent = time.Now()
+	if r.ch == nil {
+		return
+	}
+	select {
+	case r.ch <- r.progress:
+		return
+	default:
+	}
+	// Drop the stale update and try again
+	select {
+	case <-r.ch:
+	default:
+	}
+	select {
+	case r.ch <- r.progress:
+	default:
+	}
+}
+
+// verifyCancelled returns true if DiskIO is shutting down
+func (diskio *DiskIO) verifyCancelled() bool {
+	select {
+	case <-diskio.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkHash accepts a byte buffer and pieceNum, computes the SHA-1 hash of
 // the buffer and returns true or false if it's correct.
-func (diskio *DiskIO) checkHash(buf []byte, pieceIndex int) bool {
+func (diskio *DiskIO) checkHash(buf []byte, pieceNum int) bool {
+	good := checkHash(buf, diskio.pieceHashes.At(pieceNum))
+	diskio.diskCounters.countHash(good)
+	return good
+}
+
+// fileRegion is a contiguous region within a single file
+type fileRegion struct {
+	fileIndex int
+	offset    int64 // offset within the file
+	length    int
+}
+
+// fileLengths returns the length of each file in the torrent
+func (diskio *DiskIO) fileLengths() []int {
+	if len(diskio.metaInfo.Info.Files) == 0 {
+		// Single File Mode
+		return []int{diskio.metaInfo.Info.Length}
+	}
+	// Multiple File Mode
+	lengths := make([]int, len(diskio.metaInfo.Info.Files))
+	for i, file := range diskio.metaInfo.Info.Files {
+		lengths[i] = file.Length
+	}
+	return lengths
+}
+
+// filePath returns the absolute path of a file in the torrent
+func (diskio *DiskIO) filePath(fileIndex int) string {
+	return diskio.filePathIn(diskio.currentDir(), fileIndex)
+}
+
+// filePathIn returns the path of a file in the torrent stored in dir
+func (diskio *DiskIO) filePathIn(dir string, fileIndex int) string {
+	return filepath.Join(dir, diskio.relPath(fileIndex))
+}
+
+// totalLength returns the total length of all files in the torrent
+func (diskio *DiskIO) totalLength() int {
+	total := 0
+	for _, length := range diskio.fileLengths() {
+		total += length
+	}
+	return total
+}
+
+// pieceLength returns the length of a piece, the last piece may be shorter
+// than the others
+func (diskio *DiskIO) pieceLength(pieceNum int) int {
+	length := diskio.totalLength() - pieceNum*diskio.metaInfo.Info.PieceLength
+	if length > diskio.metaInfo.Info.PieceLength {
+		return diskio.metaInfo.Info.PieceLength
+	}
+	return length
+}
+
+// mapRegion maps length bytes starting at offset within the torrent to the
+// regions of the files they're stored in. The files of the torrent are
+// treated as one contiguous stream of bytes, so a region may span several
+// files. The result is truncated at the end of the last file.
+func (diskio *DiskIO) mapRegion(offset int64, length int) []fileRegion {
+	regions := make([]fileRegion, 0, 1)
+	for i, fileLength := range diskio.fileLengths() {
+		if length == 0 {
+			break
+		}
+		if offset >= int64(fileLength) {
+			offset -= int64(fileLength)
+			continue
+		}
+		n := length
+		if int64(n) > int64(fileLength)-offset {
+			n = int(int64(fileLength) - offset)
+		}
+		regions = append(regions, fileRegion{fileIndex: i, offset: offset, length: n})
+		length -= n
+		offset = 0
+	}
+	return regions
+}
+
+// readRegion fills buf with the data starting at offset within the torrent,
+// reading across file boundaries as required. If fewer than len(buf) bytes
+// could be read, io.ErrUnexpectedEOF is returned along with the number of
+// bytes read.
+func (diskio *DiskIO) readRegion(offset int64, buf []byte) (int, error) {
+	if diskio.storageFault != nil {
+		if err := diskio.storageFault(false); err != nil {
+			return 0, err
+		}
+	}
+	diskio.mapsMutex.RLock()
+	defer diskio.mapsMutex.RUnlock()
+	total := 0
+	for _, region := range diskio.mapRegion(offset, len(buf)) {
+		if mapping := diskio.mapping(region.fileIndex); mapping != nil {
+			start := time.Now()
+			err := copyMapped(buf[total:total+region.length], mapping[region.offset:])
+			diskio.diskCounters.countReadAt(start)
+			if err != nil {
+				return total, err
+			}
+			total += region.length
+			continue
+		}
+		file := diskio.file(region.fileIndex)
+		if file == nil {
+			// Nothing has been written to the file yet
+			return total, io.ErrUnexpectedEOF
+		}
+		start := time.Now()
+		n, err := file.ReadAt(buf[total:total+region.length], region.offset)
+		diskio.diskCounters.countReadAt(start)
+		total += n
+		if err == io.EOF {
+			return total, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return total, err
+		}
+	}
+	if total < len(buf) {
+		return total, io.ErrUnexpectedEOF
+	}
+	return total, nil
+}
+
+// mapping returns the mapping of a file, nil if it isn't mapped. mapsMutex
+// must be held.
+func (diskio *DiskIO) mapping(fileIndex int) []byte {
+	if fileIndex >= len(diskio.maps) {
+		return nil
+	}
+	return diskio.maps[fileIndex]
+}
+
+// writeRegion writes data starting at offset within the torrent, writing
+// across file boundaries as required.
+func (diskio *DiskIO) writeRegion(offset int64, data []byte) error {
+	if diskio.readOnly {
+		return ErrReadOnly
+	}
+	if diskio.storageFault != nil {
+		if err := diskio.storageFault(true); err != nil {
+			return err
+		}
+	}
+	regions := diskio.mapRegion(offset, len(data))
+	files := make([]*os.File, len(regions))
+	for i, region := range regions {
+		var err error
+		files[i], err = diskio.createFile(region.fileIndex)
+		if err != nil {
+			return err
+		}
+	}
+	diskio.mapsMutex.RLock()
+	defer diskio.mapsMutex.RUnlock()
+	total := 0
+	for i, region := range regions {
+		n := region.length
+		start := time.Now()
+		if mapping := diskio.mapping(region.fileIndex); mapping != nil {
+			err := copyMapped(mapping[region.offset:], data[total:total+region.length])
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			n, err = files[i].WriteAt(data[total:total+region.length], region.offset)
+			if err != nil {
+				return err
+			}
+		}
+		diskio.diskCounters.countWriteAt(n, start)
+		log.Printf("DiskIO : writeRegion : Wrote %x:%x[%x] to file %s\n", offset, region.offset, n, files[i].Name())
+		total += n
+	}
+	if total < len(data) {
+		return errors.New("Write extends past the end of the torrent")
+	}
+	return nil
+}
+
+// verifyBuffer returns a buffer for verifyPiece, as long as a piece or
+// hashChunkSize, whichever is shorter
+func (diskio *DiskIO) verifyBuffer() []byte {
+	if diskio.metaInfo.Info.PieceLength < hashChunkSize {
+		return make([]byte, diskio.metaInfo.Info.PieceLength)
+	}
+	return make([]byte, hashChunkSize)
+}
+
+// verifyPiece reads a piece from disk a buffer at a time and checks its
+// hash. A piece that extends past the end of its file(s) is reported as not
+// verified.
+func (diskio *DiskIO) verifyPiece(pieceNum int, buf []byte) (bool, error) {
+	length := diskio.pieceLength(pieceNum)
+	offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+	if length <= len(buf) {
+		buf = buf[:length]
+		_, err := diskio.readRegion(offset, buf)
+		if err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return diskio.checkHash(buf, pieceNum), nil
+	}
 	h := sha1.New()
-	h.Write(buf)
-	return bytes.Equal(h.Sum(nil), []byte(diskio.metaInfo.Info.Pieces[pieceIndex:pieceIndex+h.Size()]))
+	for done := 0; done < length; done += len(buf) {
+		if length-done < len(buf) {
+			buf = buf[:length-done]
+		}
+		_, err := diskio.readRegion(offset+int64(done), buf)
+		if err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		h.Write(buf)
+	}
+	good := string(h.Sum(nil)) == diskio.pieceHashes.At(pieceNum)
+	diskio.diskCounters.countHash(good)
+	return good, nil
+}
+
+// VerifyPiece reads a single piece from disk and verifies its SHA-1
+// checksum. It must not be called concurrently with writes to the same
+// piece, use the controller's verifyPiece channel while DiskIO is running.
+func (diskio *DiskIO) VerifyPiece(pieceNum int) (bool, error) {
+	numPieces := diskio.pieceHashes.Len()
+	if pieceNum < 0 || pieceNum >= numPieces {
+		return false, fmt.Errorf("Piece index %d out of range (%d pieces)", pieceNum, numPieces)
+	}
+	length := diskio.pieceLength(pieceNum)
+	for _, region := range diskio.mapRegion(int64(pieceNum)*int64(diskio.metaInfo.Info.PieceLength), length) {
+		if region.fileIndex >= len(diskio.files) {
+			return false, fmt.Errorf("File %d of piece %d is not open", region.fileIndex, pieceNum)
+		}
+		if diskio.file(region.fileIndex) == nil {
+			// Not created yet, nothing of the piece has been written
+			return false, nil
+		}
+		path, err := diskio.currentPath(region.fileIndex)
+		if err != nil {
+			return false, err
+		}
+		_, err = os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+	}
+	return diskio.verifyPiece(pieceNum, diskio.verifyBuffer())
 }
 
 // Verify reads in each file and verifies the SHA-1 checksum of each piece.
-// Return the boolean list pieces that are correct.
-func (diskio *DiskIO) Verify() []bool {
+// Return the boolean list pieces that are correct. Progress is reported on
+// the verifyProgress channel, and verification stops early if DiskIO is
+// shut down. The files and the resume journal are only reconciled with the
+// bitfield once every piece is checked, a cancelled verify leaves them as
+// they were.
+func (diskio *DiskIO) Verify() ([]bool, error) {
 	log.Println("DiskIO : Verify : Started")
 	defer log.Println("DiskIO : Verify : Completed")
 
-	numPieces := len(diskio.metaInfo.Info.Pieces) / 20
+	numPieces := diskio.pieceHashes.Len()
 	finishedPieces := make([]bool, numPieces)
+	buf := diskio.verifyBuffer()
 
-	buf := make([]byte, diskio.metaInfo.Info.PieceLength)
-	var pieceIndex, n int
-	var err error
+	reporter := &verifyReporter{
+		progress: VerifyProgress{PiecesTotal: numPieces},
+		lastSent: time.Now(),
+		ch:       diskio.verifyProgress,
+	}
 
 	log.Printf("Verifying downloaded files")
-	if len(diskio.metaInfo.Info.Files) > 0 {
-		// Multiple File Mode
-		var m int
-		// Iterate over each file
-		for i, _ := range diskio.metaInfo.Info.Files {
-			for offset := int64(0); ; offset += int64(n) {
-				// Read from file at offset, up to buf size or
-				// less if last read was incomplete due to EOF
-				fmt.Printf(".")
-				n, err = diskio.files[i].ReadAt(buf[m:], offset)
-				if err != nil {
-					if err == io.EOF {
-						// Reached EOF. Increment partial read counter by bytes read
-						m += n
-						break
-					}
-					log.Fatal(err)
-				}
-				// We have a full buf, check the hash of buf and
-				// append the result to the finished pieces
-				finishedPieces[(pieceIndex / 20)] = diskio.checkHash(buf, pieceIndex)
-
-				// Reset partial read counter
-				m = 0
-				// Increment piece by the length of a SHA-1 hash (20 bytes)
-				pieceIndex += 20
-			}
+	cancelled := false
+	for pieceNum := 0; pieceNum < numPieces; pieceNum++ {
+		if diskio.verifyCancelled() {
+			cancelled = true
+			break
 		}
-		// If the final iteration resulted in a partial read, then
-		// check the hash of it and append the result
-		if m > 0 {
-			//finishedPieces = append(finishedPieces, diskio.checkHash(buf[:m], pieceIndex))
-			finishedPieces[(pieceIndex / 20)] = diskio.checkHash(buf[:m], pieceIndex)
+		good, err := diskio.verifyPiece(pieceNum, buf)
+		if err != nil {
+			reporter.finish()
+			return nil, err
 		}
-	} else {
-		// Single File Mode
-		for offset := int64(0); ; offset += int64(n) {
-			// Read from file at offset, up to buf size or
-			// less if last read was incomplete due to EOF
-			fmt.Printf(".")
-			n, err = diskio.files[0].ReadAt(buf, offset)
-			if err != nil {
-				if err == io.EOF {
-					// Reached EOF
-					break
-				}
-				log.Fatal(err)
-			}
-			// We have a full buf, check the hash of buf and
-			// append the result to the finished pieces
-			//finishedPieces = append(finishedPieces, diskio.checkHash(buf, pieceIndex))
-			finishedPieces[(pieceIndex / 20)] = diskio.checkHash(buf, pieceIndex)
+		finishedPieces[pieceNum] = good
+		reporter.update(good)
+	}
+	reporter.finish()
+
+	// The Controller keeps its own copy of the bitfield
+	diskio.piecesMutex.Lock()
+	diskio.pieces = make([]bool, numPieces)
+	copy(diskio.pieces, finishedPieces)
+	diskio.piecesMutex.Unlock()
+	if cancelled {
+		// The pieces after the cancellation are unknown rather than missing
+		log.Println("DiskIO : Verify : Cancelled, leaving the files and journal as they are")
+		return finishedPieces, nil
+	}
+	err := diskio.settleFiles()
+	if err != nil {
+		return nil, err
+	}
+	err = diskio.recoverJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	return finishedPieces, nil
+}
 
-			// Increment piece by the length of a SHA-1 hash (20 bytes)
-			pieceIndex += 20
+// journalName returns the file name of the resume journal
+func (diskio *DiskIO) journalName() string {
+	return filepath.Join(diskio.incompleteDir, diskio.metaInfo.Info.Name+".journal")
+}
+
+// recoverJournal reconciles the resume journal with the verified bitfield.
+// The data on disk is authoritative: a journaled piece that no longer
+// verifies is logged and dropped, and the journal is rewritten to match.
+func (diskio *DiskIO) recoverJournal() error {
+	if diskio.journal == nil {
+		return nil
+	}
+	journaled, err := loadJournal(diskio.journalName())
+	if err != nil {
+		log.Printf("DiskIO : recoverJournal : Unable to load journal: %s", err)
+	}
+	for pieceNum := range journaled {
+		if pieceNum >= len(diskio.pieces) || !diskio.pieces[pieceNum] {
+			log.Printf("DiskIO : recoverJournal : WARNING: Journaled piece %x failed verification", pieceNum)
 		}
-		// If the final iteration resulted in a partial read, then compute a hash
-		if n > 0 {
-			//finishedPieces = append(finishedPieces, diskio.checkHash(buf[:n], pieceIndex))
-			finishedPieces[(pieceIndex / 20)] = diskio.checkHash(buf[:n], pieceIndex)
+	}
+	return diskio.compactJournal()
+}
+
+// ByteRange is a range of bytes within a file
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// ErrFileIncomplete is returned when opening a file that isn't completely
+// downloaded
+var ErrFileIncomplete = errors.New("File is incomplete")
+
+// fileCoverage returns the ranges of a file covered by verified pieces, and
+// the number of pieces overlapping the file that aren't verified yet
+func (diskio *DiskIO) fileCoverage(fileIndex int) ([]ByteRange, int, error) {
+	lengths := diskio.fileLengths()
+	if fileIndex < 0 || fileIndex >= len(lengths) {
+		return nil, 0, fmt.Errorf("File index %d out of range (%d files)", fileIndex, len(lengths))
+	}
+	start := int64(0)
+	for _, length := range lengths[:fileIndex] {
+		start += int64(length)
+	}
+	end := start + int64(lengths[fileIndex])
+	pieceLength := int64(diskio.metaInfo.Info.PieceLength)
+
+	diskio.piecesMutex.RLock()
+	defer diskio.piecesMutex.RUnlock()
+
+	ranges := make([]ByteRange, 0)
+	missing := 0
+	for pieceNum := start / pieceLength; pieceNum*pieceLength < end; pieceNum++ {
+		if pieceNum >= int64(len(diskio.pieces)) || !diskio.pieces[pieceNum] {
+			missing++
+			continue
+		}
+		lo, hi := pieceNum*pieceLength, (pieceNum+1)*pieceLength
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		// Merge with the previous range if they're adjacent
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == lo-start {
+			ranges[n-1].Length += hi - lo
+		} else {
+			ranges = append(ranges, ByteRange{Offset: lo - start, Length: hi - lo})
 		}
 	}
-	fmt.Println()
+	return ranges, missing, nil
+}
 
-	return finishedPieces
+// completedFile is a reader over a completed file. It shares the file
+// handle held by DiskIO, so closing it doesn't close the file.
+type completedFile struct {
+	*io.SectionReader
+}
+
+func (f completedFile) Close() error {
+	return nil
+}
+
+// heldFile reads a file through the handle DiskIO holds for it at the time
+// of each read, as the handle is replaced when the file is moved to another
+// filesystem
+type heldFile struct {
+	diskio    *DiskIO
+	fileIndex int
+}
+
+func (f heldFile) ReadAt(p []byte, off int64) (int, error) {
+	f.diskio.filesMutex.RLock()
+	defer f.diskio.filesMutex.RUnlock()
+	file := f.diskio.files[f.fileIndex]
+	if file == nil {
+		return 0, fmt.Errorf("%s isn't open", f.diskio.filePath(f.fileIndex))
+	}
+	return file.ReadAt(p, off)
 }
 
-func checkError(err error) {
+// OpenCompletedFile returns a reader over a file whose pieces have all been
+// verified. The reader uses the file handle held by DiskIO, so it keeps
+// working if the file is renamed or moved. Reads are positional and don't
+// interfere with concurrent piece writes.
+func (diskio *DiskIO) OpenCompletedFile(fileIndex int) (io.ReadSeekCloser, error) {
+	_, missing, err := diskio.fileCoverage(fileIndex)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	if missing > 0 {
+		return nil, fmt.Errorf("%w: %d pieces missing", ErrFileIncomplete, missing)
+	}
+	length := int64(diskio.fileLengths()[fileIndex])
+	return completedFile{io.NewSectionReader(heldFile{diskio, fileIndex}, 0, length)}, nil
+}
+
+// CompletedRanges returns the ranges of a file that are covered by verified
+// pieces
+func (diskio *DiskIO) CompletedRanges(fileIndex int) ([]ByteRange, error) {
+	ranges, _, err := diskio.fileCoverage(fileIndex)
+	return ranges, err
 }
 
 // openOrCreateFile opens the named file or creates it if it doesn't already
-// exist. If successful it returns a file handle that can be used for I/O.
-func openOrCreateFile(name string) (file *os.File) {
-	// Create the file if it doesn't exist
-	if _, err := os.Stat(name); os.IsNotExist(err) {
-		// Create the file and return a handle
-		file, err = os.Create(name)
-		checkError(err)
-	} else {
-		// Open the file and return a handle
-		file, err = os.OpenFile(name, os.O_RDWR, os.ModePerm)
-		checkError(err)
-	}
-	return
-}
-
-func NewDiskIO(metaInfo MetaInfo) *DiskIO {
+// exist, creating any parent directories as required. If successful it
+// returns a file handle that can be used for I/O.
+func openOrCreateFile(name string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(name), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// NewDiskIO creates a DiskIO which stores the files of the torrent in
+// downloadDir. Relative directories are resolved against the current working
+// directory once, here.
+func NewDiskIO(metaInfo MetaInfo, downloadDir string) *DiskIO {
+	if dir, err := filepath.Abs(downloadDir); err == nil {
+		downloadDir = dir
+	}
 	diskio := &DiskIO{
-		metaInfo: metaInfo,
-		statsCh:  make(chan int),
-		quit:     make(chan struct{}),
+		metaInfo:        metaInfo,
+		pieceHashes:     PieceHashes(metaInfo.Info.Pieces),
+		downloadDir:     downloadDir,
+		incompleteDir:   downloadDir,
+		moveDue:         make(chan struct{}, 1),
+		durability:      DurabilitySync,
+		diskSpace:       systemDiskSpace,
+		spaceMargin:     defaultSpaceMargin,
+		workers:         defaultDiskWorkers,
+		writeQueue:      make(chan Piece, diskQueueSize),
+		readQueue:       make(chan BlockRequest, diskQueueSize),
+		rechecks:        make(chan int),
+		statsCh:         make(chan int),
+		diskStatsCh:     make(chan DiskStats, 1),
+		dying:           make(chan struct{}),
+		drained:         make(chan struct{}),
+		completionsDone: make(chan struct{}),
+		done:            make(chan struct{}),
+		cancelled:       make(chan struct{}),
+		writeRetry:      defaultWriteRetry,
+		readRetry:       defaultReadRetry,
+		fullRechecks:    make(chan chan RecheckResult),
+		quit:            make(chan struct{}),
 	}
+	diskio.cache = newReadCache(defaultReadCacheBytes, diskio.readPiece, diskio.queueRecheck)
 	diskio.peerChans.writePiece = make(chan Piece)
 	diskio.peerChans.blockRequest = make(chan BlockRequest)
 	diskio.contChans.receivedPiece = make(chan ReceivedPiece)
+	diskio.contChans.verifyPiece = make(chan VerifyRequest)
+	diskio.contChans.unconfirmedPiece = make(chan ReceivedPiece)
+	diskio.contChans.tighten = make(chan struct{})
+	diskio.contChans.diskError = make(chan error)
+	diskio.contChans.lostPieces = make(chan []int)
+	diskio.contChans.recheck = make(chan []bool)
 	return diskio
 }
 
-func (diskio *DiskIO) writePiece(piece Piece) {
-	offset := piece.index * diskio.metaInfo.Info.PieceLength
+func (diskio *DiskIO) writePiece(piece Piece) error {
+	diskio.cache.invalidate(piece.index)
+	offset := int64(piece.index) * int64(diskio.metaInfo.Info.PieceLength)
+	diskio.stampsMutex.RLock()
+	err := diskio.writeRegion(offset, piece.data)
+	diskio.markWritten(diskio.mapRegion(offset, len(piece.data)))
+	diskio.stampsMutex.RUnlock()
+	// A fill started while the piece was being written may have read a mix
+	// of old and new data
+	diskio.cache.invalidate(piece.index)
+	if err != nil {
+		return err
+	}
+	log.Printf("DiskIO : writePiece : Wrote piece %x[%x]\n", piece.index, len(piece.data))
+	return nil
+}
 
-	if len(diskio.metaInfo.Info.Files) == 0 {
-		// Single file mode
-		n, err := diskio.files[0].WriteAt(piece.data, int64(offset))
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("DiskIO : writePiece: wrote piece %x:%x[%x], file %s\n", piece.index, offset, n, diskio.metaInfo.Info.Name)
-
-	} else {
-		// Multiple file mode
-		for i := 0; i < len(diskio.metaInfo.Info.Files); i++ {
-			if offset > diskio.metaInfo.Info.Files[i].Length {
-				offset -= diskio.metaInfo.Info.Files[i].Length
-			} else {
-
-				var maxWriteCurrentFile int
-				if len(piece.data) < (diskio.metaInfo.Info.Files[i].Length - offset) {
-					maxWriteCurrentFile = len(piece.data)
-				} else {
-					maxWriteCurrentFile = diskio.metaInfo.Info.Files[i].Length - offset
-				}
-
-				//log.Printf("TEMP: len(files): %d, i: %d", len(diskio.files), i)
-				//log.Printf("TEMP: len(data): %d, maxWriteCurrentFile: %d", len(piece.data), maxWriteCurrentFile)
-				//log.Printf("TEMP: offset: %d", offset)
-				//log.Printf("TEMP: file.Length: %d", diskio.metaInfo.Info.Files[i].Length)
-
-				n, err := diskio.files[i].WriteAt(piece.data[:maxWriteCurrentFile], int64(offset))
-				if err != nil {
-					log.Fatal(err)
-				}
-				log.Printf("DiskIO : writePiece: Wrote piece %x:%x[%x], file %s\n", piece.index, offset, n, diskio.metaInfo.Info.Files[i].Path)
-
-				piece.data = piece.data[maxWriteCurrentFile:]
-				offset = 0
-				if len(piece.data) == 0 {
-					break
-				}
+// fail stops DiskIO because of an I/O error and notifies the Controller, so
+// that the torrent stops instead of the whole process. Only the first error
+// is kept.
+func (diskio *DiskIO) fail(err error) {
+	diskio.errOnce.Do(func() {
+		log.Printf("DiskIO : fail : Stopping because of error: %s", err)
+		diskio.err = err
+		close(diskio.dying)
+		go func() {
+			select {
+			case diskio.contChans.diskError <- err:
+			case <-diskio.quit:
 			}
-		}
+		}()
+	})
+}
+
+// Err returns the error that stopped DiskIO, or nil if it hasn't failed
+func (diskio *DiskIO) Err() error {
+	select {
+	case <-diskio.dying:
+		return diskio.err
+	default:
+		return nil
+	}
+}
+
+// Stop stops DiskIO and waits for Run to finish. It returns the error that
+// stopped DiskIO first, if any, or the error syncing and closing the files.
+// If it returns nil every piece that was completed is durably on disk. If
+// Run never started ErrNeverStarted is returned and the files opened by Init
+// are left open.
+func (diskio *DiskIO) Stop() error {
+	if err := diskio.lifecycle.stop(func() { close(diskio.quit) }); err != nil {
+		return err
 	}
+	if err := diskio.Err(); err != nil {
+		return err
+	}
+	return diskio.closeErr
+}
+
+// Abort stops DiskIO like Stop, for removing the torrent, but the piece
+// writes and block reads still queued are cancelled instead of waited for.
+// Only the work already in flight is finished before the files are closed.
+// The pieces cancelled aren't recorded, so they're downloaded again if the
+// torrent is started again.
+func (diskio *DiskIO) Abort() error {
+	diskio.cancelOnce.Do(func() { close(diskio.cancelled) })
+	return diskio.Stop()
+}
 
+// isCancelled returns true once Abort has been called
+func (diskio *DiskIO) isCancelled() bool {
+	select {
+	case <-diskio.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeFiles syncs, unmaps and closes every open file and the journal,
+// returning the first error
+func (diskio *DiskIO) closeFiles() error {
+	err := diskio.syncFiles()
+	unmapErr := diskio.unmapFiles()
+	if err == nil {
+		err = unmapErr
+	}
+	for _, file := range diskio.files {
+		if file == nil {
+			continue
+		}
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if diskio.journal != nil {
+		closeErr := diskio.journal.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
-func (diskio *DiskIO) Init() {
+// Init opens the files of the torrent that exist and allocates the wanted
+// ones according to the allocation mode. Files that don't exist are only
+// created, and allocated, once the first data for them arrives, so Init
+// itself only creates their directories. Files are created with a .part
+// suffix, which is dropped once they're complete. An error is returned if the
+// files can't be allocated, for example when the disk is full, or if there
+// isn't enough free space for the wanted files.
+func (diskio *DiskIO) Init() error {
 	log.Println("DiskIO : Init : Started")
 	defer log.Println("DiskIO : Init : Completed")
 
-	if len(diskio.metaInfo.Info.Files) > 0 {
-		// Multiple File Mode
-		directory := diskio.metaInfo.Info.Name
-		// Create the directory if it doesn't exist
-		if _, err := os.Stat(directory); os.IsNotExist(err) {
-			err = os.Mkdir(directory, os.ModeDir|os.ModePerm)
-			checkError(err)
-		}
-		err := os.Chdir(directory)
-		checkError(err)
-		for _, file := range diskio.metaInfo.Info.Files {
-			// Create any sub-directories if required
-			if len(file.Path) > 1 {
-				directory = filepath.Join(file.Path[:len(file.Path)-1]...)
-				if _, err := os.Stat(directory); os.IsNotExist(err) {
-					err = os.MkdirAll(directory, os.ModeDir|os.ModePerm)
-					checkError(err)
-				}
-			}
-			// Create the file if it doesn't exist
-			name := filepath.Join(file.Path...)
-			diskio.files = append(diskio.files, openOrCreateFile(name))
+	// ParseTorrent refuses such paths, but the metainfo may come from
+	// elsewhere
+	err := diskio.checkPaths()
+	if err != nil {
+		return err
+	}
+	err = diskio.locatePayload()
+	if err != nil {
+		return err
+	}
+	err = diskio.openFiles()
+	if err != nil {
+		return err
+	}
+	if diskio.readOnly {
+		// Nothing is written, so nothing is allocated, mapped or
+		// journaled
+		return diskio.recordStamps()
+	}
+	err = diskio.checkDiskSpace(diskio.wantedFiles)
+	if err != nil {
+		return err
+	}
+
+	for i, length := range diskio.fileLengths() {
+		if !fileWanted(diskio.wantedFiles, i) || diskio.files[i] == nil {
+			// Skipped files are left empty, apart from the slack of
+			// pieces shared with a wanted file
+			continue
 		}
-		err = os.Chdir("..")
-		checkError(err)
-	} else {
-		// Single File Mode
-		diskio.files = append(diskio.files, openOrCreateFile(diskio.metaInfo.Info.Name))
+		err := allocateFile(diskio.files[i], int64(length), diskio.fileAllocateMode())
+		if err != nil {
+			return err
+		}
+	}
+	diskio.mapFiles()
+
+	err = diskio.recordStamps()
+	if err != nil {
+		return err
 	}
+	diskio.journal, err = openJournal(diskio.journalName())
+	return err
 }
 
-func (diskio *DiskIO) readBlock(file *os.File, block BlockInfo, offset int64) []byte {
-	blockData := make([]byte, block.length)
-	n, err := file.ReadAt(blockData, offset)
+// readPiece reads a piece from disk and verifies it, for filling the read
+// cache
+func (diskio *DiskIO) readPiece(pieceNum int) ([]byte, error) {
+	numPieces := diskio.pieceHashes.Len()
+	if pieceNum < 0 || pieceNum >= numPieces {
+		return nil, fmt.Errorf("Piece index %d out of range (%d pieces)", pieceNum, numPieces)
+	}
+	data := make([]byte, diskio.pieceLength(pieceNum))
+	err := diskio.retry(diskio.readRetry, fmt.Sprintf("read of piece %x", pieceNum), func() error {
+		_, err := diskio.readRegion(int64(pieceNum)*int64(diskio.metaInfo.Info.PieceLength), data)
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if !diskio.skipUploadCheck && !diskio.checkHash(data, pieceNum) {
+		// Corrupted on disk since it was verified, the failed read has
+		// the piece rechecked
+		log.Printf("DiskIO : readPiece : Piece %x read to serve peers failed its hash check", pieceNum)
+		return nil, errPieceHashMismatch
 	}
-	log.Printf("DiskIO : readBlock: Read block %x:%x[%x]\n", block.pieceIndex, block.begin, n)
-	return blockData
+	return data, nil
+}
+
+// ReadCacheStats returns the hit and miss counters of the read cache
+func (diskio *DiskIO) ReadCacheStats() ReadCacheStats {
+	return diskio.cache.Stats()
 }
 
-func (diskio *DiskIO) requestBlock(block BlockInfo) BlockResponse {
+// queueRecheck hands a piece that couldn't be read, or was written without
+// being hash checked by a peer that has lost its trust, over to the
+// completion pipeline, which rechecks it
+func (diskio *DiskIO) queueRecheck(pieceNum int) {
+	go func() {
+		select {
+		case diskio.rechecks <- pieceNum:
+		case <-diskio.quit:
+		}
+	}()
+}
+
+// errPieceNotVerified refuses a block of a piece we haven't downloaded and
+// hash checked, or that was lost since
+var errPieceNotVerified = errors.New("Piece isn't verified")
+
+// errPieceTooLong refuses a block request for a piece longer than
+// maxServedPieceLength, which would be read from disk whole for every block
+var errPieceTooLong = errors.New("Piece is too long to serve")
+
+// requestBlock reads a block of a verified piece. The files the piece
+// overlaps are checked for changes by other programs first, and a piece lost
+// to such a change isn't served.
+func (diskio *DiskIO) requestBlock(block BlockInfo, cancel <-chan struct{}) (BlockResponse, error) {
 	log.Println("DiskIO : requestBlock : Started")
 	defer log.Println("DiskIO : requestBlock : Completed")
 
-	offset := int64(int(block.pieceIndex)*diskio.metaInfo.Info.PieceLength + int(block.begin))
-	response := BlockResponse{info: block}
-	if len(diskio.metaInfo.Info.Files) == 0 {
-		// Single File Mode
-		response.data = diskio.readBlock(diskio.files[0], block, offset)
-	} else {
-		// Multiple File Mode
-		for i := 0; i <= len(diskio.metaInfo.Info.Files); i++ {
-			if offset > int64(diskio.metaInfo.Info.Files[i].Length) {
-				offset -= int64(diskio.metaInfo.Info.Files[i].Length)
-			} else {
-				// FIXME: Handle offset with multiple files correctly
-				response.data = diskio.readBlock(diskio.files[i], block, offset)
-				break
-			}
+	pieceNum := int(block.pieceIndex)
+	if pieceNum < 0 || pieceNum >= len(diskio.pieces) {
+		return BlockResponse{}, fmt.Errorf("Piece index %d out of range (%d pieces)", pieceNum, len(diskio.pieces))
+	}
+	diskio.checkFiles(pieceNum)
+	diskio.piecesMutex.RLock()
+	verified := diskio.pieces[pieceNum]
+	diskio.piecesMutex.RUnlock()
+	if !verified {
+		return BlockResponse{}, fmt.Errorf("%w: %x", errPieceNotVerified, pieceNum)
+	}
+	if diskio.maxServedPieceLength > 0 && diskio.pieceLength(pieceNum) > diskio.maxServedPieceLength {
+		return BlockResponse{}, fmt.Errorf("%w: %x is %d bytes", errPieceTooLong, pieceNum, diskio.pieceLength(pieceNum))
+	}
+	offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+	for _, region := range diskio.mapRegion(offset, diskio.pieceLength(pieceNum)) {
+		if diskio.file(region.fileIndex) == nil {
+			return BlockResponse{}, fmt.Errorf("Piece %x is verified, but file %d hasn't been created", pieceNum, region.fileIndex)
 		}
 	}
-	return response
+
+	data, err := diskio.cache.get(int(block.pieceIndex), cancel)
+	if err != nil {
+		return BlockResponse{}, err
+	}
+	end := uint64(block.begin) + uint64(block.length)
+	if end > uint64(len(data)) {
+		return BlockResponse{}, fmt.Errorf("Block %x:%x[%x] extends past the end of the piece", block.pieceIndex, block.begin, block.length)
+	}
+	log.Printf("DiskIO : requestBlock : Read block %x:%x[%x]\n", block.pieceIndex, block.begin, block.length)
+	atomic.AddInt64(&diskio.diskCounters.bytesRead, int64(block.length))
+	return BlockResponse{info: block, data: data[block.begin:end]}, nil
 }
 
 func (diskio *DiskIO) Run() {
+	if err := diskio.lifecycle.start(); err != nil {
+		log.Printf("DiskIO : Run : Not running: %s", err)
+		return
+	}
+	defer diskio.lifecycle.finish()
 	log.Println("DiskIO : Run : Started")
 	defer log.Println("DiskIO : Run : Completed")
 
+	go diskio.runCompletions()
+	go diskio.publishDiskStats()
+	for i := 0; i < diskio.workers; i++ {
+		diskio.workersDone.Add(1)
+		go diskio.runWorker()
+	}
+	defer diskio.shutdown()
+
+	// A piece or block request taken from a peer is held here until there's
+	// room for it in its queue. Nothing more is taken from peers while one is
+	// held, so that peers wait.
+	var heldPiece Piece
+	var heldRequest BlockRequest
+	var writeQueue chan Piece
+	var readQueue chan BlockRequest
+	diskio.checkMoveDue()
 	for {
+		writePiece := diskio.peerChans.writePiece
+		if writeQueue != nil {
+			writePiece = nil
+		}
+		blockRequest := diskio.peerChans.blockRequest
+		if readQueue != nil {
+			blockRequest = nil
+		}
+
 		select {
-		case piece := <-diskio.peerChans.writePiece:
-			go func() {
-				diskio.writePiece(piece)
-				diskio.contChans.receivedPiece <- ReceivedPiece{pieceNum: piece.index, peerName: piece.peerName}
-				diskio.statsCh <- len(piece.data)
-			}()
-		case blockRequest := <-diskio.peerChans.blockRequest:
-			log.Println("Received block request:", blockRequest)
-			go func() {
-				blockRequest.response <- diskio.requestBlock(blockRequest.request)
-			}()
+		case heldPiece = <-writePiece:
+			diskio.pending.Add(1)
+			writeQueue = diskio.writeQueue
+		case writeQueue <- heldPiece:
+			writeQueue = nil
+		case heldRequest = <-blockRequest:
+			log.Println("Received block request:", heldRequest)
+			diskio.pending.Add(1)
+			readQueue = diskio.readQueue
+		case readQueue <- heldRequest:
+			readQueue = nil
+		case reply := <-diskio.fullRechecks:
+			// Nothing more is taken from peers until the recheck is
+			// done, what's held and queued is finished first
+			diskio.finishHeld(writeQueue != nil, heldPiece, false)
+			if readQueue != nil {
+				diskio.refuseHeld(heldRequest, errRechecking)
+			}
+			writeQueue, readQueue = nil, nil
+			reply <- diskio.recheckAll()
+			diskio.checkMoveDue()
+		case <-diskio.moveDue:
+			// Like a recheck, nothing more is taken from peers while the
+			// files move
+			diskio.finishHeld(writeQueue != nil, heldPiece, false)
+			if readQueue != nil {
+				diskio.refuseHeld(heldRequest, errMoving)
+			}
+			writeQueue, readQueue = nil, nil
+			diskio.moveToComplete()
+		case <-diskio.dying:
+			diskio.finishHeld(writeQueue != nil, heldPiece, readQueue != nil)
+			return
 		case <-diskio.quit:
+			diskio.finishHeld(writeQueue != nil, heldPiece, readQueue != nil)
+			return
+		}
+	}
+}
+
+// finishHeld completes a piece held by Run when it stops, since the peer
+// has already handed it over, and drops a held block request
+func (diskio *DiskIO) finishHeld(pieceHeld bool, piece Piece, requestHeld bool) {
+	if pieceHeld {
+		diskio.processPiece(piece)
+		diskio.pending.Done()
+	}
+	if requestHeld {
+		diskio.pending.Done()
+	}
+}
+
+// runWorker completes queued pieces and serves queued block requests until
+// DiskIO has drained
+func (diskio *DiskIO) runWorker() {
+	defer diskio.workersDone.Done()
+	for {
+		select {
+		case piece := <-diskio.writeQueue:
+			atomic.AddInt32(&diskio.inFlight, 1)
+			diskio.processPiece(piece)
+			atomic.AddInt32(&diskio.inFlight, -1)
+			diskio.pending.Done()
+		case request := <-diskio.readQueue:
+			atomic.AddInt32(&diskio.inFlight, 1)
+			diskio.serveBlockRequest(request)
+			atomic.AddInt32(&diskio.inFlight, -1)
+			diskio.pending.Done()
+		case <-diskio.drained:
 			return
 		}
 	}
 }
+
+// serveBlockRequest reads a block and sends it to the peer that requested
+// it. An I/O error stops DiskIO.
+func (diskio *DiskIO) serveBlockRequest(request BlockRequest) {
+	if diskio.isCancelled() {
+		atomic.AddInt32(&diskio.cancelledItems, 1)
+		return
+	}
+	response, err := diskio.requestBlock(request.request, request.cancel)
+	if errors.Is(err, errPieceNotVerified) || errors.Is(err, errPieceTooLong) {
+		// Never serve data we haven't checked, the peer would ban us
+		// for it
+		log.Printf("DiskIO : serveBlockRequest : Refusing block request %v: %s", request.request, err)
+		response = BlockResponse{info: request.request, err: err}
+	} else if err != nil {
+		log.Printf("DiskIO : serveBlockRequest : Unable to serve block request %v: %s", request.request, err)
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			// The files of the torrent can't be read
+			diskio.fail(err)
+			return
+		}
+		// The peer is told, so that it stops counting the request as
+		// being served
+		response = BlockResponse{info: request.request, err: err}
+	}
+	select {
+	case request.response <- response:
+	case <-request.cancel:
+	case <-diskio.quit:
+	}
+}
+
+// DiskQueueStats reports the work waiting for and being processed by the
+// DiskIO workers
+type DiskQueueStats struct {
+	QueuedPieces   int // pieces waiting for a worker
+	QueuedRequests int // block requests waiting for a worker
+	InFlight       int // pieces and block requests being processed
+	Cancelled      int // queued pieces and block requests dropped by Abort
+}
+
+// QueueStats returns the depths of the DiskIO queues
+func (diskio *DiskIO) QueueStats() DiskQueueStats {
+	return DiskQueueStats{
+		QueuedPieces:   len(diskio.writeQueue),
+		QueuedRequests: len(diskio.readQueue),
+		InFlight:       int(atomic.LoadInt32(&diskio.inFlight)),
+		Cancelled:      int(atomic.LoadInt32(&diskio.cancelledItems)),
+	}
+}
+
+// shutdown waits for the queued and in progress piece writes and block
+// reads, stops the workers and the completion pipeline, then syncs and
+// closes the files
+func (diskio *DiskIO) shutdown() {
+	diskio.pending.Wait()
+	close(diskio.drained)
+	diskio.workersDone.Wait()
+	<-diskio.completionsDone
+	diskio.closeErr = diskio.closeFiles()
+	if diskio.closeErr != nil {
+		log.Printf("DiskIO : shutdown : Unable to close files: %s", diskio.closeErr)
+	}
+	close(diskio.done)
+}
@@ -0,0 +1,1132 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// createTestPayload returns numPieces pieces of test data, each of which has
+// distinct content so that a piece written at the wrong offset fails its hash
+func createTestPayload(numPieces, pieceLength int) []byte {
+	data := make([]byte, numPieces*pieceLength)
+	for i := range data {
+		data[i] = byte(i/pieceLength + i%251)
+	}
+	return data
+}
+
+// createTestMetaInfo builds a single file MetaInfo for data
+func createTestMetaInfo(data []byte, pieceLength int) MetaInfo {
+	var metaInfo MetaInfo
+	metaInfo.Info.Name = "payload"
+	metaInfo.Info.Length = len(data)
+	metaInfo.Info.PieceLength = pieceLength
+	for offset := 0; offset < len(data); offset += pieceLength {
+		end := offset + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[offset:end])
+		metaInfo.Info.Pieces += string(h[:])
+	}
+	return metaInfo
+}
+
+// I/O mode of the DiskIOs created by createTestDiskIO
+var testIOMode = IOModeFile
+
+// createTestDiskIO creates an initialized and verified DiskIO downloading
+// into dir, whose channels are buffered so the completion pipeline doesn't
+// need a running Controller or Stats to complete pieces.
+func createTestDiskIO(t *testing.T, dir string, metaInfo MetaInfo) *DiskIO {
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.ioMode = testIOMode
+	diskio.statsCh = make(chan int, 10)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio.Verify()
+	return diskio
+}
+
+// closeTestDiskIO closes all files held by diskio, emulating the process
+// exiting
+func closeTestDiskIO(diskio *DiskIO) {
+	diskio.unmapFiles()
+	for _, file := range diskio.files {
+		file.Close()
+	}
+	diskio.journal.Close()
+}
+
+// setTestFiles switches metaInfo to Multiple File Mode, with files of the
+// given names and lengths in directory name
+func setTestFiles(metaInfo *MetaInfo, name string, files []string, lengths []int) {
+	metaInfo.Info.Name = name
+	metaInfo.Info.Files = metaInfo.Info.Files[:0]
+	for i, file := range files {
+		metaInfo.Info.Files = append(metaInfo.Info.Files, struct {
+			Length int
+			Md5sum string
+			Path   []string
+		}{Length: lengths[i], Path: []string{file}})
+	}
+}
+
+func createTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// A piece that goes through the entire pipeline is written, recorded and
+// announced to both Stats and the Controller
+func TestCompletePiece(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+
+	err := diskio.completePiece(Piece{index: 1, data: data[pieceLength : 2*pieceLength], peerName: "1.2.3.4:1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !diskio.pieces[1] {
+		t.Errorf("Expected piece %d to be set in the bitfield", 1)
+	}
+	select {
+	case piece := <-diskio.contChans.receivedPiece:
+		if piece.pieceNum != 1 || piece.peerName != "1.2.3.4:1234" {
+			t.Errorf("Unexpected ReceivedPiece %v", piece)
+		}
+	default:
+		t.Errorf("Expected the Controller to be notified of piece %d", 1)
+	}
+	select {
+	case n := <-diskio.statsCh:
+		if n != pieceLength {
+			t.Errorf("Expected Stats to be notified of %d bytes, but it was %d", pieceLength, n)
+		}
+	default:
+		t.Errorf("Expected Stats to be notified of piece %d", 1)
+	}
+
+	onDisk := make([]byte, pieceLength)
+	diskio.files[0].ReadAt(onDisk, int64(pieceLength))
+	if !bytes.Equal(onDisk, data[pieceLength:2*pieceLength]) {
+		t.Errorf("Data on disk for piece %d doesn't match what was written", 1)
+	}
+}
+
+// A piece with a bad hash must not be written or announced
+func TestCompletePieceHashMismatch(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+
+	err := diskio.completePiece(Piece{index: 1, data: data[:pieceLength]})
+	if err == nil {
+		t.Fatalf("Expected a piece with corrupt data to fail the pipeline")
+	}
+	if diskio.pieces[1] {
+		t.Errorf("Expected piece %d not to be set in the bitfield", 1)
+	}
+	if len(diskio.contChans.receivedPiece) != 0 || len(diskio.statsCh) != 0 {
+		t.Errorf("Expected a corrupt piece not to be announced")
+	}
+	if diskio.files[0] != nil {
+		t.Errorf("Expected a corrupt piece not to be written, but the file was created")
+	}
+}
+
+// Crash the pipeline after each stage, then restart. In every case the
+// journal, the bitfield and the data on disk must agree, and a piece must
+// never be announced before it's been recorded.
+func TestCompletePieceCrashRecovery(t *testing.T) {
+	errCrash := errors.New("injected crash")
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+
+	for crashStage := stageVerify; crashStage < stageAnnounce; crashStage++ {
+		dir := createTempDir(t)
+		metaInfo := createTestMetaInfo(data, pieceLength)
+
+		diskio := createTestDiskIO(t, dir, metaInfo)
+		diskio.faultHook = func(stage int) error {
+			if stage == crashStage {
+				return errCrash
+			}
+			return nil
+		}
+		err := diskio.completePiece(Piece{index: 2, data: data[2*pieceLength:]})
+		if err == nil {
+			t.Errorf("Expected the pipeline to be aborted after the %s stage", stageNames[crashStage])
+		}
+		if len(diskio.contChans.receivedPiece) != 0 || len(diskio.statsCh) != 0 {
+			t.Errorf("Piece was announced after a crash in the %s stage", stageNames[crashStage])
+		}
+		closeTestDiskIO(diskio)
+
+		// Restart
+		diskio = createTestDiskIO(t, dir, metaInfo)
+		journaled, err := loadJournal(diskio.journalName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pieceNum, finished := range diskio.pieces {
+			_, inJournal := journaled[pieceNum]
+			if finished != inJournal {
+				t.Errorf("After a crash in the %s stage, piece %d is %t in the bitfield but %t in the journal", stageNames[crashStage], pieceNum, finished, inJournal)
+			}
+		}
+		// Once the piece has been written it must survive the restart
+		expected := crashStage >= stageWrite
+		if diskio.pieces[2] != expected {
+			t.Errorf("After a crash in the %s stage, expected piece %d to be %t but it was %t", stageNames[crashStage], 2, expected, diskio.pieces[2])
+		}
+		closeTestDiskIO(diskio)
+		os.RemoveAll(dir)
+	}
+}
+
+// A torn record at the end of the journal is ignored
+func TestLoadJournalPartialRecord(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.journal")
+	journal, err := openJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	appendJournal(journal, journalPieceDone, 7)
+	journal.Write([]byte{journalPieceDone, 0, 0})
+
+	done, err := loadJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := done[7]; !ok || len(done) != 1 {
+		t.Errorf("Expected only piece %d in the journal, but found %v", 7, done)
+	}
+}
+
+// A piece started but never recorded as done is rechecked at startup, even
+// though the resume data says it's verified
+func TestJournalStartedPieceRechecked(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	for pieceNum := 0; pieceNum < 2; pieceNum++ {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Crash while piece 1 is written again, tearing it
+	diskio.pipelineMutex.Lock()
+	err := diskio.journalStarted(1)
+	diskio.pipelineMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = diskio.files[0].WriteAt(make([]byte, 100), int64(pieceLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTestDiskIO(diskio)
+
+	diskio = NewDiskIO(metaInfo, dir)
+	err = diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	err = diskio.Resume([]bool{true, true, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diskio.pieces[0] || diskio.pieces[1] {
+		t.Errorf("Expected only piece 0 to survive the restart, but the bitfield was %v", diskio.pieces)
+	}
+	done, started, err := readJournal(diskio.journalName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := done[1]; ok || len(started) != 0 {
+		t.Errorf("Expected the journal to be rewritten to match the bitfield, but found %v done and %v started", done, started)
+	}
+}
+
+// The journal is compacted rather than growing with every write
+func TestJournalCompaction(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+
+	diskio.pipelineMutex.Lock()
+	for i := 0; i < 3*journalCompactSlack; i++ {
+		diskio.journalStarted(i % 3)
+		diskio.journalDone(i % 3)
+	}
+	diskio.journalStarted(2)
+	diskio.pipelineMutex.Unlock()
+
+	info, err := os.Stat(diskio.journalName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int64((len(diskio.pieces) + journalCompactSlack + 1) * journalRecordSize)
+	if info.Size() > limit {
+		t.Errorf("Expected the journal to be at most %d bytes, but it was %d", limit, info.Size())
+	}
+	_, started, err := readJournal(diskio.journalName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := started[2]; !ok || len(started) != 1 {
+		t.Errorf("Expected only piece 2 to be in flight, but found %v", started)
+	}
+}
+
+// Verify must not block when nobody reads its progress, and the final update
+// must always be delivered
+func TestVerifyProgress(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(10, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	// Only the first four pieces are on disk
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data[:4*pieceLength], 0644)
+
+	// Send an update for every piece, none of which are read
+	interval := verifyProgressInterval
+	verifyProgressInterval = 0
+	defer func() { verifyProgressInterval = interval }()
+
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.verifyProgress = make(chan VerifyProgress, 1)
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	diskio.Verify()
+
+	select {
+	case progress := <-diskio.verifyProgress:
+		expected := VerifyProgress{PiecesChecked: 10, PiecesTotal: 10, PiecesGood: 4, Done: true}
+		if progress != expected {
+			t.Errorf("Expected final progress %+v, but it was %+v", expected, progress)
+		}
+	default:
+		t.Errorf("Expected the final progress update to be delivered")
+	}
+}
+
+// A cancelled Verify still delivers a final update
+func TestVerifyProgressCancelled(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(10, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.verifyProgress = make(chan VerifyProgress, 1)
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	close(diskio.quit)
+	diskio.Verify()
+
+	select {
+	case progress := <-diskio.verifyProgress:
+		if !progress.Done || progress.PiecesChecked == progress.PiecesTotal {
+			t.Errorf("Expected a final progress update for a cancelled verify, but it was %+v", progress)
+		}
+	default:
+		t.Errorf("Expected the final progress update to be delivered")
+	}
+}
+
+// A cancelled Verify leaves the journaled pieces it didn't get to alone
+func TestVerifyCancelledKeepsJournal(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	for pieceNum := 0; pieceNum < 3; pieceNum++ {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestDiskIO(diskio)
+
+	diskio = NewDiskIO(metaInfo, dir)
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	close(diskio.quit)
+	_, err = diskio.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _, err := readJournal(diskio.journalName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 3 {
+		t.Errorf("Expected the journal to keep all 3 pieces after a cancelled verify, but found %v", done)
+	}
+}
+
+// Recheck individual pieces, including one that was corrupted on disk after
+// the initial verify
+func TestVerifyPiece(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	diskio.files[0].WriteAt([]byte{0xff, 0xff}, int64(pieceLength)+10)
+
+	for pieceNum, expected := range []bool{true, false, true} {
+		good, err := diskio.VerifyPiece(pieceNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if good != expected {
+			t.Errorf("Expected piece %d to verify as %t, but it was %t", pieceNum, expected, good)
+		}
+	}
+
+	for _, pieceNum := range []int{-1, 3} {
+		if _, err := diskio.VerifyPiece(pieceNum); err == nil {
+			t.Errorf("Expected an error verifying out of range piece %d", pieceNum)
+		}
+	}
+}
+
+// A file that has been removed from disk is reported as an error
+func TestVerifyPieceMissingFile(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	// A file that hasn't been created yet has no pieces
+	if good, err := diskio.VerifyPiece(0); good || err != nil {
+		t.Errorf("Expected a piece of a file not created yet not to verify, but got %t, %v", good, err)
+	}
+	err := diskio.completePiece(Piece{index: 1, data: data[pieceLength:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, metaInfo.Info.Name+partSuffix))
+	if _, err := diskio.VerifyPiece(0); err == nil {
+		t.Errorf("Expected an error verifying a piece of a missing file")
+	}
+}
+
+// Pieces that span file boundaries in Multiple File Mode are verified, and
+// blocks are read across the boundary
+func TestVerifyPieceMultiFile(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "multi", []string{"a", "empty", "b", "c"}, []int{1000, 0, 1500, len(data) - 2500})
+
+	os.Mkdir(filepath.Join(dir, "multi"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "multi", "a"), data[:1000], 0644)
+	ioutil.WriteFile(filepath.Join(dir, "multi", "b"), data[1000:2500], 0644)
+	ioutil.WriteFile(filepath.Join(dir, "multi", "c"), data[2500:], 0644)
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	for pieceNum, finished := range diskio.pieces {
+		if !finished {
+			t.Errorf("Expected piece %d to be verified", pieceNum)
+		}
+		if good, err := diskio.VerifyPiece(pieceNum); !good || err != nil {
+			t.Errorf("Expected piece %d to recheck as good, got %t, %v", pieceNum, good, err)
+		}
+	}
+
+	response, err := diskio.requestBlock(BlockInfo{pieceIndex: 0, begin: 900, length: 124}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.data, data[900:1024]) {
+		t.Errorf("Block read across a file boundary doesn't match the payload")
+	}
+}
+
+// Rechecks requested over the channel while DiskIO is running update the
+// bitfield
+func TestVerifyPieceRequest(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	diskio.files[0].WriteAt([]byte{0xff}, 0)
+
+	responseCh := make(chan VerifyResponse)
+	diskio.contChans.verifyPiece <- VerifyRequest{pieceNum: 0, response: responseCh}
+	response := <-responseCh
+	if response.err != nil || response.good {
+		t.Errorf("Expected piece %d to fail its recheck, got %+v", 0, response)
+	}
+
+	diskio.contChans.verifyPiece <- VerifyRequest{pieceNum: 1, response: responseCh}
+	response = <-responseCh
+	if response.err != nil || !response.good {
+		t.Errorf("Expected piece %d to pass its recheck, got %+v", 1, response)
+	}
+
+	if diskio.pieces[0] || !diskio.pieces[1] {
+		t.Errorf("Expected the bitfield to reflect the recheck, but it was %v", diskio.pieces)
+	}
+}
+
+// Block requests for pieces that were never downloaded, or were lost to a
+// change by another program, are answered with an error instead of data
+func TestRefuseUnverifiedBlocks(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	diskio.statsCh = make(chan int, 2)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 1)
+	diskio.contChans.lostPieces = make(chan []int, 1)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	request := func(pieceNum int) BlockResponse {
+		responseCh := make(chan BlockResponse)
+		diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: uint32(pieceNum), begin: 0, length: 16}, response: responseCh}
+		select {
+		case response := <-responseCh:
+			return response
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a response to the request for a block of piece %d", pieceNum)
+		}
+		return BlockResponse{}
+	}
+
+	if response := request(1); !errors.Is(response.err, errPieceNotVerified) || response.data != nil {
+		t.Errorf("Expected a block of a piece never downloaded to be refused, but got %+v", response)
+	}
+
+	result := make(chan error, 1)
+	diskio.peerChans.writePiece <- Piece{index: 1, data: data[pieceLength:], peerName: "10.0.0.1:6881", result: result}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if response := request(1); response.err != nil || !bytes.Equal(response.data, data[pieceLength:pieceLength+16]) {
+		t.Errorf("Expected the block to be served once the piece was verified, but got %+v", response)
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(diskio.file(0).Name(), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if response := request(1); !errors.Is(response.err, errPieceNotVerified) || response.data != nil {
+		t.Errorf("Expected a block of a piece changed on disk to be refused, but got %+v", response)
+	}
+	if diskio.verifiedPieces()[1] {
+		t.Errorf("Expected the changed piece to no longer be verified")
+	}
+}
+
+// A piece corrupted on disk without its file changing is caught when it's
+// read to serve a block, its blocks are refused and it's lost
+func TestRefuseCorruptBlocks(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	diskio.contChans.lostPieces = make(chan []int, 1)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	if err := diskio.completePiece(Piece{index: 1, data: data[pieceLength:]}); err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit of the piece, keeping the modification time of the file
+	file := diskio.file(0)
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{data[pieceLength+100] ^ 1}, int64(pieceLength+100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file.Name(), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unless the check is skipped
+	diskio.skipUploadCheck = true
+	if _, err := diskio.readPiece(1); err != nil {
+		t.Errorf("Expected the piece to be read without a hash check, but got %v", err)
+	}
+	diskio.skipUploadCheck = false
+
+	for i := 0; i < 2; i++ {
+		response, err := diskio.requestBlock(BlockInfo{pieceIndex: 1, begin: 0, length: 16}, nil)
+		if err == nil || response.data != nil {
+			t.Fatalf("Expected a block of a corrupt piece to be refused, but got %+v", response)
+		}
+		if i == 0 && !errors.Is(err, errPieceHashMismatch) {
+			t.Errorf("Expected %v, but got %v", errPieceHashMismatch, err)
+		}
+		if i == 0 {
+			select {
+			case lost := <-diskio.contChans.lostPieces:
+				if len(lost) != 1 || lost[0] != 1 {
+					t.Errorf("Expected piece %d to be lost, but got %v", 1, lost)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the Controller to be told the piece was lost")
+			}
+		}
+	}
+	if diskio.verifiedPieces()[1] {
+		t.Errorf("Expected the corrupt piece to no longer be verified")
+	}
+}
+
+// A small file which has been completed can be extracted from a torrent that
+// is otherwise half done
+func TestOpenCompletedFile(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "multi", []string{"info.nfo", "video"}, []int{300, len(data) - 300})
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	torrent := &Torrent{metaInfo: metaInfo, diskIO: diskio}
+
+	for _, pieceNum := range []int{0, 2} {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := torrent.OpenCompletedFile(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extracted, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extracted, data[:300]) {
+		t.Errorf("Extracted file doesn't match the payload")
+	}
+
+	_, err = torrent.OpenCompletedFile(1)
+	if !errors.Is(err, ErrFileIncomplete) {
+		t.Errorf("Expected %v opening an incomplete file, but it was %v", ErrFileIncomplete, err)
+	}
+
+	expected := []ByteRange{{0, 724}, {1748, 1024}}
+	ranges := torrent.CompletedRanges(1)
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected completed ranges %v, but they were %v", expected, ranges)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Errorf("Expected completed ranges %v, but they were %v", expected, ranges)
+		}
+	}
+}
+
+// Two torrents with the same name downloading into different directories at
+// the same time don't interfere, and the working directory is never changed
+func TestDiskIODownloadDirs(t *testing.T) {
+	cwd, _ := os.Getwd()
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	dirs := []string{createTempDir(t), createTempDir(t)}
+	for _, dir := range dirs {
+		defer os.RemoveAll(dir)
+	}
+
+	done := make(chan error)
+	for i, dir := range dirs {
+		go func(i int, dir string) {
+			metaInfo := createTestMetaInfo(data, pieceLength)
+			setTestFiles(&metaInfo, "multi", []string{"a", "b"}, []int{1500, len(data) - 1500})
+			metaInfo.Info.Files[1].Path = []string{"sub", "b"}
+			diskio := NewDiskIO(metaInfo, dir)
+			diskio.allocateMode = AllocateSparse
+			diskio.statsCh = make(chan int, 10)
+			diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+			err := diskio.Init()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer closeTestDiskIO(diskio)
+			diskio.Verify()
+			// Each torrent writes every other piece
+			for pieceNum := i; pieceNum < 4; pieceNum += 2 {
+				err = diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+				if err != nil {
+					break
+				}
+			}
+			done <- err
+		}(i, dir)
+	}
+	for range dirs {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dir, _ := os.Getwd(); dir != cwd {
+		t.Errorf("Working directory changed from %s to %s", cwd, dir)
+	}
+	for i, dir := range dirs {
+		// Neither file is complete
+		a, _ := ioutil.ReadFile(filepath.Join(dir, "multi", "a"+partSuffix))
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "multi", "sub", "b"+partSuffix))
+		onDisk := append(a, b...)
+		for pieceNum := 0; pieceNum < 4; pieceNum++ {
+			offset := pieceNum * pieceLength
+			written := pieceNum%2 == i
+			if written && (len(onDisk) < offset+pieceLength || !bytes.Equal(onDisk[offset:offset+pieceLength], data[offset:offset+pieceLength])) {
+				t.Errorf("Piece %d of the torrent in %s doesn't match the payload", pieceNum, dir)
+			}
+		}
+	}
+}
+
+// A file that becomes read-only mid-download stops DiskIO and moves the
+// Controller to its failed state, instead of killing the process
+func TestDiskIOWriteError(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+	cont := NewController(make([]bool, 3), pieceHashes, ControllerDiskIOChans{diskError: diskio.contChans.diskError}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	go cont.Run()
+	defer close(cont.quit)
+	go diskio.Run()
+
+	diskio.peerChans.writePiece <- Piece{index: 0, data: data[:pieceLength], peerName: "1.2.3.4:1234"}
+	<-diskio.contChans.receivedPiece
+
+	// Make the file read-only. The handle is reopened as well, since an
+	// open handle can still be written and root ignores permissions.
+	name := diskio.partPath(0)
+	os.Chmod(name, 0444)
+	diskio.files[0].Close()
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio.files[0] = file
+
+	diskio.peerChans.writePiece <- Piece{index: 1, data: data[pieceLength : 2*pieceLength], peerName: "1.2.3.4:1234"}
+	select {
+	case <-cont.failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the Controller to fail")
+	}
+	if diskio.pieces[1] {
+		t.Errorf("Expected piece %d not to be recorded after a failed write", 1)
+	}
+
+	err = diskio.Stop()
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("Expected Stop to return the write error, but it was %v", err)
+	}
+}
+
+// Every piece handed to DiskIO before Stop is on disk once Stop returns, and
+// the files are closed
+func TestDiskIOStopFlushesWrites(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	numPieces := 8
+	data := createTestPayload(numPieces, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	diskio.statsCh = make(chan int)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece)
+	go diskio.Run()
+
+	for i := 0; i < numPieces; i++ {
+		diskio.peerChans.writePiece <- Piece{index: i, data: data[i*pieceLength : (i+1)*pieceLength], peerName: "1.2.3.4:1234"}
+	}
+	err := diskio.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < numPieces; i++ {
+		if !diskio.pieces[i] {
+			t.Errorf("Expected piece %d to be recorded before Stop returned", i)
+		}
+	}
+	onDisk, err := ioutil.ReadFile(diskio.filePath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDisk, data) {
+		t.Errorf("Data on disk doesn't match what was written")
+	}
+	_, err = diskio.files[0].Write([]byte{0})
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected the file to be closed, but writing to it returned %v", err)
+	}
+}
+
+// With DurabilityNone files are synced every syncEvery bytes
+func TestSyncEvery(t *testing.T) {
+	diskio := &DiskIO{durability: DurabilityNone, syncEvery: 3000}
+	for i, expected := range []int64{1024, 2048, 0, 1024} {
+		err := diskio.syncAfterWrite(1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diskio.unsynced != expected {
+			t.Errorf("Expected %d unsynced bytes after write %d, but there were %d", expected, i, diskio.unsynced)
+		}
+	}
+}
+
+// Thousands of pieces pushed through DiskIO by many peers at once are all
+// written, while the queue, the number of pieces in flight and the number of
+// goroutines stay bounded
+func TestDiskIOWorkerPoolStress(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 256
+	numPieces := 3000
+	numPeers := 8
+	data := createTestPayload(numPieces, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	diskio.durability = DurabilityNone
+	baseGoroutines := runtime.NumGoroutine()
+	go diskio.Run()
+
+	go func() {
+		for range diskio.statsCh {
+		}
+	}()
+	received := make(chan struct{})
+	go func() {
+		for i := 0; i < numPieces; i++ {
+			<-diskio.contChans.receivedPiece
+		}
+		close(received)
+	}()
+
+	// Sample the queues while the pieces are written
+	var maxQueued, maxInFlight, maxGoroutines int
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-received:
+				return
+			default:
+			}
+			queues := diskio.QueueStats()
+			if queues.QueuedPieces > maxQueued {
+				maxQueued = queues.QueuedPieces
+			}
+			if queues.InFlight > maxInFlight {
+				maxInFlight = queues.InFlight
+			}
+			if n := runtime.NumGoroutine(); n > maxGoroutines {
+				maxGoroutines = n
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	for peer := 0; peer < numPeers; peer++ {
+		go func(peer int) {
+			for i := peer; i < numPieces; i += numPeers {
+				diskio.peerChans.writePiece <- Piece{index: i, data: data[i*pieceLength : (i+1)*pieceLength], peerName: "peer"}
+			}
+		}(peer)
+	}
+	select {
+	case <-received:
+	case <-time.After(60 * time.Second):
+		t.Fatal("Timed out waiting for the pieces to be written")
+	}
+	<-sampled
+	err := diskio.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxQueued > diskQueueSize {
+		t.Errorf("Expected at most %d queued pieces, but there were %d", diskQueueSize, maxQueued)
+	}
+	if maxInFlight > defaultDiskWorkers {
+		t.Errorf("Expected at most %d pieces in flight, but there were %d", defaultDiskWorkers, maxInFlight)
+	}
+	// The peers, the workers, and the helpers of this test
+	if limit := baseGoroutines + numPeers + defaultDiskWorkers + 10; maxGoroutines > limit {
+		t.Errorf("Expected at most %d goroutines, but there were %d", limit, maxGoroutines)
+	}
+	for i := 0; i < numPieces; i++ {
+		if !diskio.pieces[i] {
+			t.Errorf("Expected piece %d to be recorded", i)
+		}
+	}
+	onDisk, err := ioutil.ReadFile(diskio.filePath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDisk, data) {
+		t.Errorf("Data on disk doesn't match what was written")
+	}
+}
+
+// Aborting one of two busy DiskIOs cancels its queued pieces without
+// processing them and only waits for the pieces in flight, while the other
+// keeps completing every piece it's handed
+func TestDiskIOAbort(t *testing.T) {
+	pieceLength := 1024
+	numPieces := 32
+	data := createTestPayload(numPieces, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	removed := createTestDiskIO(t, createTempDir(t), metaInfo)
+	defer os.RemoveAll(removed.downloadDir)
+	kept := createTestDiskIO(t, createTempDir(t), metaInfo)
+	defer os.RemoveAll(kept.downloadDir)
+	for _, diskio := range []*DiskIO{removed, kept} {
+		diskio.durability = DurabilityNone
+		diskio.statsCh = make(chan int, numPieces)
+		diskio.contChans.receivedPiece = make(chan ReceivedPiece, numPieces)
+		go diskio.Run()
+	}
+
+	// The workers of the removed DiskIO hold on to their pieces until
+	// released
+	var mutex sync.Mutex
+	processed := 0
+	release := make(chan struct{})
+	removed.faultHook = func(stage int) error {
+		if stage == stageVerify {
+			mutex.Lock()
+			processed++
+			mutex.Unlock()
+			<-release
+		}
+		return nil
+	}
+	// One piece in flight per worker, a full queue and one held by Run
+	backlog := defaultDiskWorkers + diskQueueSize + 1
+	for i := 0; i < backlog; i++ {
+		removed.peerChans.writePiece <- Piece{index: i, data: data[i*pieceLength : (i+1)*pieceLength], peerName: "peer"}
+	}
+	for removed.QueueStats().InFlight < defaultDiskWorkers {
+		time.Sleep(time.Millisecond)
+	}
+
+	aborted := make(chan error)
+	go func() { aborted <- removed.Abort() }()
+	// The other DiskIO isn't held up by the removal
+	for i := 0; i < numPieces; i++ {
+		kept.peerChans.writePiece <- Piece{index: i, data: data[i*pieceLength : (i+1)*pieceLength], peerName: "peer"}
+	}
+	for i := 0; i < numPieces; i++ {
+		select {
+		case <-kept.contChans.receivedPiece:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the other DiskIO to complete its pieces")
+		}
+	}
+	close(release)
+	select {
+	case err := <-aborted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for Abort")
+	}
+
+	if processed != defaultDiskWorkers {
+		t.Errorf("Expected only the %d pieces in flight to be processed, but %d were", defaultDiskWorkers, processed)
+	}
+	if cancelled := removed.QueueStats().Cancelled; cancelled != backlog-defaultDiskWorkers {
+		t.Errorf("Expected %d pieces to be cancelled, but %d were", backlog-defaultDiskWorkers, cancelled)
+	}
+	_, err := removed.files[0].Write([]byte{0})
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected the files to be closed, but writing returned %v", err)
+	}
+	err = kept.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numPieces; i++ {
+		if !kept.pieces[i] {
+			t.Errorf("Expected piece %d to be recorded by the other DiskIO", i)
+		}
+	}
+}
+
+// Files missing at startup are neither created nor an error: their pieces
+// are unfinished, and blocks of them can't be served
+func TestVerifyMissingFiles(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "multi", []string{"a", "sub/b"}, []int{1024, len(data) - 1024})
+	os.Mkdir(filepath.Join(dir, "multi"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "multi", "a"), data[:1024], 0644)
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	for pieceNum, expected := range []bool{true, false, false} {
+		if diskio.pieces[pieceNum] != expected {
+			t.Errorf("Expected piece %d to be verified %t", pieceNum, expected)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "multi", "sub")); err != nil || !info.IsDir() {
+		t.Errorf("Expected the directory of the missing file to be created, but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi", "sub", "b"+partSuffix)); err == nil {
+		t.Errorf("Expected the missing file not to be created")
+	}
+
+	// A piece claimed by, say, stale resume data, whose file is missing
+	diskio.pieces[2] = true
+	if _, err := diskio.requestBlock(BlockInfo{pieceIndex: 2, begin: 0, length: 16}, nil); err == nil {
+		t.Errorf("Expected a block of a file that hasn't been created to be refused")
+	}
+}
+
+// A torrent whose paths escape the download directory is refused before
+// anything is created
+func TestInitPathTraversal(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	downloadDir := filepath.Join(dir, "a", "b")
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	tests := []struct {
+		name  string
+		paths [][]string
+	}{
+		{"payload", [][]string{{"ok"}, {"..", "..", "evil"}}},
+		{"..", [][]string{{"..", "evil"}}},
+		{"../../evil", nil},
+	}
+	for _, test := range tests {
+		metaInfo := createTestMetaInfo(data, pieceLength)
+		if test.paths != nil {
+			setTestFiles(&metaInfo, test.name, make([]string, len(test.paths)), make([]int, len(test.paths)))
+			for i, path := range test.paths {
+				metaInfo.Info.Files[i].Path = path
+			}
+			metaInfo.Info.Files[0].Length = len(data)
+		} else {
+			metaInfo.Info.Name = test.name
+		}
+		diskio := NewDiskIO(metaInfo, downloadDir)
+		err := diskio.Init()
+		if err == nil {
+			closeTestDiskIO(diskio)
+			t.Errorf("Expected Init to refuse %s %v", test.name, test.paths)
+		}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !strings.HasPrefix(path, downloadDir+string(filepath.Separator)) {
+				t.Errorf("Expected nothing to be written outside the download directory for %s %v, but got %s", test.name, test.paths, path)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Default share of the space needed that free space must exceed it by,
+// below which a warning is logged
+const defaultSpaceMargin = 0.05
+
+// ErrInsufficientSpace is returned when the filesystem can't hold the wanted
+// files of the torrent
+var ErrInsufficientSpace = errors.New("Not enough disk space")
+
+// DiskSpace reports on the space of the filesystem files are stored on.
+// DiskIO takes a DiskSpace so that tests can fake it.
+type DiskSpace interface {
+	Free(dir string) (int64, error)   // bytes available to us on the filesystem of dir
+	Allocated(info os.FileInfo) int64 // bytes of the filesystem a file occupies
+}
+
+// systemDiskSpace queries the filesystem, see diskspace_unix.go and
+// diskspace_windows.go
+var systemDiskSpace DiskSpace = realDiskSpace{}
+
+type realDiskSpace struct{}
+
+// checkDiskSpace returns an error naming the shortfall if the filesystem
+// can't hold the wanted files, every file if wanted is nil. Space the files
+// already occupy is credited. Free space within spaceMargin of the space
+// needed is only warned about, and so is failing to find out the free space.
+func (diskio *DiskIO) checkDiskSpace(wanted []bool) error {
+	var needed int64
+	for i, length := range diskio.fileLengths() {
+		if !fileWanted(wanted, i) {
+			continue
+		}
+		allocated := int64(0)
+		if file := diskio.file(i); file != nil {
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			allocated = diskio.diskSpace.Allocated(info)
+		}
+		if allocated < int64(length) {
+			needed += int64(length) - allocated
+		}
+	}
+	if needed == 0 {
+		return nil
+	}
+	dir := diskio.currentDir()
+	free, err := diskio.diskSpace.Free(dir)
+	if err != nil {
+		log.Printf("DiskIO : checkDiskSpace : Unable to check the free space in %s: %s", dir, err)
+		return nil
+	}
+	if free < needed {
+		return fmt.Errorf("%w in %s: %d bytes needed but only %d free, %d bytes short", ErrInsufficientSpace, dir, needed, free, needed-free)
+	}
+	if float64(free) < float64(needed)*(1+diskio.spaceMargin) {
+		log.Printf("DiskIO : checkDiskSpace : WARNING: %d bytes needed and only %d free in %s", needed, free, dir)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDiskSpace reports a fixed amount of free space, and counts the size of
+// files as the space they occupy
+type fakeDiskSpace struct {
+	free int64
+}
+
+func (d fakeDiskSpace) Free(dir string) (int64, error)   { return d.free, nil }
+func (d fakeDiskSpace) Allocated(info os.FileInfo) int64 { return info.Size() }
+
+// Init fails with the shortfall if the wanted files don't fit, crediting
+// files already on disk and leaving skipped files out
+func TestCheckDiskSpace(t *testing.T) {
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	tests := []struct {
+		name     string
+		free     int64
+		wanted   []bool
+		existing int // bytes of file a already on disk
+		short    int64
+	}{
+		{"fits", 4096, nil, 0, 0},
+		{"within margin", 4100, nil, 0, 0},
+		{"short", 4000, nil, 0, 96},
+		{"skipped", 1024, []bool{false, true}, 0, 0},
+		{"skipped short", 1000, []bool{false, true}, 0, 24},
+		{"existing", 1024, nil, 3072, 0},
+	}
+	for _, test := range tests {
+		dir := createTempDir(t)
+		metaInfo := createTestMetaInfo(data, pieceLength)
+		setTestFiles(&metaInfo, "files", []string{"a", "b"}, []int{3072, 1024})
+		if test.existing > 0 {
+			os.MkdirAll(filepath.Join(dir, "files"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "files", "a"+partSuffix), data[:test.existing], 0644)
+		}
+		diskio := NewDiskIO(metaInfo, dir)
+		diskio.diskSpace = fakeDiskSpace{free: test.free}
+		diskio.wantedFiles = test.wanted
+		err := diskio.Init()
+		if test.short == 0 && err != nil {
+			t.Errorf("%s: Expected Init to succeed, but got %s", test.name, err)
+		}
+		if test.short > 0 {
+			if !errors.Is(err, ErrInsufficientSpace) {
+				t.Errorf("%s: Expected ErrInsufficientSpace, but got %v", test.name, err)
+			} else if !strings.Contains(err.Error(), fmt.Sprintf("%d bytes short", test.short)) {
+				t.Errorf("%s: Expected the error to name the shortfall, but got %s", test.name, err)
+			}
+		}
+		if err == nil {
+			closeTestDiskIO(diskio)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// Wanting a skipped file that doesn't fit is refused
+func TestCheckDiskSpaceWantedFiles(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "files", []string{"a", "b"}, []int{1024, 3072})
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.allocateMode = AllocateSparse
+	diskio.diskSpace = fakeDiskSpace{free: 2048}
+	diskio.wantedFiles = []bool{true, false}
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+
+	err = diskio.setWantedFiles(nil)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("Expected ErrInsufficientSpace, but got %v", err)
+	}
+	if diskio.wantedFiles[1] {
+		t.Errorf("Expected file %d to stay skipped", 1)
+	}
+}
+
+// The free space of a real filesystem can be found
+func TestSystemDiskSpace(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	free, err := systemDiskSpace.Free(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("Expected some free space in %s, but got %d", dir, free)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Interval between the DiskStats snapshots DiskIO publishes to Stats
+var diskStatsInterval = 5 * time.Second
+
+// DiskStats is a snapshot of the disk throughput of DiskIO, for telling
+// whether a slow download is bound by the network or the disk
+type DiskStats struct {
+	BytesWritten int64         // bytes written to the files
+	BytesRead    int64         // bytes of blocks read to upload to peers
+	PiecesHashed int64         // pieces hash checked by DiskIO
+	HashFailures int64         // pieces that failed a hash check by DiskIO
+	WriteQueue   int           // pieces waiting for a worker
+	WriteTime    time.Duration // time spent writing to the files
+	ReadTime     time.Duration // time spent reading from the files
+}
+
+// diskCounters are the counters behind DiskStats. They're updated by every
+// worker, so they're accessed atomically rather than under a mutex.
+type diskCounters struct {
+	bytesWritten int64
+	bytesRead    int64
+	piecesHashed int64
+	hashFailures int64
+	writeNanos   int64
+	readNanos    int64
+}
+
+// countWriteAt records a write of n bytes that started at start
+func (dc *diskCounters) countWriteAt(n int, start time.Time) {
+	atomic.AddInt64(&dc.bytesWritten, int64(n))
+	atomic.AddInt64(&dc.writeNanos, int64(time.Since(start)))
+}
+
+// countReadAt records a read that started at start
+func (dc *diskCounters) countReadAt(start time.Time) {
+	atomic.AddInt64(&dc.readNanos, int64(time.Since(start)))
+}
+
+// countHash records a hash check
+func (dc *diskCounters) countHash(good bool) {
+	atomic.AddInt64(&dc.piecesHashed, 1)
+	if !good {
+		atomic.AddInt64(&dc.hashFailures, 1)
+	}
+}
+
+// DiskStats returns a snapshot of the disk throughput counters
+func (diskio *DiskIO) DiskStats() DiskStats {
+	dc := &diskio.diskCounters
+	return DiskStats{
+		BytesWritten: atomic.LoadInt64(&dc.bytesWritten),
+		BytesRead:    atomic.LoadInt64(&dc.bytesRead),
+		PiecesHashed: atomic.LoadInt64(&dc.piecesHashed),
+		HashFailures: atomic.LoadInt64(&dc.hashFailures),
+		WriteQueue:   len(diskio.writeQueue),
+		WriteTime:    time.Duration(atomic.LoadInt64(&dc.writeNanos)),
+		ReadTime:     time.Duration(atomic.LoadInt64(&dc.readNanos)),
+	}
+}
+
+// publishDiskStats sends a snapshot of the counters on diskStatsCh every
+// diskStatsInterval until DiskIO stops. A snapshot Stats hasn't taken yet is
+// replaced rather than waited for.
+func (diskio *DiskIO) publishDiskStats() {
+	ticker := time.NewTicker(diskStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats := diskio.DiskStats()
+			select {
+			case <-diskio.diskStatsCh:
+			default:
+			}
+			select {
+			case diskio.diskStatsCh <- stats:
+			default:
+			}
+		case <-diskio.quit:
+			return
+		}
+	}
+}
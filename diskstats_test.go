@@ -0,0 +1,67 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Writes, hash checks and block reads are counted, and snapshots are
+// published while DiskIO runs
+func TestDiskStats(t *testing.T) {
+	defer func(interval time.Duration) { diskStatsInterval = interval }(diskStatsInterval)
+	diskStatsInterval = 10 * time.Millisecond
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	if stats := diskio.DiskStats(); stats.BytesWritten != 0 || stats.HashFailures != 0 {
+		t.Errorf("Expected nothing written before the first piece, but got %+v", stats)
+	}
+	go diskio.Run()
+	defer diskio.Stop()
+
+	write := func(pieceNum int, pieceData []byte) error {
+		result := make(chan error, 1)
+		diskio.peerChans.writePiece <- Piece{index: pieceNum, data: pieceData, peerName: "10.0.0.1:6881", result: result}
+		return <-result
+	}
+	if err := write(0, make([]byte, pieceLength)); err == nil {
+		t.Errorf("Expected the corrupt piece to fail its hash check")
+	}
+	if err := write(0, data[:pieceLength]); err != nil {
+		t.Fatal(err)
+	}
+	responseCh := make(chan BlockResponse)
+	diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: 0, begin: 0, length: 100}, response: responseCh}
+	if response := <-responseCh; response.err != nil {
+		t.Fatal(response.err)
+	}
+
+	var stats DiskStats
+	deadline := time.After(time.Second)
+	for stats.BytesRead == 0 {
+		select {
+		case stats = <-diskio.diskStatsCh:
+		case <-deadline:
+			t.Fatalf("Expected a snapshot with the block read, but got %+v", stats)
+		}
+	}
+	if stats.BytesWritten != int64(pieceLength) || stats.BytesRead != 100 {
+		t.Errorf("Expected %d bytes written and 100 bytes read, but got %+v", pieceLength, stats)
+	}
+	if stats.PiecesHashed < 2 || stats.HashFailures != 1 {
+		t.Errorf("Expected both copies of the piece hashed and one failure, but got %+v", stats)
+	}
+	if stats.WriteTime <= 0 || stats.ReadTime <= 0 || stats.WriteQueue != 0 {
+		t.Errorf("Expected time spent writing and reading and an empty queue, but got %+v", stats)
+	}
+}
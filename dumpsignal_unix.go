@@ -0,0 +1,19 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySwarmDump relays SIGUSR1 to c, to write a dump of the swarm view
+func notifySwarmDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,15 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// notifySwarmDump does nothing, Windows has no SIGUSR1. The swarm view is
+// dumped from /debug/swarm on localhost:6060 instead.
+func notifySwarmDump(c chan<- os.Signal) {
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoMetadata is returned when the .torrent file of a torrent isn't known
+var ErrNoMetadata = errors.New("Metadata of the torrent isn't available")
+
+// withoutPieces returns a copy of a decoded .torrent file without the piece
+// hashes of its info dictionary
+func withoutPieces(metaMap map[string]interface{}) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(metaMap))
+	for key, value := range metaMap {
+		metadata[key] = value
+	}
+	if infoDict, ok := metaMap["info"].(map[string]interface{}); ok {
+		info := make(map[string]interface{}, len(infoDict))
+		for key, value := range infoDict {
+			if key != "pieces" {
+				info[key] = value
+			}
+		}
+		metadata["info"] = info
+	}
+	return metadata
+}
+
+// Metainfo returns the .torrent file of the torrent, rebuilt from the file it
+// was loaded from. Its infohash is the infohash of the torrent.
+func (t *Torrent) Metainfo() ([]byte, error) {
+	if t.metadata == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoMetadata, hex.EncodeToString(t.infoHash))
+	}
+	info := map[string]interface{}{"pieces": t.metaInfo.Info.Pieces}
+	for key, value := range t.metadata["info"].(map[string]interface{}) {
+		info[key] = value
+	}
+	metaMap := map[string]interface{}{"info": info}
+	for key, value := range t.metadata {
+		if key != "info" {
+			metaMap[key] = value
+		}
+	}
+	var b bytes.Buffer
+	err := bencode.Marshal(&b, metaMap)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ExportTorrent writes the .torrent file of the torrent to path. The file is
+// replaced atomically.
+func (t *Torrent) ExportTorrent(path string) error {
+	metainfo, err := t.Metainfo()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, metainfo, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// exportName returns the name of the exported .torrent file of a torrent
+func exportName(dir string, infoHash []byte) string {
+	return filepath.Join(dir, hex.EncodeToString(infoHash)+".torrent")
+}
+
+// ExportTorrents writes the .torrent file of each torrent to dir, named by
+// its infohash. A torrent that can't be exported doesn't stop the others,
+// the first error is returned.
+func ExportTorrents(dir string, torrents []*Torrent) error {
+	err := os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, t := range torrents {
+		err := t.ExportTorrent(exportName(dir, t.infoHash))
+		if err != nil {
+			log.Printf("Torrent : ExportTorrents : Unable to export %s: %s", t.metaInfo.Info.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
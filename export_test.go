@@ -0,0 +1,117 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// An exported torrent is added again with the same infohash, and a torrent
+// without metadata isn't exported
+func TestExportTorrent(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	metaInfo := createTestMetaInfo(createTestPayload(4, 1024), 1024)
+	path := writeTestTorrent(t, dir, metaInfo)
+	torrent, err := NewTorrent(path, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test torrent is encoded canonically, so it's rebuilt exactly
+	metainfo, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported := filepath.Join(dir, "exported.torrent")
+	err = torrent.ExportTorrent(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readded, err := NewTorrent(exported, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readded.infoHash, torrent.infoHash) {
+		t.Errorf("Expected the exported torrent to have infohash %x, but it had %x", torrent.infoHash, readded.infoHash)
+	}
+	if readded.metaInfo.Info.Name != metaInfo.Info.Name || readded.metaInfo.Info.Pieces != metaInfo.Info.Pieces {
+		t.Errorf("Expected the exported torrent to have the metainfo %+v, but it had %+v", metaInfo.Info, readded.metaInfo.Info)
+	}
+
+	// Bulk export carries on past a torrent without metadata
+	missing := &Torrent{infoHash: bytes.Repeat([]byte{0xab}, 20)}
+	if _, err := missing.Metainfo(); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Expected %v for a torrent without metadata, but got %v", ErrNoMetadata, err)
+	}
+	exportDir := filepath.Join(dir, "export")
+	err = ExportTorrents(exportDir, []*Torrent{missing, torrent})
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Expected %v exporting every torrent, but got %v", ErrNoMetadata, err)
+	}
+	data, err := ioutil.ReadFile(exportName(exportDir, torrent.infoHash))
+	if err != nil || !bytes.Equal(data, metainfo) {
+		t.Errorf("Expected the torrent to be exported to %s, but got %v", exportName(exportDir, torrent.infoHash), err)
+	}
+	if _, err := os.Stat(exportName(exportDir, missing.infoHash)); !os.IsNotExist(err) {
+		t.Errorf("Expected no file for the torrent without metadata, but got %v", err)
+	}
+}
+
+// The .torrent file of a torrent is served by its infohash
+func TestStatusServerTorrent(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	metaInfo := createTestMetaInfo(createTestPayload(4, 1024), 1024)
+	path := writeTestTorrent(t, dir, metaInfo)
+	torrent, err := NewTorrent(path, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test torrent is encoded canonically, so it's rebuilt exactly
+	metainfo, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewStatusServer("localhost", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Add(torrent)
+	go ss.Run()
+	defer ss.Stop()
+
+	for _, test := range []struct {
+		infoHash string
+		status   int
+	}{
+		{hex.EncodeToString(torrent.infoHash), http.StatusOK},
+		{hex.EncodeToString(bytes.Repeat([]byte{0xab}, 20)), http.StatusNotFound},
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/torrent?infohash=%s", ss.Port, test.infoHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected status %d for infohash %s, but got %d", test.status, test.infoHash, resp.StatusCode)
+		}
+		if test.status == http.StatusOK && !bytes.Equal(data, metainfo) {
+			t.Errorf("Expected the .torrent file to be served, but got %q", data)
+		}
+	}
+}
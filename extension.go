@@ -0,0 +1,148 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jackpal/bencode-go"
+	"log"
+)
+
+// Extension protocol (BEP 10). Peers that set the extension bit in the
+// reserved bytes of their handshake exchange an extended handshake, message
+// MsgExtended with extended message ID 0, that maps the names of the
+// extensions each supports to the extended message IDs it wants to receive
+// them under.
+const (
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10
+	extendedHandshakeID   = 0
+)
+
+// Client name and version sent in our extended handshake
+const extensionClientVersion = "Tulva 0.0.1"
+
+// Extended message IDs of the extensions we support, under which peers send
+// us their messages
+var localExtensions = map[string]int{utPexName: utPexID}
+
+// ExtendedHandshake is the bencoded payload of an extended handshake
+type ExtendedHandshake struct {
+	M map[string]int `bencode:"m"` // extension names to their IDs, 0 to disable an extension
+	V string         `bencode:"v,omitempty"`
+	// 1 if the sender only uploads, being a partial seed that will never
+	// download the pieces it's missing (BEP 21)
+	UploadOnly int `bencode:"upload_only,omitempty"`
+}
+
+// localReserved returns the reserved bytes of our handshake, flagging the
+// extension protocol, and the DHT if we run a node
+func localReserved(dht bool) [8]byte {
+	var reserved [8]byte
+	reserved[extensionReservedByte] |= extensionReservedBit
+	if dht {
+		reserved[dhtReservedByte] |= dhtReservedBit
+	}
+	return reserved
+}
+
+// supportsExtensions returns true if the reserved bytes of a handshake flag
+// support for the extension protocol
+func supportsExtensions(reserved [8]byte) bool {
+	return reserved[extensionReservedByte]&extensionReservedBit != 0
+}
+
+// encodeExtendedHandshake returns the payload of an extended handshake
+// advertising extensions, and that we only upload if uploadOnly is set,
+// starting with the extended message ID
+func encodeExtendedHandshake(extensions map[string]int, uploadOnly bool) ([]byte, error) {
+	handshake := ExtendedHandshake{M: extensions, V: extensionClientVersion}
+	if uploadOnly {
+		handshake.UploadOnly = 1
+	}
+	if handshake.M == nil {
+		handshake.M = map[string]int{}
+	}
+	b := bytes.NewBuffer([]byte{extendedHandshakeID})
+	err := bencode.Marshal(b, handshake)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeExtendedHandshake parses the bencoded dict of an extended handshake,
+// following the extended message ID
+func decodeExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	var handshake ExtendedHandshake
+	err := bencode.Unmarshal(bytes.NewReader(payload), &handshake)
+	if err != nil {
+		return handshake, err
+	}
+	for name, id := range handshake.M {
+		if id < 0 || id > 255 {
+			return handshake, errors.New("Extended message ID out of range for " + name)
+		}
+	}
+	return handshake, nil
+}
+
+// sendExtendedHandshake sends our extended handshake to a peer that supports
+// the extension protocol
+func (p *Peer) sendExtendedHandshake() {
+	if !supportsExtensions(p.reserved) {
+		return
+	}
+	payload, err := encodeExtendedHandshake(p.advertisedExtensions(), p.uploadOnly)
+	if err != nil {
+		log.Printf("Peer : sendExtendedHandshake : Unable to encode the extended handshake: %s", err)
+		return
+	}
+	log.Printf("Peer : sendExtendedHandshake : Sending extended handshake to %s", p.peerName)
+	p.sendMessage(Message{ID: MsgExtended, Payload: payload})
+}
+
+// decodeExtended handles an extension protocol message. The peer may send
+// its extended handshake more than once, each updates the extensions it
+// named. Messages of extensions we don't support are ignored.
+func (p *Peer) decodeExtended(payload []byte) {
+	if len(payload) == 0 {
+		log.Printf("Ignoring an empty Extended message that was received from %s", p.peerName)
+		return
+	}
+	switch payload[0] {
+	case extendedHandshakeID:
+	case utPexID:
+		p.receivedPex(payload[1:])
+		return
+	default:
+		log.Printf("Ignoring an Extended message with ID %d that was received from %s", payload[0], p.peerName)
+		return
+	}
+	handshake, err := decodeExtendedHandshake(payload[1:])
+	if err != nil {
+		log.Printf("Ignoring an invalid Extended handshake that was received from %s: %s", p.peerName, err)
+		return
+	}
+	log.Printf("Received an Extended handshake from %s (%s) with extensions %v", p.peerName, handshake.V, handshake.M)
+	if p.extensions == nil {
+		p.extensions = make(map[string]int)
+	}
+	for name, id := range handshake.M {
+		if id == 0 {
+			delete(p.extensions, name)
+		} else {
+			p.extensions[name] = id
+		}
+	}
+}
+
+// extensionID returns the extended message ID the peer wants to receive an
+// extension's messages under, and false if it doesn't support the extension
+func (p *Peer) extensionID(name string) (int, bool) {
+	id, ok := p.extensions[name]
+	return id, ok
+}
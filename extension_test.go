@@ -0,0 +1,89 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Our handshake flags support for the extension protocol, and our extended
+// handshake is sent to peers that support it and decodes to the extensions
+// we advertise
+func TestSendExtendedHandshake(t *testing.T) {
+	var b bytes.Buffer
+	writeHandshake(&b, make([]byte, 20), localReserved(false))
+	var handshake Handshake
+	binary.Read(&b, binary.BigEndian, &handshake)
+	if !supportsExtensions(handshake.Reserved) {
+		t.Errorf("Expected our handshake to flag the extension protocol, but the reserved bytes are %x", handshake.Reserved)
+	}
+
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 10, 16384, 10*16384, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	p.reserved = handshake.Reserved
+	p.pex = newPexView()
+	go p.sendExtendedHandshake()
+	var message []byte
+	select {
+	case message = <-p.sendChan:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the extended handshake")
+	}
+	if length := int(binary.BigEndian.Uint32(message)); length != len(message)-4 {
+		t.Fatalf("Expected a length prefix of %d, but it was %d", len(message)-4, length)
+	}
+	if message[4] != byte(MsgExtended) || message[5] != extendedHandshakeID {
+		t.Fatalf("Expected an extended handshake, but got message %d with extended ID %d", message[4], message[5])
+	}
+	decoded, err := decodeExtendedHandshake(message[6:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.V != extensionClientVersion || len(decoded.M) != len(localExtensions) {
+		t.Errorf("Expected %q advertising %v, but got %+v", extensionClientVersion, localExtensions, decoded)
+	}
+}
+
+// The extension IDs a peer sends in its extended handshakes are mapped by
+// name, and a later handshake updates them
+func TestReceiveExtendedHandshake(t *testing.T) {
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 10, 16384, 10*16384, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	receive := func(extensions map[string]int) {
+		payload, err := encodeExtendedHandshake(extensions, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.decodeMessage(append([]byte{byte(MsgExtended)}, payload...))
+	}
+
+	receive(map[string]int{"ut_metadata": 3, "ut_pex": 1})
+	for name, expected := range map[string]int{"ut_metadata": 3, "ut_pex": 1} {
+		if id, ok := p.extensionID(name); !ok || id != expected {
+			t.Errorf("Expected %s to have ID %d, but it was %d (%t)", name, expected, id, ok)
+		}
+	}
+	if _, ok := p.extensionID("lt_donthave"); ok {
+		t.Errorf("Expected %s not to be supported", "lt_donthave")
+	}
+
+	// Disables ut_pex and moves ut_metadata
+	receive(map[string]int{"ut_pex": 0, "ut_metadata": 7})
+	if _, ok := p.extensionID("ut_pex"); ok {
+		t.Errorf("Expected %s to be disabled", "ut_pex")
+	}
+	if id, _ := p.extensionID("ut_metadata"); id != 7 {
+		t.Errorf("Expected %s to have ID %d, but it was %d", "ut_metadata", 7, id)
+	}
+
+	// Invalid handshakes and messages of other extensions change nothing
+	p.decodeMessage(append([]byte{byte(MsgExtended), extendedHandshakeID}, "d1:md6:ut_pexi300eee"...))
+	p.decodeMessage([]byte{byte(MsgExtended), 5, 'x'})
+	p.decodeMessage([]byte{byte(MsgExtended)})
+	if len(p.extensions) != 1 {
+		t.Errorf("Expected only ut_metadata to be supported, but got %v", p.extensions)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseFileList parses a comma separated list of file indexes, such as
+// "0,2,5", as given on the command line
+func ParseFileList(list string) ([]int, error) {
+	indexes := make([]int, 0)
+	for _, field := range strings.Split(list, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("Invalid file index %q in %q", field, list)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// fileWanted returns true if a file is wanted, every file is wanted if
+// wanted is nil
+func fileWanted(wanted []bool, fileIndex int) bool {
+	return wanted == nil || wanted[fileIndex]
+}
+
+// wantedPieces returns which pieces overlap a wanted file, or nil if every
+// file is wanted. A piece straddling a wanted and a skipped file is wanted.
+// On read-only storage only the pieces already verified are wanted, since
+// the rest can never be downloaded.
+func (diskio *DiskIO) wantedPieces() []bool {
+	diskio.filesMutex.RLock()
+	wantedFiles := diskio.wantedFiles
+	diskio.filesMutex.RUnlock()
+	wanted := diskio.filesPieces(wantedFiles)
+	if diskio.readOnly {
+		return diskio.presentPieces(wanted)
+	}
+	return wanted
+}
+
+// filesPieces returns which pieces overlap a file of wantedFiles, or nil if
+// wantedFiles is nil
+func (diskio *DiskIO) filesPieces(wantedFiles []bool) []bool {
+	if wantedFiles == nil {
+		return nil
+	}
+	pieceLength := int64(diskio.metaInfo.Info.PieceLength)
+	wanted := make([]bool, diskio.pieceHashes.Len())
+	var offset int64
+	for i, length := range diskio.fileLengths() {
+		if wantedFiles[i] && length > 0 {
+			last := (offset + int64(length) - 1) / pieceLength
+			for pieceNum := offset / pieceLength; pieceNum <= last; pieceNum++ {
+				wanted[pieceNum] = true
+			}
+		}
+		offset += int64(length)
+	}
+	return wanted
+}
+
+// bytesLeft returns the bytes of the wanted pieces that haven't been
+// downloaded, every piece is wanted if wanted is nil
+func (diskio *DiskIO) bytesLeft(pieces []bool, wanted []bool) int {
+	left := 0
+	for pieceNum, finished := range pieces {
+		if !finished && (wanted == nil || wanted[pieceNum]) {
+			left += diskio.pieceLength(pieceNum)
+		}
+	}
+	return left
+}
+
+// verifiedPieces returns a copy of the bitfield of pieces verified on disk
+func (diskio *DiskIO) verifiedPieces() []bool {
+	diskio.piecesMutex.RLock()
+	defer diskio.piecesMutex.RUnlock()
+	pieces := make([]bool, len(diskio.pieces))
+	copy(pieces, diskio.pieces)
+	return pieces
+}
+
+// setWantedFiles changes which files are downloaded after Init. Files that
+// become wanted are allocated, right away if they exist or otherwise once
+// they're created, files that become skipped keep whatever was already
+// written to them. An error is returned, and the wanted files are left as
+// they were, if there isn't enough free space for them. Nothing is allocated
+// on read-only storage.
+func (diskio *DiskIO) setWantedFiles(wanted []bool) error {
+	if diskio.readOnly {
+		diskio.filesMutex.Lock()
+		diskio.wantedFiles = wanted
+		diskio.filesMutex.Unlock()
+		return nil
+	}
+	err := diskio.checkDiskSpace(wanted)
+	if err != nil {
+		return err
+	}
+	// Files created from here on are allocated by createFile
+	diskio.filesMutex.Lock()
+	previous := diskio.wantedFiles
+	diskio.wantedFiles = wanted
+	diskio.filesMutex.Unlock()
+	for i, length := range diskio.fileLengths() {
+		if !fileWanted(wanted, i) || fileWanted(previous, i) {
+			continue
+		}
+		file := diskio.file(i)
+		if file == nil {
+			continue
+		}
+		diskio.stampsMutex.RLock()
+		err = allocateFile(file, int64(length), diskio.fileAllocateMode())
+		diskio.markWritten([]fileRegion{{fileIndex: i}})
+		diskio.stampsMutex.RUnlock()
+		if err != nil {
+			diskio.filesMutex.Lock()
+			diskio.wantedFiles = previous
+			diskio.filesMutex.Unlock()
+			return err
+		}
+		if diskio.maps != nil {
+			diskio.mapFile(i)
+		}
+	}
+	return nil
+}
+
+// numFiles returns the number of files in the torrent
+func (t *Torrent) numFiles() int {
+	if len(t.metaInfo.Info.Files) == 0 {
+		// Single File Mode
+		return 1
+	}
+	// Multiple File Mode
+	return len(t.metaInfo.Info.Files)
+}
+
+// SetFileWanted selects whether a file of the torrent is downloaded, by its
+// index in the torrent. It may be called before or while the torrent runs.
+// Pieces that fall entirely within skipped files aren't requested, and the
+// download completes once every wanted file has been downloaded.
+//
+// Skipped files are created empty and aren't allocated. A piece straddling a
+// wanted and a skipped file is still downloaded and written whole, so the
+// edges of a skipped file may hold the slack of such pieces. The slack isn't
+// truncated, which keeps those pieces verifiable at startup and servable to
+// peers.
+func (t *Torrent) SetFileWanted(fileIndex int, wanted bool) error {
+	numFiles := t.numFiles()
+	if fileIndex < 0 || fileIndex >= numFiles {
+		return fmt.Errorf("File index %d out of range (%d files)", fileIndex, numFiles)
+	}
+	t.filesMutex.Lock()
+	if t.wantedFiles == nil {
+		t.wantedFiles = make([]bool, numFiles)
+		for i := range t.wantedFiles {
+			t.wantedFiles[i] = true
+		}
+	}
+	t.wantedFiles[fileIndex] = wanted
+	t.filesMutex.Unlock()
+
+	// Let Run know, if it's running
+	select {
+	case t.filesChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// fileSelection returns a copy of the wanted files, or nil if every file is
+// wanted
+func (t *Torrent) fileSelection() []bool {
+	t.filesMutex.Lock()
+	defer t.filesMutex.Unlock()
+	if t.wantedFiles == nil {
+		return nil
+	}
+	wanted := make([]bool, len(t.wantedFiles))
+	copy(wanted, t.wantedFiles)
+	return wanted
+}
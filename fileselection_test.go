@@ -0,0 +1,162 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFileList(t *testing.T) {
+	indexes, err := ParseFileList("0, 2,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, []int{0, 2, 5}) {
+		t.Errorf("Expected indexes [0 2 5], but got %v", indexes)
+	}
+	for _, list := range []string{"", "1,,2", "-1", "one"} {
+		if _, err := ParseFileList(list); err == nil {
+			t.Errorf("Expected an error parsing %q", list)
+		}
+	}
+}
+
+// Pieces overlapping a wanted file are wanted, including those straddling a
+// skipped file
+func TestWantedPieces(t *testing.T) {
+	pieceLength := 1024
+	metaInfo := createTestMetaInfo(createTestPayload(4, pieceLength), pieceLength)
+	tests := []struct {
+		lengths  []int
+		wanted   []bool
+		expected []bool
+	}{
+		{[]int{1024, 2048, 1024}, nil, nil},
+		{[]int{1024, 2048, 1024}, []bool{true, false, true}, []bool{true, false, false, true}},
+		{[]int{1024, 2048, 1024}, []bool{false, true, false}, []bool{false, true, true, false}},
+		{[]int{1500, 1000, 1596}, []bool{true, false, true}, []bool{true, true, true, true}},
+		{[]int{1500, 1000, 1596}, []bool{false, true, false}, []bool{false, true, true, false}},
+		{[]int{1024, 0, 3072}, []bool{false, true, false}, []bool{false, false, false, false}},
+	}
+	for _, test := range tests {
+		setTestFiles(&metaInfo, "files", []string{"a", "b", "c"}, test.lengths)
+		diskio := NewDiskIO(metaInfo, ".")
+		diskio.wantedFiles = test.wanted
+		if wanted := diskio.wantedPieces(); !reflect.DeepEqual(wanted, test.expected) {
+			t.Errorf("Expected files %v of %v to want pieces %v, but got %v", test.wanted, test.lengths, test.expected, wanted)
+		}
+	}
+}
+
+// Files are only created, and wanted files allocated, once data for them
+// arrives, and only the wanted pieces count towards the bytes left
+func TestSkippedFiles(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "files", []string{"a", "b", "c"}, []int{1024, 2048, 1024})
+
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.allocateMode = AllocateSparse
+	diskio.wantedFiles = []bool{true, false, true}
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	pieces, err := diskio.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := os.Stat(filepath.Join(dir, "files", name+partSuffix)); err == nil {
+			t.Errorf("Expected file %s not to be created before any data for it arrives", name)
+		}
+	}
+	diskio.statsCh = make(chan int, 10)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	err = diskio.completePiece(Piece{index: 0, data: data[:pieceLength]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "files", "a"))
+	if err != nil || info.Size() != 1024 {
+		t.Errorf("Expected file a to be created with 1024 bytes, but got %v", err)
+	}
+	pieces[0] = true
+	if left := diskio.bytesLeft(pieces, diskio.wantedPieces()); left != 1024 {
+		t.Errorf("Expected 1024 bytes left of the wanted files, but got %d", left)
+	}
+
+	// Wanting the skipped file allocates it once it's created
+	err = diskio.setWantedFiles(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", "b"+partSuffix)); err == nil {
+		t.Errorf("Expected file b not to be created by wanting it")
+	}
+	err = diskio.completePiece(Piece{index: 1, data: data[pieceLength : 2*pieceLength]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(filepath.Join(dir, "files", "b"+partSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2048 {
+		t.Errorf("Expected the wanted file to be allocated to 2048 bytes, but it was %d", info.Size())
+	}
+	pieces[1] = true
+	if left := diskio.bytesLeft(pieces, diskio.wantedPieces()); left != 2048 {
+		t.Errorf("Expected 2048 bytes left of every file, but got %d", left)
+	}
+}
+
+// A piece straddling a wanted and a skipped file is written whole, so it
+// verifies after a restart
+func TestStraddlingPiece(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "files", []string{"a", "b", "c"}, []int{1500, 1000, 1596})
+
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.statsCh = make(chan int, 10)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	diskio.wantedFiles = []bool{true, false, true}
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio.Verify()
+	err = diskio.completePiece(Piece{index: 1, data: data[pieceLength : 2*pieceLength]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTestDiskIO(diskio)
+
+	diskio = NewDiskIO(metaInfo, dir)
+	diskio.wantedFiles = []bool{true, false, true}
+	err = diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	pieces, err := diskio.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pieces, []bool{false, true, false, false}) {
+		t.Errorf("Expected only the straddling piece 1 to verify, but got %v", pieces)
+	}
+}
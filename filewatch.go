@@ -0,0 +1,151 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// fileStamp is the size and modification time of a file of the torrent as
+// last seen by DiskIO. A file whose stamp changes without DiskIO writing to
+// it has been modified by another program.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}
+}
+
+// recordStamps records the stamp of every open file, once they've been
+// allocated by Init
+func (diskio *DiskIO) recordStamps() error {
+	diskio.stamps = make([]fileStamp, len(diskio.files))
+	diskio.stampsDirty = make([]int32, len(diskio.files))
+	for i, file := range diskio.files {
+		if file == nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		diskio.stamps[i] = stampOf(info)
+	}
+	return nil
+}
+
+// markWritten flags the files a region is written to, so that the next
+// check takes their new stamp instead of treating it as a change. The caller
+// must hold stampsMutex for reading.
+func (diskio *DiskIO) markWritten(regions []fileRegion) {
+	if diskio.stampsDirty == nil {
+		return
+	}
+	for _, region := range regions {
+		atomic.StoreInt32(&diskio.stampsDirty[region.fileIndex], 1)
+	}
+}
+
+// checkFiles compares the stamps of the files a piece overlaps with what
+// they were after DiskIO last wrote to them, and gives up the pieces of any
+// file changed by another program. The open file handles are checked, since
+// those are what blocks are served from.
+func (diskio *DiskIO) checkFiles(pieceNum int) {
+	if diskio.stamps == nil {
+		return
+	}
+	offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+	var changed []int
+	diskio.stampsMutex.Lock()
+	for _, region := range diskio.mapRegion(offset, diskio.pieceLength(pieceNum)) {
+		i := region.fileIndex
+		file := diskio.file(i)
+		if file == nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			log.Printf("DiskIO : checkFiles : Unable to stat %s: %s", file.Name(), err)
+			continue
+		}
+		stamp := stampOf(info)
+		if atomic.SwapInt32(&diskio.stampsDirty[i], 0) == 0 && stamp != diskio.stamps[i] {
+			log.Printf("DiskIO : checkFiles : WARNING: %s was changed by another program, size %d to %d, modified %s to %s",
+				file.Name(), diskio.stamps[i].size, stamp.size, diskio.stamps[i].modTime, stamp.modTime)
+			changed = append(changed, i)
+		}
+		diskio.stamps[i] = stamp
+	}
+	diskio.stampsMutex.Unlock()
+
+	for _, i := range changed {
+		diskio.fileChanged(i)
+	}
+}
+
+// fileChanged marks every piece overlapping a file changed by another
+// program as unverified, so they are neither served nor advertised until
+// they've been downloaded again, and tells Stats and the Controller about
+// the pieces lost
+func (diskio *DiskIO) fileChanged(fileIndex int) {
+	first, end := diskio.filePieces(fileIndex)
+	var lost []int
+	lostBytes := 0
+	// The file may be shorter than its mapping now, it's read and written
+	// directly from here on
+	err := diskio.unmapFile(fileIndex)
+	if err != nil {
+		log.Printf("DiskIO : fileChanged : Error unmapping %s: %s", diskio.file(fileIndex).Name(), err)
+	}
+	diskio.pipelineMutex.Lock()
+	for pieceNum := first; pieceNum < end; pieceNum++ {
+		diskio.cache.invalidate(pieceNum)
+		if !diskio.pieces[pieceNum] {
+			continue
+		}
+		diskio.piecesMutex.Lock()
+		diskio.pieces[pieceNum] = false
+		diskio.piecesMutex.Unlock()
+		lost = append(lost, pieceNum)
+		lostBytes += diskio.pieceLength(pieceNum)
+	}
+	if diskio.complete != nil {
+		diskio.complete[fileIndex] = false
+	}
+	if len(lost) > 0 && diskio.journal != nil {
+		err = diskio.compactJournal()
+	}
+	diskio.pipelineMutex.Unlock()
+	if err != nil {
+		diskio.fail(err)
+	}
+	if len(lost) == 0 {
+		return
+	}
+
+	log.Printf("DiskIO : fileChanged : Lost %d pieces of %s", len(lost), diskio.file(fileIndex).Name())
+	diskio.announceLost(lost, lostBytes)
+}
+
+// announceLost tells Stats and the Controller about verified pieces that
+// were lost on disk
+func (diskio *DiskIO) announceLost(lost []int, lostBytes int) {
+	go func() {
+		// Bytes lost count as negative bytes written
+		select {
+		case diskio.statsCh <- -lostBytes:
+		case <-diskio.quit:
+		}
+		select {
+		case diskio.contChans.lostPieces <- lost:
+		case <-diskio.quit:
+		}
+	}()
+}
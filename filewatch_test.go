@@ -0,0 +1,89 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A file truncated or modified by another program while it's being seeded
+// loses the pieces overlapping it, which are no longer served, while DiskIO's
+// own writes go unnoticed
+func TestFileChangedWhileSeeding(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	// File a is covered by pieces 0 and 1, and b by pieces 1 to 3
+	setTestFiles(&metaInfo, "files", []string{"a", "b"}, []int{1500, 2596})
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	diskio.contChans.lostPieces = make(chan []int, 2)
+	for pieceNum := 0; pieceNum < 4; pieceNum++ {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-diskio.statsCh
+	}
+	block := func(pieceNum int) error {
+		_, err := diskio.requestBlock(BlockInfo{pieceIndex: uint32(pieceNum), length: 16}, nil)
+		return err
+	}
+	lost := func(expected []int) {
+		select {
+		case pieces := <-diskio.contChans.lostPieces:
+			if !reflect.DeepEqual(pieces, expected) {
+				t.Errorf("Expected pieces %v to be lost, but got %v", expected, pieces)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected pieces %v to be lost", expected)
+		}
+		bytes := 0
+		for _, pieceNum := range expected {
+			bytes -= diskio.pieceLength(pieceNum)
+		}
+		if written := <-diskio.statsCh; written != bytes {
+			t.Errorf("Expected Stats to be told %d bytes were written, but got %d", bytes, written)
+		}
+	}
+	for pieceNum := 0; pieceNum < 4; pieceNum++ {
+		err := block(pieceNum)
+		if err != nil {
+			t.Errorf("Expected piece %d to be served after being written, but got %s", pieceNum, err)
+		}
+	}
+
+	err := os.Truncate(filepath.Join(dir, "files", "b"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block(3) == nil {
+		t.Errorf("Expected piece %d of the truncated file not to be served", 3)
+	}
+	lost([]int{1, 2, 3})
+	if !reflect.DeepEqual(diskio.verifiedPieces(), []bool{true, false, false, false}) {
+		t.Errorf("Expected only piece 0 to remain verified, but got %v", diskio.verifiedPieces())
+	}
+	if block(0) != nil {
+		t.Errorf("Expected piece %d to still be served", 0)
+	}
+
+	// A change of the modification time alone is noticed too
+	modTime := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(dir, "files", "a"), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block(0) == nil {
+		t.Errorf("Expected piece %d of the modified file not to be served", 0)
+	}
+	lost([]int{0})
+}
@@ -5,24 +5,66 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jackpal/bencode-go"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
-	"time"
+	"strings"
 )
 
 type HttpTracker tracker
 
-func (tr *HttpTracker) Announce(event int) {
+// parseTrackerResponse decodes a bencoded tracker response. The peers key is
+// decoded separately because trackers return it either as a compact string
+// or as a list of dictionaries.
+func parseTrackerResponse(r io.Reader) (TrackerResponse, error) {
+	var response TrackerResponse
+
+	// Decode the response into a generic bencode representation
+	m, err := bencode.Decode(r)
+	if err != nil {
+		return response, err
+	}
+	respMap, ok := m.(map[string]interface{})
+	if !ok {
+		return response, errors.New("Couldn't parse tracker response")
+	}
+	peers := respMap["peers"]
+	delete(respMap, "peers")
+
+	// Re-encode the remaining keys and unmarshal them into the response
+	var b bytes.Buffer
+	err = bencode.Marshal(&b, respMap)
+	if err != nil {
+		return response, err
+	}
+	err = bencode.Unmarshal(&b, &response)
+	if err != nil {
+		return response, err
+	}
+
+	switch peers := peers.(type) {
+	case string:
+		response.Peers = parseCompactPeers([]byte(peers))
+	case []interface{}:
+		response.Peers = parseDictPeers(peers)
+	}
+
+	return response, nil
+}
+
+func (tr *HttpTracker) Announce(event int) (TrackerResponse, error) {
 	log.Println("HttpTracker : Announce : Started")
 	defer log.Println("HttpTracker : Announce : Completed")
 
 	if tr.infoHash == nil {
-		log.Println("HttpTracker : Announce : Error: infoHash undefined")
-		return
+		return TrackerResponse{}, errors.New("infoHash undefined")
 	}
 
 	// Build and encode the Tracker Request
@@ -31,10 +73,22 @@ func (tr *HttpTracker) Announce(event int) {
 	urlParams.Set("peer_id", string(PeerID[:]))
 	urlParams.Set("key", tr.key)
 	urlParams.Set("port", strconv.FormatUint(uint64(tr.port), 10))
-	urlParams.Set("uploaded", strconv.Itoa(tr.stats.Uploaded))
-	urlParams.Set("downloaded", strconv.Itoa(tr.stats.Downloaded))
-	urlParams.Set("left", strconv.Itoa(tr.stats.Left))
+	counters := (*tracker)(tr).announceCounters()
+	urlParams.Set("uploaded", strconv.Itoa(counters.Uploaded))
+	urlParams.Set("downloaded", strconv.Itoa(counters.Downloaded))
+	urlParams.Set("left", strconv.Itoa(counters.Left))
+	// Not part of the spec, so only sent when there's something to report,
+	// and redundant only to trackers known to accept it
+	if counters.Corrupt > 0 {
+		urlParams.Set("corrupt", strconv.Itoa(counters.Corrupt))
+	}
+	if counters.Redundant > 0 && tr.acceptsRedundant {
+		urlParams.Set("redundant", strconv.Itoa(counters.Redundant))
+	}
 	urlParams.Set("compact", "1")
+	if tr.trackerId != "" {
+		urlParams.Set("trackerid", tr.trackerId)
+	}
 	switch event {
 	case Started:
 		urlParams.Set("event", "started")
@@ -48,60 +102,136 @@ func (tr *HttpTracker) Announce(event int) {
 
 	// Send a request to the Tracker
 	log.Printf("Announce: %s\n", announceURL.String())
-	resp, err := http.Get(announceURL.String())
+	client := http.DefaultClient
+	if tr.failover {
+		client = &http.Client{Timeout: failoverTimeout}
+	}
+	ctx, cancel := tr.requestContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announceURL.String(), nil)
 	if err != nil {
-		log.Printf("HttpTracker Error (%s): %v", announceURL.String(), err)
-		return
+		return TrackerResponse{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return TrackerResponse{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return TrackerResponse{}, fmt.Errorf("Tracker responded with %s", resp.Status)
+	}
 
 	// Unmarshall the Tracker Response
-	err = bencode.Unmarshal(resp.Body, &tr.response)
+	response, err := parseTrackerResponse(resp.Body)
 	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	// Schedule a timer to poll this announce URL every interval
-	if tr.response.Interval != 0 && event != Stopped {
-		nextAnnounce := time.Second * time.Duration(tr.response.Interval)
-		log.Printf("Tracker : Announce : Scheduling next announce in %v\n", nextAnnounce)
-		tr.timer = time.After(nextAnnounce)
-	}
-
-	// If we're not stopping, send the list of peers to the peers channel
-	if event != Stopped {
-		// Parse peers in binary mode and return peer IP + port
-		for i := 0; i < len(tr.response.Peers); i += 6 {
-			peerIP := net.IPv4(tr.response.Peers[i], tr.response.Peers[i+1], tr.response.Peers[i+2], tr.response.Peers[i+3])
-			peerPort := uint16(tr.response.Peers[i+4]) << 8
-			peerPort = peerPort | uint16(tr.response.Peers[i+5])
-			// Send the peer IP+port to the Torrent Manager
-			go func() { tr.peerChans.peers <- PeerTuple{peerIP, peerPort} }()
-		}
+		return response, err
+	}
+	if response.FailureReason != "" {
+		return response, errors.New(response.FailureReason)
+	}
+	if response.WarningMessage != "" {
+		log.Printf("HttpTracker : Announce : Warning from %s: %s", tr.announceURL, response.WarningMessage)
+	}
+	if response.TrackerId != "" {
+		tr.trackerId = response.TrackerId
 	}
+	return response, nil
 }
 
-func (tr *HttpTracker) Run() {
-	log.Printf("Tracker : Run : Started (%s)\n", tr.announceURL)
-	defer log.Printf("Tracker : Run : Completed (%s)\n", tr.announceURL)
-
-	tr.timer = make(<-chan time.Time)
-	tr.Announce(Started)
-
-	for {
+// requestContext returns the context of a request to the tracker. A request
+// made while the tracker runs is cancelled as soon as it's stopped. A request
+// made after it was stopped, such as the stopped event, has
+// stoppedAnnounceTimeout to complete.
+func (tr *HttpTracker) requestContext() (context.Context, context.CancelFunc) {
+	select {
+	case <-tr.quit:
+		return context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	default:
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
 		select {
 		case <-tr.quit:
-			log.Println("Tracker : Stop : Stopping")
-			tr.Announce(Stopped)
-			return
-		case <-tr.completedCh:
-			go tr.Announce(Completed)
-		case <-tr.timer:
-			log.Printf("Tracker : Run : Interval Timer Expired (%s)\n", tr.announceURL)
-			go tr.Announce(Interval)
-		case stats := <-tr.peerChans.stats:
-			log.Println("read from stats", stats)
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+	return ctx, cancel
+}
+
+// errScrapeUnsupported is returned when a tracker doesn't support scraping
+var errScrapeUnsupported = errors.New("Tracker doesn't support scrape")
+
+// scrapeURL derives the scrape URL from an announce URL by replacing
+// "announce" at the start of the last path component with "scrape". If the
+// last path component doesn't start with "announce" the tracker doesn't
+// support scraping.
+func scrapeURL(announceURL *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announceURL.Path, "/")
+	if i < 0 || !strings.HasPrefix(announceURL.Path[i+1:], "announce") {
+		return nil, errScrapeUnsupported
+	}
+	u := *announceURL
+	u.Path = announceURL.Path[:i+1] + "scrape" + announceURL.Path[i+1+len("announce"):]
+	return &u, nil
+}
+
+// parseScrapeResponse decodes a bencoded scrape response and returns the
+// statistics for infoHash
+func parseScrapeResponse(r io.Reader, infoHash []byte) (SwarmStats, error) {
+	var swarm SwarmStats
+	m, err := bencode.Decode(r)
+	if err != nil {
+		return swarm, err
+	}
+	respMap, ok := m.(map[string]interface{})
+	if !ok {
+		return swarm, errors.New("Couldn't parse scrape response")
+	}
+	if reason, ok := respMap["failure reason"].(string); ok {
+		return swarm, errors.New(reason)
+	}
+	files, _ := respMap["files"].(map[string]interface{})
+	file, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return swarm, errors.New("Scrape response doesn't include our infohash")
+	}
+	complete, _ := file["complete"].(int64)
+	incomplete, _ := file["incomplete"].(int64)
+	downloaded, _ := file["downloaded"].(int64)
+	return SwarmStats{Seeders: int(complete), Leechers: int(incomplete), Downloaded: int(downloaded)}, nil
+}
+
+func (tr *HttpTracker) Scrape() (SwarmStats, error) {
+	u, err := scrapeURL(tr.announceURL)
+	if err != nil {
+		return SwarmStats{}, err
 	}
+	urlParams := url.Values{}
+	urlParams.Set("info_hash", string(tr.infoHash))
+	u.RawQuery = urlParams.Encode()
+
+	log.Printf("Scrape: %s\n", u.String())
+	ctx, cancel := tr.requestContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return SwarmStats{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return SwarmStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return SwarmStats{}, fmt.Errorf("%w (%s)", errScrapeUnsupported, resp.Status)
+	}
+	return parseScrapeResponse(resp.Body, tr.infoHash)
+}
+
+func (tr *HttpTracker) Close() {
+}
+
+func (tr *HttpTracker) String() string {
+	return tr.announceURL.String()
 }
@@ -0,0 +1,278 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestHttpTracker starts an HTTP tracker which sends the query string of
+// each announce on queries
+func newTestHttpTracker(t *testing.T, queries chan url.Values) (*httptest.Server, *HttpTracker) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tr := &HttpTracker{key: "0badcafe", port: 51413, infoHash: bytes.Repeat([]byte{0xab}, 20), announceURL: announceURL}
+	return server, tr
+}
+
+func expectEvent(t *testing.T, queries chan url.Values, event string) {
+	select {
+	case query := <-queries:
+		if query.Get("event") != event {
+			t.Errorf("Expected event %q in the announce, but it was %q", event, query.Get("event"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an announce with event %q", event)
+	}
+}
+
+// The started event is sent on the first announce, completed when the
+// download completes and stopped on shutdown
+func TestAnnounceEvents(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server, tr := newTestHttpTracker(t, queries)
+	defer server.Close()
+	a := &announcer{tiers: [][]Tracker{{tr}}, completed: make(chan struct{}), quit: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		a.Run()
+		close(done)
+	}()
+
+	expectEvent(t, queries, "started")
+	close(a.completed)
+	expectEvent(t, queries, "completed")
+	close(a.quit)
+	expectEvent(t, queries, "stopped")
+	<-done
+}
+
+// Regular announces don't carry an event
+func TestAnnounceIntervalEvent(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server, tr := newTestHttpTracker(t, queries)
+	defer server.Close()
+
+	_, err := tr.Announce(Interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := <-queries
+	if _, ok := query["event"]; ok {
+		t.Errorf("Expected no event in a regular announce, but it was %q", query.Get("event"))
+	}
+	if query.Get("compact") != "1" || query.Get("port") != "51413" {
+		t.Errorf("Unexpected announce query %v", query)
+	}
+}
+
+// The tracker id returned by the tracker is echoed back on later announces
+func TestAnnounceTrackerId(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:10:tracker id4:abcde"))
+	}))
+	defer server.Close()
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tr := &HttpTracker{key: "0badcafe", port: 51413, infoHash: bytes.Repeat([]byte{0xab}, 20), announceURL: announceURL}
+
+	tr.Announce(Started)
+	if query := <-queries; query.Get("trackerid") != "" {
+		t.Errorf("Expected no tracker id on the first announce, but it was %q", query.Get("trackerid"))
+	}
+	tr.Announce(Interval)
+	if query := <-queries; query.Get("trackerid") != "abcd" {
+		t.Errorf("Expected tracker id %q to be echoed back, but it was %q", "abcd", query.Get("trackerid"))
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	}
+	for _, test := range tests {
+		announceURL, err := url.Parse(test.announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := scrapeURL(announceURL)
+		if test.scrape == "" {
+			if err != errScrapeUnsupported {
+				t.Errorf("Expected %s not to support scrape, but got %v, %v", test.announce, u, err)
+			}
+		} else if err != nil || u.String() != test.scrape {
+			t.Errorf("Expected scrape URL %s for %s, but got %v, %v", test.scrape, test.announce, u, err)
+		}
+	}
+}
+
+// newTestScrapeTracker starts an HTTP tracker which serves response at path
+func newTestScrapeTracker(path string, response string) (*httptest.Server, *HttpTracker) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || r.URL.Query().Get("info_hash") != string(infoHash) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tr := &HttpTracker{key: "0badcafe", port: 51413, infoHash: infoHash, announceURL: announceURL}
+	return server, tr
+}
+
+func TestScrape(t *testing.T) {
+	otherHash := string(bytes.Repeat([]byte{0xcd}, 20))
+	ourHash := string(bytes.Repeat([]byte{0xab}, 20))
+	response := "d5:filesd20:" + otherHash + "d8:completei1e10:downloadedi2e10:incompletei3ee" +
+		"20:" + ourHash + "d8:completei5e10:downloadedi50e10:incompletei10eeee"
+	server, tr := newTestScrapeTracker("/scrape", response)
+	defer server.Close()
+
+	swarm, err := tr.Scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SwarmStats{Seeders: 5, Leechers: 10, Downloaded: 50}
+	if swarm != expected {
+		t.Errorf("Expected swarm stats %+v, but got %+v", expected, swarm)
+	}
+}
+
+// A tracker which doesn't serve a scrape URL doesn't support scrape, and the
+// TrackerManager falls back to the next tracker
+func TestScrapeUnsupported(t *testing.T) {
+	server, tr := newTestScrapeTracker("/other", "")
+	defer server.Close()
+
+	_, err := tr.Scrape()
+	if !errors.Is(err, errScrapeUnsupported) {
+		t.Errorf("Expected %v, but got %v", errScrapeUnsupported, err)
+	}
+
+	swarmCh := make(chan SwarmStats, 1)
+	next := &fakeTracker{name: "next", response: TrackerResponse{Complete: 7, Incomplete: 3}}
+	tm := &trackerManager{trackers: []Tracker{tr, next}, swarmCh: swarmCh}
+	swarm, err := tm.Scrape()
+	expected := SwarmStats{Seeders: 7, Leechers: 3}
+	if err != nil || swarm != expected {
+		t.Errorf("Expected swarm stats %+v from the next tracker, but got %+v, %v", expected, swarm, err)
+	}
+	select {
+	case swarm = <-swarmCh:
+		if swarm != expected {
+			t.Errorf("Expected swarm stats %+v to be sent to Stats, but got %+v", expected, swarm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the swarm stats to be sent to Stats")
+	}
+}
+
+// The corrupt count is announced only once a piece has failed its hash
+// check, and the redundant count only to trackers known to accept it
+func TestAnnounceCorruptRedundant(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+	stats := NewStats(len(data), diskio.statsCh)
+	stats.writes = diskio.WriteStats
+	go stats.Run()
+	defer stats.Stop()
+
+	queries := make(chan url.Values, 1)
+	server, tr := newTestHttpTracker(t, queries)
+	defer server.Close()
+	tr.counters = stats.AnnounceCounters
+	announce := func() url.Values {
+		if _, err := tr.Announce(Interval); err != nil {
+			t.Fatal(err)
+		}
+		return <-queries
+	}
+
+	piece := Piece{index: 0, data: data[:pieceLength], peerName: "10.0.0.1:6881"}
+	diskio.completePiece(piece)
+	diskio.completePiece(piece)
+	query := announce()
+	if _, ok := query["corrupt"]; ok {
+		t.Errorf("Expected no corrupt count before a hash failure, but got %q", query.Get("corrupt"))
+	}
+	if _, ok := query["redundant"]; ok {
+		t.Errorf("Expected no redundant count to a tracker not known to accept it, but got %q", query.Get("redundant"))
+	}
+
+	diskio.completePiece(Piece{index: 1, data: data[:pieceLength], peerName: "10.0.0.1:6881"})
+	tr.acceptsRedundant = true
+	query = announce()
+	if query.Get("corrupt") != "1024" || query.Get("redundant") != "1024" {
+		t.Errorf("Expected 1024 corrupt and redundant bytes after a hash failure and a duplicate piece, but got %v", query)
+	}
+}
+
+// An announce waiting on a tracker that doesn't respond is cancelled when
+// the tracker is stopped
+func TestAnnounceCancelledByQuit(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tr := &HttpTracker{key: "0badcafe", port: 51413, infoHash: bytes.Repeat([]byte{0xab}, 20), announceURL: announceURL, quit: make(chan struct{})}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := tr.Announce(Interval)
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(tr.quit)
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the announce to be cancelled, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the announce to return once the tracker was stopped")
+	}
+}
+
+// A response with an error status isn't parsed as a tracker response
+func TestAnnounceErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer server.Close()
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	tr := &HttpTracker{key: "0badcafe", port: 51413, infoHash: bytes.Repeat([]byte{0xab}, 20), announceURL: announceURL}
+
+	if response, err := tr.Announce(Interval); err == nil {
+		t.Errorf("Expected an error for a %s response, but got %+v", http.StatusText(http.StatusServiceUnavailable), response)
+	}
+}
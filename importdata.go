@@ -0,0 +1,221 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Name used in place of a peer for pieces imported from the local filesystem
+const importPeerName = "import"
+
+// ImportResult reports the outcome of importing data from the local
+// filesystem
+type ImportResult struct {
+	FilesScanned   int // files found under the import path
+	FilesMatched   int // torrent files with at least one candidate of the same size
+	PiecesImported int // pieces verified from the import source and written
+	PiecesSkipped  int // missing pieces that couldn't be satisfied from the import source
+}
+
+// importSource reads data for the files of the torrent from candidate files
+// of the same size elsewhere on the filesystem
+type importSource struct {
+	candidates [][]string          // candidate paths for each file of the torrent
+	chosen     []string            // candidate that last verified a piece of each file
+	handles    map[string]*os.File // open candidate files
+}
+
+// findImportCandidates returns the regular files under path, which may be a
+// file or a directory, grouped by size
+func findImportCandidates(path string) (map[int64][]string, int, error) {
+	bySize := make(map[int64][]string)
+	scanned := 0
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("DiskIO : findImportCandidates : Skipping %s: %s", name, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		scanned++
+		bySize[info.Size()] = append(bySize[info.Size()], name)
+		return nil
+	})
+	return bySize, scanned, err
+}
+
+// newImportSource matches the files under path to the files of the torrent
+// by size. Candidates with the same base name as the torrent file are tried
+// first.
+func (diskio *DiskIO) newImportSource(path string) (*importSource, int, error) {
+	bySize, scanned, err := findImportCandidates(path)
+	if err != nil {
+		return nil, scanned, err
+	}
+	lengths := diskio.fileLengths()
+	src := &importSource{
+		candidates: make([][]string, len(lengths)),
+		chosen:     make([]string, len(lengths)),
+		handles:    make(map[string]*os.File),
+	}
+	for i, length := range lengths {
+		base := filepath.Base(diskio.filePath(i))
+		candidates := append([]string(nil), bySize[int64(length)]...)
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return filepath.Base(candidates[a]) == base && filepath.Base(candidates[b]) != base
+		})
+		src.candidates[i] = candidates
+	}
+	return src, scanned, nil
+}
+
+func (src *importSource) close() {
+	for _, file := range src.handles {
+		file.Close()
+	}
+}
+
+// readAt reads a region of a torrent file from a candidate file
+func (src *importSource) readAt(candidate string, buf []byte, offset int64) error {
+	file, ok := src.handles[candidate]
+	if !ok {
+		var err error
+		file, err = os.Open(candidate)
+		if err != nil {
+			return err
+		}
+		src.handles[candidate] = file
+	}
+	_, err := file.ReadAt(buf, offset)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// assemblePiece reads a piece from the import source, across file boundaries
+// as required, and returns it if it verifies. Each region is read from the
+// candidate that last verified a piece of its file. A piece within a single
+// file is also tried against every other candidate for that file.
+func (diskio *DiskIO) assemblePiece(src *importSource, pieceNum int) ([]byte, bool) {
+	buf := make([]byte, diskio.pieceLength(pieceNum))
+	regions := diskio.mapRegion(int64(pieceNum)*int64(diskio.metaInfo.Info.PieceLength), len(buf))
+
+	tryCandidates := func(choose func(region fileRegion) []string) bool {
+		// Every combination isn't tried, only the candidates given for the
+		// first region, with the remaining regions read from their chosen
+		// candidate
+		first := choose(regions[0])
+		for _, candidate := range first {
+			total := 0
+			ok := true
+			for i, region := range regions {
+				name := candidate
+				if i > 0 {
+					name = src.chosen[region.fileIndex]
+				}
+				if name == "" || src.readAt(name, buf[total:total+region.length], region.offset) != nil {
+					ok = false
+					break
+				}
+				total += region.length
+			}
+			if ok && diskio.checkHash(buf, pieceNum) {
+				if len(regions) == 1 {
+					src.chosen[regions[0].fileIndex] = candidate
+				}
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, region := range regions {
+		if len(src.candidates[region.fileIndex]) == 0 {
+			return nil, false
+		}
+		if src.chosen[region.fileIndex] == "" {
+			src.chosen[region.fileIndex] = src.candidates[region.fileIndex][0]
+		}
+	}
+	if tryCandidates(func(region fileRegion) []string { return []string{src.chosen[region.fileIndex]} }) {
+		return buf, true
+	}
+	if len(regions) == 1 {
+		return buf, tryCandidates(func(region fileRegion) []string { return src.candidates[region.fileIndex] })
+	}
+	return nil, false
+}
+
+// ImportData acquires missing pieces from files the user already has
+// elsewhere. Files under path, which may be a file or a directory, are
+// matched to the files of the torrent by size. Each missing piece that can be
+// assembled from them and verifies is copied into the torrent's storage
+// through the completion pipeline, so the bitfield, Stats and the Controller
+// are updated just like for a piece received from a peer. Pieces that fail
+// verification are skipped. DiskIO must be running, and not on read-only
+// storage.
+func (diskio *DiskIO) ImportData(path string) (ImportResult, error) {
+	log.Println("DiskIO : ImportData : Started")
+	defer log.Println("DiskIO : ImportData : Completed")
+
+	var result ImportResult
+	if diskio.readOnly {
+		return result, ErrReadOnly
+	}
+	src, scanned, err := diskio.newImportSource(path)
+	result.FilesScanned = scanned
+	if err != nil {
+		return result, err
+	}
+	defer src.close()
+	for _, candidates := range src.candidates {
+		if len(candidates) > 0 {
+			result.FilesMatched++
+		}
+	}
+
+	diskio.piecesMutex.RLock()
+	pieces := make([]bool, len(diskio.pieces))
+	copy(pieces, diskio.pieces)
+	diskio.piecesMutex.RUnlock()
+
+	for pieceNum, done := range pieces {
+		if done {
+			continue
+		}
+		data, ok := diskio.assemblePiece(src, pieceNum)
+		if !ok {
+			result.PiecesSkipped++
+			continue
+		}
+		piece := Piece{index: pieceNum, data: data, peerName: importPeerName, result: make(chan error, 1)}
+		select {
+		case diskio.peerChans.writePiece <- piece:
+		case <-diskio.dying:
+			return result, diskio.Err()
+		case <-diskio.quit:
+			return result, errors.New("DiskIO stopped")
+		}
+		err = <-piece.result
+		if errors.Is(err, errPieceDuplicate) {
+			// Received from a peer while the import was running
+			continue
+		} else if err != nil {
+			return result, fmt.Errorf("Unable to import piece %x: %w", pieceNum, err)
+		}
+		result.PiecesImported++
+	}
+	log.Printf("DiskIO : ImportData : Imported %d pieces from %s, skipped %d", result.PiecesImported, path, result.PiecesSkipped)
+	return result, nil
+}
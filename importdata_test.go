@@ -0,0 +1,75 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Importing a subset of the files of a torrent flips the pieces they cover,
+// including pieces assembled across two imported files, to verified
+func TestImportData(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(5, pieceLength)[:5096]
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	// Pieces 0-2 lie within files a and b, piece 3 spans b and c and piece 4
+	// lies within c
+	lengths := []int{1500, 2000, 1596}
+	setTestFiles(&metaInfo, "torrent", []string{"a", "b", "c"}, lengths)
+	diskio := createTestDiskIO(t, filepath.Join(dir, "download"), metaInfo)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	// Import a and b under other names, and a file of the same size as c
+	// with the wrong contents
+	importDir := filepath.Join(dir, "elsewhere")
+	os.MkdirAll(filepath.Join(importDir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(importDir, "first"), data[:1500], 0644)
+	ioutil.WriteFile(filepath.Join(importDir, "sub", "second"), data[1500:3500], 0644)
+	ioutil.WriteFile(filepath.Join(importDir, "decoy"), make([]byte, 1596), 0644)
+
+	result, err := diskio.ImportData(importDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ImportResult{FilesScanned: 3, FilesMatched: 3, PiecesImported: 3, PiecesSkipped: 2}
+	if result != expected {
+		t.Errorf("Expected import result %+v, but got %+v", expected, result)
+	}
+	for pieceNum, imported := range []bool{true, true, true, false, false} {
+		if diskio.pieces[pieceNum] != imported {
+			t.Errorf("Expected piece %d to be verified: %t, but it was %t", pieceNum, imported, diskio.pieces[pieceNum])
+		}
+	}
+	for i := 0; i < 3; i++ {
+		piece := <-diskio.contChans.receivedPiece
+		if piece.peerName != importPeerName {
+			t.Errorf("Expected the Controller to be told piece %d was imported, but it came from %s", piece.pieceNum, piece.peerName)
+		}
+		if n := <-diskio.statsCh; n != pieceLength {
+			t.Errorf("Expected Stats to be told %d bytes were imported, but it was %d", pieceLength, n)
+		}
+	}
+
+	onDisk, err := ioutil.ReadFile(filepath.Join(dir, "download", "torrent", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDisk, data[:1500]) {
+		t.Errorf("Imported data on disk doesn't match")
+	}
+
+	// Verified pieces aren't imported again
+	result, err = diskio.ImportData(importDir)
+	if err != nil || result.PiecesImported != 0 {
+		t.Errorf("Expected nothing to be imported a second time, but got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// retryPolicy is how often, and how long apart, an operation failing with a
+// transient storage error is retried. The delay doubles after each attempt,
+// up to maxDelay.
+type retryPolicy struct {
+	attempts int // attempts in all, 1 to never retry
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// Network filesystems fail writes for a few seconds while a server fails
+// over. Reads serving uploads are retried for less long, the peer can ask
+// someone else.
+var (
+	defaultWriteRetry = retryPolicy{attempts: 6, delay: 100 * time.Millisecond, maxDelay: 2 * time.Second}
+	defaultReadRetry  = retryPolicy{attempts: 3, delay: 50 * time.Millisecond, maxDelay: 200 * time.Millisecond}
+)
+
+// Errors of network filesystems under load, and of interrupted or busy
+// calls, that may succeed if tried again. Platforms add their own in
+// platformTransientErrnos.
+var transientErrnos = []syscall.Errno{syscall.EIO, syscall.ESTALE, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT, syscall.EBUSY}
+
+// isTransient returns true if a storage error may go away by itself, false if
+// it's permanent, like a full disk or a missing permission
+func isTransient(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, transient := range transientErrnos {
+		if errno == transient {
+			return true
+		}
+	}
+	for _, transient := range platformTransientErrnos {
+		if errno == transient {
+			return true
+		}
+	}
+	return false
+}
+
+// StorageError is the storage error that stopped a torrent, classified as
+// transient, if it persisted through every retry, or permanent
+type StorageError struct {
+	Err       error
+	Transient bool
+	Attempts  int
+}
+
+func (e *StorageError) Error() string {
+	if e.Transient {
+		return fmt.Sprintf("transient storage error persisted after %d attempts: %s", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("permanent storage error: %s", e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// retry runs op until it succeeds, fails with an error that isn't transient,
+// or policy runs out of attempts. The error returned is a *StorageError. Only
+// Abort stops the retries early, a stopping DiskIO still finishes its writes.
+func (diskio *DiskIO) retry(policy retryPolicy, what string, op func() error) error {
+	delay := policy.delay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return &StorageError{Err: err}
+		}
+		if attempt >= policy.attempts || diskio.isCancelled() {
+			return &StorageError{Err: err, Transient: true, Attempts: attempt}
+		}
+		log.Printf("DiskIO : retry : Retrying %s in %v after transient error: %s", what, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-diskio.cancelled:
+		}
+		delay *= 2
+		if delay > policy.maxDelay {
+			delay = policy.maxDelay
+		}
+	}
+}
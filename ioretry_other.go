@@ -0,0 +1,13 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// Errors of NFS mounts whose server is unreachable for a while
+var platformTransientErrnos = []syscall.Errno{syscall.ENOLCK}
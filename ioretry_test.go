@@ -0,0 +1,143 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{&os.PathError{Op: "write", Path: "payload", Err: syscall.EIO}, true},
+		{&os.PathError{Op: "write", Path: "payload", Err: syscall.ESTALE}, true},
+		{syscall.EAGAIN, true},
+		{&os.PathError{Op: "write", Path: "payload", Err: syscall.ENOSPC}, false},
+		{&os.PathError{Op: "open", Path: "payload", Err: syscall.EACCES}, false},
+		{errors.New("Write extends past the end of the torrent"), false},
+	}
+	for _, test := range tests {
+		if transient := isTransient(test.err); transient != test.transient {
+			t.Errorf("Expected isTransient(%v) to be %v, but it was %v", test.err, test.transient, transient)
+		}
+	}
+}
+
+// createRetryTestDiskIO creates a DiskIO whose file access fails with err
+// while fail returns true, and that retries with short delays
+func createRetryTestDiskIO(t *testing.T, dir string, metaInfo MetaInfo, fail func(calls int32) bool, err error) (*DiskIO, *int32) {
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	diskio.statsCh = make(chan int, 100)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 100)
+	diskio.writeRetry = retryPolicy{attempts: 4, delay: time.Millisecond, maxDelay: 4 * time.Millisecond}
+	diskio.readRetry = retryPolicy{attempts: 2, delay: time.Millisecond, maxDelay: time.Millisecond}
+	calls := new(int32)
+	diskio.storageFault = func(write bool) error {
+		if write && fail(atomic.AddInt32(calls, 1)) {
+			return &os.PathError{Op: "write", Path: diskio.partPath(0), Err: err}
+		}
+		return nil
+	}
+	return diskio, calls
+}
+
+// Pieces whose writes fail for a while with a transient error are all
+// written once the error goes away. Fewer writes fail than a piece is tried,
+// however they're spread over the workers.
+func TestRetryTransientWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	numPieces := 8
+	data := createTestPayload(numPieces, pieceLength)
+	diskio, calls := createRetryTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength), func(calls int32) bool {
+		return calls <= 3
+	}, syscall.EIO)
+	go diskio.Run()
+
+	for i := 0; i < numPieces; i++ {
+		diskio.peerChans.writePiece <- Piece{index: i, data: data[i*pieceLength : (i+1)*pieceLength], peerName: "1.2.3.4:1234"}
+	}
+	err := diskio.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(calls) <= int32(numPieces) {
+		t.Errorf("Expected writes to be retried, but there were %d for %d pieces", atomic.LoadInt32(calls), numPieces)
+	}
+	for i := 0; i < numPieces; i++ {
+		if !diskio.pieces[i] {
+			t.Errorf("Expected piece %d to be recorded", i)
+		}
+	}
+	onDisk, err := ioutil.ReadFile(diskio.filePath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDisk, data) {
+		t.Errorf("Data on disk doesn't match what was written")
+	}
+}
+
+// A transient error that persists through every retry stops DiskIO, with an
+// error saying so
+func TestRetryPersistentTransientWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	diskio, calls := createRetryTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength), func(int32) bool { return true }, syscall.EIO)
+	defer closeTestDiskIO(diskio)
+
+	err := diskio.completePiece(Piece{index: 0, data: data[:pieceLength], peerName: "1.2.3.4:1234"})
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) {
+		t.Fatalf("Expected a StorageError, but it was %v", err)
+	}
+	if !storageErr.Transient || storageErr.Attempts != diskio.writeRetry.attempts {
+		t.Errorf("Expected a transient error after %d attempts, but it was %+v", diskio.writeRetry.attempts, storageErr)
+	}
+	if n := atomic.LoadInt32(calls); n != int32(diskio.writeRetry.attempts) {
+		t.Errorf("Expected %d writes, but there were %d", diskio.writeRetry.attempts, n)
+	}
+	if !errors.Is(err, syscall.EIO) || !strings.Contains(err.Error(), "transient") {
+		t.Errorf("Expected the error to describe the transient EIO, but it was %q", err)
+	}
+	if diskio.pieces[0] {
+		t.Errorf("Expected piece %d not to be recorded after a failed write", 0)
+	}
+}
+
+// A permanent error isn't retried
+func TestRetryPermanentWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	diskio, calls := createRetryTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength), func(int32) bool { return true }, syscall.ENOSPC)
+	defer closeTestDiskIO(diskio)
+
+	err := diskio.completePiece(Piece{index: 0, data: data[:pieceLength], peerName: "1.2.3.4:1234"})
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) || storageErr.Transient {
+		t.Fatalf("Expected a permanent StorageError, but it was %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("Expected a single write, but there were %d", n)
+	}
+	if !strings.Contains(err.Error(), "permanent") {
+		t.Errorf("Expected the error to say it's permanent, but it was %q", err)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// Errors of SMB shares and files briefly locked by other programs, such as
+// virus scanners
+var platformTransientErrnos = []syscall.Errno{
+	32,  // ERROR_SHARING_VIOLATION
+	33,  // ERROR_LOCK_VIOLATION
+	54,  // ERROR_NETWORK_BUSY
+	59,  // ERROR_UNEXP_NET_ERR
+	64,  // ERROR_NETNAME_DELETED
+	121, // ERROR_SEM_TIMEOUT
+}
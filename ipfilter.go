@@ -0,0 +1,247 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IPFilter is a set of IP ranges that peers aren't connected to, such as a
+// blocklist
+type IPFilter struct {
+	ranges []ipRange // sorted by start, not overlapping
+}
+
+// ipRange is an inclusive range of IPs, both in their 16 byte form
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// ParseIPFilter reads an IP filter of one range per line. A range is an IP,
+// a CIDR block such as 10.0.0.0/8, or two IPs separated by a dash, and may be
+// prefixed by a description and a colon as in P2P blocklists. Empty lines and
+// lines starting with # are ignored.
+func ParseIPFilter(r io.Reader) (*IPFilter, error) {
+	filter := new(IPFilter)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ipr, err := parseIPRange(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the IP filter: %s", lineNum, err)
+		}
+		filter.ranges = append(filter.ranges, ipr)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	filter.merge()
+	return filter, nil
+}
+
+// LoadIPFilter reads the IP filter in a file, see ParseIPFilter
+func LoadIPFilter(path string) (*IPFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseIPFilter(file)
+}
+
+// parseIPRange parses a line of an IP filter
+func parseIPRange(line string) (ipRange, error) {
+	ipr, err := parseBareIPRange(line)
+	if err != nil {
+		// A P2P blocklist line, "description:start-end"
+		if i := strings.LastIndex(line, ":"); i >= 0 {
+			if ipr, err := parseBareIPRange(line[i+1:]); err == nil {
+				return ipr, nil
+			}
+		}
+	}
+	return ipr, err
+}
+
+func parseBareIPRange(s string) (ipRange, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("Invalid CIDR block %q", s)
+		}
+		start, end := network.IP.To16(), make(net.IP, net.IPv6len)
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		return ipRange{start: start, end: end}, nil
+	}
+	startText, endText := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		startText, endText = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	start, end := net.ParseIP(startText), net.ParseIP(endText)
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+		return ipRange{}, fmt.Errorf("Invalid IP range %q", s)
+	}
+	return ipRange{start: start.To16(), end: end.To16()}, nil
+}
+
+// merge sorts the ranges and joins those that overlap
+func (f *IPFilter) merge() {
+	sort.Slice(f.ranges, func(i, j int) bool { return bytes.Compare(f.ranges[i].start, f.ranges[j].start) < 0 })
+	merged := f.ranges[:0]
+	for _, ipr := range f.ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(ipr.start, merged[last].end) <= 0 {
+			if bytes.Compare(ipr.end, merged[last].end) > 0 {
+				merged[last].end = ipr.end
+			}
+			continue
+		}
+		merged = append(merged, ipr)
+	}
+	f.ranges = merged
+}
+
+// Blocked reports whether an IP is in one of the ranges. A nil filter blocks
+// nothing.
+func (f *IPFilter) Blocked(ip net.IP) bool {
+	if f == nil || ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	// The first range starting after the IP, the one before may hold it
+	i := sort.Search(len(f.ranges), func(i int) bool { return bytes.Compare(f.ranges[i].start, ip) > 0 })
+	return i > 0 && bytes.Compare(ip, f.ranges[i-1].end) <= 0
+}
+
+// Len returns the number of ranges, after joining those that overlap
+func (f *IPFilter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
+
+// IPFilterState is the IP filter in force, shared by the Torrent and the
+// PeerManager. A reload swaps the whole filter at once.
+type IPFilterState struct {
+	mutex  sync.Mutex
+	path   string // file the filter is loaded from
+	filter *IPFilter
+	// Connections to peers the filter newly blocks are kept when it's
+	// reloaded, only new connections are refused
+	keepConnected bool
+	changed       chan struct{} // signals the PeerManager that the filter was reloaded
+}
+
+// NewIPFilterState loads the IP filter in the file at path
+func NewIPFilterState(path string, keepConnected bool) (*IPFilterState, error) {
+	filter, err := LoadIPFilter(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("IPFilter : NewIPFilterState : Loaded %d ranges from %s", filter.Len(), path)
+	return &IPFilterState{path: path, filter: filter, keepConnected: keepConnected, changed: make(chan struct{}, 1)}, nil
+}
+
+// get returns the filter in force. A nil state blocks nothing.
+func (s *IPFilterState) get() *IPFilter {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.filter
+}
+
+// reloaded returns the channel signalled when the filter is reloaded, nil
+// for a nil state
+func (s *IPFilterState) reloaded() chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.changed
+}
+
+// reload reads the filter file again. The new filter is built before it
+// replaces the old one, which stays in force if the file can't be read.
+func (s *IPFilterState) reload() error {
+	filter, err := LoadIPFilter(s.path)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.filter = filter
+	s.mutex.Unlock()
+	log.Printf("IPFilter : reload : Loaded %d ranges from %s", filter.Len(), s.path)
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// The PeerManager hasn't swept for the last reload yet
+	}
+	return nil
+}
+
+// SetIPFilter refuses connections to and from peers at the IPs listed in the
+// file at path, see ParseIPFilter. The filter is read again by
+// ReloadIPFilter, after which connected peers it newly blocks are
+// disconnected, unless keepConnected is set. It must be called before Run.
+func (t *Torrent) SetIPFilter(path string, keepConnected bool) error {
+	state, err := NewIPFilterState(path, keepConnected)
+	if err != nil {
+		return err
+	}
+	t.ipFilter = state
+	return nil
+}
+
+// ReloadIPFilter reads the file of the IP filter set with SetIPFilter again,
+// and swaps the new filter in. If the file can't be read or parsed the old
+// filter stays in force and the error is returned. ReloadIPFilter may be
+// called before or while the torrent runs.
+func (t *Torrent) ReloadIPFilter() error {
+	if t.ipFilter == nil {
+		return errors.New("No IP filter is set")
+	}
+	err := t.ipFilter.reload()
+	if err != nil {
+		log.Printf("Torrent : ReloadIPFilter : ALERT: Keeping the previous IP filter, unable to reload %s: %s", t.ipFilter.path, err)
+	}
+	return err
+}
+
+// sweepIPFilter stops the connections to peers the IP filter blocks, unless
+// they're to be kept
+func (pm *PeerManager) sweepIPFilter() {
+	if pm.ipFilter.keepConnected {
+		return
+	}
+	filter := pm.ipFilter.get()
+	for _, p := range pm.peers {
+		if filter.Blocked(remoteIP(p.conn)) {
+			log.Printf("PeerManager : sweepIPFilter : Disconnecting %s, it's blocked by the IP filter", p.peerName)
+			go p.Stop()
+		}
+	}
+}
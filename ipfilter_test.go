@@ -0,0 +1,201 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIPFilter(t *testing.T) {
+	filter, err := ParseIPFilter(strings.NewReader(`# A blocklist
+10.0.0.0/8
+192.168.1.10 - 192.168.1.20
+Some company:172.16.0.1-172.16.0.5
+172.16.0.4-172.16.0.9
+
+203.0.113.7
+2001:db8::/32
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Len() != 5 {
+		t.Errorf("Expected 5 ranges once overlapping ones are joined, but got %d", filter.Len())
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"192.168.1.9", false},
+		{"192.168.1.15", true},
+		{"192.168.1.20", true},
+		{"172.16.0.9", true},
+		{"172.16.0.10", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, test := range tests {
+		if blocked := filter.Blocked(net.ParseIP(test.ip)); blocked != test.blocked {
+			t.Errorf("Expected %s blocked %t, but got %t", test.ip, test.blocked, blocked)
+		}
+	}
+
+	for _, line := range []string{"10.0.0.0/33", "10.0.0.9-10.0.0.1", "10.0.0.1-::1", "not an ip"} {
+		_, err := ParseIPFilter(strings.NewReader("10.0.0.0/8\n" + line + "\n"))
+		if err == nil || !strings.HasPrefix(err.Error(), "Line 2 ") {
+			t.Errorf("Expected an error on line 2 for %q, but got %v", line, err)
+		}
+	}
+	var none *IPFilter
+	if none.Blocked(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Expected a nil filter to block nothing")
+	}
+}
+
+// reloadWithConnectedPeer connects a loopback peer, reloads the IP filter
+// with a range covering it and returns whether its connection was closed
+// and the peers connected after the reload. Another connection from the
+// same IP is refused either way.
+func reloadWithConnectedPeer(t *testing.T, keepConnected bool) (bool, int) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	filterPath := filepath.Join(dir, "blocklist.txt")
+	err := ioutil.WriteFile(filterPath, []byte("10.0.0.0/8\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := new(Torrent)
+	err = torrent.SetIPFilter(filterPath, keepConnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(make([]byte, 20), pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.ipFilter = torrent.ipFilter
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connect := func(peerID string) *net.TCPConn {
+		remote, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+		copy(handshake.PeerID[:], peerID)
+		binary.Write(remote, binary.BigEndian, &handshake)
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverChans.conns <- conn
+		return remote
+	}
+	remote := connect("-XX0001-filteredpeer")
+	defer remote.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Peers) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peer to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A filter that can't be parsed leaves the old one in force
+	err = ioutil.WriteFile(filterPath, []byte("127.0.0.1\nnot an ip\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.ReloadIPFilter(); err == nil {
+		t.Errorf("Expected the reload of a bad filter to fail")
+	}
+	if filter := torrent.ipFilter.get(); filter.Len() != 1 || filter.Blocked(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected the previous filter to stay in force, but got %+v", filter)
+	}
+
+	err = ioutil.WriteFile(filterPath, []byte("10.0.0.0/8\n127.0.0.0/8\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = torrent.ReloadIPFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(ioutil.Discard, remote)
+	closed := err == nil
+
+	other := connect("-XX0001-anotherpeer0")
+	defer other.Close()
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Closed with the handshake unread, the connection may be reset
+	_, err = other.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Expected a new connection from a filtered IP to be refused, but got %v", err)
+	}
+	// The PeerManager forgets a disconnected peer asynchronously
+	expected := 0
+	if keepConnected {
+		expected = 1
+	}
+	deadline = time.Now().Add(time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && (len(dump.Peers) == expected || time.Now().After(deadline)) {
+			return closed, len(dump.Peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Reloading the IP filter disconnects the connected peers it now blocks
+func TestReloadIPFilter(t *testing.T) {
+	closed, peers := reloadWithConnectedPeer(t, false)
+	if !closed || peers != 0 {
+		t.Errorf("Expected the peer to be disconnected, but its connection was closed %t and %d peers are connected", closed, peers)
+	}
+}
+
+// Peers connected before a reload may be kept, only new connections are
+// refused
+func TestReloadIPFilterKeepConnected(t *testing.T) {
+	closed, peers := reloadWithConnectedPeer(t, true)
+	if closed || peers != 1 {
+		t.Errorf("Expected the peer to stay connected, but its connection was closed %t and %d peers are connected", closed, peers)
+	}
+}
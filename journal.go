@@ -0,0 +1,182 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Journal record types
+const (
+	journalPieceDone byte = 'D' // piece was verified and durably written
+	// Piece is about to be written. A piece started after it was last done
+	// may have been torn by a crash, and is rechecked at startup.
+	journalPieceStarted byte = 'S'
+)
+
+// Each journal record is a 1-byte type followed by a 4-byte piece index
+const journalRecordSize = 5
+
+// The journal is compacted once it holds this many records more than the
+// number of pieces
+const journalCompactSlack = 1024
+
+// openJournal opens the resume journal, creating it if it doesn't exist.
+// Records are only ever appended to the journal.
+func openJournal(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// appendJournal appends a single record to the journal and syncs it to disk
+func appendJournal(journal *os.File, recordType byte, pieceNum int) error {
+	record := make([]byte, journalRecordSize)
+	record[0] = recordType
+	binary.BigEndian.PutUint32(record[1:], uint32(pieceNum))
+	_, err := journal.Write(record)
+	if err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// loadJournal reads the journal and returns the set of pieces recorded as
+// done. A trailing partial record, left behind if we crashed in the middle of
+// an append, is ignored.
+func loadJournal(name string) (map[int]struct{}, error) {
+	done, _, err := readJournal(name)
+	return done, err
+}
+
+// readJournal reads the journal and returns the set of pieces recorded as
+// done, and the set of pieces started since they were last done
+func readJournal(name string) (map[int]struct{}, map[int]struct{}, error) {
+	done := make(map[int]struct{})
+	started := make(map[int]struct{})
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return done, started, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i+journalRecordSize <= len(data); i += journalRecordSize {
+		pieceNum := int(binary.BigEndian.Uint32(data[i+1 : i+journalRecordSize]))
+		switch data[i] {
+		case journalPieceDone:
+			done[pieceNum] = struct{}{}
+			delete(started, pieceNum)
+		case journalPieceStarted:
+			started[pieceNum] = struct{}{}
+			delete(done, pieceNum)
+		default:
+			log.Printf("Journal : loadJournal : Ignoring unknown record type %x for piece %x", data[i], pieceNum)
+		}
+	}
+	return done, started, nil
+}
+
+// rewriteJournal replaces the contents of the journal with a done record for
+// every finished piece, followed by a started record for every piece being
+// written.
+func rewriteJournal(journal *os.File, finishedPieces []bool, writing map[int]int) error {
+	err := journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	records := make([]byte, 0)
+	record := make([]byte, journalRecordSize)
+	for pieceNum, finished := range finishedPieces {
+		if finished {
+			record[0] = journalPieceDone
+			binary.BigEndian.PutUint32(record[1:], uint32(pieceNum))
+			records = append(records, record...)
+		}
+	}
+	for pieceNum := range writing {
+		record[0] = journalPieceStarted
+		binary.BigEndian.PutUint32(record[1:], uint32(pieceNum))
+		records = append(records, record...)
+	}
+	_, err = journal.Write(records)
+	if err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// compactJournal rewrites the journal with only the records still needed.
+// The caller must hold pipelineMutex.
+func (diskio *DiskIO) compactJournal() error {
+	diskio.journalRecords = len(diskio.writing)
+	for _, finished := range diskio.pieces {
+		if finished {
+			diskio.journalRecords++
+		}
+	}
+	return rewriteJournal(diskio.journal, diskio.pieces, diskio.writing)
+}
+
+// journalStarted records a piece as about to be written. The caller must
+// hold pipelineMutex.
+func (diskio *DiskIO) journalStarted(pieceNum int) error {
+	if diskio.journal == nil {
+		return nil
+	}
+	if diskio.writing == nil {
+		diskio.writing = make(map[int]int)
+	}
+	diskio.writing[pieceNum]++
+	diskio.journalRecords++
+	return appendJournal(diskio.journal, journalPieceStarted, pieceNum)
+}
+
+// journalDone records a piece as written and verified, and compacts the
+// journal once it's grown well beyond the number of pieces. The caller must
+// hold pipelineMutex.
+func (diskio *DiskIO) journalDone(pieceNum int) error {
+	if diskio.journal == nil {
+		return nil
+	}
+	if diskio.writing[pieceNum] > 1 {
+		diskio.writing[pieceNum]--
+	} else {
+		delete(diskio.writing, pieceNum)
+	}
+	diskio.journalRecords++
+	if diskio.journalRecords > len(diskio.pieces)+journalCompactSlack {
+		return diskio.compactJournal()
+	}
+	return appendJournal(diskio.journal, journalPieceDone, pieceNum)
+}
+
+// recheckStarted verifies the pieces the journal records as started but not
+// done, which a crash may have left half written, whatever the resume data
+// says about them. It's called before the pieces are settled at startup.
+func (diskio *DiskIO) recheckStarted() error {
+	if diskio.journal == nil {
+		return nil
+	}
+	_, started, err := readJournal(diskio.journalName())
+	if err != nil {
+		log.Printf("DiskIO : recheckStarted : Unable to load journal: %s", err)
+		return nil
+	}
+	for pieceNum := range started {
+		if pieceNum >= len(diskio.pieces) {
+			continue
+		}
+		good, err := diskio.VerifyPiece(pieceNum)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("DiskIO : recheckStarted : Piece %x was being written when we stopped, verified %t", pieceNum, good)
+		diskio.piecesMutex.Lock()
+		diskio.pieces[pieceNum] = good
+		diskio.piecesMutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNeverStarted is returned by Stop when Run was never called, or hadn't
+// started yet when Stop was called
+var ErrNeverStarted = errors.New("never started")
+
+// ErrStopTimeout is returned by Stop when Run doesn't return within
+// stopTimeout
+var ErrStopTimeout = errors.New("timed out waiting for Run to return")
+
+// Errors returned by start when Run must return at once
+var (
+	errStoppedBeforeRun = errors.New("stopped before it was run")
+	errAlreadyRunning   = errors.New("already running")
+)
+
+// How long Stop waits for Run to return
+var stopTimeout = 10 * time.Second
+
+// lifecycle is the contract between Run and Stop shared by the components.
+// Stop may be called before Run, more than once, and from any goroutine. Run
+// returns at once if Stop was called first or if it's already running.
+type lifecycle struct {
+	mutex   sync.Mutex // guards the fields below
+	started bool
+	stopped bool
+	done    chan struct{} // closed when Run returns
+}
+
+// start is called by Run before doing anything else. It returns an error if
+// Run must return at once, because Stop was called first or Run is already
+// running. Otherwise Run must defer finish.
+func (lc *lifecycle) start() error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.stopped {
+		return errStoppedBeforeRun
+	}
+	if lc.started {
+		return errAlreadyRunning
+	}
+	lc.started = true
+	lc.done = make(chan struct{})
+	return nil
+}
+
+// finish tells Stop that Run has returned
+func (lc *lifecycle) finish() {
+	close(lc.done)
+}
+
+// stop calls halt the first time it's called, to tell Run to return, and
+// waits up to stopTimeout for Run to return. It returns ErrNeverStarted if
+// Run hadn't started, in which case it never will.
+func (lc *lifecycle) stop(halt func()) error {
+	lc.mutex.Lock()
+	if !lc.stopped {
+		lc.stopped = true
+		halt()
+	}
+	started, done := lc.started, lc.done
+	lc.mutex.Unlock()
+	if !started {
+		return ErrNeverStarted
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(stopTimeout):
+		return ErrStopTimeout
+	}
+}
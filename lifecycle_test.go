@@ -0,0 +1,202 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lifecycleTest is a component under the Run and Stop contract
+type lifecycleTest struct {
+	run       func()
+	stop      func() error
+	lifecycle *lifecycle
+	cleanup   func()
+}
+
+// lifecycleComponents returns a constructor for a fresh instance of each
+// component
+func lifecycleComponents(t *testing.T, dir string) map[string]func() lifecycleTest {
+	return map[string]func() lifecycleTest{
+		"DiskIO": func() lifecycleTest {
+			pieceLength := 1024
+			metaInfo := createTestMetaInfo(createTestPayload(2, pieceLength), pieceLength)
+			diskio := createTestDiskIO(t, createTempDirIn(t, dir), metaInfo)
+			return lifecycleTest{diskio.Run, diskio.Stop, &diskio.lifecycle, func() { closeTestDiskIO(diskio) }}
+		},
+		"PeerManager": func() lifecycleTest {
+			pm := createTestPeerManager(4)
+			return lifecycleTest{pm.Run, pm.Stop, &pm.lifecycle, nil}
+		},
+		"Controller": func() lifecycleTest {
+			cont := createTestController()
+			return lifecycleTest{cont.Run, cont.Stop, &cont.lifecycle, nil}
+		},
+		"TrackerManager": func() lifecycleTest {
+			tm := NewTrackerManager(6881)
+			return lifecycleTest{func() { tm.Run(MetaInfo{}, make([]byte, 20)) }, tm.Stop, &tm.lifecycle, nil}
+		},
+		"Server": func() lifecycleTest {
+			sv, err := NewServer(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return lifecycleTest{sv.Run, sv.Stop, &sv.lifecycle, nil}
+		},
+		"ClockJumpDetector": func() lifecycleTest {
+			d := NewClockJumpDetector(newFakeClock())
+			return lifecycleTest{d.Run, d.Stop, &d.lifecycle, nil}
+		},
+		"Stats": func() lifecycleTest {
+			s := NewStats(0, nil)
+			return lifecycleTest{s.Run, s.Stop, &s.lifecycle, nil}
+		},
+		"Torrent": func() lifecycleTest {
+			torrentDir := createTempDirIn(t, dir)
+			torrent, err := NewTorrent(writeLargeTorrent(t, torrentDir, 4), make(chan struct{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			torrent.downloadDir = torrentDir
+			return lifecycleTest{func() { torrent.Run() }, torrent.Stop, &torrent.lifecycle, nil}
+		},
+	}
+}
+
+// createTempDirIn creates a directory in dir, which is removed with dir
+func createTempDirIn(t *testing.T, dir string) string {
+	sub, err := ioutil.TempDir(dir, "component")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+// goRun starts Run and returns a channel closed when it returns
+func goRun(run func()) chan struct{} {
+	returned := make(chan struct{})
+	go func() {
+		run()
+		close(returned)
+	}()
+	return returned
+}
+
+// waitReturned fails the test if Run doesn't return soon
+func waitReturned(t *testing.T, name string, returned chan struct{}) {
+	select {
+	case <-returned:
+	case <-time.After(stopTimeout):
+		t.Fatalf("%s : Run didn't return", name)
+	}
+}
+
+// waitStarted waits until Run has started
+func waitStarted(t *testing.T, name string, lc *lifecycle) {
+	deadline := time.Now().Add(stopTimeout)
+	for {
+		lc.mutex.Lock()
+		started := lc.started
+		lc.mutex.Unlock()
+		if started {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s : Run didn't start", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Every component can be stopped before it's run, stopped more than once,
+// run twice, and stopped from many goroutines while it starts, and Stop
+// always returns
+func TestLifecycleConformance(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	for name, create := range lifecycleComponents(t, dir) {
+		// Stopped before Run, which then returns at once
+		c := create()
+		if err := c.stop(); err != ErrNeverStarted {
+			t.Errorf("%s : Expected ErrNeverStarted from Stop before Run, but got %v", name, err)
+		}
+		if err := c.stop(); err != ErrNeverStarted {
+			t.Errorf("%s : Expected ErrNeverStarted from a second Stop, but got %v", name, err)
+		}
+		waitReturned(t, name, goRun(c.run))
+		if c.cleanup != nil {
+			c.cleanup()
+		}
+
+		// Run, run again, then stopped twice
+		c = create()
+		returned := goRun(c.run)
+		waitStarted(t, name, c.lifecycle)
+		waitReturned(t, name+" run twice", goRun(c.run))
+		if err := c.stop(); err != nil {
+			t.Errorf("%s : Expected Stop to succeed, but got %s", name, err)
+		}
+		waitReturned(t, name, returned)
+		if err := c.stop(); err != nil {
+			t.Errorf("%s : Expected a second Stop to succeed, but got %s", name, err)
+		}
+
+		// Stopped from many goroutines while Run starts, they all agree
+		// on whether it started
+		c = create()
+		returned = goRun(c.run)
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = c.stop()
+			}(i)
+		}
+		wg.Wait()
+		waitReturned(t, name, returned)
+		for _, err := range errs {
+			if err != errs[0] || (err != nil && err != ErrNeverStarted) {
+				t.Errorf("%s : Expected every Stop to return nil or ErrNeverStarted, but got %v", name, errs)
+				break
+			}
+		}
+		if errs[0] == ErrNeverStarted && c.cleanup != nil {
+			c.cleanup()
+		}
+	}
+}
+
+func TestLifecycleStopTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { stopTimeout = timeout }(stopTimeout)
+	stopTimeout = 10 * time.Millisecond
+
+	var lc lifecycle
+	if err := lc.start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.start(); !errors.Is(err, errAlreadyRunning) {
+		t.Errorf("Expected a second start to fail, but got %v", err)
+	}
+	halted := 0
+	for i := 0; i < 2; i++ {
+		if err := lc.stop(func() { halted++ }); err != ErrStopTimeout {
+			t.Errorf("Expected ErrStopTimeout while Run doesn't return, but got %v", err)
+		}
+	}
+	if halted != 1 {
+		t.Errorf("Expected Run to be told to stop once, but it was told %d times", halted)
+	}
+	lc.finish()
+	if err := lc.stop(func() { halted++ }); err != nil || halted != 1 {
+		t.Errorf("Expected Stop to succeed once Run returned, but got %v", err)
+	}
+}
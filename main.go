@@ -5,8 +5,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -15,35 +19,297 @@ import (
 	"time"
 )
 
-// Unique client ID, encoded as '-' + 'TV' + <version number> + random digits
-var PeerID = [20]byte{'-', 'T', 'V', '0', '0', '0', '1'}
+// renderVerifyProgress prints a percentage line for each progress update
+// received from Verify
+func renderVerifyProgress(progressCh chan VerifyProgress) {
+	for progress := range progressCh {
+		if progress.Resumed {
+			fmt.Printf("Resumed: %d/%d pieces good, skipped verification\n", progress.PiecesGood, progress.PiecesTotal)
+			return
+		}
+		percent := 100
+		if progress.PiecesTotal > 0 {
+			percent = progress.PiecesChecked * 100 / progress.PiecesTotal
+		}
+		fmt.Printf("\rVerifying: %3d%% (%d/%d pieces checked, %d good)", percent, progress.PiecesChecked, progress.PiecesTotal, progress.PiecesGood)
+		if progress.Done {
+			fmt.Println()
+			return
+		}
+	}
+}
+
+// runBenchmark implements the benchmark subcommand, which downloads from a
+// single peer without touching the files of the torrent and prints a report
+func runBenchmark(args []string) {
+	flags := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	duration := flags.Duration("duration", 30*time.Second, "stop after this long, 0 runs until every piece the peer has is downloaded")
+	depth := flags.Int("depth", defaultRequestDepth, "number of block requests kept outstanding")
+	noVerify := flags.Bool("no-verify", false, "don't hash check the pieces received")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatalf("Usage: %s benchmark [-duration d] [-depth n] [-no-verify] <torrent file> <peer address>\n", os.Args[0])
+	}
+
+	t, err := NewTorrent(flags.Arg(0), make(chan struct{}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	report, err := t.BenchmarkPeer(ctx, flags.Arg(1), BenchmarkOptions{Duration: *duration, PipelineDepth: *depth, SkipVerify: *noVerify})
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// renderFileCompleted prints a line for each file of the torrent that
+// completes
+func renderFileCompleted(fileCompleted chan FileCompleted) {
+	for file := range fileCompleted {
+		fmt.Printf("File complete: %s\n", file.Path)
+	}
+}
 
-// init initializes a random PeerID for this client
-func init() {
-	// Initialize PeerID
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := 7; i < 20; i++ {
-		PeerID[i] = byte(r.Intn(256))
+// renderPayloadMoved prints a line once the files of the torrent are moved to
+// the complete directory, or can't be
+func renderPayloadMoved(payloadMoved chan PayloadMoved) {
+	for moved := range payloadMoved {
+		if moved.Err != nil {
+			fmt.Printf("Not moved to %s: %s\n", moved.Dir, moved.Err)
+			continue
+		}
+		fmt.Printf("Moved to %s\n", moved.Dir)
 	}
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s: <torrent file>\n", os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		runBenchmark(os.Args[2:])
+		return
+	}
+	downloadDir := flag.String("dir", ".", "directory to download files into")
+	completeDir := flag.String("complete-dir", "", "directory to move the files to once downloaded, leave them in -dir if empty")
+	allocate := flag.String("allocate", "full", "file allocation mode: none, sparse or full")
+	ioModeName := flag.String("io", "file", "how files are read and written: file, or mmap to memory-map them")
+	maxWriteAmplification := flag.Float64("max-write-amplification", 0, "extra disk writes allowed as a multiple of the torrent size before tightening, 0 disables")
+	syncEvery := flag.Int64("sync-every", 0, "sync files after every n MiB written instead of after every piece, 0 syncs after every piece")
+	diskWorkers := flag.Int("disk-workers", defaultDiskWorkers, "number of workers writing pieces and reading blocks, the memory profile's number if not given")
+	port := flag.Uint("port", 0, "TCP port to listen for incoming peer connections on, 0 picks any free port")
+	noUploadCheck := flag.Bool("no-upload-check", false, "serve pieces read from disk without hash checking them again, saving CPU")
+	readCache := flag.Int64("read-cache", defaultReadCacheBytes/(1024*1024), "MiB of recently read pieces to cache for serving peers, 0 disables the cache, the memory profile's size if not given")
+	memory := flag.String("memory", "default", "memory profile: default, or low to keep memory use low and bounded on small devices")
+	maxPeers := flag.Int("max-peers", defaultMaxPeers, "maximum number of connected peers")
+	dialTimeout := flag.Duration("dial-timeout", defaultDialTimeout, "time a peer has to accept a connection we dial")
+	requestDepth := flag.Int("request-depth", defaultRequestDepth, "block requests kept outstanding to each peer, more to fast peers")
+	maxDepth := flag.Int("max-request-depth", maxRequestDepth, "block requests kept outstanding to a fast peer at most, -request-depth to disable adapting to the peer's rate")
+	minPieceLength := flag.Int("min-piece-length", defaultMinPieceLength/1024, "KiB, torrents with shorter pieces aren't run unless -allow-piece-length is given")
+	maxPieceLength := flag.Int("max-piece-length", defaultMaxPieceLength/1024, "KiB, torrents with longer pieces aren't run unless -allow-piece-length is given")
+	allowPieceLength := flag.Bool("allow-piece-length", false, "run torrents whose piece length is outside -min-piece-length and -max-piece-length, at the cost of memory and overhead")
+	dht := flag.Bool("dht", false, "search the DHT for peers as well, needed for torrents without trackers")
+	maxUploadRate := flag.Int64("max-upload-rate", 0, "KiB/s uploaded to every peer together at most, 0 for no limit")
+	maxDownloadRate := flag.Int64("max-download-rate", 0, "KiB/s downloaded from every peer together at most, 0 for no limit")
+	suspiciousPorts := flag.String("suspicious-ports", "25,80,443,6667", "comma separated ports whose peers are dialed last, once and never reconnected")
+	blockPorts := flag.String("block-ports", "", "comma separated ports whose peers aren't dialed at all")
+	redundantTrackers := flag.String("redundant-trackers", "", "comma separated hosts of trackers that accept the redundant byte count on announces")
+	ipFilter := flag.String("ip-filter", "", "file of IP ranges not to connect to, such as a blocklist, reloaded on SIGHUP")
+	keepFiltered := flag.Bool("keep-filtered", false, "keep connections to peers an -ip-filter reload newly blocks, only refusing new ones")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", defaultMaxConnsPerIP, "maximum number of connections to a single IP, 0 for no limit")
+	verify := flag.String("verify", "full", "piece verification policy: full, spot-check:<percent> or trusted:<peer ID or IP>,... (weakens integrity guarantees)")
+	importPath := flag.String("import", "", "file or directory to import existing data from")
+	files := flag.String("files", "", "comma separated indexes of the files to download, such as 0,2,5, every file if empty")
+	spaceMargin := flag.Float64("space-margin", defaultSpaceMargin*100, "warn when free disk space exceeds the space needed by less than this percentage")
+	readOnly := flag.Bool("read-only", false, "seed the files from read-only storage such as a DVD, never writing to them nor downloading missing pieces")
+	recheck := flag.Bool("recheck", false, "verify every piece at startup even if the resume data is valid")
+	sequential := flag.Bool("sequential", false, "download pieces in ascending order instead of rarest first, for streaming")
+	seedRatio := flag.Float64("seed-ratio", 0, "stop seeding once this many times the bytes downloaded are uploaded, 0 seeds until interrupted")
+	bootstrap := flag.Duration("bootstrap", 0, "report on the swarm within this time before starting, and only start if every piece is available")
+	dumpDir := flag.String("dump-dir", os.TempDir(), "directory to write swarm dumps into on SIGUSR1, except on Windows")
+	statusPort := flag.Uint("status-port", 0, "TCP port on localhost to serve the status of the torrent as JSON at /status and its .torrent file at /torrent on, 0 disables")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s: [-dir directory] [-complete-dir directory] [-allocate none|sparse|full] [-io file|mmap] [-max-write-amplification n] [-sync-every n] [-disk-workers n] [-port n] [-max-peers n] [-dial-timeout duration] [-request-depth n] [-max-request-depth n] [-dht] [-min-piece-length n] [-max-piece-length n] [-allow-piece-length] [-max-upload-rate n] [-max-download-rate n] [-suspicious-ports ports] [-block-ports ports] [-redundant-trackers hosts] [-ip-filter file] [-keep-filtered] [-max-conns-per-ip n] [-verify policy] [-read-cache n] [-memory default|low] [-no-upload-check] [-import path] [-files indexes] [-space-margin percent] [-read-only] [-recheck] [-sequential] [-seed-ratio ratio] [-bootstrap duration] [-dump-dir directory] [-status-port n] <torrent file>\n", os.Args[0])
+	}
+	allocateMode, err := ParseAllocateMode(*allocate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ioMode, err := ParseIOMode(*ioModeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verification, err := ParseVerificationPolicy(*verify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	memoryProfile, err := ParseMemoryProfile(*memory)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	quit := make(chan struct{})
-	t, err := NewTorrent(os.Args[1], quit)
+	t, err := NewTorrent(flag.Arg(0), quit)
 	if err != nil {
 		log.Fatal(err)
 	}
+	t.downloadDir = *downloadDir
+	t.completeDir = *completeDir
+	t.allocateMode = allocateMode
+	t.ioMode = ioMode
+	t.maxWriteAmplification = *maxWriteAmplification
+	t.syncEvery = *syncEvery * 1024 * 1024
+	t.importPath = *importPath
+	t.recheck = *recheck
+	t.readOnly = *readOnly
+	t.sequential = *sequential
+	if *seedRatio < 0 {
+		log.Fatalf("Invalid seed ratio %g", *seedRatio)
+	}
+	t.seedRatioLimit = *seedRatio
+	t.spaceMargin = *spaceMargin / 100
+	if *port > 65535 {
+		log.Fatalf("Invalid port %d", *port)
+	}
+	t.port = uint16(*port)
+	t.verification = verification
+	if *maxPeers < 1 || *maxPeers > math.MaxUint16 {
+		log.Fatalf("Invalid maximum number of peers %d", *maxPeers)
+	}
+	t.maxPeers = *maxPeers
+	if *dialTimeout <= 0 {
+		log.Fatalf("Invalid dial timeout %v", *dialTimeout)
+	}
+	t.dialTimeout = *dialTimeout
+	if *requestDepth < 1 || *maxDepth < *requestDepth {
+		log.Fatalf("Invalid request depth of %d to %d", *requestDepth, *maxDepth)
+	}
+	t.requestDepth, t.maxRequestDepth = *requestDepth, *maxDepth
+	t.dht = *dht
+	if *minPieceLength < 0 || *maxPieceLength < *minPieceLength {
+		log.Fatalf("Invalid piece length bounds of %d to %d KiB", *minPieceLength, *maxPieceLength)
+	}
+	t.minPieceLength, t.maxPieceLength = *minPieceLength*1024, *maxPieceLength*1024
+	t.allowPieceLength = *allowPieceLength
+	if err := t.checkPieceLength(); err != nil {
+		log.Fatalf("%s, run it anyway with -allow-piece-length", err)
+	}
+	t.maxUploadRate = *maxUploadRate * 1024
+	t.maxDownloadRate = *maxDownloadRate * 1024
+	suspicious, err := ParsePortList(*suspiciousPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blocked, err := ParsePortList(*blockPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *maxConnsPerIP < 0 {
+		log.Fatalf("Invalid maximum number of connections per IP %d", *maxConnsPerIP)
+	}
+	t.portPolicy = NewPortPolicy(suspicious, blocked, *maxConnsPerIP)
+	if *ipFilter != "" {
+		err = t.SetIPFilter(*ipFilter, *keepFiltered)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	t.SetMemoryProfile(memoryProfile)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "read-cache":
+			t.readCacheBytes = *readCache * 1024 * 1024
+		case "disk-workers":
+			t.diskWorkers = *diskWorkers
+		}
+	})
+	t.skipUploadCheck = *noUploadCheck
+	t.redundantTrackers = ParseHostList(*redundantTrackers)
+	if *files != "" {
+		indexes, err := ParseFileList(*files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := 0; i < t.numFiles(); i++ {
+			t.SetFileWanted(i, false)
+		}
+		for _, i := range indexes {
+			err = t.SetFileWanted(i, true)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	log.Println("main : main : Started")
 	defer log.Println("main : main : Exiting")
 
+	// Dump the swarm view for debugging at /debug/swarm
+	http.HandleFunc("/debug/swarm", func(w http.ResponseWriter, r *http.Request) {
+		dump, err := t.DumpSwarm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(dump)
+	})
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 
+	if *statusPort != 0 {
+		statusServer, err := NewStatusServer("localhost", uint16(*statusPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		statusServer.Add(t)
+		go statusServer.Run()
+		defer statusServer.Stop()
+	}
+
+	// Signal handler to reload the IP filter on SIGHUP
+	if *ipFilter != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				// A failed reload keeps the previous filter and is logged
+				t.ReloadIPFilter()
+			}
+		}()
+	}
+
+	// Signal handler to write a dump of the swarm view on SIGUSR1, where
+	// there's one
+	usr1 := make(chan os.Signal, 1)
+	notifySwarmDump(usr1)
+	go func() {
+		for range usr1 {
+			_, err := t.WriteSwarmDump(*dumpDir)
+			if err != nil {
+				log.Println("main : main : Unable to write swarm dump:", err)
+			}
+		}
+	}()
+
+	if *bootstrap > 0 {
+		report := t.Bootstrap(context.Background(), *bootstrap)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		if !report.Viable() {
+			log.Fatalf("Not starting, only %.0f%% of the pieces are available", report.Availability*100)
+		}
+	}
+
+	go renderVerifyProgress(t.verifyProgress)
+	go renderFileCompleted(t.fileCompleted)
+	go renderPayloadMoved(t.payloadMoved)
+
 	// Signal handler to catch Ctrl-C and SIGTERM from 'kill' command
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -53,9 +319,12 @@ func main() {
 		// Unregister the signal handler
 		signal.Stop(c)
 		log.Println("Received Interrupt. Shutting down...")
-		close(t.quit)
+		t.Stop()
 	}()
 
 	// Launch the torrent
-	t.Run()
+	err = t.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
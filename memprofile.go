@@ -0,0 +1,125 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A memory profile sets together the knobs bounding what's kept in memory.
+// The low profile is for seeding large swarms on small devices such as a
+// Raspberry Pi, where memory runs out before bandwidth does. Its target is to
+// stay under 64 MiB of RSS seeding a 100 GiB torrent to 200 peers, which the
+// soak test in memprofile_test.go measures.
+
+// MemoryProfile holds the knobs set by a memory profile
+type MemoryProfile struct {
+	Name string
+	// Peers kept waiting to be dialed, as many as the maximum number of
+	// peers if 0
+	MaxCandidates int
+	// Peers that dropped remembered to reconnect to, 0 for no cap
+	MaxReconnects int
+	// Bytes of recently read pieces cached for serving peers
+	ReadCacheBytes int64
+	// Pieces and block reads queued for the disk workers
+	DiskQueue int
+	// Disk workers, each holding a whole piece while it's written or read
+	// to serve a block, the default if 0
+	DiskWorkers int
+	// Pieces downloaded from a peer at once, each held in memory whole
+	// until it completes
+	DownloadsPerPeer int
+	// Requests of a peer queued, read and sent at once, more are ignored,
+	// the default if 0
+	MaxServedRequests int
+	// Record how long pieces took to download and which peers were asked
+	// for each, for the swarm dump
+	PieceTimings bool
+}
+
+// DefaultMemoryProfile favours throughput
+var DefaultMemoryProfile = MemoryProfile{
+	Name:              "default",
+	ReadCacheBytes:    defaultReadCacheBytes,
+	DiskQueue:         diskQueueSize,
+	DownloadsPerPeer:  defaultDownloadsPerPeer,
+	MaxServedRequests: defaultMaxServedRequests,
+	PieceTimings:      true,
+}
+
+// LowMemoryProfile keeps memory use low and bounded, whatever the size of the
+// swarm
+var LowMemoryProfile = MemoryProfile{
+	Name:              "low",
+	MaxCandidates:     50,
+	MaxReconnects:     100,
+	ReadCacheBytes:    4 * 1024 * 1024,
+	DiskQueue:         4,
+	DiskWorkers:       2,
+	DownloadsPerPeer:  2,
+	MaxServedRequests: 8,
+}
+
+var memoryProfiles = []MemoryProfile{DefaultMemoryProfile, LowMemoryProfile}
+
+// ParseMemoryProfile returns the memory profile with the given name
+func ParseMemoryProfile(name string) (MemoryProfile, error) {
+	for _, profile := range memoryProfiles {
+		if name == profile.Name {
+			return profile, nil
+		}
+	}
+	return DefaultMemoryProfile, fmt.Errorf("Unknown memory profile %q (expected default or low)", name)
+}
+
+// String describes the values of the profile, as logged at startup
+func (mp MemoryProfile) String() string {
+	capped := func(n int, what string) string {
+		if n == 0 {
+			return "no cap on " + what
+		}
+		return fmt.Sprintf("%d %s", n, what)
+	}
+	values := []string{
+		capped(mp.MaxCandidates, "candidates"),
+		capped(mp.MaxReconnects, "peers to reconnect to"),
+		fmt.Sprintf("%d KiB read cache", mp.ReadCacheBytes/1024),
+		fmt.Sprintf("%d queued disk jobs", mp.DiskQueue),
+		fmt.Sprintf("%d disk workers", mp.DiskWorkers),
+		fmt.Sprintf("%d downloads per peer", mp.DownloadsPerPeer),
+		fmt.Sprintf("%d requests served per peer", mp.MaxServedRequests),
+		fmt.Sprintf("piece timings %t", mp.PieceTimings),
+	}
+	return mp.Name + ": " + strings.Join(values, ", ")
+}
+
+// SetMemoryProfile bounds what the torrent keeps in memory with the values
+// of a profile. It sets the read cache, which may be sized differently
+// afterwards.
+func (t *Torrent) SetMemoryProfile(profile MemoryProfile) {
+	t.memory = profile
+	t.readCacheBytes = profile.ReadCacheBytes
+}
+
+// effectiveMemoryProfile returns the memory profile with the values the
+// torrent runs with
+func (t *Torrent) effectiveMemoryProfile() MemoryProfile {
+	profile := t.memory
+	profile.ReadCacheBytes = t.readCacheBytes
+	if t.diskWorkers > 0 {
+		profile.DiskWorkers = t.diskWorkers
+	} else if profile.DiskWorkers == 0 {
+		profile.DiskWorkers = defaultDiskWorkers
+	}
+	if profile.MaxServedRequests == 0 {
+		profile.MaxServedRequests = defaultMaxServedRequests
+	}
+	if profile.MaxCandidates == 0 || profile.MaxCandidates > t.maxPeers {
+		profile.MaxCandidates = t.maxPeers
+	}
+	return profile
+}
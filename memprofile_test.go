@@ -0,0 +1,386 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var soak = flag.Bool("soak", false, "run the memory soak test, seeding a 100 GiB torrent to 200 peers with each memory profile")
+var soakTime = flag.Duration("soak-time", time.Minute, "time the memory soak test seeds for with each memory profile")
+
+func TestParseMemoryProfile(t *testing.T) {
+	for _, name := range []string{"default", "low"} {
+		profile, err := ParseMemoryProfile(name)
+		if err != nil || profile.Name != name {
+			t.Errorf("Expected the %s profile, but got %+v, %v", name, profile, err)
+		}
+	}
+	if _, err := ParseMemoryProfile("tiny"); err == nil {
+		t.Errorf("Expected an unknown memory profile to be refused")
+	}
+}
+
+// The read cache of a profile can be sized differently afterwards, and
+// candidates are never kept beyond the maximum number of peers
+func TestEffectiveMemoryProfile(t *testing.T) {
+	torrent := &Torrent{maxPeers: 20}
+	torrent.SetMemoryProfile(LowMemoryProfile)
+	if profile := torrent.effectiveMemoryProfile(); profile.ReadCacheBytes != LowMemoryProfile.ReadCacheBytes || profile.MaxCandidates != 20 || profile.DiskWorkers != LowMemoryProfile.DiskWorkers {
+		t.Errorf("Expected the read cache and disk workers of the low profile and 20 candidates, but got %+v", profile)
+	}
+	torrent.maxPeers = 200
+	torrent.readCacheBytes = 0
+	torrent.diskWorkers = 8
+	if profile := torrent.effectiveMemoryProfile(); profile.ReadCacheBytes != 0 || profile.MaxCandidates != LowMemoryProfile.MaxCandidates || profile.DiskWorkers != 8 {
+		t.Errorf("Expected no read cache, %d candidates and 8 disk workers, but got %+v", LowMemoryProfile.MaxCandidates, profile)
+	}
+	torrent.SetMemoryProfile(DefaultMemoryProfile)
+	torrent.diskWorkers = 0
+	if profile := torrent.effectiveMemoryProfile(); profile.MaxCandidates != 200 || profile.DiskWorkers != defaultDiskWorkers {
+		t.Errorf("Expected as many candidates as peers and the default disk workers with the default profile, but got %+v", profile)
+	}
+}
+
+// Only the most recent candidates are kept, and peers to reconnect to are
+// remembered up to the cap
+func TestMemoryProfileCaps(t *testing.T) {
+	pm := createTestPeerManager(10)
+	pm.maxCandidates = 3
+	pm.maxReconnects = 2
+	for i := 1; i <= 5; i++ {
+		pm.addCandidate(PeerTuple{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881})
+	}
+	if len(pm.candidates) != 3 || !pm.candidates[0].IP.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("Expected the last 3 candidates to be kept, but got %v", pm.candidates)
+	}
+	for i := 1; i <= 3; i++ {
+		peerName := fmt.Sprintf("10.0.0.%d:6881", i)
+		_, ok := pm.rememberReconnect(peerName, PeerTuple{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881})
+		if ok != (i <= 2) {
+			t.Errorf("Expected %s to be remembered %t, but it was %t", peerName, i <= 2, ok)
+		}
+	}
+	if len(pm.reconnects) != 2 {
+		t.Errorf("Expected 2 peers to reconnect to, but got %d", len(pm.reconnects))
+	}
+}
+
+// Requests of a peer beyond those being served are ignored rather than
+// queued for DiskIO, and a cancelled request is dropped from the queue
+func TestMaxServedRequests(t *testing.T) {
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	if p.maxServedRequests != defaultMaxServedRequests {
+		t.Errorf("Expected a peer to serve %d requests at once by default, but it was %d", defaultMaxServedRequests, p.maxServedRequests)
+	}
+	p.maxServedRequests = 2
+	p.amChoking = false
+	p.peerInterested = true
+	for begin := uint32(0); begin < 4*256; begin += 256 {
+		p.decodeMessage(NewRequest(0, begin, 256).Bytes()[4:])
+	}
+	if len(p.queuedRequests) != 2 || p.servedRequests != 2 {
+		t.Fatalf("Expected 2 requests queued for DiskIO, but %d were queued and %d served", len(p.queuedRequests), p.servedRequests)
+	}
+	p.decodeMessage(NewCancel(0, 0, 256).Bytes()[4:])
+	if len(p.queuedRequests) != 1 || p.queuedRequests[0].request.begin != 256 || p.servedRequests != 1 {
+		t.Errorf("Expected the cancelled request to be dropped, but %d requests were queued and %d served", len(p.queuedRequests), p.servedRequests)
+	}
+}
+
+const (
+	soakPeers       = 200
+	soakPieceLength = 4 * 1024 * 1024
+	// Beyond a 32 bit int, see TestMemoryProfileSoak
+	soakLength    int64 = 100 * 1024 * 1024 * 1024
+	soakTargetRSS int64 = 64 * 1024 * 1024
+)
+
+// The low memory profile stays under its target seeding a 100 GiB torrent to
+// 200 peers, and below the default profile. Each profile seeds from a child
+// process, so that its memory is measured alone. Run with -soak.
+func TestMemoryProfileSoak(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("Torrents of 100 GiB need 64 bit ints")
+	}
+	if name := os.Getenv("TULVA_SOAK_PROFILE"); name != "" {
+		runSoakSeed(t, name)
+		return
+	}
+	if !*soak {
+		t.Skip("Run with -soak to measure the memory of each profile")
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	metaInfo := createSoakPayload(t, dir)
+	infoHash := sha1.Sum(soakInfoDict(metaInfo))
+
+	peak := make(map[string]int64)
+	for _, name := range []string{"default", "low"} {
+		rss, hwm, served := soakProfile(t, dir, name, infoHash[:])
+		t.Logf("Memory profile %s: %d KiB RSS, %d KiB peak, %d MiB served to %d peers in %s", name, rss/1024, hwm/1024, served/(1024*1024), soakPeers, *soakTime)
+		if served == 0 {
+			t.Errorf("Expected blocks to be served with the %s profile", name)
+		}
+		peak[name] = hwm
+	}
+	if peak["low"] >= soakTargetRSS {
+		t.Errorf("Expected the low profile to peak under %d MiB, but it peaked at %d KiB", soakTargetRSS/(1024*1024), peak["low"]/1024)
+	}
+	if peak["low"] >= peak["default"] {
+		t.Errorf("Expected the low profile to peak under the default profile's %d KiB, but it peaked at %d KiB", peak["default"]/1024, peak["low"]/1024)
+	}
+}
+
+// createSoakPayload writes a torrent of a sparse file of zeros, and resume
+// data recording every piece verified, so that it's seeded without reading
+// 100 GiB first
+func createSoakPayload(t *testing.T, dir string) MetaInfo {
+	// Converted at run time, the constant doesn't fit an int on 32 bit
+	length := soakLength
+	var metaInfo MetaInfo
+	metaInfo.Info.Name = "soak"
+	metaInfo.Info.Length = int(length)
+	metaInfo.Info.PieceLength = soakPieceLength
+	sum := sha1.Sum(make([]byte, soakPieceLength))
+	numPieces := int(length / soakPieceLength)
+	metaInfo.Info.Pieces = strings.Repeat(string(sum[:]), numPieces)
+	writeTestTorrent(t, dir, metaInfo)
+
+	file, err := os.Create(filepath.Join(dir, metaInfo.Info.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Truncate(soakLength)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.readOnly = true
+	diskio.pieces = make([]bool, numPieces)
+	for pieceNum := range diskio.pieces {
+		diskio.pieces[pieceNum] = true
+	}
+	// Files aren't synced once DiskIO is done
+	close(diskio.done)
+	infoHash := sha1.Sum(soakInfoDict(metaInfo))
+	if err := diskio.saveResume(resumeName(dir, infoHash[:]), infoHash[:], 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	return metaInfo
+}
+
+// soakInfoDict returns the info dictionary written by writeTestTorrent
+func soakInfoDict(metaInfo MetaInfo) []byte {
+	info := metaInfo.Info
+	return []byte(fmt.Sprintf("d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se", info.Length, len(info.Name), info.Name, info.PieceLength, len(info.Pieces), info.Pieces))
+}
+
+// runSoakSeed seeds the soak torrent with a memory profile, in the child
+// process. It prints the port it listens on, and its resident and peak
+// memory when asked over stdin.
+func runSoakSeed(t *testing.T, name string) {
+	log.SetOutput(ioutil.Discard)
+	profile, err := ParseMemoryProfile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := os.Getenv("TULVA_SOAK_DIR")
+	torrent, err := NewTorrent(filepath.Join(dir, "soak.torrent"), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = dir
+	torrent.readOnly = true
+	torrent.maxPeers = soakPeers
+	torrent.portPolicy = NewPortPolicy(nil, nil, 0)
+	torrent.SetMemoryProfile(profile)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+	go torrent.Run()
+	defer torrent.Stop()
+	fmt.Printf("soak port %d\n", torrent.port)
+
+	stdin := bufio.NewScanner(os.Stdin)
+	for stdin.Scan() {
+		fmt.Printf("soak rss %d %d\n", readStatusKiB(t, "VmRSS"), readStatusKiB(t, "VmHWM"))
+	}
+}
+
+// readStatusKiB returns a value in KiB from /proc/self/status
+func readStatusKiB(t *testing.T, field string) int64 {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, field+":") {
+			kib, err := strconv.ParseInt(strings.Fields(line)[1], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kib
+		}
+	}
+	t.Fatalf("No %s in /proc/self/status", field)
+	return 0
+}
+
+// soakProfile seeds with a memory profile from a child process to soakPeers
+// leechers for soakTime, and returns the resident and peak memory of the
+// child in bytes, and the bytes it served
+func soakProfile(t *testing.T, dir string, name string, infoHash []byte) (rss int64, hwm int64, served int64) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMemoryProfileSoak$")
+	cmd.Env = append(os.Environ(), "TULVA_SOAK_PROFILE="+name, "TULVA_SOAK_DIR="+dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	lines := bufio.NewScanner(stdout)
+	readLine := func(prefix string) []string {
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return strings.Fields(strings.TrimPrefix(lines.Text(), prefix))
+			}
+		}
+		t.Fatalf("The %s seed exited before printing %q", name, prefix)
+		return nil
+	}
+	addr := "127.0.0.1:" + readLine("soak port ")[0]
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for i := 0; i < soakPeers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			n := runSoakLeecher(addr, infoHash, rand.New(rand.NewSource(seed)), quit)
+			mutex.Lock()
+			served += n
+			mutex.Unlock()
+		}(int64(i))
+	}
+	time.Sleep(*soakTime)
+	io.WriteString(stdin, "rss\n")
+	values := readLine("soak rss ")
+	close(quit)
+	wg.Wait()
+	rss, _ = strconv.ParseInt(values[0], 10, 64)
+	hwm, _ = strconv.ParseInt(values[1], 10, 64)
+	return rss * 1024, hwm * 1024, served
+}
+
+// runSoakLeecher requests blocks of random pieces from the seed until quit
+// is closed, keeping a few requests outstanding while unchoked and asking
+// again for blocks that don't arrive, as requests beyond the cap of the low
+// profile are ignored. It returns the bytes received.
+func runSoakLeecher(addr string, infoHash []byte, rnd *rand.Rand, quit chan struct{}) int64 {
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			break
+		}
+		select {
+		case <-quit:
+			return 0
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	go func() {
+		<-quit
+		conn.Close()
+	}()
+	if _, err := exchangeHandshake(conn, infoHash, [8]byte{}, true, handshakeTimeout); err != nil {
+		return 0
+	}
+	writer := bufio.NewWriter(conn)
+	var writeMutex sync.Mutex
+	send := func(m Message) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		m.Write(writer)
+		writer.Flush()
+	}
+	send(NewInterested())
+
+	const pipeline = 8
+	numPieces := int(soakLength / soakPieceLength)
+	outstanding := 0
+	unchoked := false
+	var received int64
+	request := func() {
+		for ; unchoked && outstanding < pipeline; outstanding++ {
+			begin := uint32(rnd.Intn(soakPieceLength/downloadBlockSize)) * downloadBlockSize
+			send(NewRequest(uint32(rnd.Intn(numPieces)), begin, downloadBlockSize))
+		}
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		m, err := ReadMessage(reader)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Requests ignored or dropped, ask again
+			outstanding = 0
+			request()
+			continue
+		}
+		if err != nil {
+			return received
+		}
+		if m.Keepalive {
+			continue
+		}
+		switch m.ID {
+		case MsgUnchoke:
+			unchoked = true
+			request()
+		case MsgChoke:
+			unchoked, outstanding = false, 0
+		case MsgBlock:
+			if bytes.Count(m.Payload[8:], []byte{0}) == len(m.Payload)-8 {
+				received += int64(len(m.Payload) - 8)
+			}
+			if outstanding > 0 {
+				outstanding--
+			}
+			request()
+		}
+	}
+}
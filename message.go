@@ -0,0 +1,247 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Length of the largest message accepted by ReadMessage: a block message of
+// the largest block peers request, 128 KiB, with its ID, index and begin
+const maxMessageLength = 128*1024 + 9
+
+// ProtocolError is a message that breaks the peer wire protocol. The peer
+// sending it is dropped.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Reason
+}
+
+func protocolErrorf(format string, args ...interface{}) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Message is a message of the peer wire protocol, other than the handshake.
+// A keepalive has no ID or payload.
+type Message struct {
+	Keepalive bool
+	ID        int
+	Payload   []byte // the message following its ID
+}
+
+// Payload lengths of the messages that have a fixed length
+var messagePayloadLengths = map[int]int{
+	MsgChoke:         0,
+	MsgUnchoke:       0,
+	MsgInterested:    0,
+	MsgNotInterested: 0,
+	MsgHave:          4,
+	MsgRequest:       12,
+	MsgCancel:        12,
+	MsgPort:          2,
+	MsgHaveAll:       0,
+	MsgHaveNone:      0,
+}
+
+// ReadMessage reads a length prefixed message, rejecting messages longer
+// than maxMessageLength
+func ReadMessage(r io.Reader) (Message, error) {
+	return readMessage(r, maxMessageLength)
+}
+
+// readMessage reads a length prefixed message of at most limit bytes
+func readMessage(r io.Reader, limit int) (Message, error) {
+	length, err := readMessageLength(r, limit)
+	if err != nil {
+		return Message{}, err
+	}
+	if length == 0 {
+		return Message{Keepalive: true}, nil
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	return parseMessage(payload)
+}
+
+// readMessageLength reads the length prefix of a message, which is a
+// protocol error if it's over limit. Nothing is allocated for the message.
+func readMessageLength(r io.Reader, limit int) (int, error) {
+	var prefix [4]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if uint64(length) > uint64(limit) {
+		return 0, protocolErrorf("Message length %d is over the limit of %d", length, limit)
+	}
+	return int(length), nil
+}
+
+// parseMessage parses a message read from a peer, without its length
+// prefix. The payload is shared with the message returned. Messages of
+// unknown IDs, such as those of extensions, are accepted as is.
+func parseMessage(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return Message{Keepalive: true}, nil
+	}
+	m := Message{ID: int(data[0]), Payload: data[1:]}
+	if expected, ok := messagePayloadLengths[m.ID]; ok && len(m.Payload) != expected {
+		return m, protocolErrorf("Message %d has a payload of %d bytes, expected %d", m.ID, len(m.Payload), expected)
+	}
+	if m.ID == MsgBlock && len(m.Payload) < 8 {
+		return m, protocolErrorf("Block message has a payload of %d bytes, expected at least 8", len(m.Payload))
+	}
+	return m, nil
+}
+
+// Bytes returns the message with its length prefix, as sent to peers
+func (m Message) Bytes() []byte {
+	if m.Keepalive {
+		return make([]byte, 4)
+	}
+	b := make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(b, uint32(1+len(m.Payload)))
+	b[4] = byte(m.ID)
+	copy(b[5:], m.Payload)
+	return b
+}
+
+// Write writes the message with its length prefix
+func (m *Message) Write(w io.Writer) error {
+	_, err := w.Write(m.Bytes())
+	return err
+}
+
+func NewKeepalive() Message {
+	return Message{Keepalive: true}
+}
+
+func NewChoke() Message {
+	return Message{ID: MsgChoke}
+}
+
+func NewUnchoke() Message {
+	return Message{ID: MsgUnchoke}
+}
+
+func NewInterested() Message {
+	return Message{ID: MsgInterested}
+}
+
+func NewNotInterested() Message {
+	return Message{ID: MsgNotInterested}
+}
+
+func NewHave(index uint32) Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, index)
+	return Message{ID: MsgHave, Payload: payload}
+}
+
+// NewBitfield returns a bitfield message of a compacted bitfield, see
+// convertBoolSliceToByteSlice
+func NewBitfield(bitfield []byte) Message {
+	return Message{ID: MsgBitfield, Payload: bitfield}
+}
+
+func NewRequest(index, begin, length uint32) Message {
+	return Message{ID: MsgRequest, Payload: encodeBlockInfo(index, begin, length)}
+}
+
+func NewPiece(index, begin uint32, block []byte) Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload, index)
+	binary.BigEndian.PutUint32(payload[4:], begin)
+	copy(payload[8:], block)
+	return Message{ID: MsgBlock, Payload: payload}
+}
+
+func NewCancel(index, begin, length uint32) Message {
+	return Message{ID: MsgCancel, Payload: encodeBlockInfo(index, begin, length)}
+}
+
+func NewPort(port uint16) Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return Message{ID: MsgPort, Payload: payload}
+}
+
+func encodeBlockInfo(index, begin, length uint32) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload, index)
+	binary.BigEndian.PutUint32(payload[4:], begin)
+	binary.BigEndian.PutUint32(payload[8:], length)
+	return payload
+}
+
+// ParseHave returns the piece index of a have message
+func ParseHave(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, protocolErrorf("Have message has a payload of %d bytes, expected 4", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// ParseBitfield returns the pieces of a bitfield message for a torrent of
+// numPieces pieces. The bitfield must be exactly as long as needed, and the
+// spare bits of its last byte must be clear.
+func ParseBitfield(payload []byte, numPieces int) ([]bool, error) {
+	if expected := (numPieces + 7) / 8; len(payload) != expected {
+		return nil, protocolErrorf("Bitfield message has a payload of %d bytes, expected %d for %d pieces", len(payload), expected, numPieces)
+	}
+	if spare := numPieces % 8; spare != 0 && payload[len(payload)-1]&(0xff>>uint(spare)) != 0 {
+		return nil, protocolErrorf("Bitfield message has spare bits set past piece %d", numPieces-1)
+	}
+	return convertByteSliceToBoolSlice(numPieces, payload), nil
+}
+
+// ParseRequest returns the block asked for by a request message
+func ParseRequest(payload []byte) (index, begin, length uint32, err error) {
+	return parseBlockInfo("Request", payload)
+}
+
+// ParseCancel returns the block cancelled by a cancel message
+func ParseCancel(payload []byte) (index, begin, length uint32, err error) {
+	return parseBlockInfo("Cancel", payload)
+}
+
+func parseBlockInfo(name string, payload []byte) (index, begin, length uint32, err error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, protocolErrorf("%s message has a payload of %d bytes, expected 12", name, len(payload))
+	}
+	index = binary.BigEndian.Uint32(payload)
+	begin = binary.BigEndian.Uint32(payload[4:])
+	length = binary.BigEndian.Uint32(payload[8:])
+	return index, begin, length, nil
+}
+
+// ParsePiece returns the block of a block (piece) message, which shares the
+// memory of payload
+func ParsePiece(payload []byte) (index, begin uint32, block []byte, err error) {
+	if len(payload) < 8 {
+		return 0, 0, nil, protocolErrorf("Block message has a payload of %d bytes, expected at least 8", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]), payload[8:], nil
+}
+
+// ParsePort returns the DHT port of a port message
+func ParsePort(payload []byte) (uint16, error) {
+	if len(payload) != 2 {
+		return 0, protocolErrorf("Port message has a payload of %d bytes, expected 2", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload), nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testMessages() []Message {
+	return []Message{
+		NewKeepalive(),
+		NewChoke(),
+		NewUnchoke(),
+		NewInterested(),
+		NewNotInterested(),
+		NewHave(0x12345678),
+		NewBitfield([]byte{0xa4, 0x80}),
+		NewRequest(7, 0x4000, 0x4000),
+		NewPiece(7, 0x4000, bytes.Repeat([]byte{0x5a}, 100)),
+		NewPiece(8, 0, nil),
+		NewCancel(7, 0x4000, 0x4000),
+		NewPort(6881),
+		{ID: MsgHaveAll, Payload: []byte{}},
+		{ID: MsgExtended, Payload: []byte("\x00de")},
+	}
+}
+
+// Every message reads back as it was written, and its payload parses to the
+// values it was constructed with
+func TestMessageRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	for _, m := range testMessages() {
+		if err := m.Write(&stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range testMessages() {
+		m, err := ReadMessage(&stream)
+		if err != nil {
+			t.Fatalf("Reading message %d: %s", expected.ID, err)
+		}
+		if m.Keepalive != expected.Keepalive || m.ID != expected.ID || !bytes.Equal(m.Payload, expected.Payload) {
+			t.Errorf("Expected %+v, but read %+v", expected, m)
+		}
+	}
+	if _, err := ReadMessage(&stream); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, but got %v", err)
+	}
+
+	if index, err := ParseHave(NewHave(0x12345678).Payload); err != nil || index != 0x12345678 {
+		t.Errorf("Expected have %x, but got %x (%v)", 0x12345678, index, err)
+	}
+	for _, parse := range []struct {
+		m     Message
+		parse func([]byte) (uint32, uint32, uint32, error)
+	}{
+		{NewRequest(7, 0x4000, 0x2000), ParseRequest},
+		{NewCancel(7, 0x4000, 0x2000), ParseCancel},
+	} {
+		index, begin, length, err := parse.parse(parse.m.Payload)
+		if err != nil || index != 7 || begin != 0x4000 || length != 0x2000 {
+			t.Errorf("Expected block 7:4000[2000] of message %d, but got %x:%x[%x] (%v)", parse.m.ID, index, begin, length, err)
+		}
+	}
+	block := []byte("block data")
+	index, begin, data, err := ParsePiece(NewPiece(3, 0x8000, block).Payload)
+	if err != nil || index != 3 || begin != 0x8000 || !bytes.Equal(data, block) {
+		t.Errorf("Expected block 3:8000 %q, but got %x:%x %q (%v)", block, index, begin, data, err)
+	}
+	if port, err := ParsePort(NewPort(6881).Payload); err != nil || port != 6881 {
+		t.Errorf("Expected port %d, but got %d (%v)", 6881, port, err)
+	}
+}
+
+// A message cut short anywhere is an error, never a shorter message
+func TestReadTruncatedMessage(t *testing.T) {
+	for _, m := range testMessages() {
+		encoded := m.Bytes()
+		for cut := 0; cut < len(encoded); cut++ {
+			_, err := ReadMessage(bytes.NewReader(encoded[:cut]))
+			if cut == 0 && err != io.EOF {
+				t.Errorf("Expected io.EOF reading nothing, but got %v", err)
+			} else if cut > 0 && err != io.ErrUnexpectedEOF {
+				t.Errorf("Expected io.ErrUnexpectedEOF for message %d cut at %d of %d bytes, but got %v", m.ID, cut, len(encoded), err)
+			}
+		}
+	}
+}
+
+// Messages of the wrong length, and payloads too short to parse, are
+// protocol errors
+func TestMessageProtocolErrors(t *testing.T) {
+	isProtocolError := func(err error) bool {
+		var protocolErr *ProtocolError
+		return errors.As(err, &protocolErr)
+	}
+	prefixed := func(data ...byte) []byte {
+		b := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		return append(b, data...)
+	}
+	invalid := [][]byte{
+		prefixed(byte(MsgChoke), 0),
+		prefixed(byte(MsgInterested), 1, 2),
+		prefixed(byte(MsgHave), 0, 0, 1),
+		prefixed(byte(MsgHave), 0, 0, 0, 1, 0),
+		prefixed(byte(MsgRequest), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40),
+		prefixed(byte(MsgCancel), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0, 0),
+		prefixed(byte(MsgBlock), 0, 0, 0, 1, 0, 0, 0),
+		prefixed(byte(MsgPort), 0x1a),
+		prefixed(byte(MsgHaveNone), 0),
+	}
+	for _, data := range invalid {
+		if _, err := ReadMessage(bytes.NewReader(data)); !isProtocolError(err) {
+			t.Errorf("Expected a protocol error for %x, but got %v", data, err)
+		}
+	}
+
+	// The declared length is rejected before anything is allocated for it
+	for _, length := range []uint32{maxMessageLength + 1, 0xffffffff} {
+		data := make([]byte, 5)
+		binary.BigEndian.PutUint32(data, length)
+		data[4] = byte(MsgBlock)
+		if _, err := ReadMessage(bytes.NewReader(data)); !isProtocolError(err) {
+			t.Errorf("Expected a protocol error for length %d, but got %v", length, err)
+		}
+	}
+	if _, err := readMessage(bytes.NewReader(NewBitfield(make([]byte, 200)).Bytes()), 100); !isProtocolError(err) {
+		t.Errorf("Expected a protocol error for a message over the limit, but got %v", err)
+	}
+	m, err := ReadMessage(bytes.NewReader(NewPiece(0, 0, make([]byte, 128*1024)).Bytes()))
+	if err != nil || len(m.Payload) != 8+128*1024 {
+		t.Errorf("Expected a block of the largest size to be read, but got %d bytes (%v)", len(m.Payload), err)
+	}
+
+	for cut := 0; cut < 12; cut++ {
+		payload := NewRequest(1, 2, 3).Payload[:cut]
+		if _, err := ParseHave(payload); cut != 4 && !isProtocolError(err) {
+			t.Errorf("Expected a protocol error parsing a have of %d bytes, but got %v", cut, err)
+		}
+		if _, _, _, err := ParseRequest(payload); !isProtocolError(err) {
+			t.Errorf("Expected a protocol error parsing a request of %d bytes, but got %v", cut, err)
+		}
+		if _, _, _, err := ParseCancel(payload); !isProtocolError(err) {
+			t.Errorf("Expected a protocol error parsing a cancel of %d bytes, but got %v", cut, err)
+		}
+		if _, _, _, err := ParsePiece(payload); (cut < 8) != isProtocolError(err) {
+			t.Errorf("Unexpected result parsing a block of %d bytes: %v", cut, err)
+		}
+		if _, err := ParsePort(payload); cut != 2 && !isProtocolError(err) {
+			t.Errorf("Expected a protocol error parsing a port of %d bytes, but got %v", cut, err)
+		}
+	}
+}
+
+// A peer sending a malformed message is dropped instead of taking the
+// process down
+func TestPeerDropsMalformedMessage(t *testing.T) {
+	for _, payload := range [][]byte{
+		{byte(MsgRequest), 0, 0, 0, 1},
+		{byte(MsgHave), 0xff, 0xff, 0xff, 0xff},
+		{byte(MsgChoke), 1},
+	} {
+		p := NewPeer("10.0.0.1:6881", make([]byte, 20), 10, 16384, 10*16384, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+		p.decodeMessage(payload)
+		select {
+		case <-p.stopping:
+		default:
+			t.Errorf("Expected the peer to be dropped after message %x", payload)
+		}
+	}
+}
+
+// Bitfields round trip at byte boundaries and with a trailing partial byte,
+// and bitfields of the wrong length or with spare bits set are protocol
+// errors
+func TestBitfieldRoundTrip(t *testing.T) {
+	for _, numPieces := range []int{1, 7, 8, 9, 15, 16, 17, 63, 64, 65} {
+		bitfield := make([]bool, numPieces)
+		for pieceNum := range bitfield {
+			bitfield[pieceNum] = pieceNum%3 == 0 || pieceNum == numPieces-1
+		}
+		payload := convertBoolSliceToByteSlice(bitfield)
+		if len(payload) != (numPieces+7)/8 {
+			t.Errorf("Expected %d bytes for %d pieces, but got %d", (numPieces+7)/8, numPieces, len(payload))
+		}
+		parsed, err := ParseBitfield(payload, numPieces)
+		if err != nil {
+			t.Errorf("Expected the bitfield of %d pieces to parse, but got %v", numPieces, err)
+			continue
+		}
+		for pieceNum := range bitfield {
+			if parsed[pieceNum] != bitfield[pieceNum] {
+				t.Errorf("Expected %v for %d pieces, but got %v", bitfield, numPieces, parsed)
+				break
+			}
+		}
+
+		var protocolErr *ProtocolError
+		if _, err := ParseBitfield(append(payload, 0), numPieces); !errors.As(err, &protocolErr) {
+			t.Errorf("Expected a protocol error for a bitfield of %d pieces that's too long, but got %v", numPieces, err)
+		}
+		if _, err := ParseBitfield(payload[1:], numPieces); !errors.As(err, &protocolErr) {
+			t.Errorf("Expected a protocol error for a bitfield of %d pieces that's too short, but got %v", numPieces, err)
+		}
+		if numPieces%8 != 0 {
+			payload[len(payload)-1] |= 1
+			if _, err := ParseBitfield(payload, numPieces); !errors.As(err, &protocolErr) {
+				t.Errorf("Expected a protocol error for a bitfield of %d pieces with a spare bit set, but got %v", numPieces, err)
+			}
+		}
+	}
+}
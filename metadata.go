@@ -0,0 +1,42 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// CreationTime returns when the torrent was created, from the creation date
+// of the metainfo, or the zero time if it has none
+func (t *Torrent) CreationTime() time.Time {
+	if t.metaInfo.CreationDate == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t.metaInfo.CreationDate), 0)
+}
+
+// Comment returns the free-form comment of the metainfo
+func (t *Torrent) Comment() string {
+	return t.metaInfo.Comment
+}
+
+// CreatedBy returns the name and version of the program that created the
+// torrent, as found in the metainfo
+func (t *Torrent) CreatedBy() string {
+	return t.metaInfo.CreatedBy
+}
+
+// TotalLength returns the total length of the files of the torrent, in
+// single and multiple file mode alike, whether or not Init has run
+func (t *Torrent) TotalLength() int {
+	if len(t.metaInfo.Info.Files) == 0 {
+		return t.metaInfo.Info.Length
+	}
+	total := 0
+	for _, file := range t.metaInfo.Info.Files {
+		total += file.Length
+	}
+	return total
+}
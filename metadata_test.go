@@ -0,0 +1,63 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The creation date, comment and creator of a torrent file are parsed, and
+// its total length found in single and multiple file mode
+func TestTorrentMetadata(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieces := string(make([]byte, 20))
+	torrents := map[string]string{
+		"single.torrent": "d7:comment12:Test payload10:created by10:tulva 0.0113:creation datei1388534400e4:infod6:lengthi3000e4:name6:single12:piece lengthi4096e6:pieces20:" + pieces + "ee",
+		"multi.torrent":  "d4:infod5:filesld6:lengthi1000e4:pathl1:aeed6:lengthi2500e4:pathl1:beee4:name5:multi12:piece lengthi4096e6:pieces20:" + pieces + "ee",
+	}
+	for name, contents := range torrents {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	single, err := NewTorrent(filepath.Join(dir, "single.torrent"), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := single.CreationTime(); !created.Equal(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the torrent to be created on 2014-01-01, but got %s", created)
+	}
+	if single.Comment() != "Test payload" || single.CreatedBy() != "tulva 0.01" {
+		t.Errorf("Expected the comment and creator to be parsed, but got %q and %q", single.Comment(), single.CreatedBy())
+	}
+	if length := single.TotalLength(); length != 3000 {
+		t.Errorf("Expected a total length of 3000 in single file mode, but got %d", length)
+	}
+
+	multi, err := NewTorrent(filepath.Join(dir, "multi.torrent"), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := multi.CreationTime(); !created.IsZero() {
+		t.Errorf("Expected the zero time without a creation date, but got %s", created)
+	}
+	if multi.Comment() != "" || multi.CreatedBy() != "" {
+		t.Errorf("Expected no comment nor creator, but got %q and %q", multi.Comment(), multi.CreatedBy())
+	}
+	for _, initialized := range []bool{false, true} {
+		if initialized {
+			multi.Init()
+		}
+		if length := multi.TotalLength(); length != 3500 {
+			t.Errorf("Expected a total length of 3500 in multiple file mode with Init run %t, but got %d", initialized, length)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validate checks that the metainfo describes a torrent that can be
+// downloaded: pieces of a positive length, a hash for each of them, and
+// files whose paths stay within the download directory
+func (mi *MetaInfo) validate() error {
+	info := &mi.Info
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("Invalid piece length %d, expected a positive length", info.PieceLength)
+	}
+	if len(info.Pieces) == 0 || len(info.Pieces)%sha1.Size != 0 {
+		return fmt.Errorf("Invalid pieces of %d bytes, expected a multiple of %d", len(info.Pieces), sha1.Size)
+	}
+	if err := validPathElement(info.Name); err != nil {
+		return fmt.Errorf("Invalid name: %s", err)
+	}
+
+	total := info.Length
+	if len(info.Files) > 0 {
+		// Multiple File Mode
+		total = 0
+		for i, file := range info.Files {
+			if file.Length < 0 {
+				return fmt.Errorf("Invalid length %d of file %d", file.Length, i)
+			}
+			if len(file.Path) == 0 {
+				return fmt.Errorf("File %d has no path", i)
+			}
+			for _, element := range file.Path {
+				if err := validPathElement(element); err != nil {
+					return fmt.Errorf("Invalid path of file %d: %s", i, err)
+				}
+			}
+			if _, err := cleanRelPath(filepath.Join(append([]string{info.Name}, file.Path...)...)); err != nil {
+				return fmt.Errorf("Invalid path of file %d: %s", i, err)
+			}
+			total += file.Length
+		}
+	}
+	if total <= 0 {
+		return fmt.Errorf("Invalid length %d, expected a positive length", total)
+	}
+	numPieces := len(info.Pieces) / sha1.Size
+	if expected := (total + info.PieceLength - 1) / info.PieceLength; numPieces != expected {
+		return fmt.Errorf("%d pieces of %d bytes don't add up to the length of %d bytes, expected %d pieces", numPieces, info.PieceLength, total, expected)
+	}
+	return nil
+}
+
+// validPathElement returns an error if name can't be used as a file or
+// directory name within the download directory
+func validPathElement(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("%q isn't a file or directory name", name)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// bencodeList returns the bencoded list of strings
+func bencodeList(elements []string) string {
+	list := "l"
+	for _, element := range elements {
+		list += fmt.Sprintf("%d:%s", len(element), element)
+	}
+	return list + "e"
+}
+
+// Malformed torrents are refused with an error saying what's wrong
+func TestValidateMetaInfo(t *testing.T) {
+	hashes := func(n int) string { return strings.Repeat("x", n) }
+	single := func(name string, length, pieceLength int, pieces string) string {
+		return fmt.Sprintf("d4:infod6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%see", length, len(name), name, pieceLength, len(pieces), pieces)
+	}
+	multi := func(path []string, pieces string) string {
+		return fmt.Sprintf("d4:infod5:filesld6:lengthi1000e4:path%sed6:lengthi2500e4:path%see4:name5:multi12:piece lengthi4096e6:pieces%d:%see", bencodeList([]string{"a"}), bencodeList(path), len(pieces), pieces)
+	}
+	tests := []struct {
+		name     string
+		torrent  string
+		expected string // in the error, "" for a valid torrent
+	}{
+		{"single file", single("single", 3000, 1024, hashes(60)), ""},
+		{"multiple files", multi([]string{"dir", "b"}, hashes(20)), ""},
+		{"truncated pieces", single("single", 3000, 1024, hashes(59)), "Invalid pieces of 59 bytes"},
+		{"no pieces", single("single", 3000, 1024, ""), "Invalid pieces of 0 bytes"},
+		{"zero piece length", single("single", 3000, 0, hashes(60)), "Invalid piece length 0"},
+		{"too few pieces", single("single", 3000, 1024, hashes(40)), "2 pieces of 1024 bytes don't add up"},
+		{"too many pieces", multi([]string{"b"}, hashes(40)), "2 pieces of 4096 bytes don't add up"},
+		{"zero length", single("single", 0, 1024, hashes(20)), "Invalid length 0"},
+		{"parent name", single("..", 3000, 1024, hashes(60)), "Invalid name"},
+		{"name with a slash", single("../single", 3000, 1024, hashes(60)), "Invalid name"},
+		{"parent in path", multi([]string{"..", "etc", "passwd"}, hashes(20)), "Invalid path of file 1"},
+		{"slash in path", multi([]string{"../../etc/passwd"}, hashes(20)), "Invalid path of file 1"},
+		{"empty path", multi(nil, hashes(20)), "File 1 has no path"},
+	}
+	for _, test := range tests {
+		_, err := ParseTorrent(strings.NewReader(test.torrent), make(chan struct{}))
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: Expected a valid torrent, but got %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: Expected an error containing %q, but got %v", test.name, test.expected, err)
+		}
+	}
+}
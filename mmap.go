@@ -0,0 +1,153 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// IOMode controls how DiskIO reads and writes the files of the torrent
+type IOMode int
+
+const (
+	IOModeFile IOMode = iota // pieces are read and written with ReadAt and WriteAt
+	IOModeMmap               // files are memory-mapped, pieces are copied in and out of the mappings
+)
+
+var ioModeNames = []string{"file", "mmap"}
+
+var errMmapUnsupported = errors.New("mmap is not supported")
+
+func (mode IOMode) String() string {
+	if mode < 0 || int(mode) >= len(ioModeNames) {
+		return fmt.Sprintf("IOMode(%d)", int(mode))
+	}
+	return ioModeNames[mode]
+}
+
+// ParseIOMode returns the IOMode with the given name
+func ParseIOMode(name string) (IOMode, error) {
+	for mode, modeName := range ioModeNames {
+		if name == modeName {
+			return IOMode(mode), nil
+		}
+	}
+	return IOModeFile, fmt.Errorf("Unknown I/O mode %q (expected file or mmap)", name)
+}
+
+// fileAllocateMode returns how wanted files are allocated. A file can only
+// be mapped once it has its final length, so in IOModeMmap files that would
+// grow as pieces are written are truncated to their final length instead.
+func (diskio *DiskIO) fileAllocateMode() AllocateMode {
+	if diskio.ioMode == IOModeMmap && diskio.allocateMode == AllocateNone {
+		return AllocateSparse
+	}
+	return diskio.allocateMode
+}
+
+// mapFiles maps every file of the torrent in IOModeMmap. Files that can't be
+// mapped, because they're empty, skipped and not at their final length, or
+// the platform doesn't support it, are read and written through their file
+// descriptors instead. Files larger than the address space aren't handled,
+// they're left unmapped too, which only matters on 32-bit platforms.
+func (diskio *DiskIO) mapFiles() {
+	if diskio.ioMode != IOModeMmap {
+		return
+	}
+	diskio.mapsMutex.Lock()
+	diskio.maps = make([][]byte, len(diskio.files))
+	diskio.mapsMutex.Unlock()
+	for i := range diskio.files {
+		diskio.mapFile(i)
+	}
+}
+
+// mapFile maps a file of the torrent if it's at its final length
+func (diskio *DiskIO) mapFile(fileIndex int) {
+	length := int64(diskio.fileLengths()[fileIndex])
+	file := diskio.file(fileIndex)
+	if file == nil {
+		// Mapped once it's created
+		return
+	}
+	fi, err := file.Stat()
+	if err != nil || length == 0 || fi.Size() != length {
+		return
+	}
+	if int64(int(length)) != length {
+		log.Printf("DiskIO : mapFile : %s is larger than the address space, not mapping it", file.Name())
+		return
+	}
+	mapping, err := mmapFile(file, int(length))
+	if err != nil {
+		log.Printf("DiskIO : mapFile : Falling back to reading and writing %s directly, mapping it failed: %s", file.Name(), err)
+		return
+	}
+	diskio.mapsMutex.Lock()
+	defer diskio.mapsMutex.Unlock()
+	if diskio.maps[fileIndex] != nil {
+		munmapFile(mapping)
+		return
+	}
+	diskio.maps[fileIndex] = mapping
+}
+
+// unmapFile unmaps a file of the torrent, which is read and written through
+// its file descriptor from then on
+func (diskio *DiskIO) unmapFile(fileIndex int) error {
+	diskio.mapsMutex.Lock()
+	defer diskio.mapsMutex.Unlock()
+	if fileIndex >= len(diskio.maps) || diskio.maps[fileIndex] == nil {
+		return nil
+	}
+	err := munmapFile(diskio.maps[fileIndex])
+	diskio.maps[fileIndex] = nil
+	return err
+}
+
+// unmapFiles unmaps every mapped file, returning the first error
+func (diskio *DiskIO) unmapFiles() error {
+	var err error
+	for i := range diskio.maps {
+		unmapErr := diskio.unmapFile(i)
+		if err == nil {
+			err = unmapErr
+		}
+	}
+	return err
+}
+
+// syncMaps writes the dirty pages of every mapped file back to the files
+func (diskio *DiskIO) syncMaps() error {
+	diskio.mapsMutex.RLock()
+	defer diskio.mapsMutex.RUnlock()
+	for _, mapping := range diskio.maps {
+		if mapping == nil {
+			continue
+		}
+		err := msyncFile(mapping)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyMapped copies between a mapping and a buffer. A file truncated by
+// another program while it's mapped faults when the missing pages are
+// accessed, which is returned as an error rather than crashing.
+func copyMapped(dst, src []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Fault accessing a mapped file: %v", r)
+		}
+	}()
+	copy(dst, src)
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// mmapFile is only implemented on Linux
+func mmapFile(file *os.File, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(mapping []byte) error {
+	return errMmapUnsupported
+}
+
+func msyncFile(mapping []byte) error {
+	return errMmapUnsupported
+}
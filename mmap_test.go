@@ -0,0 +1,149 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseIOMode(t *testing.T) {
+	for _, mode := range []IOMode{IOModeFile, IOModeMmap} {
+		parsed, err := ParseIOMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("Expected %q to parse as %d, but got %d and %v", mode, mode, parsed, err)
+		}
+	}
+	if _, err := ParseIOMode("direct"); err == nil {
+		t.Errorf("Expected an unknown I/O mode to be refused")
+	}
+}
+
+// The round trip tests of DiskIO pass with the files mapped too
+func TestIOModeMmapRoundTrip(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap is only supported on Linux")
+	}
+	testIOMode = IOModeMmap
+	defer func() { testIOMode = IOModeFile }()
+	for name, test := range map[string]func(*testing.T){
+		"CompletePiece":              TestCompletePiece,
+		"CompletePieceCrashRecovery": TestCompletePieceCrashRecovery,
+		"VerifyPieceMultiFile":       TestVerifyPieceMultiFile,
+		"DiskIOStopFlushesWrites":    TestDiskIOStopFlushesWrites,
+	} {
+		t.Run(name, test)
+	}
+}
+
+// Files that can't be mapped are read and written through their file
+// descriptors, and wanted files are truncated to their final length so
+// that they can be mapped
+func TestIOModeMmapFallback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap is only supported on Linux")
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "multi", []string{"a", "empty", "b"}, []int{1500, 0, len(data) - 1500})
+
+	diskio := NewDiskIO(metaInfo, dir)
+	diskio.statsCh = make(chan int, 10)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	diskio.ioMode = IOModeMmap
+	diskio.allocateMode = AllocateNone
+	diskio.wantedFiles = []bool{true, true, false}
+	err := diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio.Verify()
+	defer closeTestDiskIO(diskio)
+
+	// Piece 1 spans the mapped and the skipped file
+	for pieceNum := 0; pieceNum < 2; pieceNum++ {
+		err = diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diskio.maps[0] == nil || diskio.maps[1] != nil || diskio.maps[2] != nil {
+		t.Fatalf("Expected only the wanted file to be mapped")
+	}
+	response, err := diskio.requestBlock(BlockInfo{pieceIndex: 1, begin: 0, length: uint32(pieceLength)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.data, data[pieceLength:2*pieceLength]) {
+		t.Errorf("Block read across the mapped and the unmapped file doesn't match the payload")
+	}
+
+	err = diskio.setWantedFiles([]bool{true, true, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diskio.maps[2] == nil {
+		t.Errorf("Expected the file to be mapped once it's wanted")
+	}
+	err = diskio.syncFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := ioutil.ReadFile(diskio.filePath(0))
+	if err != nil || !bytes.Equal(onDisk, data[:1500]) {
+		t.Errorf("Expected the mapped file to be synced, but got %v", err)
+	}
+}
+
+// A mapped file truncated by another program fails reads instead of
+// crashing, and is read directly once the change is detected
+func TestIOModeMmapTruncated(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap is only supported on Linux")
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 4096
+	data := createTestPayload(3, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	metaInfo.Info.Name = "mapped"
+	ioutil.WriteFile(filepath.Join(dir, "mapped"), data, 0644)
+
+	testIOMode = IOModeMmap
+	defer func() { testIOMode = IOModeFile }()
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	diskio.contChans.lostPieces = make(chan []int, 1)
+	defer closeTestDiskIO(diskio)
+	if diskio.maps[0] == nil {
+		t.Fatalf("Expected the file to be mapped")
+	}
+
+	err := os.Truncate(filepath.Join(dir, "mapped"), int64(pieceLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, pieceLength)
+	if _, err := diskio.readRegion(int64(2*pieceLength), buf); err == nil {
+		t.Errorf("Expected reading past the end of the truncated file to fail")
+	}
+
+	_, err = diskio.requestBlock(BlockInfo{pieceIndex: 2, begin: 0, length: 16}, nil)
+	if err == nil {
+		t.Errorf("Expected a block of a lost piece to be refused")
+	}
+	if diskio.maps[0] != nil {
+		t.Errorf("Expected the truncated file to be unmapped")
+	}
+	if _, err := diskio.readRegion(0, buf); err != nil || !bytes.Equal(buf, data[:pieceLength]) {
+		t.Errorf("Expected the rest of the file to be read directly, but got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// Suffix of a file being copied to the complete directory. It's renamed to
+// its final name once the copy is synced, so a file at its final name in the
+// complete directory is always a whole copy.
+const moveSuffix = ".moving"
+
+// PayloadMoved is sent when the files of the torrent have been moved to the
+// complete directory, or couldn't be
+type PayloadMoved struct {
+	Dir string
+	Err error
+}
+
+// errMoveCollision is returned when a file of the torrent already exists in
+// the complete directory. It's never overwritten.
+var errMoveCollision = errors.New("File already exists in the complete directory")
+
+// errMoving refuses a block request taken while the files start moving
+var errMoving = errors.New("Moving the files to the complete directory")
+
+// renamePath renames a file, tests replace it to move across file systems
+var renamePath = os.Rename
+
+// moveEnabled returns true if the files are moved once the torrent completes
+func (diskio *DiskIO) moveEnabled() bool {
+	return diskio.completeDir != "" && diskio.completeDir != diskio.incompleteDir
+}
+
+// currentDir returns the directory the files are stored in now
+func (diskio *DiskIO) currentDir() string {
+	diskio.pathsMutex.Lock()
+	defer diskio.pathsMutex.Unlock()
+	return diskio.downloadDir
+}
+
+// moveMarkerName returns the name of the file recording that a move to the
+// complete directory is under way
+func (diskio *DiskIO) moveMarkerName() string {
+	return filepath.Join(diskio.incompleteDir, diskio.metaInfo.Info.Name+".move")
+}
+
+// payloadExists returns true if any file of the torrent exists in dir, at its
+// final or its partial name
+func (diskio *DiskIO) payloadExists(dir string) bool {
+	for i := range diskio.fileLengths() {
+		path := diskio.filePathIn(dir, i)
+		if isRegularFile(path) || isRegularFile(path+partSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// locatePayload decides which directory the files are stored in, before
+// they're opened. A move that was interrupted is finished first. The files
+// are in the complete directory if none of them are in the incomplete one.
+func (diskio *DiskIO) locatePayload() error {
+	if !diskio.moveEnabled() {
+		return nil
+	}
+	if isRegularFile(diskio.moveMarkerName()) {
+		log.Printf("DiskIO : locatePayload : Finishing the interrupted move to %s", diskio.completeDir)
+		_, err := diskio.moveFiles()
+		return err
+	}
+	if !diskio.payloadExists(diskio.incompleteDir) && diskio.payloadExists(diskio.completeDir) {
+		diskio.pathsMutex.Lock()
+		diskio.downloadDir = diskio.completeDir
+		diskio.pathsMutex.Unlock()
+	}
+	return nil
+}
+
+// checkMoveDue tells Run to move the files to the complete directory once
+// every wanted piece is verified
+func (diskio *DiskIO) checkMoveDue() {
+	if !diskio.moveEnabled() || atomic.LoadInt32(&diskio.moveAbandoned) != 0 || diskio.currentDir() == diskio.completeDir {
+		return
+	}
+	wanted := diskio.wantedPieces()
+	diskio.piecesMutex.RLock()
+	for pieceNum, verified := range diskio.pieces {
+		if !verified && (wanted == nil || wanted[pieceNum]) {
+			diskio.piecesMutex.RUnlock()
+			return
+		}
+	}
+	diskio.piecesMutex.RUnlock()
+	select {
+	case diskio.moveDue <- struct{}{}:
+	default:
+	}
+}
+
+// moveCollisions returns an error if a file of the torrent that exists in
+// the incomplete directory also exists in the complete one
+func (diskio *DiskIO) moveCollisions() error {
+	for i := range diskio.fileLengths() {
+		for _, suffix := range []string{"", partSuffix} {
+			dest := diskio.filePathIn(diskio.completeDir, i) + suffix
+			if isRegularFile(diskio.filePathIn(diskio.incompleteDir, i)+suffix) && isRegularFile(dest) {
+				return fmt.Errorf("%w: %s", errMoveCollision, dest)
+			}
+		}
+	}
+	return nil
+}
+
+// moveToComplete is run by Run, which takes nothing more from peers
+// meanwhile, to move the files to the complete directory once every wanted
+// piece is verified. Files renamed keep their handles, files copied across
+// file systems are reopened at their new path. A name collision abandons
+// the move, seeding carries on from the incomplete directory. An error
+// moving the files stops DiskIO, and the move is finished by Init when the
+// torrent is started again.
+func (diskio *DiskIO) moveToComplete() {
+	diskio.pending.Wait()
+	err := diskio.moveCollisions()
+	if err != nil {
+		log.Printf("DiskIO : moveToComplete : Not moving the files: %s", err)
+		atomic.StoreInt32(&diskio.moveAbandoned, 1)
+		diskio.sendPayloadMoved(PayloadMoved{Dir: diskio.completeDir, Err: err})
+		return
+	}
+	log.Printf("DiskIO : moveToComplete : Moving the files to %s", diskio.completeDir)
+	diskio.pipelineMutex.Lock()
+	err = diskio.syncFiles()
+	if err == nil {
+		err = writeMoveMarker(diskio.moveMarkerName())
+	}
+	var copied []int
+	if err == nil {
+		diskio.unmapFiles()
+		copied, err = diskio.moveFiles()
+	}
+	if err == nil {
+		err = diskio.reopenFiles(copied)
+	}
+	diskio.pipelineMutex.Unlock()
+	if err != nil {
+		log.Printf("DiskIO : moveToComplete : Unable to move the files to %s: %s", diskio.completeDir, err)
+		diskio.sendPayloadMoved(PayloadMoved{Dir: diskio.completeDir, Err: err})
+		diskio.fail(err)
+		return
+	}
+	diskio.mapFiles()
+	diskio.sendPayloadMoved(PayloadMoved{Dir: diskio.completeDir})
+}
+
+// sendPayloadMoved sends a PayloadMoved without blocking
+func (diskio *DiskIO) sendPayloadMoved(moved PayloadMoved) {
+	select {
+	case diskio.payloadMoved <- moved:
+	default:
+		// Nobody is listening, or the buffer is full
+	}
+}
+
+// writeMoveMarker durably records that a move is under way
+func writeMoveMarker(name string) error {
+	marker, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = marker.Sync()
+	closeErr := marker.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// moveFiles moves every file of the torrent from the incomplete to the
+// complete directory, picking up where an interrupted move left off, and
+// stores the files there from then on. It returns the files that were
+// copied rather than renamed.
+func (diskio *DiskIO) moveFiles() ([]int, error) {
+	var copied []int
+	for i := range diskio.fileLengths() {
+		for _, suffix := range []string{"", partSuffix} {
+			wasCopied, err := moveFile(diskio.filePathIn(diskio.incompleteDir, i)+suffix, diskio.filePathIn(diskio.completeDir, i)+suffix)
+			if err != nil {
+				return nil, err
+			}
+			if wasCopied {
+				copied = append(copied, i)
+			}
+		}
+		removeEmptyParents(diskio.incompleteDir, diskio.filePathIn(diskio.incompleteDir, i))
+	}
+	if len(diskio.metaInfo.Info.Files) > 0 {
+		removeEmptyDirs(filepath.Join(diskio.incompleteDir, diskio.metaInfo.Info.Name))
+	}
+
+	diskio.pathsMutex.Lock()
+	diskio.downloadDir = diskio.completeDir
+	for i, path := range diskio.paths {
+		rel, err := filepath.Rel(diskio.incompleteDir, path)
+		if err == nil {
+			diskio.paths[i] = filepath.Join(diskio.completeDir, rel)
+		}
+	}
+	diskio.pathsMutex.Unlock()
+	log.Printf("DiskIO : moveFiles : Moved the files to %s", diskio.completeDir)
+	return copied, os.Remove(diskio.moveMarkerName())
+}
+
+// moveFile moves src to dest, copying it if they're on different file
+// systems, and returns true if it was copied. A dest that already exists is
+// the copy of an interrupted move, so only src is removed, and so is a
+// partial copy left by one.
+func moveFile(src string, dest string) (bool, error) {
+	os.Remove(dest + moveSuffix)
+	if !isRegularFile(src) {
+		return false, nil
+	}
+	if isRegularFile(dest) {
+		return false, os.Remove(src)
+	}
+	err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+	err = renamePath(src, dest)
+	if err == nil {
+		return false, nil
+	}
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || linkErr.Err != syscall.EXDEV {
+		return false, err
+	}
+	log.Printf("DiskIO : moveFile : Copying %s to %s, they're on different file systems", src, dest)
+	return true, copyFile(src, dest)
+}
+
+// copyFile copies src to dest through a temporary file, which is synced and
+// renamed to dest, and then removes src
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dest + moveSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeEmptyDirs removes dir and the directories below it if they're empty
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir)
+}
+
+// reopenFiles opens files copied to the complete directory at their new
+// path, in place of the handles of the copies that were removed
+func (diskio *DiskIO) reopenFiles(copied []int) error {
+	diskio.filesMutex.Lock()
+	defer diskio.filesMutex.Unlock()
+	for _, i := range copied {
+		if diskio.files[i] == nil {
+			continue
+		}
+		diskio.files[i].Close()
+		diskio.files[i] = nil
+		path, err := diskio.currentPath(i)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		diskio.files[i] = file
+		if diskio.stampsDirty != nil {
+			// The file is stamped when it's next checked
+			atomic.StoreInt32(&diskio.stampsDirty[i], 1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// createTestMoveDiskIO creates a DiskIO downloading into incomplete/ below
+// dir and moving the files to complete/ once they're complete
+func createTestMoveDiskIO(t *testing.T, dir string, metaInfo MetaInfo) *DiskIO {
+	incompleteDir, completeDir := filepath.Join(dir, "incomplete"), filepath.Join(dir, "complete")
+	for _, d := range []string{incompleteDir, completeDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskio := NewDiskIO(metaInfo, incompleteDir)
+	diskio.completeDir = completeDir
+	diskio.ioMode = testIOMode
+	diskio.statsCh = make(chan int, 10)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	diskio.payloadMoved = make(chan PayloadMoved, 1)
+	if err := diskio.Init(); err != nil {
+		t.Fatal(err)
+	}
+	diskio.Verify()
+	return diskio
+}
+
+// writeTestPieces hands every piece of data to a running DiskIO
+func writeTestPieces(t *testing.T, diskio *DiskIO, data []byte, pieceLength int) {
+	for pieceNum := 0; pieceNum*pieceLength < len(data); pieceNum++ {
+		end := (pieceNum + 1) * pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		result := make(chan error, 1)
+		diskio.peerChans.writePiece <- Piece{index: pieceNum, data: data[pieceNum*pieceLength : end], peerName: "10.0.0.1:6881", result: result}
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The files are moved to the complete directory once every piece is
+// verified, renamed or copied across file systems, and seeded from there
+func TestMoveToComplete(t *testing.T) {
+	defer func() { renamePath = os.Rename }()
+	for _, crossDevice := range []bool{false, true} {
+		renamePath = os.Rename
+		if crossDevice {
+			renamePath = func(src string, dest string) error {
+				return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+			}
+		}
+		dir := createTempDir(t)
+		defer os.RemoveAll(dir)
+		pieceLength := 1024
+		data := createTestPayload(4, pieceLength)
+		metaInfo := createTestMetaInfo(data, pieceLength)
+		setTestFiles(&metaInfo, "album", []string{"a", "b"}, []int{1536, 2560})
+		diskio := createTestMoveDiskIO(t, dir, metaInfo)
+		go diskio.Run()
+
+		writeTestPieces(t, diskio, data, pieceLength)
+		moved := <-diskio.payloadMoved
+		if moved.Err != nil || moved.Dir != diskio.completeDir {
+			t.Fatalf("Expected the files to be moved to %s, but got %+v", diskio.completeDir, moved)
+		}
+		for i := range diskio.fileLengths() {
+			path := diskio.filePathIn(diskio.completeDir, i)
+			if current, _ := diskio.currentPath(i); current != path {
+				t.Errorf("Expected file %d to be stored at %s, but got %s", i, path, current)
+			}
+			if isRegularFile(diskio.filePathIn(diskio.incompleteDir, i)) {
+				t.Errorf("Expected file %d to be gone from the incomplete directory", i)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(diskio.incompleteDir, "album")); !os.IsNotExist(err) {
+			t.Errorf("Expected the empty directory of the torrent to be removed, but got %v", err)
+		}
+		if !isRegularFile(diskio.journalName()) || isRegularFile(diskio.moveMarkerName()) {
+			t.Errorf("Expected the journal to stay in the incomplete directory, and the move marker to be removed")
+		}
+
+		// Blocks are served from the new location, through reopened
+		// handles where the files were copied
+		responseCh := make(chan BlockResponse)
+		diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: 3, begin: 0, length: 100}, response: responseCh}
+		if response := <-responseCh; response.err != nil || !bytes.Equal(response.data, data[3*pieceLength:3*pieceLength+100]) {
+			t.Errorf("Expected block 3:0[100] to be served after the move (cross device %t), but got %v", crossDevice, response.err)
+		}
+		if err := diskio.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		closeTestDiskIO(diskio)
+	}
+}
+
+// A completed file opened before the files are copied across file systems
+// is read through the reopened handle after the move
+func TestReadCompletedFileAcrossMove(t *testing.T) {
+	defer func() { renamePath = os.Rename }()
+	renamePath = func(src string, dest string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "album", []string{"a", "b"}, []int{1536, 2560})
+	diskio := createTestMoveDiskIO(t, dir, metaInfo)
+	go diskio.Run()
+	defer closeTestDiskIO(diskio)
+	defer diskio.Stop()
+
+	// File a is complete once its two pieces are written
+	writeTestPieces(t, diskio, data[:2*pieceLength], pieceLength)
+	file, err := diskio.OpenCompletedFile(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for pieceNum := 2; pieceNum < 4; pieceNum++ {
+		result := make(chan error, 1)
+		diskio.peerChans.writePiece <- Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength], peerName: "10.0.0.1:6881", result: result}
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if moved := <-diskio.payloadMoved; moved.Err != nil {
+		t.Fatal(moved.Err)
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil || !bytes.Equal(contents, data[:1536]) {
+		t.Errorf("Expected to read file a after it was copied, but got %d bytes, %v", len(contents), err)
+	}
+}
+
+// A move interrupted part way is finished when the torrent starts again,
+// whichever file it stopped at
+func TestMoveResumed(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "album", []string{"a", "b"}, []int{1536, 2560})
+	incompleteDir, completeDir := filepath.Join(dir, "incomplete"), filepath.Join(dir, "complete")
+	for _, d := range []string{filepath.Join(incompleteDir, "album"), filepath.Join(completeDir, "album")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// File a was copied but not yet removed, b was part way through its copy
+	files := map[string][]byte{
+		filepath.Join(incompleteDir, "album", "a"):               data[:1536],
+		filepath.Join(completeDir, "album", "a"):                 data[:1536],
+		filepath.Join(incompleteDir, "album", "b"):               data[1536:],
+		filepath.Join(completeDir, "album", "b"+moveSuffix):      data[1536:2000],
+		filepath.Join(incompleteDir, metaInfo.Info.Name+".move"): nil,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(name, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diskio := createTestMoveDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	for i := range diskio.fileLengths() {
+		if current, _ := diskio.currentPath(i); current != diskio.filePathIn(completeDir, i) {
+			t.Errorf("Expected file %d to be stored in the complete directory, but got %s", i, current)
+		}
+	}
+	// Only the journal is left in the incomplete directory
+	for _, name := range []string{filepath.Join(incompleteDir, "album"), filepath.Join(completeDir, "album", "b"+moveSuffix), diskio.moveMarkerName()} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed by finishing the move, but got %v", name, err)
+		}
+	}
+	for pieceNum, verified := range diskio.verifiedPieces() {
+		if !verified {
+			t.Errorf("Expected piece %d to be verified in the complete directory", pieceNum)
+		}
+	}
+}
+
+// A file of the same name in the complete directory is never overwritten,
+// the move is abandoned and seeding carries on where the files are
+func TestMoveCollision(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	existing := []byte("someone else's file")
+	for name, contents := range map[string][]byte{
+		filepath.Join(dir, "complete", metaInfo.Info.Name):   existing,
+		filepath.Join(dir, "incomplete", metaInfo.Info.Name): data[:pieceLength],
+	} {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskio := createTestMoveDiskIO(t, dir, metaInfo)
+	go diskio.Run()
+
+	writeTestPieces(t, diskio, data, pieceLength)
+	moved := <-diskio.payloadMoved
+	if !errors.Is(moved.Err, errMoveCollision) {
+		t.Errorf("Expected the move to fail with a collision, but got %v", moved.Err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(dir, "complete", metaInfo.Info.Name)); err != nil || !bytes.Equal(contents, existing) {
+		t.Errorf("Expected the existing file to be left alone, but got %q, %v", contents, err)
+	}
+	responseCh := make(chan BlockResponse)
+	diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: 2, begin: 0, length: 100}, response: responseCh}
+	if response := <-responseCh; response.err != nil || !bytes.Equal(response.data, data[2*pieceLength:2*pieceLength+100]) {
+		t.Errorf("Expected block 2:0[100] to be served from the incomplete directory, but got %v", response.err)
+	}
+	if err := diskio.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	closeTestDiskIO(diskio)
+}
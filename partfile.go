@@ -0,0 +1,339 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Suffix of files that haven't been completely downloaded yet, so that other
+// programs don't pick up partial data
+const partSuffix = ".part"
+
+// FileCompleted is sent when every piece of a file has been verified and the
+// file has been renamed to its final name
+type FileCompleted struct {
+	Index int
+	Path  string
+}
+
+// partPath returns the path a file of the torrent is stored at until it's
+// complete
+func (diskio *DiskIO) partPath(fileIndex int) string {
+	return diskio.filePath(fileIndex) + partSuffix
+}
+
+// isRegularFile returns true if name exists and is a regular file
+func isRegularFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// currentPath returns the path a file of the torrent is stored at. Before
+// Init it's whichever of the final and the partial name exists, preferring
+// the final name, and an error is returned if both exist since which one is
+// used is only decided by verifying them.
+func (diskio *DiskIO) currentPath(fileIndex int) (string, error) {
+	diskio.pathsMutex.Lock()
+	defer diskio.pathsMutex.Unlock()
+	if diskio.paths != nil {
+		return diskio.paths[fileIndex], nil
+	}
+	final := diskio.filePathIn(diskio.downloadDir, fileIndex)
+	part := final + partSuffix
+	finalExists, partExists := isRegularFile(final), isRegularFile(part)
+	if finalExists && partExists {
+		return "", fmt.Errorf("Both %s and %s exist", final, part)
+	}
+	if finalExists {
+		return final, nil
+	}
+	return part, nil
+}
+
+// openFiles opens the files of the torrent that exist, and creates the
+// directories of the rest. Files that don't exist yet are only created once
+// data is written to them, see createFile. A file is opened at its final
+// name if it exists there, otherwise at its partial name. Where both exist
+// the one verifying more pieces is kept and the other is removed. On
+// read-only storage the files are opened read-only and nothing is created.
+func (diskio *DiskIO) openFiles() error {
+	lengths := diskio.fileLengths()
+	paths := make([]string, len(lengths))
+	diskio.files = make([]*os.File, len(lengths))
+	var conflicts []int
+	for i := range lengths {
+		final, part := diskio.filePath(i), diskio.partPath(i)
+		paths[i] = part
+		if isRegularFile(final) {
+			paths[i] = final
+			if isRegularFile(part) {
+				conflicts = append(conflicts, i)
+			}
+		} else if !isRegularFile(part) {
+			if diskio.readOnly {
+				// Its pieces are missing for good
+				continue
+			}
+			err := os.MkdirAll(filepath.Dir(part), os.ModeDir|os.ModePerm)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		file, err := os.OpenFile(paths[i], diskio.openFlag(), 0644)
+		if err != nil {
+			return err
+		}
+		diskio.files[i] = file
+	}
+	for _, i := range conflicts {
+		path, err := diskio.resolveConflict(i)
+		if err != nil {
+			return err
+		}
+		paths[i] = path
+	}
+	diskio.pathsMutex.Lock()
+	diskio.paths = paths
+	diskio.complete = make([]bool, len(lengths))
+	diskio.pathsMutex.Unlock()
+	return nil
+}
+
+// file returns the open file of the torrent at fileIndex, nil if it hasn't
+// been created yet
+func (diskio *DiskIO) file(fileIndex int) *os.File {
+	diskio.filesMutex.RLock()
+	defer diskio.filesMutex.RUnlock()
+	return diskio.files[fileIndex]
+}
+
+// createFile returns the open file of the torrent at fileIndex, creating it
+// at its partial name if it doesn't exist yet. A file created while it's
+// wanted is allocated, and mapped in IOModeMmap.
+func (diskio *DiskIO) createFile(fileIndex int) (*os.File, error) {
+	if file := diskio.file(fileIndex); file != nil {
+		return file, nil
+	}
+	if diskio.readOnly {
+		return nil, fmt.Errorf("%w: not creating %s", ErrReadOnly, diskio.filePath(fileIndex))
+	}
+	diskio.filesMutex.Lock()
+	file := diskio.files[fileIndex]
+	if file != nil {
+		diskio.filesMutex.Unlock()
+		return file, nil
+	}
+	path, err := diskio.currentPath(fileIndex)
+	if err == nil {
+		file, err = openOrCreateFile(path)
+	}
+	if err == nil && fileWanted(diskio.wantedFiles, fileIndex) {
+		err = allocateFile(file, int64(diskio.fileLengths()[fileIndex]), diskio.fileAllocateMode())
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		diskio.filesMutex.Unlock()
+		return nil, err
+	}
+	diskio.files[fileIndex] = file
+	if diskio.stampsDirty != nil {
+		// The file is stamped when it's next checked
+		atomic.StoreInt32(&diskio.stampsDirty[fileIndex], 1)
+	}
+	diskio.filesMutex.Unlock()
+	log.Printf("DiskIO : createFile : Created %s", path)
+
+	if diskio.maps != nil {
+		diskio.mapFile(fileIndex)
+	}
+	return file, nil
+}
+
+// resolveConflict decides between a file existing at both its final and its
+// partial name, which is opened at the final name, by the number of pieces
+// each verifies. The final name wins a tie. The losing file is removed, unless
+// the storage is read-only, and the path of the winner is returned.
+func (diskio *DiskIO) resolveConflict(fileIndex int) (string, error) {
+	final, part := diskio.filePath(fileIndex), diskio.partPath(fileIndex)
+	finalFile := diskio.files[fileIndex]
+	finalGood, err := diskio.countVerified(fileIndex)
+	if err != nil {
+		return "", err
+	}
+	partFile, err := os.OpenFile(part, diskio.openFlag(), 0644)
+	if err != nil {
+		return "", err
+	}
+	diskio.files[fileIndex] = partFile
+	partGood, err := diskio.countVerified(fileIndex)
+	if err != nil {
+		partFile.Close()
+		return "", err
+	}
+
+	winner, loser := finalFile, partFile
+	if partGood > finalGood {
+		winner, loser = partFile, finalFile
+	}
+	diskio.files[fileIndex] = winner
+	log.Printf("DiskIO : resolveConflict : Both %s (%d pieces good) and %s (%d pieces good) exist, keeping %s", final, finalGood, part, partGood, winner.Name())
+	loser.Close()
+	if diskio.readOnly {
+		return winner.Name(), nil
+	}
+	err = os.Remove(loser.Name())
+	if err != nil {
+		return "", err
+	}
+	return winner.Name(), nil
+}
+
+// filePieces returns the range of pieces overlapping a file, first up to but
+// not including end. The range is empty for a file of zero length.
+func (diskio *DiskIO) filePieces(fileIndex int) (first int, end int) {
+	lengths := diskio.fileLengths()
+	start := int64(0)
+	for _, length := range lengths[:fileIndex] {
+		start += int64(length)
+	}
+	if lengths[fileIndex] == 0 {
+		return 0, 0
+	}
+	pieceLength := int64(diskio.metaInfo.Info.PieceLength)
+	last := (start + int64(lengths[fileIndex]) - 1) / pieceLength
+	return int(start / pieceLength), int(last) + 1
+}
+
+// countVerified returns the number of pieces overlapping a file that verify
+// against the files currently open
+func (diskio *DiskIO) countVerified(fileIndex int) (int, error) {
+	buf := diskio.verifyBuffer()
+	first, end := diskio.filePieces(fileIndex)
+	good := 0
+	for pieceNum := first; pieceNum < end; pieceNum++ {
+		ok, err := diskio.verifyPiece(pieceNum, buf)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			good++
+		}
+	}
+	return good, nil
+}
+
+// fileVerified returns true if every piece overlapping a file is verified.
+// The caller must hold pipelineMutex or piecesMutex.
+func (diskio *DiskIO) fileVerified(fileIndex int) bool {
+	first, end := diskio.filePieces(fileIndex)
+	for pieceNum := first; pieceNum < end; pieceNum++ {
+		if !diskio.pieces[pieceNum] {
+			return false
+		}
+	}
+	return true
+}
+
+// renameFile moves an open file of the torrent to path. The file handle is
+// kept, so reads and writes carry on across the rename.
+func (diskio *DiskIO) renameFile(fileIndex int, path string) error {
+	diskio.pathsMutex.Lock()
+	defer diskio.pathsMutex.Unlock()
+	if diskio.paths[fileIndex] == path {
+		return nil
+	}
+	if diskio.readOnly {
+		return fmt.Errorf("%w: not renaming %s", ErrReadOnly, diskio.paths[fileIndex])
+	}
+	err := os.Rename(diskio.paths[fileIndex], path)
+	if err != nil {
+		return err
+	}
+	log.Printf("DiskIO : renameFile : Renamed %s to %s", diskio.paths[fileIndex], path)
+	diskio.paths[fileIndex] = path
+	return nil
+}
+
+// completeFile renames a file whose pieces have all been verified to its
+// final name, if it hasn't been already, and sends a FileCompleted. An empty
+// file, which no data is ever written to, is created here. Files on
+// read-only storage keep the name they were found at. The caller must hold
+// pipelineMutex.
+func (diskio *DiskIO) completeFile(fileIndex int) error {
+	if diskio.complete[fileIndex] || !diskio.fileVerified(fileIndex) {
+		return nil
+	}
+	if diskio.readOnly {
+		diskio.complete[fileIndex] = true
+		return nil
+	}
+	_, err := diskio.createFile(fileIndex)
+	if err != nil {
+		return err
+	}
+	err = diskio.renameFile(fileIndex, diskio.filePath(fileIndex))
+	if err != nil {
+		return err
+	}
+	diskio.complete[fileIndex] = true
+	select {
+	case diskio.fileCompleted <- FileCompleted{Index: fileIndex, Path: diskio.filePath(fileIndex)}:
+	default:
+		// Nobody is listening, or the buffer is full
+	}
+	return nil
+}
+
+// completeFiles completes the files a piece that was just recorded overlaps.
+// The caller must hold pipelineMutex.
+func (diskio *DiskIO) completeFiles(pieceNum int) error {
+	offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+	for _, region := range diskio.mapRegion(offset, diskio.pieceLength(pieceNum)) {
+		err := diskio.completeFile(region.fileIndex)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleFiles gives every open file the name matching the verified pieces
+// once they're known at startup. Complete files are moved to their final
+// name, and incomplete files found at their final name are moved back to
+// their partial name. Files on read-only storage are left as they are.
+func (diskio *DiskIO) settleFiles() error {
+	if diskio.paths == nil || diskio.readOnly {
+		return nil
+	}
+	diskio.pipelineMutex.Lock()
+	defer diskio.pipelineMutex.Unlock()
+	for i := range diskio.files {
+		if diskio.fileVerified(i) {
+			err := diskio.completeFile(i)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if diskio.file(i) == nil {
+			// Not created yet
+			continue
+		}
+		err := diskio.renameFile(i, diskio.partPath(i))
+		if err != nil {
+			return err
+		}
+		diskio.complete[i] = false
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkFileNames fails unless a file exists at its final name only if
+// complete, and at its partial name otherwise
+func checkFileNames(t *testing.T, name string, complete bool) {
+	_, finalErr := os.Stat(name)
+	_, partErr := os.Stat(name + partSuffix)
+	if complete && (finalErr != nil || partErr == nil) {
+		t.Errorf("Expected %s to be complete, but the final name gave %v and the partial name %v", name, finalErr, partErr)
+	}
+	if !complete && (finalErr == nil || partErr != nil) {
+		t.Errorf("Expected %s to be incomplete, but the final name gave %v and the partial name %v", name, finalErr, partErr)
+	}
+}
+
+// Files are downloaded to their partial name and renamed once their last
+// piece is recorded, and blocks can still be read after the rename
+func TestPartFileRenamedOnCompletion(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "files", []string{"a", "b"}, []int{1500, 2596})
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	diskio.fileCompleted = make(chan FileCompleted, 2)
+	a, b := filepath.Join(dir, "files", "a"), filepath.Join(dir, "files", "b")
+	for _, name := range []string{a, a + partSuffix, b, b + partSuffix} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("Expected %s not to be created before any data for it arrives", name)
+		}
+	}
+
+	// File a is covered by pieces 0 and 1, and b by pieces 1 to 3
+	for _, pieceNum := range []int{0, 2, 3, 1} {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFileNames(t, a, pieceNum == 1)
+		if pieceNum != 0 {
+			checkFileNames(t, b, pieceNum == 1)
+		}
+	}
+	for _, expected := range []FileCompleted{{0, a}, {1, b}} {
+		select {
+		case completed := <-diskio.fileCompleted:
+			if completed != expected {
+				t.Errorf("Expected %+v to complete, but got %+v", expected, completed)
+			}
+		default:
+			t.Errorf("Expected %+v to complete", expected)
+		}
+	}
+
+	response, err := diskio.requestBlock(BlockInfo{pieceIndex: 1, begin: 0, length: uint32(pieceLength)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.data, data[pieceLength:2*pieceLength]) {
+		t.Errorf("Block read after the rename doesn't match the payload")
+	}
+}
+
+// At startup a complete file at its final name is reused, an incomplete one
+// is moved back to its partial name, and where both names exist the one
+// verifying more pieces is kept
+func TestPartFileStartup(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "files", []string{"a", "b", "c"}, []int{1024, 1024, 2048})
+	os.MkdirAll(filepath.Join(dir, "files"), 0755)
+	a, b, c := filepath.Join(dir, "files", "a"), filepath.Join(dir, "files", "b"), filepath.Join(dir, "files", "c")
+	// a is complete, b is at its final name but corrupt, and c has one
+	// good piece at its final name and two at its partial name
+	ioutil.WriteFile(a, data[:1024], 0644)
+	ioutil.WriteFile(b, make([]byte, 1024), 0644)
+	ioutil.WriteFile(c, append(append([]byte{}, data[2048:3072]...), make([]byte, 1024)...), 0644)
+	ioutil.WriteFile(c+partSuffix, data[2048:], 0644)
+
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	checkFileNames(t, a, true)
+	checkFileNames(t, b, false)
+	checkFileNames(t, c, true)
+	onDisk, _ := ioutil.ReadFile(c)
+	if !bytes.Equal(onDisk, data[2048:]) {
+		t.Errorf("Expected the partial copy of c to be kept")
+	}
+	expected := []bool{true, false, true, true}
+	for i := range expected {
+		if diskio.pieces[i] != expected[i] {
+			t.Errorf("Expected pieces %v, but got %v", expected, diskio.pieces)
+			break
+		}
+	}
+
+	// Resume data matches the names the files settled on
+	_, err := diskio.fileStates()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// A file that can't be renamed to its final name stops DiskIO with an I/O
+// error instead of the process
+func TestPartFileRenameError(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	// Something else took the final name
+	os.MkdirAll(filepath.Join(dir, metaInfo.Info.Name, "taken"), 0755)
+
+	for pieceNum := 0; pieceNum < 2; pieceNum++ {
+		diskio.processPiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+	}
+	err := diskio.Err()
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		t.Errorf("Expected DiskIO to fail with the rename error, but it was %v", err)
+	}
+	if _, err := os.Stat(diskio.partPath(0)); err != nil {
+		t.Errorf("Expected the file to stay at its partial name, but got %v", err)
+	}
+}
@@ -10,12 +10,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net"
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,12 +37,51 @@ const (
 	MsgPort
 )
 
+// Message ID values of extensions. The fast extension isn't supported, but
+// peers send its messages regardless.
 const (
-	downloadBlockSize             = 16384
-	maxSimultaneousBlockDownloads = 20
-	maxPeers                      = 100
+	MsgHaveAll  int = 0x0e // fast extension
+	MsgHaveNone int = 0x0f // fast extension
+	MsgExtended int = 20   // extension protocol
 )
 
+const (
+	downloadBlockSize   = 16384
+	defaultMaxPeers     = 100
+	minPeerDownloadRate = 1024             // bytes per second below which a peer may be evicted
+	handshakeTimeout    = 30 * time.Second // time a peer has to complete the handshake
+	defaultDialTimeout  = 10 * time.Second // time a peer we dial has to accept the connection
+	defaultMaxHalfOpen  = 30               // connections dialed at once, more peers wait as candidates
+	peerIdleTimeout     = 2 * time.Minute  // a peer that sends nothing for this long is dropped
+	keepaliveInterval   = 90 * time.Second // a keepalive is sent after sending nothing for this long, within the peer's idle timeout
+	// Requests of a peer queued, read and sent at once, see MemoryProfile
+	defaultMaxServedRequests = 250
+)
+
+var errSelfConnection = errors.New("Connected to ourselves")
+
+// Time between checks for a peer to evict in favour of a peer we haven't
+// connected to, and how long a peer is connected before it may be evicted
+var (
+	peerEvictionInterval    = 30 * time.Second
+	peerEvictionGracePeriod = 2 * time.Minute
+)
+
+// Delay before reconnecting to a peer we dialed that dropped, or that we
+// failed to connect to, doubling after each attempt up to the maximum, and
+// the number of attempts before the peer is given up on. A peer that stays
+// connected for peerEvictionGracePeriod starts over from the minimum delay.
+var (
+	reconnectMinDelay    = time.Second
+	reconnectMaxDelay    = 5 * time.Minute
+	maxReconnectAttempts = 8
+)
+
+// Pieces that fail their hash check from peers at an IP before the IP is
+// banned. A peer is disconnected after each bad piece, so the failures are
+// counted across connections.
+var maxBadPieces = 3
+
 // PeerTuple represents a single IP+port pair of a peer
 type PeerTuple struct {
 	IP   net.IP
@@ -48,54 +89,145 @@ type PeerTuple struct {
 }
 
 type Peer struct {
-	conn             *net.TCPConn
-	peerName         string
-	amChoking        bool
-	amInterested     bool
-	peerChoking      bool
-	peerInterested   bool
-	ourBitfield      []bool
-	peerBitfield     []bool
-	peerID           []byte
-	ticker           *time.Ticker
-	lastTxMessage    time.Time
-	lastRxMessage    time.Time
-	infoHash         []byte
-	pieceLength      int
-	sendChan         chan []byte
-	totalLength      int
-	downloads        []*PieceDownload
-	diskIOChans      diskIOPeerChans
-	blockResponse    chan BlockResponse
-	peerManagerChans peerManagerChans
-	contRxChans      ControllerPeerChans
-	contTxChans      PeerControllerChans
-	stats            PeerStats
-	statsCh          chan PeerStats
-	quit             chan struct{}
-	stopping         chan bool
+	// First, to be 64 bit aligned for atomic access on 32 bit platforms
+	requestUnchoke    int64 // unchokes while the peer unchokes us, -1 while it chokes us, accessed atomically by the writer
+	conn              net.Conn
+	peerName          string
+	identity          string // key of the peer's history, its peer ID once known
+	connection        int    // number of this connection in the peer's history
+	amChoking         bool
+	amInterested      bool
+	peerChoking       bool
+	peerInterested    bool
+	unchokes          int           // times the peer unchoked us, requests of earlier unchokes were voided by a choke
+	chokeStatusSent   chan struct{} // closed once the last choke status reached the controller, nil if none was sent
+	requestDepth      int           // block requests kept outstanding, adapted to the peer's rate
+	minRequestDepth   int           // requestDepth at least, and until the peer's rate is known
+	maxRequestDepth   int           // requestDepth at most
+	ourBitfield       []bool
+	peerBitfield      []bool
+	peerID            []byte
+	reserved          [8]byte              // reserved bytes of the peer's handshake, flagging the extensions it supports
+	extensions        map[string]int       // extended message IDs of the extensions the peer supports, from its extended handshake
+	dhtPort           uint16               // UDP port of our DHT node, 0 if we don't run one
+	dhtPings          chan<- *net.UDPAddr  // DHT nodes to ping, from the peer's port message
+	uploadOnly        bool                 // we never download, seeding from read-only storage
+	maxServedRequests int                  // requests of the peer queued, read and sent at once, more are ignored
+	servedRequests    int                  // requests of the peer queued, being read or sent
+	queuedRequests    []BlockRequest       // requests of the peer waiting to be handed to DiskIO, oldest first
+	blockSent         chan struct{}        // a block requested by the peer was sent
+	pex               *pexView             // peers we're connected to, shared with the PeerManager, nil if peer exchange is disabled
+	pexSent           map[string]PeerTuple // peers sent to the peer in PEX messages
+	lastPexSent       time.Time            // when the last PEX message was sent to the peer
+	lastPexReceived   time.Time            // when the last PEX message from the peer was accepted
+	outbound          bool                 // we initiated the connection
+	piecesNeeded      int32                // pieces the peer has that we don't, accessed atomically
+	evicted           bool                 // the PeerManager has stopped the peer to make room for another
+	sentBadData       bool                 // a piece from the peer failed its hash check
+	receivedPayload   bool                 // the peer has sent a request, block or cancel
+	clock             Clock
+	ticker            Ticker
+	readTimeout       time.Duration // the connection is closed if nothing is read for this long, backing up the idle timeout of Run
+	activityMutex     sync.Mutex    // guards lastTxMessage and lastRxMessage
+	lastTxMessage     time.Time
+	lastRxMessage     time.Time
+	connectedAt       time.Time
+	infoHash          []byte
+	pieceLength       int
+	sendChan          chan []byte
+	interest          chan bool            // our latest interest in the peer, sent by the writer if the peer wasn't told it
+	requests          chan outgoingRequest // our requests for blocks, dropped by the writer once voided by a choke
+	totalLength       int
+	downloads         []*PieceDownload
+	diskIOChans       diskIOPeerChans
+	blockResponse     chan BlockResponse
+	peerManagerChans  peerManagerChans
+	contRxChans       ControllerPeerChans
+	contTxChans       PeerControllerChans
+	stats             PeerStats
+	statsCh           chan peerStatsSnapshot
+	verification      *VerificationPolicy // which pieces are hash checked, may be nil
+	chokeOverrides    *ChokeOverrides     // choke overrides of peer addresses, may be nil
+	uploadLimit       *RateLimiter        // global cap on the upload rate, nil for none
+	downloadLimit     *RateLimiter        // global cap on the download rate, nil for none
+	overrideChanged   chan struct{}       // signals Run that the choke override may have changed
+	quit              chan struct{}
+	messages          chan []byte   // messages read from the peer, decoded by Run
+	stopping          chan struct{} // closed by Stop
+	stopOnce          sync.Once
 }
 
 type PieceDownload struct {
 	pieceNum             int
-	expectedHash         []byte
+	expectedHash         string
 	data                 []byte
 	numBlocksReceived    int
 	numOutstandingBlocks int
 	numBlocksInPiece     int
+	blocksReceived       []bool // by block number
+	blocksRequested      []bool // by block number, requested since the piece was given to the peer
+	duplicateBlocks      int    // blocks received more than once
 	isFinished           bool
+	hash                 hash.Hash // SHA-1 of the blocks up to hashedBlocks, nil if the piece won't be hashed
+	hashedBlocks         int       // blocks from the start of the piece fed to hash
+}
+
+// receiveBlock copies a block into the piece and feeds it to the running
+// hash. Blocks usually arrive in order, so the piece is hashed as it's
+// downloaded. A block that arrives after a gap is hashed once the gap is
+// filled, in the worst case when the last block arrives.
+func (piece *PieceDownload) receiveBlock(blockNum int, data []byte) {
+	piece.blocksReceived[blockNum] = true
+	copy(piece.data[blockNum*downloadBlockSize:], data)
+	piece.numBlocksReceived += 1
+	piece.numOutstandingBlocks -= 1
+
+	if piece.hash == nil {
+		return
+	}
+	for piece.hashedBlocks < piece.numBlocksInPiece && piece.blocksReceived[piece.hashedBlocks] {
+		begin := piece.hashedBlocks * downloadBlockSize
+		end := begin + downloadBlockSize
+		if end > len(piece.data) {
+			end = len(piece.data)
+		}
+		piece.hash.Write(piece.data[begin:end])
+		piece.hashedBlocks++
+	}
+}
+
+// sum returns the SHA-1 of a piece whose blocks have all been received
+func (piece *PieceDownload) sum() []byte {
+	if piece.hash == nil || piece.hashedBlocks != piece.numBlocksInPiece {
+		sum := sha1.Sum(piece.data)
+		return sum[:]
+	}
+	return piece.hash.Sum(nil)
 }
 
 func (piece *PieceDownload) remainingRequestsToSend() int {
 	return piece.numBlocksInPiece - (piece.numBlocksReceived + piece.numOutstandingBlocks)
 }
 
+// nextBlockToRequest returns the first block neither received nor requested,
+// -1 if there's none
+func (piece *PieceDownload) nextBlockToRequest() int {
+	for blockNum := range piece.blocksReceived {
+		if !piece.blocksReceived[blockNum] && !piece.blocksRequested[blockNum] {
+			return blockNum
+		}
+	}
+	return -1
+}
+
 func (p *Peer) newPieceDownload(requestPiece RequestPiece) *PieceDownload {
 	return &PieceDownload{
 		pieceNum:         requestPiece.pieceNum,
 		expectedHash:     requestPiece.expectedHash,
 		data:             make([]byte, p.expectedLengthForPiece(requestPiece.pieceNum)),
 		numBlocksInPiece: p.expectedNumBlocksForPiece(requestPiece.pieceNum),
+		blocksReceived:   make([]bool, p.expectedNumBlocksForPiece(requestPiece.pieceNum)),
+		blocksRequested:  make([]bool, p.expectedNumBlocksForPiece(requestPiece.pieceNum)),
 		isFinished:       false,
 	}
 }
@@ -105,6 +237,28 @@ type PeerStats struct {
 	read   int
 	write  int
 	errors int
+	// Blocks received on this connection that were added to a piece, and
+	// those discarded, see solicitedBlock
+	blocks          int
+	discardedBlocks int
+	// The window over which rates are measured, restarted when the clock
+	// jumps
+	rateSince time.Time
+	rateRead  int
+	rateWrite int
+}
+
+// peerStatsSnapshot is a copy of the counters of a PeerStats, sent to Stats
+type peerStatsSnapshot struct {
+	read            int
+	write           int
+	errors          int
+	blocks          int
+	discardedBlocks int
+	// The identity of the peer the counters are of, and the number of the
+	// connection
+	peerName   string
+	connection int
 }
 
 func (ps *PeerStats) addRead(value int) {
@@ -125,26 +279,121 @@ func (ps *PeerStats) addError(value int) {
 	ps.Unlock()
 }
 
+// addBlock counts a block received, discarded or not
+func (ps *PeerStats) addBlock(discarded bool) {
+	ps.Lock()
+	if discarded {
+		ps.discardedBlocks++
+	} else {
+		ps.blocks++
+	}
+	ps.Unlock()
+}
+
+// snapshot returns a copy of the counters
+func (ps *PeerStats) snapshot() peerStatsSnapshot {
+	ps.Lock()
+	defer ps.Unlock()
+	return peerStatsSnapshot{read: ps.read, write: ps.write, errors: ps.errors, blocks: ps.blocks, discardedBlocks: ps.discardedBlocks}
+}
+
+// resetRates starts a new window for measuring the transfer rates
+func (ps *PeerStats) resetRates(now time.Time) {
+	ps.Lock()
+	ps.rateSince, ps.rateRead, ps.rateWrite = now, ps.read, ps.write
+	ps.Unlock()
+}
+
+// rates returns the download and upload rates in bytes per second over the
+// current window, and how long the window has been open
+func (ps *PeerStats) rates(now time.Time) (download float64, upload float64, window time.Duration) {
+	ps.Lock()
+	defer ps.Unlock()
+	window = now.Sub(ps.rateSince)
+	seconds := clampElapsed(window, time.Second).Seconds()
+	return float64(ps.read-ps.rateRead) / seconds, float64(ps.write-ps.rateWrite) / seconds, window
+}
+
 type PeerManager struct {
-	peers         map[string]*Peer
-	infoHash      []byte
-	numPieces     int
-	numPeers      int
-	pieceLength   int
-	totalLength   int
-	seeding       bool
-	peerChans     peerManagerChans
-	serverChans   serverPeerChans
-	trackerChans  trackerPeerChans
-	diskIOChans   diskIOPeerChans
-	contChans     ControllerPeerManagerChans
-	peerContChans PeerControllerChans
-	statsCh       chan PeerStats
-	quit          chan struct{}
+	peers          map[string]*Peer
+	dialing        map[string]time.Time // peers being connected to, and when we started
+	dialTimeout    time.Duration        // time a peer we dial has to accept the connection
+	maxHalfOpen    int                  // connections dialed at most at once, more peers wait as candidates
+	infoHash       []byte
+	numPieces      int
+	numPeers       int
+	maxPeers       int
+	candidates     []PeerTuple         // peers not dialed because we were at the max
+	maxCandidates  int                 // candidates kept at most, as many as maxPeers if 0
+	lowPriority    []PeerTuple         // peers on suspicious ports, dialed after every other candidate
+	ports          *PortPolicy         // how candidates are dialed by their port, and the limit of connections per IP
+	chokeOverrides *ChokeOverrides     // choke overrides of peer addresses, shared with the Torrent and the peers
+	dhtPort        uint16              // UDP port of our DHT node, 0 if we don't run one
+	dhtPings       chan<- *net.UDPAddr // DHT nodes peers tell us about in port messages, nil if we don't run one
+	uploadOnly     bool                // we never download, seeding from read-only storage
+	// Requests of each peer queued, read and sent at once, more are ignored
+	maxServedRequests int
+	requestDepth      int                        // block requests kept outstanding to a peer until its rate is known, and at least
+	maxRequestDepth   int                        // block requests kept outstanding to a peer at most, however fast
+	pex               *pexView                   // connected peers others can connect to, shared with the peers, nil to disable peer exchange
+	reachability      *Reachability              // whether peers can connect to us, shared with the Torrent
+	reconnects        map[string]*reconnectState // peers we dialed that dropped or failed to connect, by name
+	maxReconnects     int                        // peers kept in reconnects at most, 0 for no cap
+	badPieces         map[string]int             // pieces that failed their hash check, by peer IP
+	banned            map[string]struct{}        // IPs of peers that sent too many bad pieces
+	ipFilter          *IPFilterState             // IPs peers aren't connected at, shared with the Torrent, nil for none
+	handshaking       int                        // incoming connections waiting on a handshake
+	peerIDs           map[string]string          // names of connected peers, by peer ID
+	history           map[string]*peerHistory    // peers connected to recently, by identity
+	pieceLength       int
+	totalLength       int
+	seeding           bool
+	peerChans         peerManagerChans
+	serverChans       serverPeerChans
+	trackerChans      trackerPeerChans
+	diskIOChans       diskIOPeerChans
+	contChans         ControllerPeerManagerChans
+	peerContChans     PeerControllerChans
+	statsCh           chan peerStatsSnapshot
+	verification      *VerificationPolicy // which pieces received from peers are hash checked, may be nil
+	uploadLimit       *RateLimiter        // global cap on the upload rate of the peers, nil for none
+	downloadLimit     *RateLimiter        // global cap on the download rate of the peers, nil for none
+	clock             Clock
+	snapshot          chan chan *SwarmDump // requests for the PeerManager's view of the swarm
+	lifecycle         lifecycle
+	quit              chan struct{}
 }
 
 type peerManagerChans struct {
-	deadPeer chan string
+	deadPeer   chan string
+	dialed     chan dialResult     // a connection attempt to a peer has finished
+	handshaked chan handshakedConn // an incoming connection has completed the handshake
+	pexPeers   chan pexFound       // peers learned from a connected peer through peer exchange
+	reconnect  chan string         // the backoff before reconnecting to a peer has passed
+}
+
+// reconnectState tracks the attempts to reconnect to a peer that dropped, or
+// to connect to a peer that failed
+type reconnectState struct {
+	peer     PeerTuple
+	attempts int    // attempts scheduled since the peer last stayed connected
+	lastErr  string // why the last attempt failed, "" if the peer dropped instead
+}
+
+// handshakedConn is a connection to a peer that has completed the handshake
+type handshakedConn struct {
+	conn     *net.TCPConn // nil if the connection or the handshake failed
+	peerID   []byte
+	outbound bool    // we initiated the connection
+	reserved [8]byte // reserved bytes of the peer's handshake
+}
+
+// dialResult is the outcome of a connection attempt to a peer
+type dialResult struct {
+	peerName string
+	peer     PeerTuple
+	err      error // why the connection or the handshake failed
+	handshakedConn
 }
 
 type PeerComms struct {
@@ -162,8 +411,10 @@ func NewPeerComms(peerName string, cpc ControllerPeerChans) *PeerComms {
 type PeerInfo struct {
 	peerName        string
 	isChoked        bool // The peer is connected but choked. Defaults to TRUE (choked)
+	unchokes        int  // times the peer unchoked us, pieces are given to it tagged with the latest
 	availablePieces []bool
 	activeRequests  map[int]struct{}
+	requestDepth    int // block requests the peer keeps outstanding, more pieces are given to deeper peers
 	qtyPiecesNeeded int // The quantity of pieces that this peer has that we haven't yet downloaded.
 	chans           ControllerPeerChans
 }
@@ -183,6 +434,7 @@ func NewPeerInfo(quantityOfPieces int, peerComms PeerComms) *PeerInfo {
 		isChoked:        true, // By default, a peer starts as being choked by the other side.
 		availablePieces: make([]bool, quantityOfPieces),
 		activeRequests:  make(map[int]struct{}),
+		requestDepth:    defaultRequestDepth,
 	}
 }
 
@@ -193,6 +445,12 @@ type PeerChokeStatus struct {
 	isChoked bool
 }
 
+// outgoingRequest is a request for a block on its way to the writer
+type outgoingRequest struct {
+	message  []byte
+	unchokes int // the time the peer unchoked us the request was made in
+}
+
 type SortedPeers []*PeerInfo
 
 func (sp SortedPeers) Less(i, j int) bool {
@@ -220,8 +478,14 @@ func sortedPeersByQtyPiecesNeeded(peers map[string]*PeerInfo) SortedPeers {
 	return peerInfoSlice
 }
 
-func NewPeerManager(infoHash []byte, numPieces int, pieceLength int, totalLength int, diskIOChans diskIOPeerChans, serverChans serverPeerChans, statsCh chan PeerStats, trackerChans trackerPeerChans) *PeerManager {
+func NewPeerManager(infoHash []byte, numPieces int, pieceLength int, totalLength int, diskIOChans diskIOPeerChans, serverChans serverPeerChans, statsCh chan peerStatsSnapshot, trackerChans trackerPeerChans, maxPeers int) *PeerManager {
 	pm := new(PeerManager)
+	pm.maxPeers = maxPeers
+	pm.dialTimeout = defaultDialTimeout
+	pm.maxHalfOpen = defaultMaxHalfOpen
+	pm.requestDepth, pm.maxRequestDepth = defaultRequestDepth, maxRequestDepth
+	pm.maxServedRequests = defaultMaxServedRequests
+	pm.clock = systemClock
 	pm.infoHash = infoHash
 	pm.numPieces = numPieces
 	pm.pieceLength = pieceLength
@@ -231,27 +495,124 @@ func NewPeerManager(infoHash []byte, numPieces int, pieceLength int, totalLength
 	pm.statsCh = statsCh
 	pm.trackerChans = trackerChans
 	pm.seeding = false
+	pm.ports = DefaultPortPolicy()
+	pm.chokeOverrides = NewChokeOverrides()
+	pm.reachability = NewReachability()
 	pm.peerChans.deadPeer = make(chan string)
+	pm.peerChans.dialed = make(chan dialResult)
+	pm.peerChans.handshaked = make(chan handshakedConn)
+	pm.peerChans.reconnect = make(chan string)
+	pm.peerChans.pexPeers = make(chan pexFound)
+	pm.pex = newPexView()
+	pm.reconnects = make(map[string]*reconnectState)
+	pm.badPieces = make(map[string]int)
+	pm.banned = make(map[string]struct{})
 	pm.peers = make(map[string]*Peer)
+	pm.dialing = make(map[string]time.Time)
+	pm.peerIDs = make(map[string]string)
+	pm.history = make(map[string]*peerHistory)
+	pm.snapshot = make(chan chan *SwarmDump)
 	pm.contChans.newPeer = make(chan PeerComms)
 	pm.contChans.deadPeer = make(chan string)
 	pm.contChans.seeding = make(chan bool)
 	pm.peerContChans.chokeStatus = make(chan PeerChokeStatus)
 	pm.peerContChans.havePiece = make(chan chan HavePiece)
+	pm.peerContChans.badPiece = make(chan BadPiece)
 	pm.quit = make(chan struct{})
 	return pm
 }
 
-func connectToPeer(peerTuple PeerTuple, connCh chan *net.TCPConn) {
+// connectToPeer dials a peer, giving up after timeout. Refused, unreachable
+// and timed out connections are returned as errors.
+func connectToPeer(peerTuple PeerTuple, timeout time.Duration) (*net.TCPConn, error) {
 	raddr := net.TCPAddr{IP: peerTuple.IP, Port: int(peerTuple.Port)}
-	log.Println("Peer : Connecting to", raddr)
-	conn, err := net.DialTCP("tcp4", nil, &raddr)
+	log.Println("Peer : Connecting to", raddr.String())
+	conn, err := net.DialTimeout("tcp4", raddr.String(), timeout)
 	if err != nil {
-		log.Println("Peer : connectToPeer :", err)
-		return
+		return nil, err
+	}
+	log.Println("Peer : connectToPeer : Connected to", raddr.String())
+	return conn.(*net.TCPConn), nil
+}
+
+// handshake exchanges handshakes with a peer. We send ours first on
+// connections we initiated, and only once the peer's has been verified on
+// incoming connections. The connection is closed if the handshake is invalid
+// or isn't completed in time.
+func (pm *PeerManager) handshake(conn *net.TCPConn, outbound bool) (handshakedConn, error) {
+	handshake, err := exchangeHandshake(conn, pm.infoHash, localReserved(pm.dhtPort != 0), outbound, handshakeTimeout)
+	if err != nil {
+		log.Printf("PeerManager : handshake : Rejecting %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return handshakedConn{}, err
 	}
-	log.Println("Peer : connectToPeer : Connected to", raddr)
-	connCh <- conn
+	return handshakedConn{conn: conn, peerID: handshake.PeerID[:], outbound: outbound, reserved: handshake.Reserved}, nil
+}
+
+// exchangeHandshake exchanges handshakes for a torrent over conn, within
+// timeout, and returns the peer's. Ours has the reserved bytes given. An
+// incoming connection is for the torrent if the peer's handshake has its
+// infohash.
+func exchangeHandshake(conn net.Conn, infoHash []byte, reserved [8]byte, outbound bool, timeout time.Duration) (Handshake, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	var err error
+	if outbound {
+		err = writeHandshake(conn, infoHash, reserved)
+	}
+	var handshake Handshake
+	if err == nil {
+		err = binary.Read(conn, binary.BigEndian, &handshake)
+	}
+	if err == nil {
+		err = verifyHandshake(&handshake, infoHash)
+	}
+	if err == nil && !outbound {
+		err = writeHandshake(conn, infoHash, reserved)
+	}
+	return handshake, err
+}
+
+// receiveHandshake completes the handshake of an incoming connection and
+// hands it back to the PeerManager
+func (pm *PeerManager) receiveHandshake(conn *net.TCPConn) {
+	remote := remoteIP(conn)
+	inbound, err := pm.handshake(conn, false)
+	if err != nil && abortedHandshake(err) {
+		pm.reachability.inboundAborted(remote, pm.clock.Now())
+	}
+	select {
+	case pm.peerChans.handshaked <- inbound:
+	case <-pm.quit:
+		if inbound.conn != nil {
+			inbound.conn.Close()
+		}
+	}
+}
+
+// writeHandshake sends our handshake for a torrent
+func writeHandshake(conn io.Writer, infoHash []byte, reserved [8]byte) error {
+	handshake := Handshake{
+		Len:      uint8(len(Protocol)),
+		Protocol: Protocol,
+		Reserved: reserved,
+		PeerID:   PeerID,
+	}
+	copy(handshake.InfoHash[:], infoHash)
+	return binary.Write(conn, binary.BigEndian, &handshake)
+}
+
+// keepConnection decides which of two connections to the same peer is kept,
+// returning true to replace the existing connection with the new one. When
+// both peers have dialed each other, each keeps the connection initiated by
+// the peer with the lower peer ID, so that they agree on the survivor.
+// Otherwise the existing connection is kept.
+func keepConnection(existing *Peer, conn handshakedConn) bool {
+	if existing.outbound == conn.outbound {
+		return false
+	}
+	weInitiated := bytes.Compare(PeerID[:], conn.peerID) < 0
+	return conn.outbound == weInitiated
 }
 
 func NewPeer(
@@ -264,29 +625,46 @@ func NewPeer(
 	contRxChans ControllerPeerChans,
 	contTxChans PeerControllerChans,
 	peerManagerChans peerManagerChans,
-	statsCh chan PeerStats) *Peer {
+	statsCh chan peerStatsSnapshot,
+	clock Clock) *Peer {
+	now := clock.Now()
 	p := &Peer{
-		peerName:         peerName,
-		infoHash:         infoHash,
-		pieceLength:      pieceLength,
-		totalLength:      totalLength,
-		peerBitfield:     make([]bool, numPieces),
-		ourBitfield:      make([]bool, numPieces),
-		lastTxMessage:    time.Now(),
-		lastRxMessage:    time.Now(),
-		amChoking:        true,
-		amInterested:     false,
-		peerChoking:      true,
-		peerInterested:   false,
-		sendChan:         make(chan []byte),
-		diskIOChans:      diskIOChans,
-		blockResponse:    make(chan BlockResponse),
-		contRxChans:      contRxChans,
-		contTxChans:      contTxChans,
-		peerManagerChans: peerManagerChans,
-		statsCh:          statsCh,
-		downloads:        make([]*PieceDownload, 0),
-		stopping:         make(chan bool)}
+		peerName:          peerName,
+		identity:          peerName,
+		infoHash:          infoHash,
+		pieceLength:       pieceLength,
+		totalLength:       totalLength,
+		peerBitfield:      make([]bool, numPieces),
+		ourBitfield:       make([]bool, numPieces),
+		clock:             clock,
+		readTimeout:       peerIdleTimeout,
+		lastTxMessage:     now,
+		lastRxMessage:     now,
+		connectedAt:       now,
+		amChoking:         true,
+		amInterested:      false,
+		peerChoking:       true,
+		peerInterested:    false,
+		requestUnchoke:    -1,
+		requestDepth:      defaultRequestDepth,
+		minRequestDepth:   defaultRequestDepth,
+		maxRequestDepth:   maxRequestDepth,
+		maxServedRequests: defaultMaxServedRequests,
+		sendChan:          make(chan []byte),
+		interest:          make(chan bool, 1),
+		requests:          make(chan outgoingRequest),
+		diskIOChans:       diskIOChans,
+		blockResponse:     make(chan BlockResponse),
+		blockSent:         make(chan struct{}),
+		contRxChans:       contRxChans,
+		contTxChans:       contTxChans,
+		peerManagerChans:  peerManagerChans,
+		statsCh:           statsCh,
+		downloads:         make([]*PieceDownload, 0),
+		messages:          make(chan []byte),
+		overrideChanged:   make(chan struct{}, 1),
+		stopping:          make(chan struct{})}
+	p.stats.rateSince = now
 	return p
 }
 
@@ -303,6 +681,9 @@ func verifyHandshake(handshake *Handshake, infoHash []byte) error {
 		err := fmt.Sprintf("Invalid infoHash: got %x, expected %x", handshake.InfoHash, infoHash)
 		return errors.New(err)
 	}
+	if handshake.PeerID == PeerID {
+		return errSelfConnection
+	}
 	return nil
 }
 
@@ -311,7 +692,7 @@ func (p *Peer) sendBitfieldToController(bitfield []bool) {
 
 	for pieceNum, hasPiece := range bitfield {
 		if hasPiece {
-			haveSlice = append(haveSlice, HavePiece{pieceNum, p.peerName})
+			haveSlice = append(haveSlice, HavePiece{pieceNum: pieceNum, peerName: p.peerName, bitfield: true})
 		}
 	}
 
@@ -396,21 +777,33 @@ func convertBoolSliceToByteSlice(bitfield []bool) []byte {
 	return result
 }
 
-func checkHash(block []byte, expectedHash []byte) bool {
-	h := sha1.New()
-	h.Write(block)
-	return bytes.Equal(h.Sum(nil), expectedHash)
+func (p *Peer) sendFinishedPieceToDiskIO(pieceNum int, data []byte, unverified bool, duplicateBlocks int) {
+	p.diskIOChans.writePiece <- Piece{
+		index:           pieceNum,
+		data:            data,
+		peerName:        p.peerName,
+		unverified:      unverified,
+		duplicateBlocks: duplicateBlocks,
+	}
 }
 
-func (p *Peer) sendFinishedPieceToDiskIO(pieceNum int, data []byte) {
-	p.diskIOChans.writePiece <- Piece{
-		index:    pieceNum,
-		data:     data,
-		peerName: p.peerName,
+// updatePiecesNeeded counts the pieces the peer has that we don't, for the
+// PeerManager to rank peers by
+func (p *Peer) updatePiecesNeeded() {
+	needed := 0
+	for pieceNum, hasPiece := range p.ourBitfield {
+		if !hasPiece && p.peerBitfield[pieceNum] {
+			needed++
+		}
 	}
+	atomic.StoreInt32(&p.piecesNeeded, int32(needed))
 }
 
 func (p *Peer) weShouldBeInterested() bool {
+	if p.uploadOnly {
+		// We don't need any piece
+		return false
+	}
 	// Loop through our bitfield to check if there are any pieces we don't have
 	// that the peer does have
 	for pieceNum, hasPiece := range p.ourBitfield {
@@ -423,6 +816,18 @@ func (p *Peer) weShouldBeInterested() bool {
 	return false
 }
 
+// decodeMessage handles a message from the peer. The spec has the bitfield
+// sent right after the handshake, if at all, but clients order their first
+// messages differently, so the following are accepted:
+//   - the extended handshake, or any other extension message, anywhere after
+//     the handshake; messages of unsupported extensions are ignored
+//   - haves before the bitfield, which is merged with them
+//   - no bitfield at all, the peer has only the pieces it sends haves for
+//   - have all or have none in place of the bitfield, and haves after it
+//
+// A bitfield, have all or have none received after the peer has sent a
+// request, block or cancel is a violation, and the peer is dropped, as is a
+// bitfield of the wrong length or with its spare bits set.
 func (p *Peer) decodeMessage(payload []byte) {
 	if len(payload) == 0 {
 		// keepalive
@@ -430,163 +835,165 @@ func (p *Peer) decodeMessage(payload []byte) {
 		return
 	}
 
-	messageID := int(payload[0])
-	// Remove the messageID
-	payload = payload[1:]
+	message, err := parseMessage(payload)
+	if err != nil {
+		log.Printf("Peer : decodeMessage : Dropping %s: %s", p.peerName, err)
+		p.Stop()
+		return
+	}
+	// parseMessage has checked the payload lengths of the messages parsed
+	// below
+	messageID := message.ID
+	payload = message.Payload
+
+	if messageID == MsgRequest || messageID == MsgBlock || messageID == MsgCancel {
+		p.receivedPayload = true
+	}
 
 	switch messageID {
 	case MsgChoke:
-		if len(payload) != 0 {
-			log.Fatalf("Received a Choke from %s with invalid payload size of %d", p.peerName, len(payload))
-		} else {
-			log.Printf("Received a Choke message from %s", p.peerName)
-		}
+		log.Printf("Received a Choke message from %s", p.peerName)
 		if !p.peerChoking {
 			// We're changing from being unchoked to choked
 			p.peerChoking = true
-			// Clear out any unfinished work
+			atomic.StoreInt64(&p.requestUnchoke, -1)
+			// The peer discards our outstanding requests when it chokes
+			// us. Clear out any unfinished work, the controller takes
+			// the pieces back once told.
 			for _, download := range p.downloads {
 				download.isFinished = true
 				download.numBlocksReceived = 0
 				download.numOutstandingBlocks = 0
 			}
 			// Tell the controller that we've switched from unchoked to choked
-			go func() {
-				p.contTxChans.chokeStatus <- PeerChokeStatus{peerName: p.peerName, isChoked: true}
-			}()
+			p.sendChokeStatus(true)
 		} else {
 			// Ignore choke message because we're already choked.
 		}
 	case MsgUnchoke:
-		if len(payload) != 0 {
-			log.Fatalf("Received an Unchoke from %s with invalid payload size of %d", p.peerName, len(payload))
-		} else {
-			log.Printf("Received a Unchoke message from %s", p.peerName)
-		}
+		log.Printf("Received a Unchoke message from %s", p.peerName)
 		if p.peerChoking {
 			// We're changing from being choked to unchoked
 			p.peerChoking = false
-			// Tell the controller that we've switched from choked to unchoked
-			go func() {
-				p.contTxChans.chokeStatus <- PeerChokeStatus{peerName: p.peerName, isChoked: false}
-			}()
+			p.unchokes++
+			atomic.StoreInt64(&p.requestUnchoke, int64(p.unchokes))
+			// Tell the controller that we've switched from choked to
+			// unchoked, it sends us pieces to request
+			p.sendChokeStatus(false)
 		} else {
 			// Ignore unchoke message because we're already unchoked.
 		}
 	case MsgInterested:
-		if len(payload) != 0 {
-			log.Fatalf("Received an Interested from %s with invalid payload size of %d", p.peerName, len(payload))
-		} else {
-			log.Printf("\033[31mReceived an Interested message from %s\033[0m", p.peerName)
-		}
+		log.Printf("\033[31mReceived an Interested message from %s\033[0m", p.peerName)
 		p.peerInterested = true
-		p.sendUnchoke()
+		p.updateChoke()
 	case MsgNotInterested:
 		// Not Interested Message
-		if len(payload) != 0 {
-			log.Fatalf("Received a Not Interested from %s with invalid payload size of %d", p.peerName, len(payload))
-		} else {
-			log.Printf("Received a Not Interested message from %s", p.peerName)
-		}
+		log.Printf("Received a Not Interested message from %s", p.peerName)
 		p.peerInterested = false
-		p.sendChoke()
+		p.updateChoke()
 	case MsgHave:
-		if len(payload) != 4 {
-			log.Fatalf("Received a Have from %s with invalid payload size of %d", p.peerName, len(payload))
-		}
-
 		// Determine the piece number
-		pieceNum := int(binary.BigEndian.Uint32(payload))
+		index, _ := ParseHave(payload)
+		pieceNum := int(index)
+		// An index past 2^31 converts to a negative int on 32 bit platforms
+		if pieceNum < 0 || pieceNum >= len(p.peerBitfield) {
+			log.Printf("Peer : decodeMessage : Dropping %s: Have for piece %x of %d", p.peerName, pieceNum, len(p.peerBitfield))
+			p.Stop()
+			return
+		}
 		log.Printf("Received a Have message for piece %x from %s", pieceNum, p.peerName)
 
 		// Update the local peer bitfield
 		p.peerBitfield[pieceNum] = true
+		p.updatePiecesNeeded()
 
 		// Send a single HavePiece struct to the controller
 		have := make([]HavePiece, 1)
 		have[0] = HavePiece{pieceNum: pieceNum, peerName: p.peerName}
 		go p.sendHaveMessagesToController(have)
-
-		if !p.amInterested {
-			// Determine if we should switch from not interested to interested
-			if p.weShouldBeInterested() {
-				p.sendInterested()
-			}
-		}
+		p.updateInterest()
 	case MsgBitfield:
 		log.Printf("Received a Bitfield message from %s with payload %x", p.peerName, payload)
-
-		p.peerBitfield = convertByteSliceToBoolSlice(len(p.peerBitfield), payload)
-
-		// Break the bitfield into a slice of HavePiece structs and send them
-		// to the controller
-		go p.sendBitfieldToController(p.peerBitfield)
-
-		if !p.amInterested {
-			// Determine if we should switch from not interested to interested
-			if p.weShouldBeInterested() {
-				p.sendInterested()
-			}
+		bitfield, err := ParseBitfield(payload, len(p.peerBitfield))
+		if err != nil {
+			log.Printf("Peer : decodeMessage : Dropping %s: %s", p.peerName, err)
+			p.Stop()
+			return
 		}
+		p.mergeBitfield(bitfield)
+	case MsgHaveAll:
+		log.Printf("Received a Have All message from %s", p.peerName)
+		bitfield := make([]bool, len(p.peerBitfield))
+		for pieceNum := range bitfield {
+			bitfield[pieceNum] = true
+		}
+		p.mergeBitfield(bitfield)
+	case MsgHaveNone:
+		log.Printf("Received a Have None message from %s", p.peerName)
+		// Haves received before it still hold
+		p.mergeBitfield(make([]bool, len(p.peerBitfield)))
+	case MsgExtended:
+		p.decodeExtended(payload)
 	case MsgRequest:
 		var blockInfo BlockInfo
-		blockInfo.pieceIndex = binary.BigEndian.Uint32(payload[0:4])
-		blockInfo.begin = binary.BigEndian.Uint32(payload[4:8])
-		blockInfo.length = binary.BigEndian.Uint32(payload[8:12])
-		blockRequest := BlockRequest{request: blockInfo, response: p.blockResponse}
-		p.diskIOChans.blockRequest <- blockRequest
-		log.Printf("\033[31mReceived a Request message for %v from %s\033[0m", blockInfo, p.peerName)
-	case MsgBlock:
-		if len(payload) < 9 {
-			log.Fatalf("Received a Block (Piece) message from %s with invalid payload size of %d.", p.peerName, len(payload))
+		blockInfo.pieceIndex, blockInfo.begin, blockInfo.length, _ = ParseRequest(payload)
+		if p.amChoking || !p.peerInterested {
+			// Only unchoked, interested peers are uploaded to
+			log.Printf("Ignoring a Request message for %v from %s, which is choked or not interested", blockInfo, p.peerName)
+			return
 		}
-
-		pieceNum := int(binary.BigEndian.Uint32(payload[0:4]))
-		begin := int(binary.BigEndian.Uint32(payload[4:8]))
-		blockData := payload[8:]
-
-		blockNum := begin / downloadBlockSize
-
-		if !p.haveCurrentDownloads() {
-			log.Printf("WARNING: Received piece %x:%x from %s but there aren't any current downloads", pieceNum, begin, p.peerName)
+		if p.servedRequests >= p.maxServedRequests {
+			log.Printf("Ignoring a Request message for %v from %s, already serving %d requests", blockInfo, p.peerName, p.servedRequests)
 			return
-		} else if begin%downloadBlockSize != 0 {
-			log.Fatalf("Received a Block (Piece) message from %s with an invalid begin value of %x", p.peerName, begin)
-		} else if len(blockData) != p.expectedLengthForBlock(pieceNum, blockNum) {
-			log.Fatalf("Received a Block (Piece) message from %s with an invalid block size of %x. Expected %x", p.peerName, len(blockData), p.expectedLengthForBlock(pieceNum, blockNum))
-		} else {
-			//log.Printf("Received a Block (Piece) message from %s for piece %x:%x[%x]", p.peerName, pieceNum, begin, len(blockData))
 		}
+		p.servedRequests++
+		// Run hands the request to DiskIO, which may be waiting for Run
+		// to take the response to an earlier request
+		p.queuedRequests = append(p.queuedRequests, BlockRequest{request: blockInfo, response: p.blockResponse, cancel: p.stopping})
+		log.Printf("\033[31mReceived a Request message for %v from %s\033[0m", blockInfo, p.peerName)
+	case MsgBlock:
+		index, offset, blockData, _ := ParsePiece(payload)
+		pieceNum := int(index)
+		begin := int(offset)
 
-		piece := p.getPieceDownload(pieceNum)
+		piece, blockNum := p.solicitedBlock(pieceNum, begin, len(blockData))
+		p.stats.addBlock(piece == nil)
 		if piece == nil {
-			log.Printf("WARNING: The block from %s for piece %x doesn't match the current or next download pieces", p.peerName, pieceNum)
 			return
 		}
-
 		// The block (piece) message is valid. Write the contents to the buffer.
-		copy(piece.data[begin:], blockData)
-
-		piece.numBlocksReceived += 1
-		piece.numOutstandingBlocks -= 1
+		piece.receiveBlock(blockNum, blockData)
 
 		if piece.numBlocksReceived == piece.numBlocksInPiece {
 			log.Printf("Finished downloading all blocks for piece %x from %s", pieceNum, p.peerName)
 
-			// SHA1 check the entire piece
-			if !checkHash(piece.data, piece.expectedHash) {
+			// SHA1 check the entire piece, unless the verification policy
+			// trusts this peer
+			hashed, good := p.verification.verifySum(p.peerName, p.peerID, piece.sum, piece.expectedHash)
+			if !good {
 				// The piece received from this peer didn't pass the checksum.
+				// Discard its blocks and let the controller request it
+				// again, from another peer if possible.
 				log.Printf("ERROR: Checksum for piece %x received from %s did NOT match what's expected. Disconnecting.", pieceNum, p.peerName)
+				piece.isFinished = true
+				piece.numBlocksReceived = 0
+				piece.numOutstandingBlocks = 0
+				go func() {
+					p.contTxChans.badPiece <- BadPiece{pieceNum: pieceNum, peerName: p.peerName}
+				}()
+				p.sentBadData = true
 				p.Stop()
 				return
 			}
-
-			log.Printf("Checksum for piece %x received from %s matches what's expected", pieceNum, p.peerName)
+			if hashed {
+				log.Printf("Checksum for piece %x received from %s matches what's expected", pieceNum, p.peerName)
+			}
 
 			piece.isFinished = true
 			p.moveFinishedPieceDownloadsToEnd()
 
-			go p.sendFinishedPieceToDiskIO(pieceNum, piece.data)
+			go p.sendFinishedPieceToDiskIO(pieceNum, piece.data, !hashed, piece.duplicateBlocks)
 
 			// if nextDownload was previosly nil, then currentDownload will now be nil, because we
 			// copied the reference from nextDownload to currentDownload.
@@ -598,14 +1005,50 @@ func (p *Peer) decodeMessage(payload []byte) {
 
 		p.sendOneOrMoreRequests()
 	case MsgCancel:
-		// TODO: Implement cancel handling
-		pieceIndex := binary.BigEndian.Uint32(payload[0:4])
-		begin := binary.BigEndian.Uint32(payload[4:8])
-		length := binary.BigEndian.Uint32(payload[8:12])
+		pieceIndex, begin, length, _ := ParseCancel(payload)
 		log.Printf("Received a Cancel message for piece %x:%x[%x] from %s", pieceIndex, begin, length, p.peerName)
+		// Requests already handed to DiskIO are sent regardless
+		p.cancelQueuedRequest(BlockInfo{pieceIndex: pieceIndex, begin: begin, length: length})
 	case MsgPort:
-		log.Printf("Ignoring a Port message that was received from %s", p.peerName)
+		p.receivedPort(payload)
+	}
+}
+
+// cancelQueuedRequest drops a request of the peer that wasn't handed to
+// DiskIO yet
+func (p *Peer) cancelQueuedRequest(info BlockInfo) {
+	for i, request := range p.queuedRequests {
+		if request.request == info {
+			p.queuedRequests = append(p.queuedRequests[:i], p.queuedRequests[i+1:]...)
+			p.servedRequests--
+			return
+		}
+	}
+}
+
+// mergeBitfield adds the pieces of a bitfield received from the peer to the
+// pieces it sent haves for, and tells the controller about the new ones. The
+// peer is dropped if it has already sent a request, block or cancel.
+func (p *Peer) mergeBitfield(bitfield []bool) {
+	if p.receivedPayload {
+		log.Printf("ERROR: Received a bitfield from %s after a request, block or cancel. Disconnecting.", p.peerName)
+		p.Stop()
+		return
+	}
+
+	added := make([]bool, len(bitfield))
+	for pieceNum, hasPiece := range bitfield {
+		if hasPiece && !p.peerBitfield[pieceNum] {
+			p.peerBitfield[pieceNum] = true
+			added[pieceNum] = true
+		}
 	}
+	p.updatePiecesNeeded()
+
+	// Break the new pieces into a slice of HavePiece structs and send them
+	// to the controller
+	go p.sendBitfieldToController(added)
+	p.updateInterest()
 }
 
 func (p *Peer) haveCurrentDownloads() bool {
@@ -617,6 +1060,36 @@ func (p *Peer) haveCurrentDownloads() bool {
 	return false
 }
 
+// solicitedBlock returns the piece download and block number of a block
+// received from the peer, or nil if the block is to be discarded. It is if
+// the piece isn't downloaded from the peer, as when another peer completed
+// it in endgame or a choke voided our requests, if it doesn't match a block
+// of the piece, or if the block wasn't requested since the piece was given
+// to the peer or was already received.
+func (p *Peer) solicitedBlock(pieceNum int, begin int, length int) (*PieceDownload, int) {
+	piece := p.getPieceDownload(pieceNum)
+	if piece == nil {
+		log.Printf("Discarding block %x:%x from %s, the piece isn't downloaded from it", pieceNum, begin, p.peerName)
+		return nil, 0
+	}
+	blockNum := begin / downloadBlockSize
+	if begin < 0 || begin%downloadBlockSize != 0 || blockNum >= piece.numBlocksInPiece || length != p.expectedLengthForBlock(pieceNum, blockNum) {
+		log.Printf("WARNING: Discarding block %x:%x[%x] from %s, it doesn't match a block of the piece", pieceNum, begin, length, p.peerName)
+		return nil, 0
+	}
+	if piece.blocksReceived[blockNum] {
+		// Keep the first copy, the block was only requested once
+		log.Printf("WARNING: Received block %x:%x from %s more than once", pieceNum, begin, p.peerName)
+		piece.duplicateBlocks++
+		return nil, 0
+	}
+	if !piece.blocksRequested[blockNum] {
+		log.Printf("WARNING: Discarding block %x:%x from %s, it wasn't requested", pieceNum, begin, p.peerName)
+		return nil, 0
+	}
+	return piece, blockNum
+}
+
 func (p *Peer) getPieceDownload(pieceNum int) *PieceDownload {
 	for _, download := range p.downloads {
 		if !download.isFinished && download.pieceNum == pieceNum {
@@ -645,216 +1118,222 @@ func (p *Peer) reader() {
 	log.Printf("Peer (%s) : reader : Started", p.peerName)
 	defer log.Printf("Peer (%s) : reader : Completed", p.peerName)
 
-	var handshake Handshake
-	err := binary.Read(p.conn, binary.BigEndian, &handshake)
-	if err != nil {
-		log.Printf("Peer (%s) error in reader() doing binary.Read(): %s", p.peerName, err)
-		p.Stop()
-		return
-	}
-
-	p.lastRxMessage = time.Now()
-	p.stats.addRead(int(reflect.TypeOf(handshake).Size()))
-
-	err = verifyHandshake(&handshake, p.infoHash)
-	if err != nil {
-		log.Printf("Peer (%s) verifyandshake returned: %s", p.peerName, err)
-		p.Stop()
-		return
-	}
-	p.peerID = handshake.PeerID[:]
-
 	for {
-		length := make([]byte, 4)
-		n, err := io.ReadFull(p.conn, length)
+		// The deadline backs up the idle timeout of Run, in case the
+		// clock it's measured by stalls
+		p.conn.SetReadDeadline(time.Now().Add(p.readTimeout))
+		length, err := readMessageLength(p.conn, p.messageLimit())
 		if err != nil {
-			log.Printf("Peer (%s) error in reader() doing io.ReadFull(): %s", p.peerName, err)
+			log.Printf("Peer (%s) error in reader() reading the message length: %s", p.peerName, err)
 			p.Stop()
 			return
 		}
-		p.lastRxMessage = time.Now()
-		p.stats.addRead(n)
+		p.messageReceived()
+		p.stats.addRead(4)
 
-		payload := make([]byte, binary.BigEndian.Uint32(length))
-		n, err = io.ReadFull(p.conn, payload)
+		payload := make([]byte, length)
+		// Leave the message in the socket until the download rate
+		// allows it, so the peer is slowed down by TCP
+		if !p.downloadLimit.wait(len(payload), p.stopping) {
+			return
+		}
+		p.conn.SetReadDeadline(time.Now().Add(p.readTimeout))
+		n, err := io.ReadFull(p.conn, payload)
 		if err != nil {
 			log.Printf("Peer (%s) error in reader() doing io.ReadFull(): %s", p.peerName, err)
 			p.Stop()
 			return
 		}
-		p.lastRxMessage = time.Now()
+		p.messageReceived()
 		p.stats.addRead(n)
 
 		//log.Printf("Peer (%s) read %d bytes", p.peerName, n + 4)
-		go p.decodeMessage(payload)
+		// Run decodes the message, so that the state of the peer is
+		// only changed from its goroutine
+		select {
+		case p.messages <- payload:
+		case <-p.stopping:
+			return
+		}
 	}
 }
 
-func (p *Peer) sendHandshake() {
-	log.Printf("Peer : sendHandshake : Sending handshake to %s", p.peerName)
-
-	handshake := Handshake{
-		Len:      uint8(len(Protocol)),
-		Protocol: Protocol,
-		PeerID:   PeerID,
-	}
-	copy(handshake.InfoHash[:], p.infoHash)
-
-	err := binary.Write(p.conn, binary.BigEndian, &handshake)
-	if err != nil {
-		log.Printf("Peer (%s) error in sendHandshake() doing binary.Write(): %s", p.peerName, err)
-		p.Stop()
-		return
+// messageLimit returns the length of the largest message accepted from the
+// peer, which is more than maxMessageLength if the bitfield of the torrent
+// is larger
+func (p *Peer) messageLimit() int {
+	if bitfieldLength := 1 + (len(p.peerBitfield)+7)/8; bitfieldLength > maxMessageLength {
+		return bitfieldLength
 	}
-
-	p.lastTxMessage = time.Now()
-	p.stats.addWrite(int(reflect.TypeOf(&handshake).Size()))
+	return maxMessageLength
 }
 
+// sendKeepalive sends a keepalive, a message of zero length, through the
+// writer so that it can't be interleaved with another message
 func (p *Peer) sendKeepalive() {
 	log.Printf("Peer : sendKeepalive : Sending keepalive to %s", p.peerName)
+	p.sendMessage(NewKeepalive())
+}
 
-	message := make([]byte, 4)
+func (p *Peer) messageSent() {
+	p.activityMutex.Lock()
+	p.lastTxMessage = p.clock.Now()
+	p.activityMutex.Unlock()
+}
 
-	// Untested
-	err := binary.Write(p.conn, binary.BigEndian, &message)
-	if err != nil {
-		log.Printf("Peer (%s) error in sendKeepalive() doing binary.Write(): %s", p.peerName, err)
-		p.Stop()
-		return
-	}
+func (p *Peer) messageReceived() {
+	p.activityMutex.Lock()
+	p.lastRxMessage = p.clock.Now()
+	p.activityMutex.Unlock()
+}
 
-	p.lastTxMessage = time.Now()
-	p.stats.addWrite(4)
+// lastMessages returns when a message was last sent to and received from the
+// peer
+func (p *Peer) lastMessages() (tx time.Time, rx time.Time) {
+	p.activityMutex.Lock()
+	defer p.activityMutex.Unlock()
+	return p.lastTxMessage, p.lastRxMessage
 }
 
 func (p *Peer) writer() {
 	log.Println("Peer : writer : Started:", p.peerName)
 	defer log.Println("Peer : writer : Completed:", p.peerName)
 
+	sentInterested := false // our interest as the peer was last told it
 	for {
 		select {
 		case message := <-p.sendChan:
-			n, err := p.conn.Write(message)
-			if err != nil {
-				log.Printf("Peer (%s) error in writer() doing Write(): %s", p.peerName, err)
-				p.Stop()
+			if !p.write(message) {
+				return
+			}
+		case request := <-p.requests:
+			if int64(request.unchokes) != atomic.LoadInt64(&p.requestUnchoke) {
+				// The peer choked us since, which voided the request
+				continue
+			}
+			if !p.write(request.message) {
+				return
+			}
+		case interested := <-p.interest:
+			if interested == sentInterested {
+				// Changed back before the peer was told
+				continue
+			}
+			message := NewNotInterested()
+			if interested {
+				message = NewInterested()
+			}
+			if !p.write(message.Bytes()) {
 				return
 			}
-			p.lastTxMessage = time.Now()
-			p.stats.addWrite(n)
-			//log.Printf("Peer (%s) wrote %d bytes", p.peerName, n)
+			sentInterested = interested
+		case <-p.stopping:
+			return
 		}
 	}
 }
 
-// Sends any message besides a handshake or a keepalive, both of which
-// don't have a beginning LEN-ID structure. The length is automatically calculated.
-func (p *Peer) constructMessage(ID int, payload interface{}) {
-	// Write the payload to a slice of bytes so the length can be computed
-	payloadBuffer := new(bytes.Buffer)
-	err := binary.Write(payloadBuffer, binary.BigEndian, payload)
-	if err != nil {
-		log.Fatal(err)
+// write writes a message to the connection once the upload limit allows it.
+// It returns false if the peer is stopping or the write failed.
+func (p *Peer) write(message []byte) bool {
+	if !p.uploadLimit.wait(len(message), p.stopping) {
+		return false
 	}
-	payloadBytes := payloadBuffer.Bytes()
-
-	messageBuffer := new(bytes.Buffer)
-
-	// Write a 4-byte length field to the buffer
-	lengthField := uint32(len(payloadBytes) + 1) // plus 1 to account for the ID
-
-	err = binary.Write(messageBuffer, binary.BigEndian, lengthField)
+	n, err := p.conn.Write(message)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Peer (%s) error in writer() doing Write(): %s", p.peerName, err)
+		p.Stop()
+		return false
 	}
+	p.messageSent()
+	p.stats.addWrite(n)
+	//log.Printf("Peer (%s) wrote %d bytes", p.peerName, n)
+	return true
+}
 
-	// Write a 1-byte ID field to the buffer
-	err = binary.Write(messageBuffer, binary.BigEndian, uint8(ID))
-	if err != nil {
-		log.Fatal(err)
+// sendMessage sends a message to the peer through the writer. Once the peer
+// is stopping the message is dropped, so that senders don't wait forever on
+// a writer that has returned.
+func (p *Peer) sendMessage(m Message) {
+	select {
+	case p.sendChan <- m.Bytes():
+	case <-p.stopping:
 	}
-
-	// Write the variable length payload to the buffer (potentially 0 bytes)
-	err = binary.Write(messageBuffer, binary.BigEndian, payloadBytes)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Send the message to the peer
-	p.sendChan <- messageBuffer.Bytes()
 }
 
 func (p *Peer) sendChoke() {
 	log.Printf("Peer : sendChoke : Sending choke to %s", p.peerName)
-	go p.constructMessage(MsgChoke, make([]byte, 0))
+	go p.sendMessage(NewChoke())
 	p.amChoking = true
 }
 
 func (p *Peer) sendUnchoke() {
 	log.Printf("Peer : sendUnchoke : Sending unchoke to %s", p.peerName)
-	go p.constructMessage(MsgUnchoke, make([]byte, 0))
+	go p.sendMessage(NewUnchoke())
 	p.amChoking = false
 }
 
-func (p *Peer) sendInterested() {
-	log.Printf("Peer : sendInterested : Sending interested to %s", p.peerName)
-	go p.constructMessage(MsgInterested, make([]byte, 0))
-	p.amInterested = true
-}
-
-func (p *Peer) sendNotInterested() {
-	log.Printf("Peer : sendNotInterested : Sending not-interested to %s", p.peerName)
-	go p.constructMessage(MsgNotInterested, make([]byte, 0))
-	p.amInterested = false
+// updateInterest makes us interested in the peer while it has a piece we
+// need, telling the peer only when that changes. The writer sends the latest
+// interest, so that interested and not interested can't overtake one
+// another, and a change undone before the writer gets to it isn't sent.
+func (p *Peer) updateInterest() {
+	interested := p.weShouldBeInterested()
+	if interested == p.amInterested {
+		return
+	}
+	log.Printf("Peer : updateInterest : Telling %s we're interested %t", p.peerName, interested)
+	p.amInterested = interested
+	// Run is the only sender, there's room once any change the writer
+	// hasn't got to is dropped
+	select {
+	case <-p.interest:
+	default:
+	}
+	p.interest <- interested
 }
 
 func (p *Peer) sendHave(pieceNum int) {
 	log.Printf("Peer : sendHave : Sending have to %s for piece %x", p.peerName, pieceNum)
-	payloadBuffer := new(bytes.Buffer)
-	err := binary.Write(payloadBuffer, binary.BigEndian, uint32(pieceNum))
-	if err != nil {
-		log.Fatal(err)
-	}
-	p.constructMessage(MsgHave, payloadBuffer.Bytes())
+	p.sendMessage(NewHave(uint32(pieceNum)))
 }
 
+// sendBitfield sends our bitfield to the peer, unless we have no pieces at
+// all, in which case the message may be omitted
 func (p *Peer) sendBitfield() {
+	havePiece := false
+	for _, hasPiece := range p.ourBitfield {
+		havePiece = havePiece || hasPiece
+	}
+	if !havePiece {
+		log.Printf("Peer : sendBitfield : Not sending a bitfield to %s, we have no pieces", p.peerName)
+		return
+	}
 	compacted := convertBoolSliceToByteSlice(p.ourBitfield)
 	log.Printf("Peer : sendBitfield : Sending bitfield to %s with payload %x", p.peerName, compacted)
-	p.constructMessage(MsgBitfield, compacted)
+	p.sendMessage(NewBitfield(compacted))
 }
 
-func (p *Peer) sendRequest(pieceNum int, begin int, length int) {
+// sendRequest sends a request made while the peer unchoked us for the
+// unchokes time through the writer, which drops it if the peer has choked us
+// since
+func (p *Peer) sendRequest(pieceNum int, begin int, length int, unchokes int) {
 	//log.Printf("Peer : sendRequest : Sending Request to %s for piece %x:%x[%x]", p.peerName, pieceNum, begin, length)
-	buffer := new(bytes.Buffer)
-
-	ints := []uint32{uint32(pieceNum), uint32(begin), uint32(length)}
-
-	err := binary.Write(buffer, binary.BigEndian, ints)
-	if err != nil {
-		log.Fatal(err)
+	request := outgoingRequest{message: NewRequest(uint32(pieceNum), uint32(begin), uint32(length)).Bytes(), unchokes: unchokes}
+	select {
+	case p.requests <- request:
+	case <-p.stopping:
 	}
-
-	p.constructMessage(MsgRequest, buffer.Bytes())
 }
 
+// expectedLengthForBlock returns the length of a block, the last block of a
+// piece being shorter if the piece isn't a multiple of the block size
 func (p *Peer) expectedLengthForBlock(pieceNum int, blockNum int) int {
-	if pieceNum == (len(p.ourBitfield) - 1) {
-		// This is the last piece. Check to see if it's the last block
-		lastPieceLength := p.expectedLengthForPiece(pieceNum)
-
-		if ((blockNum * downloadBlockSize) + downloadBlockSize) > lastPieceLength {
-			// This is the last block of the last piece
-			return (p.totalLength % p.pieceLength) % downloadBlockSize
-		} else {
-			// This is the last piece, but not the last block.
-			return downloadBlockSize
-		}
-	} else {
-		// This is not the last piece.
+	length := p.expectedLengthForPiece(pieceNum) - blockNum*downloadBlockSize
+	if length > downloadBlockSize {
 		return downloadBlockSize
 	}
+	return length
 }
 
 func (p *Peer) expectedLengthForPiece(pieceNum int) int {
@@ -875,42 +1354,38 @@ func (p *Peer) expectedLengthForPiece(pieceNum int) int {
 }
 
 func (p *Peer) expectedNumBlocksForPiece(pieceNum int) int {
-	if pieceNum == (len(p.ourBitfield) - 1) {
-		// This is the last piece
-		lengthOfLastPiece := p.expectedLengthForPiece(pieceNum)
-		if lengthOfLastPiece == p.pieceLength {
-			return p.pieceLength / downloadBlockSize
-		} else {
-			return (lengthOfLastPiece / downloadBlockSize) + 1
-		}
-	} else {
-		// this is not the last piece
-		return p.pieceLength / downloadBlockSize
-	}
+	return (p.expectedLengthForPiece(pieceNum) + downloadBlockSize - 1) / downloadBlockSize
 }
 
-func (p *Peer) sendRequestByBlockNum(pieceNum int, blockNum int) {
+func (p *Peer) sendRequestByBlockNum(pieceNum int, blockNum int, unchokes int) {
 	begin := downloadBlockSize * blockNum
 	length := p.expectedLengthForBlock(pieceNum, blockNum)
-	p.sendRequest(pieceNum, begin, length)
+	p.sendRequest(pieceNum, begin, length, unchokes)
 }
 
 func (p *Peer) sendOneOrMoreRequests() {
+	if p.peerChoking {
+		// Requests are only sent while the peer unchokes us
+		return
+	}
 	for {
 
 		numOutstandingBlocks := p.totalOutstandingBlocks()
 
-		if numOutstandingBlocks > maxSimultaneousBlockDownloads {
-			log.Fatalf("Peer : sendOneOrMoreRequests : State Error: Somehow there are %d outstanding blocks, which is more than %d", numOutstandingBlocks, maxSimultaneousBlockDownloads)
-		} else if numOutstandingBlocks == maxSimultaneousBlockDownloads {
-			// We're maxxed out on the number of outstanding blocks to this peer.
-			// Wait until blocks are received before sending more requests.
+		if numOutstandingBlocks >= p.requestDepth {
+			// We're maxxed out on the number of outstanding blocks to this
+			// peer, or over it since the depth was lowered. Wait until
+			// blocks are received before sending more requests.
 			return
 		} else {
 			for _, piece := range p.downloads {
 				if !piece.isFinished && piece.remainingRequestsToSend() > 0 {
-					blockNum := piece.numBlocksReceived + piece.numOutstandingBlocks
-					go p.sendRequestByBlockNum(piece.pieceNum, blockNum)
+					blockNum := piece.nextBlockToRequest()
+					if blockNum < 0 {
+						continue
+					}
+					go p.sendRequestByBlockNum(piece.pieceNum, blockNum, p.unchokes)
+					piece.blocksRequested[blockNum] = true
 					piece.numOutstandingBlocks += 1
 
 					// Make a recursive call to attempt to send more requests
@@ -919,7 +1394,7 @@ func (p *Peer) sendOneOrMoreRequests() {
 				}
 			}
 
-			// We cycled through every piece and still didn't hit maxSimultaneousBlockDownloads
+			// We cycled through every piece and still didn't hit the request depth
 			return
 		}
 	}
@@ -936,34 +1411,11 @@ func (p *Peer) totalOutstandingBlocks() int {
 }
 
 func (p *Peer) sendBlock(pieceNum uint32, begin uint32, block []byte) {
-	buffer := new(bytes.Buffer)
-
-	ints := []uint32{pieceNum, begin}
-
-	err := binary.Write(buffer, binary.BigEndian, ints)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = binary.Write(buffer, binary.BigEndian, block)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	p.constructMessage(MsgBlock, buffer.Bytes())
+	p.sendMessage(NewPiece(pieceNum, begin, block))
 }
 
 func (p *Peer) sendCancel(pieceNum int, begin int, length int) {
-	buffer := new(bytes.Buffer)
-
-	ints := []uint32{uint32(pieceNum), uint32(begin), uint32(length)}
-
-	err := binary.Write(buffer, binary.BigEndian, ints)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	p.constructMessage(MsgCancel, buffer.Bytes())
+	p.sendMessage(NewCancel(uint32(pieceNum), uint32(begin), uint32(length)))
 }
 
 func (p *Peer) receiveHavesFromController(innerChan chan HavePiece) []HavePiece {
@@ -980,17 +1432,39 @@ func (p *Peer) receiveHavesFromController(innerChan chan HavePiece) []HavePiece
 
 }
 
+// ourPiecesChanged takes pieces we completed or lost from the controller,
+// announcing the completed ones to the peer. We're no longer interested
+// once we've completed the last piece we needed from the peer, and
+// interested again if we've lost one it has.
+func (p *Peer) ourPiecesChanged(havePieces []HavePiece) {
+	p.updateOurBitfield(havePieces)
+
+	// Send have messages to the peer. Since this is not the initial bitfield
+	// from the controller, there should only be one. There's no message
+	// taking back a HAVE, so lost pieces are just no longer advertised.
+	for _, havePiece := range havePieces {
+		if !havePiece.lost {
+			go p.sendHave(havePiece.pieceNum)
+		}
+	}
+	p.updateInterest()
+}
+
 func (p *Peer) updateOurBitfield(havePieces []HavePiece) {
 	// update our local bitfield based on the Have messages received from the controller.
 	for _, havePiece := range havePieces {
-		p.ourBitfield[havePiece.pieceNum] = true
+		p.ourBitfield[havePiece.pieceNum] = !havePiece.lost
 	}
+	p.updatePiecesNeeded()
 }
 
+// Stop tells Run to close the connection. It doesn't block, and may be
+// called more than once and from any goroutine, including Run's.
 func (p *Peer) Stop() {
-	log.Println("Peer : Stop : Stopping:", p.peerName)
-	p.stopping <- true
-	return
+	p.stopOnce.Do(func() {
+		log.Println("Peer : Stop : Stopping:", p.peerName)
+		close(p.stopping)
+	})
 }
 
 func (p *Peer) processCancelFromController(cancelPiece CancelPiece) {
@@ -1014,64 +1488,109 @@ func (p *Peer) Run() {
 	log.Println("Peer : Run : Started:", p.peerName)
 	defer log.Println("Peer : Run : Completed:", p.peerName)
 
-	p.ticker = time.NewTicker(time.Second)
+	p.ticker = p.clock.NewTicker(time.Second)
 	defer p.ticker.Stop()
-
-	p.sendHandshake()
+	var lastTick time.Time
+	var probedAt time.Time // when the connection was probed after the clock jumped
+	// The latest snapshot of the stats, sent once Stats takes it. Each
+	// snapshot replaces the one before, so Stats sees them in order.
+	var statsCh chan peerStatsSnapshot
+	var stats peerStatsSnapshot
 
 	// Block on this because it simplifies the logic for
 	// sending the initial bitfield to the peer
 	havePieces := p.receiveHavesFromController(<-p.contRxChans.havePiece)
 	p.updateOurBitfield(havePieces)
-	go p.sendBitfield()
 	go p.writer()
+	// Our bitfield is the first message after the handshake, followed by
+	// our extended handshake and DHT port. Nothing else is sent before the
+	// reader starts.
+	p.sendBitfield()
+	p.sendExtendedHandshake()
+	p.sendPort()
 	go p.reader()
+	// A peer pinned unchoked is unchoked straight away
+	p.updateChoke()
 
 	log.Printf("Peer : Run : %s finished initializing reader and writer", p.peerName)
 
 	for {
+		// The oldest request of the peer is handed to DiskIO once it
+		// takes it
+		var blockRequests chan BlockRequest
+		var blockRequest BlockRequest
+		if len(p.queuedRequests) > 0 {
+			blockRequests, blockRequest = p.diskIOChans.blockRequest, p.queuedRequests[0]
+		}
 		select {
-		case t := <-p.ticker.C:
-			if p.lastTxMessage.Add(time.Second * 30).Before(t) {
-				log.Println("No TxMessage for 30 seconds", p.peerName, p.lastTxMessage.Unix(), t.Unix())
+		case blockRequests <- blockRequest:
+			p.queuedRequests = p.queuedRequests[1:]
+		case statsCh <- stats:
+			statsCh = nil
+		case t := <-p.ticker.C():
+			if jump := clockJump(lastTick, t, time.Second); jump > 0 {
+				// The time since the last messages includes the
+				// jump. Rather than declaring the peer dead, probe
+				// the connection with a keepalive and give the peer
+				// the full timeout to answer.
+				log.Printf("Peer (%s) : Run : Clock jumped by %v, probing the connection", p.peerName, jump)
+				probedAt = t
+				p.stats.resetRates(t)
+				p.sendKeepalive()
+			}
+			lastTick = t
+			lastTxMessage, lastRxMessage := p.lastMessages()
+			if lastTxMessage.Add(keepaliveInterval).Before(t) {
+				log.Println("No TxMessage for", keepaliveInterval, p.peerName, lastTxMessage.Unix(), t.Unix())
 				p.sendKeepalive()
 			}
-			if p.lastRxMessage.Add(time.Second * 120).Before(t) {
-				log.Println("No RxMessage for 120 seconds", p.peerName, p.lastRxMessage.Unix(), t.Unix())
+			if probedAt.After(lastRxMessage) {
+				lastRxMessage = probedAt
+			}
+			if lastRxMessage.Add(peerIdleTimeout).Before(t) {
+				log.Println("No RxMessage for", peerIdleTimeout, p.peerName, lastRxMessage.Unix(), t.Unix())
 				p.Stop()
 			}
+			p.sendPex(t)
+			p.adaptRequestDepth(t)
+			stats = p.stats.snapshot()
+			stats.peerName, stats.connection = p.identity, p.connection
+			statsCh = p.statsCh
+		case payload := <-p.messages:
+			p.decodeMessage(payload)
+		case blockResponse := <-p.blockResponse:
+			if blockResponse.err != nil {
+				log.Printf("Peer : Run : Not sending block %v to %s: %s", blockResponse.info, p.peerName, blockResponse.err)
+				p.servedRequests--
+				break
+			}
+			if p.amChoking {
+				// The peer was choked after it requested the block
+				log.Printf("Peer : Run : Not sending block %v to %s, which is choked", blockResponse.info, p.peerName)
+				p.servedRequests--
+				break
+			}
 			go func() {
-				p.statsCh <- p.stats
+				p.sendBlock(blockResponse.info.pieceIndex, blockResponse.info.begin, blockResponse.data)
+				select {
+				case p.blockSent <- struct{}{}:
+				case <-p.stopping:
+				}
 			}()
-		case blockResponse := <-p.blockResponse:
-			go p.sendBlock(blockResponse.info.pieceIndex, blockResponse.info.begin, blockResponse.data)
+		case <-p.blockSent:
+			p.servedRequests--
 		case requestPiece := <-p.contRxChans.requestPiece:
-			log.Printf("Peer : Run : Controller told %s to get piece %x", p.peerName, requestPiece.pieceNum)
-
-			p.initializePieceDownload(requestPiece)
-
-			// Send the first set of block requests all at once. When we get response (piece) messages,
-			// we'll then determine if more need to be set.
-			p.sendOneOrMoreRequests()
+			p.startPieceDownload(requestPiece)
 
 		case cancelPiece := <-p.contRxChans.cancelPiece:
 			p.processCancelFromController(cancelPiece)
 
+		case <-p.overrideChanged:
+			p.updateChoke()
+
 		case innerChan := <-p.contRxChans.havePiece:
 			log.Printf("Peer : %s received a HavePiece innerChan from controller.", p.peerName)
-
-			havePieces := p.receiveHavesFromController(innerChan)
-			p.updateOurBitfield(havePieces)
-
-			// Send have messages to the peer. Since this is not the initial bitfield
-			// from the controller, there should only be one.
-			for _, havePiece := range havePieces {
-				go p.sendHave(havePiece.pieceNum)
-			}
-
-			if p.amInterested && !p.weShouldBeInterested() {
-				p.sendNotInterested()
-			}
+			p.ourPiecesChanged(p.receiveHavesFromController(innerChan))
 
 		case <-p.stopping:
 			p.conn.Close()
@@ -1085,6 +1604,52 @@ func (p *Peer) Run() {
 	}
 }
 
+// startPieceDownload starts downloading a piece the controller told us to
+// get. A piece given while the peer unchoked us an earlier time, or given
+// after the peer choked us, was taken back by the controller when it learned
+// of the choke, and is dropped.
+func (p *Peer) startPieceDownload(requestPiece RequestPiece) {
+	if p.peerChoking || requestPiece.unchokes != p.unchokes {
+		log.Printf("Peer : startPieceDownload : Dropping piece %x for %s, the peer choked us since it was given", requestPiece.pieceNum, p.peerName)
+		return
+	}
+	if p.getPieceDownload(requestPiece.pieceNum) != nil {
+		log.Printf("Peer : startPieceDownload : WARNING: Controller told %s to get piece %x, which it's already getting", p.peerName, requestPiece.pieceNum)
+		return
+	}
+	log.Printf("Peer : startPieceDownload : Controller told %s to get piece %x", p.peerName, requestPiece.pieceNum)
+
+	p.initializePieceDownload(requestPiece)
+
+	// Send the first set of block requests all at once. When we get response (piece) messages,
+	// we'll then determine if more need to be set.
+	p.sendOneOrMoreRequests()
+}
+
+// sendChokeStatus tells the controller that the peer choked or unchoked us.
+// Each status waits for the one before to reach the controller, so that the
+// controller learns of the changes in the order the peer made them however
+// fast it flaps.
+func (p *Peer) sendChokeStatus(isChoked bool) {
+	previous, sent := p.chokeStatusSent, make(chan struct{})
+	p.chokeStatusSent = sent
+	status := PeerChokeStatus{peerName: p.peerName, isChoked: isChoked}
+	go func() {
+		defer close(sent)
+		if previous != nil {
+			select {
+			case <-previous:
+			case <-p.stopping:
+				return
+			}
+		}
+		select {
+		case p.contTxChans.chokeStatus <- status:
+		case <-p.stopping:
+		}
+	}()
+}
+
 func (p *Peer) initializePieceDownload(requestPiece RequestPiece) {
 	var piece *PieceDownload
 	for _, download := range p.downloads {
@@ -1109,80 +1674,507 @@ func (p *Peer) initializePieceDownload(requestPiece RequestPiece) {
 	piece.numBlocksInPiece = p.expectedNumBlocksForPiece(requestPiece.pieceNum)
 	piece.numBlocksReceived = 0
 	piece.numOutstandingBlocks = 0
+	piece.blocksReceived = make([]bool, piece.numBlocksInPiece)
+	piece.blocksRequested = make([]bool, piece.numBlocksInPiece)
+	piece.duplicateBlocks = 0
+	piece.hashedBlocks = 0
+	piece.hash = nil
+	if !p.verification.allowlisted(p.peerName, p.peerID) {
+		piece.hash = sha1.New()
+	}
+}
+
+// addPeer starts a Peer for a connection that has completed the handshake.
+// A peer that's already connected under another name, having dialed us while
+// we dialed it, is only connected to once.
+func (pm *PeerManager) addPeer(hc handshakedConn) {
+	conn := hc.conn
+	peerName := conn.RemoteAddr().String()
+	_, ok := pm.peers[peerName]
+	if ok {
+		log.Printf("PeerManager: Peer %s already exists!", peerName)
+		conn.Close()
+		return
+	}
+	existingName, duplicate := pm.peerIDs[string(hc.peerID)]
+	if duplicate {
+		existing := pm.peers[existingName]
+		if rebinding(existing, hc) {
+			log.Printf("PeerManager : addPeer : Replacing %s with %s, the peer reconnected from a new port", existingName, peerName)
+		} else if !keepConnection(existing, hc) {
+			log.Printf("PeerManager : addPeer : Dropping %s, already connected to the same peer as %s", peerName, existingName)
+			conn.Close()
+			return
+		} else {
+			log.Printf("PeerManager : addPeer : Replacing %s with %s, they're connections to the same peer", existingName, peerName)
+		}
+		go existing.Stop()
+	} else if pm.capped(remoteIP(conn)) {
+		conn.Close()
+		return
+	} else if pm.numPeers >= pm.maxPeers {
+		// Not accepting any more peers because we're at the max
+		conn.Close()
+		return
+	}
+
+	// Create the Controller->Peer chans struct
+	contTxChans := *NewControllerPeerChans()
+	// Construct the Peer object
+	peer := NewPeer(
+		peerName,
+		pm.infoHash,
+		pm.numPieces,
+		pm.pieceLength,
+		pm.totalLength,
+		pm.diskIOChans,
+		contTxChans,
+		pm.peerContChans,
+		pm.peerChans,
+		pm.statsCh,
+		pm.clock)
+	peer.peerID = hc.peerID
+	peer.reserved = hc.reserved
+	peer.outbound = hc.outbound
+	handshakeSize := int(reflect.TypeOf(Handshake{}).Size())
+	peer.stats.addRead(handshakeSize)
+	peer.stats.addWrite(handshakeSize)
+	peer.verification = pm.verification
+	peer.chokeOverrides = pm.chokeOverrides
+	peer.pex = pm.pex
+	peer.dhtPort, peer.dhtPings = pm.dhtPort, pm.dhtPings
+	peer.uploadOnly = pm.uploadOnly
+	peer.maxServedRequests = pm.maxServedRequests
+	peer.requestDepth, peer.minRequestDepth, peer.maxRequestDepth = pm.requestDepth, pm.requestDepth, pm.maxRequestDepth
+	if hc.outbound && pm.pex != nil {
+		// We dialed the address, so others can connect to it too
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		pm.pex.add(peerName, PeerTuple{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	peer.uploadLimit, peer.downloadLimit = pm.uploadLimit, pm.downloadLimit
+	pm.peers[peerName] = peer
+	pm.peerIDs[string(hc.peerID)] = peerName
+
+	// Give the controller the channels that it will use to
+	// transmit messages to this new peer
+	go func() {
+		pm.contChans.newPeer <- PeerComms{peerName: peerName, chans: contTxChans}
+	}()
+	// Associate the connection with the peer object and start the peer
+	peer.conn = conn
+	pm.joinHistory(peer)
+	go peer.Run()
+	pm.numPeers += 1
+}
+
+// connected reports whether we're connected to, or dialing, a peer
+func (pm *PeerManager) connected(peerName string) bool {
+	_, ok := pm.peers[peerName]
+	_, dialing := pm.dialing[peerName]
+	return ok || dialing
+}
+
+// dial connects to a peer and exchanges handshakes
+func (pm *PeerManager) dial(peer PeerTuple) {
+	peerName := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
+	pm.dialing[peerName] = pm.clock.Now()
+	log.Printf("PeerManager : dial : %s is connecting, %d connections half-open", peerName, len(pm.dialing))
+	timeout := pm.dialTimeout
+	go func() {
+		result := dialResult{peerName: peerName, peer: peer}
+		var conn *net.TCPConn
+		conn, result.err = connectToPeer(peer, timeout)
+		if result.err == nil {
+			result.handshakedConn, result.err = pm.handshake(conn, true)
+		}
+		select {
+		case pm.peerChans.dialed <- result:
+		case <-pm.quit:
+			if result.conn != nil {
+				result.conn.Close()
+			}
+		}
+	}()
+}
+
+// addCandidate remembers a peer to dial once there's room. Only the most
+// recent maxCandidates candidates are kept, or maxPeers.
+func (pm *PeerManager) addCandidate(peer PeerTuple) {
+	for _, candidate := range pm.candidates {
+		if candidate.IP.Equal(peer.IP) && candidate.Port == peer.Port {
+			return
+		}
+	}
+	pm.candidates = append(pm.candidates, peer)
+	maxCandidates := pm.maxCandidates
+	if maxCandidates == 0 {
+		maxCandidates = pm.maxPeers
+	}
+	if len(pm.candidates) > maxCandidates {
+		pm.candidates = pm.candidates[1:]
+	}
+}
+
+// rememberReconnect returns the reconnect state of a peer, adding it unless
+// maxReconnects peers are already remembered
+func (pm *PeerManager) rememberReconnect(peerName string, peer PeerTuple) (*reconnectState, bool) {
+	if pm.maxReconnects > 0 && len(pm.reconnects) >= pm.maxReconnects {
+		log.Printf("PeerManager : rememberReconnect : Not reconnecting to %s, already remembering %d peers", peerName, len(pm.reconnects))
+		return nil, false
+	}
+	state := &reconnectState{peer: peer}
+	pm.reconnects[peerName] = state
+	return state, true
+}
+
+// peerFound dials a peer learned from a tracker or another peer, or keeps it
+// as a candidate if we're at the max
+func (pm *PeerManager) peerFound(peer PeerTuple) {
+	if pm.seeding {
+		// Not connecting to any more peers because we're seeding
+		return
+	}
+	if pm.blocked(peer.IP) {
+		return
+	}
+	peerName := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
+	pm.reachability.peerKnown(peerName)
+	if pm.connected(peerName) {
+		log.Printf("PeerManager: Peer %s already exists!", peerName)
+		return
+	}
+	if pm.capped(peer.IP) || !pm.admitCandidate(peer) {
+		return
+	}
+	if !pm.canDial() {
+		// At the max, or of half-open connections, remember the peer
+		// in case a connection is evicted or dies, or a dial finishes
+		pm.addCandidate(peer)
+		return
+	}
+	pm.dial(peer)
+}
+
+// canDial returns true if there's room for another peer, and for another
+// half-open connection
+func (pm *PeerManager) canDial() bool {
+	return pm.numPeers+len(pm.dialing) < pm.maxPeers && len(pm.dialing) < pm.maxHalfOpen
+}
+
+// dialFailed records a failed connection attempt to a peer and schedules the
+// next, unless the peer is ourselves or on a port that isn't dialed twice
+func (pm *PeerManager) dialFailed(result dialResult) {
+	if errors.Is(result.err, errSelfConnection) || pm.ports.classify(result.peer.Port) != portAllowed {
+		log.Printf("PeerManager : dialFailed : %s failed, not retrying: %s", result.peerName, result.err)
+		delete(pm.reconnects, result.peerName)
+		return
+	}
+	state, ok := pm.reconnects[result.peerName]
+	if !ok {
+		if state, ok = pm.rememberReconnect(result.peerName, result.peer); !ok {
+			return
+		}
+	}
+	state.lastErr = result.err.Error()
+	log.Printf("PeerManager : dialFailed : %s failed: %s", result.peerName, result.err)
+	pm.scheduleReconnect(result.peerName, state)
+}
+
+// dialCandidates dials remembered peers while there's room, those on
+// suspicious ports last
+func (pm *PeerManager) dialCandidates() {
+	for !pm.seeding && pm.canDial() {
+		var peer PeerTuple
+		if len(pm.candidates) > 0 {
+			peer = pm.candidates[0]
+			pm.candidates = pm.candidates[1:]
+		} else if len(pm.lowPriority) > 0 {
+			peer = pm.lowPriority[0]
+			pm.lowPriority = pm.lowPriority[1:]
+		} else {
+			break
+		}
+		if !pm.connected(fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)) && !pm.blocked(peer.IP) && !pm.capped(peer.IP) {
+			pm.dial(peer)
+		}
+	}
+}
+
+// remoteIP returns the IP address of the other end of a connection
+func remoteIP(conn net.Conn) net.IP {
+	return conn.RemoteAddr().(*net.TCPAddr).IP
+}
+
+// isBanned reports whether peers at an IP have sent too many bad pieces
+func (pm *PeerManager) isBanned(ip net.IP) bool {
+	_, banned := pm.banned[ip.String()]
+	return banned
+}
+
+// blocked reports whether peers at an IP aren't connected to, because they
+// are banned or the IP filter blocks them
+func (pm *PeerManager) blocked(ip net.IP) bool {
+	return pm.isBanned(ip) || pm.ipFilter.get().Blocked(ip)
+}
+
+// recordBadPiece counts a piece from a peer that failed its hash check.
+// Every block of a piece is requested from the same peer, so the peer is to
+// blame. Once peers at its IP have sent maxBadPieces the IP is banned, and
+// any other connections to it are stopped.
+func (pm *PeerManager) recordBadPiece(p *Peer) {
+	ip := remoteIP(p.conn)
+	pm.badPieces[ip.String()]++
+	if pm.badPieces[ip.String()] < maxBadPieces || pm.isBanned(ip) {
+		return
+	}
+	log.Printf("PeerManager : recordBadPiece : Banning %s after %d bad pieces", ip, pm.badPieces[ip.String()])
+	pm.banned[ip.String()] = struct{}{}
+	pm.chokeOverrides.ban(ip)
+	for _, other := range pm.peers {
+		if other != p && remoteIP(other.conn).Equal(ip) {
+			go other.Stop()
+		}
+	}
+}
+
+// reconnectDelay returns the delay before a reconnect attempt, after the
+// given number of attempts
+func reconnectDelay(attempts int) time.Duration {
+	delay := reconnectMinDelay
+	for i := 0; i < attempts && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		return reconnectMaxDelay
+	}
+	return delay
+}
+
+// reconnectLater schedules a reconnect to a peer that dropped, if we dialed
+// it, it wasn't evicted or sending us bad data, and isn't on a suspicious
+// port
+func (pm *PeerManager) reconnectLater(p *Peer) {
+	port := uint16(p.conn.RemoteAddr().(*net.TCPAddr).Port)
+	if !p.outbound || p.evicted || p.sentBadData || pm.blocked(remoteIP(p.conn)) || pm.ports.classify(port) != portAllowed {
+		delete(pm.reconnects, p.peerName)
+		return
+	}
+	state, ok := pm.reconnects[p.peerName]
+	if !ok || pm.clock.Now().Sub(p.connectedAt) >= peerEvictionGracePeriod {
+		delete(pm.reconnects, p.peerName)
+		addr := p.conn.RemoteAddr().(*net.TCPAddr)
+		if state, ok = pm.rememberReconnect(p.peerName, PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}); !ok {
+			return
+		}
+	}
+	pm.scheduleReconnect(p.peerName, state)
+}
+
+// scheduleReconnect waits for the backoff of the next attempt to reconnect
+// to a peer, or gives up on the peer after maxReconnectAttempts. When we're
+// firewalled peers can't connect to us, so we try harder to reconnect to
+// them.
+func (pm *PeerManager) scheduleReconnect(peerName string, state *reconnectState) {
+	maxAttempts := maxReconnectAttempts
+	delay := reconnectDelay(state.attempts)
+	if pm.reachability.firewalled() {
+		maxAttempts *= firewalledDialFactor
+		delay /= firewalledDialFactor
+	}
+	if state.attempts >= maxAttempts {
+		log.Printf("PeerManager : scheduleReconnect : Giving up on %s after %d attempts to reconnect", peerName, state.attempts)
+		delete(pm.reconnects, peerName)
+		return
+	}
+	state.attempts++
+	log.Printf("PeerManager : scheduleReconnect : Reconnecting to %s in %v", peerName, delay)
+	after := pm.clock.After(delay)
+	go func() {
+		select {
+		case <-after:
+			select {
+			case pm.peerChans.reconnect <- peerName:
+			case <-pm.quit:
+			}
+		case <-pm.quit:
+		}
+	}()
+}
+
+// evictWorstPeer stops the least useful peer to make room for a candidate
+// when we're at the max. Only peers that have been connected for the grace
+// period and either have no pieces we need or send us less than
+// minPeerDownloadRate are evicted. Of those, the peer with the fewest pieces
+// we need and then the lowest download rate goes first. The candidate is
+// dialed once the peer is dead.
+func (pm *PeerManager) evictWorstPeer() {
+	if pm.seeding || len(pm.candidates) == 0 || pm.numPeers+len(pm.dialing) < pm.maxPeers {
+		return
+	}
+	var worst *Peer
+	var worstNeeded int32
+	var worstRate float64
+	now := pm.clock.Now()
+	for _, p := range pm.peers {
+		// The rates are measured over a window that restarts when the
+		// clock jumps, so peers get a new grace period after a resume
+		rate, _, window := p.stats.rates(now)
+		if p.evicted || window < peerEvictionGracePeriod {
+			continue
+		}
+		needed := atomic.LoadInt32(&p.piecesNeeded)
+		if needed > 0 && rate >= minPeerDownloadRate {
+			continue
+		}
+		if worst == nil || needed < worstNeeded || (needed == worstNeeded && rate < worstRate) {
+			worst, worstNeeded, worstRate = p, needed, rate
+		}
+	}
+	if worst == nil {
+		return
+	}
+	log.Printf("PeerManager : evictWorstPeer : Evicting %s (%d pieces needed, %.0f bytes/s) to make room for another peer", worst.peerName, worstNeeded, worstRate)
+	worst.evicted = true
+	go worst.Stop()
+}
+
+// Stop stops PeerManager, which stops every peer, and waits for Run to
+// return
+func (pm *PeerManager) Stop() error {
+	return pm.lifecycle.stop(func() { close(pm.quit) })
 }
 
 func (pm *PeerManager) Run() {
+	if err := pm.lifecycle.start(); err != nil {
+		log.Printf("PeerManager : Run : Not running: %s", err)
+		return
+	}
+	defer pm.lifecycle.finish()
 	log.Println("PeerManager : Run : Started")
 	defer log.Println("PeerManager : Run : Completed")
 
+	evictionTicker := pm.clock.NewTicker(peerEvictionInterval)
+	defer evictionTicker.Stop()
+	pm.reachability.reset(pm.clock.Now())
+
 	for {
 		select {
 		case seeding := <-pm.contChans.seeding:
+			pm.seeding = seeding
 			if !seeding {
-				log.Fatal("PeerManager : Unexpectedly received a false over the seeding channel")
-			} else {
-				pm.seeding = true
+				// More files are wanted, connect to peers again
+				log.Println("PeerManager : Run : Downloading again, no longer only seeding")
+				pm.dialCandidates()
 			}
 		case peer := <-pm.trackerChans.peers:
-			if pm.seeding || pm.numPeers >= maxPeers {
-				// Not accepting any more peers because we're
-				// either seeding or at max
+			pm.reachability.trackerPeer(peer.IP)
+			pm.peerFound(peer)
+		case found := <-pm.peerChans.pexPeers:
+			log.Printf("PeerManager : Run : %s told us about %d peers", found.peerName, len(found.peers))
+			for _, peer := range found.peers {
+				pm.peerFound(peer)
+			}
+		case result := <-pm.peerChans.dialed:
+			delete(pm.dialing, result.peerName)
+			if result.err == nil {
+				log.Printf("PeerManager : Run : %s is connected", result.peerName)
+				pm.reachability.outboundConnected(result.peer.IP, pm.clock.Now())
+				pm.addPeer(result.handshakedConn)
+			} else {
+				pm.dialFailed(result)
+			}
+			pm.dialCandidates()
+		case peerName := <-pm.peerChans.reconnect:
+			state, ok := pm.reconnects[peerName]
+			if !ok || pm.connected(peerName) {
+				break
+			}
+			if pm.seeding {
+				delete(pm.reconnects, peerName)
+				break
+			}
+			if pm.blocked(state.peer.IP) || pm.capped(state.peer.IP) {
+				delete(pm.reconnects, peerName)
 				break
 			}
-			peerName := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
-			_, ok := pm.peers[peerName]
-			if ok {
-				log.Printf("PeerManager: Peer %s already exists!", peerName)
+			if !pm.canDial() {
+				pm.addCandidate(state.peer)
 				break
 			}
-			go connectToPeer(peer, pm.serverChans.conns)
+			log.Printf("PeerManager : Run : Reconnecting to %s, attempt %d", peerName, state.attempts)
+			pm.dial(state.peer)
 		case conn := <-pm.serverChans.conns:
-			if pm.numPeers >= maxPeers {
-				// Not accepting any more peers because we're
-				// at the max
+			if pm.isBanned(remoteIP(conn)) {
+				log.Printf("PeerManager : Rejecting %s, it's banned for sending bad pieces", conn.RemoteAddr())
 				conn.Close()
 				break
 			}
-			peerName := conn.RemoteAddr().String()
-			_, ok := pm.peers[peerName]
-			if ok {
-				log.Printf("PeerManager: Peer %s already exists!", peerName)
+			if pm.ipFilter.get().Blocked(remoteIP(conn)) {
+				log.Printf("PeerManager : Rejecting %s, it's blocked by the IP filter", conn.RemoteAddr())
 				conn.Close()
 				break
 			}
-
-			// Create the Controller->Peer chans struct
-			contTxChans := *NewControllerPeerChans()
-			// Construct the Peer object
-			pm.peers[peerName] = NewPeer(
-				peerName,
-				pm.infoHash,
-				pm.numPieces,
-				pm.pieceLength,
-				pm.totalLength,
-				pm.diskIOChans,
-				contTxChans,
-				pm.peerContChans,
-				pm.peerChans,
-				pm.statsCh)
-
-			// Give the controller the channels that it will use to
-			// transmit messages to this new peer
-			go func() {
-				pm.contChans.newPeer <- PeerComms{peerName: peerName, chans: contTxChans}
-			}()
-			// Associate the connection with the peer object and start the peer
-			pm.peers[peerName].conn = conn
-			go pm.peers[peerName].Run()
-			pm.numPeers += 1
+			if pm.capped(remoteIP(conn)) {
+				conn.Close()
+				break
+			}
+			if pm.numPeers+pm.handshaking >= pm.maxPeers {
+				// Not accepting any more peers because we're
+				// at the max
+				log.Printf("PeerManager : Rejecting %s, at the maximum of %d peers", conn.RemoteAddr(), pm.maxPeers)
+				conn.Close()
+				break
+			}
+			pm.handshaking += 1
+			go pm.receiveHandshake(conn)
+		case inbound := <-pm.peerChans.handshaked:
+			pm.handshaking -= 1
+			if inbound.conn != nil {
+				pm.reachability.inboundHandshake()
+				pm.addPeer(inbound)
+			}
 		case peer := <-pm.peerChans.deadPeer:
 			log.Printf("PeerManager : Deleting peer %s\n", peer)
+			if pm.pex != nil {
+				pm.pex.remove(peer)
+			}
 			// Tell the controller that this peer is dead
 			go func() {
 				pm.contChans.deadPeer <- peer
 			}()
+			if p, ok := pm.peers[peer]; ok && p.sentBadData {
+				pm.recordBadPiece(p)
+			}
+			if p, ok := pm.peers[peer]; ok {
+				pm.leaveHistory(p)
+			}
+			if p, ok := pm.peers[peer]; ok && pm.peerIDs[string(p.peerID)] == peer {
+				// A connection replaced by another to the same
+				// peer isn't reconnected
+				delete(pm.peerIDs, string(p.peerID))
+				pm.reconnectLater(p)
+			}
 			delete(pm.peers, peer)
+			pm.chokeOverrides.disconnected(peer)
 			pm.numPeers -= 1
+			pm.dialCandidates()
+		case <-pm.ipFilter.reloaded():
+			pm.sweepIPFilter()
+		case <-pm.chokeOverrides.changed:
+			for _, p := range pm.peers {
+				select {
+				case p.overrideChanged <- struct{}{}:
+				default:
+					// The peer hasn't applied the last change yet
+				}
+			}
+		case <-evictionTicker.C():
+			pm.evictWorstPeer()
+			pm.reachability.update(pm.clock.Now())
+		case <-pm.reachability.resets:
+			pm.reachability.reset(pm.clock.Now())
+		case reply := <-pm.snapshot:
+			reply <- pm.dumpSwarm()
 		case <-pm.quit:
 			for _, peer := range pm.peers {
 				go peer.Stop()
@@ -0,0 +1,1462 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSwarm is a set of loopback peers that complete the handshake and then
+// keep the connection open without sending anything
+type testSwarm struct {
+	mutex     sync.Mutex
+	accepted  int // connections accepted
+	open      int // connections still open
+	received  int // bytes received after the handshake
+	listeners []*net.TCPListener
+	conns     []*net.TCPConn
+}
+
+func startTestSwarm(t *testing.T, infoHash []byte, numPeers int) *testSwarm {
+	swarm := new(testSwarm)
+	for i := 0; i < numPeers; i++ {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		swarm.listeners = append(swarm.listeners, listener)
+		go func(i int) {
+			for {
+				conn, err := listener.AcceptTCP()
+				if err != nil {
+					return
+				}
+				swarm.mutex.Lock()
+				swarm.accepted++
+				swarm.open++
+				swarm.conns = append(swarm.conns, conn)
+				swarm.mutex.Unlock()
+				go func() {
+					defer func() {
+						swarm.mutex.Lock()
+						swarm.open--
+						swarm.mutex.Unlock()
+					}()
+					defer conn.Close()
+					var handshake Handshake
+					err := binary.Read(conn, binary.BigEndian, &handshake)
+					if err != nil {
+						return
+					}
+					reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+					copy(reply.InfoHash[:], infoHash)
+					copy(reply.PeerID[:], fmt.Sprintf("-XX0001-%012d", i))
+					binary.Write(conn, binary.BigEndian, &reply)
+					buf := make([]byte, 4096)
+					for {
+						n, err := conn.Read(buf)
+						swarm.mutex.Lock()
+						swarm.received += n
+						swarm.mutex.Unlock()
+						if err != nil {
+							return
+						}
+					}
+				}()
+			}
+		}(i)
+	}
+	return swarm
+}
+
+func (swarm *testSwarm) counts() (accepted int, open int) {
+	swarm.mutex.Lock()
+	defer swarm.mutex.Unlock()
+	return swarm.accepted, swarm.open
+}
+
+func (swarm *testSwarm) bytesReceived() int {
+	swarm.mutex.Lock()
+	defer swarm.mutex.Unlock()
+	return swarm.received
+}
+
+func (swarm *testSwarm) close() {
+	for _, listener := range swarm.listeners {
+		listener.Close()
+	}
+}
+
+// disconnect closes every connection accepted so far
+func (swarm *testSwarm) disconnect() {
+	swarm.mutex.Lock()
+	defer swarm.mutex.Unlock()
+	for _, conn := range swarm.conns {
+		conn.Close()
+	}
+	swarm.conns = nil
+}
+
+// Only maxPeers peers are connected at once, and peers with nothing we need
+// are evicted in favour of the peers we haven't connected to
+func TestMaxPeersEviction(t *testing.T) {
+	interval, grace := peerEvictionInterval, peerEvictionGracePeriod
+	peerEvictionInterval, peerEvictionGracePeriod = 20*time.Millisecond, 0
+	defer func() { peerEvictionInterval, peerEvictionGracePeriod = interval, grace }()
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	swarm := startTestSwarm(t, infoHash, 5)
+	defer swarm.close()
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, 3)
+	// Every peer of the swarm is on the loopback address
+	peerManager.ports = NewPortPolicy(nil, nil, 0)
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	for _, listener := range swarm.listeners {
+		addr := listener.Addr().(*net.TCPAddr)
+		trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	// None of the peers have anything we need, so they're evicted until
+	// every peer has been connected to. The last peers are kept once there
+	// are no candidates left.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Peers) > 3 {
+			t.Fatalf("Expected at most %d peers, but got %d", 3, len(dump.Peers))
+		}
+		accepted, open := swarm.counts()
+		if accepted == 5 && open == 3 && dump != nil && len(dump.Peers) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for every peer to be tried, %d connections made and %d open", accepted, open)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if accepted, open := swarm.counts(); accepted != 5 || open != 3 {
+		t.Errorf("Expected no eviction without candidates, but %d connections were made and %d are open", accepted, open)
+	}
+}
+
+// Rates are measured over a window that restarts when the clock jumps, and
+// never divide by less than a second
+func TestPeerStatsRates(t *testing.T) {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	var stats PeerStats
+	stats.resetRates(start)
+	stats.addRead(100 * 1024)
+	stats.addWrite(10 * 1024)
+
+	download, upload, window := stats.rates(start.Add(10 * time.Second))
+	if download != 10*1024 || upload != 1024 || window != 10*time.Second {
+		t.Errorf("Expected rates of %d and %d over %v, but got %.0f and %.0f over %v", 10*1024, 1024, 10*time.Second, download, upload, window)
+	}
+	download, _, _ = stats.rates(start)
+	if download != 100*1024 {
+		t.Errorf("Expected the window to be clamped to a second, but the rate was %.0f", download)
+	}
+	download, _, _ = stats.rates(start.Add(-time.Minute))
+	if download != 100*1024 {
+		t.Errorf("Expected a window from a clock that stepped back to be clamped to a second, but the rate was %.0f", download)
+	}
+
+	resumed := start.Add(2 * time.Hour)
+	stats.resetRates(resumed)
+	stats.addRead(5 * 1024)
+	download, _, window = stats.rates(resumed.Add(5 * time.Second))
+	if download != 1024 || window != 5*time.Second {
+		t.Errorf("Expected a rate of %d over %v after the reset, but got %.0f over %v", 1024, 5*time.Second, download, window)
+	}
+}
+
+// After a 2 hour jump peers are probed with a keepalive rather than
+// disconnected for not having sent anything in that time, and their rates
+// are measured from the jump
+func TestPeersSurviveClockJump(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	swarm := startTestSwarm(t, infoHash, 3)
+	defer swarm.close()
+	clock := newFakeClock()
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.clock = clock
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	for _, listener := range swarm.listeners {
+		addr := listener.Addr().(*net.TCPAddr)
+		trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	// The eviction ticker and a ticker for each peer
+	clock.waitForTimers(t, 4)
+	for i := 0; i < 5; i++ {
+		clock.tick(t, time.Second)
+	}
+
+	received := swarm.bytesReceived()
+	clock.Jump(2 * time.Hour)
+	clock.tick(t, time.Second)
+	// Each peer sends a 4 byte keepalive
+	deadline := time.Now().Add(5 * time.Second)
+	for swarm.bytesReceived() < received+3*4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peers to be probed, %d bytes received", swarm.bytesReceived()-received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		clock.tick(t, time.Second)
+	}
+
+	dump := requestSwarmDump(peerManager.snapshot)
+	if dump == nil || len(dump.Peers) != 3 {
+		t.Fatalf("Expected %d peers to survive the jump, but got %+v", 3, dump)
+	}
+	for _, peer := range dump.Peers {
+		if peer.DownloadRate != 0 {
+			t.Errorf("Expected the rate of %s to be measured from the jump, but it was %.3f bytes/s", peer.Name, peer.DownloadRate)
+		}
+	}
+	if _, open := swarm.counts(); open != 3 {
+		t.Errorf("Expected %d connections to be open, but %d are", 3, open)
+	}
+}
+
+// A peer that drops is reconnected to after 1s, 2s, 4s... up to the maximum
+// delay, and given up on after the maximum number of attempts
+func TestReconnectBackoff(t *testing.T) {
+	minDelay, maxDelay, maxAttempts := reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts
+	reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts = time.Second, 4*time.Second, 5
+	defer func() { reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts = minDelay, maxDelay, maxAttempts }()
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	swarm := startTestSwarm(t, infoHash, 1)
+	clock := newFakeClock()
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.clock = clock
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	addr := swarm.listeners[0].Addr().(*net.TCPAddr)
+	trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	// The eviction ticker and the ticker of the peer
+	clock.waitForTimers(t, 2)
+
+	// The peer drops and refuses every reconnect
+	swarm.close()
+	swarm.disconnect()
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, delay := range expected {
+		scheduled := clock.waitForScheduled(t, i+1)
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump == nil || len(dump.Reconnecting) != 1 || dump.Reconnecting[0].Attempts != i+1 {
+			t.Fatalf("Expected attempt %d to reconnect to be pending, but got %+v", i+1, dump)
+		}
+		if scheduled[i] != delay {
+			t.Fatalf("Expected reconnect %d after %v, but it was scheduled after %v", i+1, delay, scheduled[i])
+		}
+		clock.Advance(delay)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Reconnecting) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peer to be given up on, %+v", dump)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if scheduled := clock.waitForScheduled(t, 0); len(scheduled) != len(expected) {
+		t.Errorf("Expected the peer to be given up on after %d attempts, but got %v", len(expected), scheduled)
+	}
+	if accepted, _ := swarm.counts(); accepted != 1 {
+		t.Errorf("Expected %d connection, but %d were made", 1, accepted)
+	}
+}
+
+// A peer that refuses the connection is retried with backoff, and given up
+// on after maxReconnectAttempts
+func TestDialFailureBackoff(t *testing.T) {
+	minDelay, maxDelay, maxAttempts := reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts
+	reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts = time.Second, 2*time.Second, 3
+	defer func() { reconnectMinDelay, reconnectMaxDelay, maxReconnectAttempts = minDelay, maxDelay, maxAttempts }()
+
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	clock := newFakeClock()
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.clock = clock
+	go peerManager.Run()
+	defer close(peerManager.quit)
+
+	trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	expected := []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}
+	for i, delay := range expected {
+		scheduled := clock.waitForScheduled(t, i+1)
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump == nil || len(dump.Reconnecting) != 1 || dump.Reconnecting[0].Attempts != i+1 || dump.Reconnecting[0].LastError == "" {
+			t.Fatalf("Expected attempt %d to connect to be pending after a failure, but got %+v", i+1, dump)
+		}
+		if scheduled[i] != delay {
+			t.Fatalf("Expected attempt %d after %v, but it was scheduled after %v", i+1, delay, scheduled[i])
+		}
+		clock.Advance(delay)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Reconnecting) == 0 && len(dump.Dialing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peer to be given up on, %+v", dump)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if scheduled := clock.waitForScheduled(t, 0); len(scheduled) != len(expected) {
+		t.Errorf("Expected the peer to be given up on after %d attempts, but got %v", len(expected), scheduled)
+	}
+}
+
+// No more than maxHalfOpen connections are dialed at once, the other peers
+// wait as candidates until a dial finishes
+func TestMaxHalfOpen(t *testing.T) {
+	// Peers that accept the connection but never answer the handshake
+	var listeners []*net.TCPListener
+	accepted := make(chan *net.TCPConn, 10)
+	for i := 0; i < 5; i++ {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		go func() {
+			for {
+				conn, err := listener.AcceptTCP()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+	}
+
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.ports.maxConnsPerIP = 0
+	peerManager.maxHalfOpen = 3
+	go peerManager.Run()
+	defer close(peerManager.quit)
+
+	for _, listener := range listeners {
+		addr := listener.Addr().(*net.TCPAddr)
+		trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	var conns []*net.TCPConn
+	for i := 0; i < peerManager.maxHalfOpen; i++ {
+		select {
+		case conn := <-accepted:
+			conns = append(conns, conn)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for dial %d", i+1)
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatalf("Expected no more than %d dials at once", peerManager.maxHalfOpen)
+	case <-time.After(100 * time.Millisecond):
+	}
+	dump := requestSwarmDump(peerManager.snapshot)
+	if dump == nil || len(dump.Dialing) != peerManager.maxHalfOpen {
+		t.Fatalf("Expected %d peers to be connecting, but got %+v", peerManager.maxHalfOpen, dump)
+	}
+
+	// A failed handshake makes room for a candidate
+	conns[0].Close()
+	select {
+	case conn := <-accepted:
+		conns = append(conns, conn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a candidate to be dialed")
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// startBadPeer starts a loopback peer that has every one of numPieces pieces,
+// unchokes us and answers every request with a block of zeros. It returns
+// the listener and a function returning the connections accepted.
+func startBadPeer(t *testing.T, infoHash []byte, numPieces int) (*net.TCPListener, func() int) {
+	return startServingPeer(t, infoHash, numPieces, func(pieceNum, begin, length int) []byte {
+		return make([]byte, length)
+	})
+}
+
+// startServingPeer starts a loopback peer that has every one of numPieces
+// pieces, unchokes us and answers every request with the block returned by
+// block. It returns the listener and a function returning the connections
+// accepted.
+func startServingPeer(t *testing.T, infoHash []byte, numPieces int, block func(pieceNum, begin, length int) []byte) (*net.TCPListener, func() int) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	accepted := 0
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			accepted++
+			mutex.Unlock()
+			go func() {
+				defer conn.Close()
+				var handshake Handshake
+				err := binary.Read(conn, binary.BigEndian, &handshake)
+				if err != nil {
+					return
+				}
+				reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+				copy(reply.InfoHash[:], infoHash)
+				copy(reply.PeerID[:], "-XX0001-testseed0000")
+				binary.Write(conn, binary.BigEndian, &reply)
+
+				bitfield := make([]bool, numPieces)
+				for i := range bitfield {
+					bitfield[i] = true
+				}
+				payload := append([]byte{byte(MsgBitfield)}, convertBoolSliceToByteSlice(bitfield)...)
+				binary.Write(conn, binary.BigEndian, uint32(len(payload)))
+				conn.Write(payload)
+				conn.Write([]byte{0, 0, 0, 1, byte(MsgUnchoke)})
+
+				for {
+					var length uint32
+					err := binary.Read(conn, binary.BigEndian, &length)
+					if err != nil {
+						return
+					}
+					message := make([]byte, length)
+					_, err = io.ReadFull(conn, message)
+					if err != nil {
+						return
+					}
+					if length != 13 || int(message[0]) != MsgRequest {
+						continue
+					}
+					data := block(int(binary.BigEndian.Uint32(message[1:5])), int(binary.BigEndian.Uint32(message[5:9])), int(binary.BigEndian.Uint32(message[9:13])))
+					binary.Write(conn, binary.BigEndian, uint32(9+len(data)))
+					conn.Write(append([]byte{byte(MsgBlock)}, message[1:9]...))
+					conn.Write(data)
+				}
+			}()
+		}
+	}()
+	return listener, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return accepted
+	}
+}
+
+// A peer that keeps sending bad pieces is banned after maxBadPieces, and
+// isn't connected to again
+func TestBanBadPeer(t *testing.T) {
+	defer func(max int) { maxBadPieces = max }(maxBadPieces)
+	maxBadPieces = 2
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := downloadBlockSize
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	listener, accepted := startBadPeer(t, infoHash, pieceHashes.Len())
+	defer listener.Close()
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	tuple := PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	// The tracker hands out the peer again after each disconnect
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Banned) > 0 {
+			if dump.Banned[0] != "127.0.0.1" {
+				t.Errorf("Expected 127.0.0.1 to be banned, but got %v", dump.Banned)
+			}
+			break
+		}
+		if dump != nil && len(dump.Peers) == 0 && len(dump.Dialing) == 0 {
+			trackerManager.peerChans.peers <- tuple
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peer to be banned, %d connections made", accepted())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := accepted(); n != maxBadPieces {
+		t.Errorf("Expected the peer to be banned after %d connections, but %d were made", maxBadPieces, n)
+	}
+
+	trackerManager.peerChans.peers <- tuple
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted(); n != maxBadPieces {
+		t.Errorf("Expected a banned peer not to be connected to again, but %d connections were made", n)
+	}
+}
+
+// Once the handshake completes, our bitfield is the first message sent, and
+// no bitfield is sent if we have no pieces
+func TestSendBitfieldAfterHandshake(t *testing.T) {
+	tests := []struct {
+		finished []int
+		expected []byte
+	}{
+		{[]int{0, 2, 5}, []byte{0, 0, 0, 3, byte(MsgBitfield), 0xa4, 0x00}},
+		{nil, nil},
+	}
+	numPieces := 10
+	pieceLength := 1024
+	for _, test := range tests {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoHash := make([]byte, 20)
+		finishedPieces := make([]bool, numPieces)
+		for _, pieceNum := range test.finished {
+			finishedPieces[pieceNum] = true
+		}
+		trackerManager := NewTrackerManager(6881)
+		peerManager := NewPeerManager(infoHash, numPieces, pieceLength, numPieces*pieceLength, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+		controller := NewController(finishedPieces, PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, peerManager.contChans, peerManager.peerContChans)
+		go controller.Run()
+		go peerManager.Run()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var handshake Handshake
+		err = binary.Read(conn, binary.BigEndian, &handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+		copy(reply.InfoHash[:], infoHash)
+		copy(reply.PeerID[:], "-XX0001-testpeer0000")
+		binary.Write(conn, binary.BigEndian, &reply)
+
+		if test.expected == nil {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			message := make([]byte, 5)
+			if n, err := conn.Read(message); err == nil {
+				t.Errorf("Expected nothing to be sent without pieces, but got %x", message[:n])
+			}
+		} else {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			message := make([]byte, len(test.expected))
+			_, err = io.ReadFull(conn, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(message, test.expected) {
+				t.Errorf("Expected bitfield %x to be sent first for pieces %v, but got %x", test.expected, test.finished, message)
+			}
+		}
+		conn.Close()
+		listener.Close()
+		close(peerManager.quit)
+		close(controller.quit)
+	}
+}
+
+// A piece completed while peers are connected is announced on the wire to
+// each of them with a HAVE, and a peer connecting afterwards gets it in its
+// bitfield
+func TestBroadcastHaveOnWire(t *testing.T) {
+	numPieces := 10
+	pieceLength := 1024
+	infoHash := make([]byte, 20)
+	finishedPieces := make([]bool, numPieces)
+	finishedPieces[0] = true
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, numPieces, pieceLength, numPieces*pieceLength, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	diskIOChans := ControllerDiskIOChans{receivedPiece: make(chan ReceivedPiece)}
+	controller := NewController(finishedPieces, PieceHashes(make([]byte, numPieces*sha1.Size)), diskIOChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	// connect has the PeerManager dial a listening peer, completes the
+	// handshake and returns the connection once the first message, our
+	// bitfield, has been read
+	connected := 0
+	connect := func(expected []byte) *net.TCPConn {
+		connected++
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		addr := listener.Addr().(*net.TCPAddr)
+		trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var handshake Handshake
+		if err := binary.Read(conn, binary.BigEndian, &handshake); err != nil {
+			t.Fatal(err)
+		}
+		reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+		copy(reply.InfoHash[:], infoHash)
+		copy(reply.PeerID[:], fmt.Sprintf("-XX0001-testpeer%04d", connected))
+		binary.Write(conn, binary.BigEndian, &reply)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		message := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, message); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("Expected bitfield %x, but got %x", expected, message)
+		}
+		return conn
+	}
+
+	conns := []*net.TCPConn{
+		connect([]byte{0, 0, 0, 3, byte(MsgBitfield), 0x80, 0x00}),
+		connect([]byte{0, 0, 0, 3, byte(MsgBitfield), 0x80, 0x00}),
+	}
+	diskIOChans.receivedPiece <- ReceivedPiece{pieceNum: 2, peerName: importPeerName}
+	expected := NewHave(2).Bytes()
+	for i, conn := range conns {
+		// Within a tick of the peer's Run loop
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		message := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, message); err != nil {
+			t.Fatalf("Expected a HAVE on connection %d: %s", i, err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("Expected HAVE %x on connection %d, but got %x", expected, i, message)
+		}
+		conn.Close()
+	}
+	connect([]byte{0, 0, 0, 3, byte(MsgBitfield), 0xa0, 0x00}).Close()
+}
+
+// A peer that has sent nothing for keepaliveInterval is sent a keepalive,
+// before the idle timeout, and a peer that is silent for peerIdleTimeout is
+// dropped
+func TestPeerKeepaliveAndIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	deadPeer := make(chan string, 1)
+	contRxChans := ControllerPeerChans{havePiece: make(chan chan HavePiece, 1)}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, contRxChans, PeerControllerChans{}, peerManagerChans{deadPeer: deadPeer}, make(chan peerStatsSnapshot, 1000), clock)
+	p.conn = local
+	haves := make(chan HavePiece)
+	close(haves)
+	contRxChans.havePiece <- haves
+	go p.Run()
+
+	// Messages received by the remote end, closed when the connection is
+	received := make(chan []byte, 10)
+	go func() {
+		defer close(received)
+		for {
+			var length uint32
+			err := binary.Read(remote, binary.BigEndian, &length)
+			if err != nil {
+				return
+			}
+			message := make([]byte, length)
+			_, err = io.ReadFull(remote, message)
+			if err != nil {
+				return
+			}
+			received <- message
+		}
+	}()
+
+	clock.waitForTimers(t, 1)
+	for elapsed := time.Duration(0); elapsed <= keepaliveInterval; elapsed += time.Second {
+		clock.tick(t, time.Second)
+	}
+	select {
+	case message := <-received:
+		if len(message) != 0 {
+			t.Errorf("Expected a keepalive, but got %x", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a keepalive after %v", keepaliveInterval)
+	}
+	if len(deadPeer) != 0 {
+		t.Fatalf("Expected the peer not to be dropped before %v", peerIdleTimeout)
+	}
+
+	for elapsed := keepaliveInterval + time.Second; elapsed <= peerIdleTimeout; elapsed += time.Second {
+		clock.tick(t, time.Second)
+	}
+	select {
+	case peerName := <-deadPeer:
+		if peerName != p.peerName {
+			t.Errorf("Expected %s to be dropped, but got %s", p.peerName, peerName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the silent peer to be dropped after %v", peerIdleTimeout)
+	}
+	// Another keepalive may be sent while the first is being written
+	for message := range received {
+		if len(message) != 0 {
+			t.Errorf("Expected only keepalives to be sent, but got %x", message)
+		}
+	}
+}
+
+// A silent peer is dropped by the read deadline even if the clock of the
+// idle timeout stalls, and once it's stopped the writer returns and messages
+// sent to it are dropped rather than blocking their senders
+func TestPeerReadDeadline(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	deadPeer := make(chan string, 1)
+	contRxChans := ControllerPeerChans{havePiece: make(chan chan HavePiece, 1)}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, contRxChans, PeerControllerChans{}, peerManagerChans{deadPeer: deadPeer}, make(chan peerStatsSnapshot, 1000), newFakeClock())
+	p.conn = local
+	p.readTimeout = 100 * time.Millisecond
+	haves := make(chan HavePiece)
+	close(haves)
+	contRxChans.havePiece <- haves
+	go io.Copy(ioutil.Discard, remote)
+	go p.Run()
+
+	select {
+	case <-deadPeer:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the silent peer to be dropped after %v", p.readTimeout)
+	}
+	sent := make(chan struct{})
+	go func() {
+		p.sendMessage(NewKeepalive())
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message to the stopped peer to be dropped")
+	}
+}
+
+// Snapshots of the peer's stats reach Stats in order, a newer snapshot
+// replacing one Stats hasn't taken yet
+func TestPeerStatsInOrder(t *testing.T) {
+	clock := newFakeClock()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+	statsCh := make(chan peerStatsSnapshot)
+	contRxChans := ControllerPeerChans{havePiece: make(chan chan HavePiece, 1)}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, contRxChans, PeerControllerChans{}, peerManagerChans{deadPeer: make(chan string, 1)}, statsCh, clock)
+	p.conn = local
+	haves := make(chan HavePiece)
+	close(haves)
+	contRxChans.havePiece <- haves
+	go p.Run()
+	defer p.Stop()
+
+	clock.waitForTimers(t, 1)
+	for i := 0; i < 3; i++ {
+		p.stats.addRead(100)
+		clock.tick(t, time.Second)
+	}
+	// Run took the last tick, so the next snapshot it sends is taken
+	// after it
+	select {
+	case stats := <-statsCh:
+		if stats.read != 300 {
+			t.Errorf("Expected the latest snapshot of %d bytes read, but got %d", 300, stats.read)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a snapshot of the stats")
+	}
+	select {
+	case stats := <-statsCh:
+		t.Errorf("Expected older snapshots to be replaced, but got one of %d bytes read", stats.read)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Requests from a peer are answered with the block read from disk only while
+// the peer is unchoked and interested
+func TestServeBlockRequests(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	contRxChans := ControllerPeerChans{havePiece: make(chan chan HavePiece, 1)}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 2, pieceLength, len(data), diskio.peerChans, contRxChans, PeerControllerChans{}, peerManagerChans{deadPeer: make(chan string, 1)}, make(chan peerStatsSnapshot, 1000), systemClock)
+	p.conn = local
+	haves := make(chan HavePiece, 2)
+	haves <- HavePiece{pieceNum: 0}
+	haves <- HavePiece{pieceNum: 1}
+	close(haves)
+	contRxChans.havePiece <- haves
+	go p.Run()
+	defer p.Stop()
+
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			var length uint32
+			if binary.Read(remote, binary.BigEndian, &length) != nil {
+				return
+			}
+			message := make([]byte, length)
+			if _, err := io.ReadFull(remote, message); err != nil {
+				return
+			}
+			if length > 0 && int(message[0]) != MsgBitfield {
+				received <- message
+			}
+		}
+	}()
+	send := func(messageID int, payload ...uint32) {
+		message := []byte{0, 0, 0, byte(1 + 4*len(payload)), byte(messageID)}
+		for _, value := range payload {
+			message = append(message, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(message[len(message)-4:], value)
+		}
+		remote.Write(message)
+	}
+	expect := func(messageID int) []byte {
+		select {
+		case message := <-received:
+			if int(message[0]) != messageID {
+				t.Fatalf("Expected message %d, but got %x", messageID, message)
+			}
+			return message[1:]
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d", messageID)
+		}
+		return nil
+	}
+
+	// Choked, so the request is dropped
+	send(MsgRequest, 1, 0, 16)
+	select {
+	case message := <-received:
+		t.Fatalf("Expected the request of a choked peer to be ignored, but got %x", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	send(MsgInterested)
+	expect(MsgUnchoke)
+	send(MsgRequest, 1, 16, 32)
+	block := expect(MsgBlock)
+	expected := append([]byte{0, 0, 0, 1, 0, 0, 0, 16}, data[pieceLength+16:pieceLength+48]...)
+	if !bytes.Equal(block, expected) {
+		t.Errorf("Expected block %x, but got %x", expected, block)
+	}
+}
+
+// decodeTestCapture feeds a capture of the messages a peer sent, each
+// prefixed by its length as on the wire, to p
+func decodeTestCapture(t *testing.T, p *Peer, capture []byte) {
+	for len(capture) > 0 {
+		length := int(binary.BigEndian.Uint32(capture))
+		if 4+length > len(capture) {
+			t.Fatalf("Truncated message of length %d in capture", length)
+		}
+		p.decodeMessage(capture[4 : 4+length])
+		capture = capture[4+length:]
+	}
+}
+
+// The first messages of a peer are accepted in the orders clients send them,
+// and each piece it has is announced to the controller once
+func TestPeerMessageOrder(t *testing.T) {
+	const numPieces = 10
+	haveNone := []byte{0, 0, 0, 1, byte(MsgHaveNone)}
+	haveAll := []byte{0, 0, 0, 1, byte(MsgHaveAll)}
+	bitfield := []byte{0, 0, 0, 3, byte(MsgBitfield), 0xa4, 0x00} // pieces 0, 2 and 5
+	extended := append([]byte{0, 0, 0, 26, byte(MsgExtended), 0}, "d1:md11:ut_metadatai1eee"...)
+	have := func(pieceNum byte) []byte {
+		return []byte{0, 0, 0, 5, byte(MsgHave), 0, 0, 0, pieceNum}
+	}
+	request := []byte{0, 0, 0, 13, byte(MsgRequest), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0}
+	join := func(messages ...[]byte) []byte {
+		return bytes.Join(messages, nil)
+	}
+	tests := []struct {
+		name      string
+		capture   []byte
+		expected  []int
+		violation bool
+	}{
+		{"bitfield first", join(bitfield, extended), []int{0, 2, 5}, false},
+		{"extended handshake first", join(extended, bitfield), []int{0, 2, 5}, false},
+		{"haves before bitfield", join(have(2), extended, have(9), bitfield), []int{0, 2, 5, 9}, false},
+		{"no bitfield", join(extended, have(3)), []int{3}, false},
+		{"have none then haves", join(haveNone, have(1), have(4)), []int{1, 4}, false},
+		{"have after have none", join(have(7), haveNone), []int{7}, false},
+		{"have all", join(extended, haveAll), []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, false},
+		{"bitfield after request", join(have(8), request, bitfield), []int{8}, true},
+		{"bitfield too short", join(have(8), []byte{0, 0, 0, 2, byte(MsgBitfield), 0xa4}), []int{8}, true},
+		{"bitfield spare bits", join(have(8), []byte{0, 0, 0, 3, byte(MsgBitfield), 0xa4, 0x01}), []int{8}, true},
+	}
+	for _, test := range tests {
+		contChans := PeerControllerChans{havePiece: make(chan chan HavePiece)}
+		p := NewPeer("10.0.0.1:6881", make([]byte, 20), numPieces, 16384, numPieces*16384, diskIOPeerChans{}, ControllerPeerChans{}, contChans, peerManagerChans{}, nil, systemClock)
+		announced := make([]int, numPieces)
+		decodeTestCapture(t, p, test.capture)
+		// Wait for every announcement, and then for any duplicates
+		timeout := time.After(time.Second)
+		for done := false; !done; {
+			select {
+			case innerChan := <-contChans.havePiece:
+				for havePiece := range innerChan {
+					announced[havePiece.pieceNum]++
+				}
+			case <-timeout:
+				done = true
+			}
+			if !done {
+				count := 0
+				for _, n := range announced {
+					count += n
+				}
+				if count >= len(test.expected) {
+					timeout = time.After(50 * time.Millisecond)
+				}
+			}
+		}
+
+		expected := make([]int, numPieces)
+		for _, pieceNum := range test.expected {
+			expected[pieceNum] = 1
+		}
+		for pieceNum, n := range announced {
+			if n != expected[pieceNum] || p.peerBitfield[pieceNum] != (expected[pieceNum] == 1) {
+				t.Errorf("%s: Expected piece %d to be announced %d times, but it was announced %d times and is %t in the bitfield", test.name, pieceNum, expected[pieceNum], n, p.peerBitfield[pieceNum])
+			}
+		}
+		select {
+		case <-p.stopping:
+			if !test.violation {
+				t.Errorf("%s: Expected the peer to be kept", test.name)
+			}
+		default:
+			if test.violation {
+				t.Errorf("%s: Expected the peer to be dropped", test.name)
+			}
+		}
+	}
+}
+
+// A piece is hashed as its blocks arrive, whether they arrive in order or
+// not, and its hash is the same either way
+func TestPieceDownloadHash(t *testing.T) {
+	const pieceLength = 4 * downloadBlockSize
+	data := createTestPayload(2, pieceLength)[:pieceLength+1000]
+	tests := []struct {
+		pieceNum int
+		order    []int
+		trusted  bool
+	}{
+		{0, []int{0, 1, 2, 3}, false},
+		{0, []int{3, 2, 1, 0}, false},
+		{0, []int{0, 2, 3, 1}, false},
+		{1, []int{0}, false},
+		{0, []int{1, 0, 3, 2}, true},
+	}
+	for _, test := range tests {
+		p := NewPeer("10.0.0.1:6881", make([]byte, 20), 2, pieceLength, len(data), diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+		if test.trusted {
+			p.verification = TrustedVerification([]string{"10.0.0.1"})
+		}
+		pieceData := data[test.pieceNum*pieceLength:]
+		if len(pieceData) > pieceLength {
+			pieceData = pieceData[:pieceLength]
+		}
+		expected := sha1.Sum(pieceData)
+		p.initializePieceDownload(RequestPiece{pieceNum: test.pieceNum, expectedHash: string(expected[:])})
+		piece := p.downloads[0]
+		if (piece.hash == nil) != test.trusted {
+			t.Errorf("Order %v: Expected a running hash only for pieces that are hashed", test.order)
+		}
+
+		for _, blockNum := range test.order {
+			begin := blockNum * downloadBlockSize
+			end := begin + downloadBlockSize
+			if end > len(pieceData) {
+				end = len(pieceData)
+			}
+			piece.receiveBlock(blockNum, pieceData[begin:end])
+			contiguous := 0
+			for contiguous < piece.numBlocksInPiece && piece.blocksReceived[contiguous] {
+				contiguous++
+			}
+			if !test.trusted && piece.hashedBlocks != contiguous {
+				t.Errorf("Order %v: Expected %d blocks to be hashed after block %d, but %d were", test.order, contiguous, blockNum, piece.hashedBlocks)
+			}
+		}
+		if sum := piece.sum(); !bytes.Equal(sum, expected[:]) {
+			t.Errorf("Order %v: Expected piece %d to hash to %x, but got %x", test.order, test.pieceNum, expected, sum)
+		}
+		if hashed, good := p.verification.verifySum(p.peerName, p.peerID, piece.sum, piece.expectedHash); !good || hashed == test.trusted {
+			t.Errorf("Order %v: Expected the piece to be verified, but got hashed %t, good %t", test.order, hashed, good)
+		}
+	}
+}
+
+// Handshakes are exchanged in both directions, and invalid or incomplete
+// ones are rejected
+func TestExchangeHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	remoteHandshake := func(infoHash []byte) []byte {
+		handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+		handshake.Reserved[5] = 0x10 // extension protocol
+		copy(handshake.InfoHash[:], infoHash)
+		copy(handshake.PeerID[:], "-XX0001-testpeer0000")
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, &handshake)
+		return b.Bytes()
+	}
+	good := remoteHandshake(infoHash)
+	tests := []struct {
+		name     string
+		outbound bool
+		sent     []byte // sent by the remote side, nil for nothing
+		valid    bool
+	}{
+		{"outbound", true, good, true},
+		{"inbound", false, good, true},
+		{"wrong infohash", false, remoteHandshake(bytes.Repeat([]byte{0xcd}, 20)), false},
+		{"wrong infohash outbound", true, remoteHandshake(bytes.Repeat([]byte{0xcd}, 20)), false},
+		{"short read", false, good[:30], false},
+		{"garbage", false, bytes.Repeat([]byte{0x42}, len(good)), false},
+		{"timeout", false, nil, false},
+	}
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		received := make(chan []byte, 1)
+		go func() {
+			defer remote.Close()
+			ours := make([]byte, len(good))
+			if test.outbound {
+				if _, err := io.ReadFull(remote, ours); err != nil {
+					received <- nil
+					return
+				}
+			}
+			if test.sent == nil {
+				received <- nil
+				ioutil.ReadAll(remote)
+				return
+			}
+			remote.Write(test.sent)
+			if len(test.sent) < len(good) {
+				received <- nil
+				return
+			}
+			if !test.outbound {
+				if _, err := io.ReadFull(remote, ours); err != nil {
+					ours = nil
+				}
+			}
+			received <- ours
+		}()
+
+		handshake, err := exchangeHandshake(local, infoHash, localReserved(false), test.outbound, 200*time.Millisecond)
+		local.Close()
+		ours := <-received
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: Expected the handshake to succeed, but got %s", test.name, err)
+			}
+			if string(handshake.PeerID[:]) != "-XX0001-testpeer0000" || handshake.Reserved[5] != 0x10 {
+				t.Errorf("%s: Expected the peer ID and reserved bytes of the peer, but got %+v", test.name, handshake)
+			}
+			if !bytes.Equal(ours[28:48], infoHash) {
+				t.Errorf("%s: Expected our handshake to be sent with the infohash, but got %x", test.name, ours)
+			}
+		} else if err == nil {
+			t.Errorf("%s: Expected the handshake to be rejected", test.name)
+		} else if !test.outbound && ours != nil {
+			t.Errorf("%s: Expected our handshake not to be sent for a rejected one", test.name)
+		}
+	}
+}
+
+// startInterestTestPeer returns a peer of a 4 piece torrent with its writer
+// on a pipe, and a channel receiving the ID of each message on the wire
+// other than HAVE
+func startInterestTestPeer(t *testing.T) (*Peer, chan int) {
+	local, remote := net.Pipe()
+	contChans := PeerControllerChans{havePiece: make(chan chan HavePiece)}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, ControllerPeerChans{}, contChans, peerManagerChans{deadPeer: make(chan string, 1)}, nil, systemClock)
+	p.conn = local
+	go func() {
+		// The controller takes the peer's pieces
+		for {
+			select {
+			case innerChan := <-contChans.havePiece:
+				for range innerChan {
+				}
+			case <-p.stopping:
+				return
+			}
+		}
+	}()
+	messages := make(chan int, 100)
+	go func() {
+		defer remote.Close()
+		for {
+			var length uint32
+			if err := binary.Read(remote, binary.BigEndian, &length); err != nil {
+				return
+			}
+			message := make([]byte, length)
+			if _, err := io.ReadFull(remote, message); err != nil {
+				return
+			}
+			if length > 0 && int(message[0]) != MsgHave {
+				messages <- int(message[0])
+			}
+		}
+	}()
+	return p, messages
+}
+
+// expectMessages checks that the messages on the wire are the expected ones,
+// once nothing more arrives for a while
+func expectMessages(t *testing.T, step string, messages chan int, expected ...int) {
+	var received []int
+	for {
+		select {
+		case id := <-messages:
+			received = append(received, id)
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("%s: Expected the messages %v on the wire, but got %v", step, expected, received)
+	}
+}
+
+// We're interested in a peer while it has a piece we need, and tell it only
+// when that changes, whether the peer gained the piece or we completed or
+// lost it. The peer's interest in us is tracked, and unchokes it.
+func TestInterestStateMachine(t *testing.T) {
+	p, messages := startInterestTestPeer(t)
+	defer p.Stop()
+	p.updateOurBitfield([]HavePiece{{pieceNum: 0}})
+	go p.writer()
+
+	have := func(pieceNum byte) func() {
+		return func() { p.decodeMessage([]byte{byte(MsgHave), 0, 0, 0, pieceNum}) }
+	}
+	ours := func(pieceNum int, lost bool) func() {
+		return func() { p.ourPiecesChanged([]HavePiece{{pieceNum: pieceNum, lost: lost}}) }
+	}
+	steps := []struct {
+		name           string
+		action         func()
+		amInterested   bool
+		peerInterested bool
+		expected       []int
+	}{
+		{"peer has a piece we have", have(0), false, false, nil},
+		{"peer has a piece we need", have(1), true, false, []int{MsgInterested}},
+		{"peer has another piece we need", have(2), true, false, nil},
+		{"we complete a piece, still needing one", ours(1, false), true, false, nil},
+		{"we complete the last piece we need", ours(2, false), false, false, []int{MsgNotInterested}},
+		{"we complete a piece the peer doesn't have", ours(3, false), false, false, nil},
+		{"we lose a piece the peer has", ours(1, true), true, false, []int{MsgInterested}},
+		{"we lose a piece the peer doesn't have", ours(3, true), true, false, nil},
+		{"we complete the piece again", ours(1, false), false, false, []int{MsgNotInterested}},
+		{"peer has every piece", func() { p.decodeMessage([]byte{byte(MsgHaveAll)}) }, true, false, []int{MsgInterested}},
+		{"peer is interested", func() { p.decodeMessage([]byte{byte(MsgInterested)}) }, true, true, []int{MsgUnchoke}},
+		{"peer is interested again", func() { p.decodeMessage([]byte{byte(MsgInterested)}) }, true, true, nil},
+		{"peer is not interested", func() { p.decodeMessage([]byte{byte(MsgNotInterested)}) }, true, false, []int{MsgChoke}},
+		{"we complete every piece", ours(3, false), false, false, []int{MsgNotInterested}},
+	}
+	for _, step := range steps {
+		step.action()
+		if p.amInterested != step.amInterested || p.peerInterested != step.peerInterested {
+			t.Errorf("%s: Expected interested %t and the peer interested %t, but they were %t and %t", step.name, step.amInterested, step.peerInterested, p.amInterested, p.peerInterested)
+		}
+		expectMessages(t, step.name, messages, step.expected...)
+	}
+}
+
+// A change of interest undone before the writer sends it isn't sent at all,
+// and a peer seeding from read-only storage is never interested
+func TestInterestNotSent(t *testing.T) {
+	p, messages := startInterestTestPeer(t)
+	defer p.Stop()
+	p.decodeMessage([]byte{byte(MsgHave), 0, 0, 0, 1})
+	p.ourPiecesChanged([]HavePiece{{pieceNum: 1}})
+	go p.writer()
+	expectMessages(t, "interest undone before it was sent", messages)
+
+	p, messages = startInterestTestPeer(t)
+	defer p.Stop()
+	p.uploadOnly = true
+	go p.writer()
+	p.decodeMessage([]byte{byte(MsgHaveAll)})
+	if p.amInterested {
+		t.Errorf("Expected an upload only peer not to be interested")
+	}
+	expectMessages(t, "upload only", messages)
+}
+
+// startRequestTestPeer returns a peer of a torrent of two blocks per piece
+// with its writer on a pipe, a channel receiving its choke statuses and one
+// receiving the block of each request on the wire. The writer isn't started.
+func startRequestTestPeer(t *testing.T) (*Peer, chan PeerChokeStatus, chan string) {
+	local, remote := net.Pipe()
+	statuses := make(chan PeerChokeStatus, 10)
+	contChans := PeerControllerChans{chokeStatus: statuses}
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 2, 2*downloadBlockSize, 4*downloadBlockSize, diskIOPeerChans{}, ControllerPeerChans{}, contChans, peerManagerChans{deadPeer: make(chan string, 1)}, nil, systemClock)
+	p.conn = local
+	requests := make(chan string, 100)
+	go func() {
+		defer remote.Close()
+		for {
+			m, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			if m.ID == MsgRequest && !m.Keepalive {
+				index, begin, _, _ := ParseRequest(m.Payload)
+				requests <- fmt.Sprintf("%x:%x", index, begin)
+			}
+		}
+	}()
+	return p, statuses, requests
+}
+
+// expectRequests checks that the blocks requested on the wire are the
+// expected ones, in any order, once nothing more arrives for a while
+func expectRequests(t *testing.T, step string, requests chan string, expected ...string) {
+	var received []string
+	for {
+		select {
+		case request := <-requests:
+			received = append(received, request)
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	sort.Strings(received)
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("%s: Expected requests for the blocks %v on the wire, but got %v", step, expected, received)
+	}
+}
+
+// Requests are only sent while the peer unchokes us. A choke voids those
+// already made, whether or not they reached the wire, and pieces given
+// before it are dropped, so that after the next unchoke each block is
+// requested again exactly once.
+func TestChokeVoidsRequests(t *testing.T) {
+	p, statuses, requests := startRequestTestPeer(t)
+	defer p.Stop()
+	give := func(unchokes int) {
+		p.startPieceDownload(RequestPiece{pieceNum: 0, unchokes: unchokes})
+	}
+	receive := func(messageID int, isChoked bool) {
+		p.decodeMessage([]byte{byte(messageID)})
+		select {
+		case status := <-statuses:
+			if status.isChoked != isChoked {
+				t.Errorf("Expected the controller to be told choked %t, but got %+v", isChoked, status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the controller to be told choked %t", isChoked)
+		}
+	}
+
+	// Choked before the writer sends the requests of the first unchoke,
+	// given a piece before the controller learns of the choke, then
+	// unchoked again before a piece of the first unchoke arrives
+	give(0)
+	receive(MsgUnchoke, false)
+	give(1)
+	receive(MsgChoke, true)
+	give(1)
+	receive(MsgUnchoke, false)
+	give(1)
+	go p.writer()
+	expectRequests(t, "voided before the wire", requests)
+	give(2)
+	expectRequests(t, "second unchoke", requests, "0:0", "0:4000")
+	give(2)
+	expectRequests(t, "piece given twice", requests)
+
+	// Choked once the requests are on the wire
+	receive(MsgChoke, true)
+	p.decodeMessage([]byte{byte(MsgChoke)})
+	expectRequests(t, "choked", requests)
+	if len(statuses) != 0 {
+		t.Errorf("Expected the controller not to be told of a choke while choked")
+	}
+	if p.totalOutstandingBlocks() != 0 || p.haveCurrentDownloads() {
+		t.Errorf("Expected no outstanding blocks nor downloads once choked, but got %d blocks", p.totalOutstandingBlocks())
+	}
+	receive(MsgUnchoke, false)
+	give(3)
+	expectRequests(t, "third unchoke", requests, "0:0", "0:4000")
+}
+
+// Only blocks requested of a piece being downloaded are added to it, others
+// are discarded and counted. A completed piece is handed to DiskIO tagged
+// with the peer, and later copies of its blocks are discarded quietly.
+func TestReceiveBlocks(t *testing.T) {
+	p, statuses, requests := startRequestTestPeer(t)
+	defer p.Stop()
+	pieces := make(chan Piece, 1)
+	p.diskIOChans.writePiece = pieces
+	p.requestDepth = 1
+	go p.writer()
+	p.decodeMessage([]byte{byte(MsgUnchoke)})
+	<-statuses
+
+	data := createTestPayload(1, 2*downloadBlockSize)
+	expected := sha1.Sum(data)
+	p.startPieceDownload(RequestPiece{pieceNum: 0, expectedHash: string(expected[:]), unchokes: p.unchokes})
+	expectRequests(t, "first block", requests, "0:0")
+	receive := func(blockNum int, length int, blocks int, discarded int) {
+		begin := blockNum * downloadBlockSize
+		message := NewPiece(0, uint32(begin), data[begin:begin+length])
+		p.decodeMessage(append([]byte{byte(MsgBlock)}, message.Payload...))
+		if stats := p.stats.snapshot(); stats.blocks != blocks || stats.discardedBlocks != discarded {
+			t.Errorf("Expected %d blocks and %d discarded after block %d[%x], but got %d and %d", blocks, discarded, blockNum, length, stats.blocks, stats.discardedBlocks)
+		}
+	}
+
+	receive(1, downloadBlockSize, 0, 1)   // not requested yet
+	receive(0, downloadBlockSize-1, 0, 2) // too short
+	receive(0, downloadBlockSize, 1, 2)
+	expectRequests(t, "pipeline refilled", requests, "0:4000")
+	receive(0, downloadBlockSize, 1, 3) // received twice
+	receive(1, downloadBlockSize, 2, 3)
+	select {
+	case piece := <-pieces:
+		if piece.index != 0 || piece.peerName != p.peerName || !bytes.Equal(piece.data, data) || piece.duplicateBlocks != 1 {
+			t.Errorf("Expected piece 0 from %s with 1 duplicate block, but got piece %d from %s with %d", p.peerName, piece.index, piece.peerName, piece.duplicateBlocks)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the completed piece to be sent to DiskIO")
+	}
+	receive(1, downloadBlockSize, 2, 4) // late, as in endgame
+	if p.stats.snapshot().errors != 0 || p.totalOutstandingBlocks() != 0 {
+		t.Errorf("Expected no errors nor outstanding blocks once the piece completed")
+	}
+	select {
+	case <-p.stopping:
+		t.Errorf("Expected the peer to stay connected")
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+const (
+	// Blocks a peer may be assigned across every piece it's working on, as
+	// a multiple of the blocks it keeps requested at once. Bounds the work
+	// lost when a fast peer disconnects.
+	assignedBlockDepths = 2
+	// Extra blocks a peer may be assigned for a piece another peer is
+	// already working on, at the end of the download
+	endgameBlockAllowance = defaultRequestDepth
+	// Pieces a peer may work on that other peers are working on too, so
+	// that duplicate requests are spread across peers
+	maxDuplicatesPerPeer = 2
+)
+
+// pieceBlocks returns the number of blocks in a piece, 0 if the piece length
+// isn't known
+func (cont *Controller) pieceBlocks(pieceNum int) int {
+	if cont.pieceLength <= 0 {
+		return 0
+	}
+	length := cont.pieceLength
+	if pieceNum == len(cont.finishedPieces)-1 && cont.totalLength%cont.pieceLength != 0 {
+		length = cont.totalLength % cont.pieceLength
+	}
+	return (length + downloadBlockSize - 1) / downloadBlockSize
+}
+
+// assignedBlocks returns the number of blocks in the pieces a peer is working
+// on
+func (cont *Controller) assignedBlocks(peerInfo *PeerInfo) int {
+	blocks := 0
+	for pieceNum := range peerInfo.activeRequests {
+		blocks += cont.pieceBlocks(pieceNum)
+	}
+	return blocks
+}
+
+// heldDuplicates returns the number of pieces a peer is working on that
+// other peers are working on too
+func (cont *Controller) heldDuplicates(peerInfo *PeerInfo) int {
+	duplicates := 0
+	for pieceNum := range peerInfo.activeRequests {
+		if cont.activeRequestsTotals[pieceNum] > 1 {
+			duplicates++
+		}
+	}
+	return duplicates
+}
+
+// assignedBlockLimit returns the number of blocks a peer may be assigned,
+// more for a peer keeping more requests outstanding than the default
+func (cont *Controller) assignedBlockLimit(peerInfo *PeerInfo) int {
+	if peerInfo.requestDepth <= defaultRequestDepth {
+		return cont.maxAssignedBlocks
+	}
+	return cont.maxAssignedBlocks * peerInfo.requestDepth / defaultRequestDepth
+}
+
+// blockCapped returns true if the cap on assigned blocks applies
+func (cont *Controller) blockCapped() bool {
+	return cont.maxAssignedBlocks > 0 && cont.pieceLength > 0
+}
+
+// canTakeMore returns true if an unchoked peer may be assigned more pieces
+func (cont *Controller) canTakeMore(peerInfo *PeerInfo) bool {
+	if peerInfo.isChoked || len(peerInfo.activeRequests) >= cont.maxSimultaneousDownloadsPerPeer {
+		return false
+	}
+	return !cont.blockCapped() || cont.assignedBlocks(peerInfo) < cont.assignedBlockLimit(peerInfo)+endgameBlockAllowance
+}
+
+// canAssign returns true if a piece may be assigned to a peer without
+// exceeding the number of pieces, blocks or duplicate pieces it may work on.
+// Only the number of pieces is capped if the piece length isn't known. A
+// peer with no work may always take a piece, however large.
+func (cont *Controller) canAssign(peerInfo *PeerInfo, pieceNum int) bool {
+	if len(peerInfo.activeRequests) >= cont.maxSimultaneousDownloadsPerPeer {
+		return false
+	}
+	if !cont.blockCapped() {
+		return true
+	}
+	duplicate := cont.activeRequestsTotals[pieceNum] > 0
+	if duplicate && cont.heldDuplicates(peerInfo) >= maxDuplicatesPerPeer {
+		return false
+	}
+	if len(peerInfo.activeRequests) == 0 {
+		return true
+	}
+	limit := cont.assignedBlockLimit(peerInfo)
+	if duplicate {
+		limit += endgameBlockAllowance
+	}
+	return cont.assignedBlocks(peerInfo)+cont.pieceBlocks(pieceNum) <= limit
+}
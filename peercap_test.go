@@ -0,0 +1,186 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"sort"
+	"testing"
+)
+
+// simulateFastPeerLoss downloads a torrent of 32 pieces of 16 blocks from
+// one fast peer and three slow ones, each with every piece, disconnects the
+// fast peer after a few ticks and returns the most blocks the fast peer was
+// ever assigned and the ticks it took to finish the pieces it was working on
+// when it went away.
+// Pieces are picked in order and peers are given pieces in order of their
+// names, so that every run is the same.
+func simulateFastPeerLoss(t *testing.T, capped bool) (int, int) {
+	const numPieces, blocksPerPiece, killTick = 32, 16, 3
+	cont := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	cont.pieceLength, cont.totalLength = blocksPerPiece*downloadBlockSize, numPieces*blocksPerPiece*downloadBlockSize
+	cont.sequential = true
+	if !capped {
+		cont.maxAssignedBlocks = 0
+	}
+	rates := map[string]int{"fast": 24, "slow1": 2, "slow2": 2, "slow3": 2} // blocks per tick
+	sortedNames := func() []string {
+		names := make([]string, 0, len(cont.peers))
+		for peerName := range cont.peers {
+			names = append(names, peerName)
+		}
+		sort.Strings(names)
+		return names
+	}
+	// As sendRequestsToAllPeers does, in a fixed order
+	sendRequests := func() {
+		raritySlice := cont.createRaritySlice()
+		for _, peerName := range sortedNames() {
+			if peerInfo := cont.peers[peerName]; cont.canTakeMore(peerInfo) {
+				cont.sendRequestsToPeer(peerInfo, raritySlice)
+			}
+		}
+	}
+	received := make(map[string]map[int]int)
+	for peerName := range rates {
+		chans := ControllerPeerChans{requestPiece: make(chan RequestPiece, numPieces*4), cancelPiece: make(chan CancelPiece, numPieces*4)}
+		peerInfo := NewPeerInfo(numPieces, *NewPeerComms(peerName, chans))
+		peerInfo.isChoked = false
+		for pieceNum := range peerInfo.availablePieces {
+			peerInfo.availablePieces[pieceNum] = true
+		}
+		cont.peers[peerName] = peerInfo
+		received[peerName] = make(map[int]int)
+	}
+	sendRequests()
+
+	maxAssigned := 0
+	var orphaned map[int]struct{}
+	for tick := 1; tick < 1000; tick++ {
+		if peerInfo, ok := cont.peers["fast"]; ok {
+			if blocks := cont.assignedBlocks(peerInfo); blocks > maxAssigned {
+				maxAssigned = blocks
+			}
+		}
+		if tick == killTick {
+			// The same steps as the Controller takes for a dead peer
+			orphaned = cont.peers["fast"].activeRequests
+			cont.removeUnfinishedWorkForPeer(cont.peers["fast"])
+			delete(cont.peers, "fast")
+		}
+		for _, peerName := range sortedNames() {
+			peerInfo, ok := cont.peers[peerName]
+			if !ok {
+				continue
+			}
+			// Blocks arrive for the lowest pieces first
+			budget := rates[peerName]
+			for budget > 0 && len(peerInfo.activeRequests) > 0 {
+				pieceNum := numPieces
+				for p := range peerInfo.activeRequests {
+					if p < pieceNum {
+						pieceNum = p
+					}
+				}
+				n := blocksPerPiece - received[peerName][pieceNum]
+				if n > budget {
+					n = budget
+				}
+				received[peerName][pieceNum] += n
+				budget -= n
+				if received[peerName][pieceNum] == blocksPerPiece {
+					cont.removePieceFromActiveRequests(ReceivedPiece{pieceNum: pieceNum, peerName: peerName})
+					cont.finishedPieces[pieceNum] = true
+					for _, other := range received {
+						delete(other, pieceNum)
+					}
+					sendRequests()
+				}
+			}
+			if peerInfo.isChoked || len(peerInfo.activeRequests) > cont.maxSimultaneousDownloadsPerPeer {
+				t.Fatalf("Unexpected state of %s: %+v", peerName, peerInfo)
+			}
+		}
+		if orphaned != nil {
+			recovered := true
+			for pieceNum := range orphaned {
+				recovered = recovered && cont.finishedPieces[pieceNum]
+			}
+			if recovered {
+				return maxAssigned, tick - killTick
+			}
+		}
+	}
+	t.Fatalf("The pieces of the fast peer were never recovered")
+	return 0, 0
+}
+
+// With one dominant fast peer the blocks it's assigned respect the cap, and
+// the pieces it was working on are finished sooner once it's lost than
+// without the cap
+func TestPeerBlockCap(t *testing.T) {
+	cappedBlocks, cappedTicks := simulateFastPeerLoss(t, true)
+	uncappedBlocks, uncappedTicks := simulateFastPeerLoss(t, false)
+	limit := assignedBlockDepths*defaultRequestDepth + endgameBlockAllowance
+	if cappedBlocks > limit {
+		t.Errorf("Expected the fast peer to be assigned at most %d blocks, but it had %d", limit, cappedBlocks)
+	}
+	if uncappedBlocks <= limit {
+		t.Errorf("Expected the fast peer to be assigned more than %d blocks without the cap, but it had %d", limit, uncappedBlocks)
+	}
+	if cappedTicks >= uncappedTicks {
+		t.Errorf("Expected the pieces of the lost peer to be recovered sooner with the cap, but it took %d ticks against %d", cappedTicks, uncappedTicks)
+	}
+}
+
+// A piece larger than the cap is still assigned to a peer with no work, and
+// duplicates are spread across peers
+func TestPeerBlockCapAssign(t *testing.T) {
+	cont := createTestController()
+	cont.pieceLength, cont.totalLength = 64*downloadBlockSize, 10*64*downloadBlockSize
+	peerInfo := &PeerInfo{activeRequests: make(map[int]struct{})}
+	if !cont.canAssign(peerInfo, 1) {
+		t.Errorf("Expected a piece of %d blocks to be assigned to a peer with no work", cont.pieceBlocks(1))
+	}
+	peerInfo.activeRequests[1] = struct{}{}
+	cont.activeRequestsTotals[1]++
+	if cont.canAssign(peerInfo, 2) {
+		t.Errorf("Expected no second piece of %d blocks to be assigned over a cap of %d blocks", cont.pieceBlocks(2), cont.maxAssignedBlocks)
+	}
+
+	// Once pieces are a block each only duplicates are capped
+	cont.pieceLength = downloadBlockSize
+	busy := &PeerInfo{activeRequests: map[int]struct{}{1: {}, 2: {}, 3: {}}}
+	cont.activeRequestsTotals[2] += 2
+	cont.activeRequestsTotals[3] += 2
+	cont.activeRequestsTotals[5]++
+	if held := cont.heldDuplicates(busy); held != maxDuplicatesPerPeer {
+		t.Fatalf("Expected the peer to hold %d duplicates, but it held %d", maxDuplicatesPerPeer, held)
+	}
+	if cont.canAssign(busy, 5) {
+		t.Errorf("Expected a peer holding %d duplicates not to take another", maxDuplicatesPerPeer)
+	}
+	if !cont.canAssign(busy, 6) {
+		t.Errorf("Expected a peer holding %d duplicates to take a piece nobody works on", maxDuplicatesPerPeer)
+	}
+}
+
+// A peer keeping more requests outstanding than the default may be assigned
+// proportionally more blocks
+func TestPeerBlockCapDepth(t *testing.T) {
+	cont := createTestController()
+	cont.pieceLength, cont.totalLength = 16*downloadBlockSize, 10*16*downloadBlockSize
+	peerInfo := &PeerInfo{activeRequests: map[int]struct{}{1: {}}, requestDepth: defaultRequestDepth}
+	if cont.canAssign(peerInfo, 2) {
+		t.Errorf("Expected no second piece of %d blocks to be assigned over a cap of %d blocks", cont.pieceBlocks(2), cont.maxAssignedBlocks)
+	}
+	peerInfo.requestDepth = 4 * defaultRequestDepth
+	if limit := cont.assignedBlockLimit(peerInfo); limit != 4*cont.maxAssignedBlocks {
+		t.Errorf("Expected a cap of %d blocks at 4 times the default depth, but got %d", 4*cont.maxAssignedBlocks, limit)
+	}
+	if !cont.canAssign(peerInfo, 2) {
+		t.Errorf("Expected a second piece of %d blocks to be assigned to a peer with a depth of %d", cont.pieceBlocks(2), peerInfo.requestDepth)
+	}
+}
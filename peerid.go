@@ -0,0 +1,36 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Azureus-style client prefix: '-' + 'TV' + <version number> + '-'
+const peerIDPrefix = "-TV0001-"
+
+var (
+	peerID     [20]byte
+	peerIDOnce sync.Once
+)
+
+// Unique client ID, used in tracker announces and peer handshakes
+var PeerID = generatePeerID()
+
+// generatePeerID returns the peer ID of this session, the client prefix
+// followed by 12 random bytes. The ID is generated on the first call and the
+// same ID is returned on every call after that.
+func generatePeerID() [20]byte {
+	peerIDOnce.Do(func() {
+		copy(peerID[:], peerIDPrefix)
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := len(peerIDPrefix); i < len(peerID); i++ {
+			peerID[i] = byte(r.Intn(256))
+		}
+	})
+	return peerID
+}
@@ -0,0 +1,23 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGeneratePeerID(t *testing.T) {
+	id := generatePeerID()
+	if !regexp.MustCompile(`^-[A-Z]{2}[0-9]{4}-$`).Match(id[:8]) {
+		t.Errorf("Expected an Azureus-style prefix, but the peer ID starts with %q", id[:8])
+	}
+	if string(id[:8]) != peerIDPrefix {
+		t.Errorf("Expected the peer ID to start with %q, but it was %q", peerIDPrefix, id[:8])
+	}
+	if generatePeerID() != id || PeerID != id {
+		t.Errorf("Expected the same peer ID to be used for the whole session")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+)
+
+// The history of a peer is forgotten once it has been disconnected for this
+// long, a reconnect after that starts a new history
+const peerHistoryExpiry = 10 * time.Minute
+
+// peerHistory is what we know of a peer across its connections. Peers behind
+// a NAT may reconnect from a new source port, so connections are matched to
+// a history by peer ID rather than by address.
+type peerHistory struct {
+	ip             net.IP // address the peer last connected from
+	connections    int    // connections made to or from the peer
+	live           int    // connections still open
+	firstConnected time.Time
+	lastSeen       time.Time // when a connection of the peer last closed
+	// Counters of the connections that have closed
+	read   int
+	write  int
+	errors int
+}
+
+// peerIdentity is the key a peer's history is kept under: its hex encoded
+// peer ID once the handshake told us, or its address before that
+func peerIdentity(peerID []byte, peerName string) string {
+	if len(peerID) == 0 {
+		return peerName
+	}
+	return hex.EncodeToString(peerID)
+}
+
+// joinHistory gives a new connection the history of its peer. The history is
+// kept if the peer last connected from the same IP, and has a connection
+// open or closed one recently, otherwise a new history is started.
+func (pm *PeerManager) joinHistory(p *Peer) {
+	now := pm.clock.Now()
+	ip := remoteIP(p.conn)
+	p.identity = peerIdentity(p.peerID, p.peerName)
+	history, ok := pm.history[p.identity]
+	if !ok || !history.ip.Equal(ip) || (history.live == 0 && now.Sub(history.lastSeen) > peerHistoryExpiry) {
+		history = &peerHistory{ip: ip, firstConnected: now}
+		pm.history[p.identity] = history
+	} else {
+		log.Printf("PeerManager : joinHistory : %s is connection %d to the same peer", p.peerName, history.connections+1)
+	}
+	history.connections++
+	history.live++
+	p.connection = history.connections
+}
+
+// leaveHistory adds the counters of a closed connection to the history of
+// its peer, and forgets the histories of peers that have been gone for long
+func (pm *PeerManager) leaveHistory(p *Peer) {
+	now := pm.clock.Now()
+	if history, ok := pm.history[p.identity]; ok && history.live > 0 {
+		p.stats.Lock()
+		history.read += p.stats.read
+		history.write += p.stats.write
+		history.errors += p.stats.errors
+		p.stats.Unlock()
+		history.live--
+		history.lastSeen = now
+	}
+	for identity, history := range pm.history {
+		if history.live == 0 && now.Sub(history.lastSeen) > peerHistoryExpiry {
+			delete(pm.history, identity)
+		}
+	}
+}
+
+// rebinding reports whether a connection from a peer we're already connected
+// to is the peer reconnecting from a new port, as peers behind a NAT do when
+// their mapping changes. The old connection is then dead, even if we haven't
+// noticed yet.
+func rebinding(existing *Peer, conn handshakedConn) bool {
+	return !existing.outbound && !conn.outbound && remoteIP(existing.conn).Equal(remoteIP(conn.conn))
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// connectTestPeer connects to the PeerManager as a peer with the given peer
+// ID, from a new source port
+func connectTestPeer(t *testing.T, listener *net.TCPListener, serverChans serverPeerChans, peerID string) (remote *net.TCPConn, peerName string) {
+	remote, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+	copy(handshake.PeerID[:], peerID)
+	err = binary.Write(remote, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverChans.conns <- conn
+	return remote, conn.RemoteAddr().String()
+}
+
+// A peer that reconnects from a new port with the same peer ID, as peers
+// behind a NAT do, replaces its old connection and keeps its history
+func TestPeerIdentityRebinding(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+	stats := NewStats(len(data), make(chan int))
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(make([]byte, 20), pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, stats.peerCh, trackerManager.peerChans, defaultMaxPeers)
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go stats.Run()
+	go controller.Run()
+	go peerManager.Run()
+	defer stats.Stop()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peerID := "-XX0001-natpeer00001"
+
+	waitForPeer := func(peerName string, connections int, downloaded int) DumpPeer {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			dump := newSwarmDump(controller, peerManager, trackerManager, diskio)
+			if len(dump.Peers) == 1 && dump.Peers[0].Name == peerName && dump.Peers[0].Connections == connections && dump.Peers[0].Downloaded >= downloaded {
+				return dump.Peers[0]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for connection %d to %s in the dump: %+v", connections, peerName, dump.Peers)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first, firstName := connectTestPeer(t, listener, serverChans, peerID)
+	defer first.Close()
+	before := waitForPeer(firstName, 1, 1)
+
+	// The old connection is left open, a peer whose NAT mapping changed
+	// doesn't get to close it
+	second, secondName := connectTestPeer(t, listener, serverChans, peerID)
+	defer second.Close()
+	after := waitForPeer(secondName, 2, 2*before.Downloaded)
+	if after.Downloaded != 2*before.Downloaded {
+		t.Errorf("Expected %d bytes downloaded over both connections, but got %d", 2*before.Downloaded, after.Downloaded)
+	}
+
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, first); err != nil {
+		t.Errorf("Expected the old connection to be closed, but got %s", err)
+	}
+	if status := newTorrentStatus(stats, peerManager); status.ConnectedPeers != 1 {
+		t.Errorf("Expected 1 connected peer in the status, but got %d", status.ConnectedPeers)
+	}
+}
+
+// A peer that reconnects from a new port reports counters restarting from 0
+// under the same identity, and reports of the old connection are ignored
+func TestStatsPeerConnections(t *testing.T) {
+	s := NewStats(0, nil)
+	identity := peerIdentity([]byte("-XX0001-natpeer00001"), "10.0.0.1:50000")
+	s.countPeer(peerStatsSnapshot{peerName: identity, connection: 1, read: 1000})
+	s.countPeer(peerStatsSnapshot{peerName: identity, connection: 2, read: 300})
+	s.countPeer(peerStatsSnapshot{peerName: identity, connection: 1, read: 1200})
+	s.countPeer(peerStatsSnapshot{peerName: identity, connection: 2, read: 500})
+	if s.Downloaded != 1500 {
+		t.Errorf("Expected %d bytes downloaded, but got %d", 1500, s.Downloaded)
+	}
+	if rates := s.rates(); len(rates.Peers) != 1 {
+		t.Errorf("Expected 1 peer, but got %+v", rates.Peers)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	if identity := peerIdentity(nil, "10.0.0.1:6881"); identity != "10.0.0.1:6881" {
+		t.Errorf("Expected the address before the handshake, but got %s", identity)
+	}
+	if identity := peerIdentity([]byte{0xab, 0x01}, "10.0.0.1:6881"); identity != "ab01" {
+		t.Errorf("Expected the hex encoded peer ID, but got %s", identity)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer exchange (BEP 11). Peers that support ut_pex tell each other about
+// the peers they're connected to, so that fewer peers have to come from
+// trackers. It's disabled for private torrents.
+const (
+	utPexName   = "ut_pex"
+	utPexID     = 1  // extended message ID peers send us ut_pex messages with
+	maxPexPeers = 50 // peers added or dropped in a single message at most
+)
+
+// Interval between the PEX messages sent to a peer. Messages a peer sends
+// less than half of it apart are ignored.
+var pexInterval = time.Minute
+
+// pexMessage is the bencoded payload of a ut_pex message. Peers are in
+// compact form, added.f holds a byte of flags for each added peer.
+type pexMessage struct {
+	Added   string `bencode:"added"`
+	AddedF  string `bencode:"added.f"`
+	Dropped string `bencode:"dropped"`
+}
+
+// pexFound is a list of peers a connected peer told us about
+type pexFound struct {
+	peerName string
+	peers    []PeerTuple
+}
+
+// pexView is the set of peers we're connected to that others can connect to
+// as well, shared by the PeerManager with its peers
+type pexView struct {
+	sync.Mutex
+	peers map[string]PeerTuple
+}
+
+func newPexView() *pexView {
+	return &pexView{peers: make(map[string]PeerTuple)}
+}
+
+func (v *pexView) add(peerName string, peer PeerTuple) {
+	v.Lock()
+	defer v.Unlock()
+	v.peers[peerName] = peer
+}
+
+func (v *pexView) remove(peerName string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.peers, peerName)
+}
+
+// list returns a copy of the peers in the view
+func (v *pexView) list() map[string]PeerTuple {
+	v.Lock()
+	defer v.Unlock()
+	peers := make(map[string]PeerTuple, len(v.peers))
+	for peerName, peer := range v.peers {
+		peers[peerName] = peer
+	}
+	return peers
+}
+
+// compactPeers encodes peers in compact form, the reverse of
+// parseCompactPeers
+func compactPeers(peers []PeerTuple) string {
+	b := make([]byte, 0, 6*len(peers))
+	for _, peer := range peers {
+		b = append(b, peer.IP.To4()...)
+		b = append(b, byte(peer.Port>>8), byte(peer.Port))
+	}
+	return string(b)
+}
+
+// encodePex returns the payload of a ut_pex message
+func encodePex(added []PeerTuple, dropped []PeerTuple) ([]byte, error) {
+	message := pexMessage{Added: compactPeers(added), AddedF: string(make([]byte, len(added))), Dropped: compactPeers(dropped)}
+	var b bytes.Buffer
+	err := bencode.Marshal(&b, message)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodePex parses the payload of a ut_pex message into the peers added and
+// dropped
+func decodePex(payload []byte) (added []PeerTuple, dropped []PeerTuple, err error) {
+	var message pexMessage
+	err = bencode.Unmarshal(bytes.NewReader(payload), &message)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(message.Added)%6 != 0 || len(message.Dropped)%6 != 0 {
+		return nil, nil, fmt.Errorf("Peer lists of %d and %d bytes aren't compact IPv4 peers", len(message.Added), len(message.Dropped))
+	}
+	return parseCompactPeers([]byte(message.Added)), parseCompactPeers([]byte(message.Dropped)), nil
+}
+
+// advertisedExtensions returns the extensions in our extended handshake to
+// the peer
+func (p *Peer) advertisedExtensions() map[string]int {
+	extensions := make(map[string]int, len(localExtensions))
+	for name, id := range localExtensions {
+		if name != utPexName || p.pex != nil {
+			extensions[name] = id
+		}
+	}
+	return extensions
+}
+
+// receivedPex handles a ut_pex message, handing the peers added over to the
+// PeerManager. The peers dropped are left to fail on their own.
+func (p *Peer) receivedPex(payload []byte) {
+	if p.pex == nil {
+		log.Printf("Ignoring a PEX message from %s, peer exchange is disabled", p.peerName)
+		return
+	}
+	now := p.clock.Now()
+	if !p.lastPexReceived.IsZero() && now.Sub(p.lastPexReceived) < pexInterval/2 {
+		log.Printf("Ignoring a PEX message from %s, sent %v after the last", p.peerName, now.Sub(p.lastPexReceived))
+		return
+	}
+	p.lastPexReceived = now
+	added, dropped, err := decodePex(payload)
+	if err != nil {
+		log.Printf("Ignoring an invalid PEX message from %s: %s", p.peerName, err)
+		return
+	}
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+	log.Printf("Received a PEX message from %s adding %d peers and dropping %d", p.peerName, len(added), len(dropped))
+	if len(added) == 0 {
+		return
+	}
+	found := pexFound{peerName: p.peerName, peers: added}
+	go func() {
+		select {
+		case p.peerManagerChans.pexPeers <- found:
+		case <-p.stopping:
+		}
+	}()
+}
+
+// sendPex sends the peer the changes to the peers we're connected to since
+// the last PEX message, if it supports ut_pex and pexInterval has passed
+func (p *Peer) sendPex(now time.Time) {
+	id, ok := p.extensionID(utPexName)
+	if !ok || p.pex == nil || (!p.lastPexSent.IsZero() && now.Sub(p.lastPexSent) < pexInterval) {
+		return
+	}
+	current := p.pex.list()
+	delete(current, p.peerName)
+	var added, dropped []PeerTuple
+	var addedNames, droppedNames []string
+	for peerName := range current {
+		if _, sent := p.pexSent[peerName]; !sent {
+			addedNames = append(addedNames, peerName)
+		}
+	}
+	for peerName := range p.pexSent {
+		if _, ok := current[peerName]; !ok {
+			droppedNames = append(droppedNames, peerName)
+		}
+	}
+	if len(addedNames) == 0 && len(droppedNames) == 0 {
+		return
+	}
+	// What doesn't fit is sent in the next message
+	sort.Strings(addedNames)
+	sort.Strings(droppedNames)
+	if len(addedNames) > maxPexPeers {
+		addedNames = addedNames[:maxPexPeers]
+	}
+	if len(droppedNames) > maxPexPeers {
+		droppedNames = droppedNames[:maxPexPeers]
+	}
+	if p.pexSent == nil {
+		p.pexSent = make(map[string]PeerTuple)
+	}
+	for _, peerName := range addedNames {
+		added = append(added, current[peerName])
+		p.pexSent[peerName] = current[peerName]
+	}
+	for _, peerName := range droppedNames {
+		dropped = append(dropped, p.pexSent[peerName])
+		delete(p.pexSent, peerName)
+	}
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		log.Printf("Peer : sendPex : Unable to encode a PEX message: %s", err)
+		return
+	}
+	p.lastPexSent = now
+	log.Printf("Peer : sendPex : Sending PEX to %s adding %d peers and dropping %d", p.peerName, len(added), len(dropped))
+	go p.sendMessage(Message{ID: MsgExtended, Payload: append([]byte{byte(id)}, payload...)})
+}
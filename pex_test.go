@@ -0,0 +1,145 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// The peers a connected peer adds in a ut_pex message are dialed
+func TestReceivePex(t *testing.T) {
+	// The peers the mock peer tells us about
+	accepted := make(chan *net.TCPConn, 10)
+	var added []PeerTuple
+	for i := 0; i < 2; i++ {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		addr := listener.Addr().(*net.TCPAddr)
+		added = append(added, PeerTuple{IP: addr.IP, Port: uint16(addr.Port)})
+		go func() {
+			conn, err := listener.AcceptTCP()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+	}
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	numPieces := 4
+	infoHash := make([]byte, 20)
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, numPieces, 1024, numPieces*1024, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.ports.maxConnsPerIP = 0
+	controller := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	defer close(controller.quit)
+	go peerManager.Run()
+	defer close(peerManager.quit)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	conn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var handshake Handshake
+	err = binary.Read(conn, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+	reply.Reserved[extensionReservedByte] |= extensionReservedBit
+	copy(reply.InfoHash[:], infoHash)
+	copy(reply.PeerID[:], "-XX0001-testpeer0000")
+	binary.Write(conn, binary.BigEndian, &reply)
+
+	extended, err := encodeExtendedHandshake(map[string]int{utPexName: 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pex, err := encodePex(added, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(Message{ID: MsgExtended, Payload: extended}.Bytes())
+	conn.Write(Message{ID: MsgExtended, Payload: append([]byte{utPexID}, pex...)}.Bytes())
+
+	for i := range added {
+		select {
+		case c := <-accepted:
+			c.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for PEX peer %d of %d to be dialed", i+1, len(added))
+		}
+	}
+}
+
+// The peers we're connected to are sent in ut_pex messages no more than once
+// every pexInterval, as the changes since the last message
+func TestSendPex(t *testing.T) {
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 10, 16384, 10*16384, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	p.pex = newPexView()
+	p.pex.add(p.peerName, PeerTuple{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	p.pex.add("10.0.0.2:6881", PeerTuple{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	p.pex.add("10.0.0.3:6881", PeerTuple{IP: net.IPv4(10, 0, 0, 3), Port: 6881})
+
+	receive := func() (added []PeerTuple, dropped []PeerTuple) {
+		var message []byte
+		select {
+		case message = <-p.sendChan:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for a PEX message")
+		}
+		if message[4] != byte(MsgExtended) || message[5] != 3 {
+			t.Fatalf("Expected a ut_pex message with ID %d, but got message %d with extended ID %d", 3, message[4], message[5])
+		}
+		added, dropped, err := decodePex(message[6:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return added, dropped
+	}
+	expectNothing := func(when string) {
+		select {
+		case message := <-p.sendChan:
+			t.Errorf("Expected nothing to be sent %s, but got %x", when, message)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	now := time.Now()
+	p.sendPex(now)
+	expectNothing("to a peer without ut_pex")
+
+	p.extensions = map[string]int{utPexName: 3}
+	p.sendPex(now)
+	added, dropped := receive()
+	if len(added) != 2 || !added[0].IP.Equal(net.IPv4(10, 0, 0, 2)) || !added[1].IP.Equal(net.IPv4(10, 0, 0, 3)) || len(dropped) != 0 {
+		t.Errorf("Expected the other two peers to be added, but got %v and %v", added, dropped)
+	}
+
+	p.pex.remove("10.0.0.2:6881")
+	p.sendPex(now.Add(pexInterval / 2))
+	expectNothing("before pexInterval")
+	p.sendPex(now.Add(pexInterval))
+	added, dropped = receive()
+	if len(added) != 0 || len(dropped) != 1 || !dropped[0].IP.Equal(net.IPv4(10, 0, 0, 2)) || dropped[0].Port != 6881 {
+		t.Errorf("Expected only %s to be dropped, but got %v and %v", "10.0.0.2:6881", added, dropped)
+	}
+	p.sendPex(now.Add(2 * pexInterval))
+	expectNothing("without changes")
+}
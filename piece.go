@@ -9,6 +9,12 @@ type Piece struct {
 	index    int
 	data     []byte
 	peerName string
+	result   chan error // receives the outcome of completing the piece, may be nil
+	// The piece wasn't hash checked by the peer, as allowed by the
+	// verification policy, and isn't hash checked by DiskIO either
+	unverified bool
+	// Blocks of the piece the peer received more than once
+	duplicateBlocks int
 }
 
 // BlockInfo describe a request for a block from Peer to DiskIO
@@ -22,24 +28,36 @@ type BlockInfo struct {
 type BlockResponse struct {
 	info BlockInfo
 	data []byte
+	err  error // the block is refused, and data is nil
 }
 
 // BlockRequest is used by Peer for requesting blocks from DiskIO
 type BlockRequest struct {
 	request  BlockInfo
 	response chan BlockResponse // channel to send the response on
+	cancel   chan struct{}      // closed if the response is no longer wanted, may be nil
 }
 
 // Sent from the controller to the peer to request a particular piece
 type RequestPiece struct {
 	pieceNum     int
-	expectedHash []byte
+	expectedHash string
+	unchokes     int // the time the peer unchoked us the piece was given in
 }
 
 // Sent by the peer to the controller when it receives a HAVE message
 type HavePiece struct {
 	pieceNum int
 	peerName string
+	lost     bool // sent by the controller when a piece we had was lost on disk
+	bitfield bool // sent by a peer for a piece in its bitfield, rather than for a have
+}
+
+// Sent by the peer to the controller when a piece it downloaded failed its
+// hash check and was discarded
+type BadPiece struct {
+	pieceNum int
+	peerName string
 }
 
 // Sent from the controller to the peer to cancel an outstanding request
@@ -50,6 +68,20 @@ type CancelPiece struct {
 // Sent from DiskIO to the controller indicating that a piece has been
 // received and written to disk
 type ReceivedPiece struct {
+	pieceNum        int
+	peerName        string
+	duplicateBlocks int // blocks the peer received more than once
+}
+
+// Sent from the controller to DiskIO to recheck a single piece on disk
+type VerifyRequest struct {
 	pieceNum int
-	peerName string
+	response chan VerifyResponse // channel to send the response on
+}
+
+// VerifyResponse contains the result of a single piece recheck
+type VerifyResponse struct {
+	pieceNum int
+	good     bool
+	err      error
 }
@@ -0,0 +1,32 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+)
+
+// PieceHashes is the SHA-1 hash of every piece, concatenated as in the
+// "pieces" string of the metainfo. The pieces string of a large torrent can
+// be tens of megabytes, so it's never copied: converting it to PieceHashes
+// and slicing hashes out with At share its memory, and DiskIO and the
+// Controller reference that single copy.
+type PieceHashes string
+
+// Len returns the number of pieces
+func (ph PieceHashes) Len() int {
+	return len(ph) / sha1.Size
+}
+
+// At returns the hash of a piece, without copying it
+func (ph PieceHashes) At(pieceNum int) string {
+	return string(ph[pieceNum*sha1.Size : (pieceNum+1)*sha1.Size])
+}
+
+// checkHash returns true if data hashes to expectedHash
+func checkHash(data []byte, expectedHash string) bool {
+	sum := sha1.Sum(data)
+	return string(sum[:]) == expectedHash
+}
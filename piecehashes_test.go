@@ -0,0 +1,129 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+func TestPieceHashesAt(t *testing.T) {
+	data := createTestPayload(3, 1024)
+	hashes := PieceHashes(createTestMetaInfo(data, 1024).Info.Pieces)
+	if hashes.Len() != 3 {
+		t.Fatalf("Expected 3 pieces, but got %d", hashes.Len())
+	}
+	for pieceNum := 0; pieceNum < 3; pieceNum++ {
+		sum := sha1.Sum(data[pieceNum*1024 : (pieceNum+1)*1024])
+		if hashes.At(pieceNum) != string(sum[:]) {
+			t.Errorf("Expected the hash of piece %d to be %x, but got %x", pieceNum, sum, hashes.At(pieceNum))
+		}
+		if !checkHash(data[pieceNum*1024:(pieceNum+1)*1024], hashes.At(pieceNum)) || checkHash(data[:1024], hashes.At(2)) {
+			t.Errorf("Expected only the data of piece %d to match its hash", pieceNum)
+		}
+	}
+}
+
+// writeLargeTorrent writes a torrent of numPieces pieces to dir and returns
+// its path
+func writeLargeTorrent(t *testing.T, dir string, numPieces int) string {
+	pieceLength := 16384
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "d4:infod6:lengthi%de4:name5:large12:piece lengthi%de6:pieces%d:", numPieces*pieceLength, pieceLength, numPieces*sha1.Size)
+	for i := 0; i < numPieces; i++ {
+		sum := sha1.Sum([]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+		b.Write(sum[:])
+	}
+	b.WriteString("ee")
+	path := filepath.Join(dir, "large.torrent")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// Only one copy of a huge pieces string is retained once the torrent is
+// parsed, and DiskIO and the Controller share it
+func TestPieceHashesSingleCopy(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("The 16 GiB torrent needs 64 bit ints")
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	numPieces := 1 << 20
+	path := writeLargeTorrent(t, dir, numPieces)
+	size := uint64(numPieces * sha1.Size)
+
+	before := heapAlloc()
+	torrent, err := NewTorrent(path, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Init()
+	diskio := NewDiskIO(torrent.metaInfo, dir)
+	retained := heapAlloc() - before
+	if retained > size+size/4 {
+		t.Errorf("Expected about %d bytes retained for the piece hashes, but %d bytes were", size, retained)
+	}
+
+	cont := NewController(make([]bool, diskio.pieceHashes.Len()), diskio.pieceHashes, ControllerDiskIOChans{}, *NewControllerPeerManagerChans(), *NewPeerControllerChans())
+	shared := unsafe.StringData(torrent.metaInfo.Info.Pieces)
+	if unsafe.StringData(string(diskio.pieceHashes)) != shared || unsafe.StringData(string(cont.pieceHashes)) != shared {
+		t.Errorf("Expected DiskIO and the Controller to share the pieces string of the metainfo")
+	}
+	if cont.pieceHashes.Len() != numPieces {
+		t.Errorf("Expected %d pieces, but got %d", numPieces, cont.pieceHashes.Len())
+	}
+	runtime.KeepAlive(torrent)
+}
+
+func BenchmarkPieceHashesAt(b *testing.B) {
+	data := createTestPayload(1024, 16)
+	hashes := PieceHashes(createTestMetaInfo(data, 16).Info.Pieces)
+	sum := sha1.Sum(data[:16])
+	b.ReportAllocs()
+	b.ResetTimer()
+	matches := 0
+	for i := 0; i < b.N; i++ {
+		if hashes.At(i%hashes.Len()) == string(sum[:]) {
+			matches++
+		}
+	}
+	if matches == 0 {
+		b.Fatal("Expected the hash of the first piece to match")
+	}
+}
+
+// Hash checking a received piece against its hash in the metainfo, as peers
+// and DiskIO do
+func BenchmarkCheckHashAt(b *testing.B) {
+	pieceLength := 256 * 1024
+	data := createTestPayload(4, pieceLength)
+	hashes := PieceHashes(createTestMetaInfo(data, pieceLength).Info.Pieces)
+	b.SetBytes(int64(pieceLength))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pieceNum := i % hashes.Len()
+		if !checkHash(data[pieceNum*pieceLength:(pieceNum+1)*pieceLength], hashes.At(pieceNum)) {
+			b.Fatal("Piece failed its hash check")
+		}
+	}
+}
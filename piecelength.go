@@ -0,0 +1,47 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Piece lengths torrents are loaded with by default. Tiny pieces mean
+// millions of pieces, with gigabytes of hashes and bitfields, and huge ones
+// are held in memory whole while they're downloaded.
+const (
+	defaultMinPieceLength = 16 * 1024
+	defaultMaxPieceLength = 32 * 1024 * 1024
+)
+
+// Bytes of a piece read and hashed at a time when verifying it on disk, so
+// that huge pieces don't need a buffer as large as the piece
+var hashChunkSize = 4 * 1024 * 1024
+
+// PieceLengthError is returned when a torrent's piece length is outside the
+// bounds it's loaded with
+type PieceLengthError struct {
+	PieceLength int
+	Min         int
+	Max         int
+}
+
+func (e *PieceLengthError) Error() string {
+	return fmt.Sprintf("Piece length of %d bytes is outside the supported range of %d to %d bytes", e.PieceLength, e.Min, e.Max)
+}
+
+// checkPieceLength returns a PieceLengthError if the piece length of the
+// torrent is outside the bounds, unless allowPieceLength overrides them. A
+// piece length that isn't positive is never allowed.
+func (t *Torrent) checkPieceLength() error {
+	length := t.metaInfo.Info.PieceLength
+	if length <= 0 {
+		return fmt.Errorf("Invalid piece length %d", length)
+	}
+	if t.allowPieceLength || (length >= t.minPieceLength && (t.maxPieceLength <= 0 || length <= t.maxPieceLength)) {
+		return nil
+	}
+	return &PieceLengthError{PieceLength: length, Min: t.minPieceLength, Max: t.maxPieceLength}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Torrents with tiny or huge pieces are refused with a PieceLengthError
+// unless the bounds are overridden, and a piece length that isn't positive
+// is always refused
+func TestPieceLengthBounds(t *testing.T) {
+	tests := []struct {
+		pieceLength int
+		allowed     bool // within the default bounds
+	}{
+		{16, false},
+		{defaultMinPieceLength, true},
+		{256 * 1024, true},
+		{defaultMaxPieceLength, true},
+		{512 * 1024 * 1024, false},
+	}
+	for _, test := range tests {
+		torrent := &Torrent{minPieceLength: defaultMinPieceLength, maxPieceLength: defaultMaxPieceLength}
+		torrent.metaInfo.Info.PieceLength = test.pieceLength
+		err := torrent.checkPieceLength()
+		var lengthErr *PieceLengthError
+		if test.allowed && err != nil {
+			t.Errorf("Expected pieces of %d bytes to be allowed, but got %s", test.pieceLength, err)
+		} else if !test.allowed && (!errors.As(err, &lengthErr) || lengthErr.PieceLength != test.pieceLength) {
+			t.Errorf("Expected a PieceLengthError for pieces of %d bytes, but got %v", test.pieceLength, err)
+		}
+		torrent.allowPieceLength = true
+		if err := torrent.checkPieceLength(); err != nil {
+			t.Errorf("Expected pieces of %d bytes to be allowed by the override, but got %s", test.pieceLength, err)
+		}
+	}
+
+	torrent := &Torrent{allowPieceLength: true}
+	if err := torrent.checkPieceLength(); err == nil {
+		t.Error("Expected a piece length of 0 to be refused even with the override")
+	}
+
+	// A torrent with tiny pieces isn't run, nor are its files created
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	data := createTestPayload(4, 16)
+	metaInfo := createTestMetaInfo(data, 16)
+	tiny, err := NewTorrent(writeTestTorrent(t, dir, metaInfo), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiny.downloadDir = dir
+	var lengthErr *PieceLengthError
+	if err := tiny.Run(); !errors.As(err, &lengthErr) {
+		t.Errorf("Expected running a torrent with pieces of 16 bytes to fail with a PieceLengthError, but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metaInfo.Info.Name)); !os.IsNotExist(err) {
+		t.Errorf("Expected the files of a refused torrent not to be created, but got %v", err)
+	}
+}
+
+// Peers split pieces shorter than a block, or not a multiple of it, into
+// blocks that add up to the piece
+func TestTinyPieceBlocks(t *testing.T) {
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 3, 16, 40, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	for pieceNum, expected := range []int{16, 16, 8} {
+		if n := p.expectedNumBlocksForPiece(pieceNum); n != 1 {
+			t.Errorf("Expected piece %d to be a single block, but it's %d", pieceNum, n)
+		}
+		if length := p.expectedLengthForBlock(pieceNum, 0); length != expected {
+			t.Errorf("Expected the block of piece %d to be %d bytes, but it's %d", pieceNum, expected, length)
+		}
+	}
+
+	pieceLength := 3*downloadBlockSize + 100
+	p = NewPeer("10.0.0.1:6881", make([]byte, 20), 2, pieceLength, pieceLength+downloadBlockSize, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{}, nil, systemClock)
+	if n := p.expectedNumBlocksForPiece(0); n != 4 {
+		t.Errorf("Expected a piece of %d bytes to be %d blocks, but it's %d", pieceLength, 4, n)
+	}
+	if length := p.expectedLengthForBlock(0, 3); length != 100 {
+		t.Errorf("Expected the last block to be %d bytes, but it's %d", 100, length)
+	}
+	if n, length := p.expectedNumBlocksForPiece(1), p.expectedLengthForBlock(1, 0); n != 1 || length != downloadBlockSize {
+		t.Errorf("Expected the last piece to be a single full block, but it's %d blocks, the first of %d bytes", n, length)
+	}
+}
+
+// Pieces longer than hashChunkSize are verified on disk a chunk at a time,
+// and aren't served to peers when they're over maxServedPieceLength
+func TestHugePieceVerification(t *testing.T) {
+	chunkSize := hashChunkSize
+	hashChunkSize = 1000
+	defer func() { hashChunkSize = chunkSize }()
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 4096
+	data := createTestPayload(3, pieceLength)
+	data = data[:len(data)-500]
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	path := filepath.Join(dir, metaInfo.Info.Name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	if len(diskio.verifyBuffer()) != hashChunkSize {
+		t.Errorf("Expected a verify buffer of %d bytes, but it's %d", hashChunkSize, len(diskio.verifyBuffer()))
+	}
+	for pieceNum, verified := range diskio.pieces {
+		if !verified {
+			t.Errorf("Expected piece %d to verify a chunk at a time", pieceNum)
+		}
+	}
+
+	diskio.maxServedPieceLength = pieceLength - 1
+	if _, err := diskio.requestBlock(BlockInfo{pieceIndex: 0, begin: 0, length: 16}, nil); !errors.Is(err, errPieceTooLong) {
+		t.Errorf("Expected a block of a piece over the limit to be refused, but got %v", err)
+	}
+	if _, err := diskio.requestBlock(BlockInfo{pieceIndex: 2, begin: 0, length: 16}, nil); err != nil {
+		t.Errorf("Expected a block of the shorter last piece to be served, but got %s", err)
+	}
+
+	// Corrupt the last chunk of the second piece
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{data[2*pieceLength-1] + 1}, int64(2*pieceLength-1))
+	file.Close()
+	if ok, err := diskio.VerifyPiece(1); ok || err != nil {
+		t.Errorf("Expected the corrupted piece to fail verification, but got %t, %v", ok, err)
+	}
+	if ok, err := diskio.VerifyPiece(0); !ok || err != nil {
+		t.Errorf("Expected the first piece to still verify, but got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Per piece download timings, recorded by the Controller as pieces complete,
+// for tuning the pipelining defaults against real swarms.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of the piece latency histogram, in seconds
+var pieceLatencyBounds = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Upper bounds of the buckets of the histograms of peers, duplicate blocks
+// and retransmits per piece
+var pieceCountBounds = []float64{0, 1, 2, 3, 5, 10}
+
+// Latencies of the most recent pieces kept for the percentiles
+const maxLatencySamples = 1024
+
+// Histogram counts samples in buckets. Counts[i] is the number of samples no
+// greater than Bounds[i] and greater than the bound before it, the last
+// count is the number of samples greater than every bound.
+type Histogram struct {
+	Bounds []float64
+	Counts []int64
+	Sum    float64
+}
+
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.Bounds, value)
+	h.Counts[i]++
+	h.Sum += value
+}
+
+// Total returns the number of samples
+func (h Histogram) Total() int64 {
+	var total int64
+	for _, count := range h.Counts {
+		total += count
+	}
+	return total
+}
+
+func (h Histogram) copy() Histogram {
+	counts := make([]int64, len(h.Counts))
+	copy(counts, h.Counts)
+	return Histogram{Bounds: h.Bounds, Counts: counts, Sum: h.Sum}
+}
+
+// pieceTiming follows a piece from the first time it's requested until it
+// completes
+type pieceTiming struct {
+	start       time.Time
+	peers       map[string]struct{} // peers asked to download the piece
+	retransmits int                 // times the piece was requested again after every earlier attempt was dropped
+}
+
+// PieceTimings holds the distribution of how long pieces took to download.
+// It's written by the Controller and read by Stats and the swarm dump.
+type PieceTimings struct {
+	mutex           sync.Mutex
+	latency         Histogram // seconds from the first request of a piece until it's verified
+	peers           Histogram // peers that were asked to download each piece
+	duplicateBlocks Histogram // blocks of each piece received more than once by the peer that finished it
+	retransmits     Histogram
+	recent          []time.Duration // latencies of the most recent pieces, oldest first once full
+	next            int             // index of the oldest entry in recent once full
+}
+
+// PieceTimingStats is a snapshot of the piece timings
+type PieceTimingStats struct {
+	Pieces          int64
+	P50             time.Duration
+	P90             time.Duration
+	P99             time.Duration
+	Latency         Histogram
+	Peers           Histogram
+	DuplicateBlocks Histogram
+	Retransmits     Histogram
+}
+
+func NewPieceTimings() *PieceTimings {
+	return &PieceTimings{
+		latency:         NewHistogram(pieceLatencyBounds),
+		peers:           NewHistogram(pieceCountBounds),
+		duplicateBlocks: NewHistogram(pieceCountBounds),
+		retransmits:     NewHistogram(pieceCountBounds),
+	}
+}
+
+// record adds a completed piece to the distribution
+func (pt *PieceTimings) record(latency time.Duration, peers int, duplicateBlocks int, retransmits int) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.latency.observe(latency.Seconds())
+	pt.peers.observe(float64(peers))
+	pt.duplicateBlocks.observe(float64(duplicateBlocks))
+	pt.retransmits.observe(float64(retransmits))
+	if len(pt.recent) < maxLatencySamples {
+		pt.recent = append(pt.recent, latency)
+	} else {
+		pt.recent[pt.next] = latency
+		pt.next = (pt.next + 1) % maxLatencySamples
+	}
+}
+
+// percentile returns the nearest rank percentile p of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Stats returns the histograms, and the percentiles of the latencies of the
+// most recent pieces
+func (pt *PieceTimings) Stats() PieceTimingStats {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	sorted := make([]time.Duration, len(pt.recent))
+	copy(sorted, pt.recent)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return PieceTimingStats{
+		Pieces:          pt.latency.Total(),
+		P50:             percentile(sorted, 50),
+		P90:             percentile(sorted, 90),
+		P99:             percentile(sorted, 99),
+		Latency:         pt.latency.copy(),
+		Peers:           pt.peers.copy(),
+		DuplicateBlocks: pt.duplicateBlocks.copy(),
+		Retransmits:     pt.retransmits.copy(),
+	}
+}
+
+// pieceRequested starts timing a piece the first time it's requested, and
+// remembers every peer asked to download it. Nothing is recorded if the
+// timings are off.
+func (cont *Controller) pieceRequested(pieceNum int, peerName string) {
+	if cont.timings == nil {
+		return
+	}
+	timing, exists := cont.pieceTimings[pieceNum]
+	if !exists {
+		timing = &pieceTiming{start: cont.clock.Now(), peers: make(map[string]struct{})}
+		cont.pieceTimings[pieceNum] = timing
+	} else if cont.activeRequestsTotals[pieceNum] == 0 {
+		// Every earlier attempt was dropped, by a choke, a disconnect or a
+		// bad copy
+		timing.retransmits++
+	}
+	timing.peers[peerName] = struct{}{}
+}
+
+// pieceCompleted records the timing of a piece that was written and
+// verified. Pieces that weren't requested, such as imported pieces, aren't
+// recorded.
+func (cont *Controller) pieceCompleted(piece ReceivedPiece) {
+	timing, exists := cont.pieceTimings[piece.pieceNum]
+	if !exists {
+		return
+	}
+	delete(cont.pieceTimings, piece.pieceNum)
+	cont.timings.record(cont.clock.Now().Sub(timing.start), len(timing.peers), piece.duplicateBlocks, timing.retransmits)
+}
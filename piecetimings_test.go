@@ -0,0 +1,105 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPieceTimingsPercentiles(t *testing.T) {
+	pt := NewPieceTimings()
+	if stats := pt.Stats(); stats.Pieces != 0 || stats.P50 != 0 || stats.P99 != 0 {
+		t.Errorf("Expected no pieces timed, but got %+v", stats)
+	}
+	for i := 1; i <= 100; i++ {
+		pt.record(time.Duration(i)*10*time.Millisecond, 1+i%2, 0, i/60)
+	}
+	stats := pt.Stats()
+	if stats.Pieces != 100 || stats.P50 != 500*time.Millisecond || stats.P90 != 900*time.Millisecond || stats.P99 != 990*time.Millisecond {
+		t.Errorf("Expected p50 500ms, p90 900ms and p99 990ms over 100 pieces, but got %+v", stats)
+	}
+	// 10ms to 100ms, to 250ms, to 500ms, to 1s
+	if !reflect.DeepEqual(stats.Latency.Counts, []int64{10, 15, 25, 50, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Expected the latencies to be bucketed by their upper bound, but got %v", stats.Latency.Counts)
+	}
+	if !reflect.DeepEqual(stats.Peers.Counts, []int64{0, 50, 50, 0, 0, 0, 0}) || stats.Retransmits.Counts[1] != 41 {
+		t.Errorf("Expected the peers and retransmits to be counted, but got %v and %v", stats.Peers.Counts, stats.Retransmits.Counts)
+	}
+
+	// Only the most recent latencies count towards the percentiles
+	for i := 0; i < maxLatencySamples; i++ {
+		pt.record(2*time.Minute, 1, 3, 0)
+	}
+	stats = pt.Stats()
+	if stats.P50 != 2*time.Minute || stats.Latency.Counts[len(pieceLatencyBounds)] != maxLatencySamples {
+		t.Errorf("Expected the old latencies to be forgotten, but got %+v", stats)
+	}
+	if stats.Pieces != 100+maxLatencySamples || stats.DuplicateBlocks.Total() != stats.Pieces {
+		t.Errorf("Expected every piece in the histograms, but got %+v", stats)
+	}
+}
+
+// Pieces downloaded from a loopback peer that delays every block are timed
+// from their first request until they're verified
+func TestPieceTimingsLoopback(t *testing.T) {
+	const numPieces = 4
+	delay := 50 * time.Millisecond
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := downloadBlockSize
+	data := createTestPayload(numPieces, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	diskio.statsCh = make(chan int, numPieces)
+	go diskio.Run()
+	defer diskio.Stop()
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	listener, _ := startServingPeer(t, infoHash, numPieces, func(pieceNum, begin, length int) []byte {
+		time.Sleep(delay)
+		offset := pieceNum*pieceLength + begin
+		return data[offset : offset+length]
+	})
+	defer listener.Close()
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, numPieces, pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	controller := NewController(make([]bool, numPieces), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	select {
+	case <-controller.completed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the download to complete")
+	}
+
+	// The last piece is recorded before the download is flagged complete
+	stats := controller.timings.Stats()
+	if stats.Pieces != numPieces {
+		t.Fatalf("Expected %d pieces timed, but got %+v", numPieces, stats)
+	}
+	// The peer answers one request at a time, so the nth piece requested
+	// waits for n blocks
+	if stats.P50 < delay || stats.P90 < stats.P50 || stats.P99 < stats.P90 {
+		t.Errorf("Expected ordered percentiles of at least %s, but got %+v", delay, stats)
+	}
+	if stats.P99 > numPieces*delay+time.Second {
+		t.Errorf("Expected a p99 consistent with a delay of %s per block, but got %s", delay, stats.P99)
+	}
+	if stats.Peers.Counts[1] != numPieces || stats.DuplicateBlocks.Counts[0] != numPieces || stats.Retransmits.Counts[0] != numPieces {
+		t.Errorf("Expected every piece from a single peer without duplicates or retransmits, but got %+v", stats)
+	}
+}
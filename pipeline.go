@@ -0,0 +1,52 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Block requests kept outstanding to a peer until its rate is known
+	defaultRequestDepth = 10
+	// Block requests kept outstanding to a peer at most, however fast
+	maxRequestDepth = 250
+	// A peer is kept busy for this long by its outstanding requests, so
+	// that faster peers get deeper pipelines
+	requestQueueTime = 3 * time.Second
+)
+
+// PeerRequestDepth is sent by a peer to the controller when the number of
+// block requests it keeps outstanding changes, so that it's given enough
+// pieces to keep them going
+type PeerRequestDepth struct {
+	peerName string
+	depth    int
+}
+
+// adaptRequestDepth sizes the pipeline of block requests to the peer's
+// download rate, between minRequestDepth and maxRequestDepth
+func (p *Peer) adaptRequestDepth(now time.Time) {
+	rate, _, _ := p.stats.rates(now)
+	depth := int(rate * requestQueueTime.Seconds() / downloadBlockSize)
+	if depth < p.minRequestDepth {
+		depth = p.minRequestDepth
+	}
+	if depth > p.maxRequestDepth {
+		depth = p.maxRequestDepth
+	}
+	if depth == p.requestDepth {
+		return
+	}
+	log.Printf("Peer (%s) : adaptRequestDepth : Keeping %d block requests outstanding, was %d", p.peerName, depth, p.requestDepth)
+	p.requestDepth = depth
+	if p.contTxChans.requestDepth != nil {
+		go func() {
+			p.contTxChans.requestDepth <- PeerRequestDepth{peerName: p.peerName, depth: depth}
+		}()
+	}
+	p.sendOneOrMoreRequests()
+}
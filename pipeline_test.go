@@ -0,0 +1,186 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startLatencyProxy forwards connections to target, delaying what's sent to
+// it by latency, as a link with that round trip time would. What comes back
+// isn't delayed.
+func startLatencyProxy(t *testing.T, target *net.TCPAddr, latency time.Duration) *net.TCPListener {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type chunk struct {
+		data []byte
+		due  time.Time
+	}
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			upstream, err := net.DialTCP("tcp4", nil, target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			line := make(chan chunk, 1024)
+			go func() {
+				defer close(line)
+				for {
+					buf := make([]byte, 32*1024)
+					n, err := conn.Read(buf)
+					if n > 0 {
+						line <- chunk{data: buf[:n], due: time.Now().Add(latency)}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer upstream.Close()
+				for c := range line {
+					time.Sleep(time.Until(c.due))
+					if _, err := upstream.Write(c.data); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 32*1024)
+				for {
+					n, err := upstream.Read(buf)
+					if n > 0 {
+						if _, err := conn.Write(buf[:n]); err != nil {
+							return
+						}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// downloadOverLatency downloads a torrent of numBlocks blocks from a seed
+// behind a link with the given latency, keeping depth to maxDepth block
+// requests outstanding, and returns how long it took
+func downloadOverLatency(t *testing.T, numBlocks int, latency time.Duration, depth int, maxDepth int) time.Duration {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 4 * downloadBlockSize
+	data := createTestPayload(numBlocks/4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	go diskio.Run()
+	defer diskio.Stop()
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+
+	infoHash := make([]byte, 20)
+	var served int32
+	var mutex sync.Mutex
+	var first, last time.Time
+	seed, _ := startServingPeer(t, infoHash, pieceHashes.Len(), func(pieceNum, begin, length int) []byte {
+		mutex.Lock()
+		if first.IsZero() {
+			first = time.Now()
+		}
+		last = time.Now()
+		mutex.Unlock()
+		atomic.AddInt32(&served, 1)
+		offset := pieceNum*pieceLength + begin
+		return data[offset : offset+length]
+	})
+	defer seed.Close()
+	proxy := startLatencyProxy(t, seed.Addr().(*net.TCPAddr), latency)
+	defer proxy.Close()
+
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(infoHash, pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	peerManager.requestDepth, peerManager.maxRequestDepth = depth, maxDepth
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	addr := proxy.Addr().(*net.TCPAddr)
+	trackerManager.peerChans.peers <- PeerTuple{IP: addr.IP, Port: uint16(addr.Port)}
+	deadline := time.Now().Add(20 * time.Second)
+	for atomic.LoadInt32(&served) < int32(numBlocks) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out with %d of %d blocks downloaded at a depth of %d", atomic.LoadInt32(&served), numBlocks, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return last.Sub(first)
+}
+
+// Requests are pipelined, so that a link with latency is kept busy. With a
+// depth of 1 each block waits for the round trip of its request.
+func TestRequestPipelining(t *testing.T) {
+	numBlocks, latency := 48, 10*time.Millisecond
+	pingPong := downloadOverLatency(t, numBlocks, latency, 1, 1)
+	pipelined := downloadOverLatency(t, numBlocks, latency, defaultRequestDepth, maxRequestDepth)
+	if pingPong < time.Duration(numBlocks-1)*latency {
+		t.Errorf("Expected a round trip per block at a depth of 1, but %d blocks took %v", numBlocks, pingPong)
+	}
+	if pipelined > pingPong/4 {
+		t.Errorf("Expected pipelining to take at most a quarter of the %v of a depth of 1, but it took %v", pingPong, pipelined)
+	}
+}
+
+// The request depth follows the peer's download rate within its bounds, and
+// the controller is told when it changes
+func TestAdaptRequestDepth(t *testing.T) {
+	clock := newFakeClock()
+	depths := make(chan PeerRequestDepth, 10)
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{requestDepth: depths}, peerManagerChans{}, nil, clock)
+	p.minRequestDepth, p.maxRequestDepth = 5, 100
+	tests := []struct {
+		rate     int // bytes per second
+		expected int
+	}{
+		{0, 5},
+		{10 * downloadBlockSize, 30},
+		{1000 * downloadBlockSize, 100},
+	}
+	for _, test := range tests {
+		p.stats.resetRates(clock.Now())
+		p.stats.addRead(test.rate)
+		clock.Advance(time.Second)
+		p.adaptRequestDepth(clock.Now())
+		if p.requestDepth != test.expected {
+			t.Errorf("Expected a depth of %d at %d bytes/s, but got %d", test.expected, test.rate, p.requestDepth)
+		}
+		select {
+		case depth := <-depths:
+			if depth.depth != test.expected || depth.peerName != p.peerName {
+				t.Errorf("Expected the controller to be told of a depth of %d, but got %+v", test.expected, depth)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the controller to be told of a depth of %d", test.expected)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Well-known service ports. Peers advertised on them are often the victims
+// of a reflection attack, seeded into trackers so that the swarm connects to
+// them, rather than BitTorrent clients.
+var defaultSuspiciousPorts = []uint16{25, 80, 443, 6667}
+
+// Connections held to a single IP at most, whatever their port
+const defaultMaxConnsPerIP = 3
+
+// Port policy decisions for a candidate peer
+const (
+	portAllowed = iota
+	portSuspicious
+	portBlocked
+)
+
+// PortPolicy decides how candidate peers are dialed by the port they're
+// advertised on. Peers on a suspicious port are dialed at the lowest
+// priority, once there are no other candidates, and never reconnected. Peers
+// on a blocked port aren't dialed at all. Whatever the port, no more than
+// maxConnsPerIP connections are held to one IP, so that we can't be used to
+// flood a single host.
+type PortPolicy struct {
+	// First, to be 64 bit aligned for atomic access on 32 bit platforms
+	demoted       int64 // candidates dialed at the lowest priority, accessed atomically
+	blockedPeers  int64 // candidates dropped for their port, accessed atomically
+	capped        int64 // candidates and connections dropped by the per IP limit, accessed atomically
+	suspicious    map[uint16]bool
+	blocked       map[uint16]bool
+	maxConnsPerIP int // 0 disables the limit
+}
+
+// PortPolicyStats counts the candidates affected by the port policy
+type PortPolicyStats struct {
+	Demoted int64
+	Blocked int64
+	Capped  int64
+}
+
+// NewPortPolicy returns a policy demoting the suspicious ports and dropping
+// the blocked ports. A port in both lists is blocked.
+func NewPortPolicy(suspicious []uint16, blocked []uint16, maxConnsPerIP int) *PortPolicy {
+	pp := &PortPolicy{suspicious: make(map[uint16]bool), blocked: make(map[uint16]bool), maxConnsPerIP: maxConnsPerIP}
+	for _, port := range suspicious {
+		pp.suspicious[port] = true
+	}
+	for _, port := range blocked {
+		pp.blocked[port] = true
+	}
+	return pp
+}
+
+// DefaultPortPolicy returns a policy demoting the well-known service ports
+// and blocking none
+func DefaultPortPolicy() *PortPolicy {
+	return NewPortPolicy(defaultSuspiciousPorts, nil, defaultMaxConnsPerIP)
+}
+
+// ParsePortList parses a comma separated list of ports such as "25,80", an
+// empty string is an empty list
+func ParsePortList(s string) ([]uint16, error) {
+	var ports []uint16
+	if s == "" {
+		return ports, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("Invalid port %q", field)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+// classify returns how a candidate on port is treated
+func (pp *PortPolicy) classify(port uint16) int {
+	if pp.blocked[port] {
+		return portBlocked
+	}
+	if pp.suspicious[port] {
+		return portSuspicious
+	}
+	return portAllowed
+}
+
+// overLimit reports whether conns connections to an IP are already at the
+// per IP limit
+func (pp *PortPolicy) overLimit(conns int) bool {
+	return pp.maxConnsPerIP > 0 && conns >= pp.maxConnsPerIP
+}
+
+// Stats returns the counters of the candidates affected by the policy
+func (pp *PortPolicy) Stats() PortPolicyStats {
+	return PortPolicyStats{
+		Demoted: atomic.LoadInt64(&pp.demoted),
+		Blocked: atomic.LoadInt64(&pp.blockedPeers),
+		Capped:  atomic.LoadInt64(&pp.capped),
+	}
+}
+
+// connsToIP returns the connections held to, and being dialed to, an IP
+func (pm *PeerManager) connsToIP(ip net.IP) int {
+	conns := 0
+	for _, p := range pm.peers {
+		if remoteIP(p.conn).Equal(ip) {
+			conns++
+		}
+	}
+	for peerName := range pm.dialing {
+		host, _, err := net.SplitHostPort(peerName)
+		if err == nil && net.ParseIP(host).Equal(ip) {
+			conns++
+		}
+	}
+	return conns
+}
+
+// admitCandidate applies the port policy to a peer advertised by a tracker.
+// It returns false if the peer is dropped. A peer on a suspicious port is
+// queued behind every other candidate instead of being dialed right away.
+func (pm *PeerManager) admitCandidate(peer PeerTuple) bool {
+	switch pm.ports.classify(peer.Port) {
+	case portBlocked:
+		log.Printf("PeerManager : admitCandidate : Dropping %s:%d, port %d is blocked", peer.IP, peer.Port, peer.Port)
+		atomic.AddInt64(&pm.ports.blockedPeers, 1)
+		return false
+	case portSuspicious:
+		log.Printf("PeerManager : admitCandidate : %s:%d is on a suspicious port, dialing it last and only once", peer.IP, peer.Port)
+		atomic.AddInt64(&pm.ports.demoted, 1)
+		pm.addLowPriorityCandidate(peer)
+		pm.dialCandidates()
+		return false
+	}
+	return true
+}
+
+// capped reports whether we're at the limit of connections to an IP, and
+// counts the candidate or connection dropped if so
+func (pm *PeerManager) capped(ip net.IP) bool {
+	if !pm.ports.overLimit(pm.connsToIP(ip)) {
+		return false
+	}
+	log.Printf("PeerManager : capped : Not connecting to %s again, at the limit of %d connections to one IP", ip, pm.ports.maxConnsPerIP)
+	atomic.AddInt64(&pm.ports.capped, 1)
+	return true
+}
+
+// addLowPriorityCandidate remembers a peer on a suspicious port to dial once
+// there are no other candidates. Only the most recent maxPeers are kept.
+func (pm *PeerManager) addLowPriorityCandidate(peer PeerTuple) {
+	for _, candidate := range pm.lowPriority {
+		if candidate.IP.Equal(peer.IP) && candidate.Port == peer.Port {
+			return
+		}
+	}
+	pm.lowPriority = append(pm.lowPriority, peer)
+	if len(pm.lowPriority) > pm.maxPeers {
+		pm.lowPriority = pm.lowPriority[1:]
+	}
+}
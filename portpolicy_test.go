@@ -0,0 +1,136 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// createTestPeerManager returns a PeerManager that isn't running, for
+// exercising its bookkeeping directly
+func createTestPeerManager(maxPeers int) *PeerManager {
+	trackerManager := NewTrackerManager(6881)
+	return NewPeerManager(make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, serverPeerChans{}, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, maxPeers)
+}
+
+func TestParsePortList(t *testing.T) {
+	ports, err := ParsePortList("25, 80,6667")
+	if err != nil || !reflect.DeepEqual(ports, []uint16{25, 80, 6667}) {
+		t.Errorf("Expected ports [25 80 6667], but got %v and %v", ports, err)
+	}
+	ports, err = ParsePortList("")
+	if err != nil || len(ports) != 0 {
+		t.Errorf("Expected no ports, but got %v and %v", ports, err)
+	}
+	for _, s := range []string{"25,", "0", "65536", "smtp"} {
+		_, err := ParsePortList(s)
+		if err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+// A candidate on port 25 is dialed only after every other candidate, and a
+// blocked port isn't dialed at all
+func TestPortPolicyDemotesAndBlocks(t *testing.T) {
+	pm := createTestPeerManager(1)
+	defer close(pm.quit)
+	// Nothing listens on these addresses, dials are refused right away
+	suspicious := PeerTuple{IP: net.IPv4(127, 0, 0, 2), Port: 25}
+	normal := PeerTuple{IP: net.IPv4(127, 0, 0, 3), Port: 6881}
+
+	// At the max, so both are remembered
+	pm.dialing["127.0.0.1:1"] = pm.clock.Now()
+	if pm.admitCandidate(suspicious) {
+		t.Errorf("Expected %v to be demoted", suspicious)
+	}
+	if !pm.admitCandidate(normal) {
+		t.Errorf("Expected %v to be admitted", normal)
+	}
+	pm.addCandidate(normal)
+
+	delete(pm.dialing, "127.0.0.1:1")
+	pm.dialCandidates()
+	if _, ok := pm.dialing["127.0.0.3:6881"]; !ok || len(pm.dialing) != 1 {
+		t.Errorf("Expected only %v to be dialed first, but dialing %v", normal, pm.dialing)
+	}
+	pm.dialing = make(map[string]time.Time)
+	pm.dialCandidates()
+	if _, ok := pm.dialing["127.0.0.2:25"]; !ok {
+		t.Errorf("Expected %v to be dialed once there were no other candidates, but dialing %v", suspicious, pm.dialing)
+	}
+	if stats := pm.ports.Stats(); stats.Demoted != 1 {
+		t.Errorf("Expected 1 candidate demoted, but got %+v", stats)
+	}
+
+	pm.ports = NewPortPolicy(defaultSuspiciousPorts, []uint16{25}, defaultMaxConnsPerIP)
+	pm.dialing = make(map[string]time.Time)
+	if pm.admitCandidate(suspicious) || len(pm.lowPriority) != 0 {
+		t.Errorf("Expected %v to be dropped", suspicious)
+	}
+	pm.dialCandidates()
+	if len(pm.dialing) != 0 {
+		t.Errorf("Expected nothing to be dialed, but dialing %v", pm.dialing)
+	}
+	if stats := pm.ports.Stats(); stats.Blocked != 1 {
+		t.Errorf("Expected 1 candidate blocked, but got %+v", stats)
+	}
+}
+
+// No more than the limit of connections are held to one IP, whatever the
+// port
+func TestPortPolicyConnsPerIP(t *testing.T) {
+	pm := createTestPeerManager(10)
+	defer close(pm.quit)
+	pm.ports = NewPortPolicy(defaultSuspiciousPorts, nil, 2)
+	pm.dialing["10.0.0.1:6881"] = pm.clock.Now()
+	if pm.capped(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Expected a second connection to be allowed")
+	}
+	pm.dialing["10.0.0.1:6882"] = pm.clock.Now()
+	pm.addCandidate(PeerTuple{IP: net.IPv4(10, 0, 0, 1), Port: 25})
+	pm.addCandidate(PeerTuple{IP: net.IPv4(10, 0, 0, 1), Port: 6883})
+	pm.dialCandidates()
+	if len(pm.dialing) != 2 {
+		t.Errorf("Expected no more connections to 10.0.0.1, but dialing %v", pm.dialing)
+	}
+	if pm.capped(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Expected another IP not to be limited")
+	}
+	if stats := pm.ports.Stats(); stats.Capped != 2 {
+		t.Errorf("Expected 2 candidates over the limit, but got %+v", stats)
+	}
+}
+
+// A peer on a suspicious port that drops isn't reconnected
+func TestPortPolicyNoReconnect(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	conn, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, suspicious := range []bool{false, true} {
+		pm := createTestPeerManager(10)
+		if suspicious {
+			pm.ports = NewPortPolicy([]uint16{port}, nil, defaultMaxConnsPerIP)
+		}
+		p := &Peer{peerName: conn.RemoteAddr().String(), conn: conn, outbound: true, connectedAt: pm.clock.Now()}
+		pm.reconnectLater(p)
+		if _, ok := pm.reconnects[p.peerName]; ok == suspicious {
+			t.Errorf("Expected a reconnect to be scheduled only for a peer on an allowed port, suspicious %v", suspicious)
+		}
+		close(pm.quit)
+	}
+}
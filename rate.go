@@ -0,0 +1,142 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Time constant of the transfer rate averages kept by Stats
+const rateWindow = 20 * time.Second
+
+// Peers that haven't reported their counters for this long are dropped from
+// the per peer rates
+const peerRateExpiry = 2 * rateWindow
+
+// RateMeter measures a transfer rate as an exponentially weighted moving
+// average, so that bytes counted window ago weigh 1/e as much as bytes
+// counted now
+type RateMeter struct {
+	window  time.Duration
+	rate    float64   // bytes per second, as of last
+	last    time.Time // time of the last update
+	pending int       // bytes counted at last, added to the rate at the next update
+}
+
+func NewRateMeter(window time.Duration, now time.Time) *RateMeter {
+	return &RateMeter{window: window, last: now}
+}
+
+// add counts n bytes transferred at now
+func (rm *RateMeter) add(n int, now time.Time) {
+	rm.pending += n
+	elapsed := now.Sub(rm.last)
+	if elapsed < 0 {
+		// The clock stepped back, measure from now on
+		rm.last = now
+		return
+	} else if elapsed == 0 {
+		return
+	}
+	alpha := 1 - math.Exp(-elapsed.Seconds()/rm.window.Seconds())
+	rm.rate += alpha * (float64(rm.pending)/elapsed.Seconds() - rm.rate)
+	rm.last = now
+	rm.pending = 0
+}
+
+// Rate returns the rate in bytes per second at now, decayed for the time
+// since the last update
+func (rm *RateMeter) Rate(now time.Time) float64 {
+	elapsed := now.Sub(rm.last)
+	if elapsed <= 0 {
+		return rm.rate
+	}
+	return rm.rate * math.Exp(-elapsed.Seconds()/rm.window.Seconds())
+}
+
+// peerRates follows the counters reported by a peer
+type peerRates struct {
+	read   int // last cumulative bytes read reported
+	write  int // last cumulative bytes written reported
+	errors int // last cumulative errors reported
+	// Connection the counters are of, a peer that reconnects from a new
+	// port keeps its identity but restarts its counters
+	connection int
+	download   *RateMeter
+	upload     *RateMeter
+	updated    time.Time
+}
+
+// PeerRate is the transfer rates of a peer, in bytes per second
+type PeerRate struct {
+	Download float64
+	Upload   float64
+}
+
+// TransferRates is a snapshot of the transfer rates, in bytes per second
+type TransferRates struct {
+	DownloadRate float64
+	UploadRate   float64
+	Peers        map[string]PeerRate // by peer identity
+}
+
+// countPeer adds the bytes a peer transferred since its last report to the
+// totals and the rates. Peers report cumulative counters, which restart when
+// a peer reconnects. Reports of a connection replaced by a newer one to the
+// same peer are ignored, the replaced connection is dead.
+func (s *Stats) countPeer(stat peerStatsSnapshot) {
+	now := s.clock.Now()
+	peer, ok := s.peers[stat.peerName]
+	if !ok {
+		peer = &peerRates{download: NewRateMeter(rateWindow, now), upload: NewRateMeter(rateWindow, now), connection: stat.connection}
+		s.peers[stat.peerName] = peer
+	}
+	if stat.connection < peer.connection {
+		return
+	}
+	read, write, errors := stat.read-peer.read, stat.write-peer.write, stat.errors-peer.errors
+	if stat.connection > peer.connection || read < 0 || write < 0 || errors < 0 {
+		read, write, errors = stat.read, stat.write, stat.errors
+	}
+	peer.read, peer.write, peer.errors, peer.updated = stat.read, stat.write, stat.errors, now
+	peer.connection = stat.connection
+	peer.download.add(read, now)
+	peer.upload.add(write, now)
+	s.download.add(read, now)
+	s.upload.add(write, now)
+	s.Downloaded += read
+	s.Uploaded += write
+	s.Errors += errors
+}
+
+// expirePeers forgets the rates of peers that stopped reporting, because
+// they disconnected
+func (s *Stats) expirePeers() {
+	now := s.clock.Now()
+	for peerName, peer := range s.peers {
+		if now.Sub(peer.updated) > peerRateExpiry {
+			delete(s.peers, peerName)
+		}
+	}
+}
+
+// rates returns a snapshot of the global and per peer rates
+func (s *Stats) rates() TransferRates {
+	now := s.clock.Now()
+	rates := TransferRates{DownloadRate: s.download.Rate(now), UploadRate: s.upload.Rate(now), Peers: make(map[string]PeerRate)}
+	for peerName, peer := range s.peers {
+		rates.Peers[peerName] = PeerRate{Download: peer.download.Rate(now), Upload: peer.upload.Rate(now)}
+	}
+	return rates
+}
+
+// Rates returns the global and per peer transfer rates. Stats must be
+// running.
+func (s *Stats) Rates() TransferRates {
+	reply := make(chan TransferRates)
+	s.rateRequests <- reply
+	return <-reply
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// withinTolerance returns true if rate is within tolerance, a fraction, of
+// expected
+func withinTolerance(rate float64, expected float64, tolerance float64) bool {
+	return math.Abs(rate-expected) <= expected*tolerance
+}
+
+func TestRateMeter(t *testing.T) {
+	clock := newFakeClock()
+	rm := NewRateMeter(rateWindow, clock.Now())
+	// 10 KB/s, reported at irregular intervals
+	for elapsed := time.Duration(0); elapsed < 6*rateWindow; {
+		step := time.Second
+		if elapsed%(3*time.Second) == 0 {
+			step = 500 * time.Millisecond
+		}
+		clock.Advance(step)
+		elapsed += step
+		rm.add(int(10*1024*step.Seconds()), clock.Now())
+	}
+	if rate := rm.Rate(clock.Now()); !withinTolerance(rate, 10*1024, 0.01) {
+		t.Errorf("Expected a rate of about %d bytes/s, but got %.0f", 10*1024, rate)
+	}
+
+	// Bytes counted at the same instant are added at the next update
+	rm.add(10*1024, clock.Now())
+	clock.Advance(time.Second)
+	rm.add(0, clock.Now())
+	if rate := rm.Rate(clock.Now()); !withinTolerance(rate, 10*1024, 0.01) {
+		t.Errorf("Expected a rate of about %d bytes/s, but got %.0f", 10*1024, rate)
+	}
+
+	// Idle for one window, the rate decays to 1/e
+	clock.Advance(rateWindow)
+	if rate := rm.Rate(clock.Now()); !withinTolerance(rate, 10*1024/math.E, 0.01) {
+		t.Errorf("Expected the rate to decay to about %.0f bytes/s, but got %.0f", 10*1024/math.E, rate)
+	}
+}
+
+// Stats turns the cumulative counters reported by peers into totals and
+// rates, per peer and for the torrent
+func TestStatsPeerRates(t *testing.T) {
+	clock := newFakeClock()
+	s := NewStats(0, nil)
+	s.clock = clock
+	s.download, s.upload = NewRateMeter(rateWindow, clock.Now()), NewRateMeter(rateWindow, clock.Now())
+
+	peerA, peerB := "10.0.0.1:6881", "10.0.0.2:6881"
+	var readA, writeB int
+	for second := 0; second < 120; second++ {
+		clock.Advance(time.Second)
+		readA += 10 * 1024
+		writeB += 5 * 1024
+		s.countPeer(peerStatsSnapshot{peerName: peerA, read: readA})
+		s.countPeer(peerStatsSnapshot{peerName: peerB, write: writeB, errors: 1})
+	}
+	if s.Downloaded != readA || s.Uploaded != writeB || s.Errors != 1 {
+		t.Errorf("Expected %d bytes downloaded, %d uploaded and 1 error, but got %d, %d and %d", readA, writeB, s.Downloaded, s.Uploaded, s.Errors)
+	}
+	rates := s.rates()
+	if !withinTolerance(rates.DownloadRate, 10*1024, 0.02) || !withinTolerance(rates.UploadRate, 5*1024, 0.02) {
+		t.Errorf("Expected rates of about %d and %d bytes/s, but got %+v", 10*1024, 5*1024, rates)
+	}
+	if !withinTolerance(rates.Peers[peerA].Download, 10*1024, 0.02) || rates.Peers[peerA].Upload != 0 || !withinTolerance(rates.Peers[peerB].Upload, 5*1024, 0.02) {
+		t.Errorf("Expected the rates of each peer, but got %+v", rates.Peers)
+	}
+
+	// Peer A reconnects and its counters restart, peer B disconnects
+	readA = 0
+	downloaded := s.Downloaded
+	for second := 0; second <= int(peerRateExpiry/time.Second); second++ {
+		clock.Advance(time.Second)
+		readA += 10 * 1024
+		s.countPeer(peerStatsSnapshot{peerName: peerA, read: readA})
+	}
+	if s.Downloaded != downloaded+readA {
+		t.Errorf("Expected %d bytes downloaded after the reconnect, but got %d", downloaded+readA, s.Downloaded)
+	}
+	s.expirePeers()
+	rates = s.rates()
+	if _, ok := rates.Peers[peerB]; ok || len(rates.Peers) != 1 {
+		t.Errorf("Expected only %s to be left, but got %+v", peerA, rates.Peers)
+	}
+	if !withinTolerance(rates.DownloadRate, 10*1024, 0.02) || rates.UploadRate > 5*1024/math.E {
+		t.Errorf("Expected the upload rate to decay since %s left, but got %+v", peerB, rates)
+	}
+}
+
+func TestStatsETA(t *testing.T) {
+	if eta := estimateETA(10*1024*1024, 10*1024); eta != 1024*time.Second {
+		t.Errorf("Expected 10 MB at 10 KB/s to take %s, but got %s", 1024*time.Second, eta)
+	}
+	if eta := estimateETA(1024, 0); eta != InfiniteETA {
+		t.Errorf("Expected an infinite ETA at a rate of zero, but got %s", eta)
+	}
+	if eta := estimateETA(0, 0); eta != 0 {
+		t.Errorf("Expected no ETA with nothing left, but got %s", eta)
+	}
+	if eta := estimateETA(math.MaxInt, 1e-9); eta != InfiniteETA {
+		t.Errorf("Expected an ETA too large for a Duration to be infinite, but got %d", eta)
+	}
+	if percent := percentComplete(750, 1000); percent != 25 {
+		t.Errorf("Expected 25%% complete, but got %.1f%%", percent)
+	}
+	if percent := percentComplete(0, 0); percent != 100 {
+		t.Errorf("Expected a torrent with nothing wanted to be complete, but got %.1f%%", percent)
+	}
+
+	// A peer downloading at 10 KB/s, with 1 MB of 4 MB left
+	clock := newFakeClock()
+	s := NewStats(1024*1024, nil)
+	s.Total = 4 * 1024 * 1024
+	s.clock = clock
+	s.download, s.upload = NewRateMeter(rateWindow, clock.Now()), NewRateMeter(rateWindow, clock.Now())
+	var read int
+	for second := 0; second < 120; second++ {
+		clock.Advance(time.Second)
+		read += 10 * 1024
+		s.countPeer(peerStatsSnapshot{peerName: "10.0.0.1:6881", read: read})
+	}
+	go s.Run()
+	defer s.Stop()
+	snapshot := s.Snapshot()
+	if snapshot.Left != 1024*1024 || snapshot.PercentComplete != 75 || snapshot.Downloaded != read || snapshot.Peers != 1 {
+		t.Errorf("Expected 75%% complete with 1 MB left from one peer, but got %+v", snapshot)
+	}
+	if !withinTolerance(snapshot.ETA.Seconds(), 1024*1024/snapshot.DownloadRate, 0.001) || !withinTolerance(snapshot.ETA.Seconds(), 102.4, 0.02) {
+		t.Errorf("Expected an ETA of about %.1fs, but got %s", 102.4, snapshot.ETA)
+	}
+}
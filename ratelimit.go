@@ -0,0 +1,72 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter caps a transfer rate with a token bucket shared by every peer.
+// The bucket fills at the rate, up to a second's worth of bytes. A transfer
+// takes its bytes from the bucket even if that empties it, and whoever
+// transfers next waits for the bucket to fill back up, so transfers larger
+// than the bucket are allowed and the rate still holds over time.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second, 0 for no limit
+	tokens float64 // bytes that may be transferred now, negative while in debt
+	last   time.Time
+	clock  Clock
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second, or nil if rate
+// is 0. A nil limiter doesn't limit.
+func NewRateLimiter(rate int64, clock Clock) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	clock = clockOrSystem(clock)
+	return &RateLimiter{rate: float64(rate), tokens: float64(rate), last: clock.Now(), clock: clock}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// transferring them
+func (rl *RateLimiter) reserve(n int) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	now := rl.clock.Now()
+	if elapsed := now.Sub(rl.last); elapsed > 0 {
+		rl.tokens += elapsed.Seconds() * rl.rate
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+	}
+	rl.last = now
+	wait := time.Duration(0)
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.tokens -= float64(n)
+	return wait
+}
+
+// wait blocks until n bytes may be transferred. It returns false if stop is
+// closed first.
+func (rl *RateLimiter) wait(n int, stop <-chan struct{}) bool {
+	if rl == nil {
+		return true
+	}
+	wait := rl.reserve(n)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-rl.clock.After(wait):
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Bytes transferred under a limiter in a window are at most the rate over
+// the window, plus the bucket and the transfer that emptied it
+func rateLimitBound(rate int64, window time.Duration, transfer int) int64 {
+	return rate + int64(float64(rate)*window.Seconds()) + int64(transfer)
+}
+
+// Several peers transferring at once share the rate
+func TestRateLimiter(t *testing.T) {
+	const rate, transfer, peers = 64 * 1024, downloadBlockSize, 4
+	window := 500 * time.Millisecond
+	if NewRateLimiter(0, nil) != nil {
+		t.Errorf("Expected no limiter for a rate of 0")
+	}
+	var nilLimiter *RateLimiter
+	if !nilLimiter.wait(transfer, nil) {
+		t.Errorf("Expected a nil limiter not to limit")
+	}
+
+	rl := NewRateLimiter(rate, systemClock)
+	stop := make(chan struct{})
+	var transferred int64
+	var wg sync.WaitGroup
+	for i := 0; i < peers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rl.wait(transfer, stop) {
+				select {
+				case <-stop:
+					return
+				default:
+					atomic.AddInt64(&transferred, transfer)
+				}
+			}
+		}()
+	}
+	time.Sleep(window)
+	close(stop)
+	wg.Wait()
+	if limit := rateLimitBound(rate, window, transfer); transferred > limit || transferred < rate {
+		t.Errorf("Expected between %d and %d bytes to be transferred in %v, but %d were", rate, limit, window, transferred)
+	}
+}
+
+// The writer of a peer waits on the upload limit before sending a message
+func TestPeerUploadLimit(t *testing.T) {
+	const rate, messageLength = 32 * 1024, 4 * 1024
+	window := 500 * time.Millisecond
+	local, remote := net.Pipe()
+	defer remote.Close()
+	p := NewPeer("10.0.0.1:6881", make([]byte, 20), 4, 1024, 4096, diskIOPeerChans{}, ControllerPeerChans{}, PeerControllerChans{}, peerManagerChans{deadPeer: make(chan string, 1)}, nil, systemClock)
+	p.conn = local
+	p.uploadLimit = NewRateLimiter(rate, systemClock)
+	go p.writer()
+	defer p.Stop()
+	go func() {
+		for {
+			select {
+			case p.sendChan <- make([]byte, messageLength):
+			case <-p.stopping:
+				return
+			}
+		}
+	}()
+
+	var received int64
+	deadline := time.Now().Add(window)
+	remote.SetReadDeadline(deadline)
+	buf := make([]byte, messageLength)
+	for {
+		n, err := remote.Read(buf)
+		received += int64(n)
+		if err == io.EOF || time.Now().After(deadline) || err != nil {
+			break
+		}
+	}
+	if limit := rateLimitBound(rate, window, messageLength); received > limit || received == 0 {
+		t.Errorf("Expected at most %d bytes to be sent in %v, but %d were", limit, window, received)
+	}
+}
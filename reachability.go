@@ -0,0 +1,221 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Whether peers can connect to us, as inferred by Reachability
+const (
+	ReachabilityUnknown = iota
+	Reachable
+	Firewalled
+	InboundFailing
+)
+
+var reachabilityNames = []string{"unknown", "reachable", "firewalled", "inbound connections failing"}
+
+// We're only judged firewalled once both this long has passed and this many
+// peers are known without a single inbound handshake, so that a quiet swarm
+// isn't mistaken for an unforwarded port
+const (
+	firewalledAfter      = 10 * time.Minute
+	minKnownPeers        = 10
+	firewalledDialFactor = 2 // when firewalled, reconnect attempts are multiplied by this and their backoff divided
+)
+
+// A peer that drops its connection to us before the handshake, and accepts
+// ours within inboundFailureWindow, shows that inbound connections reach us
+// but fail. Scanners drop connections too, so only peers from the tracker,
+// which know our address from our announce, are counted, and
+// minInboundFailures of them are needed for a verdict.
+const (
+	inboundFailureWindow = 2 * time.Minute
+	minInboundFailures   = 3
+	maxAnnouncedPeers    = 1000 // IPs of tracker peers remembered since the check started
+)
+
+// Reachability infers whether other peers can connect to us, from whether
+// any inbound handshake completes. Nothing asks peers to connect back, since
+// neither trackers nor the protocol offer that. The check starts over at
+// startup and whenever our listen port or IP changes.
+//
+// Inbound connections may also reach us and then fail, as when a firewall or
+// an MTU problem on the path kills them after the TCP handshake. That's told
+// apart from a closed port by tracker peers whose connections to us are
+// aborted before their handshake, yet which accept our connections.
+type Reachability struct {
+	mutex           sync.Mutex
+	state           int
+	since           time.Time            // when the check started
+	knownPeers      map[string]bool      // distinct peers heard of since the check started, up to minKnownPeers
+	inbound         int                  // inbound handshakes since the check started
+	announced       map[string]bool      // IPs of tracker peers, which know our address
+	aborted         map[string]time.Time // IPs of tracker peers, by when their last connection to us was aborted
+	abortedInbound  int                  // inbound connections of tracker peers aborted before their handshake
+	inboundFailures int                  // aborted peers that accepted our connection within inboundFailureWindow
+	port            uint16               // our listen port, suggested for forwarding when we're firewalled
+	resets          chan struct{}        // signals the PeerManager to start the check over
+}
+
+// ReachabilityStats is the state of the reachability check
+type ReachabilityStats struct {
+	State           int
+	Inbound         int // inbound handshakes since the check started
+	KnownPeers      int // distinct peers heard of since the check started, up to minKnownPeers
+	AbortedInbound  int // inbound connections of tracker peers aborted before their handshake
+	InboundFailures int // aborted peers that accepted our connection soon after
+	Port            uint16
+}
+
+func NewReachability() *Reachability {
+	return &Reachability{knownPeers: make(map[string]bool), announced: make(map[string]bool), aborted: make(map[string]time.Time), resets: make(chan struct{}, 1)}
+}
+
+// reset starts the check over at now
+func (r *Reachability) reset(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	log.Printf("Reachability : reset : Checking whether peers can connect to us, was %s", reachabilityNames[r.state])
+	r.state = ReachabilityUnknown
+	r.since = now
+	r.knownPeers = make(map[string]bool)
+	r.inbound = 0
+	r.announced = make(map[string]bool)
+	r.aborted = make(map[string]time.Time)
+	r.abortedInbound = 0
+	r.inboundFailures = 0
+}
+
+// peerKnown records a peer we've heard of, from a tracker or by connecting
+// to it
+func (r *Reachability) peerKnown(peerName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.knownPeers) < minKnownPeers {
+		r.knownPeers[peerName] = true
+	}
+}
+
+// trackerPeer records the IP of a peer from the tracker, which knows our
+// address since we announced to the tracker
+func (r *Reachability) trackerPeer(ip net.IP) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.announced) < maxAnnouncedPeers {
+		r.announced[ip.String()] = true
+	}
+}
+
+// abortedHandshake returns true if a handshake failed because the
+// connection was closed or stalled, rather than because the peer sent an
+// invalid handshake
+func abortedHandshake(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// inboundAborted records an incoming connection from ip that was aborted
+// before the peer's handshake. Only tracker peers are remembered.
+func (r *Reachability) inboundAborted(ip net.IP, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.announced[ip.String()] {
+		return
+	}
+	r.abortedInbound++
+	r.aborted[ip.String()] = now
+	for abortedIP, at := range r.aborted {
+		if now.Sub(at) > inboundFailureWindow {
+			delete(r.aborted, abortedIP)
+		}
+	}
+}
+
+// outboundConnected records a handshake completed on a connection we made to
+// ip. A peer that did so soon after its own connection to us was aborted is
+// evidence that inbound connections fail.
+func (r *Reachability) outboundConnected(ip net.IP, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	at, ok := r.aborted[ip.String()]
+	if !ok {
+		return
+	}
+	delete(r.aborted, ip.String())
+	if now.Sub(at) <= inboundFailureWindow {
+		r.inboundFailures++
+		log.Printf("Reachability : outboundConnected : %s accepted our connection %v after its connection to us was aborted, %d such peers", ip, now.Sub(at), r.inboundFailures)
+	}
+}
+
+// inboundHandshake records a peer that connected to us, which proves we're
+// reachable
+func (r *Reachability) inboundHandshake() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.inbound++
+	if r.state != Reachable {
+		log.Printf("Reachability : inboundHandshake : A peer connected to us, we're reachable")
+		r.state = Reachable
+	}
+}
+
+// update judges that our inbound connections fail once enough peers have
+// shown it, or else that we're firewalled if no peer has connected to us for
+// long enough while enough peers were known
+func (r *Reachability) update(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.state != Reachable && r.state != InboundFailing && r.inboundFailures >= minInboundFailures {
+		r.state = InboundFailing
+		log.Printf("Reachability : update : ALERT: Inbound connections failing. %d peers from the tracker dropped "+
+			"their connection to us before the handshake, then accepted ours, of %d aborted inbound connections "+
+			"and %d inbound handshakes. Port %d is open, but something on the path kills inbound connections, "+
+			"check the firewall and the MTU or MSS clamping of the router.", r.inboundFailures, r.abortedInbound, r.inbound, r.port)
+		return
+	}
+	if r.state != ReachabilityUnknown || now.Sub(r.since) < firewalledAfter || len(r.knownPeers) < minKnownPeers {
+		return
+	}
+	r.state = Firewalled
+	log.Printf("Reachability : update : WARNING: No peer has connected to us in %v while %d peers were known. "+
+		"We appear to be firewalled, so every connection must be made by us. Forward TCP port %d to this host, "+
+		"or enable UPnP on the router, to reach more peers.", now.Sub(r.since), len(r.knownPeers), r.port)
+}
+
+// firewalled returns true if we're judged unreachable, either because the
+// port is closed or because inbound connections fail
+func (r *Reachability) firewalled() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.state == Firewalled || r.state == InboundFailing
+}
+
+// Stats returns the state of the check
+func (r *Reachability) Stats() ReachabilityStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return ReachabilityStats{State: r.state, Inbound: r.inbound, KnownPeers: len(r.knownPeers), AbortedInbound: r.abortedInbound, InboundFailures: r.inboundFailures, Port: r.port}
+}
+
+// ResetReachability starts the reachability check over, it should be
+// called when our listen port or external IP changes. It may be called
+// before or while the torrent runs.
+func (t *Torrent) ResetReachability() {
+	select {
+	case t.reachability.resets <- struct{}{}:
+	default:
+		// A reset is already waiting
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// We're only judged firewalled once enough time has passed and enough peers
+// are known, and any inbound handshake makes us reachable
+func TestReachabilityVerdicts(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		elapsed time.Duration
+		known   int
+		inbound bool
+		state   int
+	}{
+		{time.Minute, minKnownPeers, false, ReachabilityUnknown},
+		{firewalledAfter - time.Second, minKnownPeers * 2, false, ReachabilityUnknown},
+		{time.Hour, minKnownPeers - 1, false, ReachabilityUnknown},
+		{firewalledAfter, minKnownPeers, false, Firewalled},
+		{time.Minute, 0, true, Reachable},
+		{time.Hour, minKnownPeers, true, Reachable},
+	}
+	for _, test := range tests {
+		r := NewReachability()
+		r.reset(start)
+		for i := 0; i < test.known; i++ {
+			r.peerKnown(fmt.Sprintf("10.0.0.%d:6881", i))
+			// A peer heard of twice is only counted once
+			r.peerKnown(fmt.Sprintf("10.0.0.%d:6881", i))
+		}
+		if test.inbound {
+			r.inboundHandshake()
+		}
+		r.update(start.Add(test.elapsed))
+		if stats := r.Stats(); stats.State != test.state {
+			t.Errorf("Expected %s after %v with %d peers known and inbound %v, but got %s", reachabilityNames[test.state], test.elapsed, test.known, test.inbound, reachabilityNames[stats.State])
+		}
+	}
+
+	r := NewReachability()
+	r.reset(start)
+	for i := 0; i < minKnownPeers; i++ {
+		r.peerKnown(fmt.Sprintf("10.0.0.%d:6881", i))
+	}
+	r.update(start.Add(firewalledAfter))
+	r.inboundHandshake()
+	if r.Stats().State != Reachable {
+		t.Errorf("Expected an inbound handshake to make us reachable after being firewalled")
+	}
+	r.reset(start.Add(time.Hour))
+	if stats := r.Stats(); stats.State != ReachabilityUnknown || stats.KnownPeers != 0 || stats.Inbound != 0 {
+		t.Errorf("Expected a reset to start the check over, but got %+v", stats)
+	}
+}
+
+// Tracker peers that drop their connection to us before the handshake and
+// then accept ours show that inbound connections fail, other peers and late
+// connections aren't evidence of it
+func TestReachabilityInboundFailing(t *testing.T) {
+	start := time.Now()
+	r := NewReachability()
+	r.reset(start)
+	now := start
+	for i := 0; i < minInboundFailures; i++ {
+		now = now.Add(time.Minute)
+		scanner := net.IPv4(192, 0, 2, byte(i+1))
+		r.inboundAborted(scanner, now)
+		r.outboundConnected(scanner, now.Add(time.Second))
+
+		late := net.IPv4(10, 0, 1, byte(i+1))
+		r.trackerPeer(late)
+		r.inboundAborted(late, now)
+		r.outboundConnected(late, now.Add(inboundFailureWindow+time.Second))
+
+		peer := net.IPv4(10, 0, 0, byte(i+1))
+		r.trackerPeer(peer)
+		r.inboundAborted(peer, now)
+		r.update(now)
+		if state := r.Stats().State; state != ReachabilityUnknown {
+			t.Fatalf("Expected no verdict before %d peers failed inbound, but got %s", minInboundFailures, reachabilityNames[state])
+		}
+		r.outboundConnected(peer, now.Add(10*time.Second))
+		// Only the first connection after an aborted one counts
+		r.outboundConnected(peer, now.Add(20*time.Second))
+	}
+	r.update(now)
+	stats := r.Stats()
+	if stats.State != InboundFailing || !r.firewalled() {
+		t.Errorf("Expected inbound connections failing, but got %s", reachabilityNames[stats.State])
+	}
+	if stats.InboundFailures != minInboundFailures || stats.AbortedInbound != 2*minInboundFailures {
+		t.Errorf("Expected %d inbound failures of %d aborted connections, but got %+v", minInboundFailures, 2*minInboundFailures, stats)
+	}
+	// It takes precedence over a closed port
+	for i := 0; i < minKnownPeers; i++ {
+		r.peerKnown(fmt.Sprintf("10.0.0.%d:6881", i))
+	}
+	r.update(start.Add(time.Hour))
+	if state := r.Stats().State; state != InboundFailing {
+		t.Errorf("Expected inbound connections failing to stand, but got %s", reachabilityNames[state])
+	}
+	r.inboundHandshake()
+	if state := r.Stats().State; state != Reachable {
+		t.Errorf("Expected an inbound handshake to make us reachable, but got %s", reachabilityNames[state])
+	}
+
+	for _, test := range []struct {
+		err     error
+		aborted bool
+	}{
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{errors.New("Invalid infoHash"), false},
+		{errSelfConnection, false},
+	} {
+		if aborted := abortedHandshake(test.err); aborted != test.aborted {
+			t.Errorf("Expected %v to be aborted %t, but got %t", test.err, test.aborted, aborted)
+		}
+	}
+}
+
+// waitForReachability waits for the PeerManager's reachability to be state
+func waitForReachability(t *testing.T, pm *PeerManager, state int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pm.reachability.Stats().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for reachability %s, it's %s", reachabilityNames[state], reachabilityNames[pm.reachability.Stats().State])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A PeerManager that never receives an inbound handshake from a busy swarm
+// judges us firewalled, and is reachable again once a peer connects to it
+func TestPeerManagerReachability(t *testing.T) {
+	// Nothing listens on this port, dials are refused right away
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := uint16(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	for _, busy := range []bool{false, true} {
+		infoHash := make([]byte, 20)
+		numPieces := 4
+		clock := newFakeClock()
+		serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+		trackerManager := NewTrackerManager(6881)
+		pm := NewPeerManager(infoHash, numPieces, 1024, 4096, diskIOPeerChans{}, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+		pm.clock = clock
+		controller := NewController(make([]bool, numPieces), PieceHashes(make([]byte, numPieces*sha1.Size)), ControllerDiskIOChans{}, pm.contChans, pm.peerContChans)
+		go controller.Run()
+		go pm.Run()
+		clock.waitForTimers(t, 1)
+
+		known := minKnownPeers - 1
+		if busy {
+			known = minKnownPeers
+		}
+		for i := 0; i < known; i++ {
+			trackerManager.peerChans.peers <- PeerTuple{IP: net.IPv4(127, 0, 0, byte(i+2)), Port: refused}
+		}
+		for elapsed := time.Duration(0); elapsed < time.Hour; elapsed += peerEvictionInterval {
+			clock.tick(t, peerEvictionInterval)
+			if busy && elapsed+peerEvictionInterval < firewalledAfter && pm.reachability.Stats().State != ReachabilityUnknown {
+				t.Fatalf("Expected no verdict after %v", elapsed+peerEvictionInterval)
+			}
+		}
+		if !busy {
+			if state := pm.reachability.Stats().State; state != ReachabilityUnknown {
+				t.Errorf("Expected a quiet swarm not to give a verdict, but got %s", reachabilityNames[state])
+			}
+			close(pm.quit)
+			close(controller.quit)
+			continue
+		}
+		waitForReachability(t, pm, Firewalled)
+
+		// An inbound handshake
+		accept, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := net.DialTCP("tcp4", nil, accept.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := accept.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accept.Close()
+		serverChans.conns <- local
+		handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+		copy(handshake.InfoHash[:], infoHash)
+		copy(handshake.PeerID[:], "-XX0001-inboundpeer0")
+		binary.Write(remote, binary.BigEndian, &handshake)
+		waitForReachability(t, pm, Reachable)
+		if stats := pm.reachability.Stats(); stats.Inbound != 1 {
+			t.Errorf("Expected 1 inbound handshake, but got %+v", stats)
+		}
+
+		torrent := &Torrent{reachability: pm.reachability}
+		torrent.ResetReachability()
+		waitForReachability(t, pm, ReachabilityUnknown)
+		remote.Close()
+		close(pm.quit)
+		close(controller.quit)
+	}
+}
+
+// When firewalled, reconnects are attempted sooner and for longer
+func TestFirewalledReconnects(t *testing.T) {
+	for _, firewalled := range []bool{false, true} {
+		pm := createTestPeerManager(10)
+		clock := newFakeClock()
+		pm.clock = clock
+		if firewalled {
+			pm.reachability.reset(clock.Now())
+			for i := 0; i < minKnownPeers; i++ {
+				pm.reachability.peerKnown(fmt.Sprintf("10.0.0.%d:6881", i))
+			}
+			pm.reachability.update(clock.Now().Add(firewalledAfter))
+		}
+		state := &reconnectState{attempts: maxReconnectAttempts - 1}
+		pm.reconnects["10.0.0.1:6881"] = state
+		pm.scheduleReconnect("10.0.0.1:6881", state)
+		if scheduled := clock.waitForScheduled(t, 1); (scheduled[0] < reconnectDelay(maxReconnectAttempts-1)) != firewalled {
+			t.Errorf("Expected the backoff to be shortened only when firewalled (%v), but got %v", firewalled, scheduled[0])
+		}
+		pm.scheduleReconnect("10.0.0.1:6881", state)
+		if _, ok := pm.reconnects["10.0.0.1:6881"]; ok != firewalled {
+			t.Errorf("Expected reconnects past %d attempts only when firewalled (%v)", maxReconnectAttempts, firewalled)
+		}
+		close(pm.quit)
+	}
+}
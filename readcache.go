@@ -0,0 +1,181 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// Default number of bytes of piece data held in the read cache
+const defaultReadCacheBytes = 32 * 1024 * 1024
+
+var errRequestCancelled = errors.New("Request cancelled")
+
+// readCache holds recently read pieces so that block requests for the same
+// piece don't each go to disk. Concurrent misses for the same piece are
+// coalesced into a single fill, and every request waiting on it receives a
+// slice of the same buffer. Once the pieces held exceed the byte budget the
+// least recently used ones are evicted.
+type readCache struct {
+	mutex     sync.Mutex
+	budget    int64                              // bytes of piece data held at most, 0 disables the cache
+	size      int64                              // bytes of piece data held
+	pieces    map[int]*list.Element              // cached pieces, by index
+	lru       *list.List                         // cached pieces, least recently used first
+	fills     map[int]*pieceFill                 // fills in progress
+	read      func(pieceNum int) ([]byte, error) // reads and verifies a piece
+	readError func(pieceNum int)                 // called when a fill fails
+	stats     ReadCacheStats
+}
+
+// cachedPiece is an entry in the LRU list of the read cache
+type cachedPiece struct {
+	pieceNum int
+	data     []byte
+}
+
+// ReadCacheStats counts how block requests were served by the read cache
+type ReadCacheStats struct {
+	Hits         int64 // requests served from a cached piece
+	Misses       int64 // requests that started a read of the piece from disk
+	Coalesced    int64 // requests that waited on a read started by another request
+	CachedPieces int
+	CachedBytes  int64
+}
+
+// pieceFill is a read of a piece shared by every request that missed the
+// cache while it was in progress
+type pieceFill struct {
+	done    chan struct{} // closed once data and err are set
+	data    []byte
+	err     error
+	waiters int
+}
+
+func newReadCache(budget int64, read func(int) ([]byte, error), readError func(int)) *readCache {
+	return &readCache{
+		budget:    budget,
+		pieces:    make(map[int]*list.Element),
+		lru:       list.New(),
+		fills:     make(map[int]*pieceFill),
+		read:      read,
+		readError: readError,
+	}
+}
+
+// get returns the data of a piece, reading it from disk if it isn't cached.
+// The lock is never held while reading, so requests for other pieces are not
+// held up. If cancel is closed before the piece is available,
+// errRequestCancelled is returned. Once every request waiting on a fill has
+// been cancelled the fill is abandoned and its result is discarded.
+func (rc *readCache) get(pieceNum int, cancel <-chan struct{}) ([]byte, error) {
+	rc.mutex.Lock()
+	if element, ok := rc.pieces[pieceNum]; ok {
+		rc.lru.MoveToBack(element)
+		rc.stats.Hits++
+		rc.mutex.Unlock()
+		return element.Value.(*cachedPiece).data, nil
+	}
+	fill, ok := rc.fills[pieceNum]
+	if ok {
+		rc.stats.Coalesced++
+	} else {
+		rc.stats.Misses++
+		fill = &pieceFill{done: make(chan struct{})}
+		rc.fills[pieceNum] = fill
+		go rc.fill(pieceNum, fill)
+	}
+	fill.waiters++
+	rc.mutex.Unlock()
+
+	select {
+	case <-fill.done:
+		return fill.data, fill.err
+	case <-cancel:
+		rc.mutex.Lock()
+		fill.waiters--
+		if fill.waiters == 0 && rc.fills[pieceNum] == fill {
+			delete(rc.fills, pieceNum)
+		}
+		rc.mutex.Unlock()
+		return nil, errRequestCancelled
+	}
+}
+
+// fill reads a piece on behalf of every request waiting on it. The result is
+// only cached if the fill hasn't been abandoned or invalidated in the
+// meantime. A failed read is reported so that the piece can be rechecked.
+func (rc *readCache) fill(pieceNum int, fill *pieceFill) {
+	data, err := rc.read(pieceNum)
+
+	rc.mutex.Lock()
+	fill.data, fill.err = data, err
+	if rc.fills[pieceNum] == fill {
+		delete(rc.fills, pieceNum)
+		if err == nil {
+			rc.insert(pieceNum, data)
+		}
+	}
+	rc.mutex.Unlock()
+	close(fill.done)
+
+	if err != nil && rc.readError != nil {
+		rc.readError(pieceNum)
+	}
+}
+
+// insert adds a piece to the cache, evicting the least recently used pieces
+// until it fits in the budget. A piece larger than the budget isn't cached.
+// Must be called with the lock held.
+func (rc *readCache) insert(pieceNum int, data []byte) {
+	length := int64(len(data))
+	if length > rc.budget {
+		return
+	}
+	for rc.size+length > rc.budget {
+		rc.remove(rc.lru.Front())
+	}
+	rc.pieces[pieceNum] = rc.lru.PushBack(&cachedPiece{pieceNum: pieceNum, data: data})
+	rc.size += length
+}
+
+// remove drops a cached piece. Must be called with the lock held.
+func (rc *readCache) remove(element *list.Element) {
+	piece := rc.lru.Remove(element).(*cachedPiece)
+	delete(rc.pieces, piece.pieceNum)
+	rc.size -= int64(len(piece.data))
+}
+
+// invalidate removes a piece from the cache. A fill in progress is detached
+// so that its (possibly stale) result isn't cached, although requests already
+// waiting on it still receive it.
+func (rc *readCache) invalidate(pieceNum int) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	delete(rc.fills, pieceNum)
+	if element, ok := rc.pieces[pieceNum]; ok {
+		rc.remove(element)
+	}
+}
+
+// sizes returns the number of cached pieces and the number of fills in
+// progress
+func (rc *readCache) sizes() (cached int, filling int) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.pieces), len(rc.fills)
+}
+
+// Stats returns the hit and miss counters and the size of the cache
+func (rc *readCache) Stats() ReadCacheStats {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	stats := rc.stats
+	stats.CachedPieces = len(rc.pieces)
+	stats.CachedBytes = rc.size
+	return stats
+}
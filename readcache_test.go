@@ -0,0 +1,231 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until n requests are waiting on the fill of a piece
+func waitForWaiters(t *testing.T, rc *readCache, pieceNum int, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rc.mutex.Lock()
+		fill, ok := rc.fills[pieceNum]
+		waiters := 0
+		if ok {
+			waiters = fill.waiters
+		}
+		rc.mutex.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d requests on piece %d", n, pieceNum)
+}
+
+// Many peers requesting blocks of the same cold piece share a single read
+func TestReadCacheCoalescing(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 16384
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	var reads int32
+	release := make(chan struct{})
+	read := diskio.cache.read
+	diskio.cache.read = func(pieceNum int) ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return read(pieceNum)
+	}
+
+	numRequests := 50
+	blockLength := pieceLength / numRequests
+	responses := make([]BlockResponse, numRequests)
+	errs := make([]error, numRequests)
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			block := BlockInfo{pieceIndex: 2, begin: uint32(i * blockLength), length: uint32(blockLength)}
+			responses[i], errs[i] = diskio.requestBlock(block, nil)
+		}(i)
+	}
+	waitForWaiters(t, diskio.cache, 2, numRequests)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Errorf("Expected %d read of the piece, but there were %d", 1, n)
+	}
+	for i := 0; i < numRequests; i++ {
+		begin := 2*pieceLength + i*blockLength
+		if errs[i] != nil {
+			t.Errorf("Request %d failed: %s", i, errs[i])
+		} else if !bytes.Equal(responses[i].data, data[begin:begin+blockLength]) {
+			t.Errorf("Request %d received the wrong data", i)
+		}
+	}
+
+	// The piece is now cached
+	diskio.requestBlock(BlockInfo{pieceIndex: 2, begin: 0, length: 16}, nil)
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Errorf("Expected a cached piece not to be read again, but there were %d reads", n)
+	}
+}
+
+// A failed read is delivered to every request waiting on it and the piece is
+// reported once for recovery
+func TestReadCacheFailure(t *testing.T) {
+	errRead := errors.New("read failed")
+	release := make(chan struct{})
+	var reads int32
+	readErrors := make(chan int, 10)
+	rc := newReadCache(defaultReadCacheBytes, func(pieceNum int) ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return nil, errRead
+	}, func(pieceNum int) { readErrors <- pieceNum })
+
+	numRequests := 10
+	errs := make(chan error, numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			_, err := rc.get(5, nil)
+			errs <- err
+		}()
+	}
+	waitForWaiters(t, rc, 5, numRequests)
+	close(release)
+
+	for i := 0; i < numRequests; i++ {
+		if err := <-errs; err != errRead {
+			t.Errorf("Expected the read error to be returned to every request, but it was %v", err)
+		}
+	}
+	if pieceNum := <-readErrors; pieceNum != 5 || len(readErrors) != 0 {
+		t.Errorf("Expected piece %d to be reported once, but got %d and %d more", 5, pieceNum, len(readErrors))
+	}
+
+	// Failures aren't cached
+	rc.get(5, nil)
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Errorf("Expected a failed piece to be read again, but there were %d reads", n)
+	}
+}
+
+// Once every request has been cancelled the fill is abandoned and its result
+// isn't cached
+func TestReadCacheCancel(t *testing.T) {
+	release := make(chan struct{})
+	var reads int32
+	rc := newReadCache(defaultReadCacheBytes, func(pieceNum int) ([]byte, error) {
+		if atomic.AddInt32(&reads, 1) == 1 {
+			<-release
+		}
+		return []byte{byte(pieceNum)}, nil
+	}, nil)
+
+	cancel := make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := rc.get(1, cancel)
+			errs <- err
+		}()
+	}
+	waitForWaiters(t, rc, 1, 2)
+	close(cancel)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != errRequestCancelled {
+			t.Errorf("Expected a cancelled request to return %v, but it was %v", errRequestCancelled, err)
+		}
+	}
+	close(release)
+
+	data, err := rc.get(1, nil)
+	if err != nil || !bytes.Equal(data, []byte{1}) {
+		t.Errorf("Unexpected result %v, %v after an abandoned fill", data, err)
+	}
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Errorf("Expected the abandoned fill to be discarded, but there were %d reads", n)
+	}
+}
+
+// Pieces are evicted least recently used first once the byte budget is
+// exceeded, and hits and misses are counted
+func TestReadCacheLRU(t *testing.T) {
+	reads := make(map[int]int)
+	rc := newReadCache(30, func(pieceNum int) ([]byte, error) {
+		reads[pieceNum]++
+		return bytes.Repeat([]byte{byte(pieceNum)}, 10), nil
+	}, nil)
+
+	for _, pieceNum := range []int{1, 2, 3, 1, 4, 1, 3, 2} {
+		data, err := rc.get(pieceNum, nil)
+		if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(pieceNum)}, 10)) {
+			t.Fatalf("Unexpected result %v, %v for piece %d", data, err, pieceNum)
+		}
+	}
+
+	// Reading piece 4 evicted piece 2, the least recently used, and reading
+	// piece 2 again evicted piece 4
+	expected := map[int]int{1: 1, 2: 2, 3: 1, 4: 1}
+	for pieceNum, n := range expected {
+		if reads[pieceNum] != n {
+			t.Errorf("Expected piece %d to be read %d times, but it was read %d times", pieceNum, n, reads[pieceNum])
+		}
+	}
+	stats := rc.Stats()
+	if stats.Hits != 3 || stats.Misses != 5 || stats.CachedPieces != 3 || stats.CachedBytes != 30 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Pieces larger than the budget aren't cached
+	rc.read = func(pieceNum int) ([]byte, error) { return make([]byte, 31), nil }
+	rc.get(5, nil)
+	if stats := rc.Stats(); stats.CachedPieces != 3 || stats.CachedBytes != 30 {
+		t.Errorf("Expected a piece larger than the budget not to be cached, but got %+v", stats)
+	}
+}
+
+// Rewriting a piece drops it from the cache
+func TestReadCacheInvalidatedOnWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	block := BlockInfo{pieceIndex: 1, begin: 0, length: 16}
+	diskio.requestBlock(block, nil)
+	diskio.requestBlock(block, nil)
+	err := diskio.writePiece(Piece{index: 1, data: data[pieceLength:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskio.requestBlock(block, nil)
+	if stats := diskio.ReadCacheStats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Expected the rewritten piece to be read again, but got %+v", stats)
+	}
+}
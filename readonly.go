@@ -0,0 +1,39 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Files can be seeded straight from read-only storage, such as a DVD or a
+// read-only NFS mount. They're opened read-only and verified as usual, but
+// nothing is ever created, allocated, renamed, journaled or written. Pieces
+// missing from the storage are never downloaded, the torrent is a partial
+// seed for good and tells peers so with upload_only (BEP 21).
+
+// ErrReadOnly is returned for anything that would write to read-only storage
+var ErrReadOnly = errors.New("Storage is read-only")
+
+// openFlag returns the flag the files of the torrent are opened with
+func (diskio *DiskIO) openFlag() int {
+	if diskio.readOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR
+}
+
+// presentPieces returns which of the wanted pieces are verified, every piece
+// is wanted if wanted is nil
+func (diskio *DiskIO) presentPieces(wanted []bool) []bool {
+	present := diskio.verifiedPieces()
+	for pieceNum := range present {
+		if wanted != nil && !wanted[pieceNum] {
+			present[pieceNum] = false
+		}
+	}
+	return present
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listTree returns the paths under dir with their sizes and modification
+// times
+func listTree(t *testing.T, dir string) map[string]fileStamp {
+	tree := make(map[string]fileStamp)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		tree[path] = stampOf(info)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// Files on read-only storage are verified and served, while nothing is
+// created, allocated, renamed or written, whether every file is present or
+// only some are. The pieces that are missing aren't wanted.
+func TestReadOnlySeed(t *testing.T) {
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "payload", []string{"a", "b"}, []int{2 * pieceLength, 2 * pieceLength})
+
+	for _, partial := range []bool{false, true} {
+		dir := createTempDir(t)
+		defer os.RemoveAll(dir)
+		if err := os.Mkdir(filepath.Join(dir, "payload"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "payload", "a"), data[:2*pieceLength], 0644)
+		if !partial {
+			ioutil.WriteFile(filepath.Join(dir, "payload", "b"), data[2*pieceLength:], 0644)
+		}
+		before := listTree(t, dir)
+
+		diskio := NewDiskIO(metaInfo, dir)
+		diskio.readOnly = true
+		diskio.statsCh = make(chan int, 10)
+		diskio.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+		diskio.storageFault = func(write bool) error {
+			if write {
+				panic("Write to read-only storage")
+			}
+			return nil
+		}
+		if err := diskio.Init(); err != nil {
+			t.Fatal(err)
+		}
+		pieces, err := diskio.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []bool{true, true, !partial, !partial}
+		for pieceNum := range expected {
+			if pieces[pieceNum] != expected[pieceNum] {
+				t.Errorf("Expected the pieces verified with partial %t to be %v, but they were %v", partial, expected, pieces)
+				break
+			}
+			if wanted := diskio.wantedPieces(); wanted[pieceNum] != expected[pieceNum] {
+				t.Errorf("Expected the pieces wanted with partial %t to be %v, but they were %v", partial, expected, wanted)
+				break
+			}
+		}
+		go diskio.Run()
+
+		responseCh := make(chan BlockResponse)
+		diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: 1, begin: 0, length: 16}, response: responseCh}
+		select {
+		case response := <-responseCh:
+			if response.err != nil || !bytes.Equal(response.data, data[pieceLength:pieceLength+16]) {
+				t.Errorf("Expected a block of piece %d to be served with partial %t, but got %+v", 1, partial, response)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a response to the request for a block of piece %d", 1)
+		}
+
+		// Pieces sent anyway, present or not, are refused
+		for _, pieceNum := range []int{0, 3} {
+			result := make(chan error, 1)
+			diskio.peerChans.writePiece <- Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength], peerName: "10.0.0.1:6881", result: result}
+			if err := <-result; !errors.Is(err, ErrReadOnly) {
+				t.Errorf("Expected piece %d to be refused with partial %t, but got %v", pieceNum, partial, err)
+			}
+		}
+		if _, err := diskio.ImportData(dir); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected importing data to be refused with partial %t, but got %v", partial, err)
+		}
+		if err := diskio.SetFilePath(0, "renamed"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected renaming a file to be refused with partial %t, but got %v", partial, err)
+		}
+		if err := diskio.Stop(); err != nil {
+			t.Fatal(err)
+		}
+
+		after := listTree(t, dir)
+		if len(after) != len(before) {
+			t.Errorf("Expected nothing to be created with partial %t, but the tree went from %v to %v", partial, before, after)
+		}
+		for path, stamp := range before {
+			if after[path] != stamp {
+				t.Errorf("Expected %s not to change with partial %t, but it went from %+v to %+v", path, partial, stamp, after[path])
+			}
+		}
+	}
+}
+
+// A peer seeding from read-only storage says it only uploads in its extended
+// handshake
+func TestUploadOnlyHandshake(t *testing.T) {
+	for _, uploadOnly := range []bool{false, true} {
+		payload, err := encodeExtendedHandshake(localExtensions, uploadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake, err := decodeExtendedHandshake(payload[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (handshake.UploadOnly == 1) != uploadOnly {
+			t.Errorf("Expected upload_only %t, but the handshake was %+v", uploadOnly, handshake)
+		}
+	}
+}
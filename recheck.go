@@ -0,0 +1,238 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// errRechecking refuses a block request taken while a full recheck starts
+var errRechecking = errors.New("Rechecking every piece")
+
+// errRecheckCancelled is returned by a full recheck stopped by DiskIO
+// stopping
+var errRecheckCancelled = errors.New("Recheck cancelled")
+
+// RecheckResult is the outcome of a full recheck
+type RecheckResult struct {
+	Pieces []bool // pieces verified on disk, nil if the recheck failed
+	Gained int    // pieces found on disk that weren't verified before
+	Lost   int    // verified pieces that no longer match their hash
+	err    error
+}
+
+// Recheck verifies every piece on disk while DiskIO is running, for
+// example after suspected disk corruption or restoring the files from a
+// backup. Piece writes and block requests are paused while it runs, and the
+// Controller and Stats are told about the pieces gained and lost. It's
+// cancelled if DiskIO stops.
+func (diskio *DiskIO) Recheck() (RecheckResult, error) {
+	reply := make(chan RecheckResult, 1)
+	select {
+	case diskio.fullRechecks <- reply:
+	case <-diskio.quit:
+		return RecheckResult{}, errRecheckCancelled
+	}
+	result := <-reply
+	return result, result.err
+}
+
+// refuseHeld answers a block request held by Run when a recheck starts
+func (diskio *DiskIO) refuseHeld(request BlockRequest, err error) {
+	diskio.pending.Done()
+	go func() {
+		select {
+		case request.response <- BlockResponse{info: request.request, err: err}:
+		case <-request.cancel:
+		case <-diskio.quit:
+		}
+	}()
+}
+
+// recheckAll is run by Run, which takes nothing more from peers meanwhile.
+// The piece writes and block reads already queued are finished first, so
+// that none of them interleave with the verification reads.
+func (diskio *DiskIO) recheckAll() RecheckResult {
+	log.Println("DiskIO : recheckAll : Started")
+	defer log.Println("DiskIO : recheckAll : Completed")
+	diskio.pending.Wait()
+
+	numPieces := diskio.pieceHashes.Len()
+	pieces := make([]bool, numPieces)
+	reporter := &verifyReporter{
+		progress: VerifyProgress{PiecesTotal: numPieces},
+		lastSent: time.Now(),
+		ch:       diskio.verifyProgress,
+	}
+	defer reporter.finish()
+	for pieceNum := 0; pieceNum < numPieces; pieceNum++ {
+		if diskio.verifyCancelled() {
+			return RecheckResult{err: errRecheckCancelled}
+		}
+		good, err := diskio.recheckPieceData(pieceNum)
+		if err != nil {
+			return RecheckResult{err: fmt.Errorf("Unable to recheck piece %x: %w", pieceNum, err)}
+		}
+		pieces[pieceNum] = good
+		reporter.update(good)
+	}
+
+	previous, err := diskio.applyRecheck(pieces)
+	if err != nil {
+		diskio.fail(err)
+		return RecheckResult{err: err}
+	}
+	result := RecheckResult{Pieces: pieces}
+	wanted := diskio.wantedPieces()
+	bytesGained := 0
+	for pieceNum, good := range pieces {
+		if good == previous[pieceNum] {
+			continue
+		}
+		length := diskio.pieceLength(pieceNum)
+		if !good {
+			result.Lost++
+			length = -length
+		} else {
+			result.Gained++
+		}
+		if wanted == nil || wanted[pieceNum] {
+			bytesGained += length
+		}
+	}
+	log.Printf("DiskIO : recheckAll : %d pieces gained and %d lost", result.Gained, result.Lost)
+
+	// Stats and the Controller are told while nothing else is completed,
+	// so that no piece is counted twice
+	if bytesGained != 0 {
+		select {
+		case diskio.statsCh <- bytesGained:
+		case <-diskio.quit:
+			return RecheckResult{err: errRecheckCancelled}
+		}
+	}
+	fresh := make([]bool, numPieces)
+	copy(fresh, pieces)
+	select {
+	case diskio.contChans.recheck <- fresh:
+	case <-diskio.quit:
+		return RecheckResult{err: errRecheckCancelled}
+	}
+	return result
+}
+
+// recheckPieceData verifies a piece on disk for a full recheck. A piece of a
+// file that's missing isn't verified.
+func (diskio *DiskIO) recheckPieceData(pieceNum int) (bool, error) {
+	lock := diskio.pieceLock(pieceNum)
+	lock.Lock()
+	defer lock.Unlock()
+	diskio.cache.invalidate(pieceNum)
+	good, err := diskio.VerifyPiece(pieceNum)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return good, err
+}
+
+// applyRecheck replaces the bitfield with the pieces found by a full
+// recheck, rewrites the journal to match and returns the previous bitfield
+func (diskio *DiskIO) applyRecheck(pieces []bool) ([]bool, error) {
+	diskio.pipelineMutex.Lock()
+	defer diskio.pipelineMutex.Unlock()
+	previous := diskio.verifiedPieces()
+	changed := false
+	for pieceNum, good := range pieces {
+		if good == previous[pieceNum] {
+			continue
+		}
+		changed = true
+		if !good && diskio.complete != nil {
+			offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+			for _, region := range diskio.mapRegion(offset, diskio.pieceLength(pieceNum)) {
+				diskio.complete[region.fileIndex] = false
+			}
+		}
+	}
+	if !changed {
+		return previous, nil
+	}
+	diskio.piecesMutex.Lock()
+	copy(diskio.pieces, pieces)
+	diskio.piecesMutex.Unlock()
+	if diskio.journal != nil {
+		err := diskio.compactJournal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if diskio.complete != nil {
+		for pieceNum, good := range pieces {
+			if good && !previous[pieceNum] {
+				err := diskio.completeFiles(pieceNum)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return previous, nil
+}
+
+// Recheck verifies every piece on disk while the torrent is running, see
+// DiskIO.Recheck. It's cancelled if the torrent stops.
+func (t *Torrent) Recheck() (RecheckResult, error) {
+	reply := make(chan RecheckResult, 1)
+	select {
+	case t.recheckRequests <- reply:
+	case <-t.stopping:
+		return RecheckResult{}, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-t.quit:
+		return RecheckResult{}, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-time.After(dumpTimeout):
+		return RecheckResult{}, fmt.Errorf("Torrent %s isn't running", t.metaInfo.Info.Name)
+	}
+	result := <-reply
+	return result, result.err
+}
+
+// rebuildPieces brings the Controller in line with the pieces found on disk
+// by a full recheck. Pieces gained are announced to the peers and no longer
+// requested, pieces lost are downloaded again.
+func (cont *Controller) rebuildPieces(pieces []bool) {
+	var lost []int
+	gained := 0
+	for pieceNum, good := range pieces {
+		if good == cont.finishedPieces[pieceNum] {
+			continue
+		}
+		if !good {
+			lost = append(lost, pieceNum)
+			continue
+		}
+		gained++
+		cont.finishedPieces[pieceNum] = true
+		delete(cont.corroborating, pieceNum)
+		delete(cont.badCopies, pieceNum)
+		delete(cont.pieceTimings, pieceNum)
+		cont.sendHaveToPeersWhoNeedPiece(pieceNum)
+		cont.removePieceFromActiveRequests(ReceivedPiece{pieceNum: pieceNum})
+	}
+	log.Printf("Controller : rebuildPieces : A recheck found %d pieces gained and %d lost", gained, len(lost))
+	if len(lost) > 0 {
+		cont.losePieces(lost)
+	}
+	if gained > 0 && !cont.downloadComplete {
+		cont.updateCompletedFlagIfFinished(false)
+	}
+	for _, peerInfo := range cont.peers {
+		cont.updateQuantityNeededForPeer(peerInfo)
+	}
+	cont.sendRequestsToAllPeers()
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// A recheck while DiskIO is running finds pieces restored and corrupted
+// behind its back, and tells Stats and the Controller
+func TestRecheckRunning(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	diskio.contChans.recheck = make(chan []bool, 1)
+	go diskio.Run()
+
+	for pieceNum := 0; pieceNum < 2; pieceNum++ {
+		result := make(chan error, 1)
+		diskio.peerChans.writePiece <- Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength], peerName: "10.0.0.1:6881", result: result}
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+		<-diskio.statsCh
+	}
+
+	// Piece 0 is corrupted, pieces 2 and 3 are restored from a backup
+	path, err := diskio.currentPath(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(make([]byte, 10), 0)
+	file.WriteAt(data[2*pieceLength:], int64(2*pieceLength))
+	file.Close()
+
+	result, err := diskio.Recheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bool{false, true, true, true}
+	if result.Gained != 2 || result.Lost != 1 || !reflect.DeepEqual(result.Pieces, expected) {
+		t.Errorf("Expected 2 pieces gained and 1 lost, but got %+v", result)
+	}
+	if pieces := <-diskio.contChans.recheck; !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected the Controller to be sent %v, but got %v", expected, pieces)
+	}
+	if gained := <-diskio.statsCh; gained != pieceLength {
+		t.Errorf("Expected Stats to be told %d bytes were gained, but got %d", pieceLength, gained)
+	}
+	if pieces := diskio.verifiedPieces(); !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected the bitfield to be %v, but got %v", expected, pieces)
+	}
+
+	// The corrupted piece is no longer served, the restored ones are
+	responseCh := make(chan BlockResponse)
+	for pieceNum, verified := range expected {
+		diskio.peerChans.blockRequest <- BlockRequest{request: BlockInfo{pieceIndex: uint32(pieceNum), begin: 0, length: 100}, response: responseCh}
+		if response := <-responseCh; errors.Is(response.err, errPieceNotVerified) == verified {
+			t.Errorf("Expected piece %d to be served %t, but got %v", pieceNum, verified, response.err)
+		}
+	}
+
+	if err := diskio.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diskio.Recheck(); err != errRecheckCancelled {
+		t.Errorf("Expected a recheck after Stop to be cancelled, but got %v", err)
+	}
+}
+
+// The Controller announces pieces found by a recheck and downloads the lost
+// ones again
+func TestControllerRebuildPieces(t *testing.T) {
+	cont := createTestController()
+	pieces := make([]bool, len(cont.finishedPieces))
+	for pieceNum := range pieces {
+		pieces[pieceNum] = pieceNum != 0
+	}
+	cont.rebuildPieces(pieces)
+	if !reflect.DeepEqual(cont.finishedPieces, pieces) {
+		t.Errorf("Expected the finished pieces to be %v, but got %v", pieces, cont.finishedPieces)
+	}
+	if cont.downloadComplete {
+		t.Errorf("Expected the download not to be complete with piece 0 lost")
+	}
+	pieces[0] = true
+	cont.rebuildPieces(pieces)
+	if !cont.downloadComplete {
+		t.Errorf("Expected the download to be complete once every piece was found")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errPathCollision is returned when a file of the torrent is renamed to a
+// path that's taken
+var errPathCollision = errors.New("Path is already taken")
+
+// relPath returns the path of a file of the torrent relative to the
+// directory it's stored in. That's the path in the torrent, unless the file
+// was renamed. Pieces are always mapped to files by the torrent.
+func (diskio *DiskIO) relPath(fileIndex int) string {
+	diskio.renamesMutex.Lock()
+	renamed := ""
+	if diskio.renames != nil {
+		renamed = diskio.renames[fileIndex]
+	}
+	diskio.renamesMutex.Unlock()
+	if renamed != "" {
+		return renamed
+	}
+	if len(diskio.metaInfo.Info.Files) == 0 {
+		// Single File Mode
+		return diskio.metaInfo.Info.Name
+	}
+	// Multiple File Mode
+	return filepath.Join(append([]string{diskio.metaInfo.Info.Name}, diskio.metaInfo.Info.Files[fileIndex].Path...)...)
+}
+
+// renamedPaths returns the relative paths of every file, nil if none was
+// renamed
+func (diskio *DiskIO) renamedPaths() []string {
+	diskio.renamesMutex.Lock()
+	renamed := diskio.renames != nil
+	diskio.renamesMutex.Unlock()
+	if !renamed {
+		return nil
+	}
+	paths := make([]string, len(diskio.fileLengths()))
+	for i := range paths {
+		paths[i] = filepath.ToSlash(diskio.relPath(i))
+	}
+	return paths
+}
+
+// cleanRelPath returns path cleaned, or an error if it isn't a relative path
+// within the download directory
+func cleanRelPath(path string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if path == "" || filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path %q, expected a relative path within the download directory", path)
+	}
+	return clean, nil
+}
+
+// checkPaths returns an error if a file of the torrent would be stored
+// outside the download directory, as a torrent with ".." in a path asks
+func (diskio *DiskIO) checkPaths() error {
+	for i := range diskio.fileLengths() {
+		if _, err := cleanRelPath(diskio.relPath(i)); err != nil {
+			return fmt.Errorf("File %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// SetFilePath stores a file of the torrent at path, relative to the
+// download directory, instead of its path in the torrent. Before Init the
+// file is looked for at its new path from then on. Once the files are open
+// the file is renamed on disk, keeping its handle, if it's been created. A
+// path taken by another file of the torrent, or by a file on disk, is
+// refused, as is renaming files that are open on read-only storage. The new
+// paths are saved with the resume data.
+func (diskio *DiskIO) SetFilePath(fileIndex int, path string) error {
+	if fileIndex < 0 || fileIndex >= len(diskio.fileLengths()) {
+		return fmt.Errorf("File index %d out of range (%d files)", fileIndex, len(diskio.fileLengths()))
+	}
+	rel, err := cleanRelPath(path)
+	if err != nil {
+		return err
+	}
+	for i := range diskio.fileLengths() {
+		if i != fileIndex && diskio.relPath(i) == rel {
+			return fmt.Errorf("%w: file %d is stored at %s", errPathCollision, i, rel)
+		}
+	}
+
+	diskio.pipelineMutex.Lock()
+	defer diskio.pipelineMutex.Unlock()
+	diskio.pathsMutex.Lock()
+	opened := diskio.paths != nil
+	diskio.pathsMutex.Unlock()
+	if !opened {
+		diskio.setRelPath(fileIndex, rel)
+		return nil
+	}
+	if diskio.readOnly {
+		return ErrReadOnly
+	}
+
+	current, err := diskio.currentPath(fileIndex)
+	if err != nil {
+		return err
+	}
+	final := filepath.Join(diskio.currentDir(), rel)
+	target := final + partSuffix
+	if current == diskio.filePath(fileIndex) {
+		target = final
+	}
+	if target == current {
+		return nil
+	}
+	for _, taken := range []string{final, final + partSuffix} {
+		if _, err := os.Lstat(taken); err == nil {
+			return fmt.Errorf("%w: %s exists", errPathCollision, taken)
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(target), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if diskio.file(fileIndex) != nil {
+		err = diskio.renameFile(fileIndex, target)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Created at its new path once data is written to it
+		diskio.pathsMutex.Lock()
+		diskio.paths[fileIndex] = target
+		diskio.pathsMutex.Unlock()
+	}
+	diskio.setRelPath(fileIndex, rel)
+	removeEmptyParents(diskio.currentDir(), current)
+	log.Printf("DiskIO : SetFilePath : File %d is stored at %s", fileIndex, target)
+	return nil
+}
+
+// setRelPath records the path a file is stored at, relative to the download
+// directory
+func (diskio *DiskIO) setRelPath(fileIndex int, rel string) {
+	diskio.renamesMutex.Lock()
+	defer diskio.renamesMutex.Unlock()
+	if diskio.renames == nil {
+		diskio.renames = make([]string, len(diskio.fileLengths()))
+	}
+	diskio.renames[fileIndex] = rel
+}
+
+// setRenamedPaths stores the files at the paths saved with the resume data,
+// before Init
+func (diskio *DiskIO) setRenamedPaths(paths []string) error {
+	if len(paths) != len(diskio.fileLengths()) {
+		return fmt.Errorf("%d renamed paths for %d files", len(paths), len(diskio.fileLengths()))
+	}
+	rels := make([]string, len(paths))
+	taken := make(map[string]int)
+	for i, path := range paths {
+		rel, err := cleanRelPath(path)
+		if err != nil {
+			return err
+		}
+		if other, ok := taken[rel]; ok {
+			return fmt.Errorf("%w: files %d and %d are stored at %s", errPathCollision, other, i, rel)
+		}
+		taken[rel] = i
+		rels[i] = rel
+	}
+	for i, rel := range rels {
+		diskio.setRelPath(i, rel)
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directories path was in, up to dir, while
+// they're empty
+func removeEmptyParents(dir string, path string) {
+	for parent := filepath.Dir(path); parent != dir && strings.HasPrefix(parent, dir+string(filepath.Separator)); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The root folder of a torrent renamed mid-download holds the finished
+// files, and the renames are restored from the resume data
+func TestSetFilePath(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	files := []string{"a", "b", "c"}
+	setTestFiles(&metaInfo, "multi", files, []int{1500, 1500, len(data) - 3000})
+	diskio := createTestDiskIO(t, dir, metaInfo)
+
+	complete := func(pieceNum int) {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	complete(0)
+	complete(1)
+	for i, file := range files {
+		err := diskio.SetFilePath(i, "renamed/"+file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	complete(2)
+	complete(3)
+
+	offset := 0
+	for i, file := range files {
+		length := metaInfo.Info.Files[i].Length
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "renamed", file))
+		if err != nil || !bytes.Equal(contents, data[offset:offset+length]) {
+			t.Errorf("Expected file %d to be downloaded to its new path, but got %v", i, err)
+		}
+		offset += length
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi")); !os.IsNotExist(err) {
+		t.Errorf("Expected the old root folder to be removed, but got %v", err)
+	}
+
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	name := resumeName(dir, infoHash)
+	err := diskio.saveResume(name, infoHash, 0, 0, nil)
+	closeTestDiskIO(diskio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := NewDiskIO(metaInfo, dir)
+	_, pieces, err := resumed.loadResume(name, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []bool{true, true, true, true}; !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected resumed pieces %v, but got %v", expected, pieces)
+	}
+	for i, file := range files {
+		if rel := resumed.relPath(i); rel != filepath.Join("renamed", file) {
+			t.Errorf("Expected file %d to be resumed at renamed/%s, but it was at %s", i, file, rel)
+		}
+	}
+
+	// The restarted DiskIO uses the renamed files rather than creating the
+	// files at their original paths
+	resumed.ioMode = testIOMode
+	resumed.statsCh = make(chan int, 10)
+	resumed.contChans.receivedPiece = make(chan ReceivedPiece, 10)
+	if err := resumed.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(resumed)
+	for i, file := range files {
+		if opened := resumed.file(i); opened == nil || opened.Name() != filepath.Join(dir, "renamed", file) {
+			t.Errorf("Expected file %d to be opened at renamed/%s after the restart", i, file)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi")); !os.IsNotExist(err) {
+		t.Errorf("Expected the original root folder not to be created after the restart, but got %v", err)
+	}
+}
+
+// Paths taken by another file of the torrent, or by a file on disk, and
+// paths outside the download directory are refused
+func TestSetFilePathCollision(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(2, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "multi", []string{"a", "b"}, []int{1000, len(data) - 1000})
+	ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	if err := diskio.SetFilePath(0, "multi/b"); !errors.Is(err, errPathCollision) {
+		t.Errorf("Expected %v renaming to the path of another file, but got %v", errPathCollision, err)
+	}
+	if err := diskio.SetFilePath(0, "other"); !errors.Is(err, errPathCollision) {
+		t.Errorf("Expected %v renaming to an existing file, but got %v", errPathCollision, err)
+	}
+	if err := diskio.SetFilePath(0, "../escaped"); err == nil {
+		t.Errorf("Expected an error renaming outside the download directory")
+	}
+	if rel := diskio.relPath(0); rel != filepath.Join("multi", "a") {
+		t.Errorf("Expected a refused rename to keep the file at multi/a, but it was at %s", rel)
+	}
+}
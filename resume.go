@@ -0,0 +1,211 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version of the resume file format. Resume files of any other version are
+// ignored, as are the JSON resume files of version 1.
+const resumeVersion = 2
+
+// Interval between writes of the resume file while the torrent is running
+var resumeInterval = 5 * time.Minute
+
+// ResumeData is saved bencoded next to the download so that a restart can
+// skip verifying every piece. It's only trusted while the files on disk
+// still have the sizes and modification times recorded when it was saved.
+type ResumeData struct {
+	Version    int          `bencode:"version"`
+	InfoHash   string       `bencode:"info hash"`  // hex encoded
+	Pieces     string       `bencode:"pieces"`     // bitfield of verified pieces
+	Files      []ResumeFile `bencode:"files"`      // in the order of the torrent
+	Downloaded int          `bencode:"downloaded"` // total bytes downloaded
+	Uploaded   int          `bencode:"uploaded"`   // total bytes uploaded
+	// Paths of the files relative to the download directory, slash
+	// separated, if any was renamed
+	Paths []string `bencode:"paths,omitempty"`
+	// 1 if the files were seeded from read-only storage, where missing
+	// pieces are never downloaded
+	ReadOnly int `bencode:"read only,omitempty"`
+	// State of the completed event by announce URL, completedOwed or
+	// completedSent, once the download completed
+	Completed map[string]string `bencode:"completed,omitempty"`
+}
+
+// ResumeFile is the state of a file of the torrent when the resume data was
+// saved
+type ResumeFile struct {
+	Length  int64 `bencode:"length"`
+	ModTime int64 `bencode:"mtime"` // nanoseconds since the epoch
+}
+
+// resumeName returns the name of the resume file of a torrent
+func resumeName(downloadDir string, infoHash []byte) string {
+	return filepath.Join(downloadDir, hex.EncodeToString(infoHash)+".resume")
+}
+
+// fileStates returns the size and modification time of each file of the
+// torrent
+func (diskio *DiskIO) fileStates() ([]ResumeFile, error) {
+	states := make([]ResumeFile, 0, len(diskio.fileLengths()))
+	for i := range diskio.fileLengths() {
+		path, err := diskio.currentPath(i)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, ResumeFile{Length: info.Size(), ModTime: info.ModTime().UnixNano()})
+	}
+	return states, nil
+}
+
+// readResume reads a resume file, if it's for this torrent, without checking
+// it against the files on disk
+func readResume(name string, infoHash []byte) (*ResumeData, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	resume := new(ResumeData)
+	err = bencode.Unmarshal(bytes.NewReader(data), resume)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupt resume file: %w", err)
+	}
+	if resume.Version != resumeVersion {
+		return nil, fmt.Errorf("Resume file version %d, expected %d", resume.Version, resumeVersion)
+	}
+	if resume.InfoHash != hex.EncodeToString(infoHash) {
+		return nil, fmt.Errorf("Resume file is for infohash %s", resume.InfoHash)
+	}
+	return resume, nil
+}
+
+// loadResume reads a resume file and returns its data and the verified
+// pieces, if the file is valid for this torrent and the files on disk haven't
+// changed since it was saved. It must be called before Init, which may
+// change the files. Files renamed when it was saved are looked for at their
+// new paths, as long as the resume file is for this torrent.
+func (diskio *DiskIO) loadResume(name string, infoHash []byte) (*ResumeData, []bool, error) {
+	resume, err := readResume(name, infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	numPieces := diskio.pieceHashes.Len()
+	if len(resume.Pieces) != (numPieces+7)/8 {
+		return nil, nil, fmt.Errorf("Resume bitfield of %d bytes for %d pieces", len(resume.Pieces), numPieces)
+	}
+	if len(resume.Files) != len(diskio.fileLengths()) {
+		return nil, nil, fmt.Errorf("Resume file has %d files, expected %d", len(resume.Files), len(diskio.fileLengths()))
+	}
+	if resume.Paths != nil {
+		err = diskio.setRenamedPaths(resume.Paths)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	states, err := diskio.fileStates()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, state := range states {
+		if state != resume.Files[i] {
+			return nil, nil, fmt.Errorf("%s has changed since the resume file was saved", diskio.filePath(i))
+		}
+	}
+	return resume, convertByteSliceToBoolSlice(numPieces, []byte(resume.Pieces)), nil
+}
+
+// saveResume writes the verified pieces, the state of the files, the
+// transfer counters and the state of the completed event of each tracker to
+// a resume file. The files are synced first, unless
+// DiskIO has stopped and already closed them, so that the modification
+// times recorded are final for the pieces recorded. The resume file is
+// replaced atomically.
+func (diskio *DiskIO) saveResume(name string, infoHash []byte, downloaded int, uploaded int, completed map[string]string) error {
+	diskio.piecesMutex.RLock()
+	pieces := convertBoolSliceToByteSlice(diskio.pieces)
+	diskio.piecesMutex.RUnlock()
+	select {
+	case <-diskio.done:
+	default:
+		err := diskio.syncFiles()
+		if err != nil {
+			return err
+		}
+	}
+	states, err := diskio.fileStates()
+	if err != nil {
+		return err
+	}
+	readOnly := 0
+	if diskio.readOnly {
+		readOnly = 1
+	}
+	var data bytes.Buffer
+	err = bencode.Marshal(&data, ResumeData{
+		Version:    resumeVersion,
+		InfoHash:   hex.EncodeToString(infoHash),
+		Pieces:     string(pieces),
+		Files:      states,
+		Downloaded: downloaded,
+		Uploaded:   uploaded,
+		Paths:      diskio.renamedPaths(),
+		ReadOnly:   readOnly,
+		Completed:  completed,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, data.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Resume takes the verified pieces from resume data instead of calling
+// Verify
+func (diskio *DiskIO) Resume(pieces []bool) error {
+	log.Println("DiskIO : Resume : Skipping verification, using resume data")
+	diskio.piecesMutex.Lock()
+	diskio.pieces = make([]bool, len(pieces))
+	copy(diskio.pieces, pieces)
+	diskio.piecesMutex.Unlock()
+	err := diskio.recheckStarted()
+	if err != nil {
+		return err
+	}
+
+	good := 0
+	for _, ok := range diskio.pieces {
+		if ok {
+			good++
+		}
+	}
+	reporter := &verifyReporter{
+		progress: VerifyProgress{PiecesTotal: len(pieces), PiecesGood: good, Resumed: true},
+		ch:       diskio.verifyProgress,
+	}
+	reporter.finish()
+	err = diskio.settleFiles()
+	if err != nil {
+		return err
+	}
+	return diskio.recoverJournal()
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"github.com/jackpal/bencode-go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestResume downloads pieces 1 and 3 of a 4 piece torrent in dir and
+// saves resume data for it, leaving the files closed
+func createTestResume(t *testing.T, dir string, infoHash []byte) (MetaInfo, string) {
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	for _, pieceNum := range []int{1, 3} {
+		err := diskio.completePiece(Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := resumeName(dir, infoHash)
+	err := diskio.saveResume(name, infoHash, 4096, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metaInfo, name
+}
+
+// Resume data saved for unchanged files is loaded instead of verifying
+func TestResume(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	metaInfo, name := createTestResume(t, dir, infoHash)
+	if data, err := ioutil.ReadFile(name); err != nil || !bytes.HasPrefix(data, []byte("d")) {
+		t.Errorf("Expected a bencoded dictionary in the resume file, but got %q, %v", data, err)
+	}
+
+	diskio := NewDiskIO(metaInfo, dir)
+	resume, pieces, err := diskio.loadResume(name, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bool{false, true, false, true}
+	if !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected resumed pieces %v, but got %v", expected, pieces)
+	}
+	if resume.Downloaded != 4096 || resume.Uploaded != 1024 {
+		t.Errorf("Unexpected counters in resume data %+v", resume)
+	}
+
+	diskio.verifyProgress = make(chan VerifyProgress, 1)
+	err = diskio.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDiskIO(diskio)
+	err = diskio.Resume(pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diskio.pieces, expected) {
+		t.Errorf("Expected the bitfield of DiskIO to be %v, but it was %v", expected, diskio.pieces)
+	}
+	progress := <-diskio.verifyProgress
+	if !progress.Done || !progress.Resumed || progress.PiecesGood != 2 || progress.PiecesChecked != 0 {
+		t.Errorf("Unexpected progress %+v", progress)
+	}
+}
+
+// rewriteResume changes the data in a resume file
+func rewriteResume(t *testing.T, name string, change func(*ResumeData)) {
+	var resume ResumeData
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bencode.Unmarshal(bytes.NewReader(data), &resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(&resume)
+	var b bytes.Buffer
+	err = bencode.Marshal(&b, resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Resume data that's corrupt, of another version, for another torrent or
+// for files that have changed since is ignored
+func TestResumeInvalid(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string, name string)
+	}{
+		{"missing", func(t *testing.T, dir string, name string) {
+			os.Remove(name)
+		}},
+		{"corrupt", func(t *testing.T, dir string, name string) {
+			ioutil.WriteFile(name, []byte("d7:versioni2e6:pieces"), 0644)
+		}},
+		{"json", func(t *testing.T, dir string, name string) {
+			ioutil.WriteFile(name, []byte(`{"Version": 1, "Pieces": "Cg==", "Files": []}`), 0644)
+		}},
+		{"version", func(t *testing.T, dir string, name string) {
+			rewriteResume(t, name, func(resume *ResumeData) { resume.Version++ })
+		}},
+		{"infohash", func(t *testing.T, dir string, name string) {
+			rewriteResume(t, name, func(resume *ResumeData) { resume.InfoHash = strings.Repeat("cd", 20) })
+		}},
+		{"bitfield", func(t *testing.T, dir string, name string) {
+			rewriteResume(t, name, func(resume *ResumeData) { resume.Pieces += "\xff" })
+		}},
+		{"modified", func(t *testing.T, dir string, name string) {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(filepath.Join(dir, "payload"+partSuffix), later, later)
+		}},
+		{"resized", func(t *testing.T, dir string, name string) {
+			os.Truncate(filepath.Join(dir, "payload"+partSuffix), 1024)
+		}},
+	}
+	for _, test := range tests {
+		dir := createTempDir(t)
+		metaInfo, name := createTestResume(t, dir, infoHash)
+		test.change(t, dir, name)
+		resume, pieces, err := NewDiskIO(metaInfo, dir).loadResume(name, infoHash)
+		if err == nil || resume != nil || pieces != nil {
+			t.Errorf("Expected %s resume data to be ignored, but got %+v and %v", test.name, resume, pieces)
+		}
+		os.RemoveAll(dir)
+	}
+}
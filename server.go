@@ -18,37 +18,56 @@ type Server struct {
 	Port      uint16
 	Listener  *net.TCPListener
 	peerChans serverPeerChans
+	lifecycle lifecycle
 	quit      chan struct{}
 }
 
-func NewServer() *Server {
+// NewServer listens for incoming peer connections on the given TCP port, or
+// on a port chosen by the system if port is 0
+func NewServer(port uint16) (*Server, error) {
 	sv := &Server{quit: make(chan struct{})}
 
 	// Channel used to send new connections we receive to PeerManager
 	sv.peerChans.conns = make(chan *net.TCPConn)
 
 	var err error
-	sv.Listener, err = net.ListenTCP("tcp4", &net.TCPAddr{})
+	sv.Listener, err = net.ListenTCP("tcp4", &net.TCPAddr{Port: int(port)})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	sv.Port = uint16(sv.Listener.Addr().(*net.TCPAddr).Port)
 	log.Println("Server : Listening on port", sv.Port)
 
-	return sv
+	return sv, nil
 }
 
-// Serve accepts new TCP connections and hands them off to PeerManager
-func (sv *Server) Serve() {
-	log.Println("Server : Serve : Started")
-	defer log.Println("Server : Serve : Completed")
+// Stop stops accepting connections and waits for Run to return. If Run never
+// started the listener is closed here instead.
+func (sv *Server) Stop() error {
+	err := sv.lifecycle.stop(func() { close(sv.quit) })
+	if err == ErrNeverStarted {
+		sv.Listener.Close()
+	}
+	return err
+}
+
+// Run accepts new TCP connections and hands them off to PeerManager, which
+// validates the handshake before adding the peer
+func (sv *Server) Run() {
+	if err := sv.lifecycle.start(); err != nil {
+		log.Printf("Server : Run : Not running: %s", err)
+		return
+	}
+	defer sv.lifecycle.finish()
+	log.Println("Server : Run : Started")
+	defer log.Println("Server : Run : Completed")
+	defer sv.Listener.Close()
 
 	for {
 		// Check if we should stop accepting connections and shutdown
 		select {
 		case <-sv.quit:
-			log.Println("Server : Serve : Shutting Down")
-			sv.Listener.Close()
+			log.Println("Server : Run : Shutting Down")
 			return
 		default:
 		}
@@ -60,10 +79,16 @@ func (sv *Server) Serve() {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				continue
 			}
-			log.Fatal(err)
+			log.Println("Server : Run : Unable to accept connections:", err)
+			return
 		}
-		log.Println("Server: New connection from:", conn.RemoteAddr())
+		log.Println("Server : Run : New connection from:", conn.RemoteAddr())
 		// Hand the connection off to PeerManager
-		go func() { sv.peerChans.conns <- conn }()
+		select {
+		case sv.peerChans.conns <- conn:
+		case <-sv.quit:
+			conn.Close()
+			return
+		}
 	}
 }
@@ -0,0 +1,175 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// createTestServer starts a Server and a PeerManager that it hands incoming
+// connections to
+func createTestServer(t *testing.T, infoHash []byte) (*Server, *PeerManager) {
+	server, err := NewServer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trackerManager := NewTrackerManager(server.Port)
+	diskIOChans := diskIOPeerChans{writePiece: make(chan Piece), blockRequest: make(chan BlockRequest)}
+	peerManager := NewPeerManager(infoHash, 4, 1024, 4096, diskIOChans, server.peerChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	go server.Run()
+	go peerManager.Run()
+	return server, peerManager
+}
+
+// dialTestServer connects to the server and sends a handshake
+func dialTestServer(t *testing.T, server *Server, infoHash []byte, peerID [20]byte) *net.TCPConn {
+	conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(server.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol, PeerID: peerID}
+	copy(handshake.InfoHash[:], infoHash)
+	err = binary.Write(conn, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitForOnlyPeer waits for a peer to be the only one in the PeerManager
+func waitForOnlyPeer(t *testing.T, peerManager *PeerManager, peerName string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump := requestSwarmDump(peerManager.snapshot)
+		if dump != nil && len(dump.Peers) == 1 && dump.Peers[0].Name == peerName {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for peer %s to be the only one", peerName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// An incoming connection that completes the handshake is added as a peer
+func TestServerAcceptsPeer(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	server, peerManager := createTestServer(t, infoHash)
+	defer close(server.quit)
+	defer close(peerManager.quit)
+
+	var peerID [20]byte
+	copy(peerID[:], "-XX0001-remotepeerid")
+	conn := dialTestServer(t, server, infoHash, peerID)
+	defer conn.Close()
+
+	var handshake Handshake
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := binary.Read(conn, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatalf("Expected a handshake in reply, but got %s", err)
+	}
+	if !bytes.Equal(handshake.InfoHash[:], infoHash) || handshake.PeerID != PeerID {
+		t.Errorf("Unexpected handshake in reply: %+v", handshake)
+	}
+
+	waitForOnlyPeer(t, peerManager, conn.LocalAddr().String())
+}
+
+// Connections to ourselves, or for another torrent, are closed without
+// adding a peer
+func TestServerRejectsHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	server, peerManager := createTestServer(t, infoHash)
+	defer close(server.quit)
+	defer close(peerManager.quit)
+
+	var otherPeerID [20]byte
+	copy(otherPeerID[:], "-XX0001-remotepeerid")
+	tests := []struct {
+		name     string
+		infoHash []byte
+		peerID   [20]byte
+	}{
+		{"self", infoHash, PeerID},
+		{"wrong infohash", bytes.Repeat([]byte{0xcd}, 20), otherPeerID},
+	}
+	for _, test := range tests {
+		conn := dialTestServer(t, server, test.infoHash, test.peerID)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("Expected the %s connection to be closed, but got %v", test.name, err)
+		}
+		conn.Close()
+	}
+
+	dump := requestSwarmDump(peerManager.snapshot)
+	if dump == nil || len(dump.Peers) != 0 {
+		t.Errorf("Expected no peers to be added, but got %+v", dump)
+	}
+}
+
+// A peer that connects twice with the same peer ID is only added once. The
+// second connection from the same IP is the peer reconnecting from a new
+// port, so it replaces the first.
+func TestServerDuplicatePeerID(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	server, peerManager := createTestServer(t, infoHash)
+	defer close(server.quit)
+	defer close(peerManager.quit)
+
+	var peerID [20]byte
+	copy(peerID[:], "-XX0001-remotepeerid")
+	var handshake Handshake
+	first := dialTestServer(t, server, infoHash, peerID)
+	defer first.Close()
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := binary.Read(first, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForOnlyPeer(t, peerManager, first.LocalAddr().String())
+	second := dialTestServer(t, server, infoHash, peerID)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = binary.Read(second, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForOnlyPeer(t, peerManager, second.LocalAddr().String())
+}
+
+// When two peers dial each other both keep the connection initiated by the
+// peer with the lower peer ID
+func TestKeepConnection(t *testing.T) {
+	lower := make([]byte, 20)
+	higher := bytes.Repeat([]byte{0xff}, 20)
+	tests := []struct {
+		existingOutbound bool
+		outbound         bool
+		peerID           []byte
+		keep             bool
+	}{
+		{false, false, lower, false},
+		{true, true, higher, false},
+		{true, false, lower, true},
+		{false, true, lower, false},
+		{true, false, higher, false},
+		{false, true, higher, true},
+	}
+	for _, test := range tests {
+		existing := &Peer{outbound: test.existingOutbound}
+		keep := keepConnection(existing, handshakedConn{peerID: test.peerID, outbound: test.outbound})
+		if keep != test.keep {
+			t.Errorf("Expected keepConnection to be %t for %+v", test.keep, test)
+		}
+	}
+}
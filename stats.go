@@ -7,30 +7,178 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"time"
 )
 
 type Stats struct {
-	peerCh   chan PeerStats   // receive stats counters from peers
-	diskIOCh chan int         // receive bytes written from diskIO
-	ticker   <-chan time.Time // print updates every tick
+	peerCh   chan peerStatsSnapshot // receive stats counters from peers
+	diskIOCh chan int               // receive bytes written from diskIO
+	swarmCh  chan SwarmStats        // receive swarm statistics from trackers
+	ticker   <-chan time.Time       // print updates every tick
+	writes   func() WriteStats      // write stats from diskIO, may be nil
+	queues   func() DiskQueueStats  // queue depths from diskIO, may be nil
+	cache    func() ReadCacheStats  // read cache counters from diskIO, may be nil
+	// Pieces hash checked under a weakened verification policy, nil with
+	// full verification
+	verification func() VerificationStats
+	ports        func() PortPolicyStats   // candidates affected by the port policy, may be nil
+	reachability func() ReachabilityStats // whether peers can connect to us, may be nil
+	timings      func() PieceTimingStats  // how long pieces took to download, may be nil
+	diskStatsCh  chan DiskStats           // snapshots of the disk throughput from diskIO, may be nil
+	totals       chan chan [2]int         // requests for the bytes downloaded and uploaded
+	rateRequests chan chan TransferRates  // requests for the transfer rates
+	peers        map[string]*peerRates    // rates of the peers, by name
+	download     *RateMeter
+	upload       *RateMeter
+	clock        Clock
+	left         chan [2]int                // recalculated bytes left and total, when the wanted files change
+	snapshots    chan chan StatsSnapshot    // requests for a snapshot of the progress
+	announces    chan chan AnnounceCounters // requests for the byte counts to announce
+	lifecycle    lifecycle
+	quit         chan struct{}
 
-	Left       int // bytes left to download
-	Uploaded   int // total bytes uploaded
-	Downloaded int // total bytes downloaded
-	Errors     int // total errors
+	Left       int       // bytes left to download
+	Total      int       // bytes of the wanted pieces, set before Run
+	Uploaded   int       // total bytes uploaded
+	Downloaded int       // total bytes downloaded
+	Errors     int       // total errors
+	Seeders    int       // seeders in the swarm, as last reported by a tracker
+	Leechers   int       // leechers in the swarm, as last reported by a tracker
+	Disk       DiskStats // disk throughput, as last published by diskIO
 }
 
 func NewStats(bytesLeft int, diskIOCh chan int) *Stats {
+	now := systemClock.Now()
 	return &Stats{
-		Left:     bytesLeft,
-		peerCh:   make(chan PeerStats),
-		ticker:   make(chan time.Time),
-		diskIOCh: diskIOCh,
+		Left:         bytesLeft,
+		peerCh:       make(chan peerStatsSnapshot),
+		ticker:       make(chan time.Time),
+		diskIOCh:     diskIOCh,
+		swarmCh:      make(chan SwarmStats),
+		totals:       make(chan chan [2]int),
+		rateRequests: make(chan chan TransferRates),
+		left:         make(chan [2]int),
+		snapshots:    make(chan chan StatsSnapshot),
+		announces:    make(chan chan AnnounceCounters),
+		quit:         make(chan struct{}),
+		peers:        make(map[string]*peerRates),
+		download:     NewRateMeter(rateWindow, now),
+		upload:       NewRateMeter(rateWindow, now),
+		clock:        systemClock,
 	}
 }
 
+// Totals returns the total bytes downloaded and uploaded. Stats must be
+// running.
+func (s *Stats) Totals() (downloaded int, uploaded int) {
+	reply := make(chan [2]int)
+	s.totals <- reply
+	totals := <-reply
+	return totals[0], totals[1]
+}
+
+// AnnounceCounters returns the byte counts to announce to trackers. Corrupt
+// and redundant bytes are counted since diskIO started, zero if Stats has
+// stopped.
+func (s *Stats) AnnounceCounters() AnnounceCounters {
+	reply := make(chan AnnounceCounters, 1)
+	select {
+	case s.announces <- reply:
+	case <-s.quit:
+		return AnnounceCounters{}
+	}
+	return <-reply
+}
+
+// announceCounters returns the byte counts to announce to trackers
+func (s *Stats) announceCounters() AnnounceCounters {
+	counters := AnnounceCounters{Uploaded: s.Uploaded, Downloaded: s.Downloaded, Left: s.Left}
+	if s.writes != nil {
+		writes := s.writes()
+		counters.Corrupt, counters.Redundant = int(writes.FailedBytes), int(writes.ExtraBytes)
+	}
+	return counters
+}
+
+// ETA of a download that isn't progressing
+const InfiniteETA = time.Duration(math.MaxInt64)
+
+// StatsSnapshot is the progress of the download, for display
+type StatsSnapshot struct {
+	Downloaded      int
+	Uploaded        int
+	Left            int
+	Total           int
+	PercentComplete float64
+	DownloadRate    float64 // bytes per second
+	UploadRate      float64 // bytes per second
+	Peers           int     // peers that reported transfers recently
+	ETA             time.Duration
+}
+
+// percentComplete returns the share of total that isn't left, as a
+// percentage
+func percentComplete(left int, total int) float64 {
+	if total <= 0 || left <= 0 {
+		return 100
+	}
+	if left >= total {
+		return 0
+	}
+	return 100 * float64(total-left) / float64(total)
+}
+
+// estimateETA returns the time to download left bytes at rate bytes per
+// second, InfiniteETA if the rate is zero
+func estimateETA(left int, rate float64) time.Duration {
+	if left <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return InfiniteETA
+	}
+	seconds := float64(left) / rate
+	if seconds >= InfiniteETA.Seconds() {
+		return InfiniteETA
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// snapshot returns the progress of the download
+func (s *Stats) snapshot() StatsSnapshot {
+	rates := s.rates()
+	return StatsSnapshot{
+		Downloaded:      s.Downloaded,
+		Uploaded:        s.Uploaded,
+		Left:            s.Left,
+		Total:           s.Total,
+		PercentComplete: percentComplete(s.Left, s.Total),
+		DownloadRate:    rates.DownloadRate,
+		UploadRate:      rates.UploadRate,
+		Peers:           len(rates.Peers),
+		ETA:             estimateETA(s.Left, rates.DownloadRate),
+	}
+}
+
+// Snapshot returns the progress of the download. Stats must be running.
+func (s *Stats) Snapshot() StatsSnapshot {
+	reply := make(chan StatsSnapshot)
+	s.snapshots <- reply
+	return <-reply
+}
+
+// Stop stops Stats and waits for Run to return
+func (s *Stats) Stop() error {
+	return s.lifecycle.stop(func() { close(s.quit) })
+}
+
 func (s *Stats) Run() {
+	if err := s.lifecycle.start(); err != nil {
+		log.Printf("Stats : Run : Not running: %s", err)
+		return
+	}
+	defer s.lifecycle.finish()
 	log.Println("Stats : Run : Started")
 	defer log.Println("Stats : Run : Stopped")
 
@@ -39,13 +187,75 @@ func (s *Stats) Run() {
 	for {
 		select {
 		case stat := <-s.peerCh:
-			s.Downloaded += stat.read
-			s.Uploaded += stat.write
-			s.Errors += stat.errors
+			s.countPeer(stat)
 		case bytesWritten := <-s.diskIOCh:
 			s.Left -= bytesWritten
+		case left := <-s.left:
+			s.Left, s.Total = left[0], left[1]
+		case reply := <-s.snapshots:
+			reply <- s.snapshot()
+		case reply := <-s.announces:
+			reply <- s.announceCounters()
+		case <-s.quit:
+			return
+		case reply := <-s.totals:
+			reply <- [2]int{s.Downloaded, s.Uploaded}
+		case reply := <-s.rateRequests:
+			reply <- s.rates()
+		case disk := <-s.diskStatsCh:
+			s.Disk = disk
+		case swarm := <-s.swarmCh:
+			s.Seeders = swarm.Seeders
+			s.Leechers = swarm.Leechers
 		case <-s.ticker:
-			fmt.Printf("\033[31mDownloaded: %d, Left: %d, Uploaded: %d, Errors: %d\033[0m\n", s.Downloaded, s.Left, s.Uploaded, s.Errors)
+			fmt.Printf("\033[31mDownloaded: %d, Left: %d, Uploaded: %d, Errors: %d, Seeders: %d, Leechers: %d\033[0m\n", s.Downloaded, s.Left, s.Uploaded, s.Errors, s.Seeders, s.Leechers)
+			s.expirePeers()
+			rates := s.rates()
+			fmt.Printf("\033[31mDownload rate: %.1f KB/s, Upload rate: %.1f KB/s, Peers transferring: %d\033[0m\n", rates.DownloadRate/1024, rates.UploadRate/1024, len(rates.Peers))
+			eta := "unknown"
+			if remaining := estimateETA(s.Left, rates.DownloadRate); remaining != InfiniteETA {
+				eta = remaining.Round(time.Second).String()
+			}
+			fmt.Printf("\033[31mComplete: %.1f%%, ETA: %s\033[0m\n", percentComplete(s.Left, s.Total), eta)
+			if s.diskStatsCh != nil {
+				fmt.Printf("\033[31mDisk written: %d (%s writing), Read for uploads: %d (%s reading), Pieces hashed: %d, Hash failures: %d, Write queue: %d\033[0m\n", s.Disk.BytesWritten, s.Disk.WriteTime, s.Disk.BytesRead, s.Disk.ReadTime, s.Disk.PiecesHashed, s.Disk.HashFailures, s.Disk.WriteQueue)
+			}
+			if s.writes != nil {
+				writes := s.writes()
+				fmt.Printf("\033[31mWritten: %d, Extra: %d, Duplicate pieces: %d, Failed pieces: %d\033[0m\n", writes.WrittenBytes, writes.ExtraBytes, writes.DuplicatePieces, writes.FailedPieces)
+			}
+			if s.queues != nil {
+				queues := s.queues()
+				fmt.Printf("\033[31mQueued pieces: %d, Queued block requests: %d, In flight: %d\033[0m\n", queues.QueuedPieces, queues.QueuedRequests, queues.InFlight)
+			}
+			if s.cache != nil {
+				cache := s.cache()
+				fmt.Printf("\033[31mRead cache hits: %d, Misses: %d, Coalesced: %d, Cached: %d pieces (%d bytes)\033[0m\n", cache.Hits, cache.Misses, cache.Coalesced, cache.CachedPieces, cache.CachedBytes)
+			}
+			if s.ports != nil {
+				ports := s.ports()
+				fmt.Printf("\033[31mCandidates on suspicious ports: %d, On blocked ports: %d, Over the per IP limit: %d\033[0m\n", ports.Demoted, ports.Blocked, ports.Capped)
+			}
+			if s.reachability != nil {
+				reachability := s.reachability()
+				fmt.Printf("\033[31mReachability: %s, Inbound connections: %d\033[0m\n", reachabilityNames[reachability.State], reachability.Inbound)
+				if reachability.State == Firewalled {
+					fmt.Printf("\033[31mWARNING: No peer can connect to us, forward TCP port %d to this host or enable UPnP on the router\033[0m\n", reachability.Port)
+				}
+				if reachability.State == InboundFailing {
+					fmt.Printf("\033[31mALERT: Inbound connections failing, %d peers dropped their connection to us then accepted ours, of %d aborted. Check the firewall and the MTU of the path to port %d\033[0m\n", reachability.InboundFailures, reachability.AbortedInbound, reachability.Port)
+				}
+			}
+			if s.timings != nil {
+				timings := s.timings()
+				if timings.Pieces > 0 {
+					fmt.Printf("\033[31mPiece latency p50: %s, p90: %s, p99: %s, Pieces timed: %d\033[0m\n", timings.P50, timings.P90, timings.P99, timings.Pieces)
+				}
+			}
+			if s.verification != nil {
+				verification := s.verification()
+				fmt.Printf("\033[31mWARNING: Verification policy %s, integrity not guaranteed. Hashed pieces: %d, Unhashed pieces: %d, Revoked peers: %d\033[0m\n", verification.Policy, verification.HashedPieces, verification.UnhashedPieces, verification.RevokedPeers)
+			}
 		}
 	}
 }
@@ -0,0 +1,186 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TorrentStatus is the progress of a torrent, for programs polling it
+type TorrentStatus struct {
+	Name           string
+	InfoHash       string // hex encoded
+	Pieces         int
+	ConnectedPeers int
+	Progress       StatsSnapshot
+	Labels         []string          `json:",omitempty"`
+	UserData       map[string]string `json:",omitempty"`
+	Error          string            `json:",omitempty"` // why the status is unavailable
+}
+
+// StatusResponse is the body of a /status response
+type StatusResponse struct {
+	Torrents []TorrentStatus
+}
+
+// Status returns the progress of the torrent. The torrent must be running.
+func (t *Torrent) Status() (TorrentStatus, error) {
+	status := TorrentStatus{Name: t.metaInfo.Info.Name, InfoHash: hex.EncodeToString(t.infoHash), Pieces: t.pieceHashes().Len(), Labels: t.Labels(), UserData: t.UserData()}
+	reply := make(chan TorrentStatus, 1)
+	select {
+	case t.statusRequests <- reply:
+	case <-t.quit:
+		return status, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-t.stopping:
+		return status, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-time.After(dumpTimeout):
+		return status, fmt.Errorf("Torrent %s isn't running", t.metaInfo.Info.Name)
+	}
+	running := <-reply
+	status.ConnectedPeers, status.Progress = running.ConnectedPeers, running.Progress
+	return status, nil
+}
+
+// newTorrentStatus gathers the status of a running torrent from its
+// components
+func newTorrentStatus(stats *Stats, pm *PeerManager) TorrentStatus {
+	var status TorrentStatus
+	status.Progress = stats.Snapshot()
+	if pmDump := requestSwarmDump(pm.snapshot); pmDump != nil {
+		status.ConnectedPeers = len(pmDump.Peers)
+	}
+	return status
+}
+
+// StatusServer serves the status of torrents as JSON over HTTP at /status,
+// or of those with a label at /status?label=<label>, and their .torrent files
+// at /torrent?infohash=<hex encoded infohash>
+type StatusServer struct {
+	Port      uint16
+	listener  net.Listener
+	server    *http.Server
+	torrents  []*Torrent
+	mutex     sync.Mutex // guards torrents
+	lifecycle lifecycle
+}
+
+// NewStatusServer listens for status requests on the given TCP port of
+// addr, or on a port chosen by the system if port is 0
+func NewStatusServer(addr string, port uint16) (*StatusServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	ss := &StatusServer{Port: uint16(listener.Addr().(*net.TCPAddr).Port), listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", ss.serveStatus)
+	mux.HandleFunc("/torrent", ss.serveTorrent)
+	ss.server = &http.Server{Handler: mux}
+	log.Println("StatusServer : Listening on port", ss.Port)
+	return ss, nil
+}
+
+// Add reports the status of a torrent
+func (ss *StatusServer) Add(t *Torrent) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.torrents = append(ss.torrents, t)
+}
+
+// added returns the torrents added
+func (ss *StatusServer) added() []*Torrent {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return append([]*Torrent(nil), ss.torrents...)
+}
+
+// Status returns the status of every torrent added. A torrent that isn't
+// running is reported with the reason.
+func (ss *StatusServer) Status() StatusResponse {
+	return ss.statusWithLabel("")
+}
+
+// statusWithLabel returns the status of the torrents added with a label, or
+// of every torrent if label is empty
+func (ss *StatusServer) statusWithLabel(label string) StatusResponse {
+	torrents := ss.added()
+	response := StatusResponse{Torrents: make([]TorrentStatus, 0, len(torrents))}
+	for _, t := range torrents {
+		if label != "" && !t.HasLabel(label) {
+			continue
+		}
+		status, err := t.Status()
+		if err != nil {
+			status.Error = err.Error()
+		}
+		response.Torrents = append(response.Torrents, status)
+	}
+	return response
+}
+
+func (ss *StatusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(ss.statusWithLabel(r.URL.Query().Get("label")))
+}
+
+// ExportTorrents writes the .torrent file of every torrent added to dir,
+// see ExportTorrents
+func (ss *StatusServer) ExportTorrents(dir string) error {
+	return ExportTorrents(dir, ss.added())
+}
+
+func (ss *StatusServer) serveTorrent(w http.ResponseWriter, r *http.Request) {
+	infoHash := r.URL.Query().Get("infohash")
+	for _, t := range ss.added() {
+		if !strings.EqualFold(infoHash, hex.EncodeToString(t.infoHash)) {
+			continue
+		}
+		metainfo, err := t.Metainfo()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Write(metainfo)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Stop stops serving and waits for Run to return. If Run never started the
+// listener is closed here instead.
+func (ss *StatusServer) Stop() error {
+	err := ss.lifecycle.stop(func() { ss.server.Close() })
+	if err == ErrNeverStarted {
+		ss.listener.Close()
+	}
+	return err
+}
+
+// Run serves status requests until Stop is called
+func (ss *StatusServer) Run() {
+	if err := ss.lifecycle.start(); err != nil {
+		log.Printf("StatusServer : Run : Not running: %s", err)
+		return
+	}
+	defer ss.lifecycle.finish()
+	log.Println("StatusServer : Run : Started")
+	defer log.Println("StatusServer : Run : Completed")
+
+	err := ss.server.Serve(ss.listener)
+	if err != http.ErrServerClosed {
+		log.Println("StatusServer : Run : Unable to serve:", err)
+	}
+}
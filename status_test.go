@@ -0,0 +1,88 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestTorrent writes a single file torrent for metaInfo to dir and
+// returns its path
+func writeTestTorrent(t *testing.T, dir string, metaInfo MetaInfo) string {
+	info := metaInfo.Info
+	torrent := fmt.Sprintf("d4:infod6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%see", info.Length, len(info.Name), info.Name, info.PieceLength, len(info.Pieces), info.Pieces)
+	path := filepath.Join(dir, info.Name+".torrent")
+	if err := ioutil.WriteFile(path, []byte(torrent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The status of a torrent half downloaded is served as JSON
+func TestStatusServer(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	// The first two pieces were downloaded before
+	if err := ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data[:2*pieceLength], 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrent(writeTestTorrent(t, dir, metaInfo), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = dir
+	// The pieces of the test torrent are tiny
+	torrent.allowPieceLength = true
+	go torrent.Run()
+	defer torrent.Stop()
+
+	ss, err := NewStatusServer("localhost", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Add(torrent)
+	go ss.Run()
+	defer ss.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", ss.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected a JSON response, but got %s", contentType)
+	}
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Torrents) != 1 {
+		t.Fatalf("Expected the status of 1 torrent, but got %+v", status)
+	}
+	got := status.Torrents[0]
+	if got.Error != "" {
+		t.Fatalf("Expected the torrent to be running, but got %s", got.Error)
+	}
+	if got.Name != metaInfo.Info.Name || got.InfoHash != hex.EncodeToString(torrent.infoHash) || got.Pieces != 4 || got.ConnectedPeers != 0 {
+		t.Errorf("Expected the name, infohash, piece count and peers of the torrent, but got %+v", got)
+	}
+	progress := got.Progress
+	if progress.Left != 2*pieceLength || progress.Total != 4*pieceLength || progress.PercentComplete != 50 {
+		t.Errorf("Expected the torrent to be half downloaded, but got %+v", progress)
+	}
+	if progress.DownloadRate != 0 || progress.ETA != InfiniteETA {
+		t.Errorf("Expected no ETA without any transfers, but got %+v", progress)
+	}
+}
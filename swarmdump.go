@@ -0,0 +1,391 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Diagnostic dump of the swarm view, for debugging stalled downloads. Each
+// component builds its part of the dump from its own goroutine, so transfers
+// are never paused.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Maximum number of entries in each list of the dump. Longer lists are
+// truncated and the number of entries left out is recorded.
+const maxDumpEntries = 200
+
+// Time to wait for a component to provide its part of the dump
+var dumpTimeout = 5 * time.Second
+
+// SwarmDump is a snapshot of the swarm view of a torrent
+type SwarmDump struct {
+	Time     time.Time
+	Name     string
+	InfoHash string
+
+	// Peer table, merged from the Controller and PeerManager
+	Peers        []DumpPeer
+	PeersOmitted int
+
+	// Availability[n] is the number of pieces we need which n unchoked peers
+	// have
+	Availability []int
+
+	// Pieces we need, in the order the picker prefers them
+	PickerQueue        []int
+	PickerQueueOmitted int
+
+	// Pieces assigned to one or more peers
+	InFlight        []DumpInFlight
+	InFlightOmitted int
+
+	Requests DumpRequests
+
+	// Peers being connected to
+	Dialing        []DumpDial
+	DialingOmitted int
+
+	// Peers that dropped or failed to connect, waiting to be reconnected to
+	Reconnecting        []DumpReconnect
+	ReconnectingOmitted int
+
+	// IPs of peers banned for sending bad pieces
+	Banned        []string
+	BannedOmitted int
+
+	Trackers []TrackerStatus
+
+	// How long completed pieces took to download
+	PieceTimings PieceTimingStats
+
+	ControllerChannels []DumpChannel
+
+	// Components which didn't respond in time
+	Unavailable []string
+}
+
+// DumpPeer is a row of the peer table
+type DumpPeer struct {
+	Name             string
+	Choked           bool // the peer is choking us
+	PiecesAvailable  int
+	ActiveRequests   []int // pieces the peer has been asked to download
+	Downloaded       int
+	Uploaded         int
+	Errors           int
+	Blocks           int // blocks received on this connection and added to a piece
+	DiscardedBlocks  int // blocks received on this connection that weren't requested, or were late or malformed
+	Connections      int // connections to the peer, counted across reconnects from new ports
+	ConnectedSeconds float64
+	DownloadRate     float64 // bytes per second, averaged since connecting or the clock last jumped
+	UploadRate       float64 // bytes per second, averaged since connecting or the clock last jumped
+	ChokeOverride    string  // pin-unchoked or never-unchoke if set with Torrent.SetChokeOverride
+	StickyOverride   bool    // the override is kept when the peer disconnects
+}
+
+// DumpInFlight is a piece assigned to peers by the picker
+type DumpInFlight struct {
+	Piece int
+	Peers []string
+}
+
+// DumpRequests holds the sizes of the outstanding request registries
+type DumpRequests struct {
+	ActivePieceRequests int // piece assignments summed over every peer
+	Corroborating       int // pieces waiting for a copy from another peer
+	CachedPieces        int // pieces held in the DiskIO read cache
+	PendingReads        int // pieces being read into the read cache
+}
+
+// DumpDial is a connection attempt in progress
+type DumpDial struct {
+	Peer  string
+	Since time.Time
+}
+
+// DumpReconnect is a peer that dropped or failed to connect, and the
+// attempts to reconnect to it so far
+type DumpReconnect struct {
+	Peer      string
+	Attempts  int
+	LastError string // why the last attempt failed, empty if the peer dropped
+}
+
+// DumpChannel is the depth of a channel
+type DumpChannel struct {
+	Name string
+	Len  int
+	Cap  int
+}
+
+// dumpSwarm returns the Controller's view of the swarm. It must be called
+// from the Controller's goroutine.
+func (cont *Controller) dumpSwarm() *SwarmDump {
+	dump := new(SwarmDump)
+
+	for _, peerInfo := range cont.peers {
+		peer := DumpPeer{Name: peerInfo.peerName, Choked: peerInfo.isChoked}
+		for _, hasPiece := range peerInfo.availablePieces {
+			if hasPiece {
+				peer.PiecesAvailable++
+			}
+		}
+		for pieceNum := range peerInfo.activeRequests {
+			peer.ActiveRequests = append(peer.ActiveRequests, pieceNum)
+		}
+		sort.Ints(peer.ActiveRequests)
+		dump.Peers = append(dump.Peers, peer)
+	}
+
+	dump.Availability = make([]int, len(cont.peers)+1)
+	for pieceNum, total := range cont.createPeerPieceTotals() {
+		if !cont.finishedPieces[pieceNum] {
+			dump.Availability[total]++
+		}
+	}
+
+	dump.PickerQueue = cont.createRaritySlice()
+
+	for pieceNum, total := range cont.activeRequestsTotals {
+		if total == 0 {
+			continue
+		}
+		inFlight := DumpInFlight{Piece: pieceNum}
+		for _, peerInfo := range cont.peers {
+			if _, exists := peerInfo.activeRequests[pieceNum]; exists {
+				inFlight.Peers = append(inFlight.Peers, peerInfo.peerName)
+			}
+		}
+		sort.Strings(inFlight.Peers)
+		dump.InFlight = append(dump.InFlight, inFlight)
+		dump.Requests.ActivePieceRequests += total
+	}
+	dump.Requests.Corroborating = len(cont.corroborating)
+
+	rx := cont.rxChans
+	dump.ControllerChannels = []DumpChannel{
+		{"diskIO.receivedPiece", len(rx.diskIO.receivedPiece), cap(rx.diskIO.receivedPiece)},
+		{"diskIO.verifyPiece", len(rx.diskIO.verifyPiece), cap(rx.diskIO.verifyPiece)},
+		{"diskIO.unconfirmedPiece", len(rx.diskIO.unconfirmedPiece), cap(rx.diskIO.unconfirmedPiece)},
+		{"diskIO.lostPieces", len(rx.diskIO.lostPieces), cap(rx.diskIO.lostPieces)},
+		{"diskIO.recheck", len(rx.diskIO.recheck), cap(rx.diskIO.recheck)},
+		{"peerManager.newPeer", len(rx.peerManager.newPeer), cap(rx.peerManager.newPeer)},
+		{"peerManager.deadPeer", len(rx.peerManager.deadPeer), cap(rx.peerManager.deadPeer)},
+		{"peer.chokeStatus", len(rx.peer.chokeStatus), cap(rx.peer.chokeStatus)},
+		{"peer.requestDepth", len(rx.peer.requestDepth), cap(rx.peer.requestDepth)},
+		{"peer.havePiece", len(rx.peer.havePiece), cap(rx.peer.havePiece)},
+	}
+	return dump
+}
+
+// dumpSwarm returns the PeerManager's view of the swarm. It must be called
+// from the PeerManager's goroutine.
+func (pm *PeerManager) dumpSwarm() *SwarmDump {
+	dump := new(SwarmDump)
+	now := pm.clock.Now()
+
+	for _, p := range pm.peers {
+		if name, ok := pm.peerIDs[string(p.peerID)]; ok && name != p.peerName {
+			// Replaced by a newer connection to the same peer
+			continue
+		}
+		p.stats.Lock()
+		peer := DumpPeer{Name: p.peerName, Downloaded: p.stats.read, Uploaded: p.stats.write, Errors: p.stats.errors, Blocks: p.stats.blocks, DiscardedBlocks: p.stats.discardedBlocks, Connections: 1}
+		p.stats.Unlock()
+		if history, ok := pm.history[p.identity]; ok {
+			peer.Downloaded += history.read
+			peer.Uploaded += history.write
+			peer.Errors += history.errors
+			peer.Connections = history.connections
+		}
+		peer.ConnectedSeconds = clampElapsed(now.Sub(p.connectedAt), 0).Seconds()
+		peer.DownloadRate, peer.UploadRate, _ = p.stats.rates(now)
+		if override := pm.chokeOverrides.get(p.peerName); override.mode != ChokeAuto {
+			peer.ChokeOverride = chokeOverrideNames[override.mode]
+			peer.StickyOverride = override.sticky
+		}
+		dump.Peers = append(dump.Peers, peer)
+	}
+
+	for peerName, since := range pm.dialing {
+		dump.Dialing = append(dump.Dialing, DumpDial{Peer: peerName, Since: since})
+	}
+	sort.Slice(dump.Dialing, func(i, j int) bool { return dump.Dialing[i].Since.Before(dump.Dialing[j].Since) })
+
+	for peerName, state := range pm.reconnects {
+		dump.Reconnecting = append(dump.Reconnecting, DumpReconnect{Peer: peerName, Attempts: state.attempts, LastError: state.lastErr})
+	}
+	sort.Slice(dump.Reconnecting, func(i, j int) bool { return dump.Reconnecting[i].Peer < dump.Reconnecting[j].Peer })
+
+	for ip := range pm.banned {
+		dump.Banned = append(dump.Banned, ip)
+	}
+	sort.Strings(dump.Banned)
+	return dump
+}
+
+// requestSwarmDump asks a component for its view of the swarm. It returns nil
+// if the component doesn't respond within dumpTimeout.
+func requestSwarmDump(snapshot chan chan *SwarmDump) *SwarmDump {
+	reply := make(chan *SwarmDump, 1)
+	timeout := time.After(dumpTimeout)
+	select {
+	case snapshot <- reply:
+	case <-timeout:
+		return nil
+	}
+	select {
+	case dump := <-reply:
+		return dump
+	case <-timeout:
+		return nil
+	}
+}
+
+// newSwarmDump builds a dump of the swarm view from each component
+func newSwarmDump(cont *Controller, pm *PeerManager, tm *trackerManager, diskio *DiskIO) *SwarmDump {
+	dump := &SwarmDump{Time: time.Now()}
+
+	contDump := requestSwarmDump(cont.snapshot)
+	if contDump != nil {
+		dump.Peers = contDump.Peers
+		dump.Availability = contDump.Availability
+		dump.PickerQueue = contDump.PickerQueue
+		dump.InFlight = contDump.InFlight
+		dump.Requests = contDump.Requests
+		dump.ControllerChannels = contDump.ControllerChannels
+	} else {
+		dump.Unavailable = append(dump.Unavailable, "Controller")
+	}
+
+	pmDump := requestSwarmDump(pm.snapshot)
+	if pmDump != nil {
+		dump.mergePeers(pmDump.Peers)
+		dump.Dialing = pmDump.Dialing
+		dump.Reconnecting = pmDump.Reconnecting
+		dump.Banned = pmDump.Banned
+	} else {
+		dump.Unavailable = append(dump.Unavailable, "PeerManager")
+	}
+
+	dump.Trackers = tm.Statuses()
+	if cont.timings != nil {
+		dump.PieceTimings = cont.timings.Stats()
+	}
+	dump.Requests.CachedPieces, dump.Requests.PendingReads = diskio.cache.sizes()
+
+	sort.Slice(dump.Peers, func(i, j int) bool { return dump.Peers[i].Name < dump.Peers[j].Name })
+	dump.truncate(maxDumpEntries)
+	return dump
+}
+
+// mergePeers adds the PeerManager's stats to the Controller's peer table.
+// Peers known to only one of them are included as well.
+func (dump *SwarmDump) mergePeers(peers []DumpPeer) {
+	index := make(map[string]int)
+	for i, peer := range dump.Peers {
+		index[peer.Name] = i
+	}
+	for _, peer := range peers {
+		i, ok := index[peer.Name]
+		if !ok {
+			peer.Choked = true
+			dump.Peers = append(dump.Peers, peer)
+			continue
+		}
+		merged := &dump.Peers[i]
+		merged.Downloaded = peer.Downloaded
+		merged.Uploaded = peer.Uploaded
+		merged.Errors = peer.Errors
+		merged.Blocks = peer.Blocks
+		merged.DiscardedBlocks = peer.DiscardedBlocks
+		merged.Connections = peer.Connections
+		merged.ConnectedSeconds = peer.ConnectedSeconds
+		merged.DownloadRate = peer.DownloadRate
+		merged.UploadRate = peer.UploadRate
+		merged.ChokeOverride = peer.ChokeOverride
+		merged.StickyOverride = peer.StickyOverride
+	}
+}
+
+// truncate limits each list in the dump to max entries
+func (dump *SwarmDump) truncate(max int) {
+	if len(dump.Peers) > max {
+		dump.PeersOmitted = len(dump.Peers) - max
+		dump.Peers = dump.Peers[:max]
+	}
+	if len(dump.PickerQueue) > max {
+		dump.PickerQueueOmitted = len(dump.PickerQueue) - max
+		dump.PickerQueue = dump.PickerQueue[:max]
+	}
+	if len(dump.InFlight) > max {
+		dump.InFlightOmitted = len(dump.InFlight) - max
+		dump.InFlight = dump.InFlight[:max]
+	}
+	if len(dump.Dialing) > max {
+		dump.DialingOmitted = len(dump.Dialing) - max
+		dump.Dialing = dump.Dialing[:max]
+	}
+	if len(dump.Reconnecting) > max {
+		dump.ReconnectingOmitted = len(dump.Reconnecting) - max
+		dump.Reconnecting = dump.Reconnecting[:max]
+	}
+	if len(dump.Banned) > max {
+		dump.BannedOmitted = len(dump.Banned) - max
+		dump.Banned = dump.Banned[:max]
+	}
+}
+
+// writeSwarmDump writes a dump to a timestamped file in dir and returns the
+// name of the file
+func writeSwarmDump(dump *SwarmDump, dir string) (string, error) {
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("tulva-swarm-%s.json", dump.Time.Format("20060102-150405.000")))
+	err = ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("SwarmDump : writeSwarmDump : Wrote %s", name)
+	return name, nil
+}
+
+// DumpSwarm returns a snapshot of the swarm view of the torrent. The torrent
+// must be running.
+func (t *Torrent) DumpSwarm() (*SwarmDump, error) {
+	reply := make(chan *SwarmDump, 1)
+	select {
+	case t.dumpRequests <- reply:
+	case <-t.quit:
+		return nil, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-t.stopping:
+		return nil, fmt.Errorf("Torrent %s is stopped", t.metaInfo.Info.Name)
+	case <-time.After(dumpTimeout):
+		return nil, fmt.Errorf("Torrent %s isn't running", t.metaInfo.Info.Name)
+	}
+	dump := <-reply
+	dump.Name = t.metaInfo.Info.Name
+	dump.InfoHash = hex.EncodeToString(t.infoHash)
+	return dump, nil
+}
+
+// WriteSwarmDump writes a snapshot of the swarm view of the torrent to a
+// timestamped file in dir and returns the name of the file
+func (t *Torrent) WriteSwarmDump(dir string) (string, error) {
+	dump, err := t.DumpSwarm()
+	if err != nil {
+		return "", err
+	}
+	return writeSwarmDump(dump, dir)
+}
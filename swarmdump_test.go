@@ -0,0 +1,128 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// A dump of a session with one peer connected over loopback parses and
+// contains every section
+func TestSwarmDumpLoopback(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+
+	pieceHashes := PieceHashes(metaInfo.Info.Pieces)
+	serverChans := serverPeerChans{conns: make(chan *net.TCPConn)}
+	trackerManager := NewTrackerManager(6881)
+	peerManager := NewPeerManager(make([]byte, 20), pieceHashes.Len(), pieceLength, len(data), diskio.peerChans, serverChans, make(chan peerStatsSnapshot, 100), trackerManager.peerChans, defaultMaxPeers)
+	controller := NewController(make([]bool, pieceHashes.Len()), pieceHashes, diskio.contChans, peerManager.contChans, peerManager.peerContChans)
+	go controller.Run()
+	go peerManager.Run()
+	defer close(controller.quit)
+	defer close(peerManager.quit)
+
+	tr := &fakeTracker{name: "http://tracker.example.com/announce", response: TrackerResponse{Interval: 1800, Complete: 3, Incomplete: 4}}
+	trackerManager.trackers = []Tracker{tr}
+	trackerManager.recordAnnounce(tr, tr.response, nil)
+
+	// Connect a peer over loopback
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	remote, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	handshake := Handshake{Len: uint8(len(Protocol)), Protocol: Protocol}
+	copy(handshake.PeerID[:], "-XX0001-remotepeerid")
+	err = binary.Write(remote, binary.BigEndian, &handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverChans.conns <- conn
+	peerName := conn.RemoteAddr().String()
+
+	// The Controller learns about the peer asynchronously
+	var dump *SwarmDump
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dump = newSwarmDump(controller, peerManager, trackerManager, diskio)
+		if len(dump.Peers) == 1 && dump.Peers[0].PiecesAvailable == 0 && dump.Peers[0].ConnectedSeconds > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the peer to appear in the dump: %+v", dump.Peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if dump.Peers[0].Name != peerName || !dump.Peers[0].Choked {
+		t.Errorf("Expected choked peer %s in the dump, but got %+v", peerName, dump.Peers[0])
+	}
+	if len(dump.PickerQueue) != pieceHashes.Len() {
+		t.Errorf("Expected %d pieces in the picker queue, but got %v", pieceHashes.Len(), dump.PickerQueue)
+	}
+	if len(dump.Unavailable) != 0 {
+		t.Errorf("Expected every component to respond, but %v didn't", dump.Unavailable)
+	}
+
+	name, err := writeSwarmDump(dump, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed map[string]interface{}
+	err = json.Unmarshal(contents, &parsed)
+	if err != nil {
+		t.Fatalf("Couldn't parse the dump: %s", err)
+	}
+	for _, section := range []string{"Peers", "Availability", "PickerQueue", "InFlight", "Requests", "Dialing", "Reconnecting", "Banned", "Trackers", "ControllerChannels"} {
+		if _, ok := parsed[section]; !ok {
+			t.Errorf("Expected section %s in the dump", section)
+		}
+	}
+	trackers, _ := parsed["Trackers"].([]interface{})
+	if len(trackers) != 1 || trackers[0].(map[string]interface{})["Seeders"] != float64(3) {
+		t.Errorf("Expected the tracker status in the dump, but got %v", parsed["Trackers"])
+	}
+}
+
+// Long lists are truncated and the number of entries left out is recorded
+func TestSwarmDumpTruncate(t *testing.T) {
+	dump := new(SwarmDump)
+	for i := 0; i < 300; i++ {
+		dump.Peers = append(dump.Peers, DumpPeer{})
+		dump.PickerQueue = append(dump.PickerQueue, i)
+	}
+	dump.truncate(maxDumpEntries)
+	if len(dump.Peers) != maxDumpEntries || dump.PeersOmitted != 100 {
+		t.Errorf("Expected %d peers with %d omitted, but got %d with %d omitted", maxDumpEntries, 100, len(dump.Peers), dump.PeersOmitted)
+	}
+	if len(dump.PickerQueue) != maxDumpEntries || dump.PickerQueueOmitted != 100 {
+		t.Errorf("Expected %d pieces with %d omitted, but got %d with %d omitted", maxDumpEntries, 100, len(dump.PickerQueue), dump.PickerQueueOmitted)
+	}
+}
@@ -8,17 +8,98 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"github.com/jackpal/bencode-go"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Torrent struct {
 	metaInfo MetaInfo
 	infoHash []byte
-	peer     chan PeerTuple
-	quit     chan struct{}
+	// The decoded .torrent file without the piece hashes, which are kept
+	// once in metaInfo, nil if unknown
+	metadata       map[string]interface{}
+	peer           chan PeerTuple
+	verifyProgress chan VerifyProgress
+	fileCompleted  chan FileCompleted // files renamed to their final name once complete
+	diskIO         *DiskIO            // set by Run once the files are verified, guarded by diskIOMutex
+	diskIOMutex    sync.Mutex         // guards diskIO
+	downloadDir    string             // directory the files of the torrent are downloaded into
+	// Directory the files are moved to once every wanted piece is verified,
+	// "" to leave them in downloadDir
+	completeDir  string
+	payloadMoved chan PayloadMoved // outcome of moving the files to completeDir
+	allocateMode AllocateMode
+	ioMode       IOMode
+	// Extra disk writes allowed as a multiple of the torrent size before
+	// behaviour is tightened, 0 disables the guard
+	maxWriteAmplification float64
+	// Sync files after this many bytes are written instead of after every
+	// piece, 0 syncs after every piece
+	syncEvery    int64
+	importPath   string              // file or directory to import existing data from at startup
+	diskWorkers  int                 // number of DiskIO workers, the memory profile's if 0
+	port         uint16              // TCP port to listen for peers on, any port if 0
+	verification *VerificationPolicy // which received pieces are hash checked, full if nil
+	maxPeers     int                 // maximum number of connected peers
+	dialTimeout  time.Duration       // time a peer we dial has to accept the connection
+	// Block requests kept outstanding to a peer at least, and at most as
+	// its rate grows
+	requestDepth    int
+	maxRequestDepth int
+	dht             bool     // search the DHT for peers, unless the torrent is private
+	webSeeds        []string // HTTP servers holding the files, from the url-list of the metainfo
+	// Caps on the upload and download rates of every peer together, in
+	// bytes per second, 0 for no cap
+	maxUploadRate   int64
+	maxDownloadRate int64
+	portPolicy      *PortPolicy // how candidates are dialed by their port, DefaultPortPolicy if nil
+	// Choke overrides of peer addresses, see SetChokeOverride
+	chokeOverrides *ChokeOverrides
+	reachability   *Reachability // whether peers can connect to us, see ResetReachability
+	recheck        bool          // verify every piece even if the resume data is valid
+	readOnly       bool          // seed from read-only storage, never writing to it nor downloading missing pieces
+	sequential     bool          // download pieces in ascending order, for streaming
+	// Stop once seeding and the bytes uploaded reach this multiple of the
+	// bytes downloaded, 0 to seed until stopped
+	seedRatioLimit float64
+	// Hosts of trackers known to accept the redundant announce parameter
+	redundantTrackers map[string]bool
+	spaceMargin       float64 // free space within this share of the space needed is warned about
+	wantedFiles       []bool  // files to download, nil for every file, guarded by filesMutex
+	filesMutex        sync.Mutex
+	filesChanged      chan struct{} // signals Run that wantedFiles changed
+	// Bytes of recently read pieces cached for serving block requests, 0
+	// disables the cache
+	readCacheBytes int64
+	memory         MemoryProfile  // bounds on what's kept in memory, see SetMemoryProfile
+	ipFilter       *IPFilterState // IPs peers aren't connected at, see SetIPFilter, nil for none
+	// Serve blocks of pieces read from disk without hash checking them
+	skipUploadCheck bool
+	// Piece lengths the torrent is run with, see checkPieceLength. With
+	// allowPieceLength any positive piece length is run.
+	minPieceLength   int
+	maxPieceLength   int
+	allowPieceLength bool
+	dumpRequests     chan chan *SwarmDump // requests for a dump of the swarm view
+	// Requests for a recheck of every piece, see Recheck
+	recheckRequests chan chan RecheckResult
+	statusRequests  chan chan TorrentStatus // requests for the progress, see Status
+	// Subscriptions to availability changes, see SubscribeAvailability
+	availabilitySubscriptions chan *AvailabilitySubscription
+	// Labels and data of frontends, loaded from downloadDir when first
+	// used, see SetLabels and SetUserData
+	user      *UserData
+	userMutex sync.Mutex // guards user
+	lifecycle lifecycle
+	stopping  chan struct{} // closed by Stop
+	quit      chan struct{} // closed by the caller of NewTorrent to stop the torrent, like Stop
 }
 
 // Metainfo File Structure
@@ -44,60 +125,98 @@ type MetaInfo struct {
 	Encoding     string
 }
 
+// Largest torrent file parsed, so that a hostile or broken server can't
+// exhaust memory. It holds the piece hashes of a torrent of over 12 TiB in
+// pieces of 4 MiB.
+var maxTorrentSize int64 = 64 * 1024 * 1024
+
 // NewTorrent opens the torrent filename specified and parses it,
 // returning a Torrent structure with the MetaInfo and SHA-1 hash of the
 // Info dictionary.
 func NewTorrent(filename string, quit chan struct{}) (*Torrent, error) {
-	torrent := &Torrent{quit: quit}
-
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer file.Close()
+	torrent, err := ParseTorrent(file, quit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	log.Printf("Parse : NewTorrent : Successfully parsed %s", filename)
+	return torrent, nil
+}
+
+// ParseTorrent parses a torrent file read from r, such as the body of an
+// HTTP response or a torrent held in memory, like NewTorrent. At most
+// maxTorrentSize bytes are read, a longer torrent is an error.
+func ParseTorrent(r io.Reader, quit chan struct{}) (*Torrent, error) {
+	// The file is decoded twice, generically to find the info dictionary,
+	// then into the MetaInfo structure
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxTorrentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxTorrentSize {
+		return nil, fmt.Errorf("The torrent is larger than the maximum of %d bytes", maxTorrentSize)
+	}
+	torrent := &Torrent{quit: quit, stopping: make(chan struct{}), verifyProgress: make(chan VerifyProgress, 1), dumpRequests: make(chan chan *SwarmDump), recheckRequests: make(chan chan RecheckResult), statusRequests: make(chan chan TorrentStatus), availabilitySubscriptions: make(chan *AvailabilitySubscription), filesChanged: make(chan struct{}, 1), readCacheBytes: defaultReadCacheBytes, memory: DefaultMemoryProfile, minPieceLength: defaultMinPieceLength, maxPieceLength: defaultMaxPieceLength, maxPeers: defaultMaxPeers, dialTimeout: defaultDialTimeout, requestDepth: defaultRequestDepth, maxRequestDepth: maxRequestDepth, spaceMargin: defaultSpaceMargin, chokeOverrides: NewChokeOverrides(), reachability: NewReachability()}
 
 	// Decode the file into a generic bencode representation
-	m, err := bencode.Decode(file)
+	m, err := bencode.Decode(bytes.NewReader(data))
 	if err != nil {
-		return torrent, err
+		return nil, err
 	}
 	// WTF?: Understand the next line
 	metaMap, ok := m.(map[string]interface{})
 	if !ok {
-		err = errors.New("Couldn't parse torrent file")
-		return torrent, err
+		return nil, errors.New("Couldn't parse torrent file")
 	}
 	infoDict, ok := metaMap["info"]
 	if !ok {
-		err = errors.New("Unable to locate info dict in torrent file")
-		return torrent, err
+		return nil, errors.New("Unable to locate info dict in torrent file")
 	}
 
 	// Create an Info dict based on the decoded file
 	var b bytes.Buffer
 	err = bencode.Marshal(&b, infoDict)
 	if err != nil {
-		return torrent, err
+		return nil, err
 	}
 
 	// Compute the info hash
 	h := sha1.New()
 	h.Write(b.Bytes())
 	torrent.infoHash = append(torrent.infoHash, h.Sum(nil)...)
+	torrent.metadata = withoutPieces(metaMap)
+	torrent.webSeeds = parseURLList(metaMap["url-list"])
 
 	// Populate the metaInfo structure
-	file.Seek(0, 0)
-	err = bencode.Unmarshal(file, &torrent.metaInfo)
+	err = bencode.Unmarshal(bytes.NewReader(data), &torrent.metaInfo)
+	if err != nil {
+		return nil, err
+	}
+	err = torrent.metaInfo.validate()
 	if err != nil {
-		return torrent, err
+		return nil, err
 	}
 
-	log.Printf("Parse : ParseTorrentFile : Successfully parsed %s", filename)
-	log.Printf("Parse : ParseTorrentFile : The length of each piece is %d", torrent.metaInfo.Info.PieceLength)
+	// Every file completes at most once, so sending never has to block
+	torrent.fileCompleted = make(chan FileCompleted, torrent.numFiles())
+	// The files are moved at most once, or fail to
+	torrent.payloadMoved = make(chan PayloadMoved, 1)
+
+	log.Printf("Parse : ParseTorrent : The length of each piece is %d", torrent.metaInfo.Info.PieceLength)
 
 	return torrent, nil
 }
 
+// pieceHashes returns the hashes of the pieces, sharing the memory of the
+// metainfo
+func (t *Torrent) pieceHashes() PieceHashes {
+	return PieceHashes(t.metaInfo.Info.Pieces)
+}
+
 // Init completes the initalization of the Torrent structure
 func (t *Torrent) Init() {
 	// Initialize Length to total length of files when in Multiple File mode
@@ -108,73 +227,401 @@ func (t *Torrent) Init() {
 		}
 	}
 
-	numFiles := 0
-	if len(t.metaInfo.Info.Files) > 0 {
-		// Multiple File Mode
-		for i := 0; i < len(t.metaInfo.Info.Files); i++ {
-			numFiles += 1
-		}
-	} else {
-		// Single File Mode
-		numFiles = 1
+	log.Printf("Torrent : Run : The torrent contains %d file(s), which are split across %d pieces", t.numFiles(), t.pieceHashes().Len())
+	log.Printf("Torrent : Run : The total length of all file(s) is %d", t.metaInfo.Info.Length)
+}
+
+// OpenCompletedFile opens a file of the torrent for reading before the
+// torrent has finished. It fails with ErrFileIncomplete unless every piece
+// covering the file has been verified.
+func (t *Torrent) OpenCompletedFile(index int) (io.ReadSeekCloser, error) {
+	diskIO := t.runningDiskIO()
+	if diskIO == nil {
+		return nil, errors.New("Torrent is not running")
 	}
+	return diskIO.OpenCompletedFile(index)
+}
 
-	log.Printf("Torrent : Run : The torrent contains %d file(s), which are split across %d pieces", numFiles, (len(t.metaInfo.Info.Pieces) / 20))
-	log.Printf("Torrent : Run : The total length of all file(s) is %d", t.metaInfo.Info.Length)
+// ImportData acquires missing pieces from files the user already has
+// elsewhere, see DiskIO.ImportData
+func (t *Torrent) ImportData(path string) (ImportResult, error) {
+	diskIO := t.runningDiskIO()
+	if diskIO == nil {
+		return ImportResult{}, errors.New("Torrent is not running")
+	}
+	return diskIO.ImportData(path)
 }
 
-// calcBytesLeft calculates the bytes remaining to download
-func calcBytesLeft(bytesLeft, pieceLength int, pieces []bool) int {
-	// Compute bytes remaining to download
-	for _, piece := range pieces {
-		if piece {
-			bytesLeft -= pieceLength
-		}
+// CompletedRanges returns the ranges of a file that have been downloaded and
+// verified, for callers that want to read partial regions of a file
+func (t *Torrent) CompletedRanges(fileIndex int) []ByteRange {
+	diskIO := t.runningDiskIO()
+	if diskIO == nil {
+		return nil
 	}
-	return bytesLeft
+	ranges, err := diskIO.CompletedRanges(fileIndex)
+	if err != nil {
+		log.Printf("Torrent : CompletedRanges : %s", err)
+		return nil
+	}
+	return ranges
 }
 
-// Run starts the Torrent session and orchestrates all the child processes
-func (t *Torrent) Run() {
+// runningDiskIO returns the DiskIO of the torrent, nil until Run has verified
+// the files
+func (t *Torrent) runningDiskIO() *DiskIO {
+	t.diskIOMutex.Lock()
+	defer t.diskIOMutex.Unlock()
+	return t.diskIO
+}
+
+// Stop stops the torrent and every component it started, and waits for Run
+// to return. It may be called before Run, more than once and from any
+// goroutine. ErrNeverStarted is returned if Run never started.
+func (t *Torrent) Stop() error {
+	return t.lifecycle.stop(func() { close(t.stopping) })
+}
+
+// Run starts the Torrent session and orchestrates all the child processes.
+// An error is returned if the files of the torrent can't be initialized, in
+// which case nothing else is started.
+func (t *Torrent) Run() error {
+	if err := t.lifecycle.start(); err != nil {
+		return fmt.Errorf("Torrent %s not run: %w", t.metaInfo.Info.Name, err)
+	}
+	defer t.lifecycle.finish()
 	log.Println("Torrent : Run : Started")
 	defer log.Println("Torrent : Run : Completed")
+	if err := t.checkPieceLength(); err != nil {
+		return err
+	}
 	t.Init()
 
-	// initalize the slice of piece hashes
-	pieceHashes := make([][]byte, 0)
-	for offset := 0; offset <= len(t.metaInfo.Info.Pieces)-20; offset += 20 {
-		pieceHashes = append(pieceHashes, []byte(t.metaInfo.Info.Pieces[offset:offset+20]))
+	diskIO := NewDiskIO(t.metaInfo, t.downloadDir)
+	pieceHashes := diskIO.pieceHashes
+	diskIO.verifyProgress = t.verifyProgress
+	diskIO.fileCompleted = t.fileCompleted
+	diskIO.payloadMoved = t.payloadMoved
+	diskIO.readOnly = t.readOnly
+	if t.completeDir != "" && t.readOnly {
+		log.Printf("Torrent : Run : Not moving the files to %s, they're on read-only storage", t.completeDir)
+	} else if t.completeDir != "" {
+		diskIO.completeDir = t.completeDir
+		if dir, err := filepath.Abs(t.completeDir); err == nil {
+			diskIO.completeDir = dir
+		}
+	}
+	diskIO.allocateMode = t.allocateMode
+	diskIO.ioMode = t.ioMode
+	diskIO.spaceMargin = t.spaceMargin
+	diskIO.wantedFiles = t.fileSelection()
+	diskIO.maxWriteAmplification = t.maxWriteAmplification
+	diskIO.verification = t.verification
+	diskIO.cache.budget = t.readCacheBytes
+	memory := t.effectiveMemoryProfile()
+	log.Printf("Torrent : Run : Memory profile %s", memory)
+	// Nothing is queued before DiskIO runs
+	diskIO.writeQueue = make(chan Piece, memory.DiskQueue)
+	diskIO.readQueue = make(chan BlockRequest, memory.DiskQueue)
+	diskIO.skipUploadCheck = t.skipUploadCheck
+	if t.maxPieceLength > 0 && t.metaInfo.Info.PieceLength > t.maxPieceLength {
+		// Allowed by allowPieceLength. Pieces are verified on disk a
+		// chunk at a time, but peers still download each piece into
+		// memory whole, and serving a block would read the whole piece
+		// from disk.
+		log.Printf("Torrent : Run : WARNING: Pieces of %d bytes are downloaded into memory whole, and aren't served to peers", t.metaInfo.Info.PieceLength)
+		diskIO.maxServedPieceLength = t.maxPieceLength
+	}
+	diskIO.workers = memory.DiskWorkers
+	if t.syncEvery > 0 {
+		diskIO.durability = DurabilityNone
+		diskIO.syncEvery = t.syncEvery
+	}
+	// The files are found, and an interrupted move to the complete
+	// directory finished, before the resume data is checked against them
+	if err := diskIO.locatePayload(); err != nil {
+		return err
+	}
+	// Resume data is checked against the files before Init, which may
+	// change them. It's kept in the download directory, wherever the files
+	// are.
+	resumeFile := resumeName(diskIO.incompleteDir, t.infoHash)
+	var resume *ResumeData
+	var resumedPieces []bool
+	if t.recheck {
+		log.Println("Torrent : Run : Verifying every piece, ignoring any resume data")
+	} else {
+		var err error
+		resume, resumedPieces, err = diskIO.loadResume(resumeFile, t.infoHash)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Torrent : Run : Ignoring resume data: %s", err)
+		}
+	}
+	// Which trackers are owed the completed event doesn't depend on the
+	// files, it's kept even when the resume data isn't used
+	var completedStates map[string]string
+	if resume != nil {
+		completedStates = resume.Completed
+	} else if saved, err := readResume(resumeFile, t.infoHash); err == nil {
+		completedStates = saved.Completed
+	}
+	if resume != nil && (resume.ReadOnly != 0) != t.readOnly {
+		log.Printf("Torrent : Run : The resume data was saved with read-only storage %t, it's now %t", resume.ReadOnly != 0, t.readOnly)
+	}
+	err := diskIO.Init()
+	if err != nil {
+		return err
+	}
+	var pieces []bool
+	if resume != nil {
+		pieces = resumedPieces
+		err = diskIO.Resume(pieces)
+	} else {
+		pieces, err = diskIO.Verify()
+	}
+	if err != nil {
+		return err
 	}
-
-	diskIO := NewDiskIO(t.metaInfo)
-	diskIO.Init()
-	pieces := diskIO.Verify()
 	go diskIO.Run()
-	bytesLeft := calcBytesLeft(t.metaInfo.Info.Length, t.metaInfo.Info.PieceLength, pieces)
+	t.diskIOMutex.Lock()
+	t.diskIO = diskIO
+	t.diskIOMutex.Unlock()
+	// Only the wanted pieces are left to download
+	wantedPieces := diskIO.wantedPieces()
+	bytesLeft := diskIO.bytesLeft(pieces, wantedPieces)
 
-	server := NewServer()
+	server, err := NewServer(t.port)
+	if err != nil {
+		return err
+	}
 	stats := NewStats(bytesLeft, diskIO.statsCh)
+	stats.Total = diskIO.bytesLeft(make([]bool, pieceHashes.Len()), wantedPieces)
+	if resume != nil {
+		stats.Downloaded, stats.Uploaded = resume.Downloaded, resume.Uploaded
+	}
+	stats.writes = diskIO.WriteStats
+	stats.queues = diskIO.QueueStats
+	stats.diskStatsCh = diskIO.diskStatsCh
+	stats.cache = diskIO.ReadCacheStats
+	clockJumps := NewClockJumpDetector(systemClock)
 	trackerManager := NewTrackerManager(server.Port)
-	peerManager := NewPeerManager(t.infoHash, len(pieceHashes), t.metaInfo.Info.PieceLength, t.metaInfo.Info.Length, diskIO.peerChans, server.peerChans, stats.peerCh, trackerManager.peerChans)
+	trackerManager.swarmCh = stats.swarmCh
+	trackerManager.clockJumps = clockJumps
+	trackerManager.counters = stats.AnnounceCounters
+	trackerManager.redundantHosts = t.redundantTrackers
+	trackerManager.completedEvents = newCompletedEvents(completedStates)
+	peerManager := NewPeerManager(t.infoHash, pieceHashes.Len(), t.metaInfo.Info.PieceLength, t.metaInfo.Info.Length, diskIO.peerChans, server.peerChans, stats.peerCh, trackerManager.peerChans, t.maxPeers)
+	peerManager.verification = t.verification
+	peerManager.dialTimeout = t.dialTimeout
+	peerManager.requestDepth, peerManager.maxRequestDepth = t.requestDepth, t.maxRequestDepth
+	peerManager.ipFilter = t.ipFilter
+	peerManager.uploadLimit = NewRateLimiter(t.maxUploadRate, systemClock)
+	peerManager.downloadLimit = NewRateLimiter(t.maxDownloadRate, systemClock)
+	if t.portPolicy != nil {
+		peerManager.ports = t.portPolicy
+	}
+	if t.chokeOverrides != nil {
+		peerManager.chokeOverrides = t.chokeOverrides
+	}
+	if t.reachability != nil {
+		peerManager.reachability = t.reachability
+	}
+	if t.metaInfo.Info.Private != 0 {
+		// Private torrents only get their peers from the tracker
+		// (BEP 27)
+		peerManager.pex = nil
+	}
+	peerManager.reachability.port = server.Port
+	peerManager.uploadOnly = t.readOnly
+	peerManager.maxCandidates = memory.MaxCandidates
+	peerManager.maxReconnects = memory.MaxReconnects
+	peerManager.maxServedRequests = memory.MaxServedRequests
+
+	var dht *DHT
+	if t.dht && t.metaInfo.Info.Private != 0 {
+		log.Println("Torrent : Run : Not searching the DHT for peers of a private torrent")
+	} else if t.dht {
+		// The DHT listens on the same port number as the Server, which
+		// is what's announced
+		dht, err = NewDHT(t.infoHash, server.Port, trackerManager.peerChans)
+		if err != nil {
+			log.Printf("Torrent : Run : Not searching the DHT for peers: %s", err)
+		} else {
+			peerManager.dhtPort, peerManager.dhtPings = dht.Port(), dht.pings
+		}
+	} else if len(announceTiers(t.metaInfo)) == 0 {
+		log.Println("Torrent : Run : The torrent has no trackers, peers can only be found with -dht")
+	}
+	stats.ports = peerManager.ports.Stats
+	stats.reachability = peerManager.reachability.Stats
+	if t.verification.Weakened() {
+		log.Printf("Torrent : Run : WARNING: Verification policy is %s, pieces from some peers won't be hash checked", t.verification)
+		t.verification.recheck = diskIO.queueRecheck
+		stats.verification = t.verification.Stats
+	}
 	controller := NewController(pieces, pieceHashes, diskIO.contChans, peerManager.contChans, peerManager.peerContChans)
+	controller.pieceLength, controller.totalLength = t.metaInfo.Info.PieceLength, diskIO.totalLength()
+	controller.sequential = t.sequential
+	controller.maxSimultaneousDownloadsPerPeer = memory.DownloadsPerPeer
+	controller.setWantedPieces(wantedPieces, true)
+	if memory.PieceTimings {
+		stats.timings = controller.timings.Stats
+	} else {
+		controller.timings = nil
+	}
 
+	go clockJumps.Run()
 	go controller.Run()
 	go stats.Run()
 	go peerManager.Run()
-	go server.Serve()
+	go server.Run()
 	go trackerManager.Run(t.metaInfo, t.infoHash)
+	if dht != nil {
+		go dht.Run()
+	}
+	var webSeeder *WebSeeder
+	if len(t.webSeeds) > 0 && !t.readOnly {
+		webSeeder = NewWebSeeder(t.webSeeds, diskIO)
+		webSeeder.numPeers = func() int {
+			if dump := requestSwarmDump(peerManager.snapshot); dump != nil {
+				return len(dump.Peers)
+			}
+			return 0
+		}
+		go webSeeder.Run()
+	}
+
+	if t.importPath != "" && t.readOnly {
+		log.Printf("Torrent : Run : Not importing data from %s onto read-only storage", t.importPath)
+	} else if t.importPath != "" {
+		go func() {
+			_, err := diskIO.ImportData(t.importPath)
+			if err != nil {
+				log.Printf("Torrent : Run : Unable to import data from %s: %s", t.importPath, err)
+			}
+		}()
+	}
 
+	// stop stops every component and returns the error that stopped
+	// DiskIO, if any
+	stop := func() error {
+		stopComponent("Server", server.Stop)
+		if dht != nil {
+			stopComponent("DHT", dht.Stop)
+		}
+		stopComponent("PeerManager", peerManager.Stop)
+		if webSeeder != nil {
+			stopComponent("WebSeeder", webSeeder.Stop)
+		}
+		err := diskIO.Stop()
+		stopComponent("Controller", controller.Stop)
+		// The trackers are told we stopped before Stats, which has
+		// the byte counts to announce, is stopped
+		stopComponent("TrackerManager", trackerManager.Stop)
+		if err == nil {
+			// Every completed piece is durably on disk, and the
+			// trackers won't be told the download completed anymore
+			t.saveResume(diskIO, stats, trackerManager)
+		}
+		stopComponent("ClockJumpDetector", clockJumps.Stop)
+		stopComponent("Stats", stats.Stop)
+		return err
+	}
+
+	resumeTicker := time.NewTicker(resumeInterval)
+	defer resumeTicker.Stop()
+	ratioTicker := time.NewTicker(seedRatioInterval)
+	defer ratioTicker.Stop()
+
+	wantedBytes := stats.Total
+	completed := controller.completed
 	for {
 		select {
+		case <-resumeTicker.C:
+			t.saveResume(diskIO, stats, trackerManager)
+		case <-completed:
+			log.Println("Torrent : Run : Download completed")
+			trackerManager.downloadCompleted()
+			// The trackers are owed the completed event even if we
+			// stop before they can be told
+			t.saveResume(diskIO, stats, trackerManager)
+			completed = nil
+		case <-ratioTicker.C:
+			// The ratio only matters while seeding every wanted piece
+			if t.seedRatioLimit <= 0 || diskIO.bytesLeft(diskIO.verifiedPieces(), diskIO.wantedPieces()) > 0 {
+				break
+			}
+			downloaded, uploaded := stats.Totals()
+			if ratio := seedRatio(downloaded, uploaded, wantedBytes); ratio >= t.seedRatioLimit {
+				log.Printf("Torrent : Run : Stopping, the seed ratio of %.2f reached the limit of %.2f", ratio, t.seedRatioLimit)
+				return stop()
+			}
+		case <-t.filesChanged:
+			err := diskIO.setWantedFiles(t.fileSelection())
+			if err != nil {
+				log.Printf("Torrent : Run : Unable to allocate the wanted files: %s", err)
+			}
+			wantedPieces := diskIO.wantedPieces()
+			wantedBytes = diskIO.bytesLeft(make([]bool, pieceHashes.Len()), wantedPieces)
+			stats.left <- [2]int{diskIO.bytesLeft(diskIO.verifiedPieces(), wantedPieces), wantedBytes}
+			controller.wanted <- wantedPieces
+		case reply := <-t.dumpRequests:
+			go func() { reply <- newSwarmDump(controller, peerManager, trackerManager, diskIO) }()
+		case reply := <-t.statusRequests:
+			go func() { reply <- newTorrentStatus(stats, peerManager) }()
+		case s := <-t.availabilitySubscriptions:
+			controller.subscribe <- s
+		case reply := <-t.recheckRequests:
+			go func() {
+				result, err := diskIO.Recheck()
+				if err != nil {
+					log.Printf("Torrent : Run : Recheck failed: %s", err)
+				}
+				result.err = err
+				reply <- result
+			}()
+		case <-controller.failed:
+			log.Println("Torrent : Run : Stopping because of a disk error")
+			return fmt.Errorf("Torrent %s stopped: %w", t.metaInfo.Info.Name, stop())
+		case <-t.stopping:
+			return stop()
 		case <-t.quit:
-			// TODO: Some of these should block
-			close(server.quit)
-			close(peerManager.quit)
-			close(diskIO.quit)
-			close(controller.quit)
-			close(trackerManager.quit)
-			time.Sleep(time.Second)
-			return
+			return stop()
 		}
 	}
 }
+
+// Interval between checks of the seed ratio while seeding
+var seedRatioInterval = 30 * time.Second
+
+// seedRatio returns the bytes uploaded as a multiple of the bytes
+// downloaded. If nothing was downloaded, because the files were complete
+// when the torrent started, it's a multiple of the wanted bytes instead.
+func seedRatio(downloaded int, uploaded int, wanted int) float64 {
+	if downloaded == 0 {
+		downloaded = wanted
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(uploaded) / float64(downloaded)
+}
+
+// stopComponent stops a component started by Run, logging it if it doesn't
+// stop
+func stopComponent(name string, stop func() error) {
+	if err := stop(); err != nil {
+		log.Printf("Torrent : Run : Unable to stop %s: %s", name, err)
+	}
+}
+
+// saveResume writes the resume file of the torrent, so that the next start
+// can skip verifying the pieces and knows which trackers are owed the
+// completed event
+func (t *Torrent) saveResume(diskIO *DiskIO, stats *Stats, tm *trackerManager) {
+	downloaded, uploaded := stats.Totals()
+	err := diskIO.saveResume(resumeName(diskIO.incompleteDir, t.infoHash), t.infoHash, downloaded, uploaded, tm.completedEvents.snapshot())
+	if err != nil {
+		log.Printf("Torrent : saveResume : Unable to save resume data: %s", err)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedRatio(t *testing.T) {
+	tests := []struct {
+		downloaded, uploaded, wanted int
+		expected                     float64
+	}{
+		{1000, 2000, 4096, 2},
+		{0, 2048, 4096, 0.5},
+		{0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		if ratio := seedRatio(test.downloaded, test.uploaded, test.wanted); ratio != test.expected {
+			t.Errorf("Expected a ratio of %g for %+v, but got %g", test.expected, test, ratio)
+		}
+	}
+}
+
+// A seeding torrent stops by itself once it reaches the seed ratio limit
+func TestSeedRatioLimit(t *testing.T) {
+	defer func(interval time.Duration) { seedRatioInterval = interval }(seedRatioInterval)
+	seedRatioInterval = 10 * time.Millisecond
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	if err := ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrent(writeTestTorrent(t, dir, metaInfo), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = dir
+	// The pieces of the test torrent are tiny
+	torrent.allowPieceLength = true
+	torrent.seedRatioLimit = 1.5
+
+	// 2000 bytes were uploaded for 1000 downloaded before the restart
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	err = diskio.saveResume(resumeName(diskio.incompleteDir, torrent.infoHash), torrent.infoHash, 1000, 2000, nil)
+	closeTestDiskIO(diskio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ratio is only reached with the counters of the resume data
+	resume, _, err := NewDiskIO(metaInfo, dir).loadResume(resumeName(diskio.incompleteDir, torrent.infoHash), torrent.infoHash)
+	if err != nil || resume.Downloaded != 1000 || resume.Uploaded != 2000 {
+		t.Fatalf("Expected the resume data to restore the counters, but got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- torrent.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the torrent to stop without an error, but got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		torrent.Stop()
+		t.Fatal("Expected the torrent to stop once it reached the seed ratio limit")
+	}
+}
+
+// Stopping a torrent, as on SIGINT or SIGTERM, tells the tracker we stopped
+// and closes the files before Stop returns
+func TestTorrentShutdown(t *testing.T) {
+	events := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	if err := ioutil.WriteFile(filepath.Join(dir, metaInfo.Info.Name), data[:2*pieceLength], 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrent(writeTestTorrent(t, dir, metaInfo), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = dir
+	// The pieces of the test torrent are tiny
+	torrent.allowPieceLength = true
+	torrent.metaInfo.Announce = tracker.URL + "/announce"
+	go torrent.Run()
+
+	// The verified files can be read while the torrent starts
+	deadline := time.Now().Add(5 * time.Second)
+	ranges := torrent.CompletedRanges(0)
+	for ranges == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		ranges = torrent.CompletedRanges(0)
+	}
+	if len(ranges) != 1 || ranges[0] != (ByteRange{Offset: 0, Length: int64(2 * pieceLength)}) {
+		t.Errorf("Expected the first 2 pieces to be completed, but got %v", ranges)
+	}
+	select {
+	case event := <-events:
+		if event != "started" {
+			t.Fatalf("Expected the started event first, but got %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the torrent to announce to the tracker")
+	}
+	if err := torrent.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event != "stopped" {
+			t.Errorf("Expected the stopped event, but got %q", event)
+		}
+	default:
+		t.Errorf("Expected the tracker to be told we stopped by the time Stop returned")
+	}
+	for i, file := range torrent.diskIO.files {
+		if file == nil {
+			continue
+		}
+		if _, err := file.Write([]byte{0}); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected file %d to be closed, but writing it returned %v", i, err)
+		}
+	}
+}
+
+// A torrent is parsed from memory the same as from its file, and a file
+// that can't be opened or parsed is an error
+func TestParseTorrent(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	data := createTestPayload(4, 1024)
+	path := writeTestTorrent(t, dir, createTestMetaInfo(data, 1024))
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseTorrent(bytes.NewReader(contents), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := NewTorrent(path, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.infoHash, opened.infoHash) || parsed.metaInfo.Info.Name != "payload" || parsed.pieceHashes().Len() != 4 || parsed.TotalLength() != len(data) {
+		t.Errorf("Expected the torrent parsed from memory to match its file, but got %x %+v", parsed.infoHash, parsed.metaInfo.Info)
+	}
+
+	if _, err := NewTorrent(filepath.Join(dir, "missing.torrent"), make(chan struct{})); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing torrent file to be an error, but got %v", err)
+	}
+	for _, bad := range []string{"", "not bencode", "d8:announce3:fooe", "li1ee"} {
+		if torrent, err := ParseTorrent(bytes.NewReader([]byte(bad)), make(chan struct{})); err == nil || torrent != nil {
+			t.Errorf("Expected %q to be an error, but got %v, %v", bad, torrent, err)
+		}
+	}
+
+	// Only the maximum is read of a torrent that's too large
+	defer func(size int64) { maxTorrentSize = size }(maxTorrentSize)
+	maxTorrentSize = int64(len(contents))
+	if _, err := ParseTorrent(bytes.NewReader(contents), make(chan struct{})); err != nil {
+		t.Errorf("Expected a torrent of the maximum size to be parsed, but got %v", err)
+	}
+	reader := bytes.NewReader(append(contents, make([]byte, 1000)...))
+	if _, err := ParseTorrent(reader, make(chan struct{})); err == nil || reader.Len() != 999 {
+		t.Errorf("Expected a torrent over the maximum size to be an error once a byte past it is read, but got %v with %d bytes unread", err, reader.Len())
+	}
+}
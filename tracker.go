@@ -6,10 +6,13 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
 	"log"
 	"math/rand"
+	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,14 +25,26 @@ const (
 )
 
 type trackerPeerChans struct {
-	stats chan Stats
+	stats chan *Stats
 	peers chan PeerTuple
 }
 
 type trackerManager struct {
-	peerChans trackerPeerChans
-	port      uint16
-	quit      chan struct{}
+	peerChans        trackerPeerChans
+	port             uint16
+	announceAllTiers bool                     // announce to every tier rather than the first working one
+	trackers         []Tracker                // every tracker, in tier order
+	trackersMutex    sync.Mutex               // guards trackers and trackerStatuses
+	trackerStatuses  map[string]TrackerStatus // result of the last announce to each tracker
+	swarmCh          chan SwarmStats          // swarm statistics from announces and scrapes, may be nil
+	clockJumps       *ClockJumpDetector       // tells announcers when the clock jumps, may be nil
+	counters         func() AnnounceCounters  // byte counts to announce, zero if nil
+	redundantHosts   map[string]bool          // hosts of trackers known to accept the redundant parameter
+	completed        chan struct{}            // closed when the download completes
+	completedEvents  *completedEvents         // which trackers are owed the completed event
+	announcers       sync.WaitGroup           // announcers that haven't sent the stopped event yet
+	lifecycle        lifecycle
+	quit             chan struct{}
 }
 
 type TrackerResponse struct {
@@ -40,29 +55,132 @@ type TrackerResponse struct {
 	TrackerId      string `bencode:"tracker id"`
 	Complete       int
 	Incomplete     int
-	Peers          string `bencode:"peers"`
-	//TODO: Figure out how to handle dict of peers
-	//	Peers          []Peers "peers"
+	Peers          []PeerTuple // populated separately, see parseTrackerResponse
 }
 
+// SwarmStats describes the health of the swarm as reported by a tracker
+type SwarmStats struct {
+	Seeders    int // peers with the complete torrent
+	Leechers   int // peers still downloading
+	Downloaded int // number of completed downloads, only reported by scrapes
+}
+
+// Tracker is a single announce URL
 type Tracker interface {
-	Announce(event int)
-	Run()
+	// Announce sends an announce request to the tracker and returns its
+	// response
+	Announce(event int) (TrackerResponse, error)
+	// Scrape requests the swarm statistics for our infohash
+	Scrape() (SwarmStats, error)
+	// Close releases any resources held by the tracker
+	Close()
+	String() string
+}
+
+// AnnounceCounters are the byte counts reported to trackers on announces
+type AnnounceCounters struct {
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Corrupt    int // bytes of pieces that failed their hash check
+	Redundant  int // bytes downloaded again that were already on disk
 }
 
 type tracker struct {
 	announceURL *url.URL
-	response    TrackerResponse
-	peerChans   trackerPeerChans
-	completedCh chan bool
-	timer       <-chan time.Time
+	trackerId   string // tracker id from the last response, echoed back on announces
 	stats       Stats
-	key         string
-	port        uint16
-	infoHash    []byte
+	counters    func() AnnounceCounters // byte counts to announce, stats is announced if nil
+	// The tracker software is known to accept the redundant parameter
+	acceptsRedundant bool
+	// Other trackers can be announced to instead, so a single bounded
+	// attempt is made rather than waiting out an unresponsive tracker
+	failover bool
+	key      string
+	port     uint16
+	infoHash []byte
+	quit     chan struct{}
+}
+
+// announceCounters returns the byte counts to announce
+func (tr *tracker) announceCounters() AnnounceCounters {
+	if tr.counters != nil {
+		return tr.counters()
+	}
+	return AnnounceCounters{Uploaded: tr.stats.Uploaded, Downloaded: tr.stats.Downloaded, Left: tr.stats.Left}
+}
+
+// Time to wait before announcing again after every tracker failed
+var announceRetryInterval = 5 * time.Minute
+
+// Interval between announces if the tracker doesn't return one
+var defaultAnnounceInterval = 30 * time.Minute
+
+// Time an HTTP tracker has to respond when there are other trackers to fail
+// over to. A UDP tracker makes a single attempt of requestTimeout instead.
+var failoverTimeout = 15 * time.Second
+
+// Time the announcers have to send the stopped event when the trackerManager
+// stops, so that an unresponsive tracker doesn't hold up shutting down
+var stoppedAnnounceTimeout = 5 * time.Second
+
+// announcer announces to tiers of trackers as described in BEP 12. Trackers
+// within a tier are tried in order, and a tier is only abandoned for the next
+// one when all of its trackers have failed.
+type announcer struct {
+	tiers       [][]Tracker
+	peerChans   trackerPeerChans
+	swarmCh     chan SwarmStats                       // receives the swarm statistics from each response, may be nil
+	record      func(Tracker, TrackerResponse, error) // records the result of each announce, may be nil
+	interval    time.Duration                         // interval returned by the last tracker response
+	minInterval time.Duration                         // min interval returned by the last tracker response
+	clock       Clock                                 // schedules the next announce, the system clock if nil
+	clockJumps  <-chan time.Duration                  // receives how far the clock jumped, may be nil
+	completed   chan struct{}                         // closed when the download completes
+	events      *completedEvents                      // which trackers are owed the completed event, may be nil
 	quit        chan struct{}
 }
 
+// parseCompactPeers parses a compact peer list (BEP 23), a string of 6-byte
+// entries each consisting of a 4-byte IPv4 address and a 2-byte port in
+// network byte order. Any trailing partial entry is ignored.
+func parseCompactPeers(b []byte) []PeerTuple {
+	peers := make([]PeerTuple, 0, len(b)/6)
+	for i := 0; i+6 <= len(b); i += 6 {
+		peerIP := net.IPv4(b[i], b[i+1], b[i+2], b[i+3])
+		peerPort := uint16(b[i+4])<<8 | uint16(b[i+5])
+		peers = append(peers, PeerTuple{peerIP, peerPort})
+	}
+	return peers
+}
+
+// parseDictPeers parses the original (non-compact) peer list, a list of
+// dictionaries containing the keys 'peer id', 'ip' and 'port'. Entries with
+// a missing or unparseable IP or port are skipped.
+func parseDictPeers(list []interface{}) []PeerTuple {
+	peers := make([]PeerTuple, 0, len(list))
+	for _, entry := range list {
+		dict, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ip, ok := dict["ip"].(string)
+		if !ok {
+			continue
+		}
+		peerIP := net.ParseIP(ip)
+		if peerIP == nil {
+			continue
+		}
+		port, ok := dict["port"].(int64)
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+		peers = append(peers, PeerTuple{peerIP, uint16(port)})
+	}
+	return peers
+}
+
 func initKey() string {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	key := make([]byte, 4)
@@ -72,64 +190,552 @@ func initKey() string {
 	return hex.EncodeToString(key)
 }
 
-func newTracker(key string, chans trackerPeerChans, port uint16, infoHash []byte, announce string, quit chan struct{}) Tracker {
+func newTracker(key string, port uint16, infoHash []byte, announce string, quit chan struct{}) (Tracker, error) {
 	announceURL, err := url.Parse(announce)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if len(key) < 8 {
 		log.Fatalf("newTracker: key too short %d (expected at least 8 bytes)\n", len(key))
 	}
 
 	if strings.HasPrefix(announceURL.String(), "udp://") {
-		tracker := NewUdpTracker(key, chans, port, infoHash, announceURL)
+		tracker := NewUdpTracker(key, port, infoHash, announceURL)
 		tracker.infoHash = make([]byte, len(infoHash))
 		tracker.quit = quit
 		copy(tracker.infoHash, infoHash)
-		return tracker
+		return tracker, nil
 	}
 
-	tracker := &HttpTracker{key: key, peerChans: chans, port: port, infoHash: infoHash, announceURL: announceURL}
+	tracker := &HttpTracker{key: key, port: port, infoHash: infoHash, announceURL: announceURL}
 	tracker.infoHash = make([]byte, len(infoHash))
 	tracker.quit = quit
 	copy(tracker.infoHash, infoHash)
 
-	return tracker
+	return tracker, nil
+}
+
+// configureTracker gives a tracker the byte counts to announce
+func (tm *trackerManager) configureTracker(tr Tracker) {
+	switch tr := tr.(type) {
+	case *HttpTracker:
+		tr.counters = tm.counters
+		tr.acceptsRedundant = tm.redundantHosts[strings.ToLower(tr.announceURL.Hostname())]
+	case *UdpTracker:
+		tr.counters = tm.counters
+	}
+}
+
+// boundAttempts has the trackers of an announcer make a single bounded
+// attempt when there's more than one of them, so that an unresponsive tracker
+// doesn't hold up the others for the two hours of BEP 15 retransmissions
+func boundAttempts(tiers [][]Tracker) {
+	trackers := 0
+	for _, tier := range tiers {
+		trackers += len(tier)
+	}
+	if trackers < 2 {
+		return
+	}
+	for _, tier := range tiers {
+		for _, tr := range tier {
+			switch tr := tr.(type) {
+			case *HttpTracker:
+				tr.failover = true
+			case *UdpTracker:
+				tr.failover = true
+			}
+		}
+	}
+}
+
+// ParseHostList parses a comma separated list of host names such as
+// "tracker.example.com,10.0.0.1", an empty string is an empty set
+func ParseHostList(s string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		if host := strings.TrimSpace(field); host != "" {
+			hosts[strings.ToLower(host)] = true
+		}
+	}
+	return hosts
 }
 
 func NewTrackerManager(port uint16) *trackerManager {
 	chans := new(trackerPeerChans)
 	chans.peers = make(chan PeerTuple)
-	chans.stats = make(chan Stats)
-	return &trackerManager{peerChans: *chans, port: port, quit: make(chan struct{})}
+	chans.stats = make(chan *Stats)
+	return &trackerManager{peerChans: *chans, port: port, completed: make(chan struct{}), completedEvents: newCompletedEvents(nil), quit: make(chan struct{})}
+}
+
+// announceTiers returns the tiers of announce URLs for a torrent. If the
+// announce-list key is present the announce key is ignored (BEP 12). The URLs
+// within each tier are shuffled.
+func announceTiers(m MetaInfo) [][]string {
+	if len(m.AnnounceList) == 0 {
+		if len(m.Announce) == 0 {
+			return nil
+		}
+		return [][]string{{m.Announce}}
+	}
+	tiers := make([][]string, 0, len(m.AnnounceList))
+	for _, urls := range m.AnnounceList {
+		if len(urls) == 0 {
+			continue
+		}
+		tier := make([]string, len(urls))
+		for i, j := range rand.Perm(len(urls)) {
+			tier[i] = urls[j]
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+// Stop stops the announcers, which send the stopped event, and waits for Run
+// to return. Run waits up to stoppedAnnounceTimeout for the stopped events to
+// be sent.
+func (tm *trackerManager) Stop() error {
+	return tm.lifecycle.stop(func() { close(tm.quit) })
 }
 
-// Run spawns trackers for each announce URL
+// Run creates trackers for each announce URL and spawns announcers for them.
+// Normally a single announcer works through all tiers, but if
+// announceAllTiers is set each tier gets its own announcer.
 func (tm *trackerManager) Run(m MetaInfo, infoHash []byte) {
+	if err := tm.lifecycle.start(); err != nil {
+		log.Printf("TrackerManager : Run : Not running: %s", err)
+		return
+	}
+	defer tm.lifecycle.finish()
 	log.Println("TrackerManager : Run : Started")
 	defer log.Println("TrackerManager : Run : Completed")
 
-	// Handle multiple announce URL's
-	for i := range m.AnnounceList {
-		// TODO: Correctly implement BEP 12 - currently connects to all trackers on all tiers
-		for _, announceURL := range m.AnnounceList[i] {
-			log.Println("TrackerManager : Starting Tracker", announceURL)
-			tr := newTracker(initKey(), tm.peerChans, tm.port, infoHash, announceURL, tm.quit)
-			go tr.Run()
+	tiers := make([][]Tracker, 0)
+	for _, urls := range announceTiers(m) {
+		tier := make([]Tracker, 0, len(urls))
+		for _, announceURL := range urls {
+			tr, err := newTracker(initKey(), tm.port, infoHash, announceURL, tm.quit)
+			if err != nil {
+				log.Printf("TrackerManager : Run : Ignoring tracker %s: %s", announceURL, err)
+				continue
+			}
+			tm.configureTracker(tr)
+			tier = append(tier, tr)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
 		}
 	}
-	// Handle a single announce URL
-	if len(m.Announce) > 0 {
-		log.Println("TrackerManager : Starting Tracker", m.Announce)
-		tr := newTracker(initKey(), tm.peerChans, tm.port, infoHash, m.Announce, tm.quit)
-		go tr.Run()
+
+	tm.trackersMutex.Lock()
+	for _, tier := range tiers {
+		tm.trackers = append(tm.trackers, tier...)
+	}
+	tm.completedEvents.add(tm.trackers)
+	tm.trackersMutex.Unlock()
+
+	if tm.announceAllTiers {
+		for _, tier := range tiers {
+			boundAttempts([][]Tracker{tier})
+			a := &announcer{tiers: [][]Tracker{tier}, peerChans: tm.peerChans, swarmCh: tm.swarmCh, record: tm.recordAnnounce, clockJumps: tm.clockJumps.Subscribe(), completed: tm.completed, events: tm.completedEvents, quit: tm.quit}
+			tm.runAnnouncer(a)
+		}
+	} else if len(tiers) > 0 {
+		boundAttempts(tiers)
+		a := &announcer{tiers: tiers, peerChans: tm.peerChans, swarmCh: tm.swarmCh, record: tm.recordAnnounce, clockJumps: tm.clockJumps.Subscribe(), completed: tm.completed, events: tm.completedEvents, quit: tm.quit}
+		tm.runAnnouncer(a)
 	}
 
 	for {
 		select {
 		case <-tm.quit:
 			log.Println("TrackerManager : Run : Stopping")
+			tm.waitForAnnouncers(stoppedAnnounceTimeout)
+			return
+		}
+	}
+}
+
+// downloadCompleted owes the completed event to every tracker that wasn't
+// sent it before, and has the announcers announce it
+func (tm *trackerManager) downloadCompleted() {
+	tm.completedEvents.complete()
+	close(tm.completed)
+}
+
+// runAnnouncer starts an announcer, which is waited for when stopping
+func (tm *trackerManager) runAnnouncer(a *announcer) {
+	tm.announcers.Add(1)
+	go func() {
+		defer tm.announcers.Done()
+		a.Run()
+	}()
+}
+
+// waitForAnnouncers waits up to timeout for the announcers to send the
+// stopped event and return
+func (tm *trackerManager) waitForAnnouncers(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		tm.announcers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("TrackerManager : Run : WARNING: Not waiting more than %v for the trackers to be told we stopped", timeout)
+	}
+}
+
+// Scrape requests the swarm statistics from the first tracker that supports
+// scraping, in tier order
+func (tm *trackerManager) Scrape() (SwarmStats, error) {
+	tm.trackersMutex.Lock()
+	trackers := tm.trackers
+	tm.trackersMutex.Unlock()
+
+	err := errScrapeUnsupported
+	for _, tr := range trackers {
+		var swarm SwarmStats
+		swarm, err = tr.Scrape()
+		if err != nil {
+			log.Printf("TrackerManager : Scrape : Error (%s): %v", tr, err)
+			continue
+		}
+		sendSwarmStats(tm.swarmCh, swarm)
+		return swarm, nil
+	}
+	return SwarmStats{}, err
+}
+
+// TrackerStatus is the result of the last announce to a tracker
+type TrackerStatus struct {
+	URL          string
+	LastAnnounce time.Time
+	LastError    string
+	Peers        int
+	Seeders      int
+	Leechers     int
+	Interval     int
+	Completed    string // completedOwed or completedSent once the download completed
+}
+
+// recordAnnounce records the result of an announce to a tracker
+func (tm *trackerManager) recordAnnounce(tr Tracker, response TrackerResponse, err error) {
+	status := TrackerStatus{URL: tr.String(), LastAnnounce: time.Now()}
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.Peers = len(response.Peers)
+		status.Seeders = response.Complete
+		status.Leechers = response.Incomplete
+		status.Interval = response.Interval
+	}
+	tm.trackersMutex.Lock()
+	defer tm.trackersMutex.Unlock()
+	if tm.trackerStatuses == nil {
+		tm.trackerStatuses = make(map[string]TrackerStatus)
+	}
+	tm.trackerStatuses[status.URL] = status
+}
+
+// Statuses returns the status of every tracker in tier order. Trackers which
+// haven't been announced to yet only have their URL set.
+func (tm *trackerManager) Statuses() []TrackerStatus {
+	tm.trackersMutex.Lock()
+	defer tm.trackersMutex.Unlock()
+	statuses := make([]TrackerStatus, 0, len(tm.trackers))
+	for _, tr := range tm.trackers {
+		status, ok := tm.trackerStatuses[tr.String()]
+		if !ok {
+			status.URL = tr.String()
+		}
+		status.Completed = tm.completedEvents.state(tr)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// States of the completed event for a tracker
+const (
+	completedOwed = "owed" // the download completed, the tracker hasn't been told yet
+	completedSent = "sent" // the tracker was told the download completed
+)
+
+// completedEvents tracks the completed event for each tracker, by announce
+// URL. It's kept in the resume data, so that a tracker which couldn't be
+// told the download completed before we stopped is told after a restart,
+// and a tracker that was told isn't told again. Nothing is owed for a
+// download that was already complete when the torrent was added.
+type completedEvents struct {
+	mutex    sync.Mutex
+	states   map[string]string
+	trackers []Tracker // every tracker, owed the event once the download completes
+	finished bool      // the download completed while running
+}
+
+// newCompletedEvents returns the completed events with the states saved in
+// resume data, which may be nil
+func newCompletedEvents(states map[string]string) *completedEvents {
+	ce := &completedEvents{states: make(map[string]string)}
+	for announceURL, state := range states {
+		if state == completedOwed || state == completedSent {
+			ce.states[announceURL] = state
+		}
+	}
+	return ce
+}
+
+// add adds the trackers of the torrent, which are owed the event if the
+// download has already completed
+func (ce *completedEvents) add(trackers []Tracker) {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	ce.trackers = append(ce.trackers, trackers...)
+	if ce.finished {
+		ce.owe(trackers)
+	}
+}
+
+// complete owes the event to every tracker that wasn't sent it
+func (ce *completedEvents) complete() {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	ce.finished = true
+	ce.owe(ce.trackers)
+}
+
+// owe owes the event to the trackers that weren't sent it, ce.mutex must be
+// held
+func (ce *completedEvents) owe(trackers []Tracker) {
+	for _, tr := range trackers {
+		if ce.states[tr.String()] != completedSent {
+			ce.states[tr.String()] = completedOwed
+		}
+	}
+}
+
+// event returns the event to announce to a tracker instead of a regular
+// announce or the completed event: completed while it's owed the event, and
+// a regular announce once it was sent. Other events are announced as they
+// are.
+func (ce *completedEvents) event(tr Tracker, event int) int {
+	if ce == nil || (event != Interval && event != Completed) {
+		return event
+	}
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	if ce.states[tr.String()] == completedOwed {
+		return Completed
+	}
+	return Interval
+}
+
+// sent records that a tracker was sent the event
+func (ce *completedEvents) sent(tr Tracker) {
+	if ce == nil {
+		return
+	}
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	ce.states[tr.String()] = completedSent
+}
+
+// owed returns whether any of the tiers of trackers is owed the event
+func (ce *completedEvents) owed(tiers [][]Tracker) bool {
+	if ce == nil {
+		return false
+	}
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	for _, tier := range tiers {
+		for _, tr := range tier {
+			if ce.states[tr.String()] == completedOwed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// state returns the state of the event for a tracker, empty if the download
+// hasn't completed
+func (ce *completedEvents) state(tr Tracker) string {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	return ce.states[tr.String()]
+}
+
+// snapshot returns the state of the event for each tracker, to be saved in
+// the resume data
+func (ce *completedEvents) snapshot() map[string]string {
+	ce.mutex.Lock()
+	defer ce.mutex.Unlock()
+	if len(ce.states) == 0 {
+		return nil
+	}
+	states := make(map[string]string, len(ce.states))
+	for announceURL, state := range ce.states {
+		states[announceURL] = state
+	}
+	return states
+}
+
+// sendSwarmStats sends swarm statistics without blocking the caller
+func sendSwarmStats(swarmCh chan SwarmStats, swarm SwarmStats) {
+	if swarmCh != nil {
+		go func() { swarmCh <- swarm }()
+	}
+}
+
+// announce sends an announce to the first tracker that responds, trying each
+// tier in turn. The tracker that responded is moved to the front of its tier
+// so that it's tried first next time. Regular announces to a tracker owed the
+// completed event carry it instead.
+func (a *announcer) announce(event int) (TrackerResponse, error) {
+	err := errors.New("No trackers")
+	for _, tier := range a.tiers {
+		for i, tr := range tier {
+			var response TrackerResponse
+			trackerEvent := a.events.event(tr, event)
+			response, err = tr.Announce(trackerEvent)
+			if a.record != nil {
+				a.record(tr, response, err)
+			}
+			if err != nil {
+				log.Printf("Tracker : announce : Error (%s): %v\n", tr, err)
+				continue
+			}
+			if trackerEvent == Completed {
+				a.events.sent(tr)
+			}
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tr
+			return response, nil
+		}
+	}
+	return TrackerResponse{}, err
+}
+
+// Announce announces an event and sends the peers received to the peer
+// manager. It returns a channel on which the next regular announce is due,
+// which is never sooner than the tracker's min interval.
+func (a *announcer) Announce(event int) <-chan time.Time {
+	response, err := a.announce(event)
+	if event == Stopped {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Tracker : Announce : All trackers failed, retrying in %v\n", a.nextAnnounce(announceRetryInterval))
+		return a.schedule(a.nextAnnounce(announceRetryInterval))
+	}
+
+	for _, peer := range response.Peers {
+		// Send the peer IP+port to the Torrent Manager
+		go func(p PeerTuple) { a.peerChans.peers <- p }(peer)
+	}
+	sendSwarmStats(a.swarmCh, SwarmStats{Seeders: response.Complete, Leechers: response.Incomplete})
+
+	a.interval = time.Second * time.Duration(response.Interval)
+	a.minInterval = time.Second * time.Duration(response.MinInterval)
+	nextAnnounce := a.nextAnnounce(a.interval)
+	log.Printf("Tracker : Announce : Scheduling next announce in %v\n", nextAnnounce)
+	return a.schedule(nextAnnounce)
+}
+
+// nextAnnounce returns the time to wait before the next announce, falling
+// back to the default interval and never less than the min interval
+func (a *announcer) nextAnnounce(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	if interval < a.minInterval {
+		interval = a.minInterval
+	}
+	return interval
+}
+
+func (a *announcer) schedule(d time.Duration) <-chan time.Time {
+	return clockOrSystem(a.clock).After(d)
+}
+
+// Run announces the started event, then announces at the interval requested
+// by the tracker, or right away when the clock jumps. The completed event is
+// announced once when the download completes, and the stopped event when the
+// announcer quits. A tracker owed the completed event, because it couldn't be
+// told before or before a restart, is told on the next announce, and right
+// after the started event. Announces run in the background so that quit and
+// the completed event are seen while a tracker is slow to respond. Only one
+// announce is in flight at a time, and an event that comes up meanwhile is
+// announced once it's done.
+func (a *announcer) Run() {
+	log.Println("Tracker : Run : Started")
+	defer log.Println("Tracker : Run : Completed")
+	defer func() {
+		for _, tier := range a.tiers {
+			for _, tr := range tier {
+				tr.Close()
+			}
+		}
+	}()
+
+	var timer <-chan time.Time
+	announced := make(chan (<-chan time.Time))
+	announcing := false
+	pending := -1 // event to announce once the announce in flight is done
+	announce := func(event int) {
+		if announcing {
+			// The completed event takes the place of a regular announce
+			if pending != Completed {
+				pending = event
+			}
+			return
+		}
+		announcing = true
+		go func() { announced <- a.Announce(event) }()
+	}
+
+	// Checked before the started announce, which reorders the tiers
+	owed := a.events.owed(a.tiers)
+	announce(Started)
+	if owed {
+		announce(Completed)
+	}
+
+	for {
+		select {
+		case <-a.quit:
+			log.Println("Tracker : Stop : Stopping")
+			if announcing {
+				// Cut short by quit, or by the failover timeout
+				<-announced
+			}
+			if pending == Completed {
+				a.Announce(Completed)
+			}
+			a.Announce(Stopped)
 			return
+		case timer = <-announced:
+			announcing = false
+			if pending >= 0 {
+				announce(pending)
+				pending = -1
+			}
+		case <-a.completed:
+			// Only announce completion once
+			a.completed = nil
+			announce(Completed)
+		case <-timer:
+			log.Println("Tracker : Run : Interval Timer Expired")
+			announce(Interval)
+		case jump := <-a.clockJumps:
+			// The schedule can't be trusted after the clock jumped,
+			// and the swarm has likely changed while we were away
+			log.Printf("Tracker : Run : Clock jumped by %v, announcing now", jump)
+			announce(Interval)
+		case stats := <-a.peerChans.stats:
+			log.Println("read from stats", stats)
 		}
 	}
 }
@@ -0,0 +1,380 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertPeerTuple(t *testing.T, peers []PeerTuple, index int, ip string, port uint16) {
+	if index >= len(peers) {
+		t.Errorf("Expected peer at index %d, but only %d peers were parsed", index, len(peers))
+		return
+	}
+	if !peers[index].IP.Equal(net.ParseIP(ip)) || peers[index].Port != port {
+		t.Errorf("Expected peers[%d] to be %s:%d, but it was %s:%d", index, ip, port, peers[index].IP, peers[index].Port)
+	}
+}
+
+// Parse a compact peer list containing three peers
+func TestParseCompactPeers(t *testing.T) {
+	compact := []byte{
+		10, 0, 0, 1, 0x1a, 0xe1, // 10.0.0.1:6881
+		192, 168, 1, 20, 0xc8, 0xd5, // 192.168.1.20:51413
+		1, 2, 3, 4, 0x00, 0x50, // 1.2.3.4:80
+	}
+	peers := parseCompactPeers(compact)
+	if len(peers) != 3 {
+		t.Fatalf("Expected %d peers but parsed %d", 3, len(peers))
+	}
+	assertPeerTuple(t, peers, 0, "10.0.0.1", 6881)
+	assertPeerTuple(t, peers, 1, "192.168.1.20", 51413)
+	assertPeerTuple(t, peers, 2, "1.2.3.4", 80)
+}
+
+// A trailing partial entry should be ignored rather than read past the end
+func TestParseCompactPeersTruncated(t *testing.T) {
+	peers := parseCompactPeers([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0})
+	if len(peers) != 1 {
+		t.Fatalf("Expected %d peer but parsed %d", 1, len(peers))
+	}
+	assertPeerTuple(t, peers, 0, "10.0.0.1", 6881)
+}
+
+// Parse a tracker response which returns peers in compact form
+func TestParseTrackerResponseCompact(t *testing.T) {
+	body := "d8:completei5e10:incompletei3e8:intervali1800e5:peers12:" +
+		string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}) + "e"
+	response, err := parseTrackerResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 1800 || response.Complete != 5 || response.Incomplete != 3 {
+		t.Errorf("Unexpected response values: %+v", response)
+	}
+	if len(response.Peers) != 2 {
+		t.Fatalf("Expected %d peers but parsed %d", 2, len(response.Peers))
+	}
+	assertPeerTuple(t, response.Peers, 0, "10.0.0.1", 6881)
+	assertPeerTuple(t, response.Peers, 1, "10.0.0.2", 6882)
+}
+
+// Parse a tracker response which returns peers as a list of dictionaries
+func TestParseTrackerResponseDict(t *testing.T) {
+	body := "d8:intervali900e5:peersl" +
+		"d2:ip8:10.0.0.17:peer id20:-TV0001-0123456789ab4:porti6881ee" +
+		"d2:ip11:192.168.1.24:porti51413ee" +
+		"d2:ip7:invalid4:porti1234ee" +
+		"ee"
+	response, err := parseTrackerResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 900 {
+		t.Errorf("Expected interval to be %d but it was %d", 900, response.Interval)
+	}
+	if len(response.Peers) != 2 {
+		t.Fatalf("Expected %d peers but parsed %d", 2, len(response.Peers))
+	}
+	assertPeerTuple(t, response.Peers, 0, "10.0.0.1", 6881)
+	assertPeerTuple(t, response.Peers, 1, "192.168.1.2", 51413)
+}
+
+// fakeTracker is a Tracker which responds to announces with response, or
+// fails with err
+type fakeTracker struct {
+	name      string
+	response  TrackerResponse
+	err       error
+	announces int
+	events    []int // event of each announce
+}
+
+func (tr *fakeTracker) Announce(event int) (TrackerResponse, error) {
+	tr.announces++
+	tr.events = append(tr.events, event)
+	return tr.response, tr.err
+}
+
+func (tr *fakeTracker) Scrape() (SwarmStats, error) {
+	return SwarmStats{Seeders: tr.response.Complete, Leechers: tr.response.Incomplete}, tr.err
+}
+
+func (tr *fakeTracker) Close() {
+}
+
+func (tr *fakeTracker) String() string {
+	return tr.name
+}
+
+// When every tracker in the first tier fails, the second tier is used
+func TestAnnounceTierFailover(t *testing.T) {
+	tier1 := &fakeTracker{name: "tier1", err: errors.New("connection refused")}
+	tier2a := &fakeTracker{name: "tier2a", err: errors.New("connection refused")}
+	tier2b := &fakeTracker{name: "tier2b", response: TrackerResponse{Interval: 1800}}
+	a := &announcer{tiers: [][]Tracker{{tier1}, {tier2a, tier2b}}}
+
+	response, err := a.announce(Started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 1800 {
+		t.Errorf("Expected the response from %s, but it was %+v", tier2b, response)
+	}
+	if tier1.announces != 1 || tier2a.announces != 1 || tier2b.announces != 1 {
+		t.Errorf("Expected each tracker to be tried once")
+	}
+	// The tracker that responded is moved to the front of its tier
+	if a.tiers[1][0] != tier2b || a.tiers[1][1] != tier2a {
+		t.Errorf("Expected %s to be moved to the front of its tier, but it was %v", tier2b, a.tiers[1])
+	}
+
+	// The first tier is still preferred once it recovers
+	tier1.err = nil
+	a.announce(Interval)
+	if tier1.announces != 2 || tier2b.announces != 1 {
+		t.Errorf("Expected the first tier to be used once it recovered")
+	}
+}
+
+// An error is returned when no tracker responds
+func TestAnnounceAllTiersFail(t *testing.T) {
+	tr := &fakeTracker{name: "tier1", err: errors.New("connection refused")}
+	a := &announcer{tiers: [][]Tracker{{tr}}}
+	if _, err := a.announce(Started); err == nil {
+		t.Errorf("Expected an error when all trackers fail")
+	}
+}
+
+// slowTracker is a fakeTracker whose announces wait to be released
+type slowTracker struct {
+	fakeTracker
+	announcing chan int
+	release    chan struct{}
+}
+
+func (tr *slowTracker) Announce(event int) (TrackerResponse, error) {
+	tr.announcing <- event
+	<-tr.release
+	return tr.fakeTracker.Announce(event)
+}
+
+func expectAnnouncing(t *testing.T, tr *slowTracker, event int) {
+	select {
+	case announced := <-tr.announcing:
+		if announced != event {
+			t.Fatalf("Expected event %d to be announced, but it was %d", event, announced)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected event %d to be announced", event)
+	}
+}
+
+// The announcer keeps handling events while a tracker is slow to respond, and
+// announces the completed event once the announce in flight is done
+func TestAnnounceWhileTrackerSlow(t *testing.T) {
+	tr := &slowTracker{fakeTracker: fakeTracker{name: "slow"}, announcing: make(chan int), release: make(chan struct{})}
+	a := &announcer{tiers: [][]Tracker{{tr}}, peerChans: trackerPeerChans{stats: make(chan *Stats)}, clock: newFakeClock(), completed: make(chan struct{}), quit: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		a.Run()
+		close(done)
+	}()
+
+	expectAnnouncing(t, tr, Started)
+	select {
+	case a.peerChans.stats <- &Stats{}:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the announcer to handle events while the started event is announced")
+	}
+	close(a.completed)
+	tr.release <- struct{}{}
+	expectAnnouncing(t, tr, Completed)
+	close(a.quit)
+	tr.release <- struct{}{}
+	expectAnnouncing(t, tr, Stopped)
+	close(tr.release)
+	<-done
+	if !reflect.DeepEqual(tr.events, []int{Started, Completed, Stopped}) {
+		t.Errorf("Expected the started, completed and stopped events, but they were %v", tr.events)
+	}
+}
+
+// The announce key is ignored when an announce-list is present
+func TestAnnounceTiers(t *testing.T) {
+	var m MetaInfo
+	m.Announce = "http://a/announce"
+	if tiers := announceTiers(m); len(tiers) != 1 || tiers[0][0] != m.Announce {
+		t.Errorf("Expected a single tier with %s, but it was %v", m.Announce, tiers)
+	}
+	m.AnnounceList = [][]string{{"http://b/announce", "http://c/announce"}, {}, {"udp://d:80"}}
+	tiers := announceTiers(m)
+	if len(tiers) != 2 || len(tiers[0]) != 2 || tiers[1][0] != "udp://d:80" {
+		t.Errorf("Unexpected tiers %v", tiers)
+	}
+}
+
+// The next announce is scheduled after the returned interval, but never
+// sooner than the min interval
+func TestAnnounceInterval(t *testing.T) {
+	tr := &fakeTracker{name: "tracker"}
+	clock := newFakeClock()
+	a := &announcer{tiers: [][]Tracker{{tr}}, clock: clock}
+
+	responses := []TrackerResponse{
+		{Interval: 1800},
+		{Interval: 60, MinInterval: 300},
+		{},
+	}
+	expected := []time.Duration{30 * time.Minute, 5 * time.Minute, defaultAnnounceInterval}
+	for i, response := range responses {
+		tr.response = response
+		a.Announce(Interval)
+		if len(clock.scheduled) != i+1 || clock.scheduled[i] != expected[i] {
+			t.Errorf("Expected the next announce for %+v to be scheduled in %v, but it was %v", response, expected[i], clock.scheduled)
+		}
+	}
+
+	// Retries after a failure respect the last min interval
+	tr.response = TrackerResponse{Interval: 60, MinInterval: 600}
+	a.Announce(Interval)
+	tr.err = errors.New("connection refused")
+	a.Announce(Interval)
+	if last := clock.scheduled[len(clock.scheduled)-1]; last != 10*time.Minute {
+		t.Errorf("Expected a retry to wait for the min interval of %v, but it was %v", 10*time.Minute, last)
+	}
+}
+
+// An announce is sent as soon as the clock jumps, rather than when the
+// schedule from before the jump says so
+func TestAnnounceOnClockJump(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server, tr := newTestHttpTracker(t, queries)
+	defer server.Close()
+	clock := newFakeClock()
+	detector := NewClockJumpDetector(clock)
+	go detector.Run()
+	defer close(detector.quit)
+	a := &announcer{tiers: [][]Tracker{{tr}}, clock: clock, clockJumps: detector.Subscribe(), completed: make(chan struct{}), quit: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		a.Run()
+		close(done)
+	}()
+	defer func() {
+		close(a.quit)
+		<-done
+	}()
+
+	expectEvent(t, queries, "started")
+	// The detector's ticker and the next announce
+	clock.waitForTimers(t, 2)
+	clock.Jump(2 * time.Hour)
+	clock.tick(t, time.Second)
+	expectEvent(t, queries, "")
+}
+
+// runTestAnnouncer runs an announcer until it has announced on startup, then
+// stops it
+func runTestAnnouncer(tr *fakeTracker, events *completedEvents) {
+	a := &announcer{tiers: [][]Tracker{{tr}}, clock: newFakeClock(), events: events, quit: make(chan struct{})}
+	close(a.quit)
+	a.Run()
+}
+
+// restartCompletedEvents saves the completed events in a resume file and
+// reads them back, as a restart does
+func restartCompletedEvents(t *testing.T, diskio *DiskIO, dir string, infoHash []byte, events *completedEvents) *completedEvents {
+	name := resumeName(dir, infoHash)
+	if err := diskio.saveResume(name, infoHash, 0, 0, events.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	resume, err := readResume(name, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newCompletedEvents(resume.Completed)
+}
+
+// A tracker that's down when the download completes is owed the completed
+// event across a restart, and told exactly once when it's back up
+func TestCompletedOwedAcrossRestart(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	data := createTestPayload(1, 1024)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, 1024))
+	defer closeTestDiskIO(diskio)
+	if err := diskio.completePiece(Piece{index: 0, data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &fakeTracker{name: "http://tracker/announce", err: errors.New("connection refused")}
+	tm := NewTrackerManager(6881)
+	tm.trackers = []Tracker{tr}
+	tm.completedEvents.add(tm.trackers)
+	a := &announcer{tiers: [][]Tracker{{tr}}, clock: newFakeClock(), events: tm.completedEvents}
+	a.Announce(Started)
+	if status := tm.Statuses()[0]; status.Completed != "" {
+		t.Errorf("Expected nothing to be owed before the download completed, but the status was %+v", status)
+	}
+	tm.downloadCompleted()
+	a.Announce(Completed)
+	// Retries carry the completed event
+	a.Announce(Interval)
+	if status := tm.Statuses()[0]; status.Completed != completedOwed {
+		t.Errorf("Expected the completed event to be owed while the tracker is down, but the status was %+v", status)
+	}
+	expected := []int{Started, Completed, Completed}
+	if !reflect.DeepEqual(tr.events, expected) {
+		t.Errorf("Expected the events %v while the tracker was down, but got %v", expected, tr.events)
+	}
+
+	// The tracker is back up after a restart, and again after another one
+	tr.err = nil
+	events := tm.completedEvents
+	for restart, expected := range [][]int{{Started, Completed, Stopped}, {Started, Stopped}} {
+		events = restartCompletedEvents(t, diskio, dir, infoHash, events)
+		tr.events = nil
+		runTestAnnouncer(tr, events)
+		if !reflect.DeepEqual(tr.events, expected) {
+			t.Errorf("Expected the events %v after restart %d, but got %v", expected, restart+1, tr.events)
+		}
+		if state := events.state(tr); state != completedSent {
+			t.Errorf("Expected the completed event to be sent after restart %d, but it was %q", restart+1, state)
+		}
+	}
+	// Regular announces don't carry it anymore
+	a = &announcer{tiers: [][]Tracker{{tr}}, clock: newFakeClock(), events: events}
+	tr.events = nil
+	a.Announce(Interval)
+	if len(tr.events) != 1 || tr.events[0] != Interval {
+		t.Errorf("Expected a regular announce once the tracker was told, but got %v", tr.events)
+	}
+}
+
+// Nothing is owed to the trackers of a download that was already complete
+// when the torrent was added
+func TestCompletedNotOwedWhenAddedComplete(t *testing.T) {
+	tr := &fakeTracker{name: "http://tracker/announce"}
+	events := newCompletedEvents(nil)
+	events.add([]Tracker{tr})
+	runTestAnnouncer(tr, events)
+	expected := []int{Started, Stopped}
+	if !reflect.DeepEqual(tr.events, expected) {
+		t.Errorf("Expected the events %v, but got %v", expected, tr.events)
+	}
+	if state := events.state(tr); state != "" || events.snapshot() != nil {
+		t.Errorf("Expected nothing to be owed, but the state was %q", state)
+	}
+}
@@ -10,12 +10,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
-	"math"
 	"math/rand"
 	"net"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,10 +24,16 @@ const (
 	initialConnectionId       = 0x41727101980
 	connectMinResponseLength  = 16
 	announceMinResponseLength = 20
+	scrapeResponseLength      = 20
 	connectBufferSize         = 150
 	announceBufferSize        = 20000
+	maxRequestRetries         = 8
+	connectionIdLifetime      = time.Minute
 )
 
+// Time to wait for the first response to a request, doubled on every retry
+var requestTimeout = 15 * time.Second
+
 const (
 	Connect uint32 = iota
 	Announce
@@ -36,10 +43,11 @@ const (
 
 type UdpTracker struct {
 	*tracker
-	ConnectionId  uint64
-	TransactionId uint32
-	ServerAddr    *net.UDPAddr
-	Conn          *net.UDPConn
+	ConnectionId uint64
+	ServerAddr   *net.UDPAddr
+	Conn         *net.UDPConn
+	connectedAt  time.Time  // time the connection ID was obtained
+	mutex        sync.Mutex // only one request may be outstanding at a time
 }
 
 type connectRequest struct {
@@ -85,6 +93,21 @@ type announceResponse struct {
 	Peers         []PeerTuple
 }
 
+type scrapeRequest struct {
+	ConnectionId  uint64
+	Action        uint32
+	TransactionId uint32
+	InfoHash      [20]byte
+}
+
+type scrapeResponse struct {
+	Action        uint32
+	TransactionId uint32
+	Seeders       uint32
+	Completed     uint32
+	Leechers      uint32
+}
+
 func (r *connectRequest) MarshalBinary() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.BigEndian, r)
@@ -98,19 +121,13 @@ func (r *connectResponse) UnmarshalBinary(data []byte) error {
 }
 
 func (r *errorResponse) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewReader(append([]byte{0, 0, 0, data[0]}, data[4:]...))
-	err := binary.Read(buf, binary.BigEndian, &r.Action)
-	if err != nil {
-		return err
+	if len(data) < 8 {
+		return errors.New("Invalid error response length")
 	}
-
-	err = binary.Read(buf, binary.BigEndian, &r.TransactionId)
-	if err != nil {
-		return err
-	}
-
+	r.Action = binary.BigEndian.Uint32(data[0:4])
+	r.TransactionId = binary.BigEndian.Uint32(data[4:8])
 	r.Message = string(data[8:])
-	return err
+	return nil
 }
 
 func (r *announceRequest) MarshalBinary() ([]byte, error) {
@@ -119,6 +136,18 @@ func (r *announceRequest) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+func (r *scrapeRequest) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, r)
+	return buf.Bytes(), err
+}
+
+func (r *scrapeResponse) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+	err := binary.Read(buf, binary.BigEndian, r)
+	return err
+}
+
 func (r *announceResponse) UnmarshalBinary(data []byte) error {
 	buf := bytes.NewReader(data)
 
@@ -147,211 +176,317 @@ func (r *announceResponse) UnmarshalBinary(data []byte) error {
 		return err
 	}
 
-	if len(data) > announceMinResponseLength {
-		peerBytes := bytes.NewReader(data[announceMinResponseLength:])
-		peers := (len(data) - announceMinResponseLength) / 6
+	r.Peers = parseCompactPeers(data[announceMinResponseLength:])
+	return nil
+}
 
-		for i := 0; i < peers; i++ {
-			var peer PeerTuple
-			var ipBuf [4]byte
+func NewUdpTracker(key string, port uint16, infoHash []byte, announce *url.URL) *UdpTracker {
+	return &UdpTracker{tracker: &tracker{key: key, port: port, infoHash: infoHash, announceURL: announce}}
+}
 
-			err = binary.Read(peerBytes, binary.BigEndian, &ipBuf)
-			if err != nil {
-				return err
-			}
+// udpEvent converts an announce event to its value in the UDP protocol
+func udpEvent(event int) uint32 {
+	switch event {
+	case Completed:
+		return 1
+	case Started:
+		return 2
+	case Stopped:
+		return 3
+	}
+	return 0
+}
 
-			err = binary.Read(peerBytes, binary.BigEndian, &peer.Port)
-			if err != nil {
-				return err
-			}
+func (tr *UdpTracker) Announce(event int) (TrackerResponse, error) {
+	if tr.Conn == nil {
+		err := tr.open()
+		if err != nil {
+			return TrackerResponse{}, err
+		}
+	}
+	response, err := tr.announce(event)
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+	return TrackerResponse{
+		Interval:   int(response.Interval),
+		Complete:   int(response.Seeders),
+		Incomplete: int(response.Leechers),
+		Peers:      response.Peers,
+	}, nil
+}
 
-			peer.IP = net.IPv4(ipBuf[0], ipBuf[1], ipBuf[2], ipBuf[3])
-			r.Peers = append(r.Peers, peer)
+func (tr *UdpTracker) Scrape() (SwarmStats, error) {
+	if tr.Conn == nil {
+		err := tr.open()
+		if err != nil {
+			return SwarmStats{}, err
 		}
 	}
-	return nil
+	response, err := tr.scrape()
+	if err != nil {
+		return SwarmStats{}, err
+	}
+	return SwarmStats{
+		Seeders:    int(response.Seeders),
+		Leechers:   int(response.Leechers),
+		Downloaded: int(response.Completed),
+	}, nil
 }
 
-func NewUdpTracker(key string, chans trackerPeerChans, port uint16, infoHash []byte, announce *url.URL) *UdpTracker {
-	return &UdpTracker{&tracker{key: key, peerChans: chans, port: port, infoHash: infoHash, announceURL: announce}, 0, 0, &net.UDPAddr{}, &net.UDPConn{}}
+func (tr *UdpTracker) Close() {
+	if tr.Conn != nil {
+		tr.Conn.Close()
+	}
 }
 
-func (tr *UdpTracker) Announce(event int) {
-	err := tr.connect()
-	if err != nil {
-		log.Printf("Tracker : Could not connect to tracker %s: %v\n", tr.announceURL.String(), err)
-		return
+func (tr *UdpTracker) String() string {
+	return tr.announceURL.String()
+}
+
+// announce connects to the tracker if required, sends an announce request
+// and returns the tracker's response.
+func (tr *UdpTracker) announce(event int) (*announceResponse, error) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if time.Since(tr.connectedAt) > connectionIdLifetime {
+		err := tr.connect()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	key, _ := strconv.ParseUint(tr.key, 16, 4)
+	key, _ := strconv.ParseUint(tr.key, 16, 32)
+	// BEP 15 has no room for the corrupt and redundant counts
+	counters := tr.announceCounters()
 	announce := &announceRequest{
 		ConnectionId:  tr.ConnectionId,
 		Action:        Announce,
-		TransactionId: tr.TransactionId,
+		TransactionId: rand.Uint32(),
 		PeerId:        PeerID,
-		Downloaded:    uint64(tr.stats.Downloaded),
-		Left:          uint64(tr.stats.Left),
-		Uploaded:      uint64(tr.stats.Uploaded),
-		Event:         uint32(event),
+		Downloaded:    uint64(counters.Downloaded),
+		Left:          uint64(counters.Left),
+		Uploaded:      uint64(counters.Uploaded),
+		Event:         udpEvent(event),
 		IpAddr:        0,
 		Key:           uint32(key),
 		NumWant:       -1,
-		Port:          6881,
+		Port:          tr.port,
 	}
 	copy(announce.InfoHash[:20], tr.infoHash)
 	announceBytes, err := announce.MarshalBinary()
 	if err != nil {
-		log.Println("Tracker : Announce : Invalid response")
-		return
+		return nil, err
 	}
 
 	buf := make([]byte, announceBufferSize)
-	length := tr.request(announceBytes, buf)
+	length, err := tr.request(announceBytes, announce.TransactionId, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkErrorResponse(buf[:length])
+	if err != nil {
+		return nil, err
+	}
+	if length < announceMinResponseLength {
+		return nil, errors.New("Invalid announce response length")
+	}
+	response := new(announceResponse)
+	err = response.UnmarshalBinary(buf[:length])
+	if err != nil {
+		return nil, err
+	}
+	if response.Action != Announce {
+		return nil, fmt.Errorf("Unexpected action %d in announce response", response.Action)
+	}
+	return response, nil
+}
+
+// scrape connects to the tracker if required, sends a scrape request for our
+// infohash and returns the tracker's response.
+func (tr *UdpTracker) scrape() (*scrapeResponse, error) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
 
-	if length >= announceMinResponseLength {
-		var response announceResponse
-		err := response.UnmarshalBinary(buf[:length])
+	if time.Since(tr.connectedAt) > connectionIdLifetime {
+		err := tr.connect()
 		if err != nil {
-			// TODO: Handle tracker errors gracefully
-			log.Fatal(err)
+			return nil, err
 		}
+	}
 
-		if event != Stopped {
-			if response.Interval != 0 {
-				nextAnnounce := time.Second * time.Duration(response.Interval)
-				log.Println("Tracker : Announce : Scheduling next announce in", nextAnnounce)
-				tr.timer = time.After(nextAnnounce)
-			}
+	scrape := &scrapeRequest{ConnectionId: tr.ConnectionId, Action: Scrape, TransactionId: rand.Uint32()}
+	copy(scrape.InfoHash[:20], tr.infoHash)
+	scrapeBytes, err := scrape.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
 
-			for _, peer := range response.Peers {
-				// avoid a race condition by copying peer to p
-				go func(p PeerTuple) {
-					// send the peer to peer manager
-					tr.peerChans.peers <- p
-				}(peer)
-			}
-		}
+	buf := make([]byte, connectBufferSize)
+	length, err := tr.request(scrapeBytes, scrape.TransactionId, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkErrorResponse(buf[:length])
+	if err != nil {
+		return nil, err
+	}
+	if length < scrapeResponseLength {
+		return nil, errors.New("Invalid scrape response length")
+	}
+	response := new(scrapeResponse)
+	err = response.UnmarshalBinary(buf[:scrapeResponseLength])
+	if err != nil {
+		return nil, err
+	}
+	if response.Action != Scrape {
+		return nil, fmt.Errorf("Unexpected action %d in scrape response", response.Action)
 	}
+	return response, nil
 }
 
+// checkErrorResponse returns the tracker's error message if the response is
+// an error response
+func checkErrorResponse(data []byte) error {
+	if len(data) < 4 || binary.BigEndian.Uint32(data[0:4]) != Error {
+		return nil
+	}
+	var response errorResponse
+	err := response.UnmarshalBinary(data)
+	if err != nil {
+		return err
+	}
+	return errors.New(response.Message)
+}
+
+// connect obtains a connection ID from the tracker
 func (tr *UdpTracker) connect() error {
 	log.Printf("Tracker : Connect (%v)", tr.announceURL)
 
-	connectReq := connectRequest{ConnectionId: initialConnectionId, Action: Connect, TransactionId: tr.TransactionId}
+	connectReq := connectRequest{ConnectionId: initialConnectionId, Action: Connect, TransactionId: rand.Uint32()}
 	connectBytes, _ := connectReq.MarshalBinary()
 
 	buf := make([]byte, connectBufferSize)
-	length := tr.request(connectBytes, buf)
-
-	if length >= connectMinResponseLength {
-		var response connectResponse
-		err := response.UnmarshalBinary(buf[:length])
-		if err != nil {
-			log.Println("Tracker : Connect : Invalid response")
-			return err
-		}
-
-		if response.Action == Error || tr.TransactionId != response.TransactionId {
-			error := errorResponse{}
-			err := error.UnmarshalBinary(buf)
-			if err != nil {
-				return errors.New(error.Message)
-			} else {
-				return err
-			}
-		}
+	length, err := tr.request(connectBytes, connectReq.TransactionId, buf)
+	if err != nil {
+		return err
+	}
 
-		tr.ConnectionId = response.ConnectionId
-		return nil
+	err = checkErrorResponse(buf[:length])
+	if err != nil {
+		return err
+	}
+	if length < connectMinResponseLength {
+		return errors.New("Invalid connect response length")
+	}
+	var response connectResponse
+	err = response.UnmarshalBinary(buf[:length])
+	if err != nil {
+		return err
+	}
+	if response.Action != Connect {
+		return fmt.Errorf("Unexpected action %d in connect response", response.Action)
 	}
 
-	return errors.New("Invalid connect response length")
+	tr.ConnectionId = response.ConnectionId
+	tr.connectedAt = time.Now()
+	return nil
 }
 
-func (tr *UdpTracker) Run() {
-	log.Printf("Tracker : Run : Started (%s)\n", tr.announceURL)
-	defer log.Printf("Tracker : Run : Completed (%s)\n", tr.announceURL)
-
-	rand.Seed(time.Now().UnixNano())
-
+// open resolves the tracker address and binds a local UDP socket
+func (tr *UdpTracker) open() error {
 	serverAddr, err := net.ResolveUDPAddr("udp", tr.announceURL.Host)
 	if err != nil {
-		log.Println("Tracker : Could not resolve tracker host!")
-		return
+		return err
 	}
 
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
 	if err != nil {
-		log.Println("Tracker : Could not bind to any port")
-		return
+		return err
 	}
 
-	tr.TransactionId = rand.Uint32()
 	tr.ServerAddr = serverAddr
 	tr.Conn = conn
-	tr.Announce(Started)
-
-	for {
-		select {
-		case <-tr.quit:
-			log.Println("Tracker : Stop : Stopping")
-			tr.Announce(Stopped)
-			return
-		case <-tr.completedCh:
-			go tr.Announce(Completed)
-		case <-tr.timer:
-			log.Printf("Tracker : Run : Interval Timer Expired (%s)\n", tr.announceURL)
-			go tr.Announce(Interval)
-		case stats := <-tr.peerChans.stats:
-			log.Println("read from stats", stats)
-		}
-	}
+	return nil
 }
 
-// Send a udp packet to the tracker, fill in the dest buffer with the response
-func (tr *UdpTracker) request(payload []byte, dest []byte) int {
-	n := 0
-	totalAttempts := 0
+// fromServer reports whether a packet was sent by the tracker, rather than
+// by a host trying to inject a response
+func (tr *UdpTracker) fromServer(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && udpAddr.IP.Equal(tr.ServerAddr.IP) && udpAddr.Port == tr.ServerAddr.Port
+}
 
-	// notify the sender when a response is recieved
-	recvChan := make(chan bool)
+// request sends a packet to the tracker and waits for the response with a
+// matching transaction ID, which is copied into dest. If no response is
+// received the packet is retransmitted, waiting 15 * 2 ^ n seconds for a
+// response to attempt n, up to n = 8 (BEP 15). We give up as soon as the
+// tracker is stopped, interrupting the wait for a response. A request made
+// after the tracker was stopped, such as the stopped event, gets a single
+// attempt, as does a request to a tracker with others to fail over to.
+func (tr *UdpTracker) request(payload []byte, transactionId uint32, dest []byte) (int, error) {
+	quit := tr.quit
+	retries := uint(maxRequestRetries)
+	if tr.failover {
+		retries = 0
+	}
+	select {
+	case <-quit:
+		quit = nil
+		retries = 0
+	default:
+	}
+	if quit != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-quit:
+				// Wake up the read waiting for a response
+				tr.Conn.SetReadDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
 
-	// keep sending the packet and wait for the specifed time
-	// before trying again, limit n to 8
-	go func() {
+	for n := uint(0); n <= retries; n++ {
+		if n > 0 {
+			log.Printf("Tracker : request : No response from %s, retransmitting (attempt %d)", tr.announceURL, n+1)
+		}
 
-		// initial send
-		tr.Conn.WriteTo(payload, tr.ServerAddr)
-	Listen:
+		_, err := tr.Conn.WriteTo(payload, tr.ServerAddr)
+		if err != nil {
+			return 0, err
+		}
+
+		tr.Conn.SetReadDeadline(time.Now().Add(requestTimeout * (1 << n)))
 		for {
-			// timeout: 15 * 2 ^ n (0-8)
-			timeout := time.Second * time.Duration(15*int(math.Pow(2.0, float64(n))))
-			timer := time.After(timeout)
+			// Checked after setting the deadline, which may have replaced
+			// the one set when quit was closed
 			select {
-			case <-recvChan:
-				break Listen
-			case <-timer:
-				tr.Conn.WriteTo(payload, tr.ServerAddr)
-				totalAttempts++
-				if n < 8 {
-					n++
+			case <-quit:
+				return 0, errors.New("Tracker stopped")
+			default:
+			}
+			length, addr, err := tr.Conn.ReadFrom(dest)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
 				}
+				return 0, err
 			}
-		}
-	}()
-
-	// read until some data is received
-	var err error
-	length := 0
-	for length == 0 {
-		length, _, err = tr.Conn.ReadFrom(dest)
-
-		// not sure what to do here?
-		if err != nil {
-			log.Println("Tracker : udp packet read error")
+			if !tr.fromServer(addr) {
+				log.Printf("Tracker : request : Ignoring a packet from %s, which isn't %s", addr, tr.announceURL)
+				continue
+			}
+			if length >= 8 && binary.BigEndian.Uint32(dest[4:8]) == transactionId {
+				return length, nil
+			}
+			// Ignore responses to earlier requests
 		}
 	}
-
-	recvChan <- true
-	return length
+	return 0, errors.New("Tracker did not respond")
 }
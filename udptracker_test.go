@@ -0,0 +1,235 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeUdpTracker emulates the connect and announce exchange of a UDP
+// tracker. The first dropRequests requests received are ignored to exercise
+// retransmission. If spoofer is set, a forged connect response is sent from
+// it ahead of each genuine one.
+type fakeUdpTracker struct {
+	conn         *net.UDPConn
+	dropRequests int
+	announces    chan announceRequest
+	spoofer      *net.UDPConn
+}
+
+func newFakeUdpTracker(t *testing.T, dropRequests int) *fakeUdpTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft := &fakeUdpTracker{conn: conn, dropRequests: dropRequests, announces: make(chan announceRequest, 1)}
+	go ft.serve()
+	return ft
+}
+
+func (ft *fakeUdpTracker) serve() {
+	const connectionId = 0x1122334455667788
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := ft.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ft.dropRequests > 0 {
+			ft.dropRequests--
+			continue
+		}
+		response := new(bytes.Buffer)
+		if n == 16 {
+			var req connectRequest
+			binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &req)
+			if req.ConnectionId != initialConnectionId {
+				continue
+			}
+			if ft.spoofer != nil {
+				forged := new(bytes.Buffer)
+				binary.Write(forged, binary.BigEndian, connectResponse{Connect, req.TransactionId, connectionId + 1})
+				ft.spoofer.WriteTo(forged.Bytes(), addr)
+			}
+			binary.Write(response, binary.BigEndian, connectResponse{Connect, req.TransactionId, connectionId})
+		} else {
+			var req announceRequest
+			binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &req)
+			if req.ConnectionId != connectionId {
+				binary.Write(response, binary.BigEndian, []uint32{Error, req.TransactionId})
+				response.WriteString("Invalid connection id")
+			} else {
+				ft.announces <- req
+				binary.Write(response, binary.BigEndian, []uint32{Announce, req.TransactionId, 1800, 3, 7})
+				response.Write([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+			}
+		}
+		ft.conn.WriteTo(response.Bytes(), addr)
+	}
+}
+
+func newTestUdpTracker(t *testing.T, ft *fakeUdpTracker) *UdpTracker {
+	announceURL, _ := url.Parse("udp://" + ft.conn.LocalAddr().String() + "/announce")
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	tr := NewUdpTracker("0badcafe", 51413, infoHash, announceURL)
+	tr.quit = make(chan struct{})
+	err := tr.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// Connect to the tracker and announce, checking the request fields and the
+// parsed response
+func TestUdpTrackerAnnounce(t *testing.T) {
+	ft := newFakeUdpTracker(t, 0)
+	defer ft.conn.Close()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+	tr.stats.Left = 1000
+
+	response, err := tr.announce(Started)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-ft.announces
+	if !bytes.Equal(req.InfoHash[:], tr.infoHash) || req.PeerId != PeerID {
+		t.Errorf("Unexpected infohash %x or peer id %x in announce", req.InfoHash, req.PeerId)
+	}
+	if req.Event != 2 || req.Port != 51413 || req.Key != 0x0badcafe || req.Left != 1000 || req.NumWant != -1 {
+		t.Errorf("Unexpected announce request %+v", req)
+	}
+
+	if response.Interval != 1800 || response.Leechers != 3 || response.Seeders != 7 {
+		t.Errorf("Unexpected announce response %+v", response)
+	}
+	if len(response.Peers) != 2 {
+		t.Fatalf("Expected %d peers but received %d", 2, len(response.Peers))
+	}
+	assertPeerTuple(t, response.Peers, 0, "10.0.0.1", 6881)
+	assertPeerTuple(t, response.Peers, 1, "10.0.0.2", 6882)
+}
+
+// Responses from hosts other than the tracker are ignored, even with the
+// transaction ID of the request
+func TestUdpTrackerSpoofedResponse(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	spoofer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+	ft := &fakeUdpTracker{conn: conn, announces: make(chan announceRequest, 1), spoofer: spoofer}
+	go ft.serve()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+
+	// The announce is rejected if it uses the forged connection ID
+	if _, err := tr.announce(Started); err != nil {
+		t.Fatalf("Expected the forged connect response to be ignored, but got %v", err)
+	}
+	<-ft.announces
+}
+
+// Requests that go unanswered are retransmitted
+func TestUdpTrackerRetransmit(t *testing.T) {
+	timeout := requestTimeout
+	requestTimeout = 20 * time.Millisecond
+	defer func() { requestTimeout = timeout }()
+
+	ft := newFakeUdpTracker(t, 2)
+	defer ft.conn.Close()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+
+	_, err := tr.announce(Stopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-ft.announces; req.Event != 3 {
+		t.Errorf("Expected event %d in announce, but it was %d", 3, req.Event)
+	}
+}
+
+// Stopping the tracker interrupts a request waiting for a response
+func TestUdpTrackerStopped(t *testing.T) {
+	ft := newFakeUdpTracker(t, maxRequestRetries+1)
+	defer ft.conn.Close()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+
+	errCh := make(chan error)
+	go func() {
+		_, err := tr.announce(Started)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(tr.quit)
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("Expected announce to fail when the tracker is stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected stopping the tracker to interrupt the announce")
+	}
+}
+
+// A tracker with others to fail over to gives up after a single attempt,
+// rather than retransmitting for two hours
+func TestUdpTrackerFailover(t *testing.T) {
+	timeout := requestTimeout
+	requestTimeout = 50 * time.Millisecond
+	defer func() { requestTimeout = timeout }()
+
+	ft := newFakeUdpTracker(t, maxRequestRetries+1)
+	defer ft.conn.Close()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+	backup := &fakeTracker{name: "backup", response: TrackerResponse{Interval: 1800}}
+	tiers := [][]Tracker{{tr}, {backup}}
+	boundAttempts(tiers)
+	a := &announcer{tiers: tiers}
+
+	start := time.Now()
+	response, err := a.announce(Started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 1800 {
+		t.Errorf("Expected the response from %s, but it was %+v", backup, response)
+	}
+	if elapsed := time.Since(start); elapsed > 10*requestTimeout {
+		t.Errorf("Expected to fail over after a single attempt, but it took %v", elapsed)
+	}
+}
+
+// Give up after the maximum number of retries without a response
+func TestUdpTrackerNoResponse(t *testing.T) {
+	timeout := requestTimeout
+	requestTimeout = time.Millisecond
+	defer func() { requestTimeout = timeout }()
+
+	ft := newFakeUdpTracker(t, maxRequestRetries+1)
+	defer ft.conn.Close()
+	tr := newTestUdpTracker(t, ft)
+	defer tr.Conn.Close()
+
+	_, err := tr.announce(Started)
+	if err == nil {
+		t.Errorf("Expected announce to fail when the tracker doesn't respond")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Size of the encoded labels and user data of a torrent at most, to keep
+// the files small
+const maxUserDataSize = 4096
+
+// ErrUserDataTooLarge is returned when the labels and user data of a torrent
+// would take more than maxUserDataSize bytes
+var ErrUserDataTooLarge = fmt.Errorf("Labels and user data take more than %d bytes", maxUserDataSize)
+
+// UserData is what frontends attach to a torrent. It's saved bencoded next to
+// the resume file, so that it's kept across restarts.
+type UserData struct {
+	Labels []string          `bencode:"labels"`
+	Data   map[string]string `bencode:"data"`
+}
+
+// userDataName returns the name of the file the user data of a torrent is
+// saved in
+func userDataName(downloadDir string, infoHash []byte) string {
+	return filepath.Join(downloadDir, hex.EncodeToString(infoHash)+".userdata")
+}
+
+// userData returns the user data of the torrent, loading it when first used.
+// userMutex must be held.
+func (t *Torrent) userData() *UserData {
+	if t.user != nil {
+		return t.user
+	}
+	t.user = &UserData{}
+	data, err := ioutil.ReadFile(userDataName(t.downloadDir, t.infoHash))
+	if err == nil {
+		err = bencode.Unmarshal(bytes.NewReader(data), t.user)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Torrent : userData : Ignoring the user data of %s: %s", t.metaInfo.Info.Name, err)
+		t.user = &UserData{}
+	}
+	return t.user
+}
+
+// saveUserData replaces the user data of the torrent and writes it to disk
+// right away. userMutex must be held.
+func (t *Torrent) saveUserData(user *UserData) error {
+	var b bytes.Buffer
+	err := bencode.Marshal(&b, *user)
+	if err != nil {
+		return err
+	}
+	if b.Len() > maxUserDataSize {
+		return ErrUserDataTooLarge
+	}
+	name := userDataName(t.downloadDir, t.infoHash)
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, b.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	t.user = user
+	return nil
+}
+
+// Labels returns the labels of the torrent
+func (t *Torrent) Labels() []string {
+	t.userMutex.Lock()
+	defer t.userMutex.Unlock()
+	return append([]string(nil), t.userData().Labels...)
+}
+
+// HasLabel returns true if the torrent has a label
+func (t *Torrent) HasLabel(label string) bool {
+	for _, l := range t.Labels() {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLabels replaces the labels of the torrent, such as "tv" or
+// "linux-isos". Blank and repeated labels are dropped.
+func (t *Torrent) SetLabels(labels ...string) error {
+	t.userMutex.Lock()
+	defer t.userMutex.Unlock()
+	user := *t.userData()
+	user.Labels = nil
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label != "" && !seen[label] {
+			seen[label] = true
+			user.Labels = append(user.Labels, label)
+		}
+	}
+	return t.saveUserData(&user)
+}
+
+// UserData returns a copy of the key/value data attached to the torrent
+func (t *Torrent) UserData() map[string]string {
+	t.userMutex.Lock()
+	defer t.userMutex.Unlock()
+	data := make(map[string]string, len(t.userData().Data))
+	for key, value := range t.userData().Data {
+		data[key] = value
+	}
+	return data
+}
+
+// SetUserData attaches a value to the torrent under key, replacing any value
+// it had. An empty value removes the key.
+func (t *Torrent) SetUserData(key string, value string) error {
+	if key == "" {
+		return errors.New("Empty user data key")
+	}
+	t.userMutex.Lock()
+	defer t.userMutex.Unlock()
+	user := *t.userData()
+	user.Data = make(map[string]string, len(user.Data)+1)
+	for k, v := range t.userData().Data {
+		user.Data[k] = v
+	}
+	if value == "" {
+		delete(user.Data, key)
+	} else {
+		user.Data[key] = value
+	}
+	return t.saveUserData(&user)
+}
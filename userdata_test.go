@@ -0,0 +1,97 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Labels and user data are kept across restarts, limited in size, and the
+// torrents listed by the status server are filtered by label
+func TestUserData(t *testing.T) {
+	defer func(timeout time.Duration) { dumpTimeout = timeout }(dumpTimeout)
+	dumpTimeout = 10 * time.Millisecond
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	newTorrent := func(name string) *Torrent {
+		metaInfo := createTestMetaInfo(createTestPayload(2, 1024), 1024)
+		metaInfo.Info.Name = name
+		torrent, err := NewTorrent(writeTestTorrent(t, dir, metaInfo), make(chan struct{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrent.downloadDir = dir
+		return torrent
+	}
+
+	torrent := newTorrent("show")
+	if err := torrent.SetLabels("tv", " linux-isos ", "tv", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.SetUserData("category", "shows"); err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.SetUserData("notes", strings.Repeat("x", maxUserDataSize)); !errors.Is(err, ErrUserDataTooLarge) {
+		t.Errorf("Expected %v for too much user data, but got %v", ErrUserDataTooLarge, err)
+	}
+	labels, data := []string{"tv", "linux-isos"}, map[string]string{"category": "shows"}
+
+	// Restarted on the same directory
+	restarted := newTorrent("show")
+	if !reflect.DeepEqual(restarted.Labels(), labels) || !reflect.DeepEqual(restarted.UserData(), data) {
+		t.Errorf("Expected labels %v and user data %v after a restart, but got %v and %v", labels, data, restarted.Labels(), restarted.UserData())
+	}
+	other := newTorrent("distro")
+	if err := other.SetLabels("linux-isos"); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := NewStatusServer("localhost", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Add(restarted)
+	ss.Add(other)
+	go ss.Run()
+	defer ss.Stop()
+	for _, test := range []struct {
+		label    string
+		expected []string
+	}{
+		{"tv", []string{"show"}},
+		{"linux-isos", []string{"show", "distro"}},
+		{"", []string{"show", "distro"}},
+		{"movies", nil},
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status?label=%s", ss.Port, test.label))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status StatusResponse
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, torrent := range status.Torrents {
+			names = append(names, torrent.Name)
+			if torrent.Name == "show" && (!reflect.DeepEqual(torrent.Labels, labels) || !reflect.DeepEqual(torrent.UserData, data)) {
+				t.Errorf("Expected the status to have labels %v and user data %v, but got %+v", labels, data, torrent)
+			}
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Expected torrents %v with label %q, but got %v", test.expected, test.label, names)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verification modes
+const (
+	VerifyFull      = iota // hash every piece
+	VerifySpotCheck        // hash a sample of the pieces from peers that passed every sampled check
+	VerifyTrusted          // don't hash pieces from allowlisted peers
+)
+
+// VerificationPolicy decides which pieces received from peers are hash
+// checked. Anything other than full verification weakens the integrity
+// guarantees of the download, and is only meant for replicating known-good
+// data between trusted machines.
+//
+// With spot checking a peer's pieces are hashed until one passes, after that
+// only a random sample of them is. A peer that fails a sampled check loses
+// its trust for the rest of the session, and every piece it sent that wasn't
+// hashed is queued to be checked on disk. Peers are told apart by their IP
+// address, so reconnecting doesn't restore trust.
+//
+// A nil policy hashes every piece.
+type VerificationPolicy struct {
+	mode      int
+	percent   int             // with VerifySpotCheck, the share of pieces hashed
+	allowlist map[string]bool // with VerifyTrusted, peer IDs and IP addresses whose pieces aren't hashed
+	recheck   func(int)       // queues a piece on disk to be checked, set by the Torrent
+	mutex     sync.Mutex      // guards the fields below
+	peers     map[string]*peerTrust
+	rand      *rand.Rand
+	hashed    int
+	skipped   int
+}
+
+// peerTrust is the spot check history of a peer
+type peerTrust struct {
+	passed     int   // sampled pieces that passed their hash check
+	revoked    bool  // a sampled piece failed its hash check
+	unverified []int // pieces written without being hashed
+}
+
+// VerificationStats counts the pieces that were and weren't hash checked
+type VerificationStats struct {
+	Policy         string
+	HashedPieces   int
+	UnhashedPieces int
+	RevokedPeers   int
+}
+
+// FullVerification returns a policy that hashes every piece
+func FullVerification() *VerificationPolicy {
+	return newVerificationPolicy(VerifyFull)
+}
+
+// SpotCheckVerification returns a policy that hashes percent of the pieces
+// from peers that have passed every sampled check
+func SpotCheckVerification(percent int) *VerificationPolicy {
+	vp := newVerificationPolicy(VerifySpotCheck)
+	vp.percent = percent
+	return vp
+}
+
+// TrustedVerification returns a policy that doesn't hash pieces from peers
+// whose peer ID or IP address is in the allowlist
+func TrustedVerification(allowlist []string) *VerificationPolicy {
+	vp := newVerificationPolicy(VerifyTrusted)
+	for _, entry := range allowlist {
+		if ip := net.ParseIP(entry); ip != nil {
+			entry = ip.String()
+		}
+		vp.allowlist[entry] = true
+	}
+	return vp
+}
+
+func newVerificationPolicy(mode int) *VerificationPolicy {
+	return &VerificationPolicy{
+		mode:      mode,
+		allowlist: make(map[string]bool),
+		peers:     make(map[string]*peerTrust),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// ParseVerificationPolicy parses a policy given as "full", "spot-check:n"
+// where n is the percentage of pieces to hash, or "trusted:a,b" where a and
+// b are peer IDs or IP addresses
+func ParseVerificationPolicy(s string) (*VerificationPolicy, error) {
+	mode, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		mode, arg = s[:i], s[i+1:]
+	}
+	switch mode {
+	case "full":
+		if arg == "" {
+			return FullVerification(), nil
+		}
+	case "spot-check":
+		percent, err := strconv.Atoi(arg)
+		if err == nil && percent >= 0 && percent <= 100 {
+			return SpotCheckVerification(percent), nil
+		}
+	case "trusted":
+		if arg != "" {
+			return TrustedVerification(strings.Split(arg, ",")), nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid verification policy %q, expected full, spot-check:<percent> or trusted:<peer ID or IP>,...", s)
+}
+
+func (vp *VerificationPolicy) String() string {
+	if vp == nil {
+		return "full"
+	}
+	switch vp.mode {
+	case VerifySpotCheck:
+		return fmt.Sprintf("spot-check %d%%", vp.percent)
+	case VerifyTrusted:
+		return fmt.Sprintf("trusted (%d allowlisted)", len(vp.allowlist))
+	}
+	return "full"
+}
+
+// Weakened reports whether the policy lets pieces be written without being
+// hashed
+func (vp *VerificationPolicy) Weakened() bool {
+	return vp != nil && vp.mode != VerifyFull
+}
+
+// peerHost returns the IP address of a peer named host:port
+func peerHost(peerName string) string {
+	host, _, err := net.SplitHostPort(peerName)
+	if err != nil {
+		return peerName
+	}
+	return host
+}
+
+// shouldHash decides whether a piece received from a peer is hash checked
+func (vp *VerificationPolicy) shouldHash(peerName string, peerID []byte) bool {
+	if vp == nil {
+		return true
+	}
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	hash := true
+	switch vp.mode {
+	case VerifySpotCheck:
+		trust := vp.peers[peerHost(peerName)]
+		if trust != nil && trust.passed > 0 && !trust.revoked {
+			hash = vp.rand.Intn(100) < vp.percent
+		}
+	case VerifyTrusted:
+		hash = !vp.allowlisted(peerName, peerID)
+	}
+	if hash {
+		vp.hashed++
+	} else {
+		vp.skipped++
+	}
+	return hash
+}
+
+// allowlisted returns true if the pieces of a peer are never hashed
+func (vp *VerificationPolicy) allowlisted(peerName string, peerID []byte) bool {
+	return vp != nil && vp.mode == VerifyTrusted && (vp.allowlist[string(peerID)] || vp.allowlist[peerHost(peerName)])
+}
+
+// verify hash checks a piece received from a peer if the policy requires it,
+// and returns whether it was hashed and whether it's good
+func (vp *VerificationPolicy) verify(peerName string, peerID []byte, data []byte, expectedHash string) (hashed bool, good bool) {
+	return vp.verifySum(peerName, peerID, func() []byte {
+		sum := sha1.Sum(data)
+		return sum[:]
+	}, expectedHash)
+}
+
+// verifySum is verify for a piece whose hash is computed by sum, only called
+// if the piece is hash checked
+func (vp *VerificationPolicy) verifySum(peerName string, peerID []byte, sum func() []byte, expectedHash string) (hashed bool, good bool) {
+	if !vp.shouldHash(peerName, peerID) {
+		return false, true
+	}
+	good = string(sum()) == expectedHash
+	vp.checked(peerName, good)
+	return true, good
+}
+
+// checked records the result of hashing a piece from a peer. A failed check
+// revokes a spot checked peer's trust and queues the pieces it sent that
+// weren't hashed to be checked on disk.
+func (vp *VerificationPolicy) checked(peerName string, good bool) {
+	if vp == nil || vp.mode != VerifySpotCheck {
+		return
+	}
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	trust := vp.trust(peerName)
+	if good {
+		trust.passed++
+		return
+	}
+	if trust.revoked {
+		return
+	}
+	log.Printf("Verification : checked : %s failed a spot check, revoking its trust and rechecking %d unverified pieces", peerName, len(trust.unverified))
+	trust.revoked = true
+	for _, pieceNum := range trust.unverified {
+		vp.queueRecheck(pieceNum)
+	}
+	trust.unverified = nil
+}
+
+// recordUnverified records a piece from a peer that was written without being
+// hashed. It's checked right away if the peer has lost its trust since.
+func (vp *VerificationPolicy) recordUnverified(peerName string, pieceNum int) {
+	if vp == nil || vp.mode != VerifySpotCheck {
+		return
+	}
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+
+	trust := vp.trust(peerName)
+	if trust.revoked {
+		vp.queueRecheck(pieceNum)
+		return
+	}
+	trust.unverified = append(trust.unverified, pieceNum)
+}
+
+func (vp *VerificationPolicy) trust(peerName string) *peerTrust {
+	host := peerHost(peerName)
+	trust, ok := vp.peers[host]
+	if !ok {
+		trust = new(peerTrust)
+		vp.peers[host] = trust
+	}
+	return trust
+}
+
+func (vp *VerificationPolicy) queueRecheck(pieceNum int) {
+	if vp.recheck != nil {
+		vp.recheck(pieceNum)
+	}
+}
+
+// Stats returns the number of pieces hashed and not hashed so far
+func (vp *VerificationPolicy) Stats() VerificationStats {
+	if vp == nil {
+		return VerificationStats{Policy: "full"}
+	}
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	stats := VerificationStats{Policy: vp.String(), HashedPieces: vp.hashed, UnhashedPieces: vp.skipped}
+	for _, trust := range vp.peers {
+		if trust.revoked {
+			stats.RevokedPeers++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseVerificationPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{"full", "full"},
+		{"spot-check:5", "spot-check 5%"},
+		{"trusted:10.0.0.1,-TV0001-000000000000", "trusted (2 allowlisted)"},
+	}
+	for _, test := range tests {
+		vp, err := ParseVerificationPolicy(test.policy)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %s", test.policy, err)
+		} else if vp.String() != test.expected {
+			t.Errorf("Expected %s to parse as %s, but got %s", test.policy, test.expected, vp)
+		}
+	}
+	for _, policy := range []string{"", "none", "full:1", "spot-check", "spot-check:101", "trusted:"} {
+		_, err := ParseVerificationPolicy(policy)
+		if err == nil {
+			t.Errorf("Expected an error parsing %q", policy)
+		}
+	}
+}
+
+// Only pieces from allowlisted peers skip the hash check
+func TestTrustedVerification(t *testing.T) {
+	var trustedID [20]byte
+	copy(trustedID[:], "-TV0001-trustedpeer1")
+	vp := TrustedVerification([]string{"10.0.0.1", string(trustedID[:])})
+	tests := []struct {
+		peerName string
+		peerID   []byte
+		hash     bool
+	}{
+		{"10.0.0.1:6881", nil, false},
+		{"10.0.0.2:6881", trustedID[:], false},
+		{"10.0.0.2:6881", []byte("-XX0001-someotherpee"), true},
+	}
+	for _, test := range tests {
+		if hash := vp.shouldHash(test.peerName, test.peerID); hash != test.hash {
+			t.Errorf("Expected shouldHash(%s, %q) to be %t", test.peerName, test.peerID, test.hash)
+		}
+	}
+	if stats := vp.Stats(); stats.HashedPieces != 1 || stats.UnhashedPieces != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+// waitForPiece waits for the bitfield of DiskIO to show a piece as good or bad
+func waitForPiece(t *testing.T, diskio *DiskIO, pieceNum int, good bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		diskio.piecesMutex.RLock()
+		have := diskio.pieces[pieceNum]
+		diskio.piecesMutex.RUnlock()
+		if have == good {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for piece %d to be %t", pieceNum, good)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A peer that fails a spot check loses its trust, and the pieces it sent
+// that weren't hashed are checked on disk
+func TestSpotCheckRevocation(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	numPieces := 4
+	data := createTestPayload(numPieces, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	vp := SpotCheckVerification(0)
+	vp.recheck = diskio.queueRecheck
+	diskio.verification = vp
+	// Pieces written, and pieces lost when rechecked
+	diskio.statsCh = make(chan int, 2*numPieces)
+	diskio.contChans.receivedPiece = make(chan ReceivedPiece, numPieces)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	peerName := "10.0.0.1:6881"
+	piece := func(pieceNum int) []byte {
+		return data[pieceNum*pieceLength : (pieceNum+1)*pieceLength]
+	}
+	corrupt := make([]byte, pieceLength)
+	write := func(pieceNum int, pieceData []byte) {
+		hashed, good := vp.verify(peerName, nil, pieceData, PieceHashes(metaInfo.Info.Pieces).At(pieceNum))
+		if !good {
+			return
+		}
+		result := make(chan error, 1)
+		diskio.peerChans.writePiece <- Piece{index: pieceNum, data: pieceData, peerName: peerName, unverified: !hashed, result: result}
+		err := <-result
+		if err != nil {
+			t.Fatalf("Unexpected error writing piece %d: %s", pieceNum, err)
+		}
+	}
+
+	// The first piece is hashed, once it passes nothing else is
+	write(0, piece(0))
+	write(1, piece(1))
+	write(2, corrupt)
+	if stats := vp.Stats(); stats.HashedPieces != 1 || stats.UnhashedPieces != 2 {
+		t.Fatalf("Expected only the first piece to be hashed, but got %+v", stats)
+	}
+	waitForPiece(t, diskio, 2, true)
+
+	// A failed sampled check revokes trust, rechecking pieces 1 and 2
+	vp.checked(peerName, checkHash(corrupt, PieceHashes(metaInfo.Info.Pieces).At(3)))
+	waitForPiece(t, diskio, 2, false)
+	waitForPiece(t, diskio, 1, true)
+
+	// Everything from the peer is hashed from now on
+	if vp.shouldHash(peerName, nil) != true {
+		t.Errorf("Expected pieces from a revoked peer to be hashed")
+	}
+	if stats := vp.Stats(); stats.RevokedPeers != 1 {
+		t.Errorf("Expected %d revoked peer, but got %+v", 1, stats)
+	}
+
+	// A piece that was in flight when trust was revoked is checked once
+	// it's written
+	result := make(chan error, 1)
+	diskio.peerChans.writePiece <- Piece{index: 3, data: corrupt, peerName: peerName, unverified: true, result: result}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	waitForPiece(t, diskio, 3, false)
+}
+
+// benchmarkVerification measures the cost of verifying 1 MiB pieces received
+// from a single peer under a policy
+func benchmarkVerification(b *testing.B, vp *VerificationPolicy) {
+	data := createTestPayload(1, 1024*1024)
+	sum := sha1.Sum(data)
+	peerName := "10.0.0.1:6881"
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, good := vp.verify(peerName, nil, data, string(sum[:]))
+		if !good {
+			b.Fatal("Piece failed verification")
+		}
+	}
+}
+
+func BenchmarkVerificationFull(b *testing.B) {
+	benchmarkVerification(b, FullVerification())
+}
+
+func BenchmarkVerificationSpotCheck5(b *testing.B) {
+	benchmarkVerification(b, SpotCheckVerification(5))
+}
+
+func BenchmarkVerificationTrusted(b *testing.B) {
+	benchmarkVerification(b, TrustedVerification([]string{"10.0.0.1"}))
+}
@@ -0,0 +1,269 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Web seeds (BEP 19) are HTTP servers holding the files of the torrent,
+// listed under url-list in the metainfo. Pieces missing while few peers are
+// connected are fetched from them with range requests.
+
+// Missing pieces are fetched from web seeds while fewer peers than this are
+// connected
+var webSeedMinPeers = 5
+
+// Interval between checks of whether pieces should be fetched from web
+// seeds
+var webSeedInterval = 10 * time.Second
+
+// Time a web seed has to answer a range request in full
+var webSeedTimeout = time.Minute
+
+// A web seed is given up on after this many failed pieces in a row
+const maxWebSeedFailures = 3
+
+// errWebSeedHash is returned for a piece from a web seed that doesn't match
+// its hash
+var errWebSeedHash = errors.New("Piece from web seed failed its hash check")
+
+// parseURLList returns the web seeds of the url-list of a metainfo, which
+// may be a single URL or a list of them. Anything but an HTTP or HTTPS URL
+// is skipped.
+func parseURLList(value interface{}) []string {
+	var values []interface{}
+	switch v := value.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	var urls []string
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Printf("Parse : parseURLList : Skipping web seed %q", s)
+			continue
+		}
+		urls = append(urls, s)
+	}
+	return urls
+}
+
+// WebSeeder fetches missing pieces from the web seeds of a torrent and hands
+// them to DiskIO, like pieces received from peers. A piece being downloaded
+// from peers too may be fetched, the copy completed second is dropped as a
+// duplicate.
+type WebSeeder struct {
+	urls      []string
+	diskio    *DiskIO
+	client    *http.Client
+	numPeers  func() int     // number of connected peers
+	failures  map[string]int // failed pieces in a row, by web seed
+	lifecycle lifecycle
+	quit      chan struct{}
+}
+
+// NewWebSeeder returns a WebSeeder fetching the pieces of diskio from urls
+func NewWebSeeder(urls []string, diskio *DiskIO) *WebSeeder {
+	return &WebSeeder{
+		urls:     urls,
+		diskio:   diskio,
+		client:   &http.Client{Timeout: webSeedTimeout},
+		numPeers: func() int { return 0 },
+		failures: make(map[string]int),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Stop stops fetching pieces, and waits for Run to return
+func (ws *WebSeeder) Stop() error {
+	return ws.lifecycle.stop(func() { close(ws.quit) })
+}
+
+// Run fetches missing pieces from the web seeds every webSeedInterval, while
+// fewer than webSeedMinPeers peers are connected
+func (ws *WebSeeder) Run() {
+	if err := ws.lifecycle.start(); err != nil {
+		log.Printf("WebSeeder : Run : Not running: %s", err)
+		return
+	}
+	defer ws.lifecycle.finish()
+	log.Printf("WebSeeder : Run : Started with %d web seeds", len(ws.urls))
+	defer log.Println("WebSeeder : Run : Completed")
+
+	// Requests in flight are cancelled by Stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ws.quit
+		cancel()
+	}()
+
+	ticker := time.NewTicker(webSeedInterval)
+	defer ticker.Stop()
+	for {
+		ws.fetchMissing(ctx)
+		if len(ws.urls) == 0 {
+			log.Println("WebSeeder : Run : No web seeds left")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ws.quit:
+			return
+		}
+	}
+}
+
+// missingPieces returns the wanted pieces that aren't verified
+func (ws *WebSeeder) missingPieces() []int {
+	wanted := ws.diskio.wantedPieces()
+	var missing []int
+	for pieceNum, verified := range ws.diskio.verifiedPieces() {
+		if !verified && (wanted == nil || wanted[pieceNum]) {
+			missing = append(missing, pieceNum)
+		}
+	}
+	return missing
+}
+
+// fetchMissing fetches missing pieces, taking turns between the web seeds,
+// until none are missing, enough peers are connected or every web seed has
+// been given up on
+func (ws *WebSeeder) fetchMissing(ctx context.Context) {
+	next := 0
+	for _, pieceNum := range ws.missingPieces() {
+		if len(ws.urls) == 0 || ws.numPeers() >= webSeedMinPeers {
+			return
+		}
+		select {
+		case <-ws.quit:
+			return
+		default:
+		}
+		next %= len(ws.urls)
+		base := ws.urls[next]
+		err := ws.fetchPiece(ctx, base, pieceNum)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("WebSeeder : fetchMissing : Piece %x from %s failed: %s", pieceNum, base, err)
+			ws.failures[base]++
+			if ws.failures[base] >= maxWebSeedFailures {
+				log.Printf("WebSeeder : fetchMissing : Giving up on %s after %d failed pieces", base, ws.failures[base])
+				ws.urls = append(ws.urls[:next], ws.urls[next+1:]...)
+				continue
+			}
+		} else {
+			ws.failures[base] = 0
+		}
+		next++
+	}
+}
+
+// fileURL returns the URL of a file of the torrent on a web seed. The URL of
+// a single file torrent is the file itself, unless it ends with a slash, in
+// which case the name of the torrent is appended. Files of a multiple file
+// torrent are under the directory named after the torrent.
+func (ws *WebSeeder) fileURL(base string, fileIndex int) string {
+	info := ws.diskio.metaInfo.Info
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(info.Name)
+		}
+		return base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	elements := []string{url.PathEscape(info.Name)}
+	for _, element := range info.Files[fileIndex].Path {
+		elements = append(elements, url.PathEscape(element))
+	}
+	return base + strings.Join(elements, "/")
+}
+
+// fetchPiece fetches a piece from a web seed, a range of each file it
+// overlaps, and has DiskIO complete it once it matches its hash
+func (ws *WebSeeder) fetchPiece(ctx context.Context, base string, pieceNum int) error {
+	diskio := ws.diskio
+	data := make([]byte, diskio.pieceLength(pieceNum))
+	offset := int64(pieceNum) * int64(diskio.metaInfo.Info.PieceLength)
+	start := 0
+	for _, region := range diskio.mapRegion(offset, len(data)) {
+		err := ws.fetchRange(ctx, ws.fileURL(base, region.fileIndex), region.offset, data[start:start+region.length])
+		if err != nil {
+			return err
+		}
+		start += region.length
+	}
+	if !checkHash(data, diskio.pieceHashes.At(pieceNum)) {
+		return errWebSeedHash
+	}
+
+	piece := Piece{index: pieceNum, data: data, peerName: base, result: make(chan error, 1)}
+	select {
+	case diskio.peerChans.writePiece <- piece:
+	case <-diskio.dying:
+		return diskio.Err()
+	case <-ws.quit:
+		return nil
+	}
+	select {
+	case err := <-piece.result:
+		if errors.Is(err, errPieceDuplicate) {
+			// Received from a peer meanwhile
+			return nil
+		}
+		if err == nil {
+			log.Printf("WebSeeder : fetchPiece : Fetched piece %x from %s", pieceNum, base)
+		}
+		return err
+	case <-ws.quit:
+		return nil
+	}
+}
+
+// fetchRange fills buf with the bytes of the file at fileURL starting at
+// offset
+func (ws *WebSeeder) fetchRange(ctx context.Context, fileURL string, offset int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		// The range was ignored, the file starts with it
+	default:
+		return fmt.Errorf("%s answered %s for bytes %d-%d", fileURL, resp.Status, offset, offset+int64(len(buf))-1)
+	}
+	_, err = io.ReadFull(resp.Body, buf)
+	if err != nil {
+		return fmt.Errorf("%s sent a short range: %w", fileURL, err)
+	}
+	return nil
+}
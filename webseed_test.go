@@ -0,0 +1,181 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestParseURLList(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected []string
+	}{
+		{nil, nil},
+		{"http://example.com/files/", []string{"http://example.com/files/"}},
+		{[]interface{}{"https://a.example.com/payload", int64(3), "ftp://b.example.com/", "http://c.example.com/"}, []string{"https://a.example.com/payload", "http://c.example.com/"}},
+		{"not a url", nil},
+	}
+	for _, test := range tests {
+		urls := parseURLList(test.value)
+		if len(urls) != len(test.expected) {
+			t.Errorf("Expected %v for %v, but got %v", test.expected, test.value, urls)
+			continue
+		}
+		for i := range urls {
+			if urls[i] != test.expected[i] {
+				t.Errorf("Expected %v for %v, but got %v", test.expected, test.value, urls)
+				break
+			}
+		}
+	}
+}
+
+// The files of a torrent are found on a web seed as BEP 19 lays out
+func TestWebSeedFileURL(t *testing.T) {
+	data := createTestPayload(2, 1024)
+	metaInfo := createTestMetaInfo(data, 1024)
+	ws := NewWebSeeder(nil, NewDiskIO(metaInfo, "."))
+	for base, expected := range map[string]string{
+		"http://example.com/payload.bin": "http://example.com/payload.bin",
+		"http://example.com/files/":      "http://example.com/files/payload",
+	} {
+		if u := ws.fileURL(base, 0); u != expected {
+			t.Errorf("Expected %s for a single file on %s, but got %s", expected, base, u)
+		}
+	}
+
+	setTestFiles(&metaInfo, "my payload", []string{"a", "b c"}, []int{1024, 1024})
+	ws = NewWebSeeder(nil, NewDiskIO(metaInfo, "."))
+	for _, base := range []string{"http://example.com/files", "http://example.com/files/"} {
+		if u, expected := ws.fileURL(base, 1), "http://example.com/files/my%20payload/b%20c"; u != expected {
+			t.Errorf("Expected %s for the second file on %s, but got %s", expected, base, u)
+		}
+	}
+}
+
+// startWebSeed serves the files under dir with range requests, recording
+// the Range header of each request
+func startWebSeed(dir string) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	var ranges []string
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mutex.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+// Missing pieces of a multiple file torrent, some straddling two files, are
+// fetched from a web seed with range requests, verified and written. A web
+// seed serving bad data is given up on and nothing it sent is written.
+func TestWebSeedFetch(t *testing.T) {
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	metaInfo := createTestMetaInfo(data, pieceLength)
+	setTestFiles(&metaInfo, "payload", []string{"a", "b"}, []int{1500, len(data) - 1500})
+
+	seedDir := createTempDir(t)
+	defer os.RemoveAll(seedDir)
+	os.Mkdir(filepath.Join(seedDir, "payload"), 0755)
+	ioutil.WriteFile(filepath.Join(seedDir, "payload", "a"), data[:1500], 0644)
+	corrupt := append([]byte(nil), data[1500:]...)
+	for _, i := range []int{0, 600, 1600} {
+		// A byte of each piece overlapping the file
+		corrupt[i] ^= 0xff
+	}
+	ioutil.WriteFile(filepath.Join(seedDir, "payload", "b"), corrupt, 0644)
+	badServer, _ := startWebSeed(seedDir)
+	defer badServer.Close()
+
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	diskio := createTestDiskIO(t, dir, metaInfo)
+	defer closeTestDiskIO(diskio)
+	go diskio.Run()
+	defer diskio.Stop()
+
+	ws := NewWebSeeder([]string{badServer.URL}, diskio)
+	ws.fetchMissing(context.Background())
+	if len(ws.urls) != 0 {
+		t.Errorf("Expected the web seed serving bad data to be given up on, but got %v", ws.urls)
+	}
+	for pieceNum, verified := range diskio.verifiedPieces() {
+		// Only the first piece is entirely within the good file
+		if verified != (pieceNum == 0) {
+			t.Errorf("Expected piece %d to be verified %t from the bad web seed", pieceNum, pieceNum == 0)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(seedDir, "payload", "b"), data[1500:], 0644)
+	server, ranges := startWebSeed(seedDir)
+	defer server.Close()
+	ws = NewWebSeeder([]string{server.URL + "/"}, diskio)
+	ws.fetchMissing(context.Background())
+	for pieceNum, verified := range diskio.verifiedPieces() {
+		if !verified {
+			t.Errorf("Expected piece %d to be fetched from the web seed", pieceNum)
+		}
+	}
+	// Piece 1 straddles both files
+	expected := []string{"bytes=1024-1499", "bytes=0-547", "bytes=548-1571", "bytes=1572-2595"}
+	if got := ranges(); len(got) != len(expected) {
+		t.Errorf("Expected the ranges %v to be requested, but got %v", expected, got)
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("Expected the ranges %v to be requested, but got %v", expected, got)
+				break
+			}
+		}
+	}
+
+	if err := diskio.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	var onDisk []byte
+	for _, name := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "payload", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		onDisk = append(onDisk, b...)
+	}
+	if !bytes.Equal(onDisk, data) {
+		t.Errorf("Data on disk doesn't match what the web seed served")
+	}
+}
+
+// Nothing is fetched from web seeds while enough peers are connected
+func TestWebSeedEnoughPeers(t *testing.T) {
+	data := createTestPayload(2, 1024)
+	metaInfo := createTestMetaInfo(data, 1024)
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	server, ranges := startWebSeed(dir)
+	defer server.Close()
+	ws := NewWebSeeder([]string{server.URL + "/"}, NewDiskIO(metaInfo, "."))
+	ws.diskio.pieces = make([]bool, 2)
+	ws.numPeers = func() int { return webSeedMinPeers }
+	ws.fetchMissing(context.Background())
+	if got := ranges(); len(got) != 0 {
+		t.Errorf("Expected nothing to be fetched, but got requests for %v", got)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+)
+
+// Maximum number of pieces a peer works on at once once the write guard has
+// tightened behaviour
+const tightenedDownloadsPerPeer = 1
+
+// Copies of a piece received without two of them matching, after which the
+// piece is hash checked rather than waiting for a match that may never come
+const maxUnconfirmedCopies = 3
+
+var (
+	errPieceDuplicate       = errors.New("Piece is already on disk")
+	errPieceNotCorroborated = errors.New("Piece is waiting to be corroborated by another peer")
+)
+
+// WriteStats counts the bytes written to disk. Pieces are hash checked before
+// they're written, so a piece that fails its hash check is counted but never
+// written. Extra bytes are those written beyond one write per verified byte,
+// such as duplicate pieces in endgame or pieces rewritten after a recheck
+// found them corrupt.
+type WriteStats struct {
+	PayloadBytes    int64 // bytes of verified pieces, each counted once
+	WrittenBytes    int64 // all bytes written
+	ExtraBytes      int64 // bytes written beyond the payload
+	DuplicatePieces int   // pieces received that were already on disk
+	FailedPieces    int   // pieces that failed their hash check
+	FailedBytes     int64 // bytes of the pieces that failed their hash check
+}
+
+func (ws *WriteStats) add(other WriteStats) {
+	ws.PayloadBytes += other.PayloadBytes
+	ws.WrittenBytes += other.WrittenBytes
+	ws.ExtraBytes += other.ExtraBytes
+	ws.DuplicatePieces += other.DuplicatePieces
+	ws.FailedPieces += other.FailedPieces
+	ws.FailedBytes += other.FailedBytes
+}
+
+// Write stats summed over every torrent in this session
+var sessionWriteStats struct {
+	sync.Mutex
+	WriteStats
+}
+
+// SessionWriteStats returns the write stats summed over every torrent
+func SessionWriteStats() WriteStats {
+	sessionWriteStats.Lock()
+	defer sessionWriteStats.Unlock()
+	return sessionWriteStats.WriteStats
+}
+
+// WriteStats returns the write stats of this torrent
+func (diskio *DiskIO) WriteStats() WriteStats {
+	diskio.writeStatsMutex.Lock()
+	defer diskio.writeStatsMutex.Unlock()
+	return diskio.writeStats
+}
+
+// countWrite updates the torrent and session write stats
+func (diskio *DiskIO) countWrite(delta WriteStats) {
+	diskio.writeStatsMutex.Lock()
+	diskio.writeStats.add(delta)
+	diskio.writeStatsMutex.Unlock()
+
+	sessionWriteStats.Lock()
+	sessionWriteStats.add(delta)
+	sessionWriteStats.Unlock()
+}
+
+// countPieceWrite counts a piece about to be written. A piece that's already
+// on disk, or was written earlier in this session, is an extra write.
+func (diskio *DiskIO) countPieceWrite(piece Piece) {
+	if diskio.written == nil {
+		diskio.written = make([]bool, len(diskio.pieces))
+	}
+	length := int64(len(piece.data))
+	delta := WriteStats{WrittenBytes: length}
+	if diskio.pieces[piece.index] || diskio.written[piece.index] {
+		delta.ExtraBytes = length
+		if diskio.pieces[piece.index] {
+			delta.DuplicatePieces = 1
+		}
+	} else {
+		delta.PayloadBytes = length
+	}
+	diskio.written[piece.index] = true
+	diskio.countWrite(delta)
+}
+
+// checkWriteGuard tightens behaviour once the extra bytes written exceed
+// maxWriteAmplification times the size of the torrent. The guard is disabled
+// when maxWriteAmplification is zero.
+func (diskio *DiskIO) checkWriteGuard() {
+	if diskio.maxWriteAmplification <= 0 || diskio.tightened {
+		return
+	}
+	limit := int64(diskio.maxWriteAmplification * float64(diskio.totalLength()))
+	extra := diskio.WriteStats().ExtraBytes
+	if extra <= limit {
+		return
+	}
+	log.Printf("DiskIO : checkWriteGuard : ALERT: %d extra bytes written exceeds the limit of %d, tightening", extra, limit)
+	diskio.tightened = true
+	close(diskio.contChans.tighten)
+}
+
+// corroborate rejects pieces that are already on disk, and holds a piece that
+// wasn't hash checked until an identical copy has been received from a
+// different peer. A hash checked piece is proven already, a second copy could
+// only ever match it. If maxUnconfirmedCopies copies are received without two
+// matching, such as when no other peer has the piece, the piece is hash
+// checked instead. It's only used once the write guard has tightened
+// behaviour.
+func (diskio *DiskIO) corroborate(piece Piece) error {
+	if diskio.pieces[piece.index] {
+		diskio.countWrite(WriteStats{DuplicatePieces: 1})
+		return errPieceDuplicate
+	}
+	if !piece.unverified {
+		return nil
+	}
+	if diskio.unconfirmed == nil {
+		diskio.unconfirmed = make(map[int]Piece)
+		diskio.unconfirmedCopies = make(map[int]int)
+	}
+	pending, ok := diskio.unconfirmed[piece.index]
+	if ok && pending.peerName != piece.peerName && bytes.Equal(pending.data, piece.data) {
+		delete(diskio.unconfirmed, piece.index)
+		delete(diskio.unconfirmedCopies, piece.index)
+		return nil
+	}
+	if ok && pending.peerName != piece.peerName {
+		log.Printf("DiskIO : corroborate : Piece %x from %s doesn't match the copy from %s", piece.index, piece.peerName, pending.peerName)
+	}
+	err := errPieceNotCorroborated
+	diskio.unconfirmedCopies[piece.index]++
+	if diskio.unconfirmedCopies[piece.index] >= maxUnconfirmedCopies {
+		log.Printf("DiskIO : corroborate : No match after %d copies of piece %x, hash checking the copy from %s", diskio.unconfirmedCopies[piece.index], piece.index, piece.peerName)
+		if diskio.checkHash(piece.data, piece.index) {
+			delete(diskio.unconfirmed, piece.index)
+			delete(diskio.unconfirmedCopies, piece.index)
+			return nil
+		}
+		diskio.countWrite(WriteStats{FailedPieces: 1, FailedBytes: int64(len(piece.data))})
+		err = errPieceHashMismatch
+	} else {
+		diskio.unconfirmed[piece.index] = piece
+	}
+	// Have the Controller request the piece again, from another peer if
+	// possible
+	go func() {
+		select {
+		case diskio.contChans.unconfirmedPiece <- ReceivedPiece{pieceNum: piece.index, peerName: piece.peerName}:
+		case <-diskio.quit:
+		}
+	}()
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func assertWriteStats(t *testing.T, diskio *DiskIO, expected WriteStats) {
+	if stats := diskio.WriteStats(); stats != expected {
+		t.Errorf("Expected write stats %+v, but they were %+v", expected, stats)
+	}
+}
+
+// A poisoning peer sends a corrupt piece and then duplicates of pieces that
+// are already on disk. Once the extra writes exceed the limit the write guard
+// trips, and pieces are only written once they've been corroborated by a
+// second peer.
+func TestWriteGuard(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(4, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+	diskio.maxWriteAmplification = 0.25
+	diskio.contChans.unconfirmedPiece = make(chan ReceivedPiece, 10)
+	session := SessionWriteStats()
+
+	piece := func(pieceNum int, peerName string) Piece {
+		return Piece{index: pieceNum, data: data[pieceNum*pieceLength : (pieceNum+1)*pieceLength], peerName: peerName}
+	}
+
+	// A corrupt piece is counted but not written
+	if err := diskio.completePiece(Piece{index: 0, data: data[pieceLength : 2*pieceLength], peerName: "evil"}); err == nil {
+		t.Fatalf("Expected a corrupt piece to be rejected")
+	}
+	diskio.completePiece(piece(0, "good"))
+	assertWriteStats(t, diskio, WriteStats{PayloadBytes: 1024, WrittenBytes: 1024, FailedPieces: 1, FailedBytes: 1024})
+
+	// Duplicates are written until the limit of 1024 extra bytes is exceeded
+	diskio.completePiece(piece(0, "evil"))
+	assertWriteStats(t, diskio, WriteStats{PayloadBytes: 1024, WrittenBytes: 2048, ExtraBytes: 1024, DuplicatePieces: 1, FailedPieces: 1, FailedBytes: 1024})
+	if diskio.tightened {
+		t.Errorf("Expected the write guard not to trip at the limit")
+	}
+	diskio.completePiece(piece(0, "evil"))
+	if !diskio.tightened {
+		t.Fatalf("Expected the write guard to trip once the limit was exceeded")
+	}
+	select {
+	case <-diskio.contChans.tighten:
+	default:
+		t.Errorf("Expected the Controller to be told to tighten")
+	}
+
+	// Duplicates are no longer written
+	if err := diskio.completePiece(piece(0, "evil")); err == nil {
+		t.Errorf("Expected a duplicate piece to be rejected")
+	}
+	assertWriteStats(t, diskio, WriteStats{PayloadBytes: 1024, WrittenBytes: 3072, ExtraBytes: 2048, DuplicatePieces: 3, FailedPieces: 1, FailedBytes: 1024})
+
+	// A piece that wasn't hash checked is held until a second peer sends a
+	// matching copy
+	unverified := func(pieceNum int, peerName string, pieceData []byte) Piece {
+		return Piece{index: pieceNum, data: pieceData, peerName: peerName, unverified: true}
+	}
+	for _, peerName := range []string{"peer1", "peer1"} {
+		if err := diskio.completePiece(unverified(1, peerName, data[pieceLength:2*pieceLength])); err == nil {
+			t.Errorf("Expected piece %d from %s to wait for corroboration", 1, peerName)
+		}
+		if unconfirmed := <-diskio.contChans.unconfirmedPiece; unconfirmed.pieceNum != 1 || unconfirmed.peerName != peerName {
+			t.Errorf("Unexpected notification of unconfirmed piece %v", unconfirmed)
+		}
+	}
+	if diskio.pieces[1] {
+		t.Errorf("Expected piece %d not to be recorded before it's corroborated", 1)
+	}
+	if err := diskio.completePiece(unverified(1, "peer2", data[pieceLength:2*pieceLength])); err != nil {
+		t.Fatal(err)
+	}
+	if !diskio.pieces[1] {
+		t.Errorf("Expected piece %d to be recorded once it was corroborated", 1)
+	}
+
+	// A hash checked piece doesn't need a second copy
+	if err := diskio.completePiece(piece(2, "peer1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A piece sent by a single peer is hash checked once enough copies
+	// were received without a match, rather than held forever
+	for i := 1; i <= maxUnconfirmedCopies; i++ {
+		err := diskio.completePiece(unverified(3, "evil", data[:pieceLength]))
+		if i < maxUnconfirmedCopies && !errors.Is(err, errPieceNotCorroborated) {
+			t.Errorf("Expected copy %d of piece %d to wait for corroboration, but got %v", i, 3, err)
+		} else if i == maxUnconfirmedCopies && !errors.Is(err, errPieceHashMismatch) {
+			t.Errorf("Expected copy %d of piece %d to fail its hash check, but got %v", i, 3, err)
+		}
+		<-diskio.contChans.unconfirmedPiece
+	}
+	if err := diskio.completePiece(unverified(3, "peer1", data[3*pieceLength:])); err != nil {
+		t.Fatal(err)
+	}
+	if !diskio.pieces[3] {
+		t.Errorf("Expected piece %d to be recorded once a copy passed its hash check", 3)
+	}
+	assertWriteStats(t, diskio, WriteStats{PayloadBytes: 4096, WrittenBytes: 6144, ExtraBytes: 2048, DuplicatePieces: 3, FailedPieces: 2, FailedBytes: 2048})
+
+	expected := session
+	expected.add(diskio.WriteStats())
+	if stats := SessionWriteStats(); stats != expected {
+		t.Errorf("Expected session write stats %+v, but they were %+v", expected, stats)
+	}
+}
+
+// The write guard is off by default
+func TestWriteGuardDisabled(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	pieceLength := 1024
+	data := createTestPayload(1, pieceLength)
+	diskio := createTestDiskIO(t, dir, createTestMetaInfo(data, pieceLength))
+	defer closeTestDiskIO(diskio)
+
+	for i := 0; i < 10; i++ {
+		diskio.completePiece(Piece{index: 0, data: data})
+	}
+	if diskio.tightened {
+		t.Errorf("Expected the write guard to be disabled by default")
+	}
+	assertWriteStats(t, diskio, WriteStats{PayloadBytes: 1024, WrittenBytes: 10240, ExtraBytes: 9216, DuplicatePieces: 9})
+}